@@ -2,50 +2,94 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"../shared"
 	"../util"
+	"../util/retry"
 )
 
 const LocalHostAddress = "127.0.0.1"
 const PollingTime = 100
+const PollingLimit = 100                               // messages per poll
+const MaxInFlightMessages = shared.MaxInFlightMessages // sends awaiting an end-to-end ack before Send blocks
 
 type ChatClient struct {
-	Name   string
-	Reader *bufio.Reader
-	Proxy  *rpc.Client
+	Name      string
+	Reader    *bufio.Reader
+	Proxy     *rpc.Client
+	inFlight  chan struct{} // one token per unacknowledged message
+	Channel   string        // messages are sent here, shared.DefaultChannel if empty
+	proxyAddr string
+	session   string // token to resume the proxy session with after reconnecting
+
+	profile    string // the proxy profile connected with, "" connects as Name
+	passphrase string // the profile's, kept to connect it again after a proxy restart
+
+	proxyMutex sync.Mutex // guards Proxy, replaced when reconnecting
+
+	sendMutex sync.Mutex  // held while numbering a send and writing it to the proxy
+	sendSeq   uint64      // SendSeq of the last send, so the proxy publishes them in order
+	seqProxy  *rpc.Client // the connection sendSeq counts on, sends are counted from 1 on each
+
+	joined  []string // channels joined, in the order they were
+	history []string // lines typed, oldest first
 }
 
+// go run chat_client.go [-output text|json|quiet] [-proxy port] [-name username] [-profile name]
 func main() {
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
+	proxyPort := flag.String("proxy", "", "port of the onion proxy, asked for if not given")
+	username := flag.String("name", "", "username to connect with, asked for if not given")
+	profile := flag.String("profile", "", "connect with this identity profile of the proxy instead of a username, creating it if missing")
+	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentChatClient, *showFeatures))
+		return
+	}
+
 	reader := bufio.NewReader(os.Stdin)
-	fmt.Printf("What is your username? ")
-	username := readInputLine(reader)
-	fmt.Printf("Hello, %s.\n", username)
+	if *username == "" && *profile == "" {
+		util.PrintStatus("What is your username? ")
+		*username = readInputLine(reader)
+	}
 
 	client := ChatClient{
-		username,
-		reader,
-		nil,
+		Name:     *username,
+		Reader:   reader,
+		inFlight: make(chan struct{}, MaxInFlightMessages),
+		profile:  *profile,
 	}
 
-	client.connectToProxy()
+	client.connectToProxy(*proxyPort)
 
 	go client.pollForNewMessages()
 	client.getMessageInput()
 }
 
-func (client *ChatClient) connectToProxy() {
+func (client *ChatClient) connectToProxy(proxyPort string) {
 	// Prompt for and verify proxy port number
-	// TODO - could just hardcode this seeing as we're hardcoding everything else
-	fmt.Print("Proxy port: ")
-	proxyPort := readInputLine(client.Reader)
+	if proxyPort == "" {
+		util.PrintStatus("Proxy port: ")
+		proxyPort = readInputLine(client.Reader)
+	}
 	proxyPort = strings.TrimSpace(proxyPort)
 
 	if !isValidPortNum(proxyPort) {
@@ -61,45 +105,576 @@ func (client *ChatClient) connectToProxy() {
 
 	go client.startClientListen(proxyListener)
 
-	proxyAddr := LocalHostAddress + ":" + proxyPort
-	proxy, err := rpc.Dial("tcp", proxyAddr)
+	client.proxyAddr = net.JoinHostPort(LocalHostAddress, proxyPort)
+	proxy, err := retry.DialRPC(context.Background(), retry.Startup, "tcp", client.proxyAddr)
 	util.HandleFatalError("Could not dial proxy", err)
 	client.Proxy = proxy
 
-	var _ignored bool
-	err = client.Proxy.Call("OPServer.Connect", client.Name, &_ignored)
+	if client.profile != "" {
+		client.openProfile()
+	}
+	err = client.connectSession(proxy)
+	if err != nil {
+		var receipt shared.CircuitBuildReceipt
+		if client.call("OPServer.GetLastBuildReceipt", true, &receipt) == nil {
+			util.ErrLog.Println(receipt)
+		}
+	}
 	util.HandleFatalError("Could not connect to proxy", err)
+	util.HandleFatalError("Could not get session token", client.call("OPServer.GetSessionToken", true, &client.session))
 
-	fmt.Println("Client to Proxy connection established")
-	fmt.Println("WELCOME TO TORCHAT!")
+	util.PrintStatus("Hello, %s.\n", client.Name)
+	util.PrintStatus("Client to Proxy connection established\n")
+	util.PrintStatus("WELCOME TO TORCHAT! /help lists the commands\n")
 }
 
-func (client *ChatClient) getMessageInput() {
-	for {
-		msg := readInputLine(client.Reader)
+// Asks for the passphrase of client.profile, creating the profile on the proxy
+// first if it has none by that name
+func (client *ChatClient) openProfile() {
+	util.PrintStatus("Passphrase for profile %s: ", client.profile)
+	client.passphrase = readInputLine(client.Reader)
+
+	var names []string
+	util.HandleFatalError("Could not list profiles", client.call("OPServer.ListProfiles", true, &names))
+	for _, name := range names {
+		if name == client.profile {
+			return
+		}
+	}
 
+	if client.Name == "" {
+		util.PrintStatus("There is no profile %s yet. What is its username? ", client.profile)
+		client.Name = readInputLine(client.Reader)
+	}
+	req := shared.ProfileRequest{Name: client.profile, Username: client.Name, Passphrase: client.passphrase}
+	var _ignored bool
+	util.HandleFatalError("Could not create profile", client.call("OPServer.CreateProfile", req, &_ignored))
+	util.PrintStatus("Created profile %s\n", client.profile)
+}
+
+// Connects the session on proxy as client.Name, or with client.profile,
+// which sets client.Name to the profile's username
+func (client *ChatClient) connectSession(proxy *rpc.Client) error {
+	if client.profile == "" {
 		var _ignored bool
-		if err := client.Proxy.Call("OPServer.SendMessage", msg, &_ignored); err != nil {
-			util.HandleNonFatalError("Could not send message, please try again!", err)
+		return proxy.Call("OPServer.Connect", client.Name, &_ignored)
+	}
+	req := shared.ProfileRequest{Name: client.profile, Passphrase: client.passphrase}
+	return proxy.Call("OPServer.ConnectProfile", req, &client.Name)
+}
+
+// The current connection to the proxy
+func (client *ChatClient) proxy() *rpc.Client {
+	client.proxyMutex.Lock()
+	defer client.proxyMutex.Unlock()
+
+	return client.Proxy
+}
+
+func (client *ChatClient) call(method string, args interface{}, reply interface{}) error {
+	return client.proxy().Call(method, args, reply)
+}
+
+// Whether err says the connection to the proxy is gone, rather than that the
+// proxy refused a call
+func proxyLost(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
+}
+
+// Replaces the broken connection to the proxy with a new one bound to the
+// same session, so polling goes on where it stopped. A proxy that restarted
+// without keeping its sessions gets the username or profile connected again. Does
+// nothing if broken was replaced already.
+func (client *ChatClient) reconnect(broken *rpc.Client) error {
+	client.proxyMutex.Lock()
+	defer client.proxyMutex.Unlock()
+
+	if client.Proxy != broken {
+		return nil
+	}
+	proxy, err := retry.DialRPC(context.Background(), retry.Startup, "tcp", client.proxyAddr)
+	if err != nil {
+		return err
+	}
+
+	var _ignored bool
+	if err = proxy.Call("OPServer.ResumeSession", client.session, &_ignored); err != nil {
+		if err = client.connectSession(proxy); err == nil {
+			err = proxy.Call("OPServer.GetSessionToken", true, &client.session)
+		}
+	}
+	if err != nil {
+		proxy.Close()
+		return err
+	}
+
+	broken.Close()
+	client.Proxy = proxy
+	return nil
+}
+
+func (client *ChatClient) changeUsername(newUsername string) {
+	var _ignored bool
+	if err := client.call("OPServer.ChangeUsername", newUsername, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not change username: " + err.Error()})
+		return
+	}
+	client.Name = newUsername
+}
+
+// Handles "/profiles"
+func (client *ChatClient) showProfiles(string) {
+	var names []string
+	if err := client.call("OPServer.ListProfiles", true, &names); err != nil {
+		displayMessages([]string{"*** Could not list profiles: " + err.Error()})
+		return
+	}
+	if len(names) == 0 {
+		displayMessages([]string{"*** The proxy has no profiles yet"})
+		return
+	}
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		marker := " "
+		if name == client.profile {
+			marker = "*"
+		}
+		lines = append(lines, "*** "+marker+" "+name)
+	}
+	displayMessages(lines)
+}
+
+// Handles "/forget yes": deletes the user and everything the chat servers
+// keep about them. Without "yes" it only explains what would happen.
+func (client *ChatClient) forget(confirm string) {
+	if confirm != "yes" {
+		displayMessages([]string{"*** /forget yes deletes " + client.Name + " and all its messages and direct messages from the chat servers. This can't be undone."})
+		return
+	}
+
+	var _ignored bool
+	if err := client.call("OPServer.ForgetUser", true, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not forget user: " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** " + client.Name + " was forgotten. Restart the client to chat again."})
+}
+
+// Handles "/read [#channel]"
+func (client *ChatClient) markRead(channel string) {
+	var _ignored bool
+	if err := client.call("OPServer.MarkRead", channel, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not mark messages read: " + err.Error()})
+	}
+}
+
+func (client *ChatClient) showUnreadCounts(string) {
+	var counts map[string]int
+	if err := client.call("OPServer.GetUnreadCounts", true, &counts); err != nil {
+		displayMessages([]string{"*** Could not get unread counts: " + err.Error()})
+		return
+	}
+
+	channels := make([]string, 0, len(counts))
+	for channel := range counts {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	lines := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		lines = append(lines, fmt.Sprintf("*** %s: %d unread", channel, counts[channel]))
+	}
+	displayMessages(lines)
+}
+
+// Handles "/export <#channel|dms> <file> [hours]": saves the channel, or the
+// user's direct messages, from the last hours (everything kept if not given)
+// to file as NDJSON, one chunk at a time
+func (client *ChatClient) export(args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 {
+		displayMessages([]string{"*** Usage: /export <#channel|dms> <file> [hours]"})
+		return
+	}
+
+	req := shared.ExportRequest{Format: shared.ExportNDJSON}
+	if fields[0] == "dms" {
+		req.DirectMessages = true
+	} else {
+		req.Channel = fields[0]
+	}
+	if len(fields) == 3 {
+		hours, err := strconv.Atoi(fields[2])
+		if err != nil || hours <= 0 {
+			displayMessages([]string{"*** Usage: /export <#channel|dms> <file> [hours]"})
+			return
+		}
+		req.Since = time.Now().Add(-time.Duration(hours) * time.Hour)
+	}
+
+	file, err := os.Create(fields[1])
+	if err != nil {
+		displayMessages([]string{"*** Could not create export file: " + err.Error()})
+		return
+	}
+	defer file.Close()
+
+	total := 0
+	for {
+		var chunk shared.ExportChunk
+		if err = client.call("OPServer.ExportLog", req, &chunk); err != nil {
+			displayMessages([]string{"*** Export failed: " + err.Error()})
+			return
+		}
+		if _, err = file.Write(chunk.Data); err != nil {
+			displayMessages([]string{"*** Could not write export file: " + err.Error()})
+			return
+		}
+		total += len(chunk.Data)
+		if chunk.Done {
+			break
+		}
+		req.Cursor = chunk.NextCursor
+	}
+	displayMessages([]string{fmt.Sprintf("*** Exported %s to %s (%d bytes)", fields[0], fields[1], total)})
+}
+
+func (client *ChatClient) showChatServers(string) {
+	var servers []shared.ChatServerInfo
+	if err := client.call("OPServer.ListChatServers", true, &servers); err != nil {
+		displayMessages([]string{"*** Could not list chat servers: " + err.Error()})
+		return
+	}
+
+	lines := []string{"*** Chat servers channels can be homed on:"}
+	for _, server := range servers {
+		lines = append(lines, fmt.Sprintf("***   %s (%s)", server.Name, server.Address))
+	}
+	displayMessages(lines)
+}
+
+// Handles "/circuit [purpose|all]": shows the path of the data circuit, or
+// of the circuits for purpose
+func (client *ChatClient) showCircuits(purpose string) {
+	var statuses []shared.CircuitStatus
+	if err := client.call("OPServer.GetCircuitStatus", purpose, &statuses); err != nil {
+		displayMessages([]string{"*** Could not get circuit status: " + err.Error()})
+		return
+	}
+
+	var lines []string
+	for _, status := range statuses {
+		recent := 0
+		for _, n := range status.RecentErrors {
+			recent += n
+		}
+		lines = append(lines, fmt.Sprintf("*** Circuit %d (%s), up %v, idle %v, %d errors, %d recent",
+			status.CircuitId, strings.Join(status.Purposes, ", "), status.Age.Truncate(time.Second),
+			status.Idle.Truncate(time.Second), status.Errors, recent))
+		if status.RTT > 0 {
+			lines = append(lines, "***   round trip "+status.RTT.Round(time.Microsecond).String())
+		}
+		for i, hop := range status.Hops {
+			latency := "-"
+			if hop.Latency > 0 {
+				latency = hop.Latency.Round(time.Microsecond).String()
+			}
+			lines = append(lines, fmt.Sprintf("***   %d. %s %s %s", i+1, hop.Address, hop.Fingerprint, latency))
+		}
+		if status.LastError != "" {
+			lines = append(lines, "***   last error: "+status.LastError)
+		}
+	}
+	displayMessages(lines)
+}
+
+// Handles "/ping [purpose]": pings the exit of the data circuit, or of the
+// circuit for purpose
+func (client *ChatClient) pingCircuit(purpose string) {
+	var rtt time.Duration
+	if err := client.call("OPServer.PingCircuit", purpose, &rtt); err != nil {
+		displayMessages([]string{"*** Ping failed: " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** Pong from the exit in " + rtt.Round(time.Microsecond).String()})
+}
+
+// Handles "/home <#channel> [server]": moves the channel to a chat server
+// from /servers, or back to the proxy's default one without a server
+func (client *ChatClient) homeChannel(args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 1 || len(fields) > 2 {
+		displayMessages([]string{"*** Usage: /home <#channel> [server]"})
+		return
+	}
+
+	req := shared.ChannelHome{Channel: fields[0]}
+	if len(fields) == 2 {
+		req.Server = fields[1]
+	}
+	var _ignored bool
+	if err := client.call("OPServer.HomeChannel", req, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not home " + req.Channel + ": " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** " + req.Channel + " is now homed on " + homeName(req.Server)})
+}
+
+func homeName(server string) string {
+	if server == "" {
+		return "the default chat server"
+	}
+	return server
+}
+
+// Handles "/msg <username> <text>"
+func (client *ChatClient) sendDirectMessage(args string) {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		displayMessages([]string{"*** Usage: /msg <username> <text>"})
+		return
+	}
+
+	var _ignored bool
+	req := shared.ChatMessage{Recipient: fields[0], Message: fields[1]}
+	if err := client.call("OPServer.SendDirectMessage", req, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not send direct message: " + err.Error()})
+	}
+}
+
+// Handles "/anon <text>": posts to the current channel under no username,
+// spending one of the posting tokens the chat server issued to the user
+func (client *ChatClient) sendAnonymousMessage(text string) {
+	var _ignored bool
+	req := shared.ChatMessage{Channel: client.Channel, Message: text}
+	if err := client.call("OPServer.SendAnonymousMessage", req, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not send anonymous message: " + err.Error()})
+	}
+}
+
+// Handles "/encrypt": end-to-end encrypts what is sent to the current channel
+func (client *ChatClient) encryptChannel(string) {
+	var _ignored bool
+	if err := client.call("OPServer.EncryptChannel", client.Channel, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not encrypt channel: " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** Messages to " + client.currentChannel() + " are now end-to-end encrypted"})
+}
+
+// Handles "/block <username>"
+func (client *ChatClient) blockUser(username string) {
+	client.changeBlock("OPServer.BlockUser", username, " is blocked")
+}
+
+// Handles "/unblock <username>"
+func (client *ChatClient) unblockUser(username string) {
+	client.changeBlock("OPServer.UnblockUser", username, " is no longer blocked")
+}
+
+func (client *ChatClient) changeBlock(method string, username string, done string) {
+	if len(strings.Fields(username)) != 1 {
+		displayMessages([]string{"*** Usage: /block <username> or /unblock <username>"})
+		return
+	}
+
+	var _ignored bool
+	if err := client.call(method, username, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not change block list: " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** " + username + done})
+}
+
+// Handles "/blocked"
+func (client *ChatClient) showBlocked(string) {
+	var blocked []string
+	if err := client.call("OPServer.GetBlocked", true, &blocked); err != nil {
+		displayMessages([]string{"*** Could not list blocked users: " + err.Error()})
+		return
+	}
+	if len(blocked) == 0 {
+		displayMessages([]string{"*** Nobody is blocked"})
+		return
+	}
+	displayMessages([]string{"*** Blocked: " + strings.Join(blocked, ", ")})
+}
+
+// Handles "/contacts"
+func (client *ChatClient) showContacts(string) {
+	var contacts []shared.Contact
+	if err := client.call("OPServer.GetContacts", true, &contacts); err != nil {
+		displayMessages([]string{"*** Could not list contacts: " + err.Error()})
+		return
+	}
+	if len(contacts) == 0 {
+		displayMessages([]string{"*** No contacts"})
+		return
+	}
+	lines := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		line := "*** " + contact.Username
+		if contact.Alias != "" {
+			line += " (" + contact.Alias + ")"
+		}
+		if fingerprint := shared.Fingerprint(contact.SigningKey); fingerprint != "" {
+			line += " key " + fingerprint
+		} else {
+			line += " key not seen yet"
 		}
+		lines = append(lines, line)
+	}
+	displayMessages(lines)
+}
+
+const contactUsage = "*** Usage: /contact add|remove|trust|request|accept|decline <username> [alias]"
+
+// Handles "/contact add <username> [alias]", "/contact remove <username>" and
+// "/contact trust <username>", which change the roster, and "/contact request",
+// "/contact accept" and "/contact decline", which ask for and answer contact
+// approval on the chat server
+func (client *ChatClient) changeContact(args string) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) < 2 || fields[1] == "" {
+		displayMessages([]string{contactUsage})
+		return
+	}
+
+	var _ignored bool
+	var err error
+	switch fields[0] {
+	case "add":
+		req := shared.Contact{Username: fields[1]}
+		if len(fields) == 3 {
+			req.Alias = fields[2]
+		}
+		err = client.call("OPServer.AddContact", req, &_ignored)
+	case "remove":
+		err = client.call("OPServer.RemoveContact", fields[1], &_ignored)
+	case "trust":
+		err = client.call("OPServer.TrustContactKeys", fields[1], &_ignored)
+	case shared.ContactRequested, shared.ContactAccepted, shared.ContactDeclined:
+		req := shared.ContactRequest{Contact: fields[1], Action: fields[0]}
+		err = client.call("OPServer.ChangeContact", req, &_ignored)
+	default:
+		displayMessages([]string{contactUsage})
+		return
+	}
+	if err != nil {
+		displayMessages([]string{"*** Could not change contact: " + err.Error()})
+	}
+}
+
+// Handles "/edit <id> <new text>", where id is the number shown as #id
+// before each message
+func (client *ChatClient) editMessage(args string) {
+	fields := strings.SplitN(args, " ", 2)
+	id, ok := messageId(fields[0])
+	if !ok || len(fields) != 2 {
+		displayMessages([]string{"*** Usage: /edit <id> <new text>"})
+		return
+	}
+
+	var _ignored bool
+	req := shared.MessageEditRequest{MessageId: id, Message: fields[1]}
+	if err := client.call("OPServer.EditMessage", req, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not change message: " + err.Error()})
+	}
+}
+
+// Handles "/delete <id>"
+func (client *ChatClient) deleteMessage(args string) {
+	id, ok := messageId(args)
+	if !ok {
+		displayMessages([]string{"*** Usage: /delete <id>"})
+		return
+	}
+
+	var _ignored bool
+	if err := client.call("OPServer.DeleteMessage", id, &_ignored); err != nil {
+		displayMessages([]string{"*** Could not change message: " + err.Error()})
 	}
 }
 
+// Parses a message id, with or without the # it is shown with
+func messageId(field string) (uint32, bool) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(field, "#"), 10, 32)
+	return uint32(id), err == nil
+}
+
+// What became of a message handed to Send
+type SendOutcome struct {
+	shared.SendResult
+	Err error
+}
+
+// Sends a message without waiting for it to be delivered. The returned channel
+// receives the outcome once the exit node has handed the message to the IRC
+// server, the proxy queued it in its outbox for lack of a circuit, or an error
+// stopped it. Send blocks while MaxInFlightMessages are still
+// unacknowledged, so callers are held back when the network is slow.
+// A non-zero deadline makes the proxy retry until then and fail with
+// shared.ExpiredError if the message still isn't delivered. A non-zero ttl
+// has the IRC server purge the message that long after publishing it.
+// Messages are published in the order they are handed to Send.
+func (client *ChatClient) Send(msg string, deadline time.Time, ttl time.Duration) <-chan SendOutcome {
+	client.inFlight <- struct{}{}
+
+	done := make(chan SendOutcome, 1)
+	var outcome SendOutcome
+	client.sendMutex.Lock()
+	proxy := client.proxy()
+	if proxy != client.seqProxy {
+		client.seqProxy = proxy
+		client.sendSeq = 0
+	}
+	client.sendSeq++
+	req := shared.ChatMessage{Channel: client.Channel, Message: msg, Deadline: deadline, TTL: ttl, SendSeq: client.sendSeq}
+	call := proxy.Go("OPServer.SendChatMessage", req, &outcome.SendResult, make(chan *rpc.Call, 1))
+	client.sendMutex.Unlock()
+	go func() {
+		<-call.Done
+		<-client.inFlight
+		outcome.Err = call.Error
+		done <- outcome
+	}()
+
+	return done
+}
+
+// Polls a page at a time, straight away again while a backlog is draining
 func (client *ChatClient) pollForNewMessages() {
 	for {
-		var newMessages []string
-		if err := client.Proxy.Call("OPServer.GetNewMessages", true, &newMessages); err != nil {
+		var result shared.PollResult
+		proxy := client.proxy()
+		if err := proxy.Call("OPServer.PollMessages", shared.PollRequest{Limit: PollingLimit}, &result); proxyLost(err) {
+			displayMessages([]string{"*** Lost the connection to the proxy, reconnecting"})
+			util.HandleFatalError("Could not reconnect to the proxy, please restart!", client.reconnect(proxy))
+			displayMessages([]string{"*** Reconnected to the proxy"})
+		} else if err != nil {
 			util.HandleFatalError("Could not retrieve new messages, please reconnect!", err)
 		} else {
-			displayMessages(newMessages)
+			displayMessages(result.Lines())
+		}
+		if !result.More {
+			time.Sleep(time.Duration(PollingTime) * time.Millisecond)
 		}
-		time.Sleep(time.Duration(PollingTime) * time.Millisecond)
 	}
 }
 
+// Messages are shown in every output mode, as JSON lines in json mode
 func displayMessages(messages []string) {
 	for _, message := range messages {
-		fmt.Println(message)
+		if util.OutputMode() == util.OutputJSON {
+			util.PrintResult(message, map[string]string{"message": message})
+		} else {
+			fmt.Println(message)
+		}
 	}
 }
 
@@ -113,15 +688,24 @@ func (client *ChatClient) PushNewMessage(msg string, resp *bool) error {
 
 func (client *ChatClient) startClientListen(proxy *net.TCPListener) {
 	conn, _ := proxy.Accept()
-	fmt.Println("Proxy to Client connection established")
+	util.PrintStatus("Proxy to Client connection established\n")
 	clientRpcServer := rpc.NewServer()
 	clientRpcServer.Register(client)
 	clientRpcServer.ServeConn(conn)
 }
 
 func readInputLine(reader *bufio.Reader) string {
-	str, _ := reader.ReadString('\n')
-	return strings.TrimSpace(str)
+	str, _ := readInput(reader)
+	return str
+}
+
+// Reads a line, failing once the input ends
+func readInput(reader *bufio.Reader) (string, error) {
+	str, err := reader.ReadString('\n')
+	if err == io.EOF && str != "" {
+		err = nil
+	}
+	return strings.TrimSpace(str), err
 }
 
 func isValidPortNum(portNumStr string) bool {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Stands in for the onion proxy, holding every send until it is released,
+// and answering that it was queued if queued is set
+type testProxy struct {
+	received chan shared.ChatMessage
+	release  chan error
+	queued   bool
+}
+
+func (s *testProxy) SendChatMessage(req shared.ChatMessage, result *shared.SendResult) error {
+	s.received <- req
+	if s.queued {
+		result.Queued, result.Outbox = true, 1
+	}
+	return <-s.release
+}
+
+func testClient(t *testing.T) (*ChatClient, *testProxy) {
+	op := &testProxy{received: make(chan shared.ChatMessage, 2*MaxInFlightMessages), release: make(chan error)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("OPServer", op); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	proxy := rpc.NewClient(clientConn)
+	t.Cleanup(func() { proxy.Close() })
+	return &ChatClient{Name: "alice", Proxy: proxy, inFlight: make(chan struct{}, MaxInFlightMessages)}, op
+}
+
+func TestSendWindow(t *testing.T) {
+	client, op := testClient(t)
+
+	var done []<-chan SendOutcome
+	for i := 0; i < MaxInFlightMessages; i++ {
+		done = append(done, client.Send("hello", time.Time{}, 0))
+	}
+	for i := 0; i < MaxInFlightMessages; i++ {
+		<-op.received
+	}
+
+	// The window is full, so the next send waits for an ack
+	sent := make(chan (<-chan SendOutcome))
+	go func() { sent <- client.Send("one more", time.Time{}, 0) }()
+	select {
+	case <-sent:
+		t.Fatal("a send went past a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	op.release <- nil
+	last := <-sent
+	<-op.received
+	for i := 1; i < MaxInFlightMessages; i++ {
+		op.release <- nil
+	}
+	failed := errors.New("exit unreachable")
+	op.release <- failed
+
+	var errs int
+	for _, d := range append(done, last) {
+		if err := (<-d).Err; err != nil {
+			if err.Error() != failed.Error() {
+				t.Fatalf("a send failed with %v, want %v", err, failed)
+			}
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Fatalf("%d sends failed, want 1", errs)
+	}
+}
+
+func TestSendPassesDeadline(t *testing.T) {
+	client, op := testClient(t)
+	deadline := time.Now().Add(time.Minute).Truncate(time.Second)
+	done := client.Send("hurry", deadline, 0)
+	if req := <-op.received; req.Message != "hurry" || !req.Deadline.Equal(deadline) {
+		t.Fatalf("the proxy got %+v", req)
+	}
+	op.release <- shared.ExpiredError
+	if outcome := <-done; !shared.IsExpiredError(outcome.Err) {
+		t.Fatalf("an expired send gave %v", outcome.Err)
+	}
+}
+
+func TestSendReportsQueued(t *testing.T) {
+	client, op := testClient(t)
+	op.queued = true
+	done := client.Send("later", time.Time{}, 0)
+	<-op.received
+	op.release <- nil
+	if outcome := <-done; outcome.Err != nil || !outcome.Queued || outcome.Outbox != 1 {
+		t.Fatalf("a queued send gave %+v", outcome)
+	}
+}
+
+func TestSendsAreNumbered(t *testing.T) {
+	client, op := testClient(t)
+	var done []<-chan SendOutcome
+	for i := 0; i < 3; i++ {
+		done = append(done, client.Send("hello", time.Time{}, 0))
+	}
+	seqs := make(map[uint64]bool)
+	for i := 0; i < 3; i++ {
+		seqs[(<-op.received).SendSeq] = true
+		op.release <- nil
+	}
+	if len(seqs) != 3 || !seqs[1] || !seqs[2] || !seqs[3] {
+		t.Fatalf("the sends were numbered %v", seqs)
+	}
+	for _, d := range done {
+		<-d
+	}
+
+	// A new proxy connection counts from 1 again
+	reconnected, next := testClient(t)
+	client.Proxy = reconnected.Proxy
+	d := client.Send("again", time.Time{}, 0)
+	if req := <-next.received; req.SendSeq != 1 {
+		t.Fatalf("the first send on the new connection is %d", req.SendSeq)
+	}
+	next.release <- nil
+	<-d
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Command line configurations
+const (
+	MaxHistory = 100 // input lines /history and ! recall
+)
+
+// A slash command: what it takes, what it does, and the handler, which gets
+// what follows the command's name
+type command struct {
+	usage   string
+	summary string
+	run     func(client *ChatClient, args string)
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"/help":      {"", "lists the commands", (*ChatClient).showHelp},
+		"/quit":      {"", "disconnects from the proxy and exits", (*ChatClient).quit},
+		"/reconnect": {"", "dials the proxy again and resumes the session", (*ChatClient).reconnectCommand},
+		"/history":   {"", "lists the lines typed lately, !! or !<n> sends one again", (*ChatClient).showHistory},
+
+		"/join":     {"<#channel>", "sends what you type to the channel", (*ChatClient).join},
+		"/channel":  {"<#channel>", "the same as /join", (*ChatClient).join},
+		"/part":     {"[#channel]", "leaves the channel, the current one if not given", (*ChatClient).part},
+		"/channels": {"", "lists the channels joined", (*ChatClient).showChannels},
+		"/nick":     {"<username>", "changes your username, and the profile's if connected with one", (*ChatClient).changeUsername},
+		"/profiles": {"", "lists the proxy's identity profiles, -profile connects with one", (*ChatClient).showProfiles},
+
+		"/msg":      {"<username> <text>", "sends a direct message", (*ChatClient).sendDirectMessage},
+		"/anon":     {"<text>", "posts to the channel under no username", func(client *ChatClient, args string) { go client.sendAnonymousMessage(args) }},
+		"/ttl":      {"<seconds> <text>", "sends a message the chat server purges that long after", (*ChatClient).sendWithTTL},
+		"/deadline": {"<seconds> <text>", "sends a message that fails unless delivered in time", (*ChatClient).sendWithDeadline},
+		"/edit":     {"<id> <new text>", "edits one of your messages", (*ChatClient).editMessage},
+		"/delete":   {"<id>", "deletes one of your messages", (*ChatClient).deleteMessage},
+		"/read":     {"[#channel]", "marks the channel read, the default one if not given", (*ChatClient).markRead},
+		"/unread":   {"", "lists unread counts", (*ChatClient).showUnreadCounts},
+		"/export":   {"<#channel|dms> <file> [hours]", "saves a channel or your direct messages as NDJSON", func(client *ChatClient, args string) { go client.export(args) }},
+		"/encrypt":  {"", "end-to-end encrypts the current channel", (*ChatClient).encryptChannel},
+
+		"/block":    {"<username>", "hides a user's messages", (*ChatClient).blockUser},
+		"/unblock":  {"<username>", "shows a user's messages again", (*ChatClient).unblockUser},
+		"/blocked":  {"", "lists blocked users", (*ChatClient).showBlocked},
+		"/contacts": {"", "lists contacts", (*ChatClient).showContacts},
+		"/contact":  {"add|remove|trust|request|accept|decline <username> [alias]", "changes a contact", (*ChatClient).changeContact},
+
+		"/servers": {"", "lists the chat servers channels can be homed on", (*ChatClient).showChatServers},
+		"/home":    {"<#channel> [server]", "moves a channel to another chat server", (*ChatClient).homeChannel},
+		"/circuit": {"[purpose|all]", "shows the path of the data circuit, or of others", (*ChatClient).showCircuits},
+		"/ping":    {"[purpose]", "pings the exit of the data circuit, or of another", (*ChatClient).pingCircuit},
+		"/forget":  {"[yes]", "deletes your user from the chat servers", (*ChatClient).forget},
+	}
+}
+
+// Reads lines until stdin ends, handling slash commands and sending
+// everything else. A line starting with "//" is sent with one "/" less.
+func (client *ChatClient) getMessageInput() {
+	for {
+		line, err := readInput(client.Reader)
+		if err != nil {
+			client.quit("")
+		}
+		if line == "" {
+			continue
+		}
+		line, ok := client.recall(line)
+		if !ok {
+			continue
+		}
+		client.remember(line)
+		client.handleLine(line)
+	}
+}
+
+func (client *ChatClient) handleLine(line string) {
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		client.sendLine(strings.TrimPrefix(line, "/"), time.Time{}, 0)
+		return
+	}
+
+	name, args := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		displayMessages([]string{"*** Unknown command " + name + ", /help lists the commands"})
+		return
+	}
+	cmd.run(client, args)
+}
+
+// Turns "!!" into the last line typed and "!<n>" into line n of /history.
+// Other lines are returned as they are.
+func (client *ChatClient) recall(line string) (string, bool) {
+	if !strings.HasPrefix(line, "!") {
+		return line, true
+	}
+
+	n := len(client.history)
+	if line != "!!" {
+		var err error
+		if n, err = strconv.Atoi(line[1:]); err != nil {
+			return line, true
+		}
+	}
+	if n < 1 || n > len(client.history) {
+		displayMessages([]string{"*** No such line in /history: " + line})
+		return "", false
+	}
+	recalled := client.history[n-1]
+	displayMessages([]string{"*** " + recalled})
+	return recalled, true
+}
+
+func (client *ChatClient) remember(line string) {
+	client.history = append(client.history, line)
+	if len(client.history) > MaxHistory {
+		client.history = client.history[len(client.history)-MaxHistory:]
+	}
+}
+
+// Handles "/history"
+func (client *ChatClient) showHistory(string) {
+	lines := make([]string, 0, len(client.history))
+	for i, line := range client.history {
+		lines = append(lines, fmt.Sprintf("*** %3d  %s", i+1, line))
+	}
+	displayMessages(lines)
+}
+
+// Handles "/help"
+func (client *ChatClient) showHelp(string) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"*** Anything else you type is sent to " + client.currentChannel() + ", // sends a line starting with /"}
+	for _, name := range names {
+		cmd := commands[name]
+		lines = append(lines, fmt.Sprintf("***   %s - %s", strings.TrimSpace(name+" "+cmd.usage), cmd.summary))
+	}
+	displayMessages(lines)
+}
+
+// Handles "/quit", and the end of stdin
+func (client *ChatClient) quit(string) {
+	if proxy := client.proxy(); proxy != nil {
+		proxy.Close()
+	}
+	displayMessages([]string{"*** Bye"})
+	os.Exit(0)
+}
+
+// Handles "/reconnect"
+func (client *ChatClient) reconnectCommand(string) {
+	if err := client.reconnect(client.proxy()); err != nil {
+		displayMessages([]string{"*** Could not reconnect to the proxy: " + err.Error()})
+		return
+	}
+	displayMessages([]string{"*** Reconnected to the proxy"})
+}
+
+// The channel messages are sent to
+func (client *ChatClient) currentChannel() string {
+	if client.Channel == "" {
+		return shared.DefaultChannel
+	}
+	return client.Channel
+}
+
+// Handles "/join <#channel>": the chat server adds the user to a channel when
+// they first post to it, so joining only switches where messages go
+func (client *ChatClient) join(args string) {
+	if len(strings.Fields(args)) != 1 {
+		displayMessages([]string{"*** Usage: /join <#channel>"})
+		return
+	}
+	client.Channel = args
+	if containsChannel(client.joined, args) {
+		displayMessages([]string{"*** Now sending to " + args})
+		return
+	}
+	client.joined = append(client.joined, args)
+	displayMessages([]string{"*** Joined " + args + ", now sending to it"})
+}
+
+// Handles "/part [#channel]": forgets the channel, and sends to the channel
+// joined before it if it was the current one
+func (client *ChatClient) part(args string) {
+	channel := args
+	if channel == "" {
+		channel = client.currentChannel()
+	}
+
+	for i, joined := range client.joined {
+		if joined != channel {
+			continue
+		}
+		client.joined = append(client.joined[:i], client.joined[i+1:]...)
+		if channel == client.currentChannel() {
+			client.Channel = ""
+			if len(client.joined) > 0 {
+				client.Channel = client.joined[len(client.joined)-1]
+			}
+		}
+		displayMessages([]string{"*** Left " + channel + ", now sending to " + client.currentChannel()})
+		return
+	}
+	displayMessages([]string{"*** " + channel + " was not joined"})
+}
+
+// Handles "/channels"
+func (client *ChatClient) showChannels(string) {
+	channels := client.joined
+	if !containsChannel(channels, shared.DefaultChannel) {
+		channels = append([]string{shared.DefaultChannel}, channels...)
+	}
+	lines := make([]string, 0, len(channels))
+	for _, channel := range channels {
+		marker := " "
+		if channel == client.currentChannel() {
+			marker = "*"
+		}
+		lines = append(lines, "*** "+marker+" "+channel)
+	}
+	displayMessages(lines)
+}
+
+func containsChannel(channels []string, channel string) bool {
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles "/ttl <seconds> <text>"
+func (client *ChatClient) sendWithTTL(args string) {
+	secs, text, ok := secondsAndText(args)
+	if !ok {
+		displayMessages([]string{"*** Usage: /ttl <seconds> <text>"})
+		return
+	}
+	client.sendLine(text, time.Time{}, secs)
+}
+
+// Handles "/deadline <seconds> <text>"
+func (client *ChatClient) sendWithDeadline(args string) {
+	secs, text, ok := secondsAndText(args)
+	if !ok {
+		displayMessages([]string{"*** Usage: /deadline <seconds> <text>"})
+		return
+	}
+	client.sendLine(text, time.Now().Add(secs), 0)
+}
+
+func secondsAndText(args string) (time.Duration, string, bool) {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) != 2 {
+		return 0, "", false
+	}
+	secs, err := strconv.Atoi(fields[0])
+	if err != nil || secs <= 0 {
+		return 0, "", false
+	}
+	return time.Duration(secs) * time.Second, fields[1], true
+}
+
+// Sends msg to the current channel and reports how it went once it did
+func (client *ChatClient) sendLine(msg string, deadline time.Time, ttl time.Duration) {
+	done := client.Send(msg, deadline, ttl)
+	go func() {
+		outcome := <-done
+		err := outcome.Err
+		if outcome.Queued {
+			displayMessages([]string{fmt.Sprintf("*** No circuit can carry messages right now, queued (%d waiting): %s", outcome.Outbox, msg)})
+		} else if shared.IsExpiredError(err) {
+			displayMessages([]string{"*** Message expired before it could be delivered: " + msg})
+		} else if throttled, ok := shared.ParseThrottledError(err); ok {
+			displayMessages([]string{fmt.Sprintf("*** You are sending messages too fast, wait %v and try again", throttled.RetryAfter)})
+		} else if err != nil {
+			util.HandleNonFatalError("Could not send message, please try again!", err)
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestRecall(t *testing.T) {
+	client := &ChatClient{}
+	for _, line := range []string{"hello", "/join #other", "bye"} {
+		client.remember(line)
+	}
+	for line, want := range map[string]string{"!!": "bye", "!2": "/join #other", "!x": "!x", "plain": "plain"} {
+		if got, ok := client.recall(line); !ok || got != want {
+			t.Fatalf("%q recalled %q, want %q", line, got, want)
+		}
+	}
+	if _, ok := client.recall("!4"); ok {
+		t.Fatal("a line past the history was recalled")
+	}
+
+	for i := 0; i < MaxHistory+5; i++ {
+		client.remember("again")
+	}
+	if len(client.history) != MaxHistory {
+		t.Fatalf("kept %d lines, want %d", len(client.history), MaxHistory)
+	}
+}
+
+func TestJoinAndPart(t *testing.T) {
+	client := &ChatClient{}
+	client.join("#one")
+	client.join("#two")
+	if client.currentChannel() != "#two" || len(client.joined) != 2 {
+		t.Fatalf("sending to %s with %v joined", client.currentChannel(), client.joined)
+	}
+	client.part("")
+	if client.currentChannel() != "#one" {
+		t.Fatalf("leaving the current channel sends to %s, want #one", client.currentChannel())
+	}
+	client.part("#one")
+	if client.currentChannel() != shared.DefaultChannel || len(client.joined) != 0 {
+		t.Fatalf("leaving every channel sends to %s with %v joined", client.currentChannel(), client.joined)
+	}
+}
+
+func TestSecondsAndText(t *testing.T) {
+	if secs, text, ok := secondsAndText("30 see you soon"); !ok || secs != 30*time.Second || text != "see you soon" {
+		t.Fatalf("parsed %v, %q, %v", secs, text, ok)
+	}
+	for _, args := range []string{"30", "0 hi", "soon hi", ""} {
+		if _, _, ok := secondsAndText(args); ok {
+			t.Fatalf("%q parsed", args)
+		}
+	}
+}
+
+func TestHandleLine(t *testing.T) {
+	client, op := testClient(t)
+	client.handleLine("//shrug")
+	if req := <-op.received; req.Message != "/shrug" {
+		t.Fatalf("an escaped slash sent %q", req.Message)
+	}
+	op.release <- nil
+
+	client.handleLine("/join #other")
+	client.handleLine("hi")
+	if req := <-op.received; req.Channel != "#other" || req.Message != "hi" {
+		t.Fatalf("after /join the proxy got %+v", req)
+	}
+	op.release <- nil
+
+	// An unknown command is not sent
+	client.handleLine("/frobnicate")
+	select {
+	case req := <-op.received:
+		t.Fatalf("an unknown command sent %+v", req)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProxyLost(t *testing.T) {
+	for _, err := range []error{rpc.ErrShutdown, io.EOF, io.ErrUnexpectedEOF, &net.OpError{Op: "read", Err: errors.New("reset")}} {
+		if !proxyLost(err) {
+			t.Fatalf("%v doesn't count as the proxy lost", err)
+		}
+	}
+	if proxyLost(nil) || proxyLost(errors.New("Not connected")) {
+		t.Fatal("a refused call counts as the proxy lost")
+	}
+}
+
+// Stands in for a proxy that knows the session token it is resumed with
+type testResumeProxy struct {
+	token   string
+	resumed chan string
+}
+
+func (p *testResumeProxy) ResumeSession(token string, ack *bool) error {
+	p.resumed <- token
+	if token != p.token {
+		return errors.New("unknown session")
+	}
+	*ack = true
+	return nil
+}
+
+func TestReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	p := &testResumeProxy{token: "session-token", resumed: make(chan string, 2)}
+	server := rpc.NewServer()
+	if err = server.RegisterName("OPServer", p); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+
+	client, _ := testClient(t)
+	client.proxyAddr, client.session = listener.Addr().String(), "session-token"
+	broken := client.proxy()
+	if err = client.reconnect(broken); err != nil {
+		t.Fatal(err)
+	}
+	if token := <-p.resumed; token != "session-token" || client.proxy() == broken {
+		t.Fatalf("resumed %q, replacing the connection: %v", token, client.proxy() != broken)
+	}
+	t.Cleanup(func() { client.proxy().Close() })
+
+	// A connection replaced already isn't replaced again
+	replaced := client.proxy()
+	if err = client.reconnect(broken); err != nil || client.proxy() != replaced {
+		t.Fatalf("reconnecting a replaced connection gave %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type ApprovalError error
+
+const (
+	// Contact approval configurations
+	maxPendingRequests int = 100 // unanswered contact requests kept per user
+)
+
+// The contacts a user approved, and the users waiting for their approval
+type approvalList struct {
+	approved map[uint64]bool      // by Registration.Id
+	pending  map[uint64]time.Time // by Registration.Id of the requester
+}
+
+var (
+	// Contact Approval Errors
+	notApprovedError               ApprovalError = errors.New("Recipient has not approved you as a contact; send them a contact request")
+	approvalNeedsRegistrationError ApprovalError = errors.New("Only registered usernames can have contacts")
+	badContactActionError          ApprovalError = errors.New("Contact action must be request, accept or decline")
+	selfContactError               ApprovalError = errors.New("You can't be your own contact")
+	tooManyRequestsError           ApprovalError = errors.New("Recipient has too many unanswered contact requests")
+)
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) approvalsOf(reg *Registration) *approvalList {
+	list, ok := ns.approvals[reg.Id]
+	if !ok {
+		list = &approvalList{approved: make(map[uint64]bool), pending: make(map[uint64]time.Time)}
+		ns.approvals[reg.Id] = list
+	}
+	return list
+}
+
+// Checks that the recipient of a direct message approved its sender, where
+// the namespace requires it. Caller must hold the namespace lock.
+func (ns *Namespace) checkApproved(from *Registration, recipient string) error {
+	if !ns.policy.ContactApproval {
+		return nil
+	}
+	to, ok := ns.registrations[recipient]
+	if !ok {
+		return unknownRecipientError
+	}
+	if list, ok := ns.approvals[to.Id]; ok && list.approved[from.Id] {
+		return nil
+	}
+	return notApprovedError
+}
+
+// Asks a user to approve the sender as a contact, or approves or declines a
+// user. Asking approves the user asked, and so does accepting a request; the
+// other side hears of both through their inbox. Declining also withdraws an
+// earlier approval.
+func (c *CServer) ChangeContact(req shared.ContactRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return approvalNeedsRegistrationError
+	}
+	contact, ok := ns.registrations[req.Contact]
+	if !ok {
+		return unknownRecipientError
+	}
+	if contact.Id == reg.Id {
+		return selfContactError
+	}
+
+	own := ns.approvalsOf(reg)
+	theirs := ns.approvalsOf(contact)
+	switch req.Action {
+	case shared.ContactRequested:
+		own.approved[contact.Id] = true
+		if _, asked := theirs.pending[reg.Id]; asked || theirs.approved[reg.Id] || ns.isBlocked(contact.Username, reg.Username) {
+			break
+		}
+		if len(theirs.pending) >= maxPendingRequests {
+			return tooManyRequestsError
+		}
+		theirs.pending[reg.Id] = time.Now()
+		ns.deliverToInbox(contact.Username, InboxMessage{From: reg.Username, Contact: &shared.ContactEvent{From: reg.Username, Kind: shared.ContactRequested}})
+	case shared.ContactAccepted:
+		own.approved[contact.Id] = true
+		if _, asked := own.pending[contact.Id]; asked {
+			delete(own.pending, contact.Id)
+			ns.deliverToInbox(contact.Username, InboxMessage{From: reg.Username, Contact: &shared.ContactEvent{From: reg.Username, Kind: shared.ContactAccepted}})
+		}
+	case shared.ContactDeclined:
+		delete(own.approved, contact.Id)
+		if _, asked := own.pending[contact.Id]; asked {
+			delete(own.pending, contact.Id)
+			ns.deliverToInbox(contact.Username, InboxMessage{From: reg.Username, Contact: &shared.ContactEvent{From: reg.Username, Kind: shared.ContactDeclined}})
+		}
+	default:
+		return badContactActionError
+	}
+
+	util.OutLog.Printf("[%s] %s: contact %s %s\n", ns.name, reg.Username, req.Action, contact.Username)
+	*ack = true
+	return nil
+}
+
+// Drops the user's approvals, and them from everyone else's. Caller must
+// hold the namespace lock.
+func (ns *Namespace) forgetApprovals(reg *Registration) {
+	delete(ns.approvals, reg.Id)
+	for _, list := range ns.approvals {
+		delete(list.approved, reg.Id)
+		delete(list.pending, reg.Id)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func changeContact(username string, contact string, action string) error {
+	var ack bool
+	return new(CServer).ChangeContact(shared.ContactRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, Contact: contact, Action: action}, &ack)
+}
+
+func TestContactApproval(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {ContactApproval: true}}})
+	for _, username := range []string{"alice", "bob", "carol"} {
+		if err := registerUserName(username, "token-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sendDirectMessage("alice", "bob", "hi"); err != notApprovedError {
+		t.Fatalf("a DM before approval gave %v, want %v", err, notApprovedError)
+	}
+
+	// Asking approves bob, who hears of it in his inbox
+	if err := changeContact("alice", "bob", shared.ContactRequested); err != nil {
+		t.Fatal(err)
+	}
+	resp := pollInbox(t, "bob", 0)
+	if len(resp.ContactEvents) != 1 || resp.ContactEvents[0] != (shared.ContactEvent{From: "alice", Kind: shared.ContactRequested}) || len(resp.Inbox) != 0 {
+		t.Fatalf("bob got %+v", resp)
+	}
+	if err := sendDirectMessage("bob", "alice", "hi"); err != nil {
+		t.Fatalf("a DM to a user who asked gave %v", err)
+	}
+	if err := changeContact("bob", "alice", shared.ContactAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := pollInbox(t, "alice", 0); len(resp.ContactEvents) != 1 || resp.ContactEvents[0].Kind != shared.ContactAccepted {
+		t.Fatalf("alice got %+v", resp.ContactEvents)
+	}
+
+	// Declining withdraws it again
+	if err := changeContact("bob", "alice", shared.ContactDeclined); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "hi"); err != notApprovedError {
+		t.Fatalf("a DM after declining gave %v, want %v", err, notApprovedError)
+	}
+	if err := sendDirectMessage("carol", "alice", "hi"); err != notApprovedError {
+		t.Fatalf("a DM from a stranger gave %v, want %v", err, notApprovedError)
+	}
+}
+
+func TestChangeContactErrors(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {ContactApproval: true}}})
+	if err := changeContact("alice", "bob", shared.ContactRequested); err != approvalNeedsRegistrationError {
+		t.Fatalf("an unregistered user gave %v, want %v", err, approvalNeedsRegistrationError)
+	}
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		contact, action string
+		want            error
+	}{
+		{"dave", shared.ContactRequested, unknownRecipientError},
+		{"alice", shared.ContactRequested, selfContactError},
+	} {
+		if err := changeContact("alice", test.contact, test.action); err != test.want {
+			t.Fatalf("%s %s gave %v, want %v", test.action, test.contact, err, test.want)
+		}
+	}
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := changeContact("alice", "bob", "block"); err != badContactActionError {
+		t.Fatalf("an unknown action gave %v, want %v", err, badContactActionError)
+	}
+}
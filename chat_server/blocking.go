@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"../shared"
+	"../util"
+)
+
+type BlockError error
+
+const (
+	// Blocking configurations
+	maxBlockedUsers int = 1000 // per user
+)
+
+var (
+	// Blocking Errors
+	blockNeedsRegistrationError BlockError = errors.New("Only registered usernames can block users")
+	selfBlockError              BlockError = errors.New("You can't block yourself")
+	tooManyBlockedError         BlockError = errors.New("Too many blocked users")
+)
+
+// Blocks or unblocks a user for the sender. Blocking also withdraws the
+// sender's approval of them and drops their contact request.
+func (c *CServer) BlockUser(req shared.BlockRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return blockNeedsRegistrationError
+	}
+	blocked, ok := ns.registrations[req.Blocked]
+	if !ok {
+		return unknownRecipientError
+	}
+	if blocked.Id == reg.Id {
+		return selfBlockError
+	}
+
+	if req.Unblock {
+		delete(ns.blocks[reg.Id], blocked.Id)
+		util.OutLog.Printf("[%s] %s unblocked %s\n", ns.name, reg.Username, blocked.Username)
+		*ack = true
+		return nil
+	}
+
+	list, ok := ns.blocks[reg.Id]
+	if !ok {
+		list = make(map[uint64]bool)
+		ns.blocks[reg.Id] = list
+	}
+	if !list[blocked.Id] && len(list) >= maxBlockedUsers {
+		return tooManyBlockedError
+	}
+	list[blocked.Id] = true
+	if approvals, ok := ns.approvals[reg.Id]; ok {
+		delete(approvals.approved, blocked.Id)
+		delete(approvals.pending, blocked.Id)
+	}
+
+	util.OutLog.Printf("[%s] %s blocked %s\n", ns.name, reg.Username, blocked.Username)
+	*ack = true
+	return nil
+}
+
+// Whether recipient blocked the user called from. Caller must hold the
+// namespace lock.
+func (ns *Namespace) isBlocked(recipient string, from string) bool {
+	to, ok := ns.registrations[recipient]
+	if !ok {
+		return false
+	}
+	sender, ok := ns.registrations[from]
+	return ok && ns.blocks[to.Id][sender.Id]
+}
+
+// The current usernames of the users reg blocked, sorted. Caller must hold
+// the namespace lock.
+func (ns *Namespace) blockedBy(reg *Registration) []string {
+	list := ns.blocks[reg.Id]
+	if len(list) == 0 {
+		return nil
+	}
+	var names []string
+	for _, blocked := range ns.registrations {
+		if list[blocked.Id] {
+			names = append(names, blocked.Username)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Drops the user's block list, and them from everyone else's. Caller must
+// hold the namespace lock.
+func (ns *Namespace) forgetBlocks(reg *Registration) {
+	delete(ns.blocks, reg.Id)
+	for _, list := range ns.blocks {
+		delete(list, reg.Id)
+	}
+}
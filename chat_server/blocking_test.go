@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func blockUser(username string, blocked string, unblock bool) error {
+	var ack bool
+	return new(CServer).BlockUser(shared.BlockRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, Blocked: blocked, Unblock: unblock}, &ack)
+}
+
+func TestBlockUser(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := blockUser("bob", "alice", false); err != blockNeedsRegistrationError {
+		t.Fatalf("an unregistered user gave %v, want %v", err, blockNeedsRegistrationError)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := registerUserName(username, "token-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := blockUser("bob", "bob", false); err != selfBlockError {
+		t.Fatalf("blocking yourself gave %v, want %v", err, selfBlockError)
+	}
+	if err := blockUser("bob", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sender isn't told
+	if err := sendDirectMessage("alice", "bob", "hi"); err != nil {
+		t.Fatalf("a DM to a user who blocked the sender gave %v", err)
+	}
+	if err := publish("uni", "alice", "@bob look"); err != nil {
+		t.Fatal(err)
+	}
+	resp := pollInbox(t, "bob", 0)
+	if len(resp.Inbox) != 0 || len(resp.Blocked) != 1 || resp.Blocked[0] != "alice" {
+		t.Fatalf("bob got inbox %q, blocked %q", resp.Inbox, resp.Blocked)
+	}
+
+	if err := blockUser("bob", "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if resp = pollInbox(t, "bob", resp.NextInboxId); len(resp.Inbox) != 1 || len(resp.Blocked) != 0 {
+		t.Fatalf("after unblocking bob got inbox %q, blocked %q", resp.Inbox, resp.Blocked)
+	}
+}
+
+func TestBlockingWithdrawsApproval(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {ContactApproval: true}}})
+	for _, username := range []string{"alice", "bob"} {
+		if err := registerUserName(username, "token-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := changeContact("bob", "alice", shared.ContactAccepted); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockUser("bob", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockUser("bob", "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "hi"); err != notApprovedError {
+		t.Fatalf("a DM after a block was lifted gave %v, want %v", err, notApprovedError)
+	}
+
+	// Requests from a blocked user don't reach the inbox
+	if err := blockUser("bob", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := changeContact("alice", "bob", shared.ContactRequested); err != nil {
+		t.Fatal(err)
+	}
+	if resp := pollInbox(t, "bob", 0); len(resp.ContactEvents) != 0 {
+		t.Fatalf("bob got %+v", resp.ContactEvents)
+	}
+}
@@ -1,62 +1,417 @@
 package main
 
 import (
-	"fmt"
+	"flag"
 	"net"
 	"net/rpc"
-	"sync"
+	"os"
+	"sync/atomic"
+	"time"
 
+	"../shared"
 	"../util"
+	"../util/faults"
 )
 
-type CServer int
+// One CServer is registered per connection so RPCs know which host (normally
+// an exit node) they came from.
+type CServer struct {
+	remoteHost string
+}
 
 const (
 	cserverPort string = ":12346"
-)
 
-type AllMessages struct {
-	sync.RWMutex
-	all []string
-}
+	maxClockSkew time.Duration = 5 * time.Minute // sender clocks further off than this are flagged
 
-var messages = AllMessages{all: make([]string, 0)}
+	defaultPollingLimit int = 200 // messages per poll, small enough to come back through a circuit
+	maxPollingLimit     int = 1000
+)
 
-// go run chat_server.go
+// go run *.go [-listen :12346] [-directory ip:port -name a -public-addr ip:port] [-namespaces config.json] [-user-rate 1 -user-burst 8] [-exit-rate 20 -exit-burst 50] [-irc-addr :6667 -irc-namespace default] [-xmpp-server localhost:5347 -xmpp-domain torchat.example.org -xmpp-secret s]
+// [-matrix-addr :9009 -matrix-homeserver http://localhost:8008 -matrix-server-name example.org -matrix-as-token a -matrix-hs-token h] [-health-addr :9300] [-faults spec]
 func main() {
-	cserver := new(CServer)
-	server := rpc.NewServer()
-	server.Register(cserver)
+	configPath := flag.String("namespaces", "", "path to namespace config file")
+	ircAddr := flag.String("irc-addr", "", "address to accept RFC 1459 IRC clients on, e.g. :6667 (disabled if empty)")
+	ircNamespace := flag.String("irc-namespace", shared.DefaultNamespace, "namespace IRC clients are bridged into")
+	xmppServer := flag.String("xmpp-server", "", "XMPP server to connect to as an external component, e.g. localhost:5347 (disabled if empty)")
+	xmppDomain := flag.String("xmpp-domain", "", "component domain the XMPP server routes to the gateway; rooms are <channel>@<domain>")
+	xmppSecret := flag.String("xmpp-secret", "", "component secret shared with the XMPP server")
+	xmppNamespace := flag.String("xmpp-namespace", shared.DefaultNamespace, "namespace XMPP users are bridged into")
+	matrixAddr := flag.String("matrix-addr", "", "address the Matrix application service listens on for the homeserver, e.g. :9009 (disabled if empty)")
+	matrixHomeserver := flag.String("matrix-homeserver", "", "client-server API URL of the homeserver, e.g. http://localhost:8008")
+	matrixServerName := flag.String("matrix-server-name", "", "server name of the homeserver, the part after : in user ids")
+	matrixASToken := flag.String("matrix-as-token", "", "as_token from the application service registration")
+	matrixHSToken := flag.String("matrix-hs-token", "", "hs_token from the application service registration")
+	matrixNamespace := flag.String("matrix-namespace", shared.DefaultNamespace, "namespace mirrored into Matrix")
+	flag.Float64Var(&rateLimiter.userLimit.Rate, "user-rate", 1, "messages per second each username may publish (0 for unlimited)")
+	flag.Float64Var(&rateLimiter.userLimit.Burst, "user-burst", shared.MaxInFlightMessages, "messages a username may publish in a burst")
+	flag.Float64Var(&rateLimiter.exitLimit.Rate, "exit-rate", 20, "messages per second each exit node may publish (0 for unlimited)")
+	flag.Float64Var(&rateLimiter.exitLimit.Burst, "exit-burst", 50, "messages an exit node may publish in a burst")
+	listenAddr := flag.String("listen", cserverPort, "ip:port to serve the CServer RPC on, so several chat servers can run on one host")
+	dirServerAddr := flag.String("directory", "", "ip:port of a directory server to register with, so proxies find this chat server (disabled if empty)")
+	name := flag.String("name", "", "name the directory server advertises this chat server under, with -directory")
+	publicAddr := flag.String("public-addr", "", "ip:port exit nodes reach this chat server on, with -directory (the listen address if empty)")
+	dirToken := flag.String("directory-token", os.Getenv("TORCHAT_CHAT_SERVER_TOKEN"), "chat server token of the directory server, if it requires one (env TORCHAT_CHAT_SERVER_TOKEN)")
+	historyDir := flag.String("history", "", "directory to keep encrypted message history in across restarts (disabled if empty)")
+	historyKey := flag.String("history-key", os.Getenv("TORCHAT_HISTORY_KEY"), "64 hex digit AES key history is encrypted with, with -history (env TORCHAT_HISTORY_KEY)")
+	dashboardAddr := flag.String("dashboard-addr", "", "loopback ip:port to serve the admin web dashboard on, e.g. 127.0.0.1:8090 (disabled if empty)")
+	healthAddr := util.HealthFlag()
+	faultSpec := faults.Flag()
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
+	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+	faults.Setup(*faultSpec)
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentChatServer, *showFeatures))
+		return
+	}
+
+	if rateLimiter.userLimit.Burst < 1 || rateLimiter.exitLimit.Burst < 1 {
+		util.ErrLog.Fatalln("[FATAL ERROR] Rate limit bursts must be at least 1")
+	}
+
+	if *configPath != "" {
+		config, err := loadNamespaceConfig(*configPath)
+		util.HandleFatalError("Could not load namespace config", err)
+		namespaces.config = config
+	}
+
+	if *healthAddr != "" {
+		go util.ServeHealth(*healthAddr, healthChecks)
+	}
+
+	if *dashboardAddr != "" {
+		go serveDashboard(*dashboardAddr)
+	}
+
+	if *historyDir != "" {
+		store, err := openHistory(*historyDir, *historyKey)
+		util.HandleFatalError("Could not open message history", err)
+		util.HandleFatalError("Could not restore message history", store.load())
+		go store.persist()
+	}
+
+	go enforceRetention()
+	go rateLimiter.sweep()
+
+	if *ircAddr != "" {
+		go serveIRC(*ircAddr, *ircNamespace)
+	}
+	if *xmppServer != "" {
+		if *xmppDomain == "" || *xmppSecret == "" {
+			util.ErrLog.Fatalln("[FATAL ERROR] -xmpp-server needs -xmpp-domain and -xmpp-secret")
+		}
+		go serveXMPP(*xmppServer, *xmppDomain, *xmppSecret, *xmppNamespace)
+	}
+	if *matrixAddr != "" {
+		if *matrixHomeserver == "" || *matrixServerName == "" || *matrixASToken == "" || *matrixHSToken == "" {
+			util.ErrLog.Fatalln("[FATAL ERROR] -matrix-addr needs -matrix-homeserver, -matrix-server-name, -matrix-as-token and -matrix-hs-token")
+		}
+		go serveMatrix(*matrixAddr, *matrixHomeserver, *matrixServerName, *matrixASToken, *matrixHSToken, *matrixNamespace)
+	}
 
-	listener, err := net.Listen("tcp", cserverPort)
+	listener, err := net.Listen("tcp", *listenAddr)
 	util.HandleFatalError("Error starting server", err)
-	fmt.Println("Server is listening on addr/port: ", listener.Addr(), "\n")
+	listener = faults.Listen(listener)
+	util.OutLog.Println("Server is listening on addr/port: ", listener.Addr())
+
+	if *dirServerAddr != "" {
+		if *publicAddr == "" {
+			*publicAddr = *listenAddr
+		}
+		if host, _, err := net.SplitHostPort(*publicAddr); err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+			util.ErrLog.Fatalln("[FATAL ERROR] -directory needs -public-addr when listening on all addresses")
+		}
+		if *name == "" {
+			util.ErrLog.Fatalln("[FATAL ERROR] -directory needs -name")
+		}
+		go announceToDirectory(*dirServerAddr, shared.ChatServerRegistration{
+			Name:            *name,
+			Address:         *publicAddr,
+			Token:           *dirToken,
+			ProtocolVersion: shared.ProtocolVersion,
+		})
+	}
+	atomic.StoreInt32(&listening, 1)
 
 	for {
 		conn, err := listener.Accept()
 		util.HandleFatalError("Error accepting", err)
+
+		remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		server := rpc.NewServer()
+		server.Register(&CServer{remoteHost: remoteHost})
 		go server.ServeConn(conn)
 	}
 }
 
-func (c *CServer) PublishMessage(msg string, ack *bool) error {
-	messages.Lock()
-	defer messages.Unlock()
+func (c *CServer) PublishMessage(chatMessage shared.ChatMessage, ack *bool) error {
+	ns, err := getNamespace(chatMessage.Namespace)
+	if err != nil {
+		return err
+	}
 
-	messages.all = append(messages.all, msg)
-	fmt.Println(msg)
+	ns.Lock()
+	defer ns.Unlock()
+
+	// The other copy of a message sent over two circuits got here first
+	if ns.duplicate(chatMessage) {
+		*ack = true
+		return nil
+	}
+	if err = ns.publish(chatMessage, c.remoteHost); err != nil {
+		return err
+	}
+	ns.rememberMessageId(chatMessage)
 
 	*ack = true
 	return nil
 }
 
-func (c *CServer) GetNewMessages(last uint32, resp *[]string) error {
-	messages.RLock()
-	defer messages.RUnlock()
+// Publishes a message to a channel, or to the recipient's inbox for direct
+// messages, after every check a sender must pass. remoteHost is where the
+// message came from for rate limiting. Caller must hold the namespace lock.
+func (ns *Namespace) publish(chatMessage shared.ChatMessage, remoteHost string) error {
+	// Message times always come from the server's clock. A sender clock far off
+	// ours is flagged, and its deadline is moved onto our clock.
+	skew := clockSkew(chatMessage.SentAt)
+	deadline := chatMessage.Deadline
+	if skew != 0 && !deadline.IsZero() {
+		deadline = deadline.Add(skew)
+	}
+
+	// A message that arrives too late is worse than none, e.g. a stale presence ping
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return shared.ExpiredError
+	}
+
+	if chatMessage.PostingToken != nil {
+		return ns.publishAnonymous(chatMessage, remoteHost, skew)
+	}
+
+	if err := ns.checkCanPublish(chatMessage.Username); err != nil {
+		return err
+	}
+
+	// Publishing under an unregistered username claims it
+	reg, seen, err := ns.authenticateMessage(chatMessage)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return nil
+	}
+
+	if err = rateLimiter.allow(ns.name, chatMessage.Username, shared.HostKey(remoteHost)); err != nil {
+		util.OutLog.Printf("[%s] Throttled %s via %s: %s\n", ns.name, chatMessage.Username, remoteHost, err)
+		return err
+	}
+
+	if ns.policy.MaxMessageLength > 0 && len(chatMessage.Message) > ns.policy.MaxMessageLength {
+		return messageTooLongError
+	}
+	if err = ns.checkPayload(chatMessage); err != nil {
+		return err
+	}
+	expiresAt, err := expiryOf(chatMessage.TTL)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ns.users[chatMessage.Username]; !ok && ns.policy.MaxUsers > 0 && len(ns.users) >= ns.policy.MaxUsers {
+		return namespaceQuotaError
+	}
+	ns.users[chatMessage.Username] = time.Now()
+
+	if chatMessage.SenderKey != nil {
+		return ns.deliverSenderKey(chatMessage)
+	}
+
+	// Direct messages skip the shared log and go straight to the recipient's inbox
+	if chatMessage.Recipient != "" {
+		if err = ns.checkApproved(reg, chatMessage.Recipient); err != nil {
+			return err
+		}
+		// Looks delivered to the sender, but isn't logged for the recipient either
+		if ns.isBlocked(chatMessage.Recipient, chatMessage.Username) {
+			ns.rememberSignature(chatMessage)
+			util.OutLog.Printf("[%s] DM %s -> %s dropped, blocked\n", ns.name, chatMessage.Username, chatMessage.Recipient)
+			return nil
+		}
+		inboxMessage := InboxMessage{
+			From:      chatMessage.Username,
+			Message:   chatMessage.Message,
+			ExpiresAt: expiresAt,
+		}
+		logged := chatMessage.Message
+		if chatMessage.Ratchet != nil {
+			if inboxMessage.Ratchet, err = ns.ratchetEnvelope(reg, chatMessage.Recipient, *chatMessage.Ratchet); err != nil {
+				return err
+			}
+			logged = shared.EncryptedPlaceholder
+		}
+		if err = ns.deliverToInbox(chatMessage.Recipient, inboxMessage); err != nil {
+			return err
+		}
+		ns.logDirectMessage(reg, chatMessage.Recipient, logged, expiresAt)
+		ns.scheduleExpiry(expiresAt)
+		ns.rememberSignature(chatMessage)
+		util.OutLog.Printf("[%s] DM %s -> %s\n", ns.name, chatMessage.Username, chatMessage.Recipient)
+		return nil
+	}
+
+	// Publishing to a channel joins it, which is also how kicked users rejoin
+	channel := channelOrDefault(chatMessage.Channel)
+	ns.joinedChannels(chatMessage.Username)[channel] = true
+
+	msg := ns.appendMessage(channel, chatMessage.Username, chatMessage.Message, reg.Id)
+	msg.Encrypted = chatMessage.Encrypted
+	msg.ClockSkewed = skew != 0
+	msg.ExpiresAt = expiresAt
+	ns.scheduleExpiry(expiresAt)
+	if msg.ClockSkewed {
+		util.OutLog.Printf("[%s] %s's clock is off by %v\n", ns.name, chatMessage.Username, skew)
+	}
+	ns.queueMentions(channel, chatMessage.Username, chatMessage.Message, expiresAt)
+	ns.rememberSignature(chatMessage)
+	util.OutLog.Printf("[%s] %s\n", ns.name, ns.messages[len(ns.messages)-1].logString())
+
+	return nil
+}
+
+// Returns new messages and presence events from the channels the polling user
+// has joined. Every device of a user polls with its own cursors. At most
+// pollingMessage.Limit messages are returned, with More set if there are more.
+func (c *CServer) GetNewMessages(pollingMessage shared.PollingMessage, resp *shared.PollingResponse) error {
+	ns, err := getNamespace(pollingMessage.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	// Another device of this user may have changed its name
+	username := pollingMessage.Username
+	if current, renamed := ns.renamedTo(username, pollingMessage.UserToken); renamed {
+		username = current
+	}
+
+	if ns.banned[username] {
+		return bannedError
+	}
+	reg, err := ns.authenticate(username, pollingMessage.UserToken, false)
+	if err != nil {
+		return err
+	}
+	channels := ns.joinedChannels(username)
+	ns.lastPolled[username] = time.Now()
+	ns.expireMessages()
+
+	sess := ns.session(username, pollingMessage.DeviceId)
+	sess.LastPolled = time.Now()
+
+	// Messages before firstId have been dropped by retention, skip past them
+	start := pollingMessage.LastMessageId
+	if start < ns.firstId {
+		start = ns.firstId
+	}
+	nextId := ns.firstId + uint32(len(ns.messages))
+	if start > nextId {
+		start = nextId
+	}
 
-	temp := make([]string, len(messages.all))
-	copy(temp, messages.all)
-	*resp = temp[last:]
+	limit := pollingMessage.Limit
+	if limit <= 0 || limit > maxPollingLimit {
+		limit = defaultPollingLimit
+	}
 
+	// The page ends before the first message that doesn't fit
+	pageEnd := nextId
+	newMessages := make([]string, 0, limit)
+	messageMeta := make([]shared.MessageMeta, 0, limit)
+	for i, msg := range ns.messages[start-ns.firstId:] {
+		if !channels[msg.Channel] || msg.Deleted {
+			continue
+		}
+		if len(newMessages) == limit {
+			pageEnd = start + uint32(i)
+			break
+		}
+		newMessages = append(newMessages, msg.String())
+		messageMeta = append(messageMeta, msg.meta(start+uint32(i)))
+	}
+
+	sess.LastMessageId = start
+
+	events, nextEventId := ns.presenceSince(username, pollingMessage.LastEventId)
+	updates, nextUpdateId := ns.updatesSince(channels, pollingMessage.LastUpdateId, start)
+
+	// Only the owner of a registered username can read its inbox
+	var inbox []string
+	var senderKeys []shared.SenderKeyEnvelope
+	var ratchetMessages []shared.RatchetEnvelope
+	var contactEvents []shared.ContactEvent
+	var nextInboxId uint32
+	if reg != nil {
+		var inboxMessages []InboxMessage
+		inboxMessages, nextInboxId = ns.takeInbox(username, sess, pollingMessage.LastInboxId)
+		for _, msg := range inboxMessages {
+			if msg.SenderKey != nil {
+				senderKeys = append(senderKeys, *msg.SenderKey)
+			} else if msg.Ratchet != nil {
+				ratchetMessages = append(ratchetMessages, *msg.Ratchet)
+			} else if msg.Contact != nil {
+				contactEvents = append(contactEvents, *msg.Contact)
+			} else {
+				inbox = append(inbox, msg.String())
+			}
+		}
+	}
+
+	readMarkers, unreadCounts := ns.unreadCounts(username, channels)
+
+	*resp = shared.PollingResponse{
+		Messages:      newMessages,
+		MessageMeta:   messageMeta,
+		NextMessageId: pageEnd,
+		More:          pageEnd < nextId,
+		Events:        events,
+		NextEventId:   nextEventId,
+		Updates:       updates,
+		NextUpdateId:  nextUpdateId,
+		Inbox:         inbox,
+		NextInboxId:   nextInboxId,
+		Username:      username,
+		ReadMarkers:   readMarkers,
+		UnreadCounts:  unreadCounts,
+		SenderKeys:    senderKeys,
+
+		RatchetMessages: ratchetMessages,
+		ContactEvents:   contactEvents,
+	}
+	if reg != nil {
+		resp.SignedPrekeyId, resp.OneTimePrekeys = ns.prekeysLeft(reg)
+		resp.Blocked = ns.blockedBy(reg)
+	}
 	return nil
 }
+
+// Returns how far the server's clock is ahead of a sender's, or 0 if the
+// sender didn't say or is within maxClockSkew
+func clockSkew(sentAt time.Time) time.Duration {
+	if sentAt.IsZero() {
+		return 0
+	}
+
+	skew := time.Since(sentAt)
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return skew
+	}
+	return 0
+}
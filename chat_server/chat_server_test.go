@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestPollingPages(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, message := range []string{"one", "two", "three", "four", "five"} {
+		if err := publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var texts []string
+	var last uint32
+	pages := 0
+	for {
+		var resp shared.PollingResponse
+		if err := new(CServer).GetNewMessages(shared.PollingMessage{Namespace: "uni", LastMessageId: last, Limit: 2}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Messages) > 2 || len(resp.MessageMeta) != len(resp.Messages) {
+			t.Fatalf("a page of 2 has %+v", resp)
+		}
+		texts = append(texts, resp.Messages...)
+		last = resp.NextMessageId
+		pages++
+		if !resp.More {
+			break
+		}
+	}
+	if pages != 3 || len(texts) != 5 || texts[0] != "alice: one" || texts[4] != "alice: five" || last != 5 {
+		t.Fatalf("read %q in %d pages up to %d", texts, pages, last)
+	}
+
+	// Without a limit the server's default applies
+	if resp := poll(t, "uni", 0); len(resp.Messages) != 5 || resp.More {
+		t.Fatalf("an unlimited poll gave %+v", resp)
+	}
+}
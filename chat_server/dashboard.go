@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type DashboardError error
+
+// Dashboard configurations
+const (
+	dashboardRefresh           time.Duration = 5 * time.Second // how often the page fetches /api/activity
+	dashboardReadHeaderTimeout time.Duration = 10 * time.Second
+)
+
+var (
+	// Dashboard Errors
+	dashboardMethodError DashboardError = errors.New("Only GET is supported")
+)
+
+// Answer to a request the dashboard refused
+type dashboardError struct {
+	Error string
+}
+
+// Serves the admin dashboard on addr, which must be a loopback address as it
+// is plain HTTP. The page asks for a namespace and an operator, and shows
+// what the query RPCs return with the operator's token.
+func serveDashboard(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	util.HandleFatalError("Invalid dashboard address", err)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		util.ErrLog.Fatalf("[FATAL ERROR] Dashboard address must be a loopback address, got %s\n", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/activity", serveActivity)
+	mux.HandleFunc("/", serveDashboardPage)
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: dashboardReadHeaderTimeout}
+	util.OutLog.Printf("Dashboard available at http://%s/\n", addr)
+	util.HandleFatalError("Dashboard stopped", server.ListenAndServe())
+}
+
+func writeDashboardResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /api/activity?namespace=&operator= with the operator's token as a
+// bearer token: what GetNamespaceActivity returns
+func serveActivity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeDashboardResponse(w, http.StatusMethodNotAllowed, dashboardError{Error: dashboardMethodError.Error()})
+		return
+	}
+
+	req := shared.OperatorQuery{
+		Namespace: r.URL.Query().Get("namespace"),
+		Operator:  r.URL.Query().Get("operator"),
+		Token:     strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+	}
+	var activity shared.NamespaceActivity
+	if err := (&CServer{}).GetNamespaceActivity(req, &activity); err != nil {
+		status := http.StatusBadRequest
+		if err == notOperatorError {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			status = http.StatusUnauthorized
+		}
+		writeDashboardResponse(w, status, dashboardError{Error: err.Error()})
+		return
+	}
+	writeDashboardResponse(w, http.StatusOK, activity)
+}
+
+// GET /: the dashboard page. It holds no data itself; the operator's
+// credentials are only sent with /api/activity requests.
+func serveDashboardPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeDashboardResponse(w, http.StatusMethodNotAllowed, dashboardError{Error: dashboardMethodError.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	fmt.Fprintf(w, chatDashboardHTML, dashboardRefresh.Milliseconds())
+}
+
+// Usernames, channel names and reasons are only ever put in the page as
+// text, never as HTML, as users choose them
+const chatDashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TorChat chat server</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+.bad { color: #b00; }
+#error { color: #b00; }
+#rates { display: flex; align-items: flex-end; height: 80px; gap: 1px; margin-bottom: 0.5em; }
+#rates div { width: 6px; background: #47a; }
+</style>
+</head>
+<body>
+<h1>TorChat chat server</h1>
+<form id="login">
+<input id="namespace" placeholder="namespace">
+<input id="operator" placeholder="operator">
+<input id="token" type="password" placeholder="operator token">
+<button>Show</button>
+</form>
+<p id="error"></p>
+<h2>Message rates</h2>
+<div id="rates"></div>
+<p id="ratesummary"></p>
+<h2>Channels</h2>
+<table id="channels"></table>
+<h2>Active users</h2>
+<table id="users"></table>
+<h2>Moderation actions</h2>
+<table id="moderation"></table>
+<script>
+var login = JSON.parse(sessionStorage.getItem("torchat-operator") || "null");
+
+function row(table, cells, header, cls) {
+	var tr = table.insertRow();
+	if (cls) tr.className = cls;
+	cells.forEach(function (text) {
+		var cell = document.createElement(header ? "th" : "td");
+		cell.textContent = text;
+		tr.appendChild(cell);
+	});
+}
+
+function clear(id) {
+	var el = document.getElementById(id);
+	el.textContent = "";
+	return el;
+}
+
+function when(t) {
+	var d = new Date(t);
+	return d.getFullYear() > 1 ? d.toLocaleString() : "-";
+}
+
+function render(activity) {
+	var rates = clear("rates");
+	var most = Math.max.apply(null, activity.Rates.PerMinute.concat([1]));
+	activity.Rates.PerMinute.forEach(function (n, i) {
+		var bar = document.createElement("div");
+		bar.style.height = Math.round(n / most * 100) + "%%";
+		bar.title = (activity.Rates.PerMinute.length - i) + " min ago: " + n;
+		rates.appendChild(bar);
+	});
+	clear("ratesummary").textContent = activity.Rates.LastHour + " messages in the last hour, " +
+		activity.Rates.PerSecond.toFixed(2) + " per second over the last minute";
+
+	var channels = clear("channels");
+	row(channels, ["Channel", "Members", "Messages kept", "Per minute", "Last message"], true);
+	activity.Channels.forEach(function (c) {
+		row(channels, [c.Name, String(c.Members), String(c.Messages), c.PerMinute.toFixed(2), when(c.LastMessage)]);
+	});
+
+	var users = clear("users");
+	row(users, ["Username", "Registered", "Channels", "Devices", "Last posted", "Last polled", "Status"], true);
+	activity.Users.forEach(function (u) {
+		var status = u.Banned ? "banned" : when(u.MutedUntil) != "-" ? "muted until " + when(u.MutedUntil) : "";
+		row(users, [u.Username, u.Registered ? "yes" : "no", (u.Channels || []).join(" "), String(u.Devices),
+			when(u.LastPosted), when(u.LastPolled), status], false, status ? "bad" : "");
+	});
+
+	var moderation = clear("moderation");
+	row(moderation, ["Time", "Operator", "Action", "Username", "Channel", "Duration", "Reason"], true);
+	activity.Moderation.forEach(function (m) {
+		row(moderation, [when(m.Time), m.Operator, m.Action, m.Username, m.Channel,
+			m.DurationSecs ? m.DurationSecs + "s" : "", m.Reason || ""]);
+	});
+}
+
+function refresh() {
+	if (!login) return;
+	var query = "?namespace=" + encodeURIComponent(login.namespace) + "&operator=" + encodeURIComponent(login.operator);
+	fetch("/api/activity" + query, { headers: { "Authorization": "Bearer " + login.token } }).then(function (resp) {
+		return resp.json().then(function (body) {
+			if (resp.status == 401) {
+				login = null;
+				sessionStorage.removeItem("torchat-operator");
+			}
+			if (!resp.ok) throw new Error(body.Error || resp.statusText);
+			return body;
+		});
+	}).then(function (activity) {
+		clear("error");
+		render(activity);
+	}).catch(function (err) {
+		clear("error").textContent = "Could not get the namespace activity: " + err.message;
+	});
+}
+
+document.getElementById("login").addEventListener("submit", function (e) {
+	e.preventDefault();
+	login = {
+		namespace: document.getElementById("namespace").value,
+		operator: document.getElementById("operator").value,
+		token: document.getElementById("token").value
+	};
+	sessionStorage.setItem("torchat-operator", JSON.stringify(login));
+	refresh();
+});
+
+refresh();
+setInterval(refresh, %d);
+</script>
+</body>
+</html>
+`
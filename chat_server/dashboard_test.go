@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"../shared"
+)
+
+func TestServeActivity(t *testing.T) {
+	moderatedNamespace()
+	get := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/activity?namespace=uni&operator=carol", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		serveActivity(w, r)
+		return w
+	}
+
+	if w := get("wrong"); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Fatalf("a wrong token gave %d", w.Code)
+	}
+	w := get("op-token")
+	var activity shared.NamespaceActivity
+	if err := json.NewDecoder(w.Body).Decode(&activity); err != nil || w.Code != http.StatusOK || activity.Namespace != "uni" {
+		t.Fatalf("the activity is %d, %+v, %v", w.Code, activity, err)
+	}
+
+	w = httptest.NewRecorder()
+	serveActivity(w, httptest.NewRequest(http.MethodPost, "/api/activity", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("a POST gave %d", w.Code)
+	}
+}
+
+func TestServeDashboardPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveDashboardPage(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, "%!") || !strings.Contains(body, "setInterval(refresh, 5000)") || strings.Contains(body, "innerHTML") {
+		t.Fatalf("the page gave %d and wasn't filled in as expected", w.Code)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'none'") {
+		t.Fatalf("the page is served with policy %q", csp)
+	}
+
+	w = httptest.NewRecorder()
+	serveDashboardPage(w, httptest.NewRequest(http.MethodGet, "/other", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("another path gave %d", w.Code)
+	}
+}
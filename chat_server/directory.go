@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+// Registers with the directory server so it advertises this chat server to
+// proxies, then keeps sending heartbeats, registering again whenever the
+// directory server has forgotten it
+func announceToDirectory(dirServerAddr string, reg shared.ChatServerRegistration) {
+	dirServer, err := retry.Dial(context.Background(), retry.Background, "tcp", dirServerAddr)
+	if err != nil {
+		util.HandleNonFatalError("Could not dial directory server", err)
+		return
+	}
+
+	registered := false
+	for {
+		var ack bool
+		if !registered {
+			err := dirServer.Call("DServer.RegisterChatServer", reg, &ack)
+			util.HandleNonFatalError("Could not register with directory server", err)
+			if err == nil {
+				util.OutLog.Printf("Registered as %s at %s with directory server %s\n", reg.Name, reg.Address, dirServerAddr)
+				registered = true
+			}
+		} else if err := dirServer.Call("DServer.SendChatServerHeartbeat", reg, &ack); err != nil {
+			util.HandleNonFatalError("Could not send heartbeat to directory server", err)
+			registered = false
+		}
+		time.Sleep(shared.ChatServerHeartbeatInterval)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+
+	"../shared"
+	"../util"
+)
+
+type UnknownMessageError error
+type NotAuthorError error
+
+var (
+	// Edit Errors
+	unknownMessageError UnknownMessageError = errors.New("Message does not exist or has expired")
+	notAuthorError      NotAuthorError      = errors.New("Only the sender can change a message")
+)
+
+// Returns updates after lastUpdateId to messages before seenBefore in the
+// given channels, and the id to poll from next. Messages from seenBefore on are
+// returned in their current state, so their updates are skipped.
+// Caller must hold the namespace lock.
+func (ns *Namespace) updatesSince(channels map[string]bool, lastUpdateId uint32, seenBefore uint32) ([]shared.MessageUpdate, uint32) {
+	nextUpdateId := ns.firstUpdateId + uint32(len(ns.updates))
+	if lastUpdateId < ns.firstUpdateId {
+		lastUpdateId = ns.firstUpdateId
+	}
+	if lastUpdateId > nextUpdateId {
+		lastUpdateId = nextUpdateId
+	}
+
+	updates := make([]shared.MessageUpdate, 0)
+	for _, update := range ns.updates[lastUpdateId-ns.firstUpdateId:] {
+		if update.MessageId >= seenBefore || update.MessageId < ns.firstId {
+			continue
+		}
+		if channels[ns.messages[update.MessageId-ns.firstId].Channel] {
+			updates = append(updates, update)
+		}
+	}
+	return updates, nextUpdateId
+}
+
+// Turns earlier edits of the given messages, which still carry their text,
+// into tombstones. Caller must hold the namespace lock.
+func (ns *Namespace) scrubUpdates(messageIds map[uint32]bool) {
+	if len(messageIds) == 0 {
+		return
+	}
+	for i, update := range ns.updates {
+		if messageIds[update.MessageId] && !update.Deleted {
+			ns.updates[i] = shared.MessageUpdate{MessageId: update.MessageId, Deleted: true}
+		}
+	}
+}
+
+// Looks up a message the requesting user sent. Caller must hold the namespace lock.
+func (ns *Namespace) authoredMessage(req shared.MessageEditRequest) (*StoredMessage, error) {
+	if err := ns.checkCanPublish(req.Username); err != nil {
+		return nil, err
+	}
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.MessageId < ns.firstId || req.MessageId >= ns.firstId+uint32(len(ns.messages)) {
+		return nil, unknownMessageError
+	}
+	msg := &ns.messages[req.MessageId-ns.firstId]
+	if msg.Deleted {
+		return nil, unknownMessageError
+	}
+
+	// Authorship follows the registration, not the name, so it survives nick changes
+	if reg == nil || msg.AuthorId == 0 || msg.AuthorId != reg.Id {
+		return nil, notAuthorError
+	}
+	return msg, nil
+}
+
+func (c *CServer) EditMessage(req shared.MessageEditRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	msg, err := ns.authoredMessage(req)
+	if err != nil {
+		return err
+	}
+	if ns.policy.MaxMessageLength > 0 && len(req.Message) > ns.policy.MaxMessageLength {
+		return messageTooLongError
+	}
+	// A plaintext edit would give away what the channel hid
+	if msg.Encrypted != nil {
+		return encryptedEditError
+	}
+
+	msg.Message = req.Message
+	msg.Edited = true
+	ns.updates = append(ns.updates, shared.MessageUpdate{
+		MessageId: req.MessageId,
+		Message:   msg.String(),
+	})
+	util.OutLog.Printf("[%s] Edited message %d: %s\n", ns.name, req.MessageId, msg.logString())
+
+	*ack = true
+	return nil
+}
+
+// Replaces a message with a tombstone. Clients that already received it are
+// told to remove it on their next poll.
+func (c *CServer) DeleteMessage(req shared.MessageEditRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	msg, err := ns.authoredMessage(req)
+	if err != nil {
+		return err
+	}
+
+	msg.Message = ""
+	msg.Deleted = true
+	ns.updates = append(ns.updates, shared.MessageUpdate{
+		MessageId: req.MessageId,
+		Deleted:   true,
+	})
+	util.OutLog.Printf("[%s] Deleted message %d\n", ns.name, req.MessageId)
+
+	*ack = true
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func editRequest(username string, token string, messageId uint32, message string) shared.MessageEditRequest {
+	return shared.MessageEditRequest{Namespace: "uni", Username: username, UserToken: token, MessageId: messageId, Message: message}
+}
+
+func pollUpdates(t *testing.T, lastMessageId uint32, lastUpdateId uint32) shared.PollingResponse {
+	var resp shared.PollingResponse
+	req := shared.PollingMessage{Namespace: "uni", Username: "bob", UserToken: "token-bob", LastMessageId: lastMessageId, LastUpdateId: lastUpdateId}
+	if err := new(CServer).GetNewMessages(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestOnlyTheSenderChangesAMessage(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {MaxMessageLength: 10}}})
+	if err := publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	for _, test := range []struct {
+		req  shared.MessageEditRequest
+		want error
+	}{
+		{editRequest("bob", "token-bob", 0, "mine now"), notAuthorError},
+		{editRequest("alice", "token-mallory", 0, "mine now"), userNameTakenError},
+		{editRequest("alice", "token-alice", 1, "hello"), unknownMessageError},
+		{editRequest("alice", "token-alice", 0, "far too long"), messageTooLongError},
+	} {
+		if err := new(CServer).EditMessage(test.req, &ack); err != test.want {
+			t.Fatalf("%+v gave %v, want %v", test.req, err, test.want)
+		}
+	}
+
+	// Authorship survives a nick change
+	rename := shared.UserNameRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice", NewUsername: "alicia"}
+	if err := new(CServer).ChangeUserName(rename, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).EditMessage(editRequest("alicia", "token-alice", 0, "hello"), &ack); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEditsAndDeletesReachPollers(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, message := range []string{"one", "two"} {
+		if err := publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := pollUpdates(t, 0, 0)
+	if len(seen.MessageMeta) != 2 || seen.MessageMeta[1].Id != 1 {
+		t.Fatalf("bob got %+v", seen)
+	}
+
+	var ack bool
+	if err := new(CServer).EditMessage(editRequest("alice", "token-alice", 0, "uno"), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).DeleteMessage(editRequest("alice", "token-alice", 1, ""), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).EditMessage(editRequest("alice", "token-alice", 1, "dos"), &ack); err != unknownMessageError {
+		t.Fatalf("editing a deleted message gave %v, want %v", err, unknownMessageError)
+	}
+
+	resp := pollUpdates(t, seen.NextMessageId, seen.NextUpdateId)
+	want := []shared.MessageUpdate{{MessageId: 0, Message: "alice: uno"}, {MessageId: 1, Deleted: true}}
+	if len(resp.Updates) != len(want) || resp.Updates[0] != want[0] || resp.Updates[1] != want[1] {
+		t.Fatalf("bob got updates %+v, want %+v", resp.Updates, want)
+	}
+
+	// A poller that hadn't seen the messages gets them as they are now
+	fresh := pollUpdates(t, 0, 0)
+	if len(fresh.Messages) != 1 || fresh.Messages[0] != "alice: uno" || !fresh.MessageMeta[0].Edited || len(fresh.Updates) != 0 {
+		t.Fatalf("a fresh poll got %+v", fresh)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"../shared"
+)
+
+type ExportNotAllowedError error
+type UnknownExportFormatError error
+
+const (
+	defaultExportChunkBytes int = 16 * 1024 // small enough to come back through a circuit in one cell
+	maxExportChunkBytes     int = 64 * 1024
+)
+
+// A direct message kept for exports. Inboxes drop messages once they are
+// delivered, so this log is the only record, and it follows the namespace's
+// retention policy like the channel log.
+type StoredDirectMessage struct {
+	From    string
+	FromId  uint64 // Registration.Id of the sender, so renames don't lose messages
+	To      string
+	ToId    uint64
+	Message string
+	Time    time.Time
+	Deleted bool // the sender or recipient was forgotten, or it expired
+
+	ExpiresAt time.Time `json:",omitempty"`
+}
+
+var (
+	// Export Errors
+	exportNotAllowedError    ExportNotAllowedError    = errors.New("Only registered members of a channel can export it")
+	unknownExportFormatError UnknownExportFormatError = errors.New("Export format must be json or ndjson")
+)
+
+// Records a direct message for exports. Caller must hold the namespace lock.
+func (ns *Namespace) logDirectMessage(from *Registration, to string, message string, expiresAt time.Time) {
+	msg := StoredDirectMessage{
+		From:      from.Username,
+		FromId:    from.Id,
+		To:        to,
+		Message:   message,
+		Time:      time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	if reg, ok := ns.registrations[to]; ok {
+		msg.ToId = reg.Id
+	}
+	ns.directMessages = append(ns.directMessages, msg)
+	ns.applyRetention()
+}
+
+// Returns one chunk of an archive of a channel the user has joined, or of
+// their direct messages, with messages in [Since, Until]
+func (c *CServer) ExportLog(req shared.ExportRequest, chunk *shared.ExportChunk) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	ns.expireMessages()
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return exportNotAllowedError
+	}
+
+	format := req.Format
+	if format == "" {
+		format = shared.ExportJSON
+	}
+	if format != shared.ExportJSON && format != shared.ExportNDJSON {
+		return unknownExportFormatError
+	}
+
+	maxBytes := req.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultExportChunkBytes
+	}
+	if maxBytes > maxExportChunkBytes {
+		maxBytes = maxExportChunkBytes
+	}
+
+	var records func(start uint32) ([]shared.ExportRecord, uint32)
+	if req.DirectMessages {
+		records = func(start uint32) ([]shared.ExportRecord, uint32) {
+			return ns.directMessageRecords(reg, start)
+		}
+	} else {
+		channel := channelOrDefault(req.Channel)
+		if !ns.joinedChannels(req.Username)[channel] {
+			return exportNotAllowedError
+		}
+		records = func(start uint32) ([]shared.ExportRecord, uint32) {
+			return ns.channelRecords(channel, start)
+		}
+	}
+
+	// Cursors are one past the next id, so 0 can mean the start of the log
+	var start uint32
+	if req.Cursor > 0 {
+		start = req.Cursor - 1
+	}
+	all, nextId := records(start)
+
+	var data bytes.Buffer
+	if format == shared.ExportJSON && req.Cursor == 0 {
+		data.WriteByte('[')
+	}
+
+	written := 0
+	next := nextId
+	for _, record := range all {
+		if (!req.Since.IsZero() && record.Time.Before(req.Since)) || (!req.Until.IsZero() && record.Time.After(req.Until)) {
+			continue
+		}
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		// Every chunk carries at least one record so exports always make progress
+		if written > 0 && data.Len()+len(encoded)+2 > maxBytes {
+			next = record.Id
+			break
+		}
+		if format == shared.ExportJSON && (written > 0 || req.Cursor > 0) {
+			data.WriteByte(',')
+		}
+		data.Write(encoded)
+		if format == shared.ExportNDJSON {
+			data.WriteByte('\n')
+		}
+		written++
+	}
+
+	done := next == nextId
+	if format == shared.ExportJSON && done {
+		data.WriteByte(']')
+	}
+
+	*chunk = shared.ExportChunk{
+		Data:       data.Bytes(),
+		NextCursor: next + 1,
+		Done:       done,
+	}
+	return nil
+}
+
+// Returns the channel's messages from id start on and the next id.
+// Caller must hold the namespace lock.
+func (ns *Namespace) channelRecords(channel string, start uint32) ([]shared.ExportRecord, uint32) {
+	nextId := ns.firstId + uint32(len(ns.messages))
+	if start < ns.firstId {
+		start = ns.firstId
+	}
+	if start > nextId {
+		start = nextId
+	}
+
+	var records []shared.ExportRecord
+	for i, msg := range ns.messages[start-ns.firstId:] {
+		if msg.Channel != channel || msg.Deleted {
+			continue
+		}
+		from := msg.Username
+		if msg.Anonymous {
+			from = anonymousLabel
+		} else if from == "" {
+			from = "***"
+		}
+		// The server can't read encrypted messages, so exports show the placeholder
+		text := msg.Message
+		if msg.Encrypted != nil {
+			text = shared.EncryptedPlaceholder
+		}
+		records = append(records, shared.ExportRecord{
+			Id:      start + uint32(i),
+			Channel: msg.Channel,
+			From:    from,
+			Message: text,
+			Time:    msg.Time,
+			Edited:  msg.Edited,
+		})
+	}
+	return records, nextId
+}
+
+// Returns the direct messages the user sent or received from id start on and
+// the next id. Caller must hold the namespace lock.
+func (ns *Namespace) directMessageRecords(reg *Registration, start uint32) ([]shared.ExportRecord, uint32) {
+	nextId := ns.firstDirectId + uint32(len(ns.directMessages))
+	if start < ns.firstDirectId {
+		start = ns.firstDirectId
+	}
+	if start > nextId {
+		start = nextId
+	}
+
+	var records []shared.ExportRecord
+	for i, msg := range ns.directMessages[start-ns.firstDirectId:] {
+		if msg.Deleted || (msg.FromId != reg.Id && msg.ToId != reg.Id) {
+			continue
+		}
+		records = append(records, shared.ExportRecord{
+			Id:      start + uint32(i),
+			From:    msg.From,
+			To:      msg.To,
+			Message: msg.Message,
+			Time:    msg.Time,
+		})
+	}
+	return records, nextId
+}
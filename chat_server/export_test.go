@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"../shared"
+)
+
+// Fetches every chunk of an export and puts them together
+func exportAll(t *testing.T, req shared.ExportRequest) ([]byte, int) {
+	var data bytes.Buffer
+	chunks := 0
+	for {
+		var chunk shared.ExportChunk
+		if err := new(CServer).ExportLog(req, &chunk); err != nil {
+			t.Fatal(err)
+		}
+		data.Write(chunk.Data)
+		chunks++
+		if chunk.Done {
+			return data.Bytes(), chunks
+		}
+		req.Cursor = chunk.NextCursor
+	}
+}
+
+func TestExportChannelInChunks(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, message := range []string{"one", "two", "three", "four"} {
+		if err := publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := shared.ExportRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice", MaxBytes: 100}
+	data, chunks := exportAll(t, req)
+	var records []shared.ExportRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatalf("the chunks aren't one JSON array: %v\n%s", err, data)
+	}
+	if len(records) != 4 || records[0].Message != "one" || records[3].Message != "four" || records[0].From != "alice" || chunks < 2 {
+		t.Fatalf("exported %+v in %d chunks", records, chunks)
+	}
+
+	req.Format, req.MaxBytes = shared.ExportNDJSON, 0
+	data, _ = exportAll(t, req)
+	if lines := bytes.Count(data, []byte("\n")); lines != 4 {
+		t.Fatalf("exported %d lines, want 4:\n%s", lines, data)
+	}
+	req.Format = "csv"
+	var chunk shared.ExportChunk
+	if err := new(CServer).ExportLog(req, &chunk); err != unknownExportFormatError {
+		t.Fatalf("a csv export gave %v, want %v", err, unknownExportFormatError)
+	}
+}
+
+func TestExportNeedsMembership(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunk shared.ExportChunk
+	for _, req := range []shared.ExportRequest{
+		{Namespace: "uni", Username: "carol"},
+		{Namespace: "uni", Username: "bob", UserToken: "token-bob", Channel: "#go"},
+	} {
+		if err := new(CServer).ExportLog(req, &chunk); err != exportNotAllowedError {
+			t.Fatalf("%+v gave %v, want %v", req, err, exportNotAllowedError)
+		}
+	}
+	if err := new(CServer).ExportLog(shared.ExportRequest{Namespace: "uni", Username: "alice", UserToken: "wrong"}, &chunk); err == nil {
+		t.Fatal("an export with the wrong token was allowed")
+	}
+}
+
+func TestExportDirectMessages(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, username := range []string{"bob", "carol"} {
+		if err := registerUserName(username, "token-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sendDirectMessage("alice", "bob", "to bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "carol", "to carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob's archive keeps the message after he read it, and doesn't have carol's
+	pollInbox(t, "bob", 0)
+	data, _ := exportAll(t, shared.ExportRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob", DirectMessages: true})
+	var records []shared.ExportRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].From != "alice" || records[0].To != "bob" || records[0].Message != "to bob" {
+		t.Fatalf("bob exported %+v", records)
+	}
+}
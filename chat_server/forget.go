@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+
+	"../shared"
+	"../util"
+)
+
+type NotRegisteredError error
+
+var (
+	// Forget Errors
+	notRegisteredError NotRegisteredError = errors.New("Only a registered username can be forgotten")
+)
+
+// Deletes the user's registration and everything kept about them. Messages
+// become tombstones, so polling clients remove them like deleted messages and
+// message ids stay stable. The username may be registered again afterwards;
+// bans are kept.
+func (c *CServer) ForgetUser(req shared.ForgetRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return notRegisteredError
+	}
+
+	messages, directMessages := ns.forget(reg)
+	util.OutLog.Printf("[%s] Forgot %s: %d messages, %d direct messages\n", ns.name, reg.Username, messages, directMessages)
+
+	*ack = true
+	return nil
+}
+
+// Removes a registration and the data tied to it, and returns how many
+// messages and direct messages were deleted. Caller must hold the namespace lock.
+func (ns *Namespace) forget(reg *Registration) (int, int) {
+	// Earlier names count too, unless someone else has taken them since
+	names := map[string]bool{reg.Username: true}
+	for _, previous := range reg.PreviousNames {
+		if _, taken := ns.registrations[previous]; !taken {
+			names[previous] = true
+		}
+	}
+
+	messages := 0
+	authored := make(map[uint32]bool)
+	for i, msg := range ns.messages {
+		if msg.AuthorId != reg.Id {
+			continue
+		}
+		authored[ns.firstId+uint32(i)] = true
+		// The channel stays so the update only reaches its members
+		ns.messages[i] = StoredMessage{Channel: msg.Channel, Time: msg.Time, Deleted: true}
+		if !msg.Deleted {
+			ns.updates = append(ns.updates, shared.MessageUpdate{
+				MessageId: ns.firstId + uint32(i),
+				Deleted:   true,
+			})
+			messages++
+		}
+	}
+
+	ns.scrubUpdates(authored)
+
+	directMessages := 0
+	for i, msg := range ns.directMessages {
+		if msg.FromId == reg.Id || msg.ToId == reg.Id {
+			if !msg.Deleted {
+				directMessages++
+			}
+			ns.directMessages[i] = StoredDirectMessage{Time: msg.Time, Deleted: true}
+		}
+	}
+
+	// Inboxes are kept so their ids never go backwards, see expireInboxes
+	for username, inbox := range ns.inboxes {
+		if names[username] {
+			inbox.messages = nil
+			continue
+		}
+		kept := inbox.messages[:0]
+		for _, msg := range inbox.messages {
+			if !names[msg.From] {
+				kept = append(kept, msg)
+			}
+		}
+		inbox.messages = kept
+	}
+
+	kept := ns.presence[:0]
+	for _, record := range ns.presence {
+		if !names[record.Event.Username] {
+			kept = append(kept, record)
+		}
+	}
+	ns.presence = kept
+
+	for name := range names {
+		delete(ns.users, name)
+		delete(ns.memberships, name)
+		delete(ns.sessions, name)
+		delete(ns.readMarkers, name)
+		delete(ns.lastPolled, name)
+	}
+	delete(ns.registrations, reg.Username)
+	delete(ns.tokensIssued, reg.Id)
+	delete(ns.prekeys, reg.Id)
+	delete(ns.rosters, reg.Id)
+	ns.forgetApprovals(reg)
+	ns.forgetBlocks(reg)
+
+	return messages, directMessages
+}
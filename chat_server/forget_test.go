@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func forgetUser(username string, token string) error {
+	var ack bool
+	return new(CServer).ForgetUser(shared.ForgetRequest{Namespace: "uni", Username: username, UserToken: token}, &ack)
+}
+
+func TestForgetUser(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, message := range []string{"one", "two"} {
+		if err := publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publish("uni", "bob", "three"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	if err := new(CServer).EditMessage(editRequest("alice", "token-alice", 0, "uno"), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	seen := pollUpdates(t, 0, 0)
+
+	if err := forgetUser("carol", "token-carol"); err != notRegisteredError {
+		t.Fatalf("forgetting an unregistered user gave %v, want %v", err, notRegisteredError)
+	}
+	if err := forgetUser("alice", "token-mallory"); err == nil {
+		t.Fatal("a user was forgotten with the wrong token")
+	}
+	if err := forgetUser("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pollers are told to remove the messages, and the edit no longer carries the text
+	resp := pollUpdates(t, seen.NextMessageId, seen.NextUpdateId)
+	if len(resp.Updates) != 2 || !resp.Updates[0].Deleted || !resp.Updates[1].Deleted || len(resp.Inbox) != 0 {
+		t.Fatalf("bob got %+v", resp)
+	}
+	for _, update := range pollUpdates(t, 0, 0).Updates {
+		if update.Message != "" {
+			t.Fatalf("an update still holds %q", update.Message)
+		}
+	}
+	if fresh := pollUpdates(t, 0, 0); len(fresh.Messages) != 1 || fresh.Messages[0] != "bob: three" || fresh.NextMessageId != 3 {
+		t.Fatalf("a fresh poll got %+v", fresh)
+	}
+
+	// The name is free again
+	if err := registerUserName("alice", "token-new"); err != nil {
+		t.Fatal(err)
+	}
+}
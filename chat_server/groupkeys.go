@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"../shared"
+	"../util"
+)
+
+type EncryptionError error
+
+const (
+	encryptionKeySize int = 32 // X25519
+	gcmOverhead       int = 16 // tag added to every encrypted message
+)
+
+var (
+	// Encryption Errors
+	invalidEncryptionKeyError  EncryptionError = errors.New("Encryption keys must be 32 byte X25519 public keys")
+	encryptionKeyMismatchError EncryptionError = errors.New("A different encryption key is registered for this username")
+	notChannelMemberError      EncryptionError = errors.New("Only members of a channel can get its members' keys")
+	mixedPayloadError          EncryptionError = errors.New("A message carries one of a plaintext, an encrypted text, a sender key and a ratchet message")
+	senderKeyRecipientError    EncryptionError = errors.New("Sender keys and ratchet messages are sent as direct messages, and encrypted messages to channels")
+	encryptedEditError         EncryptionError = errors.New("Encrypted messages can't be edited")
+)
+
+// Registers the key sender keys for reg are sealed to, if reg has none yet.
+// Caller must hold the namespace lock.
+func (ns *Namespace) registerEncryptionKey(reg *Registration, key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if len(key) != encryptionKeySize {
+		return invalidEncryptionKeyError
+	}
+	if reg.EncryptionKey == nil {
+		reg.EncryptionKey = append([]byte(nil), key...)
+		return nil
+	}
+	if !bytes.Equal(reg.EncryptionKey, key) {
+		return encryptionKeyMismatchError
+	}
+	return nil
+}
+
+// Checks that a message carries at most one of a plaintext, an encrypted
+// text, a sender key and a ratchet message, each where it belongs, and that
+// an encrypted text is within the namespace's length limit
+func (ns *Namespace) checkPayload(chatMessage shared.ChatMessage) error {
+	payloads := 0
+	for _, set := range []bool{chatMessage.Encrypted != nil, chatMessage.SenderKey != nil, chatMessage.Ratchet != nil} {
+		if set {
+			payloads++
+		}
+	}
+	if payloads == 0 {
+		return nil
+	}
+	if chatMessage.Message != "" || payloads > 1 {
+		return mixedPayloadError
+	}
+	if (chatMessage.Encrypted != nil) != (chatMessage.Recipient == "") {
+		return senderKeyRecipientError
+	}
+
+	var ciphertext []byte
+	if chatMessage.Encrypted != nil {
+		ciphertext = chatMessage.Encrypted.Ciphertext
+	} else if chatMessage.Ratchet != nil {
+		ciphertext = chatMessage.Ratchet.Ciphertext
+	}
+	if ns.policy.MaxMessageLength > 0 && len(ciphertext) > ns.policy.MaxMessageLength+gcmOverhead {
+		return messageTooLongError
+	}
+	return nil
+}
+
+// Queues a sender key for its recipient. Sender keys aren't chat, so they
+// skip the direct message log and are handed to the recipient's proxy apart
+// from the inbox. Caller must hold the namespace lock.
+func (ns *Namespace) deliverSenderKey(chatMessage shared.ChatMessage) error {
+	envelope := *chatMessage.SenderKey
+	envelope.From = chatMessage.Username
+	err := ns.deliverToInbox(chatMessage.Recipient, InboxMessage{
+		From:      chatMessage.Username,
+		SenderKey: &envelope,
+	})
+	if err != nil {
+		return err
+	}
+	ns.rememberSignature(chatMessage)
+	util.OutLog.Printf("[%s] Sender key %s -> %s\n", ns.name, chatMessage.Username, chatMessage.Recipient)
+	return nil
+}
+
+// Returns the encryption keys of a channel's registered members, so a member
+// can seal their sender key to each of them
+func (c *CServer) GetChannelKeys(req shared.ChannelKeysRequest, resp *shared.ChannelKeysResponse) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	if _, err = ns.authenticate(req.Username, req.UserToken, false); err != nil {
+		return err
+	}
+	channel := channelOrDefault(req.Channel)
+	if !ns.joinedChannels(req.Username)[channel] {
+		return notChannelMemberError
+	}
+
+	members := make([]shared.MemberKey, 0)
+	for username, reg := range ns.registrations {
+		if reg.EncryptionKey == nil || ns.banned[username] || !ns.isMember(username, channel) {
+			continue
+		}
+		members = append(members, shared.MemberKey{Username: username, EncryptionKey: reg.EncryptionKey})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Username < members[j].Username })
+
+	*resp = shared.ChannelKeysResponse{Members: members}
+	return nil
+}
+
+// Like joinedChannels, without making a membership for users who have none
+// yet. Caller must hold the namespace lock.
+func (ns *Namespace) isMember(username string, channel string) bool {
+	channels, ok := ns.memberships[username]
+	if !ok {
+		return channel == shared.DefaultChannel
+	}
+	return channels[channel]
+}
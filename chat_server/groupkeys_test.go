@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"../shared"
+)
+
+func registerEncryptionKey(username string, key []byte) error {
+	var ack bool
+	return new(CServer).RegisterUserName(shared.UserNameRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, EncryptionKey: key}, &ack)
+}
+
+func TestChannelKeys(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	aliceKey, bobKey := bytes.Repeat([]byte{1}, encryptionKeySize), bytes.Repeat([]byte{2}, encryptionKeySize)
+	if err := registerEncryptionKey("alice", []byte("short")); err != invalidEncryptionKeyError {
+		t.Fatalf("a short key gave %v, want %v", err, invalidEncryptionKeyError)
+	}
+	for username, key := range map[string][]byte{"alice": aliceKey, "bob": bobKey} {
+		if err := registerEncryptionKey(username, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := registerEncryptionKey("alice", bobKey); err != encryptionKeyMismatchError {
+		t.Fatalf("a second key gave %v, want %v", err, encryptionKeyMismatchError)
+	}
+	if err := registerUserName("carol", "token-carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp shared.ChannelKeysResponse
+	if err := new(CServer).GetChannelKeys(shared.ChannelKeysRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Members) != 2 || resp.Members[0].Username != "alice" || !bytes.Equal(resp.Members[1].EncryptionKey, bobKey) {
+		t.Fatalf("got keys %+v", resp.Members)
+	}
+	if err := new(CServer).GetChannelKeys(shared.ChannelKeysRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice", Channel: "#go"}, &resp); err != notChannelMemberError {
+		t.Fatalf("a channel alice isn't in gave %v, want %v", err, notChannelMemberError)
+	}
+}
+
+func TestEncryptedPayloads(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := &shared.EncryptedMessage{KeyId: "k", Nonce: []byte("nonce"), Ciphertext: []byte("ciphertext")}
+	envelope := &shared.SenderKeyEnvelope{Ephemeral: []byte("e"), Ciphertext: []byte("sealed")}
+	var ack bool
+	for _, test := range []struct {
+		msg  shared.ChatMessage
+		want error
+	}{
+		{shared.ChatMessage{Message: "plain", Encrypted: encrypted}, mixedPayloadError},
+		{shared.ChatMessage{Encrypted: encrypted, SenderKey: envelope, Recipient: "bob"}, mixedPayloadError},
+		{shared.ChatMessage{Encrypted: encrypted, Recipient: "bob"}, senderKeyRecipientError},
+		{shared.ChatMessage{SenderKey: envelope}, senderKeyRecipientError},
+	} {
+		test.msg.Namespace, test.msg.Username, test.msg.UserToken = "uni", "alice", "token-alice"
+		if err := new(CServer).PublishMessage(test.msg, &ack); err != test.want {
+			t.Fatalf("%+v gave %v, want %v", test.msg, err, test.want)
+		}
+	}
+
+	// The server shows a placeholder, and hands sender keys over apart from the inbox
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Username: "alice", UserToken: "token-alice", Encrypted: encrypted}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Username: "alice", UserToken: "token-alice", Recipient: "bob", SenderKey: envelope}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	resp := pollInbox(t, "bob", 0)
+	if len(resp.Messages) != 1 || resp.Messages[0] != "alice: "+shared.EncryptedPlaceholder || resp.MessageMeta[0].Encrypted == nil {
+		t.Fatalf("bob got %+v", resp)
+	}
+	if len(resp.Inbox) != 0 || len(resp.SenderKeys) != 1 || resp.SenderKeys[0].From != "alice" {
+		t.Fatalf("bob got inbox %q and sender keys %+v", resp.Inbox, resp.SenderKeys)
+	}
+}
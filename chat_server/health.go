@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"../util"
+)
+
+type NotListeningError error
+
+var (
+	// Health Errors
+	notListeningError NotListeningError = errors.New("Not accepting RPC connections yet")
+
+	listening int32 // set once the RPC listener is open
+)
+
+// The IRC server is ready once proxies and exit nodes can reach its RPC port
+var healthChecks = []util.HealthCheck{
+	{Name: "rpc", Check: func() error {
+		if atomic.LoadInt32(&listening) == 0 {
+			return notListeningError
+		}
+		return nil
+	}},
+}
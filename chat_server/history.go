@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type HistoryKeyError error
+type HistoryFileError error
+
+const (
+	// History configurations
+	historySaveInterval time.Duration = 10 * time.Second
+	historyFileSuffix   string        = ".history"
+	historyFormat       int           = 1
+)
+
+// The message history of one namespace as it is encrypted into its file
+type namespaceHistory struct {
+	FirstId  uint32
+	Messages []StoredMessage
+
+	FirstUpdateId uint32
+	Updates       []shared.MessageUpdate
+
+	FirstDirectId  uint32
+	DirectMessages []StoredDirectMessage
+
+	// Registrations are kept so their users can still edit and forget the
+	// messages they sent before a restart, and ids are never handed out
+	// again so a new user can't edit the messages of an old one
+	Registrations []Registration `json:",omitempty"`
+	NextUserId    uint64
+}
+
+// A history file. Data is the namespaceHistory as JSON, sealed with AES-GCM
+// under the server's history key, with the namespace name as additional data
+// so files can't be swapped between namespaces.
+type historyFile struct {
+	Format int
+	Nonce  []byte
+	Data   []byte
+}
+
+// Where histories are kept, and the digest of what was last written for each
+// namespace so unchanged histories aren't written again
+type historyStore struct {
+	dir     string
+	aead    cipher.AEAD
+	written map[string][sha256.Size]byte
+}
+
+var (
+	// History Errors
+	historyKeyError  HistoryKeyError  = errors.New("History key must be 64 hex digits (32 bytes)")
+	historyFileError HistoryFileError = errors.New("History file is not in a known format")
+)
+
+// Opens the history directory with a hex encoded AES-256 key. The key should
+// be kept apart from the directory, or encrypting it gains nothing.
+func openHistory(dir string, hexKey string) (*historyStore, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil || len(key) != 32 {
+		return nil, historyKeyError
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &historyStore{dir: dir, aead: aead, written: make(map[string][sha256.Size]byte)}, nil
+}
+
+// Namespace names may hold any character, so files are named by their hex
+func (h *historyStore) path(namespace string) string {
+	return filepath.Join(h.dir, hex.EncodeToString([]byte(namespace))+historyFileSuffix)
+}
+
+func (h *historyStore) seal(namespace string, plaintext []byte) (historyFile, error) {
+	nonce := make([]byte, h.aead.NonceSize())
+	if _, err := io.ReadFull(util.Random, nonce); err != nil {
+		return historyFile{}, err
+	}
+	return historyFile{
+		Format: historyFormat,
+		Nonce:  nonce,
+		Data:   h.aead.Seal(nil, nonce, plaintext, []byte(namespace)),
+	}, nil
+}
+
+func (h *historyStore) open(namespace string, file historyFile) ([]byte, error) {
+	if file.Format != historyFormat || len(file.Nonce) != h.aead.NonceSize() {
+		return nil, historyFileError
+	}
+	return h.aead.Open(nil, file.Nonce, file.Data, []byte(namespace))
+}
+
+// Restores the history of every namespace in the directory. A file that
+// doesn't decrypt is an error rather than skipped, so a wrong key doesn't
+// get the history overwritten with an empty one.
+func (h *historyStore) load() error {
+	paths, err := filepath.Glob(filepath.Join(h.dir, "*"+historyFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(path), historyFileSuffix))
+		if err != nil {
+			continue
+		}
+		namespace := string(name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var file historyFile
+		if err = json.Unmarshal(data, &file); err != nil {
+			return errors.New(path + ": " + historyFileError.Error())
+		}
+		plaintext, err := h.open(namespace, file)
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+		var saved namespaceHistory
+		err = json.Unmarshal(plaintext, &saved)
+		digest := sha256.Sum256(plaintext)
+		secmem.Wipe(plaintext)
+		if err != nil {
+			return errors.New(path + ": " + err.Error())
+		}
+
+		ns, err := getNamespace(namespace)
+		if err != nil {
+			util.HandleNonFatalError("Not restoring history of namespace "+namespace, err)
+			continue
+		}
+		ns.Lock()
+		ns.restoreHistory(saved)
+		ns.Unlock()
+		h.written[namespace] = digest
+		util.OutLog.Printf("[%s] Restored %d messages from history\n", namespace, len(saved.Messages))
+	}
+	return nil
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) restoreHistory(saved namespaceHistory) {
+	ns.firstId = saved.FirstId
+	ns.messages = append(make([]StoredMessage, 0, len(saved.Messages)), saved.Messages...)
+	ns.firstUpdateId = saved.FirstUpdateId
+	ns.updates = saved.Updates
+	ns.firstDirectId = saved.FirstDirectId
+	ns.directMessages = saved.DirectMessages
+	for _, reg := range saved.Registrations {
+		reg := reg
+		ns.registrations[reg.Username] = &reg
+		if reg.Id > ns.nextUserId {
+			ns.nextUserId = reg.Id
+		}
+	}
+	if saved.NextUserId > ns.nextUserId {
+		ns.nextUserId = saved.NextUserId
+	}
+	for _, msg := range ns.messages {
+		if !msg.Deleted {
+			ns.scheduleExpiry(msg.ExpiresAt)
+		}
+	}
+	for _, msg := range ns.directMessages {
+		if !msg.Deleted {
+			ns.scheduleExpiry(msg.ExpiresAt)
+		}
+	}
+	ns.applyRetention()
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) historySnapshot() namespaceHistory {
+	registrations := make([]Registration, 0, len(ns.registrations))
+	for _, reg := range ns.registrations {
+		registrations = append(registrations, *reg)
+	}
+	// Map order would make every snapshot differ, and every save a write
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].Id < registrations[j].Id })
+
+	return namespaceHistory{
+		FirstId:        ns.firstId,
+		Messages:       ns.messages,
+		FirstUpdateId:  ns.firstUpdateId,
+		Updates:        ns.updates,
+		FirstDirectId:  ns.firstDirectId,
+		DirectMessages: ns.directMessages,
+		Registrations:  registrations,
+		NextUserId:     ns.nextUserId,
+	}
+}
+
+// Writes the history of every namespace that changed since it was last
+// written
+func (h *historyStore) save() error {
+	namespaces.RLock()
+	all := make(map[string]*Namespace, len(namespaces.all))
+	for name, ns := range namespaces.all {
+		all[name] = ns
+	}
+	namespaces.RUnlock()
+
+	for name, ns := range all {
+		// Messages whose TTL ran out never reach the disk again
+		ns.Lock()
+		ns.expireMessages()
+		plaintext, err := json.Marshal(ns.historySnapshot())
+		ns.Unlock()
+		if err != nil {
+			return err
+		}
+
+		digest := sha256.Sum256(plaintext)
+		if last, ok := h.written[name]; ok && last == digest {
+			continue
+		}
+		file, err := h.seal(name, plaintext)
+		secmem.Wipe(plaintext)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(file)
+		if err != nil {
+			return err
+		}
+		tmp := h.path(name) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, h.path(name)); err != nil {
+			return err
+		}
+		h.written[name] = digest
+	}
+	return nil
+}
+
+// Saves histories every historySaveInterval, and once more before the server
+// exits on SIGINT or SIGTERM
+func (h *historyStore) persist() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(historySaveInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			util.HandleNonFatalError("Could not save message history", h.save())
+		case sig := <-signals:
+			util.HandleNonFatalError("Could not save message history", h.save())
+			util.OutLog.Printf("Saved message history, exiting on %v\n", sig)
+			os.Exit(0)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testHistoryKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+func TestHistoryRoundTrip(t *testing.T) {
+	defer resetNamespaces(NamespaceConfig{})
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	dir := t.TempDir()
+	store, err := openHistory(dir, testHistoryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"first", "a secret plan"} {
+		if err = publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(store.path("uni"))
+	if err != nil || strings.Contains(string(data), "secret plan") {
+		t.Fatalf("the history file holds %q, %v", data, err)
+	}
+
+	// A restarted server carries on from the same ids
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	restarted, err := openHistory(dir, testHistoryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 1); len(resp.Messages) != 1 || resp.Messages[0] != "alice: a secret plan" || resp.NextMessageId != 2 {
+		t.Fatalf("the restored history gave %+v", resp)
+	}
+
+	// Unchanged histories aren't written again
+	if err = os.Remove(restarted.path("uni")); err != nil {
+		t.Fatal(err)
+	}
+	if err = restarted.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(restarted.path("uni")); !os.IsNotExist(err) {
+		t.Fatal("an unchanged history was written again")
+	}
+}
+
+func TestHistoryNeedsItsKey(t *testing.T) {
+	defer resetNamespaces(NamespaceConfig{})
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	dir := t.TempDir()
+	for _, key := range []string{"", "00", strings.Repeat("zz", 32)} {
+		if _, err := openHistory(dir, key); err != historyKeyError {
+			t.Fatalf("key %q gave %v, want %v", key, err, historyKeyError)
+		}
+	}
+	store, err := openHistory(dir, testHistoryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openHistory(dir, strings.Repeat("ff", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.load(); err == nil {
+		t.Fatal("a history was restored with the wrong key")
+	}
+
+	// Nor can a file be moved to another namespace
+	if err = os.Rename(store.path("uni"), store.path("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.load(); err == nil || !strings.Contains(err.Error(), filepath.Base(store.path("other"))) {
+		t.Fatalf("a history moved between namespaces gave %v", err)
+	}
+}
+
+func TestHistoryKeepsRegistrations(t *testing.T) {
+	defer resetNamespaces(NamespaceConfig{})
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	dir := t.TempDir()
+	store, err := openHistory(dir, testHistoryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err = publish("uni", username, "hi from "+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	restarted, err := openHistory(dir, testHistoryKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = restarted.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err = registerUserName("alice", "token-mallory"); err != userNameTakenError {
+		t.Fatalf("taking a restored name gave %v, want %v", err, userNameTakenError)
+	}
+	// Forgetting still finds the messages sent before the restart
+	if err = forgetUser("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 0); len(resp.Messages) != 1 || resp.Messages[0] != "bob: hi from bob" {
+		t.Fatalf("after forgetting alice the history gave %+v", resp)
+	}
+	if err = registerUserName("carol", "token-carol"); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := getNamespace("uni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.RLock()
+	carol, bob := ns.registrations["carol"], ns.registrations["bob"]
+	ns.RUnlock()
+	if carol.Id <= bob.Id {
+		t.Fatalf("a new user got id %d after a restored one of %d", carol.Id, bob.Id)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"../shared"
+)
+
+type UnknownRecipientError error
+
+const (
+	defaultInboxSize    int   = 100              // messages kept per inbox, oldest dropped first
+	defaultInboxTTL     int64 = 7 * 24 * 60 * 60 // seconds a queued message is kept
+	pollingOnlineWindow int64 = 10               // seconds after a poll that a user counts as online
+)
+
+// Direct messages and mentions queued for one user. Messages stay queued until
+// every device of the user acknowledges them with LastInboxId, so they
+// survive disconnects and lost poll responses.
+type Inbox struct {
+	messages []InboxMessage
+	nextId   uint32
+}
+
+type InboxMessage struct {
+	Id      uint32
+	From    string
+	Channel string // empty for direct messages
+	Message string
+	Time    time.Time
+
+	ExpiresAt time.Time // dropped then, for direct messages sent with a TTL
+
+	SenderKey *shared.SenderKeyEnvelope // set instead of Message for sender keys of encrypted channels
+	Ratchet   *shared.RatchetEnvelope   // or for encrypted direct messages
+	Contact   *shared.ContactEvent      // or for contact requests and their answers
+}
+
+var (
+	// Inbox Errors
+	unknownRecipientError UnknownRecipientError = errors.New("Recipient is not registered in this namespace")
+)
+
+func (msg InboxMessage) String() string {
+	if msg.Channel == "" {
+		return "[DM] " + msg.From + ": " + msg.Message
+	}
+	return "[mention in " + msg.Channel + "] " + msg.From + ": " + msg.Message
+}
+
+func (ns *Namespace) inboxSize() int {
+	if ns.policy.InboxSize > 0 {
+		return ns.policy.InboxSize
+	}
+	return defaultInboxSize
+}
+
+func (ns *Namespace) inboxTTL() time.Duration {
+	if ns.policy.InboxTTLSecs > 0 {
+		return time.Duration(ns.policy.InboxTTLSecs) * time.Second
+	}
+	return time.Duration(defaultInboxTTL) * time.Second
+}
+
+// Users count as online while their proxy keeps polling. Caller must hold the namespace lock.
+func (ns *Namespace) isPolling(username string) bool {
+	lastPolled, ok := ns.lastPolled[username]
+	return ok && time.Since(lastPolled) < time.Duration(pollingOnlineWindow)*time.Second
+}
+
+// Queues a message for a registered user. Messages from users the recipient
+// blocked are dropped without telling the sender. Caller must hold the
+// namespace lock.
+func (ns *Namespace) deliverToInbox(recipient string, msg InboxMessage) error {
+	if _, ok := ns.registrations[recipient]; !ok {
+		return unknownRecipientError
+	}
+	if ns.isBlocked(recipient, msg.From) {
+		return nil
+	}
+
+	inbox, ok := ns.inboxes[recipient]
+	if !ok {
+		inbox = &Inbox{}
+		ns.inboxes[recipient] = inbox
+	}
+
+	msg.Id = inbox.nextId
+	msg.Time = time.Now()
+	inbox.nextId++
+	inbox.messages = append(inbox.messages, msg)
+	ns.expireInbox(inbox)
+
+	return nil
+}
+
+// Queues a channel message for mentioned users who are not polling and can
+// see the channel. The copies expire with the message, if it has a TTL.
+// Caller must hold the namespace lock.
+func (ns *Namespace) queueMentions(channel string, from string, message string, expiresAt time.Time) {
+	for _, word := range strings.Fields(message) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		mentioned := strings.TrimRight(strings.TrimPrefix(word, "@"), ".,:;!?")
+
+		// Mentions of unregistered names are just words
+		if _, registered := ns.registrations[mentioned]; !registered || mentioned == from {
+			continue
+		}
+		if ns.isPolling(mentioned) || ns.banned[mentioned] || !ns.joinedChannels(mentioned)[channel] {
+			continue
+		}
+
+		ns.deliverToInbox(mentioned, InboxMessage{
+			From:      from,
+			Channel:   channel,
+			Message:   message,
+			ExpiresAt: expiresAt,
+		})
+	}
+}
+
+// Drops messages past the inbox's size cap or TTL. Caller must hold the namespace lock.
+func (ns *Namespace) expireInbox(inbox *Inbox) {
+	drop := 0
+	if len(inbox.messages) > ns.inboxSize() {
+		drop = len(inbox.messages) - ns.inboxSize()
+	}
+
+	cutoff := time.Now().Add(-ns.inboxTTL())
+	for drop < len(inbox.messages) && inbox.messages[drop].Time.Before(cutoff) {
+		drop++
+	}
+
+	if drop > 0 {
+		inbox.messages = append([]InboxMessage(nil), inbox.messages[drop:]...)
+	}
+
+	// Messages with a TTL may run out anywhere in the inbox
+	now := time.Now()
+	kept := inbox.messages[:0]
+	for _, msg := range inbox.messages {
+		if msg.ExpiresAt.IsZero() || now.Before(msg.ExpiresAt) {
+			kept = append(kept, msg)
+		}
+	}
+	inbox.messages = kept
+}
+
+// Records that the device has seen inbox messages before lastInboxId, drops
+// messages every device of the user has seen, and returns the ones this device
+// has not with the id to acknowledge them with next. Caller must hold the namespace lock.
+func (ns *Namespace) takeInbox(username string, sess *Session, lastInboxId uint32) ([]InboxMessage, uint32) {
+	inbox, ok := ns.inboxes[username]
+	if !ok {
+		return nil, 0
+	}
+
+	// A cursor ahead of the inbox (e.g. after a restart) acknowledges nothing
+	if lastInboxId > inbox.nextId {
+		lastInboxId = 0
+	}
+	sess.LastInboxId = lastInboxId
+
+	ackedByAll := ns.inboxAckedByAll(username)
+	acked := 0
+	for acked < len(inbox.messages) && inbox.messages[acked].Id < ackedByAll {
+		acked++
+	}
+	inbox.messages = append([]InboxMessage(nil), inbox.messages[acked:]...)
+	ns.expireInbox(inbox)
+
+	messages := make([]InboxMessage, 0, len(inbox.messages))
+	for _, msg := range inbox.messages {
+		if msg.Id >= lastInboxId {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, inbox.nextId
+}
+
+// Expires queued messages of users who never come back. Inboxes themselves
+// are kept so their ids never go backwards. Caller must hold the namespace lock.
+func (ns *Namespace) expireInboxes() {
+	for _, inbox := range ns.inboxes {
+		ns.expireInbox(inbox)
+	}
+}
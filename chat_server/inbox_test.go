@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func sendDirectMessage(from string, to string, message string) error {
+	var ack bool
+	return new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Username: from, UserToken: "token-" + from, Recipient: to, Message: message}, &ack)
+}
+
+func pollInbox(t *testing.T, username string, lastInboxId uint32) shared.PollingResponse {
+	var resp shared.PollingResponse
+	req := shared.PollingMessage{Namespace: "uni", Username: username, UserToken: "token-" + username, LastInboxId: lastInboxId}
+	if err := new(CServer).GetNewMessages(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestDirectMessagesWaitForAcknowledgement(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {InboxSize: 2}}})
+	if err := sendDirectMessage("alice", "bob", "hi"); err != unknownRecipientError {
+		t.Fatalf("a DM to an unregistered user gave %v, want %v", err, unknownRecipientError)
+	}
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []string{"one", "two", "three"} {
+		if err := sendDirectMessage("alice", "bob", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The oldest message went past the inbox size, and DMs stay out of the shared log
+	resp := pollInbox(t, "bob", 0)
+	if len(resp.Inbox) != 2 || resp.Inbox[0] != "[DM] alice: two" || resp.NextInboxId != 3 || len(resp.Messages) != 0 {
+		t.Fatalf("bob got %+v", resp)
+	}
+	if again := pollInbox(t, "bob", 0); len(again.Inbox) != 2 {
+		t.Fatalf("unacknowledged messages were dropped: %+v", again.Inbox)
+	}
+	if acked := pollInbox(t, "bob", resp.NextInboxId); len(acked.Inbox) != 0 {
+		t.Fatalf("acknowledged messages were kept: %+v", acked.Inbox)
+	}
+
+	// Someone else polling as bob without his token reads nothing
+	var other shared.PollingResponse
+	if err := new(CServer).GetNewMessages(shared.PollingMessage{Namespace: "uni", Username: "bob"}, &other); err != userNameTakenError {
+		t.Fatalf("polling bob's inbox without a token gave %v, want %v", err, userNameTakenError)
+	}
+}
+
+func TestMentionsQueueForOfflineUsers(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, username := range []string{"bob", "carol"} {
+		if err := registerUserName(username, "token-"+username); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Carol is polling, so she sees the mention in the channel instead
+	pollInbox(t, "carol", 0)
+
+	if err := publish("uni", "alice", "hey @bob, @carol and @nobody!"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := pollInbox(t, "bob", 0); len(resp.Inbox) != 1 || resp.Inbox[0] != "[mention in #general] alice: hey @bob, @carol and @nobody!" {
+		t.Fatalf("bob got %q", resp.Inbox)
+	}
+	if resp := pollInbox(t, "carol", 0); len(resp.Inbox) != 0 {
+		t.Fatalf("carol was online but got %q", resp.Inbox)
+	}
+}
+
+func TestInboxTTL(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {InboxTTLSecs: 60}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := getNamespace("uni")
+	ns.Lock()
+	ns.inboxes["bob"].messages[0].Time = time.Now().Add(-2 * time.Minute)
+	ns.expireInboxes()
+	ns.Unlock()
+
+	if resp := pollInbox(t, "bob", 0); len(resp.Inbox) != 0 || resp.NextInboxId != 1 {
+		t.Fatalf("an expired message was kept: %+v", resp)
+	}
+}
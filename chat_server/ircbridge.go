@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	ircServerName   string        = "torchat"
+	ircPollInterval time.Duration = 500 * time.Millisecond // how often bridged clients are sent new messages
+	ircMaxLineBytes int           = 512                    // RFC 1459 limit, including the trailing CRLF
+)
+
+// One IRC client connected to the bridge. IRC nicks are TorChat usernames and
+// IRC channels are TorChat channels of the bridged namespace, so both sides
+// see each other's messages.
+type ircConn struct {
+	writeMutex sync.Mutex
+	conn       net.Conn
+	writer     *bufio.Writer
+
+	ns         *Namespace
+	remoteHost string
+	deviceId   string // session of the bridge connection, next to the user's proxies
+
+	// Only used by the goroutine reading from the client
+	token         string // from PASS, or random, in which case only this connection can use the nick
+	requestedNick string
+	gotUser       bool
+
+	nick string // set once registered; changed only under the namespace lock
+}
+
+var ircDeviceIds = struct {
+	sync.Mutex
+	next int
+}{}
+
+// Accepts IRC clients on addr for the namespace. Runs until the listener fails.
+func serveIRC(addr string, namespace string) {
+	ns, err := getNamespace(namespace)
+	util.HandleFatalError("Could not open IRC bridge namespace", err)
+
+	listener, err := net.Listen("tcp", addr)
+	util.HandleFatalError("Error starting IRC bridge", err)
+	util.OutLog.Printf("IRC bridge for namespace %s is listening on addr/port: %s\n", ns.name, listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Error accepting IRC client", err)
+			continue
+		}
+
+		ircDeviceIds.Lock()
+		ircDeviceIds.next++
+		deviceId := fmt.Sprintf("irc-%d", ircDeviceIds.next)
+		ircDeviceIds.Unlock()
+
+		remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		c := &ircConn{
+			conn:       conn,
+			writer:     bufio.NewWriter(conn),
+			ns:         ns,
+			remoteHost: remoteHost,
+			deviceId:   deviceId,
+		}
+		go c.serve()
+	}
+}
+
+// Splits an IRC line into its command and parameters, dropping any prefix.
+// A parameter starting with ':' takes the rest of the line.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return "", nil
+		}
+		line = line[i+1:]
+	}
+
+	var params []string
+	for {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		i := strings.Index(line, " ")
+		if i < 0 {
+			params = append(params, line)
+			break
+		}
+		params = append(params, line[:i])
+		line = line[i+1:]
+	}
+
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// Writes one line, with newlines in message text flattened and the line cut
+// to the RFC 1459 length limit
+func (c *ircConn) send(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	line = strings.NewReplacer("\r", " ", "\n", " ").Replace(line)
+	if len(line) > ircMaxLineBytes-2 {
+		line = line[:ircMaxLineBytes-2]
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.writer.WriteString(line + "\r\n")
+	c.writer.Flush()
+}
+
+// Sends a numeric reply addressed to nick, or * before registration
+func (c *ircConn) reply(code string, nick string, text string) {
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(":%s %s %s %s", ircServerName, code, nick, text)
+}
+
+func ircPrefix(nick string) string {
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+func (c *ircConn) currentNick() string {
+	c.ns.RLock()
+	defer c.ns.RUnlock()
+	return c.nick
+}
+
+func (c *ircConn) serve() {
+	closed := make(chan struct{})
+	defer c.conn.Close()
+	defer close(closed)
+
+	util.OutLog.Printf("[%s] IRC client connected from %s\n", c.ns.name, c.remoteHost)
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		command, params := parseIRCLine(scanner.Text())
+		if command == "" {
+			continue
+		}
+		wasRegistered := c.currentNick() != ""
+		if !c.handle(command, params) {
+			break
+		}
+		if !wasRegistered && c.currentNick() != "" {
+			go c.relay(closed)
+		}
+	}
+
+	// Don't hold back inbox messages for a device that is gone
+	c.ns.Lock()
+	if c.nick != "" {
+		delete(c.ns.sessions[c.nick], c.deviceId)
+		util.OutLog.Printf("[%s] IRC client %s disconnected\n", c.ns.name, c.nick)
+	}
+	c.ns.Unlock()
+}
+
+// Handles one command. Returns false once the client quits.
+func (c *ircConn) handle(command string, params []string) bool {
+	nick := c.currentNick()
+
+	switch command {
+	case "PASS":
+		if nick != "" {
+			c.reply("462", nick, ":You may not reregister")
+		} else if len(params) > 0 {
+			c.token = params[0]
+		}
+	case "NICK":
+		if len(params) == 0 {
+			c.reply("431", nick, ":No nickname given")
+		} else if nick == "" {
+			c.requestedNick = params[0]
+			c.register()
+		} else {
+			c.changeNick(nick, params[0])
+		}
+	case "USER":
+		if nick != "" || c.gotUser {
+			c.reply("462", nick, ":You may not reregister")
+		} else {
+			c.gotUser = true
+			c.register()
+		}
+	case "PING":
+		if len(params) > 0 {
+			c.send(":%s PONG %s :%s", ircServerName, ircServerName, params[0])
+		}
+	case "PONG":
+	case "QUIT":
+		c.send("ERROR :Closing link")
+		return false
+	default:
+		if nick == "" {
+			c.reply("451", nick, ":You have not registered")
+		} else {
+			c.handleRegistered(nick, command, params)
+		}
+	}
+	return true
+}
+
+// Commands that need a registered nick
+func (c *ircConn) handleRegistered(nick string, command string, params []string) {
+	switch command {
+	case "JOIN":
+		if len(params) == 0 {
+			c.reply("461", nick, "JOIN :Not enough parameters")
+			return
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			c.join(nick, channel)
+		}
+	case "PART":
+		if len(params) == 0 {
+			c.reply("461", nick, "PART :Not enough parameters")
+			return
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			c.part(nick, channel)
+		}
+	case "NAMES":
+		if len(params) > 0 {
+			for _, channel := range strings.Split(params[0], ",") {
+				c.names(nick, channel)
+			}
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 || params[1] == "" {
+			c.reply("412", nick, ":No text to send")
+			return
+		}
+		c.privmsg(nick, params[0], params[1])
+	default:
+		c.reply("421", nick, command+" :Unknown command")
+	}
+}
+
+// Claims the requested nick once both NICK and USER arrived. A nick owned by
+// someone else, on IRC or TorChat, needs its user token as the PASS.
+func (c *ircConn) register() {
+	if c.requestedNick == "" || !c.gotUser {
+		return
+	}
+
+	if c.token == "" {
+		token := make([]byte, 16)
+		_, err := util.Random.Read(token)
+		util.HandleFatalError("Could not generate user token", err)
+		c.token = hex.EncodeToString(token)
+	}
+
+	c.ns.Lock()
+	var err error
+	if c.ns.banned[c.requestedNick] {
+		err = bannedError
+	} else if _, err = c.ns.authenticate(c.requestedNick, c.token, true); err == nil {
+		c.nick = c.requestedNick
+		c.ns.users[c.nick] = time.Now()
+		c.ns.lastPolled[c.nick] = time.Now()
+		sess := c.ns.session(c.nick, c.deviceId)
+		sess.LastPolled = time.Now()
+	}
+	var channels []string
+	for channel := range c.ns.joinedChannels(c.requestedNick) {
+		channels = append(channels, channel)
+	}
+	c.ns.Unlock()
+
+	switch {
+	case err == invalidUserNameError:
+		c.reply("432", "", c.requestedNick+" :Erroneous nickname")
+		c.requestedNick = ""
+		return
+	case err != nil:
+		c.reply("433", "", c.requestedNick+" :Nickname is already in use")
+		c.requestedNick = ""
+		return
+	}
+
+	nick := c.requestedNick
+	util.OutLog.Printf("[%s] IRC client %s registered as %s\n", c.ns.name, c.remoteHost, nick)
+	c.reply("001", nick, ":Welcome to TorChat namespace "+c.ns.name+", "+ircPrefix(nick))
+	c.reply("002", nick, ":Your host is "+ircServerName)
+	c.reply("003", nick, ":This server bridges IRC clients and TorChat circuits")
+	c.reply("004", nick, ircServerName+" torchat o o")
+	c.reply("422", nick, ":MOTD File is missing")
+
+	// TorChat users start out in the default channel, put the client there too
+	sort.Strings(channels)
+	for _, channel := range channels {
+		c.sendJoined(nick, channel)
+	}
+}
+
+func (c *ircConn) changeNick(oldNick string, newNick string) {
+	c.ns.Lock()
+	reg, err := c.ns.authenticate(oldNick, c.token, false)
+	if err == nil && reg == nil {
+		err = userNameTakenError
+	}
+	if err == nil {
+		if err = c.ns.rename(reg, newNick); err == nil {
+			c.nick = newNick
+		}
+	}
+	c.ns.Unlock()
+
+	switch {
+	case err == invalidUserNameError:
+		c.reply("432", oldNick, newNick+" :Erroneous nickname")
+	case err != nil:
+		c.reply("433", oldNick, newNick+" :Nickname is already in use")
+	default:
+		c.send(":%s NICK :%s", ircPrefix(oldNick), newNick)
+	}
+}
+
+func validIRCChannel(channel string) bool {
+	return len(channel) > 1 && (channel[0] == '#' || channel[0] == '&') && !strings.ContainsAny(channel, " ,\x07")
+}
+
+func (c *ircConn) join(nick string, channel string) {
+	if !validIRCChannel(channel) {
+		c.reply("403", nick, channel+" :No such channel")
+		return
+	}
+
+	c.ns.Lock()
+	err := c.ns.checkCanPublish(nick)
+	if err == nil {
+		c.ns.joinedChannels(nick)[channel] = true
+	}
+	c.ns.Unlock()
+
+	if err != nil {
+		c.reply("474", nick, channel+" :Cannot join channel ("+err.Error()+")")
+		return
+	}
+	c.sendJoined(nick, channel)
+}
+
+// Confirms a join the way IRC clients expect: echo the JOIN, then the names
+func (c *ircConn) sendJoined(nick string, channel string) {
+	c.send(":%s JOIN %s", ircPrefix(nick), channel)
+	c.names(nick, channel)
+}
+
+func (c *ircConn) part(nick string, channel string) {
+	c.ns.Lock()
+	channels := c.ns.joinedChannels(nick)
+	joined := channels[channel]
+	delete(channels, channel)
+	c.ns.Unlock()
+
+	if !joined {
+		c.reply("442", nick, channel+" :You're not on that channel")
+		return
+	}
+	c.send(":%s PART %s", ircPrefix(nick), channel)
+}
+
+// Lists the users who have joined the channel, on IRC or TorChat
+func (c *ircConn) names(nick string, channel string) {
+	var members []string
+	c.ns.RLock()
+	for username, channels := range c.ns.memberships {
+		if channels[channel] && !c.ns.banned[username] {
+			members = append(members, username)
+		}
+	}
+	c.ns.RUnlock()
+	sort.Strings(members)
+
+	// One reply per batch of names keeps lines under the length limit
+	for len(members) > 0 {
+		batch := members
+		if len(batch) > 20 {
+			batch = batch[:20]
+		}
+		members = members[len(batch):]
+		c.reply("353", nick, "= "+channel+" :"+strings.Join(batch, " "))
+	}
+	c.reply("366", nick, channel+" :End of NAMES list")
+}
+
+// Publishes to a channel, or sends a direct message if the target is a nick
+func (c *ircConn) privmsg(nick string, target string, text string) {
+	chatMessage := shared.ChatMessage{
+		Namespace: c.ns.name,
+		Username:  nick,
+		UserToken: c.token,
+		Message:   text,
+	}
+	if validIRCChannel(target) {
+		chatMessage.Channel = target
+	} else {
+		chatMessage.Recipient = target
+	}
+
+	c.ns.Lock()
+	err := c.ns.publish(chatMessage, c.remoteHost)
+	c.ns.Unlock()
+
+	switch {
+	case err == unknownRecipientError:
+		c.reply("401", nick, target+" :No such nick/channel")
+	case err != nil:
+		c.reply("404", nick, target+" :Cannot send to channel ("+err.Error()+")")
+	}
+}
+
+// Sends the client what others publish in its channels and its direct
+// messages, polling the namespace like a proxy would until the client leaves
+func (c *ircConn) relay(closed chan struct{}) {
+	c.ns.RLock()
+	cursor := c.ns.firstId + uint32(len(c.ns.messages))
+	c.ns.RUnlock()
+	var lastInboxId uint32
+
+	ticker := time.NewTicker(ircPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		var lines []string
+		c.ns.Lock()
+		nick := c.nick
+		channels := c.ns.joinedChannels(nick)
+		c.ns.lastPolled[nick] = time.Now()
+		sess := c.ns.session(nick, c.deviceId)
+		sess.LastPolled = time.Now()
+
+		// Messages before firstId have been dropped by retention, skip past them
+		if cursor < c.ns.firstId {
+			cursor = c.ns.firstId
+		}
+		for _, msg := range c.ns.messages[cursor-c.ns.firstId:] {
+			if !channels[msg.Channel] || msg.Deleted || msg.Username == nick {
+				continue
+			}
+			if msg.Username == "" {
+				lines = append(lines, ":"+ircServerName+" NOTICE "+msg.Channel+" :"+msg.bridgedText())
+			} else {
+				lines = append(lines, ":"+ircPrefix(msg.Username)+" PRIVMSG "+msg.Channel+" :"+msg.Message)
+			}
+		}
+		cursor = c.ns.firstId + uint32(len(c.ns.messages))
+		sess.LastMessageId = cursor
+
+		inbox, nextInboxId := c.ns.takeInbox(nick, sess, lastInboxId)
+		lastInboxId = nextInboxId
+		for _, msg := range inbox {
+			// Mentions are already shown in the channel to clients that joined it
+			if msg.Channel == "" {
+				lines = append(lines, ":"+ircPrefix(msg.From)+" PRIVMSG "+nick+" :"+msg.Message)
+			} else if !channels[msg.Channel] {
+				lines = append(lines, ":"+ircPrefix(msg.From)+" PRIVMSG "+nick+" :[mention in "+msg.Channel+"] "+msg.Message)
+			}
+		}
+		c.ns.Unlock()
+
+		for _, line := range lines {
+			c.send("%s", line)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		command string
+		params  []string
+	}{
+		{"NICK alice\r\n", "NICK", []string{"alice"}},
+		{":alice!a@host privmsg #go :hello there", "PRIVMSG", []string{"#go", "hello there"}},
+		{"USER alice 0 *  :Alice A", "USER", []string{"alice", "0", "*", "Alice A"}},
+		{"PING", "PING", nil},
+		{":prefix-only", "", nil},
+		{"", "", nil},
+	} {
+		command, params := parseIRCLine(test.line)
+		if command != test.command || strings.Join(params, "|") != strings.Join(test.params, "|") {
+			t.Fatalf("%q parsed to %q %q, want %q %q", test.line, command, params, test.command, test.params)
+		}
+	}
+}
+
+// Connects an IRC client to the bridge and returns a way to send it lines and
+// the lines it receives
+func testIRCClient(t *testing.T, ns *Namespace) (func(string), <-chan string) {
+	clientConn, serverConn := net.Pipe()
+	c := &ircConn{conn: serverConn, writer: bufio.NewWriter(serverConn), ns: ns, remoteHost: "127.0.0.1", deviceId: "irc-test"}
+	go c.serve()
+	t.Cleanup(func() { clientConn.Close() })
+
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(clientConn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	return func(line string) { clientConn.Write([]byte(line + "\r\n")) }, lines
+}
+
+// Waits for a line containing want
+func expectIRCLine(t *testing.T, lines <-chan string, want string) {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("the connection closed before %q", want)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %q from the bridge", want)
+		}
+	}
+}
+
+func TestIRCBridge(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := getNamespace("uni")
+	send, lines := testIRCClient(t, ns)
+
+	// bob is a TorChat user, so his nick needs his token
+	send("NICK bob")
+	send("USER alice 0 * :Alice")
+	expectIRCLine(t, lines, "433 * bob :Nickname is already in use")
+	send("NICK alice")
+	expectIRCLine(t, lines, "001 alice :Welcome to TorChat namespace uni")
+	expectIRCLine(t, lines, "JOIN "+shared.DefaultChannel)
+
+	send("JOIN #go")
+	expectIRCLine(t, lines, ":alice!alice@torchat JOIN #go")
+	send("PRIVMSG #go :hi from irc")
+	send("PING sync")
+	expectIRCLine(t, lines, "PONG torchat :sync")
+	var ack bool
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Channel: "#go", Username: "bob", UserToken: "token-bob", Message: "hi from torchat"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	expectIRCLine(t, lines, ":bob!bob@torchat PRIVMSG #go :hi from torchat")
+
+	messages, err := pollAs(t, "bob")
+	if err != nil || len(messages) == 0 || messages[0] != "[#go] alice: hi from irc" {
+		t.Fatalf("bob got %q, %v", messages, err)
+	}
+
+	send("PRIVMSG nobody :hi")
+	expectIRCLine(t, lines, "401 alice nobody :No such nick/channel")
+	send("QUIT")
+	expectIRCLine(t, lines, "ERROR :Closing link")
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+const (
+	matrixPollInterval time.Duration = 500 * time.Millisecond // how often the log is mirrored into Matrix
+	matrixHTTPTimeout  time.Duration = 10 * time.Second
+	matrixDedupWindow  time.Duration = time.Hour // how long seen transaction and event ids are remembered
+
+	matrixBotLocalpart = "torchat"  // the bridge's own user, sender_localpart in the registration
+	matrixPuppetPrefix = "torchat_" // localparts of TorChat users in Matrix and of bridged room aliases
+)
+
+// A Matrix application service that mirrors every channel of one namespace
+// into a Matrix room, #general into #torchat_general:server. TorChat users
+// appear in Matrix as puppets (@torchat_alice:server) and Matrix users appear
+// in TorChat under their user id without the @ (bob:example.org).
+type matrixBridge struct {
+	sync.Mutex // guards the maps below; never held across HTTP calls
+	ns         *Namespace
+	homeserver string // base URL of the homeserver's client-server API
+	serverName string
+	asToken    string // the bridge's token to the homeserver
+	hsToken    string // the homeserver's token to the bridge
+	client     *http.Client
+	txnPrefix  string // keeps our transaction ids unique across restarts
+
+	roomByChannel map[string]string
+	channelByRoom map[string]string
+	puppets       map[string]bool            // Matrix localparts registered so far
+	puppetRooms   map[string]map[string]bool // localpart -> room ids joined
+	matrixUsers   map[string]bool            // TorChat usernames that belong to Matrix users
+
+	seenTxns   map[string]time.Time // transactions the homeserver already pushed
+	sentEvents map[string]time.Time // events the bridge sent itself
+	cursor     uint32
+}
+
+type matrixEvent struct {
+	Type     string `json:"type"`
+	RoomId   string `json:"room_id"`
+	Sender   string `json:"sender"`
+	EventId  string `json:"event_id"`
+	StateKey string `json:"state_key"`
+	Content  struct {
+		MsgType    string `json:"msgtype"`
+		Body       string `json:"body"`
+		Membership string `json:"membership"`
+		Alias      string `json:"alias"`
+	} `json:"content"`
+}
+
+// Error responses of the Matrix APIs
+type matrixError struct {
+	Status  int    `json:"-"`
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e matrixError) Error() string {
+	return fmt.Sprintf("Matrix error %d %s: %s", e.Status, e.ErrCode, e.Message)
+}
+
+// Listens on listenAddr for the homeserver and mirrors the namespace into it
+func serveMatrix(listenAddr string, homeserver string, serverName string, asToken string, hsToken string, namespace string) {
+	ns, err := getNamespace(namespace)
+	util.HandleFatalError("Could not open Matrix bridge namespace", err)
+
+	b := &matrixBridge{
+		ns:            ns,
+		homeserver:    strings.TrimRight(homeserver, "/"),
+		serverName:    serverName,
+		asToken:       asToken,
+		hsToken:       hsToken,
+		client:        &http.Client{Timeout: matrixHTTPTimeout},
+		txnPrefix:     fmt.Sprintf("torchat-%d", time.Now().UnixNano()),
+		roomByChannel: make(map[string]string),
+		channelByRoom: make(map[string]string),
+		puppets:       make(map[string]bool),
+		puppetRooms:   make(map[string]map[string]bool),
+		matrixUsers:   make(map[string]bool),
+		seenTxns:      make(map[string]time.Time),
+		sentEvents:    make(map[string]time.Time),
+	}
+	go b.relay()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_matrix/app/v1/transactions/", b.handleTransaction)
+	mux.HandleFunc("/_matrix/app/v1/rooms/", b.handleRoomQuery)
+	mux.HandleFunc("/_matrix/app/v1/users/", b.handleUserQuery)
+
+	util.OutLog.Printf("Matrix bridge for namespace %s is listening on addr/port: %s\n", ns.name, listenAddr)
+	util.HandleFatalError("Matrix bridge stopped", http.ListenAndServe(listenAddr, mux))
+}
+
+// Escapes a TorChat name into the characters Matrix localparts allow, the way
+// the Matrix spec suggests: A becomes _a, _ becomes __ and other bytes =xx
+func matrixLocalpart(name string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '/':
+			escaped.WriteByte(c)
+		case c == '_':
+			escaped.WriteString("__")
+		case c >= 'A' && c <= 'Z':
+			escaped.WriteByte('_')
+			escaped.WriteByte(c + 'a' - 'A')
+		default:
+			fmt.Fprintf(&escaped, "=%02x", c)
+		}
+	}
+	return escaped.String()
+}
+
+// Reverses matrixLocalpart
+func unescapeMatrixLocalpart(localpart string) string {
+	var name strings.Builder
+	for i := 0; i < len(localpart); i++ {
+		c := localpart[i]
+		switch {
+		case c == '_' && i+1 < len(localpart) && localpart[i+1] == '_':
+			name.WriteByte('_')
+			i++
+		case c == '_' && i+1 < len(localpart):
+			name.WriteByte(localpart[i+1] - 'a' + 'A')
+			i++
+		case c == '=' && i+2 < len(localpart):
+			if decoded, err := hex.DecodeString(localpart[i+1 : i+3]); err == nil {
+				name.Write(decoded)
+				i += 2
+				continue
+			}
+			name.WriteByte(c)
+		default:
+			name.WriteByte(c)
+		}
+	}
+	return name.String()
+}
+
+func (b *matrixBridge) puppetId(username string) string {
+	return "@" + matrixPuppetPrefix + matrixLocalpart(username) + ":" + b.serverName
+}
+
+func (b *matrixBridge) roomAlias(channel string) string {
+	return "#" + matrixPuppetPrefix + matrixLocalpart(strings.TrimPrefix(channel, "#")) + ":" + b.serverName
+}
+
+// Puppets and the bridge's own user are in the application service's user
+// namespace. Their events are echoes of what the bridge sent.
+func (b *matrixBridge) isBridged(userId string) bool {
+	if userId == "@"+matrixBotLocalpart+":"+b.serverName {
+		return true
+	}
+	return strings.HasPrefix(userId, "@"+matrixPuppetPrefix) && strings.HasSuffix(userId, ":"+b.serverName)
+}
+
+// Derives a TorChat user token from a Matrix user id. The homeserver has
+// authenticated the sender, and only the bridge knows the AS token.
+func (b *matrixBridge) tokenFor(userId string) string {
+	digest := sha256.Sum256([]byte(b.asToken + "\x00" + userId))
+	return hex.EncodeToString(digest[:])
+}
+
+// Checks the homeserver's token, sent as a bearer token or, by older
+// homeservers, as ?access_token
+func (b *matrixBridge) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("access_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.hsToken)) == 1
+}
+
+func writeMatrixResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (b *matrixBridge) checkRequest(w http.ResponseWriter, r *http.Request) bool {
+	if !b.authorized(r) {
+		writeMatrixResponse(w, http.StatusForbidden, matrixError{ErrCode: "M_FORBIDDEN", Message: "Bad homeserver token"})
+		return false
+	}
+	return true
+}
+
+// Calls the client-server API as the bridge, or as a puppet if asUser is set
+func (b *matrixBridge) call(method string, path string, asUser string, body interface{}, resp interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	target := b.homeserver + path
+	if asUser != "" {
+		target += "?user_id=" + url.QueryEscape(asUser)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.asToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode/100 != 2 {
+		matrixErr := matrixError{Status: httpResp.StatusCode}
+		json.NewDecoder(httpResp.Body).Decode(&matrixErr)
+		return matrixErr
+	}
+	if resp != nil {
+		return json.NewDecoder(httpResp.Body).Decode(resp)
+	}
+	return nil
+}
+
+// Retries calls that failed in transit or were rate limited; other errors are
+// answers that retrying won't change
+func (b *matrixBridge) callWithRetry(method string, path string, asUser string, body interface{}, resp interface{}) error {
+	return retry.Do(context.Background(), retry.Interactive, func() error {
+		err := b.call(method, path, asUser, body, resp)
+		if matrixErr, ok := err.(matrixError); ok && matrixErr.ErrCode != "M_LIMIT_EXCEEDED" && matrixErr.Status < 500 {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+}
+
+// Returns the room a channel is mirrored into, creating it on first use
+func (b *matrixBridge) ensureRoom(channel string) (string, error) {
+	b.Lock()
+	roomId, ok := b.roomByChannel[channel]
+	b.Unlock()
+	if ok {
+		return roomId, nil
+	}
+
+	var resolved struct {
+		RoomId string `json:"room_id"`
+	}
+	alias := b.roomAlias(channel)
+	err := b.callWithRetry("GET", "/_matrix/client/v3/directory/room/"+url.PathEscape(alias), "", nil, &resolved)
+	if matrixErr, ok := err.(matrixError); ok && matrixErr.ErrCode == "M_NOT_FOUND" {
+		create := map[string]interface{}{
+			"room_alias_name": strings.TrimSuffix(strings.TrimPrefix(alias, "#"), ":"+b.serverName),
+			"name":            channel,
+			"topic":           "TorChat channel " + channel + " in namespace " + b.ns.name,
+			"preset":          "public_chat",
+			"visibility":      "public",
+		}
+		err = b.callWithRetry("POST", "/_matrix/client/v3/createRoom", "", create, &resolved)
+		if err == nil {
+			util.OutLog.Printf("[%s] Created Matrix room %s for %s\n", b.ns.name, alias, channel)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	b.Lock()
+	b.roomByChannel[channel] = resolved.RoomId
+	b.channelByRoom[resolved.RoomId] = channel
+	b.Unlock()
+	return resolved.RoomId, nil
+}
+
+// Returns the channel a room mirrors, or "" for rooms the bridge doesn't own.
+// After a restart rooms are recognised by their canonical alias.
+func (b *matrixBridge) channelOfRoom(roomId string) string {
+	b.Lock()
+	channel, ok := b.channelByRoom[roomId]
+	b.Unlock()
+	if ok {
+		return channel
+	}
+
+	var state struct {
+		Alias string `json:"alias"`
+	}
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomId) + "/state/m.room.canonical_alias"
+	if err := b.callWithRetry("GET", path, "", nil, &state); err != nil {
+		return ""
+	}
+	channel = b.channelOfAlias(state.Alias)
+	if channel == "" {
+		return ""
+	}
+
+	b.Lock()
+	b.roomByChannel[channel] = roomId
+	b.channelByRoom[roomId] = channel
+	b.Unlock()
+	return channel
+}
+
+// Maps #torchat_general:server back to #general
+func (b *matrixBridge) channelOfAlias(alias string) string {
+	prefix := "#" + matrixPuppetPrefix
+	suffix := ":" + b.serverName
+	if !strings.HasPrefix(alias, prefix) || !strings.HasSuffix(alias, suffix) {
+		return ""
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(alias, prefix), suffix)
+	if name == "" {
+		return ""
+	}
+	return "#" + unescapeMatrixLocalpart(name)
+}
+
+// Registers the puppet of a TorChat user and joins it to the room
+func (b *matrixBridge) ensurePuppet(username string, roomId string) (string, error) {
+	userId := b.puppetId(username)
+	localpart := strings.TrimSuffix(strings.TrimPrefix(userId, "@"), ":"+b.serverName)
+
+	b.Lock()
+	registered := b.puppets[localpart]
+	joined := b.puppetRooms[localpart][roomId]
+	b.Unlock()
+
+	if !registered {
+		register := map[string]string{"type": "m.login.application_service", "username": localpart}
+		err := b.callWithRetry("POST", "/_matrix/client/v3/register", "", register, nil)
+		if matrixErr, ok := err.(matrixError); err != nil && !(ok && matrixErr.ErrCode == "M_USER_IN_USE") {
+			return "", err
+		}
+		b.callWithRetry("PUT", "/_matrix/client/v3/profile/"+url.PathEscape(userId)+"/displayname", userId,
+			map[string]string{"displayname": username + " (TorChat)"}, nil)
+
+		b.Lock()
+		b.puppets[localpart] = true
+		b.Unlock()
+	}
+
+	if !joined {
+		if err := b.callWithRetry("POST", "/_matrix/client/v3/rooms/"+url.PathEscape(roomId)+"/join", userId, struct{}{}, nil); err != nil {
+			return "", err
+		}
+
+		b.Lock()
+		if b.puppetRooms[localpart] == nil {
+			b.puppetRooms[localpart] = make(map[string]bool)
+		}
+		b.puppetRooms[localpart][roomId] = true
+		b.Unlock()
+	}
+	return userId, nil
+}
+
+// Sends one TorChat message into its room. The transaction id makes retries
+// of the same message idempotent on the homeserver.
+func (b *matrixBridge) mirror(id uint32, msg StoredMessage) error {
+	roomId, err := b.ensureRoom(msg.Channel)
+	if err != nil {
+		return err
+	}
+
+	// Server notices come from the bridge's own user
+	sender := ""
+	content := map[string]string{"msgtype": "m.notice", "body": msg.bridgedText()}
+	if msg.Username != "" {
+		if sender, err = b.ensurePuppet(msg.Username, roomId); err != nil {
+			return err
+		}
+		content["msgtype"] = "m.text"
+	}
+
+	var sent struct {
+		EventId string `json:"event_id"`
+	}
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s-%d", url.PathEscape(roomId), b.txnPrefix, id)
+	if err = b.callWithRetry("PUT", path, sender, content, &sent); err != nil {
+		return err
+	}
+
+	b.Lock()
+	b.sentEvents[sent.EventId] = time.Now()
+	b.Unlock()
+	return nil
+}
+
+// Mirrors new TorChat messages into Matrix, except those that came from
+// Matrix in the first place
+func (b *matrixBridge) relay() {
+	b.ns.RLock()
+	b.cursor = b.ns.firstId + uint32(len(b.ns.messages))
+	b.ns.RUnlock()
+
+	for {
+		time.Sleep(matrixPollInterval)
+		b.forgetOldIds()
+
+		type pending struct {
+			id  uint32
+			msg StoredMessage
+		}
+		var messages []pending
+
+		b.ns.RLock()
+		b.Lock()
+		// Messages before firstId have been dropped by retention, skip past them
+		if b.cursor < b.ns.firstId {
+			b.cursor = b.ns.firstId
+		}
+		for i, msg := range b.ns.messages[b.cursor-b.ns.firstId:] {
+			if !msg.Deleted && !b.matrixUsers[msg.Username] {
+				messages = append(messages, pending{b.cursor + uint32(i), msg})
+			}
+		}
+		b.cursor = b.ns.firstId + uint32(len(b.ns.messages))
+		b.Unlock()
+		b.ns.RUnlock()
+
+		for _, m := range messages {
+			if err := b.mirror(m.id, m.msg); err != nil {
+				util.HandleNonFatalError("Could not mirror message into Matrix", err)
+			}
+		}
+	}
+}
+
+func (b *matrixBridge) forgetOldIds() {
+	cutoff := time.Now().Add(-matrixDedupWindow)
+
+	b.Lock()
+	defer b.Unlock()
+	for txnId, seen := range b.seenTxns {
+		if seen.Before(cutoff) {
+			delete(b.seenTxns, txnId)
+		}
+	}
+	for eventId, sent := range b.sentEvents {
+		if sent.Before(cutoff) {
+			delete(b.sentEvents, eventId)
+		}
+	}
+}
+
+// PUT /_matrix/app/v1/transactions/{txnId}: events the homeserver pushes.
+// The homeserver retries a transaction until we answer, so each is applied once.
+func (b *matrixBridge) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !b.checkRequest(w, r) {
+		return
+	}
+	txnId := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1/transactions/")
+
+	var txn struct {
+		Events []matrixEvent `json:"events"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		writeMatrixResponse(w, http.StatusBadRequest, matrixError{ErrCode: "M_NOT_JSON", Message: err.Error()})
+		return
+	}
+
+	b.Lock()
+	_, duplicate := b.seenTxns[txnId]
+	b.seenTxns[txnId] = time.Now()
+	b.Unlock()
+
+	if !duplicate {
+		for _, event := range txn.Events {
+			b.handleEvent(event)
+		}
+	}
+	writeMatrixResponse(w, http.StatusOK, struct{}{})
+}
+
+func (b *matrixBridge) handleEvent(event matrixEvent) {
+	b.Lock()
+	_, ours := b.sentEvents[event.EventId]
+	b.Unlock()
+	if ours || b.isBridged(event.Sender) {
+		return
+	}
+
+	channel := b.channelOfRoom(event.RoomId)
+	if channel == "" {
+		return
+	}
+
+	username := strings.TrimPrefix(event.Sender, "@")
+	if !validUserName(username) {
+		util.OutLog.Printf("[%s] Ignoring Matrix user %s, the id is too long for a username\n", b.ns.name, event.Sender)
+		return
+	}
+	b.Lock()
+	b.matrixUsers[username] = true
+	b.Unlock()
+
+	b.ns.Lock()
+	defer b.ns.Unlock()
+
+	switch {
+	case event.Type == "m.room.member" && event.StateKey == event.Sender:
+		if event.Content.Membership == "join" {
+			if _, err := b.ns.authenticate(username, b.tokenFor(event.Sender), true); err != nil {
+				util.HandleNonFatalError("Could not bridge Matrix user "+event.Sender, err)
+				return
+			}
+			b.ns.joinedChannels(username)[channel] = true
+		} else {
+			delete(b.ns.joinedChannels(username), channel)
+		}
+	case event.Type == "m.room.message" && event.Content.Body != "":
+		body := event.Content.Body
+		if event.Content.MsgType == "m.emote" {
+			body = "* " + username + " " + body
+		}
+		err := b.ns.publish(shared.ChatMessage{
+			Namespace: b.ns.name,
+			Channel:   channel,
+			Username:  username,
+			UserToken: b.tokenFor(event.Sender),
+			Message:   body,
+		}, b.serverName)
+		if err != nil {
+			util.HandleNonFatalError("Could not publish message from Matrix user "+event.Sender, err)
+		}
+	}
+}
+
+// GET /_matrix/app/v1/rooms/{alias}: a Matrix user asked for a bridged
+// room that doesn't exist yet, e.g. by joining #torchat_lobby:server
+func (b *matrixBridge) handleRoomQuery(w http.ResponseWriter, r *http.Request) {
+	if !b.checkRequest(w, r) {
+		return
+	}
+	alias := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1/rooms/")
+
+	channel := b.channelOfAlias(alias)
+	if channel == "" {
+		writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_NOT_FOUND", Message: "Not a TorChat channel"})
+		return
+	}
+	if _, err := b.ensureRoom(channel); err != nil {
+		util.HandleNonFatalError("Could not create Matrix room for "+channel, err)
+		writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_NOT_FOUND", Message: err.Error()})
+		return
+	}
+	writeMatrixResponse(w, http.StatusOK, struct{}{})
+}
+
+// GET /_matrix/app/v1/users/{userId}: puppets are registered on demand
+func (b *matrixBridge) handleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !b.checkRequest(w, r) {
+		return
+	}
+	userId := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1/users/")
+	if !b.isBridged(userId) {
+		writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_NOT_FOUND", Message: "Not a TorChat user"})
+		return
+	}
+
+	localpart := strings.TrimSuffix(strings.TrimPrefix(userId, "@"), ":"+b.serverName)
+	register := map[string]string{"type": "m.login.application_service", "username": localpart}
+	err := b.callWithRetry("POST", "/_matrix/client/v3/register", "", register, nil)
+	if matrixErr, ok := err.(matrixError); err != nil && !(ok && matrixErr.ErrCode == "M_USER_IN_USE") {
+		writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_NOT_FOUND", Message: err.Error()})
+		return
+	}
+
+	b.Lock()
+	b.puppets[localpart] = true
+	b.Unlock()
+	writeMatrixResponse(w, http.StatusOK, struct{}{})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMatrixBridge(homeserver string) *matrixBridge {
+	ns, _ := getNamespace("uni")
+	return &matrixBridge{
+		ns:            ns,
+		homeserver:    homeserver,
+		serverName:    "example.org",
+		asToken:       "as-token",
+		hsToken:       "hs-token",
+		client:        &http.Client{Timeout: time.Second},
+		roomByChannel: make(map[string]string),
+		channelByRoom: make(map[string]string),
+		puppets:       make(map[string]bool),
+		puppetRooms:   make(map[string]map[string]bool),
+		matrixUsers:   make(map[string]bool),
+		seenTxns:      make(map[string]time.Time),
+		sentEvents:    make(map[string]time.Time),
+	}
+}
+
+// Pushes a transaction the way the homeserver does
+func pushTransaction(b *matrixBridge, txnId string, token string, events ...matrixEvent) int {
+	body, _ := json.Marshal(map[string]interface{}{"events": events})
+	r := httptest.NewRequest("PUT", "/_matrix/app/v1/transactions/"+txnId, strings.NewReader(string(body)))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	b.handleTransaction(w, r)
+	return w.Code
+}
+
+func matrixMessage(eventId string, sender string, body string) matrixEvent {
+	event := matrixEvent{Type: "m.room.message", RoomId: "!go:example.org", Sender: sender, EventId: eventId}
+	event.Content.MsgType, event.Content.Body = "m.text", body
+	return event
+}
+
+func TestMatrixLocalparts(t *testing.T) {
+	for name, localpart := range map[string]string{"alice": "alice", "Bob_2": "_bob__2", "go lang": "go=20lang"} {
+		if got := matrixLocalpart(name); got != localpart {
+			t.Fatalf("%q escaped to %q, want %q", name, got, localpart)
+		}
+		if got := unescapeMatrixLocalpart(localpart); got != name {
+			t.Fatalf("%q unescaped to %q, want %q", localpart, got, name)
+		}
+	}
+
+	b := testMatrixBridge("")
+	if alias := b.roomAlias("#Go"); alias != "#torchat__go:example.org" || b.channelOfAlias(alias) != "#Go" {
+		t.Fatalf("#Go is mirrored into %s", alias)
+	}
+	if b.channelOfAlias("#torchat_go:other.org") != "" || b.channelOfAlias("#go:example.org") != "" || b.channelOfAlias("#torchat_:example.org") != "" {
+		t.Fatal("an alias the bridge doesn't own named a channel")
+	}
+	if !b.isBridged(b.puppetId("alice")) || !b.isBridged("@torchat:example.org") || b.isBridged("@bob:example.org") || b.isBridged("@torchat_alice:other.org") {
+		t.Fatal("puppets aren't told apart from Matrix users")
+	}
+}
+
+func TestMatrixTransactions(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	b := testMatrixBridge("")
+	b.roomByChannel["#go"], b.channelByRoom["!go:example.org"] = "!go:example.org", "#go"
+	messages := func() int {
+		b.ns.Lock()
+		defer b.ns.Unlock()
+		return len(b.ns.messages)
+	}
+
+	if code := pushTransaction(b, "t1", "wrong", matrixMessage("$1", "@bob:example.org", "hi")); code != http.StatusForbidden || messages() != 0 {
+		t.Fatalf("a bad homeserver token gave %d and %d messages", code, messages())
+	}
+
+	if code := pushTransaction(b, "t1", "hs-token", matrixMessage("$1", "@bob:example.org", "hi from matrix")); code != http.StatusOK {
+		t.Fatalf("the transaction gave %d", code)
+	}
+	b.ns.Lock()
+	last := b.ns.messages[len(b.ns.messages)-1]
+	b.ns.Unlock()
+	if last.Channel != "#go" || last.String() != "[#go] bob:example.org: hi from matrix" {
+		t.Fatalf("the namespace got %+v", last)
+	}
+
+	// A retried transaction and the bridge's own echoes are ignored
+	count := messages()
+	pushTransaction(b, "t1", "hs-token", matrixMessage("$1", "@bob:example.org", "hi from matrix"))
+	pushTransaction(b, "t2", "hs-token", matrixMessage("$2", b.puppetId("alice"), "echo"))
+	b.sentEvents["$3"] = time.Now()
+	pushTransaction(b, "t3", "hs-token", matrixMessage("$3", "@bob:example.org", "echo"))
+	if messages() != count {
+		t.Fatalf("%d messages were published twice", messages()-count)
+	}
+}
+
+func TestMatrixRoomQuery(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	var created string
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer as-token" {
+			writeMatrixResponse(w, http.StatusForbidden, matrixError{ErrCode: "M_FORBIDDEN"})
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/directory/room/"):
+			writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_NOT_FOUND"})
+		case r.URL.Path == "/_matrix/client/v3/createRoom":
+			var create map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&create)
+			created, _ = create["room_alias_name"].(string)
+			writeMatrixResponse(w, http.StatusOK, map[string]string{"room_id": "!new:example.org"})
+		default:
+			writeMatrixResponse(w, http.StatusNotFound, matrixError{ErrCode: "M_UNRECOGNIZED"})
+		}
+	}))
+	defer homeserver.Close()
+	b := testMatrixBridge(homeserver.URL)
+
+	query := func(alias string) int {
+		r := httptest.NewRequest("GET", "/_matrix/app/v1/rooms/"+alias+"?access_token=hs-token", nil)
+		w := httptest.NewRecorder()
+		b.handleRoomQuery(w, r)
+		return w.Code
+	}
+	if code := query("#other:example.org"); code != http.StatusNotFound {
+		t.Fatalf("an alias outside the bridge gave %d", code)
+	}
+	if code := query("#torchat_go:example.org"); code != http.StatusOK || created != "torchat_go" || b.channelByRoom["!new:example.org"] != "#go" {
+		t.Fatalf("gave %d after creating %q", code, created)
+	}
+}
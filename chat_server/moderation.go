@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type NotOperatorError error
+type BannedError error
+type MutedError error
+
+const (
+	// Moderation configurations
+	maxModerationLog int = 200 // actions kept per namespace for CServer.ListModerationActions
+)
+
+var (
+	// Moderation Errors
+	notOperatorError NotOperatorError = errors.New("Not an operator of this namespace")
+	bannedError      BannedError      = errors.New("Username is banned from this namespace")
+	mutedError       MutedError       = errors.New("Username is muted")
+
+	emptyOperatorTokenError NotOperatorError = errors.New("Operator has no moderation token")
+)
+
+// Operators are listed with their tokens in the namespace policy. An empty
+// token never authorizes, even if the policy lists one.
+func (ns *Namespace) authorizeOperator(operator string, token string) error {
+	want, ok := ns.policy.Operators[operator]
+	if !ok || want == "" || token == "" || subtle.ConstantTimeCompare([]byte(want), []byte(token)) != 1 {
+		return notOperatorError
+	}
+	return nil
+}
+
+// Refuses a policy listing an operator without a token
+func (p NamespacePolicy) checkOperators() error {
+	for operator, token := range p.Operators {
+		if token == "" {
+			return errors.New(operator + ": " + emptyOperatorTokenError.Error())
+		}
+	}
+	return nil
+}
+
+// Checks bans and mutes. Caller must hold the namespace lock.
+func (ns *Namespace) checkCanPublish(username string) error {
+	if ns.banned[username] {
+		return bannedError
+	}
+
+	if until, ok := ns.mutedUntil[username]; ok {
+		if time.Now().Before(until) {
+			return mutedError
+		}
+		delete(ns.mutedUntil, username)
+	}
+	return nil
+}
+
+// Runs a moderation action on the request's namespace after checking the
+// operator, and records it for CServer.ListModerationActions
+func moderate(req shared.ModerationRequest, name string, action func(ns *Namespace, channel string) string) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if err = ns.authorizeOperator(req.Operator, req.Token); err != nil {
+		return err
+	}
+
+	channel := channelOrDefault(req.Channel)
+	notice := action(ns, channel)
+	if req.Reason != "" {
+		notice += " (" + req.Reason + ")"
+	}
+
+	// Let the channel see what happened
+	ns.appendMessage(channel, "", "*** "+notice, 0)
+	util.OutLog.Printf("[%s] %s\n", ns.name, notice)
+
+	ns.moderationLog = append(ns.moderationLog, shared.ModerationAction{
+		Time:         time.Now(),
+		Operator:     req.Operator,
+		Action:       name,
+		Username:     req.Username,
+		Channel:      channel,
+		DurationSecs: req.DurationSecs,
+		Reason:       req.Reason,
+	})
+	if len(ns.moderationLog) > maxModerationLog {
+		ns.moderationLog = ns.moderationLog[len(ns.moderationLog)-maxModerationLog:]
+	}
+
+	return nil
+}
+
+// Removes a user from a channel. They can rejoin by posting to it again.
+func (c *CServer) Kick(req shared.ModerationRequest, ack *bool) error {
+	err := moderate(req, "kick", func(ns *Namespace, channel string) string {
+		delete(ns.joinedChannels(req.Username), channel)
+		return fmt.Sprintf("%s was kicked from %s by %s", req.Username, channel, req.Operator)
+	})
+	*ack = err == nil
+	return err
+}
+
+// Bans a username from publishing and polling anywhere in the namespace
+func (c *CServer) Ban(req shared.ModerationRequest, ack *bool) error {
+	err := moderate(req, "ban", func(ns *Namespace, channel string) string {
+		ns.banned[req.Username] = true
+		delete(ns.memberships, req.Username)
+		return fmt.Sprintf("%s was banned by %s", req.Username, req.Operator)
+	})
+	*ack = err == nil
+	return err
+}
+
+func (c *CServer) Unban(req shared.ModerationRequest, ack *bool) error {
+	err := moderate(req, "unban", func(ns *Namespace, channel string) string {
+		delete(ns.banned, req.Username)
+		return fmt.Sprintf("%s was unbanned by %s", req.Username, req.Operator)
+	})
+	*ack = err == nil
+	return err
+}
+
+// Stops a username from publishing for req.DurationSecs
+func (c *CServer) Mute(req shared.ModerationRequest, ack *bool) error {
+	err := moderate(req, "mute", func(ns *Namespace, channel string) string {
+		duration := time.Duration(req.DurationSecs) * time.Second
+		ns.mutedUntil[req.Username] = time.Now().Add(duration)
+		return fmt.Sprintf("%s was muted for %v by %s", req.Username, duration, req.Operator)
+	})
+	*ack = err == nil
+	return err
+}
+
+func (c *CServer) Unmute(req shared.ModerationRequest, ack *bool) error {
+	err := moderate(req, "unmute", func(ns *Namespace, channel string) string {
+		delete(ns.mutedUntil, req.Username)
+		return fmt.Sprintf("%s was unmuted by %s", req.Username, req.Operator)
+	})
+	*ack = err == nil
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func moderatedNamespace() {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{
+		"uni": {Operators: map[string]string{"carol": "op-token"}},
+	}})
+}
+
+func moderation(username string) shared.ModerationRequest {
+	return shared.ModerationRequest{Namespace: "uni", Operator: "carol", Token: "op-token", Username: username}
+}
+
+func pollAs(t *testing.T, username string) ([]string, error) {
+	var resp shared.PollingResponse
+	err := new(CServer).GetNewMessages(shared.PollingMessage{Namespace: "uni", Username: username, UserToken: "token-" + username}, &resp)
+	return resp.Messages, err
+}
+
+func TestModerationNeedsAnOperator(t *testing.T) {
+	moderatedNamespace()
+	var ack bool
+	for _, req := range []shared.ModerationRequest{
+		{Namespace: "uni", Operator: "carol", Token: "wrong", Username: "bob"},
+		{Namespace: "uni", Operator: "mallory", Token: "op-token", Username: "bob"},
+	} {
+		if err := new(CServer).Ban(req, &ack); err != notOperatorError || ack {
+			t.Fatalf("%+v gave %v, want %v", req, err, notOperatorError)
+		}
+	}
+}
+
+func TestEmptyOperatorTokens(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{
+		"uni": {Operators: map[string]string{"carol": ""}},
+	}})
+	var ack bool
+	req := shared.ModerationRequest{Namespace: "uni", Operator: "carol", Username: "bob"}
+	if err := new(CServer).Ban(req, &ack); err != notOperatorError || ack {
+		t.Fatalf("an empty token gave %v, want %v", err, notOperatorError)
+	}
+
+	path := filepath.Join(t.TempDir(), "namespaces.json")
+	if err := ioutil.WriteFile(path, []byte(`{"Namespaces": {"uni": {"Operators": {"carol": ""}}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadNamespaceConfig(path); err == nil || !strings.Contains(err.Error(), emptyOperatorTokenError.Error()) {
+		t.Fatalf("a config with an empty operator token gave %v", err)
+	}
+}
+
+func TestKickAndRejoin(t *testing.T) {
+	moderatedNamespace()
+	var ack bool
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Channel: "#go", Username: "bob", UserToken: "token-bob", Message: "hi"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	req := moderation("bob")
+	req.Channel, req.Reason = "#go", "spam"
+	if err := new(CServer).Kick(req, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Channel: "#go", Username: "alice", UserToken: "token-alice", Message: "bye"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob no longer sees #go until he posts to it again
+	messages, err := pollAs(t, "bob")
+	if err != nil || len(messages) != 0 {
+		t.Fatalf("a kicked user got %q, %v", messages, err)
+	}
+	if err = new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Channel: "#go", Username: "bob", UserToken: "token-bob", Message: "back"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ = pollAs(t, "bob")
+	want := []string{"[#go] bob: hi", "[#go] *** bob was kicked from #go by carol (spam)", "[#go] alice: bye", "[#go] bob: back"}
+	if len(messages) != len(want) {
+		t.Fatalf("bob got %q after rejoining, want %q", messages, want)
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Fatalf("bob got %q after rejoining, want %q", messages, want)
+		}
+	}
+}
+
+func TestBanAndMute(t *testing.T) {
+	moderatedNamespace()
+	var ack bool
+	if err := new(CServer).Ban(moderation("bob"), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("uni", "bob", "hi"); err != bannedError {
+		t.Fatalf("a banned user publishing gave %v, want %v", err, bannedError)
+	}
+	if _, err := pollAs(t, "bob"); err != bannedError {
+		t.Fatalf("a banned user polling gave %v, want %v", err, bannedError)
+	}
+	if err := new(CServer).Unban(moderation("bob"), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("uni", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	mute := moderation("bob")
+	mute.DurationSecs = 60
+	if err := new(CServer).Mute(mute, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("uni", "bob", "hi"); err != mutedError {
+		t.Fatalf("a muted user gave %v, want %v", err, mutedError)
+	}
+	if _, err := pollAs(t, "bob"); err != nil {
+		t.Fatalf("a muted user couldn't poll: %v", err)
+	}
+
+	// A mute that ran out lets the user post again
+	ns, _ := getNamespace("uni")
+	ns.Lock()
+	ns.mutedUntil["bob"] = time.Now().Add(-time.Second)
+	ns.Unlock()
+	if err := publish("uni", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+}
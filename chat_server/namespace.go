@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type UnknownNamespaceError error
+type NamespaceQuotaError error
+type MessageTooLongError error
+
+const (
+	retentionPeriod    int64 = 60  // seconds between retention sweeps
+	defaultMaxUnlisted int   = 100 // unlisted namespaces created on demand, unless the config says otherwise
+)
+
+// Quotas and retention applied to one namespace. Zero values mean unlimited.
+type NamespacePolicy struct {
+	MaxUsers          int
+	MaxMessageLength  int
+	MaxMessages       int               // oldest messages are dropped beyond this count
+	MaxMessageAgeSecs int64             // messages older than this are dropped
+	Operators         map[string]string // operator username -> moderation token
+	InboxSize         int               // messages queued per offline user, 0 uses the default of 100
+	InboxTTLSecs      int64             // how long queued messages are kept, 0 uses the default of a week
+
+	// New usernames must be registered with one of these single use tokens,
+	// or with a proof of work of this many bits; either will do if both are set
+	RegistrationTokens  []string
+	RegistrationPowBits int
+
+	// Posting tokens each registered user is issued per posting key, for
+	// anonymous messages. 0 disables anonymous posting.
+	PostingTokens int
+
+	// Users only get direct messages from contacts they approved
+	ContactApproval bool
+}
+
+// Namespace configuration file, e.g.
+// {"AllowUnlisted": false, "Default": {...}, "Namespaces": {"uni": {"MaxUsers": 50}}}
+type NamespaceConfig struct {
+	AllowUnlisted bool // create unlisted namespaces on demand with the Default policy
+	MaxUnlisted   int  // unlisted namespaces created at most, 0 uses the default of 100
+	Default       NamespacePolicy
+	Namespaces    map[string]NamespacePolicy
+}
+
+type StoredMessage struct {
+	Channel  string
+	Username string
+	AuthorId uint64 // Registration.Id of the sender, 0 for server notices
+	Message  string
+	Time     time.Time
+	Edited   bool
+	Deleted  bool // kept as a tombstone so message ids stay stable
+
+	ClockSkewed bool      // the sender's clock was off by more than maxClockSkew
+	ExpiresAt   time.Time `json:",omitempty"` // purged then, for messages sent with a TTL
+	Anonymous   bool      `json:",omitempty"` // published with a posting token, Username is empty
+
+	Encrypted *shared.EncryptedMessage `json:",omitempty"` // the text of an end-to-end encrypted message, Message is empty
+}
+
+// An isolated tenant on the chat server with its own users, channels and
+// message history. All channels share one message log so a single polling
+// cursor covers every channel a user has joined.
+type Namespace struct {
+	sync.RWMutex
+	name        string
+	policy      NamespacePolicy
+	messages    []StoredMessage
+	firstId     uint32 // id of messages[0]; advances as retention drops messages
+	users       map[string]time.Time
+	memberships map[string]map[string]bool // username -> joined channels
+	banned      map[string]bool
+	mutedUntil  map[string]time.Time
+
+	moderationLog []shared.ModerationAction // the latest maxModerationLog, oldest first, never persisted
+
+	registrations map[string]*Registration // by current username
+	nextUserId    uint64
+
+	presence       []PresenceRecord // recent presence events, never persisted
+	nextPresenceId uint32
+
+	updates       []shared.MessageUpdate // edits and deletions of earlier messages
+	firstUpdateId uint32                 // id of updates[0]
+
+	inboxes    map[string]*Inbox // direct messages and mentions by recipient
+	lastPolled map[string]time.Time
+	sessions   map[string]map[string]*Session // username -> device id -> session
+
+	readMarkers map[string]map[string]uint32 // username -> channel -> last read message id
+
+	directMessages []StoredDirectMessage // kept for exports, under the same retention as messages
+	firstDirectId  uint32                // id of directMessages[0]
+
+	seenSignatures   map[string]time.Time // send time of recent signed messages, by signature
+	signaturesPruned time.Time
+
+	seenMessageIds   map[string]time.Time // publish time of recent messages, by messageIdKey
+	messageIdsPruned time.Time
+
+	usedRegistrationTokens map[string]bool
+
+	nextExpiry time.Time // earliest ExpiresAt of a message not yet purged, zero if none
+
+	tokensIssued    map[uint64]int // posting tokens signed by Registration.Id, with the key below
+	tokensIssuedKey string
+
+	prekeys map[uint64]*prekeyStore // by Registration.Id
+
+	rosters map[uint64]*shared.RosterBlob // by Registration.Id
+
+	approvals map[uint64]*approvalList   // by Registration.Id
+	blocks    map[uint64]map[uint64]bool // Registration.Ids each user blocked, by Registration.Id
+}
+
+type AllNamespaces struct {
+	sync.RWMutex
+	config NamespaceConfig
+	all    map[string]*Namespace
+}
+
+var (
+	// Namespace Errors
+	unknownNamespaceError UnknownNamespaceError = errors.New("Namespace is not hosted on this server")
+	namespaceQuotaError   NamespaceQuotaError   = errors.New("Namespace user quota exceeded")
+	messageTooLongError   MessageTooLongError   = errors.New("Message exceeds namespace length limit")
+	unlistedQuotaError    NamespaceQuotaError   = errors.New("Server hosts as many unlisted namespaces as it allows")
+
+	namespaces = AllNamespaces{
+		config: NamespaceConfig{AllowUnlisted: true},
+		all:    make(map[string]*Namespace),
+	}
+)
+
+func loadNamespaceConfig(path string) (NamespaceConfig, error) {
+	var config NamespaceConfig
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err = json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+	if err = config.Default.checkOperators(); err != nil {
+		return config, errors.New(path + ": Default: " + err.Error())
+	}
+	for name, policy := range config.Namespaces {
+		if err = policy.checkOperators(); err != nil {
+			return config, errors.New(path + ": " + name + ": " + err.Error())
+		}
+	}
+
+	for name := range config.Namespaces {
+		util.OutLog.Printf("Hosting namespace %s\n", name)
+	}
+	return config, nil
+}
+
+// Looks up a namespace, creating it if it is listed in the config or unlisted
+// namespaces are allowed.
+func getNamespace(name string) (*Namespace, error) {
+	if name == "" {
+		name = shared.DefaultNamespace
+	}
+
+	namespaces.RLock()
+	ns, ok := namespaces.all[name]
+	namespaces.RUnlock()
+	if ok {
+		return ns, nil
+	}
+
+	namespaces.Lock()
+	defer namespaces.Unlock()
+
+	if ns, ok := namespaces.all[name]; ok {
+		return ns, nil
+	}
+
+	policy, listed := namespaces.config.Namespaces[name]
+	if !listed {
+		if !namespaces.config.AllowUnlisted && name != shared.DefaultNamespace {
+			return nil, unknownNamespaceError
+		}
+		if name != shared.DefaultNamespace && namespaces.unlisted() >= namespaces.config.maxUnlisted() {
+			return nil, unlistedQuotaError
+		}
+		policy = namespaces.config.Default
+	}
+
+	ns = &Namespace{
+		name:        name,
+		policy:      policy,
+		messages:    make([]StoredMessage, 0),
+		users:       make(map[string]time.Time),
+		memberships: make(map[string]map[string]bool),
+		banned:      make(map[string]bool),
+		mutedUntil:  make(map[string]time.Time),
+
+		registrations: make(map[string]*Registration),
+		inboxes:       make(map[string]*Inbox),
+		lastPolled:    make(map[string]time.Time),
+		sessions:      make(map[string]map[string]*Session),
+		readMarkers:   make(map[string]map[string]uint32),
+
+		seenSignatures:         make(map[string]time.Time),
+		seenMessageIds:         make(map[string]time.Time),
+		usedRegistrationTokens: make(map[string]bool),
+		prekeys:                make(map[uint64]*prekeyStore),
+		rosters:                make(map[uint64]*shared.RosterBlob),
+		approvals:              make(map[uint64]*approvalList),
+		blocks:                 make(map[uint64]map[uint64]bool),
+	}
+	namespaces.all[name] = ns
+	util.OutLog.Printf("Created namespace %s\n", name)
+
+	return ns, nil
+}
+
+// Namespaces created on demand, besides the default one.
+// Caller must hold the namespaces lock.
+func (n *AllNamespaces) unlisted() int {
+	count := 0
+	for name := range n.all {
+		if _, listed := n.config.Namespaces[name]; !listed && name != shared.DefaultNamespace {
+			count++
+		}
+	}
+	return count
+}
+
+func (c NamespaceConfig) maxUnlisted() int {
+	if c.MaxUnlisted > 0 {
+		return c.MaxUnlisted
+	}
+	return defaultMaxUnlisted
+}
+
+func channelOrDefault(channel string) string {
+	if channel == "" {
+		return shared.DefaultChannel
+	}
+	return channel
+}
+
+// Users start out in the default channel. Caller must hold the namespace lock.
+func (ns *Namespace) joinedChannels(username string) map[string]bool {
+	channels, ok := ns.memberships[username]
+	if !ok {
+		channels = map[string]bool{shared.DefaultChannel: true}
+		ns.memberships[username] = channels
+	}
+	return channels
+}
+
+// Appends a message to the log. Caller must hold the namespace lock.
+func (ns *Namespace) appendMessage(channel string, username string, message string, authorId uint64) *StoredMessage {
+	ns.messages = append(ns.messages, StoredMessage{
+		Channel:  channel,
+		Username: username,
+		AuthorId: authorId,
+		Message:  message,
+		Time:     time.Now(),
+	})
+	ns.applyRetention()
+	return &ns.messages[len(ns.messages)-1]
+}
+
+func (msg StoredMessage) meta(id uint32) shared.MessageMeta {
+	return shared.MessageMeta{
+		Id:          id,
+		Channel:     msg.Channel,
+		Time:        msg.Time,
+		Edited:      msg.Edited,
+		ClockSkewed: msg.ClockSkewed,
+		ExpiresAt:   msg.ExpiresAt,
+		Anonymous:   msg.Anonymous,
+		From:        msg.Username,
+		Encrypted:   msg.Encrypted,
+	}
+}
+
+func (msg StoredMessage) String() string {
+	return msg.format(msg.Message)
+}
+
+// The message as logged, its body redacted unless -log-sensitive is set
+func (msg StoredMessage) logString() string {
+	return msg.format(util.LogText(msg.Message))
+}
+
+// The text of a message bridges show without a sender: labelled if it is
+// anonymous, so it doesn't pass for a server notice, and a placeholder if it
+// is encrypted
+func (msg StoredMessage) bridgedText() string {
+	if msg.Encrypted != nil {
+		return shared.EncryptedPlaceholder
+	}
+	if msg.Anonymous {
+		return anonymousLabel + ": " + msg.Message
+	}
+	return msg.Message
+}
+
+func (msg StoredMessage) format(text string) string {
+	if msg.Encrypted != nil {
+		text = shared.EncryptedPlaceholder
+	}
+	if msg.Username != "" {
+		text = msg.Username + ": " + text
+	} else if msg.Anonymous {
+		text = anonymousLabel + ": " + text
+	}
+	if msg.Channel != shared.DefaultChannel {
+		text = "[" + msg.Channel + "] " + text
+	}
+	return text
+}
+
+// Drops messages that exceed the namespace's retention policy or their TTL.
+// Caller must hold the namespace lock.
+func (ns *Namespace) applyRetention() {
+	ns.expireMessages()
+
+	drop := 0
+	if ns.policy.MaxMessages > 0 && len(ns.messages) > ns.policy.MaxMessages {
+		drop = len(ns.messages) - ns.policy.MaxMessages
+	}
+
+	if ns.policy.MaxMessageAgeSecs > 0 {
+		cutoff := time.Now().Add(-time.Duration(ns.policy.MaxMessageAgeSecs) * time.Second)
+		for drop < len(ns.messages) && ns.messages[drop].Time.Before(cutoff) {
+			drop++
+		}
+	}
+
+	if drop > 0 {
+		ns.messages = append([]StoredMessage(nil), ns.messages[drop:]...)
+		ns.firstId += uint32(drop)
+	}
+
+	dropDirect := 0
+	if ns.policy.MaxMessages > 0 && len(ns.directMessages) > ns.policy.MaxMessages {
+		dropDirect = len(ns.directMessages) - ns.policy.MaxMessages
+	}
+	if ns.policy.MaxMessageAgeSecs > 0 {
+		cutoff := time.Now().Add(-time.Duration(ns.policy.MaxMessageAgeSecs) * time.Second)
+		for dropDirect < len(ns.directMessages) && ns.directMessages[dropDirect].Time.Before(cutoff) {
+			dropDirect++
+		}
+	}
+	if dropDirect > 0 {
+		ns.directMessages = append([]StoredDirectMessage(nil), ns.directMessages[dropDirect:]...)
+		ns.firstDirectId += uint32(dropDirect)
+	}
+
+	// Updates to dropped messages are no use to anyone
+	dropUpdates := 0
+	for dropUpdates < len(ns.updates) && ns.updates[dropUpdates].MessageId < ns.firstId {
+		dropUpdates++
+	}
+	if dropUpdates > 0 {
+		ns.updates = append([]shared.MessageUpdate(nil), ns.updates[dropUpdates:]...)
+		ns.firstUpdateId += uint32(dropUpdates)
+	}
+}
+
+// Periodically applies retention so idle namespaces also expire old messages
+func enforceRetention() {
+	for {
+		time.Sleep(time.Duration(retentionPeriod) * time.Second)
+
+		namespaces.RLock()
+		for _, ns := range namespaces.all {
+			ns.Lock()
+			ns.applyRetention()
+			ns.expirePresence()
+			ns.expireInboxes()
+			ns.expireSessions()
+			ns.Unlock()
+		}
+		namespaces.RUnlock()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Starts the tests over with the namespaces config describes
+func resetNamespaces(config NamespaceConfig) {
+	namespaces.Lock()
+	namespaces.config = config
+	namespaces.all = make(map[string]*Namespace)
+	namespaces.Unlock()
+}
+
+func publish(namespace string, username string, message string) error {
+	var ack bool
+	return new(CServer).PublishMessage(shared.ChatMessage{Namespace: namespace, Username: username, UserToken: "token-" + username, Message: message}, &ack)
+}
+
+func poll(t *testing.T, namespace string, last uint32) shared.PollingResponse {
+	var resp shared.PollingResponse
+	if err := new(CServer).GetNewMessages(shared.PollingMessage{Namespace: namespace, LastMessageId: last}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true})
+	if err := publish("uni", "alice", "hi uni"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("", "bob", "hi default"); err != nil {
+		t.Fatal(err)
+	}
+
+	uni := poll(t, "uni", 0)
+	if len(uni.Messages) != 1 || uni.Messages[0] != "alice: hi uni" || uni.NextMessageId != 1 {
+		t.Fatalf("uni has %+v", uni)
+	}
+	if def := poll(t, shared.DefaultNamespace, 0); len(def.Messages) != 1 || def.Messages[0] != "bob: hi default" {
+		t.Fatalf("the default namespace has %+v", def)
+	}
+	if again := poll(t, "uni", uni.NextMessageId); len(again.Messages) != 0 {
+		t.Fatalf("polling from the end gave %+v", again)
+	}
+}
+
+func TestUnlistedNamespaces(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := publish("elsewhere", "alice", "hi"); err != unknownNamespaceError {
+		t.Fatalf("an unlisted namespace gave %v, want %v", err, unknownNamespaceError)
+	}
+	if err := publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("", "alice", "hi"); err != nil {
+		t.Fatalf("the default namespace wasn't created: %v", err)
+	}
+}
+
+func TestUnlistedNamespacesAreCapped(t *testing.T) {
+	resetNamespaces(NamespaceConfig{AllowUnlisted: true, MaxUnlisted: 2, Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, name := range []string{"one", "two"} {
+		if err := publish(name, "alice", "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publish("three", "alice", "hi"); err != unlistedQuotaError {
+		t.Fatalf("a third unlisted namespace gave %v, want %v", err, unlistedQuotaError)
+	}
+	// Listed namespaces, the default one and those already created don't count
+	for _, name := range []string{"uni", "", "one"} {
+		if err := publish(name, "alice", "hi"); err != nil {
+			t.Fatalf("namespace %q gave %v", name, err)
+		}
+	}
+}
+
+func TestNamespaceQuotas(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{
+		"small": {MaxUsers: 1, MaxMessageLength: 5, MaxMessages: 2},
+	}})
+	if err := publish("small", "alice", "too long"); err != messageTooLongError {
+		t.Fatalf("a long message gave %v, want %v", err, messageTooLongError)
+	}
+	for _, message := range []string{"one", "two", "three"} {
+		if err := publish("small", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publish("small", "bob", "hi"); err != namespaceQuotaError {
+		t.Fatalf("a second user gave %v, want %v", err, namespaceQuotaError)
+	}
+
+	// The oldest message was dropped, and polls from before it skip past it
+	resp := poll(t, "small", 0)
+	if len(resp.Messages) != 2 || resp.Messages[0] != "alice: two" || resp.NextMessageId != 3 {
+		t.Fatalf("small has %+v", resp)
+	}
+}
+
+func TestRetentionByAge(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"brief": {MaxMessageAgeSecs: 60}}})
+	if err := publish("brief", "alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+	ns, err := getNamespace("brief")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Lock()
+	ns.messages[0].Time = time.Now().Add(-2 * time.Minute)
+	ns.applyRetention()
+	ns.Unlock()
+
+	if resp := poll(t, "brief", 0); len(resp.Messages) != 0 || resp.NextMessageId != 1 {
+		t.Fatalf("an expired message is still kept: %+v", resp)
+	}
+}
+
+func TestLateMessagesExpire(t *testing.T) {
+	resetNamespaces(NamespaceConfig{})
+	var ack bool
+	late := shared.ChatMessage{Username: "alice", UserToken: "token-alice", Message: "hi", Deadline: time.Now().Add(-time.Second)}
+	if err := new(CServer).PublishMessage(late, &ack); err != shared.ExpiredError {
+		t.Fatalf("a late message gave %v, want %v", err, shared.ExpiredError)
+	}
+	late.Deadline = time.Now().Add(time.Minute)
+	if err := new(CServer).PublishMessage(late, &ack); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkewedClocksAreFlagged(t *testing.T) {
+	resetNamespaces(NamespaceConfig{})
+	var ack bool
+	for _, sentAt := range []time.Time{time.Now(), time.Now().Add(-time.Hour), {}} {
+		msg := shared.ChatMessage{Username: "alice", UserToken: "token-alice", Message: "hi", SentAt: sentAt}
+		if err := new(CServer).PublishMessage(msg, &ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp := poll(t, "", 0)
+	if len(resp.MessageMeta) != 3 || resp.MessageMeta[0].ClockSkewed || !resp.MessageMeta[1].ClockSkewed || resp.MessageMeta[2].ClockSkewed {
+		t.Fatalf("got %+v", resp.MessageMeta)
+	}
+
+	// A deadline is judged on the server's clock, not the sender's
+	behind := shared.ChatMessage{Username: "alice", UserToken: "token-alice", Message: "hi", SentAt: time.Now().Add(-time.Hour), Deadline: time.Now().Add(-59 * time.Minute)}
+	if err := new(CServer).PublishMessage(behind, &ack); err != nil {
+		t.Fatalf("a deadline a minute away on the sender's clock gave %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type PostingTokenError error
+
+const (
+	// Posting token configurations
+	postingKeyBits       int           = 2048
+	postingKeyLifetime   time.Duration = 24 * time.Hour // tokens are signed with a key this long, then redeemed for as long again
+	maxPostingTokenBatch int           = 20
+
+	anonymousLabel string = "(anonymous)" // shown where an anonymous message would have its username
+)
+
+// A key posting tokens are signed with, and the tokens already spent, by
+// namespace and token key
+type postingKey struct {
+	private   *rsa.PrivateKey
+	public    shared.PostingKey
+	id        string
+	signUntil time.Time
+	spent     map[string]bool
+}
+
+// The key tokens are signed with now, and the one before it whose tokens are
+// still redeemed. Spent tokens are forgotten with their key, so the sets
+// never hold more than two lifetimes of tokens.
+type PostingKeys struct {
+	sync.Mutex
+	current  *postingKey
+	previous *postingKey
+}
+
+var (
+	// Posting Token Errors
+	postingTokensDisabledError  PostingTokenError = errors.New("Anonymous posting is not enabled in this namespace")
+	tokensNeedRegistrationError PostingTokenError = errors.New("Only registered usernames are issued posting tokens")
+	badPostingTokenError        PostingTokenError = errors.New("Posting token was not signed by this IRC server")
+	postingTokenSpentError      PostingTokenError = errors.New("Posting token has already been spent")
+	anonymousMessageError       PostingTokenError = errors.New("Posting tokens are only spent on channel messages without a username")
+	tooManyTokensError          PostingTokenError = errors.New("Too many posting tokens asked for at once")
+	badTokenSignatureError      PostingTokenError = errors.New("Message signature does not match its posting token")
+
+	postingKeys = PostingKeys{}
+)
+
+// The key to sign tokens with, made the first time one is needed and again
+// once it has signed for postingKeyLifetime
+func (keys *PostingKeys) signing() (*postingKey, error) {
+	keys.Lock()
+	defer keys.Unlock()
+
+	if keys.current != nil && time.Now().Before(keys.current.signUntil) {
+		return keys.current, nil
+	}
+
+	private, err := rsa.GenerateKey(util.Random, postingKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	key := &postingKey{
+		private:   private,
+		public:    shared.PostingKeyOf(&private.PublicKey, now.Add(2*postingKeyLifetime)),
+		signUntil: now.Add(postingKeyLifetime),
+		spent:     make(map[string]bool),
+	}
+	key.id = key.public.Id()
+
+	keys.previous, keys.current = keys.current, key
+	util.OutLog.Printf("New posting key %s\n", key.id)
+	return key, nil
+}
+
+// The key a token names, if its tokens are still redeemed
+func (keys *PostingKeys) redeeming(id string) *postingKey {
+	keys.Lock()
+	defer keys.Unlock()
+
+	now := time.Now()
+	for _, key := range []*postingKey{keys.current, keys.previous} {
+		if key != nil && key.id == id && now.Before(key.public.ExpiresAt) {
+			return key
+		}
+	}
+	return nil
+}
+
+// Marks a token spent, or returns false if it was spent before
+func (keys *PostingKeys) spend(key *postingKey, namespace string, token shared.PostingToken) bool {
+	keys.Lock()
+	defer keys.Unlock()
+
+	spentKey := namespace + "\n" + string(token.PublicKey)
+	if key.spent[spentKey] {
+		return false
+	}
+	key.spent[spentKey] = true
+	return true
+}
+
+// Signs the blinded tokens of a registered user, up to the namespace's
+// PostingTokens for each key. The server learns nothing about the tokens it
+// signs, so the messages they are spent on can't be traced back to the user.
+func (c *CServer) IssuePostingTokens(req shared.PostingTokenRequest, resp *shared.PostingTokenResponse) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if ns.policy.PostingTokens <= 0 {
+		return postingTokensDisabledError
+	}
+	if len(req.Blinded) > maxPostingTokenBatch {
+		return tooManyTokensError
+	}
+	// Making a key takes a while, so not under the namespace lock
+	key, err := postingKeys.signing()
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return tokensNeedRegistrationError
+	}
+	if err = ns.checkCanPublish(reg.Username); err != nil {
+		return err
+	}
+
+	if ns.tokensIssuedKey != key.id {
+		ns.tokensIssuedKey = key.id
+		ns.tokensIssued = make(map[uint64]int)
+	}
+
+	remaining := ns.policy.PostingTokens - ns.tokensIssued[reg.Id]
+	*resp = shared.PostingTokenResponse{Key: key.public}
+
+	// Blinded for an older key, or just asking for the key
+	if req.KeyId == key.id {
+		for _, blinded := range req.Blinded {
+			if remaining <= 0 {
+				break
+			}
+			signature, err := shared.SignBlindedToken(key.private, blinded)
+			if err != nil {
+				return err
+			}
+			resp.Signatures = append(resp.Signatures, signature)
+			remaining--
+		}
+		ns.tokensIssued[reg.Id] += len(resp.Signatures)
+	}
+	resp.Remaining = remaining
+
+	if len(resp.Signatures) > 0 {
+		util.OutLog.Printf("[%s] Issued %d posting tokens to %s\n", ns.name, len(resp.Signatures), reg.Username)
+	}
+	return nil
+}
+
+// Publishes a channel message that carries a posting token instead of a
+// username, after the checks of publish that don't need one. The token is
+// spent last so a message refused for another reason doesn't cost one.
+// Caller must hold the namespace lock.
+func (ns *Namespace) publishAnonymous(chatMessage shared.ChatMessage, remoteHost string, skew time.Duration) error {
+	if ns.policy.PostingTokens <= 0 {
+		return postingTokensDisabledError
+	}
+	if chatMessage.Username != "" || chatMessage.UserToken != "" || chatMessage.Recipient != "" || chatMessage.Encrypted != nil || chatMessage.SenderKey != nil || chatMessage.Ratchet != nil {
+		return anonymousMessageError
+	}
+
+	token := *chatMessage.PostingToken
+	key := postingKeys.redeeming(token.KeyId)
+	if key == nil {
+		return shared.PostingKeyExpiredError
+	}
+	if !shared.VerifyPostingToken(key.public, ns.name, token) {
+		return badPostingTokenError
+	}
+	if !shared.VerifyMessage(chatMessage, ed25519.PublicKey(token.PublicKey)) {
+		return badTokenSignatureError
+	}
+	age := time.Since(chatMessage.SentAt)
+	if chatMessage.SentAt.IsZero() || age > maxSignedMessageAge || age < -maxSignedMessageAge {
+		return staleSignatureError
+	}
+
+	// A retry of a message that got through
+	ns.forgetOldSignatures()
+	if _, seen := ns.seenSignatures[string(chatMessage.Signature)]; seen {
+		return nil
+	}
+
+	if err := rateLimiter.allow(ns.name, "", shared.HostKey(remoteHost)); err != nil {
+		util.OutLog.Printf("[%s] Throttled anonymous message via %s: %s\n", ns.name, remoteHost, err)
+		return err
+	}
+	if ns.policy.MaxMessageLength > 0 && len(chatMessage.Message) > ns.policy.MaxMessageLength {
+		return messageTooLongError
+	}
+	expiresAt, err := expiryOf(chatMessage.TTL)
+	if err != nil {
+		return err
+	}
+
+	if !postingKeys.spend(key, ns.name, token) {
+		return postingTokenSpentError
+	}
+
+	channel := channelOrDefault(chatMessage.Channel)
+	msg := ns.appendMessage(channel, "", chatMessage.Message, 0)
+	msg.Anonymous = true
+	msg.ClockSkewed = skew != 0
+	msg.ExpiresAt = expiresAt
+	ns.scheduleExpiry(expiresAt)
+	ns.rememberSignature(chatMessage)
+	util.OutLog.Printf("[%s] %s\n", ns.name, ns.messages[len(ns.messages)-1].logString())
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Blinds a token for bob, has it signed and unblinds it
+func issueTestToken(t *testing.T) (shared.PostingToken, shared.BlindedToken) {
+	req := shared.PostingTokenRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob"}
+	var resp shared.PostingTokenResponse
+	if err := new(CServer).IssuePostingTokens(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	blinded, err := shared.BlindPostingToken(resp.Key, "uni", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.KeyId, req.Blinded = resp.Key.Id(), [][]byte{blinded.Blinded}
+	if err = new(CServer).IssuePostingTokens(req, &resp); err != nil || len(resp.Signatures) != 1 {
+		t.Fatalf("signed %d tokens, %v", len(resp.Signatures), err)
+	}
+	token, err := blinded.Unblind(resp.Signatures[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, blinded
+}
+
+func publishAnonymously(t *testing.T, token shared.PostingToken, blinded shared.BlindedToken, message string) error {
+	chatMessage := shared.ChatMessage{Namespace: "uni", Message: message, SentAt: time.Now()}
+	if err := shared.SignAnonymousMessage(&chatMessage, token, blinded.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	return new(CServer).PublishMessage(chatMessage, &ack)
+}
+
+func TestPostingTokens(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {PostingTokens: 2}}})
+	var resp shared.PostingTokenResponse
+	if err := new(CServer).IssuePostingTokens(shared.PostingTokenRequest{Namespace: "uni", Username: "bob"}, &resp); err != tokensNeedRegistrationError {
+		t.Fatalf("an unregistered user gave %v, want %v", err, tokensNeedRegistrationError)
+	}
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	token, blinded := issueTestToken(t)
+	if err := publishAnonymously(t, token, blinded, "who said this"); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 0); len(resp.Messages) != 1 || resp.Messages[0] != anonymousLabel+": who said this" {
+		t.Fatalf("published %q", resp.Messages)
+	}
+	if err := publishAnonymously(t, token, blinded, "and again"); err != postingTokenSpentError {
+		t.Fatalf("spending a token twice gave %v, want %v", err, postingTokenSpentError)
+	}
+
+	// Each user gets PostingTokens a key
+	issueTestToken(t)
+	req := shared.PostingTokenRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob", KeyId: token.KeyId, Blinded: [][]byte{blinded.Blinded}}
+	if err := new(CServer).IssuePostingTokens(req, &resp); err != nil || len(resp.Signatures) != 0 || resp.Remaining != 0 {
+		t.Fatalf("signed %d tokens over the allowance, %v", len(resp.Signatures), err)
+	}
+}
+
+func TestPostingTokensAreBoundToTheirNamespace(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {PostingTokens: 1}, "other": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	var resp shared.PostingTokenResponse
+	if err := new(CServer).IssuePostingTokens(shared.PostingTokenRequest{Namespace: "other"}, &resp); err != postingTokensDisabledError {
+		t.Fatalf("a namespace without tokens gave %v, want %v", err, postingTokensDisabledError)
+	}
+
+	token, blinded := issueTestToken(t)
+	chatMessage := shared.ChatMessage{Namespace: "uni", Message: "hi", SentAt: time.Now(), Recipient: "bob"}
+	if err := shared.SignAnonymousMessage(&chatMessage, token, blinded.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	if err := new(CServer).PublishMessage(chatMessage, &ack); err != anonymousMessageError {
+		t.Fatalf("an anonymous direct message gave %v, want %v", err, anonymousMessageError)
+	}
+	chatMessage.Recipient, chatMessage.Message = "", "changed"
+	if err := new(CServer).PublishMessage(chatMessage, &ack); err != badTokenSignatureError {
+		t.Fatalf("a message changed after signing gave %v, want %v", err, badTokenSignatureError)
+	}
+}
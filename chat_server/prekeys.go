@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+
+	"../shared"
+	"../util"
+)
+
+type PrekeyError error
+
+const (
+	// Prekey configurations
+	maxOneTimePrekeys int = 100 // unclaimed one-time prekeys kept per user
+	maxClaimedPrekeys int = 100 // claimed ones kept until the owner is sent a message using them
+)
+
+// The prekeys a user's proxy left for others to start sessions with. Private
+// halves are sealed to the user's encryption key, so they are only of use to
+// the user's proxy, which gets them back with the first message of a session.
+type prekeyStore struct {
+	signed    *shared.Prekey
+	signature []byte
+	previous  *shared.Prekey // replaced, kept for sessions started just before
+	oneTime   []shared.Prekey
+	claimed   []shared.Prekey // handed out in a bundle, oldest first
+}
+
+var (
+	// Prekey Errors
+	prekeysNeedRegistrationError PrekeyError = errors.New("Only registered usernames with signing and encryption keys can leave prekeys")
+	badPrekeyError               PrekeyError = errors.New("Prekeys must be X25519 keys with a nonzero id and a sealed private half")
+	badPrekeySignatureError      PrekeyError = errors.New("Signed prekey is not signed by the registered signing key")
+	tooManyPrekeysError          PrekeyError = errors.New("Too many one-time prekeys left on the IRC server")
+	ratchetIdentityError         PrekeyError = errors.New("Encrypted direct message names an identity key other than the sender's")
+)
+
+func validPrekey(p shared.Prekey) bool {
+	return p.Id != 0 && len(p.Public) == encryptionKeySize && len(p.Sealed) > 0
+}
+
+// Stores prekeys for the sender. A signed prekey replaces the current one;
+// one-time prekeys are added to those left.
+func (c *CServer) UploadPrekeys(req shared.PrekeyUpload, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil || reg.SigningKey == nil || reg.EncryptionKey == nil {
+		return prekeysNeedRegistrationError
+	}
+
+	store, ok := ns.prekeys[reg.Id]
+	if !ok {
+		store = &prekeyStore{}
+	}
+	if req.SignedPrekey != nil {
+		if !validPrekey(*req.SignedPrekey) {
+			return badPrekeyError
+		}
+		if !ed25519.Verify(reg.SigningKey, shared.SignedPrekeyBytes(*req.SignedPrekey), req.Signature) {
+			return badPrekeySignatureError
+		}
+	}
+	if len(store.oneTime)+len(req.OneTimePrekeys) > maxOneTimePrekeys {
+		return tooManyPrekeysError
+	}
+	for _, p := range req.OneTimePrekeys {
+		if !validPrekey(p) || store.prekey(p.Id) != nil {
+			return badPrekeyError
+		}
+	}
+
+	if req.SignedPrekey != nil {
+		if store.signed != nil && store.signed.Id != req.SignedPrekey.Id {
+			store.previous = store.signed
+		}
+		signed := *req.SignedPrekey
+		store.signed = &signed
+		store.signature = req.Signature
+	}
+	store.oneTime = append(store.oneTime, req.OneTimePrekeys...)
+	ns.prekeys[reg.Id] = store
+
+	util.OutLog.Printf("[%s] %s left %d one-time prekeys, %d in all\n", ns.name, reg.Username, len(req.OneTimePrekeys), len(store.oneTime))
+	*ack = true
+	return nil
+}
+
+// Returns the owner's bundle, handing out one of their one-time prekeys if
+// any are left
+func (c *CServer) GetPrekeyBundle(req shared.PrekeyBundleRequest, resp *shared.PrekeyBundle) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	if _, err = ns.authenticate(req.Username, req.UserToken, false); err != nil {
+		return err
+	}
+	owner, ok := ns.registrations[req.Owner]
+	if !ok {
+		return unknownRecipientError
+	}
+	store, ok := ns.prekeys[owner.Id]
+	if !ok || store.signed == nil {
+		return shared.NoPrekeysError
+	}
+
+	*resp = shared.PrekeyBundle{
+		Owner:        owner.Username,
+		IdentityKey:  owner.EncryptionKey,
+		SigningKey:   owner.SigningKey,
+		SignedPrekey: publicPrekey(*store.signed),
+		Signature:    store.signature,
+	}
+	if len(store.oneTime) > 0 {
+		oneTime := store.oneTime[0]
+		store.oneTime = store.oneTime[1:]
+		store.claimed = append(store.claimed, oneTime)
+		if len(store.claimed) > maxClaimedPrekeys {
+			store.claimed = store.claimed[len(store.claimed)-maxClaimedPrekeys:]
+		}
+		public := publicPrekey(oneTime)
+		resp.OneTimePrekey = &public
+	}
+	return nil
+}
+
+// A prekey without its sealed half, as other users get it
+func publicPrekey(p shared.Prekey) shared.Prekey {
+	return shared.Prekey{Id: p.Id, Public: p.Public}
+}
+
+// The user's prekey with that id, wherever it is kept
+func (store *prekeyStore) prekey(id uint32) *shared.Prekey {
+	for _, p := range []*shared.Prekey{store.signed, store.previous} {
+		if p != nil && p.Id == id {
+			return p
+		}
+	}
+	for _, list := range [][]shared.Prekey{store.oneTime, store.claimed} {
+		for i := range list {
+			if list[i].Id == id {
+				return &list[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Checks an encrypted direct message and builds its envelope. A message
+// starting a session gets the recipient's sealed prekeys it used attached,
+// the one-time prekey only once since it is used up with that.
+// Caller must hold the namespace lock.
+func (ns *Namespace) ratchetEnvelope(from *Registration, recipient string, message shared.RatchetMessage) (*shared.RatchetEnvelope, error) {
+	envelope := &shared.RatchetEnvelope{From: from.Username, Message: message}
+	init := message.Init
+	if init == nil {
+		return envelope, nil
+	}
+	if !bytes.Equal(init.IdentityKey, from.EncryptionKey) {
+		return nil, ratchetIdentityError
+	}
+
+	reg, ok := ns.registrations[recipient]
+	if !ok {
+		return nil, unknownRecipientError
+	}
+	store, ok := ns.prekeys[reg.Id]
+	if !ok {
+		return envelope, nil
+	}
+	for _, p := range []*shared.Prekey{store.signed, store.previous} {
+		if p != nil && p.Id == init.SignedPrekeyId {
+			signed := *p
+			envelope.SignedPrekey = &signed
+		}
+	}
+	for i, p := range store.claimed {
+		if init.OneTimePrekeyId != 0 && p.Id == init.OneTimePrekeyId {
+			envelope.OneTimePrekey = &p
+			store.claimed = append(store.claimed[:i:i], store.claimed[i+1:]...)
+			break
+		}
+	}
+	return envelope, nil
+}
+
+// The id of the user's signed prekey, zero if none, and how many one-time
+// prekeys they have left. Caller must hold the namespace lock.
+func (ns *Namespace) prekeysLeft(reg *Registration) (uint32, int) {
+	store, ok := ns.prekeys[reg.Id]
+	if !ok || store.signed == nil {
+		return 0, 0
+	}
+	return store.signed.Id, len(store.oneTime)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"../shared"
+)
+
+// Registers username with signing and encryption keys and leaves a signed
+// prekey and one one-time prekey
+func uploadTestPrekeys(t *testing.T, username string) ed25519.PrivateKey {
+	pub, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := shared.EncryptionKeyFromSigningKey(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	req := shared.UserNameRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, SigningKey: pub, EncryptionKey: identity.PublicKey().Bytes()}
+	if err = new(CServer).RegisterUserName(req, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	signed, _ := shared.NewPrekey(1, identity, rand.Reader)
+	oneTime, _ := shared.NewPrekey(2, identity, rand.Reader)
+	upload := shared.PrekeyUpload{
+		Namespace:      "uni",
+		Username:       username,
+		UserToken:      "token-" + username,
+		SignedPrekey:   &signed,
+		Signature:      ed25519.Sign(signingKey, shared.SignedPrekeyBytes(signed)),
+		OneTimePrekeys: []shared.Prekey{oneTime},
+	}
+	if err = new(CServer).UploadPrekeys(upload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return signingKey
+}
+
+func getPrekeyBundle(owner string) (shared.PrekeyBundle, error) {
+	var bundle shared.PrekeyBundle
+	err := new(CServer).GetPrekeyBundle(shared.PrekeyBundleRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice", Owner: owner}, &bundle)
+	return bundle, err
+}
+
+func TestPrekeyBundles(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	uploadTestPrekeys(t, "bob")
+	if err := registerUserName("carol", "token-carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := getPrekeyBundle("bob")
+	if err != nil || !shared.VerifyPrekeyBundle(bundle) || bundle.OneTimePrekey == nil {
+		t.Fatalf("got %+v, %v", bundle, err)
+	}
+	if bundle.SignedPrekey.Sealed != nil || bundle.OneTimePrekey.Sealed != nil {
+		t.Fatal("a bundle handed out sealed private halves")
+	}
+	// One-time prekeys are handed out once
+	if again, err := getPrekeyBundle("bob"); err != nil || again.OneTimePrekey != nil {
+		t.Fatalf("got %+v, %v", again, err)
+	}
+	if _, err = getPrekeyBundle("carol"); err != shared.NoPrekeysError {
+		t.Fatalf("a user without prekeys gave %v, want %v", err, shared.NoPrekeysError)
+	}
+	if _, err = getPrekeyBundle("dave"); err != unknownRecipientError {
+		t.Fatalf("an unregistered user gave %v, want %v", err, unknownRecipientError)
+	}
+}
+
+func TestUploadPrekeys(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	signingKey := uploadTestPrekeys(t, "bob")
+	identity, _ := shared.EncryptionKeyFromSigningKey(signingKey)
+	if err := registerUserName("carol", "token-carol"); err != nil {
+		t.Fatal(err)
+	}
+	signed, _ := shared.NewPrekey(3, identity, rand.Reader)
+	other, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	var ack bool
+	for _, test := range []struct {
+		req  shared.PrekeyUpload
+		want error
+	}{
+		{shared.PrekeyUpload{Username: "carol", UserToken: "token-carol"}, prekeysNeedRegistrationError},
+		{shared.PrekeyUpload{Username: "bob", UserToken: "token-bob", SignedPrekey: &signed, Signature: []byte("forged")}, badPrekeySignatureError},
+		{shared.PrekeyUpload{Username: "bob", UserToken: "token-bob", OneTimePrekeys: []shared.Prekey{{Id: 2, Public: other.PublicKey().Bytes(), Sealed: []byte("x")}}}, badPrekeyError},
+		{shared.PrekeyUpload{Username: "bob", UserToken: "token-bob", OneTimePrekeys: []shared.Prekey{{Id: 4, Public: []byte("short"), Sealed: []byte("x")}}}, badPrekeyError},
+		{shared.PrekeyUpload{Username: "bob", UserToken: "token-bob", OneTimePrekeys: make([]shared.Prekey, maxOneTimePrekeys)}, tooManyPrekeysError},
+	} {
+		test.req.Namespace = "uni"
+		if err := new(CServer).UploadPrekeys(test.req, &ack); err != test.want {
+			t.Fatalf("%+v gave %v, want %v", test.req, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"../shared"
+)
+
+type UnknownPresenceError error
+
+const (
+	presenceLifetime time.Duration = 10 * time.Second // events older than this are not delivered
+)
+
+// A presence event waiting to be polled. Ids count up from 0 per namespace.
+type PresenceRecord struct {
+	Id    uint32
+	Event shared.PresenceEvent
+	Time  time.Time
+}
+
+var (
+	// Presence Errors
+	unknownPresenceError UnknownPresenceError = errors.New("Unknown presence event kind")
+)
+
+// Drops presence events nobody should see anymore. Caller must hold the namespace lock.
+func (ns *Namespace) expirePresence() {
+	cutoff := time.Now().Add(-presenceLifetime)
+	drop := 0
+	for drop < len(ns.presence) && ns.presence[drop].Time.Before(cutoff) {
+		drop++
+	}
+	if drop > 0 {
+		ns.presence = append([]PresenceRecord(nil), ns.presence[drop:]...)
+	}
+}
+
+// Returns presence events after lastEventId in the user's channels, leaving
+// out their own, and the id to poll from next. Caller must hold the namespace lock.
+func (ns *Namespace) presenceSince(username string, lastEventId uint32) ([]shared.PresenceEvent, uint32) {
+	ns.expirePresence()
+
+	// A cursor ahead of the server (e.g. after a restart) starts over
+	if lastEventId > ns.nextPresenceId {
+		lastEventId = 0
+	}
+
+	channels := ns.joinedChannels(username)
+	events := make([]shared.PresenceEvent, 0)
+	for _, record := range ns.presence {
+		if record.Id >= lastEventId && record.Event.Username != username && channels[record.Event.Channel] {
+			events = append(events, record.Event)
+		}
+	}
+	return events, ns.nextPresenceId
+}
+
+// Relays a presence event to the other members of a channel. Only members of
+// the channel who may publish to it can announce presence there.
+func (c *CServer) PublishPresence(req shared.PresenceRequest, ack *bool) error {
+	if req.Kind != shared.PresenceTyping && req.Kind != shared.PresenceStoppedTyping {
+		return unknownPresenceError
+	}
+
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if err = ns.checkCanPublish(req.Username); err != nil {
+		return err
+	}
+	if err = ns.checkImplicitClaim(req.Username); err != nil {
+		return err
+	}
+	if _, err = ns.authenticate(req.Username, req.UserToken, true); err != nil {
+		return err
+	}
+
+	channel := channelOrDefault(req.Channel)
+	if !ns.joinedChannels(req.Username)[channel] {
+		*ack = false
+		return nil
+	}
+
+	ns.expirePresence()
+	ns.presence = append(ns.presence, PresenceRecord{
+		Id: ns.nextPresenceId,
+		Event: shared.PresenceEvent{
+			Channel:  channel,
+			Username: req.Username,
+			Kind:     req.Kind,
+		},
+		Time: time.Now(),
+	})
+	ns.nextPresenceId++
+
+	*ack = true
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func publishPresence(username string, kind string) (bool, error) {
+	var ack bool
+	err := new(CServer).PublishPresence(shared.PresenceRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, Kind: kind}, &ack)
+	return ack, err
+}
+
+func pollEvents(t *testing.T, username string, last uint32) shared.PollingResponse {
+	var resp shared.PollingResponse
+	if err := new(CServer).GetNewMessages(shared.PollingMessage{Namespace: "uni", Username: username, UserToken: "token-" + username, LastEventId: last}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestPresenceReachesOtherMembers(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if _, err := publishPresence("alice", "dancing"); err != unknownPresenceError {
+		t.Fatalf("an unknown kind gave %v, want %v", err, unknownPresenceError)
+	}
+	// Only members of the channel can announce presence in it
+	var ack bool
+	req := shared.PresenceRequest{Namespace: "uni", Channel: "#go", Username: "alice", UserToken: "token-alice", Kind: shared.PresenceTyping}
+	if err := new(CServer).PublishPresence(req, &ack); err != nil || ack {
+		t.Fatalf("a non-member's presence gave %v, %v", ack, err)
+	}
+	var err error
+
+	for _, username := range []string{"alice", "bob"} {
+		if err = publish("uni", username, "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ack, err = publishPresence("alice", shared.PresenceTyping); err != nil || !ack {
+		t.Fatalf("presence gave %v, %v", ack, err)
+	}
+
+	resp := pollEvents(t, "bob", 0)
+	if len(resp.Events) != 1 || resp.Events[0].Username != "alice" || resp.Events[0].Kind != shared.PresenceTyping || resp.NextEventId != 1 {
+		t.Fatalf("bob got %+v", resp)
+	}
+	if mine := pollEvents(t, "alice", 0); len(mine.Events) != 0 {
+		t.Fatalf("alice got her own events %+v", mine.Events)
+	}
+	if again := pollEvents(t, "bob", resp.NextEventId); len(again.Events) != 0 {
+		t.Fatalf("bob got %+v again", again.Events)
+	}
+}
+
+func TestPresenceExpires(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, username := range []string{"alice", "bob"} {
+		if err := publish("uni", username, "hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := publishPresence("alice", shared.PresenceTyping); err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := getNamespace("uni")
+	ns.Lock()
+	ns.presence[0].Time = time.Now().Add(-2 * presenceLifetime)
+	ns.Unlock()
+
+	if resp := pollEvents(t, "bob", 0); len(resp.Events) != 0 {
+		t.Fatalf("bob got an expired event %+v", resp.Events)
+	}
+	// A cursor from before a restart starts over
+	if resp := pollEvents(t, "bob", 50); resp.NextEventId != 1 {
+		t.Fatalf("a cursor ahead of the server gave %+v", resp)
+	}
+}
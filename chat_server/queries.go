@@ -0,0 +1,185 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"../shared"
+)
+
+const (
+	// Query configurations
+	activeUserWindow  time.Duration = time.Hour // users who posted or polled since count as active
+	messageRateWindow int           = 60        // minutes GetMessageRates counts messages over
+)
+
+// Runs a query on the namespace of req after checking the operator. The
+// namespace is read locked while query runs.
+func queryNamespace(req shared.OperatorQuery, query func(ns *Namespace)) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.RLock()
+	defer ns.RUnlock()
+
+	if err = ns.authorizeOperator(req.Operator, req.Token); err != nil {
+		return err
+	}
+	query(ns)
+	return nil
+}
+
+// Lists the namespace's channels: those with messages kept and those users
+// joined, sorted by name
+func (c *CServer) ListChannels(req shared.OperatorQuery, channels *[]shared.ChannelActivity) error {
+	return queryNamespace(req, func(ns *Namespace) {
+		*channels = ns.channelActivity(time.Now())
+	})
+}
+
+// Lists the users who posted or polled within activeUserWindow, sorted by
+// username
+func (c *CServer) ListActiveUsers(req shared.OperatorQuery, users *[]shared.UserActivity) error {
+	return queryNamespace(req, func(ns *Namespace) {
+		*users = ns.activeUsers(time.Now())
+	})
+}
+
+// Counts the messages published in each of the last messageRateWindow minutes
+func (c *CServer) GetMessageRates(req shared.OperatorQuery, rates *shared.MessageRates) error {
+	return queryNamespace(req, func(ns *Namespace) {
+		*rates = ns.messageRates(time.Now())
+	})
+}
+
+// Lists the latest moderation actions, newest first
+func (c *CServer) ListModerationActions(req shared.OperatorQuery, actions *[]shared.ModerationAction) error {
+	return queryNamespace(req, func(ns *Namespace) {
+		*actions = ns.moderationActions()
+	})
+}
+
+// Every query at once, for the dashboard
+func (c *CServer) GetNamespaceActivity(req shared.OperatorQuery, activity *shared.NamespaceActivity) error {
+	return queryNamespace(req, func(ns *Namespace) {
+		now := time.Now()
+		*activity = shared.NamespaceActivity{
+			Namespace:  ns.name,
+			Time:       now,
+			Channels:   ns.channelActivity(now),
+			Users:      ns.activeUsers(now),
+			Rates:      ns.messageRates(now),
+			Moderation: ns.moderationActions(),
+		}
+	})
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) channelActivity(now time.Time) []shared.ChannelActivity {
+	byName := make(map[string]*shared.ChannelActivity)
+	channel := func(name string) *shared.ChannelActivity {
+		if _, ok := byName[name]; !ok {
+			byName[name] = &shared.ChannelActivity{Name: name}
+		}
+		return byName[name]
+	}
+
+	hourAgo := now.Add(-time.Duration(messageRateWindow) * time.Minute)
+	for _, msg := range ns.messages {
+		if msg.Deleted {
+			continue
+		}
+		activity := channel(msg.Channel)
+		activity.Messages++
+		if msg.Time.After(activity.LastMessage) {
+			activity.LastMessage = msg.Time
+		}
+		if published(msg) && msg.Time.After(hourAgo) {
+			activity.PerMinute++
+		}
+	}
+	for _, joined := range ns.memberships {
+		for name := range joined {
+			channel(name).Members++
+		}
+	}
+
+	channels := make([]shared.ChannelActivity, 0, len(byName))
+	for _, activity := range byName {
+		activity.PerMinute /= float64(messageRateWindow)
+		channels = append(channels, *activity)
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) activeUsers(now time.Time) []shared.UserActivity {
+	seen := make(map[string]bool)
+	for username, posted := range ns.users {
+		if now.Sub(posted) <= activeUserWindow {
+			seen[username] = true
+		}
+	}
+	for username, polled := range ns.lastPolled {
+		if now.Sub(polled) <= activeUserWindow {
+			seen[username] = true
+		}
+	}
+
+	users := make([]shared.UserActivity, 0, len(seen))
+	for username := range seen {
+		user := shared.UserActivity{
+			Username:   username,
+			Devices:    len(ns.sessions[username]),
+			LastPosted: ns.users[username],
+			LastPolled: ns.lastPolled[username],
+			Banned:     ns.banned[username],
+		}
+		_, user.Registered = ns.registrations[username]
+		if until, ok := ns.mutedUntil[username]; ok && now.Before(until) {
+			user.MutedUntil = until
+		}
+		for channel := range ns.memberships[username] {
+			user.Channels = append(user.Channels, channel)
+		}
+		sort.Strings(user.Channels)
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) messageRates(now time.Time) shared.MessageRates {
+	rates := shared.MessageRates{PerMinute: make([]int, messageRateWindow)}
+	for _, msg := range ns.messages {
+		if !published(msg) {
+			continue
+		}
+		age := int(now.Sub(msg.Time) / time.Minute)
+		if age < 0 || age >= messageRateWindow {
+			continue
+		}
+		rates.PerMinute[messageRateWindow-1-age]++
+		rates.LastHour++
+	}
+	rates.PerSecond = float64(rates.PerMinute[messageRateWindow-1]) / 60
+	return rates
+}
+
+// Whether a user published msg, rather than it being a server notice
+func published(msg StoredMessage) bool {
+	return msg.Username != "" || msg.Anonymous
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) moderationActions() []shared.ModerationAction {
+	actions := make([]shared.ModerationAction, 0, len(ns.moderationLog))
+	for i := len(ns.moderationLog) - 1; i >= 0; i-- {
+		actions = append(actions, ns.moderationLog[i])
+	}
+	return actions
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func operatorQuery() shared.OperatorQuery {
+	return shared.OperatorQuery{Namespace: "uni", Operator: "carol", Token: "op-token"}
+}
+
+func TestOperatorQueries(t *testing.T) {
+	moderatedNamespace()
+	var ack bool
+	for _, msg := range []shared.ChatMessage{
+		{Namespace: "uni", Channel: "#go", Username: "bob", UserToken: "token-bob", Message: "hi"},
+		{Namespace: "uni", Channel: "#go", Username: "alice", UserToken: "token-alice", Message: "hello"},
+		{Namespace: "uni", Channel: "#rust", Username: "alice", UserToken: "token-alice", Message: "hey"},
+	} {
+		if err := new(CServer).PublishMessage(msg, &ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := moderation("bob")
+	req.Channel, req.Reason = "#go", "spam"
+	if err := new(CServer).Kick(req, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	var channels []shared.ChannelActivity
+	if err := new(CServer).ListChannels(operatorQuery(), &channels); err != nil || len(channels) != 3 || channels[1].Name != "#go" {
+		t.Fatalf("the channels are %+v, %v", channels, err)
+	}
+	// The kick notice is kept, but isn't counted as published
+	if goChannel := channels[1]; goChannel.Messages != 3 || goChannel.Members != 1 || goChannel.PerMinute*60 != 2 {
+		t.Fatalf("#go is %+v", goChannel)
+	}
+
+	var users []shared.UserActivity
+	if err := new(CServer).ListActiveUsers(operatorQuery(), &users); err != nil || len(users) != 2 || users[0].Username != "alice" {
+		t.Fatalf("the active users are %+v, %v", users, err)
+	}
+	if len(users[0].Channels) != 3 || len(users[1].Channels) != 1 {
+		t.Fatalf("alice is in %v and bob in %v", users[0].Channels, users[1].Channels)
+	}
+
+	var rates shared.MessageRates
+	if err := new(CServer).GetMessageRates(operatorQuery(), &rates); err != nil || rates.LastHour != 3 || rates.PerMinute[len(rates.PerMinute)-1] != 3 {
+		t.Fatalf("the rates are %+v, %v", rates, err)
+	}
+
+	var actions []shared.ModerationAction
+	if err := new(CServer).ListModerationActions(operatorQuery(), &actions); err != nil || len(actions) != 1 {
+		t.Fatalf("the moderation actions are %+v, %v", actions, err)
+	}
+	if action := actions[0]; action.Action != "kick" || action.Operator != "carol" || action.Username != "bob" || action.Reason != "spam" {
+		t.Fatalf("the kick was recorded as %+v", action)
+	}
+
+	wrong := operatorQuery()
+	wrong.Token = "wrong"
+	if err := new(CServer).ListActiveUsers(wrong, &users); err != notOperatorError {
+		t.Fatalf("a wrong operator token gave %v, want %v", err, notOperatorError)
+	}
+}
+
+func TestModerationLogIsCapped(t *testing.T) {
+	moderatedNamespace()
+	var ack bool
+	for i := 0; i < maxModerationLog+10; i++ {
+		if err := new(CServer).Unban(moderation("bob"), &ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var actions []shared.ModerationAction
+	if err := new(CServer).ListModerationActions(operatorQuery(), &actions); err != nil || len(actions) != maxModerationLog {
+		t.Fatalf("kept %d actions, %v", len(actions), err)
+	}
+}
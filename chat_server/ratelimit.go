@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"../shared"
+)
+
+const (
+	bucketIdleTimeout time.Duration = 10 * time.Minute // forget buckets that have been full this long
+)
+
+type RateLimit struct {
+	Rate  float64 // tokens added per second; 0 means unlimited
+	Burst float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets keyed by namespace/username and by exit node host
+type RateLimiter struct {
+	sync.Mutex
+	userLimit RateLimit
+	exitLimit RateLimit
+	users     map[string]*tokenBucket
+	exits     map[string]*tokenBucket
+}
+
+var rateLimiter = RateLimiter{
+	users: make(map[string]*tokenBucket),
+	exits: make(map[string]*tokenBucket),
+}
+
+// Takes one token from the user's and the exit's buckets, or returns a
+// ThrottledError without taking any if either is empty. Anonymous messages
+// have no username and only take from the exit's bucket; their posting
+// token limits them instead.
+func (rl *RateLimiter) allow(namespace string, username string, exitHost string) error {
+	rl.Lock()
+	defer rl.Unlock()
+
+	now := time.Now()
+	var userBucket *tokenBucket
+	if username != "" {
+		userBucket = rl.bucket(rl.users, namespace+"/"+username, rl.userLimit, now)
+	}
+	exitBucket := rl.bucket(rl.exits, exitHost, rl.exitLimit, now)
+
+	if wait := waitTime(userBucket, rl.userLimit); wait > 0 {
+		return shared.ThrottledError{Scope: "user", RetryAfter: wait}
+	}
+	if wait := waitTime(exitBucket, rl.exitLimit); wait > 0 {
+		return shared.ThrottledError{Scope: "exit", RetryAfter: wait}
+	}
+
+	if userBucket != nil {
+		userBucket.tokens--
+	}
+	if exitBucket != nil {
+		exitBucket.tokens--
+	}
+	return nil
+}
+
+// Returns the refilled bucket for key, or nil if the limit is unlimited
+func (rl *RateLimiter) bucket(buckets map[string]*tokenBucket, key string, limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		buckets[key] = b
+	}
+
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	return b
+}
+
+func waitTime(b *tokenBucket, limit RateLimit) time.Duration {
+	if b == nil || b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// Periodically drops buckets that have refilled so idle users don't pile up
+func (rl *RateLimiter) sweep() {
+	for {
+		time.Sleep(bucketIdleTimeout)
+
+		rl.Lock()
+		cutoff := time.Now().Add(-bucketIdleTimeout)
+		for _, buckets := range []map[string]*tokenBucket{rl.users, rl.exits} {
+			for key, b := range buckets {
+				if b.last.Before(cutoff) {
+					delete(buckets, key)
+				}
+			}
+		}
+		rl.Unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func testRateLimiter(user RateLimit, exit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		userLimit: user,
+		exitLimit: exit,
+		users:     make(map[string]*tokenBucket),
+		exits:     make(map[string]*tokenBucket),
+	}
+}
+
+func TestUserBurstThenThrottle(t *testing.T) {
+	rl := testRateLimiter(RateLimit{Rate: 1, Burst: 3}, RateLimit{})
+	for i := 0; i < 3; i++ {
+		if err := rl.allow("uni", "alice", "10.0.0.1"); err != nil {
+			t.Fatalf("message %d of a burst of 3 gave %v", i+1, err)
+		}
+	}
+	err := rl.allow("uni", "alice", "10.0.0.1")
+	throttled, ok := err.(shared.ThrottledError)
+	if !ok || throttled.Scope != "user" || throttled.RetryAfter <= 0 || throttled.RetryAfter > time.Second {
+		t.Fatalf("a fourth message gave %v", err)
+	}
+
+	// Other users and namespaces have their own buckets
+	if err = rl.allow("uni", "bob", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = rl.allow("other", "alice", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second later there is a token again
+	rl.users["uni/alice"].last = rl.users["uni/alice"].last.Add(-time.Second)
+	if err = rl.allow("uni", "alice", "10.0.0.1"); err != nil {
+		t.Fatalf("a refilled bucket gave %v", err)
+	}
+}
+
+func TestExitThrottleTakesNoUserToken(t *testing.T) {
+	rl := testRateLimiter(RateLimit{Rate: 1, Burst: 5}, RateLimit{Rate: 1, Burst: 1})
+	if err := rl.allow("uni", "alice", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	err := rl.allow("uni", "bob", "10.0.0.1")
+	if throttled, ok := err.(shared.ThrottledError); !ok || throttled.Scope != "exit" {
+		t.Fatalf("a second message through a full exit gave %v", err)
+	}
+	if tokens := rl.users["uni/bob"].tokens; tokens != 5 {
+		t.Fatalf("a throttled message took a user token, %v left", tokens)
+	}
+	if err = rl.allow("uni", "bob", "10.0.0.2"); err != nil {
+		t.Fatalf("another exit gave %v", err)
+	}
+}
+
+func TestUnlimitedRates(t *testing.T) {
+	rl := testRateLimiter(RateLimit{}, RateLimit{})
+	for i := 0; i < 100; i++ {
+		if err := rl.allow("uni", "alice", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rl.users) != 0 || len(rl.exits) != 0 {
+		t.Fatal("unlimited rates kept buckets")
+	}
+}
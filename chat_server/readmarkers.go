@@ -0,0 +1,84 @@
+package main
+
+import (
+	"../shared"
+)
+
+// Returns the user's read markers and the number of unread messages in each
+// joined channel. Messages the user sent don't count as unread.
+// Caller must hold the namespace lock.
+func (ns *Namespace) unreadCounts(username string, channels map[string]bool) (map[string]uint32, map[string]int) {
+	markers := make(map[string]uint32)
+	for channel, id := range ns.readMarkers[username] {
+		markers[channel] = id
+	}
+
+	counts := make(map[string]int)
+	for channel := range channels {
+		counts[channel] = 0
+	}
+	for i, msg := range ns.messages {
+		if !channels[msg.Channel] || msg.Deleted || msg.Username == username {
+			continue
+		}
+		if marker, ok := markers[msg.Channel]; ok && ns.firstId+uint32(i) <= marker {
+			continue
+		}
+		counts[msg.Channel]++
+	}
+	return markers, counts
+}
+
+// Moves the user's read marker in a channel forward. Markers never move back,
+// so devices marking messages read out of order can't undo each other.
+func (c *CServer) MarkRead(req shared.ReadMarkerRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	if _, err = ns.authenticate(req.Username, req.UserToken, false); err != nil {
+		return err
+	}
+
+	markers, ok := ns.readMarkers[req.Username]
+	if !ok {
+		markers = make(map[string]uint32)
+		ns.readMarkers[req.Username] = markers
+	}
+
+	channel := channelOrDefault(req.Channel)
+	if marker, ok := markers[channel]; !ok || req.MessageId > marker {
+		markers[channel] = req.MessageId
+	}
+
+	*ack = true
+	return nil
+}
+
+// Returns the user's read markers and unread counts without polling for messages
+func (c *CServer) GetReadMarkers(req shared.ReadMarkerRequest, resp *shared.PollingResponse) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	if _, err = ns.authenticate(req.Username, req.UserToken, false); err != nil {
+		return err
+	}
+
+	resp.ReadMarkers, resp.UnreadCounts = ns.unreadCounts(req.Username, ns.joinedChannels(req.Username))
+	return nil
+}
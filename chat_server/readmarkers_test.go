@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func markRead(username string, channel string, messageId uint32) error {
+	var ack bool
+	return new(CServer).MarkRead(shared.ReadMarkerRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, Channel: channel, MessageId: messageId}, &ack)
+}
+
+func readMarkers(t *testing.T, username string) shared.PollingResponse {
+	var resp shared.PollingResponse
+	if err := new(CServer).GetReadMarkers(shared.ReadMarkerRequest{Namespace: "uni", Username: username, UserToken: "token-" + username}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestUnreadCounts(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, message := range []string{"one", "two", "three"} {
+		if err := publish("uni", "alice", message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publish("uni", "bob", "mine"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing read yet, and bob's own message doesn't count
+	if resp := readMarkers(t, "bob"); resp.UnreadCounts[shared.DefaultChannel] != 3 {
+		t.Fatalf("bob has %v unread", resp.UnreadCounts)
+	}
+	if err := markRead("bob", "", 1); err != nil {
+		t.Fatal(err)
+	}
+	resp := readMarkers(t, "bob")
+	if resp.UnreadCounts[shared.DefaultChannel] != 1 || resp.ReadMarkers[shared.DefaultChannel] != 1 {
+		t.Fatalf("after reading up to 1 bob has %v unread and markers %v", resp.UnreadCounts, resp.ReadMarkers)
+	}
+
+	// Markers only move forward
+	if err := markRead("bob", shared.DefaultChannel, 0); err != nil {
+		t.Fatal(err)
+	}
+	if resp = readMarkers(t, "bob"); resp.ReadMarkers[shared.DefaultChannel] != 1 {
+		t.Fatalf("a marker moved back to %v", resp.ReadMarkers)
+	}
+}
+
+func TestReadMarkersNeedTheUsersToken(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	if err := new(CServer).MarkRead(shared.ReadMarkerRequest{Namespace: "uni", Username: "bob", UserToken: "wrong"}, &ack); err != userNameTakenError {
+		t.Fatalf("marking another user's messages read gave %v, want %v", err, userNameTakenError)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"time"
+
+	"../shared"
+)
+
+const (
+	// Redundant delivery configurations
+	messageIdWindow        time.Duration = 10 * time.Minute // how long a message id is remembered
+	messageIdPruneInterval time.Duration = time.Minute
+)
+
+// Message ids are only unique per sender
+func messageIdKey(chatMessage shared.ChatMessage) string {
+	return chatMessage.Username + "\n" + chatMessage.MessageId
+}
+
+// Whether a message with the same id from the same sender was published, as
+// when a proxy sends every message over two circuits. Caller must hold the
+// namespace lock.
+func (ns *Namespace) duplicate(chatMessage shared.ChatMessage) bool {
+	if chatMessage.MessageId == "" {
+		return false
+	}
+	if time.Since(ns.messageIdsPruned) >= messageIdPruneInterval {
+		ns.messageIdsPruned = time.Now()
+		for key, seen := range ns.seenMessageIds {
+			if time.Since(seen) > messageIdWindow {
+				delete(ns.seenMessageIds, key)
+			}
+		}
+	}
+	_, seen := ns.seenMessageIds[messageIdKey(chatMessage)]
+	return seen
+}
+
+// Remembers the id of a published message. Only messages that got through
+// are remembered, so a copy that failed a check can't shadow the real one.
+// Caller must hold the namespace lock.
+func (ns *Namespace) rememberMessageId(chatMessage shared.ChatMessage) {
+	if chatMessage.MessageId != "" {
+		ns.seenMessageIds[messageIdKey(chatMessage)] = time.Now()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestMessagesArePublishedOnce(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	var ack bool
+	msg := shared.ChatMessage{Namespace: "uni", Username: "alice", UserToken: "token-alice", Message: "hi", MessageId: "0123"}
+	for i := 0; i < 2; i++ {
+		if err := new(CServer).PublishMessage(msg, &ack); err != nil || !ack {
+			t.Fatalf("copy %d gave %v", i+1, err)
+		}
+	}
+	// Ids are only unique per sender
+	other := msg
+	other.Username, other.UserToken = "bob", "token-bob"
+	if err := new(CServer).PublishMessage(other, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 0); len(resp.Messages) != 2 || resp.Messages[0] != "alice: hi" || resp.Messages[1] != "bob: hi" {
+		t.Fatalf("published %q", resp.Messages)
+	}
+
+	// A copy refused by a check doesn't shadow the real one
+	refused := shared.ChatMessage{Namespace: "uni", Username: "alice", UserToken: "token-mallory", Message: "hi", MessageId: "4567"}
+	if err := new(CServer).PublishMessage(refused, &ack); err == nil {
+		t.Fatal("a copy with the wrong token was published")
+	}
+	refused.UserToken = "token-alice"
+	if err := new(CServer).PublishMessage(refused, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 2); len(resp.Messages) != 1 {
+		t.Fatalf("published %q", resp.Messages)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"../shared"
+)
+
+type RegistrationGateError error
+
+const (
+	// Proof of work stamps further off the server's clock than this are
+	// refused, so work can't be done in advance for many usernames at once
+	maxProofOfWorkAge time.Duration = 10 * time.Minute
+)
+
+var (
+	// Registration Gate Errors
+	registrationRequiredError      RegistrationGateError = errors.New("Usernames in this namespace must be registered with RegisterUserName first")
+	badRegistrationTokenError      RegistrationGateError = errors.New("Registration token is unknown or already used")
+	registrationTokenRequiredError RegistrationGateError = errors.New("Registering a username here takes a registration token")
+	staleProofOfWorkStampError     RegistrationGateError = errors.New("Proof of work stamp is too far off the IRC server's clock")
+)
+
+// Whether new usernames in the namespace have to pass a registration gate
+func (ns *Namespace) gatesRegistration() bool {
+	return len(ns.policy.RegistrationTokens) > 0 || ns.policy.RegistrationPowBits > 0
+}
+
+// Refuses to claim an unregistered username on the fly, as posting does, in
+// a namespace that gates registrations. Caller must hold the namespace lock.
+func (ns *Namespace) checkImplicitClaim(username string) error {
+	if _, ok := ns.registrations[username]; ok || !ns.gatesRegistration() {
+		return nil
+	}
+	return registrationRequiredError
+}
+
+// Checks that a request registering a new username passes the namespace's
+// gate, with an unused registration token or a proof of work. Returns the
+// token to spend once the username is registered. Usernames already
+// registered pass, so proxies can re-register after reconnecting. Caller
+// must hold the namespace lock.
+func (ns *Namespace) admitRegistration(req shared.UserNameRequest) (string, error) {
+	if _, ok := ns.registrations[req.Username]; ok || !ns.gatesRegistration() {
+		return "", nil
+	}
+
+	if req.RegistrationToken != "" {
+		for _, token := range ns.policy.RegistrationTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(req.RegistrationToken)) == 1 && !ns.usedRegistrationTokens[token] {
+				return token, nil
+			}
+		}
+	}
+
+	// A token that doesn't work here may still be backed by work
+	bits := ns.policy.RegistrationPowBits
+	if bits <= 0 {
+		if req.RegistrationToken != "" {
+			return "", badRegistrationTokenError
+		}
+		return "", registrationTokenRequiredError
+	}
+	if req.PowStamp.IsZero() {
+		return "", shared.ProofOfWorkError{Bits: bits}
+	}
+	age := time.Since(req.PowStamp)
+	if age > maxProofOfWorkAge || age < -maxProofOfWorkAge {
+		return "", staleProofOfWorkStampError
+	}
+	if !shared.CheckProofOfWork(ns.name, req.Username, req.PowStamp, req.PowNonce, bits) {
+		return "", shared.ProofOfWorkError{Bits: bits}
+	}
+	return "", nil
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) useRegistrationToken(token string) {
+	if token != "" {
+		ns.usedRegistrationTokens[token] = true
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func registerWith(req shared.UserNameRequest) error {
+	var ack bool
+	req.Namespace = "uni"
+	req.UserToken = "token-" + req.Username
+	return new(CServer).RegisterUserName(req, &ack)
+}
+
+func TestRegistrationTokens(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {RegistrationTokens: []string{"invite-1"}}}})
+
+	if err := registerWith(shared.UserNameRequest{Username: "alice"}); err != registrationTokenRequiredError {
+		t.Fatalf("registering without a token gave %v, want %v", err, registrationTokenRequiredError)
+	}
+	if err := registerWith(shared.UserNameRequest{Username: "alice", RegistrationToken: "guess"}); err != badRegistrationTokenError {
+		t.Fatalf("a wrong token gave %v, want %v", err, badRegistrationTokenError)
+	}
+	if err := registerWith(shared.UserNameRequest{Username: "alice", RegistrationToken: "invite-1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Tokens are spent, registered usernames can register again
+	if err := registerWith(shared.UserNameRequest{Username: "bob", RegistrationToken: "invite-1"}); err != badRegistrationTokenError {
+		t.Fatalf("a used token gave %v, want %v", err, badRegistrationTokenError)
+	}
+	if err := registerWith(shared.UserNameRequest{Username: "alice"}); err != nil {
+		t.Fatalf("re-registering gave %v", err)
+	}
+
+	// Posting or showing presence doesn't claim a username in a gated
+	// namespace
+	if err := publish("uni", "bob", "hi"); err != registrationRequiredError {
+		t.Fatalf("posting as an unregistered user gave %v, want %v", err, registrationRequiredError)
+	}
+	if _, err := publishPresence("bob", shared.PresenceTyping); err != registrationRequiredError {
+		t.Fatalf("presence of an unregistered user gave %v, want %v", err, registrationRequiredError)
+	}
+	if err := publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistrationProofOfWork(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {RegistrationPowBits: 8}}})
+
+	err := registerWith(shared.UserNameRequest{Username: "alice"})
+	if pow, ok := shared.ParseProofOfWorkError(err); !ok || pow.Bits != 8 {
+		t.Fatalf("registering without work gave %v", err)
+	}
+
+	stamp := time.Now()
+	nonce := shared.SolveProofOfWork("uni", "alice", stamp, 8)
+	// Unless alice's nonce happens to solve bob's puzzle too
+	if !shared.CheckProofOfWork("uni", "bob", stamp, nonce, 8) {
+		if err = registerWith(shared.UserNameRequest{Username: "bob", PowStamp: stamp, PowNonce: nonce}); err == nil {
+			t.Fatal("work done for another username was accepted")
+		}
+	}
+	old := stamp.Add(-2 * maxProofOfWorkAge)
+	if err = registerWith(shared.UserNameRequest{Username: "alice", PowStamp: old, PowNonce: shared.SolveProofOfWork("uni", "alice", old, 8)}); err != staleProofOfWorkStampError {
+		t.Fatalf("an old stamp gave %v, want %v", err, staleProofOfWorkStampError)
+	}
+	if err = registerWith(shared.UserNameRequest{Username: "alice", PowStamp: stamp, PowNonce: nonce}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+
+	"../shared"
+	"../util"
+)
+
+type RosterError error
+
+const (
+	// Roster configurations
+	maxRosterSize int = 64 * 1024 // bytes of encrypted blob kept per user
+)
+
+var (
+	// Roster Errors
+	rosterNeedsRegistrationError RosterError = errors.New("Only registered usernames can sync a roster")
+	rosterTooLargeError          RosterError = errors.New("Roster is too large to sync")
+)
+
+// Replaces the sender's roster blob, if they saw the one it replaces. The
+// blob is encrypted by the sender's proxy; it is kept as it is.
+func (c *CServer) PutRoster(req shared.RosterRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return rosterNeedsRegistrationError
+	}
+	if len(req.Blob) > maxRosterSize {
+		return rosterTooLargeError
+	}
+
+	var version uint64
+	if stored, ok := ns.rosters[reg.Id]; ok {
+		version = stored.Version
+	}
+	if req.BaseVersion != version {
+		return shared.RosterConflictError
+	}
+	ns.rosters[reg.Id] = &shared.RosterBlob{Version: version + 1, Blob: req.Blob}
+
+	util.OutLog.Printf("[%s] %s synced roster version %d\n", ns.name, reg.Username, version+1)
+	*ack = true
+	return nil
+}
+
+// Returns the sender's roster blob, version zero if they never synced one
+func (c *CServer) GetRoster(req shared.RosterRequest, resp *shared.RosterBlob) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	reg, err := ns.authenticate(req.Username, req.UserToken, false)
+	if err != nil {
+		return err
+	}
+	if reg == nil {
+		return rosterNeedsRegistrationError
+	}
+
+	*resp = shared.RosterBlob{}
+	if stored, ok := ns.rosters[reg.Id]; ok {
+		*resp = *stored
+	}
+	return nil
+}
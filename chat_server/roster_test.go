@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func putRoster(username string, base uint64, blob string) error {
+	var ack bool
+	return new(CServer).PutRoster(shared.RosterRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, BaseVersion: base, Blob: []byte(blob)}, &ack)
+}
+
+func TestRosterSync(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := putRoster("alice", 0, "sealed"); err != rosterNeedsRegistrationError {
+		t.Fatalf("an unregistered user gave %v, want %v", err, rosterNeedsRegistrationError)
+	}
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	var blob shared.RosterBlob
+	get := shared.RosterRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice"}
+	if err := new(CServer).GetRoster(get, &blob); err != nil || blob.Version != 0 {
+		t.Fatalf("got %+v, %v before any sync", blob, err)
+	}
+	if err := putRoster("alice", 0, "first"); err != nil {
+		t.Fatal(err)
+	}
+	// A device that hasn't seen the first sync can't overwrite it
+	if err := putRoster("alice", 0, "stale"); err != shared.RosterConflictError {
+		t.Fatalf("a stale put gave %v, want %v", err, shared.RosterConflictError)
+	}
+	if err := putRoster("alice", 1, "second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(CServer).GetRoster(get, &blob); err != nil || blob.Version != 2 || string(blob.Blob) != "second" {
+		t.Fatalf("got %+v, %v", blob, err)
+	}
+	if err := putRoster("alice", 2, string(make([]byte, maxRosterSize+1))); err != rosterTooLargeError {
+		t.Fatalf("a large roster gave %v, want %v", err, rosterTooLargeError)
+	}
+}
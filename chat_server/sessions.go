@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/subtle"
+	"time"
+)
+
+// One device (onion proxy) polling for a username. Devices of the same user
+// share its registration token and each keeps its own cursors.
+type Session struct {
+	LastPolled    time.Time
+	LastMessageId uint32 // messages before this id have been delivered to the device
+	LastInboxId   uint32 // inbox messages before this id have been delivered to the device
+}
+
+// Returns the session of a user's device, starting one if needed.
+// Caller must hold the namespace lock.
+func (ns *Namespace) session(username string, deviceId string) *Session {
+	devices, ok := ns.sessions[username]
+	if !ok {
+		devices = make(map[string]*Session)
+		ns.sessions[username] = devices
+	}
+
+	sess, ok := devices[deviceId]
+	if !ok {
+		sess = &Session{}
+		devices[deviceId] = sess
+	}
+	return sess
+}
+
+// Returns the lowest inbox cursor of the user's devices, so inbox messages
+// are kept until every device has picked them up. Caller must hold the namespace lock.
+func (ns *Namespace) inboxAckedByAll(username string) uint32 {
+	var acked uint32
+	first := true
+	for _, sess := range ns.sessions[username] {
+		if first || sess.LastInboxId < acked {
+			acked = sess.LastInboxId
+			first = false
+		}
+	}
+	return acked
+}
+
+// Returns the current name of a registration that used to be called username.
+// Lets a user's other devices follow a nick change made on one of them.
+// Caller must hold the namespace lock.
+func (ns *Namespace) renamedTo(username string, token string) (string, bool) {
+	if _, ok := ns.registrations[username]; ok || token == "" {
+		return "", false
+	}
+
+	for current, reg := range ns.registrations {
+		if subtle.ConstantTimeCompare([]byte(reg.Token), []byte(token)) != 1 {
+			continue
+		}
+		for _, previous := range reg.PreviousNames {
+			if previous == username {
+				return current, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Forgets devices that have not polled for as long as queued messages are
+// kept. Caller must hold the namespace lock.
+func (ns *Namespace) expireSessions() {
+	cutoff := time.Now().Add(-ns.inboxTTL())
+	for username, devices := range ns.sessions {
+		for deviceId, sess := range devices {
+			if sess.LastPolled.Before(cutoff) {
+				delete(devices, deviceId)
+			}
+		}
+		if len(devices) == 0 {
+			delete(ns.sessions, username)
+		}
+	}
+}
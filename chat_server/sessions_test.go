@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func pollDevice(t *testing.T, username string, deviceId string, lastInboxId uint32) shared.PollingResponse {
+	var resp shared.PollingResponse
+	req := shared.PollingMessage{Namespace: "uni", Username: username, UserToken: "token-bob", DeviceId: deviceId, LastInboxId: lastInboxId}
+	if err := new(CServer).GetNewMessages(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestInboxIsKeptForEveryDevice(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	pollDevice(t, "bob", "laptop", 0)
+	pollDevice(t, "bob", "phone", 0)
+	if err := sendDirectMessage("alice", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	laptop := pollDevice(t, "bob", "laptop", 0)
+	if len(laptop.Inbox) != 1 {
+		t.Fatalf("the laptop got %q", laptop.Inbox)
+	}
+	if acked := pollDevice(t, "bob", "laptop", laptop.NextInboxId); len(acked.Inbox) != 0 {
+		t.Fatalf("the laptop got %q again", acked.Inbox)
+	}
+	// The laptop acknowledging it doesn't take it from the phone
+	if phone := pollDevice(t, "bob", "phone", 0); len(phone.Inbox) != 1 {
+		t.Fatalf("the phone got %q", phone.Inbox)
+	}
+	pollDevice(t, "bob", "phone", laptop.NextInboxId)
+
+	ns, _ := getNamespace("uni")
+	ns.Lock()
+	kept := len(ns.inboxes["bob"].messages)
+	ns.Unlock()
+	if kept != 0 {
+		t.Fatalf("%d messages kept after every device acknowledged them", kept)
+	}
+}
+
+func TestDevicesFollowNickChanges(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	rename := shared.UserNameRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob", NewUsername: "robert"}
+	if err := new(CServer).ChangeUserName(rename, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if resp := pollDevice(t, "bob", "phone", 0); resp.Username != "robert" {
+		t.Fatalf("the phone still polls as %q", resp.Username)
+	}
+
+	// Devices that stop polling are forgotten
+	ns, _ := getNamespace("uni")
+	ns.Lock()
+	ns.sessions["robert"]["phone"].LastPolled = time.Now().Add(-2 * ns.inboxTTL())
+	ns.expireSessions()
+	_, kept := ns.sessions["robert"]
+	ns.Unlock()
+	if kept {
+		t.Fatal("an idle device was kept")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"../shared"
+)
+
+type SignatureError error
+
+const (
+	// Signed messages whose send time is further off the server's clock
+	// than this are refused, so a signature only has to be remembered this
+	// long to catch replays
+	maxSignedMessageAge    time.Duration = 10 * time.Minute
+	signaturePruneInterval time.Duration = time.Minute
+)
+
+var (
+	// Signature Errors
+	badSignatureError       SignatureError = errors.New("Message signature does not match the username's signing key")
+	signatureRequiredError  SignatureError = errors.New("Messages from this username must be signed")
+	staleSignatureError     SignatureError = errors.New("Send time of the signed message is too far off the IRC server's clock")
+	invalidSigningKeyError  SignatureError = errors.New("Signing keys must be 32 byte Ed25519 public keys")
+	signingKeyMismatchError SignatureError = errors.New("A different signing key is registered for this username")
+)
+
+// Registers key as the one reg's messages must be signed with, if reg has
+// none yet. An empty key changes nothing. Caller must hold the namespace lock.
+func (ns *Namespace) registerSigningKey(reg *Registration, key []byte) error {
+	if len(key) == 0 {
+		return nil
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return invalidSigningKeyError
+	}
+	if reg.SigningKey == nil {
+		reg.SigningKey = ed25519.PublicKey(append([]byte(nil), key...))
+		return nil
+	}
+	if !bytes.Equal(reg.SigningKey, key) {
+		return signingKeyMismatchError
+	}
+	return nil
+}
+
+// Checks who sent a message. A username with a signing key only accepts
+// messages signed with it, whoever knows its token, so no exit node can post
+// in its name. Other usernames are checked by token, and claimed by it if
+// unregistered; their signatures are ignored. Returns whether the message was
+// published before, in which case it must not be published again. Caller
+// must hold the namespace lock.
+func (ns *Namespace) authenticateMessage(chatMessage shared.ChatMessage) (*Registration, bool, error) {
+	reg, ok := ns.registrations[chatMessage.Username]
+	if !ok || reg.SigningKey == nil {
+		if err := ns.checkImplicitClaim(chatMessage.Username); err != nil {
+			return nil, false, err
+		}
+		reg, err := ns.authenticate(chatMessage.Username, chatMessage.UserToken, true)
+		return reg, false, err
+	}
+
+	if len(chatMessage.Signature) == 0 {
+		return nil, false, signatureRequiredError
+	}
+	if !shared.VerifyMessage(chatMessage, reg.SigningKey) {
+		return nil, false, badSignatureError
+	}
+	age := time.Since(chatMessage.SentAt)
+	if chatMessage.SentAt.IsZero() || age > maxSignedMessageAge || age < -maxSignedMessageAge {
+		return nil, false, staleSignatureError
+	}
+
+	// A retry of a message that got through, or a replay
+	ns.forgetOldSignatures()
+	_, seen := ns.seenSignatures[string(chatMessage.Signature)]
+	return reg, seen, nil
+}
+
+// Remembers a published signed message so it isn't published twice. Caller
+// must hold the namespace lock.
+func (ns *Namespace) rememberSignature(chatMessage shared.ChatMessage) {
+	if len(chatMessage.Signature) > 0 {
+		ns.seenSignatures[string(chatMessage.Signature)] = chatMessage.SentAt
+	}
+}
+
+// Caller must hold the namespace lock.
+func (ns *Namespace) forgetOldSignatures() {
+	if time.Since(ns.signaturesPruned) < signaturePruneInterval {
+		return
+	}
+	ns.signaturesPruned = time.Now()
+	for signature, sentAt := range ns.seenSignatures {
+		if time.Since(sentAt) > maxSignedMessageAge {
+			delete(ns.seenSignatures, signature)
+		}
+	}
+}
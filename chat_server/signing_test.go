@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func registerSigningKey(t *testing.T, username string) ed25519.PrivateKey {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	if err = new(CServer).RegisterUserName(shared.UserNameRequest{Namespace: "uni", Username: username, UserToken: "token-" + username, SigningKey: pub}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signedMessage(key ed25519.PrivateKey, username string, message string) shared.ChatMessage {
+	m := shared.ChatMessage{Namespace: "uni", Username: username, UserToken: "token-" + username, Message: message, SentAt: time.Now()}
+	shared.SignMessage(&m, key)
+	return m
+}
+
+func TestSignedMessages(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	key := registerSigningKey(t, "alice")
+
+	var ack bool
+	if err := publish("uni", "alice", "unsigned"); err != signatureRequiredError {
+		t.Fatalf("an unsigned message gave %v, want %v", err, signatureRequiredError)
+	}
+	m := signedMessage(key, "alice", "hi")
+	if err := new(CServer).PublishMessage(m, &ack); err != nil {
+		t.Fatal(err)
+	}
+	// A retry or replay isn't published twice
+	if err := new(CServer).PublishMessage(m, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if resp := poll(t, "uni", 0); len(resp.Messages) != 1 {
+		t.Fatalf("published %v", resp.Messages)
+	}
+
+	// Knowing the token isn't enough once a key is registered
+	forged := m
+	forged.Message = "forged"
+	if err := new(CServer).PublishMessage(forged, &ack); err != badSignatureError {
+		t.Fatalf("a changed message gave %v, want %v", err, badSignatureError)
+	}
+	stale := m
+	stale.SentAt = time.Now().Add(-2 * maxSignedMessageAge)
+	shared.SignMessage(&stale, key)
+	if err := new(CServer).PublishMessage(stale, &ack); err != staleSignatureError {
+		t.Fatalf("an old message gave %v, want %v", err, staleSignatureError)
+	}
+}
+
+func TestRegisterSigningKey(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	registerSigningKey(t, "alice")
+
+	var ack bool
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := new(CServer).RegisterUserName(shared.UserNameRequest{Namespace: "uni", Username: "alice", UserToken: "token-alice", SigningKey: other}, &ack); err != signingKeyMismatchError {
+		t.Fatalf("registering another key gave %v, want %v", err, signingKeyMismatchError)
+	}
+	if err := new(CServer).RegisterUserName(shared.UserNameRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob", SigningKey: other[:8]}, &ack); err != invalidSigningKeyError {
+		t.Fatalf("a short key gave %v, want %v", err, invalidSigningKeyError)
+	}
+	// Registering again without a key keeps the one registered
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("uni", "alice", "unsigned"); err != signatureRequiredError {
+		t.Fatalf("an unsigned message gave %v, want %v", err, signatureRequiredError)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type InvalidTTLError error
+
+const (
+	minMessageTTL time.Duration = time.Second
+	maxMessageTTL time.Duration = 7 * 24 * time.Hour
+)
+
+var (
+	// TTL Errors
+	invalidTTLError InvalidTTLError = errors.New("Message TTL must be between a second and a week")
+)
+
+// When a message sent with ttl is purged, zero for messages without one
+func expiryOf(ttl time.Duration) (time.Time, error) {
+	if ttl == 0 {
+		return time.Time{}, nil
+	}
+	if ttl < minMessageTTL || ttl > maxMessageTTL {
+		return time.Time{}, invalidTTLError
+	}
+	return time.Now().Add(ttl), nil
+}
+
+// Remembers that a message will need purging at expiresAt.
+// Caller must hold the namespace lock.
+func (ns *Namespace) scheduleExpiry(expiresAt time.Time) {
+	if !expiresAt.IsZero() && (ns.nextExpiry.IsZero() || expiresAt.Before(ns.nextExpiry)) {
+		ns.nextExpiry = expiresAt
+	}
+}
+
+// Replaces messages and direct messages whose TTL ran out with tombstones,
+// and tells pollers that saw them. Cheap until the next message is due.
+// Caller must hold the namespace lock.
+func (ns *Namespace) expireMessages() {
+	now := time.Now()
+	if ns.nextExpiry.IsZero() || now.Before(ns.nextExpiry) {
+		return
+	}
+
+	var next time.Time
+	expired := make(map[uint32]bool)
+	for i, msg := range ns.messages {
+		if msg.ExpiresAt.IsZero() || msg.Deleted {
+			continue
+		}
+		if now.Before(msg.ExpiresAt) {
+			if next.IsZero() || msg.ExpiresAt.Before(next) {
+				next = msg.ExpiresAt
+			}
+			continue
+		}
+		id := ns.firstId + uint32(i)
+		expired[id] = true
+		ns.messages[i] = StoredMessage{Channel: msg.Channel, Time: msg.Time, Deleted: true}
+		ns.updates = append(ns.updates, shared.MessageUpdate{MessageId: id, Deleted: true, Expired: true})
+	}
+	ns.scrubUpdates(expired)
+
+	for i, msg := range ns.directMessages {
+		if msg.ExpiresAt.IsZero() || msg.Deleted {
+			continue
+		}
+		if now.Before(msg.ExpiresAt) {
+			if next.IsZero() || msg.ExpiresAt.Before(next) {
+				next = msg.ExpiresAt
+			}
+			continue
+		}
+		ns.directMessages[i] = StoredDirectMessage{Time: msg.Time, Deleted: true}
+	}
+
+	ns.nextExpiry = next
+	if len(expired) > 0 {
+		util.OutLog.Printf("[%s] %d messages expired\n", ns.name, len(expired))
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func publishWithTTL(from string, recipient string, message string, ttl time.Duration) error {
+	var ack bool
+	return new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Username: from, UserToken: "token-" + from, Recipient: recipient, Message: message, TTL: ttl}, &ack)
+}
+
+// Moves every message's expiry into the past, as if its TTL had run out
+func expireAll(t *testing.T) {
+	ns, err := getNamespace("uni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.Lock()
+	defer ns.Unlock()
+	past := time.Now().Add(-time.Second)
+	for i := range ns.messages {
+		if !ns.messages[i].ExpiresAt.IsZero() {
+			ns.messages[i].ExpiresAt = past
+		}
+	}
+	for i := range ns.directMessages {
+		if !ns.directMessages[i].ExpiresAt.IsZero() {
+			ns.directMessages[i].ExpiresAt = past
+		}
+	}
+	for _, inbox := range ns.inboxes {
+		for i := range inbox.messages {
+			if !inbox.messages[i].ExpiresAt.IsZero() {
+				inbox.messages[i].ExpiresAt = past
+			}
+		}
+	}
+	ns.nextExpiry = past
+}
+
+func TestMessageTTL(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	for _, ttl := range []time.Duration{time.Millisecond, 8 * 24 * time.Hour} {
+		if err := publishWithTTL("alice", "", "hi", ttl); err != invalidTTLError {
+			t.Fatalf("a TTL of %v gave %v, want %v", ttl, err, invalidTTLError)
+		}
+	}
+	if err := publishWithTTL("alice", "", "gone soon", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish("uni", "alice", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	seen := pollUpdates(t, 0, 0)
+	if len(seen.Messages) != 2 || seen.MessageMeta[0].ExpiresAt.IsZero() || !seen.MessageMeta[1].ExpiresAt.IsZero() {
+		t.Fatalf("bob got %+v", seen)
+	}
+
+	expireAll(t)
+	resp := pollUpdates(t, seen.NextMessageId, seen.NextUpdateId)
+	if len(resp.Updates) != 1 || resp.Updates[0].MessageId != 0 || !resp.Updates[0].Deleted || !resp.Updates[0].Expired {
+		t.Fatalf("bob got updates %+v", resp.Updates)
+	}
+	if fresh := pollUpdates(t, 0, 0); len(fresh.Messages) != 1 || fresh.Messages[0] != "alice: kept" {
+		t.Fatalf("a fresh poll got %+v", fresh)
+	}
+}
+
+func TestDirectMessageTTL(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishWithTTL("alice", "bob", "gone soon", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendDirectMessage("alice", "bob", "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	expireAll(t)
+	if resp := pollInbox(t, "bob", 0); len(resp.Inbox) != 1 || resp.Inbox[0] != "[DM] alice: kept" {
+		t.Fatalf("bob's inbox holds %q", resp.Inbox)
+	}
+	ns, _ := getNamespace("uni")
+	ns.RLock()
+	defer ns.RUnlock()
+	if msg := ns.directMessages[0]; !msg.Deleted || msg.Message != "" {
+		t.Fatalf("the expired direct message is kept as %+v", msg)
+	}
+}
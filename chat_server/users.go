@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type UserNameTakenError error
+type InvalidUserNameError error
+type UserTokenRequiredError error
+
+const (
+	maxUserNameLength int = 32
+)
+
+// Ownership of a username. The id stays the same across renames so a user's
+// messages, channels and mutes follow them to their new name.
+type Registration struct {
+	Id            uint64
+	Username      string
+	Token         string
+	PreviousNames []string
+	RegisteredAt  time.Time
+	SigningKey    ed25519.PublicKey // messages must be signed with this once set
+	EncryptionKey []byte            // X25519 key sender keys for the user are sealed to
+}
+
+var (
+	// Username Errors
+	userNameTakenError     UserNameTakenError     = errors.New("Username is already taken")
+	invalidUserNameError   InvalidUserNameError   = errors.New("Usernames must be 1-32 characters without spaces")
+	userTokenRequiredError UserTokenRequiredError = errors.New("A user token is required")
+)
+
+func validUserName(username string) bool {
+	return len(username) > 0 && len(username) <= maxUserNameLength && !strings.ContainsAny(username, " \t\r\n")
+}
+
+// Checks that token owns username. With claim set, an unregistered username
+// is registered to token; otherwise unregistered usernames are let through
+// and nil is returned. Caller must hold the namespace lock.
+func (ns *Namespace) authenticate(username string, token string, claim bool) (*Registration, error) {
+	reg, ok := ns.registrations[username]
+	if ok {
+		if subtle.ConstantTimeCompare([]byte(reg.Token), []byte(token)) != 1 {
+			return nil, userNameTakenError
+		}
+		return reg, nil
+	}
+
+	if !claim {
+		return nil, nil
+	}
+	if !validUserName(username) {
+		return nil, invalidUserNameError
+	}
+	if token == "" {
+		return nil, userTokenRequiredError
+	}
+
+	ns.nextUserId++
+	reg = &Registration{
+		Id:           ns.nextUserId,
+		Username:     username,
+		Token:        token,
+		RegisteredAt: time.Now(),
+	}
+	ns.registrations[username] = reg
+	util.OutLog.Printf("[%s] Registered %s\n", ns.name, username)
+
+	return reg, nil
+}
+
+// Claims a username, and registers the signing key its messages must be
+// signed with if it has none. Registering again with the same token succeeds,
+// so a proxy can re-register after reconnecting.
+func (c *CServer) RegisterUserName(req shared.UserNameRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	token, err := ns.admitRegistration(req)
+	if err != nil {
+		return err
+	}
+	reg, err := ns.authenticate(req.Username, req.UserToken, true)
+	if err != nil {
+		return err
+	}
+	ns.useRegistrationToken(token)
+	if err = ns.registerSigningKey(reg, req.SigningKey); err != nil {
+		return err
+	}
+	if err = ns.registerEncryptionKey(reg, req.EncryptionKey); err != nil {
+		return err
+	}
+
+	*ack = true
+	return nil
+}
+
+// Renames a registered user and tells every channel they are in
+func (c *CServer) ChangeUserName(req shared.UserNameRequest, ack *bool) error {
+	ns, err := getNamespace(req.Namespace)
+	if err != nil {
+		return err
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+
+	if ns.banned[req.Username] {
+		return bannedError
+	}
+	if err = ns.checkImplicitClaim(req.Username); err != nil {
+		return err
+	}
+	reg, err := ns.authenticate(req.Username, req.UserToken, true)
+	if err != nil {
+		return err
+	}
+	if err = ns.rename(reg, req.NewUsername); err != nil {
+		return err
+	}
+
+	*ack = true
+	return nil
+}
+
+// Moves a registration and everything tied to the username over to newName,
+// and tells every channel the user is in. Caller must hold the namespace lock.
+func (ns *Namespace) rename(reg *Registration, newName string) error {
+	if !validUserName(newName) {
+		return invalidUserNameError
+	}
+	if _, taken := ns.registrations[newName]; taken || ns.banned[newName] {
+		return userNameTakenError
+	}
+
+	oldName := reg.Username
+
+	delete(ns.registrations, oldName)
+	reg.PreviousNames = append(reg.PreviousNames, oldName)
+	reg.Username = newName
+	ns.registrations[newName] = reg
+
+	if lastSeen, ok := ns.users[oldName]; ok {
+		delete(ns.users, oldName)
+		ns.users[newName] = lastSeen
+	}
+	if until, ok := ns.mutedUntil[oldName]; ok {
+		delete(ns.mutedUntil, oldName)
+		ns.mutedUntil[newName] = until
+	}
+
+	if inbox, ok := ns.inboxes[oldName]; ok {
+		delete(ns.inboxes, oldName)
+		ns.inboxes[newName] = inbox
+	}
+	if lastPolled, ok := ns.lastPolled[oldName]; ok {
+		delete(ns.lastPolled, oldName)
+		ns.lastPolled[newName] = lastPolled
+	}
+	if devices, ok := ns.sessions[oldName]; ok {
+		delete(ns.sessions, oldName)
+		ns.sessions[newName] = devices
+	}
+	if markers, ok := ns.readMarkers[oldName]; ok {
+		delete(ns.readMarkers, oldName)
+		ns.readMarkers[newName] = markers
+	}
+
+	channels := ns.joinedChannels(oldName)
+	delete(ns.memberships, oldName)
+	ns.memberships[newName] = channels
+
+	for channel := range channels {
+		ns.appendMessage(channel, "", "*** "+oldName+" is now known as "+newName, 0)
+	}
+	util.OutLog.Printf("[%s] %s is now known as %s\n", ns.name, oldName, newName)
+
+	return nil
+}
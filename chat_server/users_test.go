@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func registerUserName(username string, token string) error {
+	var ack bool
+	return new(CServer).RegisterUserName(shared.UserNameRequest{Namespace: "uni", Username: username, UserToken: token}, &ack)
+}
+
+func TestRegisterUserName(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatalf("re-registering with the same token gave %v", err)
+	}
+	if err := registerUserName("alice", "token-mallory"); err != userNameTakenError {
+		t.Fatalf("a taken username gave %v, want %v", err, userNameTakenError)
+	}
+	if err := publish("uni", "alice", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	if err := new(CServer).PublishMessage(shared.ChatMessage{Namespace: "uni", Username: "alice", UserToken: "token-mallory", Message: "hi"}, &ack); err != userNameTakenError {
+		t.Fatalf("publishing as someone else gave %v, want %v", err, userNameTakenError)
+	}
+
+	for _, username := range []string{"", "two words", "abcdefghijklmnopqrstuvwxyz0123456"} {
+		if err := registerUserName(username, "token"); err != invalidUserNameError {
+			t.Fatalf("%q gave %v, want %v", username, err, invalidUserNameError)
+		}
+	}
+	if err := registerUserName("bob", ""); err != userTokenRequiredError {
+		t.Fatalf("an empty token gave %v, want %v", err, userTokenRequiredError)
+	}
+}
+
+func TestChangeUserName(t *testing.T) {
+	moderatedNamespace()
+	if err := publish("uni", "bob", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerUserName("alice", "token-alice"); err != nil {
+		t.Fatal(err)
+	}
+	var ack bool
+	mute := moderation("bob")
+	mute.DurationSecs = 60
+	if err := new(CServer).Mute(mute, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	rename := shared.UserNameRequest{Namespace: "uni", Username: "bob", UserToken: "token-bob", NewUsername: "alice"}
+	if err := new(CServer).ChangeUserName(rename, &ack); err != userNameTakenError {
+		t.Fatalf("renaming to a taken username gave %v, want %v", err, userNameTakenError)
+	}
+	rename.NewUsername = "robert"
+	if err := new(CServer).ChangeUserName(rename, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mute and the channel follow the new name, and bob is free again
+	var err error
+	if err = publish("uni", "robert", "hi"); err != mutedError {
+		t.Fatalf("a renamed muted user gave %v, want %v", err, mutedError)
+	}
+	var resp shared.PollingResponse
+	err = new(CServer).GetNewMessages(shared.PollingMessage{Namespace: "uni", Username: "robert", UserToken: "token-bob"}, &resp)
+	if err != nil || len(resp.Messages) == 0 || resp.Messages[len(resp.Messages)-1] != "*** bob is now known as robert" {
+		t.Fatalf("robert got %q, %v", resp.Messages, err)
+	}
+	if err = registerUserName("bob", "token-someone"); err != nil {
+		t.Fatalf("the old name couldn't be claimed: %v", err)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+type XMPPHandshakeError error
+
+const (
+	xmppPollInterval time.Duration = 500 * time.Millisecond // how often occupants are sent new messages
+
+	xmppComponentNS = "jabber:component:accept"
+	xmppStreamNS    = "http://etherx.jabber.org/streams"
+	xmppStanzasNS   = "urn:ietf:params:xml:ns:xmpp-stanzas"
+)
+
+var (
+	// XMPP Gateway Errors
+	xmppHandshakeError XMPPHandshakeError = errors.New("XMPP server rejected the component handshake")
+)
+
+// An XMPP component (XEP-0114) that shows the channels of one namespace as
+// multi-user chat rooms: #general is general@domain, and the occupant nick is
+// the TorChat username. XMPP users are identified by their bare JID, which
+// the XMPP server has authenticated, so they keep their nick across logins.
+type xmppGateway struct {
+	sync.Mutex // guards users and cursor; taken before the namespace lock
+	ns         *Namespace
+	serverAddr string
+	domain     string
+	secret     string
+
+	writeMutex sync.Mutex
+	conn       net.Conn
+
+	users  map[string]*xmppUser // by full JID of the user's client
+	cursor uint32               // next message in the namespace log to relay
+}
+
+// An XMPP client in at least one room
+type xmppUser struct {
+	jid         string
+	nick        string
+	token       string
+	rooms       map[string]bool // channels joined through the gateway
+	lastInboxId uint32
+}
+
+type xmppPresence struct {
+	XMLName xml.Name     `xml:"presence"`
+	From    string       `xml:"from,attr,omitempty"`
+	To      string       `xml:"to,attr,omitempty"`
+	Id      string       `xml:"id,attr,omitempty"`
+	Type    string       `xml:"type,attr,omitempty"`
+	MUCUser *xmppMUCUser `xml:"http://jabber.org/protocol/muc#user x,omitempty"`
+	Error   *xmppError   `xml:"error,omitempty"`
+}
+
+type xmppMUCUser struct {
+	Item     xmppMUCItem  `xml:"item"`
+	Statuses []xmppStatus `xml:"status"`
+}
+
+type xmppMUCItem struct {
+	Affiliation string `xml:"affiliation,attr"`
+	Role        string `xml:"role,attr"`
+}
+
+type xmppStatus struct {
+	Code string `xml:"code,attr"`
+}
+
+type xmppMessage struct {
+	XMLName xml.Name   `xml:"message"`
+	From    string     `xml:"from,attr,omitempty"`
+	To      string     `xml:"to,attr,omitempty"`
+	Id      string     `xml:"id,attr,omitempty"`
+	Type    string     `xml:"type,attr,omitempty"`
+	Body    string     `xml:"body,omitempty"`
+	Error   *xmppError `xml:"error,omitempty"`
+}
+
+type xmppError struct {
+	Type      string        `xml:"type,attr"`
+	Condition xmppCondition // element named after the condition, e.g. conflict
+	Text      string        `xml:"urn:ietf:params:xml:ns:xmpp-stanzas text,omitempty"`
+}
+
+type xmppCondition struct {
+	XMLName xml.Name
+}
+
+func newXMPPError(errorType string, condition string, text string) *xmppError {
+	return &xmppError{
+		Type:      errorType,
+		Condition: xmppCondition{XMLName: xml.Name{Space: xmppStanzasNS, Local: condition}},
+		Text:      text,
+	}
+}
+
+// Connects to the XMPP server as the component for domain and bridges it into
+// the namespace, reconnecting whenever the connection drops
+func serveXMPP(serverAddr string, domain string, secret string, namespace string) {
+	ns, err := getNamespace(namespace)
+	util.HandleFatalError("Could not open XMPP gateway namespace", err)
+
+	gw := &xmppGateway{
+		ns:         ns,
+		serverAddr: serverAddr,
+		domain:     domain,
+		secret:     secret,
+		users:      make(map[string]*xmppUser),
+	}
+	go gw.relay()
+
+	// Only a rejected handshake stops the retries, and retrying won't fix it
+	err = retry.Do(context.Background(), retry.Background, gw.run)
+	util.HandleFatalError("XMPP gateway stopped", err)
+}
+
+// Splits a JID into its bare part and resource
+func splitJID(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i >= 0 {
+		return jid[:i], jid[i+1:]
+	}
+	return jid, ""
+}
+
+// Channel names map to room JIDs by their name without the leading '#'
+func (gw *xmppGateway) roomJID(channel string) string {
+	return strings.TrimPrefix(channel, "#") + "@" + gw.domain
+}
+
+// Returns the channel a room JID names, or "" if it isn't one of ours
+func (gw *xmppGateway) channelOf(roomJID string) string {
+	suffix := "@" + gw.domain
+	if !strings.HasSuffix(roomJID, suffix) || len(roomJID) == len(suffix) {
+		return ""
+	}
+	return "#" + strings.TrimSuffix(roomJID, suffix)
+}
+
+// Derives a TorChat user token from a bare JID. Only the gateway knows the
+// secret, so only that XMPP account can use the nick it claimed.
+func (gw *xmppGateway) tokenFor(bareJID string) string {
+	digest := sha256.Sum256([]byte(gw.secret + "\x00" + bareJID))
+	return hex.EncodeToString(digest[:])
+}
+
+func (gw *xmppGateway) write(v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	gw.writeMutex.Lock()
+	defer gw.writeMutex.Unlock()
+	if gw.conn == nil {
+		return nil
+	}
+	_, err = gw.conn.Write(data)
+	return err
+}
+
+// One connection to the XMPP server: the stream header, the handshake, then
+// stanzas until the stream ends
+func (gw *xmppGateway) run() error {
+	conn, err := net.Dial("tcp", gw.serverAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("<?xml version='1.0'?><stream:stream xmlns='" + xmppComponentNS +
+		"' xmlns:stream='" + xmppStreamNS + "' to='" + gw.domain + "'>"))
+	if err != nil {
+		return err
+	}
+
+	connected := false
+	decoder := xml.NewDecoder(conn)
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			util.HandleNonFatalError("XMPP gateway lost its connection", err)
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			switch element.Name.Local {
+			case "stream":
+				var streamId string
+				for _, attr := range element.Attr {
+					if attr.Name.Local == "id" {
+						streamId = attr.Value
+					}
+				}
+				digest := sha1.Sum([]byte(streamId + gw.secret))
+				if _, err = conn.Write([]byte("<handshake>" + hex.EncodeToString(digest[:]) + "</handshake>")); err != nil {
+					return err
+				}
+			case "handshake":
+				decoder.Skip()
+				connected = true
+				gw.writeMutex.Lock()
+				gw.conn = conn
+				gw.writeMutex.Unlock()
+				defer gw.disconnected()
+				util.OutLog.Printf("XMPP gateway for namespace %s connected to %s as %s\n", gw.ns.name, gw.serverAddr, gw.domain)
+			case "presence":
+				var presence xmppPresence
+				if err = decoder.DecodeElement(&presence, &element); err != nil {
+					return err
+				}
+				gw.handlePresence(presence)
+			case "message":
+				var msg xmppMessage
+				if err = decoder.DecodeElement(&msg, &element); err != nil {
+					return err
+				}
+				gw.handleMessage(msg)
+			case "error":
+				decoder.Skip()
+				if !connected {
+					return retry.Permanent(xmppHandshakeError)
+				}
+				return errors.New("XMPP server sent a stream error")
+			default:
+				decoder.Skip()
+			}
+		case xml.EndElement:
+			if element.Name.Local == "stream" {
+				return errors.New("XMPP server closed the stream")
+			}
+		}
+	}
+}
+
+// Forgets every occupant: the XMPP server won't tell us who left while the
+// gateway was away, so clients have to join again
+func (gw *xmppGateway) disconnected() {
+	gw.writeMutex.Lock()
+	gw.conn = nil
+	gw.writeMutex.Unlock()
+
+	gw.Lock()
+	defer gw.Unlock()
+	gw.ns.Lock()
+	defer gw.ns.Unlock()
+
+	for jid, user := range gw.users {
+		for channel := range user.rooms {
+			delete(gw.ns.joinedChannels(user.nick), channel)
+		}
+		delete(gw.ns.sessions[user.nick], gw.deviceId(user))
+		delete(gw.users, jid)
+	}
+}
+
+// Joins and leaves rooms
+func (gw *xmppGateway) handlePresence(presence xmppPresence) {
+	roomJID, nick := splitJID(presence.To)
+	channel := gw.channelOf(roomJID)
+	if channel == "" || nick == "" || presence.Type == "error" {
+		return
+	}
+
+	switch presence.Type {
+	case "":
+		gw.join(presence, channel, nick)
+	case "unavailable":
+		gw.leave(presence.From, channel)
+	}
+}
+
+func (gw *xmppGateway) join(presence xmppPresence, channel string, nick string) {
+	bareJID, _ := splitJID(presence.From)
+	roomJID := gw.roomJID(channel)
+
+	gw.Lock()
+	user, ok := gw.users[presence.From]
+	if !ok {
+		user = &xmppUser{
+			jid:   presence.From,
+			token: gw.tokenFor(bareJID),
+			rooms: make(map[string]bool),
+		}
+	}
+
+	var xmppErr *xmppError
+	var occupants []string
+	gw.ns.Lock()
+	switch {
+	case user.nick != "" && user.nick != nick:
+		xmppErr = newXMPPError("modify", "not-acceptable", "TorChat users have one nick in every room; leave all rooms to change it")
+	case gw.ns.banned[nick]:
+		xmppErr = newXMPPError("auth", "forbidden", bannedError.Error())
+	default:
+		if _, err := gw.ns.authenticate(nick, user.token, true); err == invalidUserNameError {
+			xmppErr = newXMPPError("modify", "jid-malformed", err.Error())
+		} else if err != nil {
+			xmppErr = newXMPPError("cancel", "conflict", err.Error())
+		}
+	}
+	if xmppErr == nil {
+		user.nick = nick
+		user.rooms[channel] = true
+		gw.users[presence.From] = user
+		gw.ns.users[nick] = time.Now()
+		gw.ns.lastPolled[nick] = time.Now()
+		gw.ns.session(nick, gw.deviceId(user)).LastPolled = time.Now()
+		gw.ns.joinedChannels(nick)[channel] = true
+
+		for username, channels := range gw.ns.memberships {
+			if channels[channel] && username != nick && !gw.ns.banned[username] {
+				occupants = append(occupants, username)
+			}
+		}
+	}
+	gw.ns.Unlock()
+
+	// Tell the other XMPP occupants
+	var others []string
+	if xmppErr == nil {
+		for _, other := range gw.users {
+			if other != user && other.rooms[channel] {
+				others = append(others, other.jid)
+			}
+		}
+	}
+	gw.Unlock()
+
+	if xmppErr != nil {
+		gw.write(xmppPresence{From: presence.To, To: presence.From, Id: presence.Id, Type: "error", Error: xmppErr})
+		return
+	}
+
+	// Occupants first, then the user's own presence, as XEP-0045 asks
+	sort.Strings(occupants)
+	for _, occupant := range occupants {
+		gw.write(xmppPresence{From: roomJID + "/" + occupant, To: presence.From, MUCUser: occupantItem()})
+	}
+	self := occupantItem()
+	self.Statuses = []xmppStatus{{Code: "110"}}
+	gw.write(xmppPresence{From: roomJID + "/" + nick, To: presence.From, Id: presence.Id, MUCUser: self})
+	for _, other := range others {
+		gw.write(xmppPresence{From: roomJID + "/" + nick, To: other, MUCUser: occupantItem()})
+	}
+
+	util.OutLog.Printf("[%s] XMPP user %s joined %s as %s\n", gw.ns.name, bareJID, channel, nick)
+}
+
+func occupantItem() *xmppMUCUser {
+	return &xmppMUCUser{Item: xmppMUCItem{Affiliation: "none", Role: "participant"}}
+}
+
+func (gw *xmppGateway) deviceId(user *xmppUser) string {
+	return "xmpp:" + user.jid
+}
+
+func (gw *xmppGateway) leave(jid string, channel string) {
+	roomJID := gw.roomJID(channel)
+
+	gw.Lock()
+	user, ok := gw.users[jid]
+	if !ok || !user.rooms[channel] {
+		gw.Unlock()
+		return
+	}
+	delete(user.rooms, channel)
+
+	gw.ns.Lock()
+	delete(gw.ns.joinedChannels(user.nick), channel)
+	if len(user.rooms) == 0 {
+		// Don't hold back inbox messages for a client that is gone
+		delete(gw.ns.sessions[user.nick], gw.deviceId(user))
+		delete(gw.users, jid)
+	}
+	gw.ns.Unlock()
+
+	var others []string
+	for _, other := range gw.users {
+		if other.rooms[channel] {
+			others = append(others, other.jid)
+		}
+	}
+	gw.Unlock()
+
+	self := occupantItem()
+	self.Item.Role = "none"
+	self.Statuses = []xmppStatus{{Code: "110"}}
+	gw.write(xmppPresence{From: roomJID + "/" + user.nick, To: jid, Type: "unavailable", MUCUser: self})
+	for _, other := range others {
+		gw.write(xmppPresence{From: roomJID + "/" + user.nick, To: other, Type: "unavailable", MUCUser: &xmppMUCUser{Item: xmppMUCItem{Affiliation: "none", Role: "none"}}})
+	}
+}
+
+// Publishes groupchat messages to channels and private messages as direct
+// messages
+func (gw *xmppGateway) handleMessage(msg xmppMessage) {
+	if msg.Type == "error" || msg.Body == "" {
+		return
+	}
+	roomJID, nick := splitJID(msg.To)
+	channel := gw.channelOf(roomJID)
+	if channel == "" {
+		return
+	}
+
+	gw.Lock()
+	defer gw.Unlock()
+
+	user, ok := gw.users[msg.From]
+	if !ok {
+		gw.write(xmppMessage{From: msg.To, To: msg.From, Id: msg.Id, Type: "error",
+			Error: newXMPPError("modify", "not-acceptable", "Join the room first")})
+		return
+	}
+
+	chatMessage := shared.ChatMessage{
+		Namespace: gw.ns.name,
+		Username:  user.nick,
+		UserToken: user.token,
+		Message:   msg.Body,
+	}
+	if msg.Type == "groupchat" && nick == "" {
+		chatMessage.Channel = channel
+	} else if nick != "" {
+		chatMessage.Recipient = nick
+	} else {
+		return
+	}
+
+	host, _, _ := net.SplitHostPort(gw.serverAddr)
+	gw.ns.Lock()
+	err := gw.ns.publish(chatMessage, host)
+	gw.ns.Unlock()
+
+	switch {
+	case err == unknownRecipientError:
+		gw.write(xmppMessage{From: msg.To, To: msg.From, Id: msg.Id, Type: "error",
+			Error: newXMPPError("cancel", "item-not-found", err.Error())})
+	case err != nil:
+		gw.write(xmppMessage{From: msg.To, To: msg.From, Id: msg.Id, Type: "error",
+			Error: newXMPPError("wait", "policy-violation", err.Error())})
+	}
+}
+
+// Sends occupants what is published in their rooms, their own messages
+// included as XEP-0045 reflects them, and their direct messages
+func (gw *xmppGateway) relay() {
+	gw.ns.RLock()
+	gw.cursor = gw.ns.firstId + uint32(len(gw.ns.messages))
+	gw.ns.RUnlock()
+
+	for {
+		time.Sleep(xmppPollInterval)
+
+		var stanzas []xmppMessage
+		gw.Lock()
+		gw.ns.Lock()
+
+		// Messages before firstId have been dropped by retention, skip past them
+		if gw.cursor < gw.ns.firstId {
+			gw.cursor = gw.ns.firstId
+		}
+		for _, msg := range gw.ns.messages[gw.cursor-gw.ns.firstId:] {
+			if msg.Deleted {
+				continue
+			}
+			from := gw.roomJID(msg.Channel)
+			if msg.Username != "" {
+				from += "/" + msg.Username
+			}
+			for _, user := range gw.users {
+				if user.rooms[msg.Channel] {
+					stanzas = append(stanzas, xmppMessage{From: from, To: user.jid, Type: "groupchat", Body: msg.bridgedText()})
+				}
+			}
+		}
+		gw.cursor = gw.ns.firstId + uint32(len(gw.ns.messages))
+
+		for _, user := range gw.users {
+			gw.ns.lastPolled[user.nick] = time.Now()
+			sess := gw.ns.session(user.nick, gw.deviceId(user))
+			sess.LastPolled = time.Now()
+			sess.LastMessageId = gw.cursor
+
+			var inbox []InboxMessage
+			inbox, user.lastInboxId = gw.ns.takeInbox(user.nick, sess, user.lastInboxId)
+			for _, msg := range inbox {
+				// Mentions are already shown in rooms the user is in
+				if msg.Channel != "" && user.rooms[msg.Channel] {
+					continue
+				}
+				body := msg.Message
+				if msg.Channel != "" {
+					body = msg.String()
+				}
+				stanzas = append(stanzas, xmppMessage{
+					From: gw.roomJID(gw.anyRoom(user, msg.Channel)) + "/" + msg.From,
+					To:   user.jid,
+					Type: "chat",
+					Body: body,
+				})
+			}
+		}
+
+		gw.ns.Unlock()
+		gw.Unlock()
+
+		for _, stanza := range stanzas {
+			if err := gw.write(stanza); err != nil {
+				util.HandleNonFatalError("Could not relay to XMPP server", err)
+				break
+			}
+		}
+	}
+}
+
+// Private messages come from an occupant JID, so pick a room to send them
+// from: the mention's channel if given, otherwise one the user is in
+func (gw *xmppGateway) anyRoom(user *xmppUser, channel string) string {
+	if channel != "" {
+		return channel
+	}
+	rooms := make([]string, 0, len(user.rooms))
+	for room := range user.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	if len(rooms) == 0 {
+		return shared.DefaultChannel
+	}
+	return rooms[0]
+}
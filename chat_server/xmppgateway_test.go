@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects what the gateway writes to the XMPP server
+type xmppRecorder struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func recordXMPP(t *testing.T, conn net.Conn) *xmppRecorder {
+	r := &xmppRecorder{}
+	go func() {
+		chunk := make([]byte, 4096)
+		for {
+			n, err := conn.Read(chunk)
+			r.Lock()
+			r.buf.Write(chunk[:n])
+			r.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Waits until the gateway wrote want
+func (r *xmppRecorder) expect(t *testing.T, want string) {
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		r.Lock()
+		found := strings.Contains(r.buf.String(), want)
+		r.Unlock()
+		if found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Lock()
+	defer r.Unlock()
+	t.Fatalf("the gateway didn't write %q, only\n%s", want, r.buf.String())
+}
+
+func testGateway(t *testing.T) (*xmppGateway, *xmppRecorder) {
+	ns, _ := getNamespace("uni")
+	gatewayConn, serverConn := net.Pipe()
+	t.Cleanup(func() { gatewayConn.Close() })
+	gw := &xmppGateway{ns: ns, serverAddr: "127.0.0.1:5347", domain: "chat.example.org", secret: "s3cret", conn: gatewayConn, users: make(map[string]*xmppUser)}
+	return gw, recordXMPP(t, serverConn)
+}
+
+func TestXMPPRoomJIDs(t *testing.T) {
+	gw := &xmppGateway{domain: "chat.example.org"}
+	if gw.roomJID("#go") != "go@chat.example.org" || gw.channelOf("go@chat.example.org") != "#go" {
+		t.Fatal("#go isn't go@chat.example.org")
+	}
+	if gw.channelOf("go@other.example.org") != "" || gw.channelOf("@chat.example.org") != "" {
+		t.Fatal("a JID outside the domain named a channel")
+	}
+	if bare, resource := splitJID("alice@example.org/phone"); bare != "alice@example.org" || resource != "phone" {
+		t.Fatalf("split into %q and %q", bare, resource)
+	}
+	if gw.tokenFor("alice@example.org") == gw.tokenFor("bob@example.org") {
+		t.Fatal("two JIDs got the same token")
+	}
+}
+
+func TestXMPPJoinAndPublish(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	if err := registerUserName("bob", "token-bob"); err != nil {
+		t.Fatal(err)
+	}
+	gw, server := testGateway(t)
+
+	gw.handlePresence(xmppPresence{From: "alice@example.org/phone", To: "go@chat.example.org/alice", Id: "j1"})
+	server.expect(t, `from="go@chat.example.org/alice" to="alice@example.org/phone" id="j1"`)
+	server.expect(t, `<status code="110"></status>`)
+
+	// A TorChat user's nick can't be taken from XMPP
+	gw.handlePresence(xmppPresence{From: "mallory@example.org/pc", To: "go@chat.example.org/bob", Id: "j2"})
+	server.expect(t, `id="j2" type="error"`)
+	server.expect(t, `<conflict xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"></conflict>`)
+
+	gw.handleMessage(xmppMessage{From: "alice@example.org/phone", To: "go@chat.example.org", Type: "groupchat", Body: "hi from xmpp"})
+	gw.ns.Lock()
+	count := len(gw.ns.messages)
+	last := gw.ns.messages[count-1]
+	gw.ns.Unlock()
+	if last.Channel != "#go" || last.String() != "[#go] alice: hi from xmpp" {
+		t.Fatalf("the namespace got %+v", last)
+	}
+
+	// Only occupants may speak
+	gw.handleMessage(xmppMessage{From: "mallory@example.org/pc", To: "go@chat.example.org", Type: "groupchat", Id: "m1", Body: "hi"})
+	server.expect(t, `id="m1" type="error"`)
+
+	gw.handlePresence(xmppPresence{From: "alice@example.org/phone", To: "go@chat.example.org/alice", Type: "unavailable"})
+	server.expect(t, `type="unavailable"`)
+	if _, ok := gw.users["alice@example.org/phone"]; ok {
+		t.Fatal("a user who left every room was kept")
+	}
+}
+
+func TestXMPPHandshake(t *testing.T) {
+	resetNamespaces(NamespaceConfig{Namespaces: map[string]NamespacePolicy{"uni": {}}})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	ns, _ := getNamespace("uni")
+	gw := &xmppGateway{ns: ns, serverAddr: listener.Addr().String(), domain: "chat.example.org", secret: "s3cret", users: make(map[string]*xmppUser)}
+	done := make(chan error, 1)
+	go func() { done <- gw.run() }()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := recordXMPP(t, conn)
+	gateway.expect(t, `to='chat.example.org'>`)
+	conn.Write([]byte(`<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' id='abc' from='chat.example.org'>`))
+	digest := sha1.Sum([]byte("abc" + "s3cret"))
+	gateway.expect(t, "<handshake>"+hex.EncodeToString(digest[:])+"</handshake>")
+	conn.Write([]byte(`<handshake/><presence from='alice@example.org/phone' to='go@chat.example.org/alice'/>`))
+	gateway.expect(t, `from="go@chat.example.org/alice"`)
+
+	conn.Write([]byte(`</stream:stream>`))
+	if err = <-done; err == nil {
+		t.Fatal("the stream ended without an error")
+	}
+	if len(gw.users) != 0 {
+		t.Fatal("occupants were kept after the connection dropped")
+	}
+}
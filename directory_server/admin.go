@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type UnauthorizedError error
+type InvalidIntervalError error
+
+// Admin RPC service, only reachable on the loopback admin port
+type AdminServer struct {
+	token string
+}
+
+const (
+	adminAddr string = "127.0.0.1:12347"
+)
+
+var (
+	// Admin Errors
+	unauthorizedError    UnauthorizedError    = errors.New("Invalid admin token")
+	invalidIntervalError InvalidIntervalError = errors.New("Heartbeat interval must be at least one second")
+)
+
+func startAdminServer(token string) {
+	server := rpc.NewServer()
+	server.Register(&AdminServer{token: token})
+
+	listener, err := net.Listen("tcp", adminAddr)
+	util.HandleFatalError("Could not start admin server", err)
+	util.OutLog.Println("Admin server is listening on addr/port: ", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			printError(err)
+			continue
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+func (a *AdminServer) authorize(token string) error {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return unauthorizedError
+	}
+	return nil
+}
+
+// Lists every registered OR, including ones not yet usable in circuits
+func (a *AdminServer) ListNodes(req shared.AdminRequest, resp *[]shared.RouterStatus) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	*resp = routerStatuses(false)
+	return nil
+}
+
+// Lists the ORs GetNodes currently picks circuits from
+func (a *AdminServer) DumpConsensus(req shared.AdminRequest, resp *[]shared.RouterStatus) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	*resp = routerStatuses(true)
+	return nil
+}
+
+// Removes an OR immediately instead of waiting for its heartbeats to time out.
+// The OR must register again to be listed.
+func (a *AdminServer) ExpireNode(req shared.AdminRequest, ack *bool) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	activeORs.Lock()
+	defer activeORs.Unlock()
+
+	address := canonical(req.Address)
+	if _, ok := activeORs.all[address]; !ok {
+		return unregisteredAddrError
+	}
+	removeOR(address)
+	util.OutLog.Printf("%s expired by admin\n", req.Address)
+
+	*ack = true
+	return nil
+}
+
+func (a *AdminServer) SetHeartBeatInterval(req shared.AdminRequest, ack *bool) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+	if req.Seconds < 1 {
+		return invalidIntervalError
+	}
+
+	atomic.StoreInt64(&heartBeatInterval, req.Seconds)
+	util.OutLog.Printf("Heartbeat interval set to %ds by admin\n", req.Seconds)
+
+	*ack = true
+	return nil
+}
+
+func routerStatuses(usableOnly bool) []shared.RouterStatus {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	now := time.Now()
+	median := medianBandwidth()
+	threshold := stableThreshold(now)
+	statuses := make([]shared.RouterStatus, 0, len(activeORs.all))
+	for orAddress, or := range activeORs.all {
+		status := shared.RouterStatus{
+			Address:       orAddress,
+			Uptime:        now.Sub(time.Unix(or.RegisteredAt, 0)),
+			LastHeartBeat: time.Unix(or.MostRecentHeartBeat, 0),
+			Reachable:     or.Reachable,
+			Blacklisted:   isBlacklisted(orAddress),
+			FailureScore:  failureScore(orAddress),
+			Weight:        selectionWeight(orAddress, median),
+			Bandwidth:     or.Bandwidth,
+			Measured:      or.Measured,
+			SelfTest:      or.SelfTest,
+			MTBF:          mtbf(orAddress, now),
+			Stable:        isStable(orAddress, threshold, now),
+			Capabilities:  orInfo(orAddress, or).Offered(),
+			Contact:       or.Contact,
+			Accounting:    or.Accounting,
+
+			ProtocolVersion: or.ProtocolVersion,
+		}
+
+		if usableOnly && (!status.Reachable || status.Blacklisted) {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Address < statuses[j].Address
+	})
+	return statuses
+}
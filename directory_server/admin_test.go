@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestAdminRequiresToken(t *testing.T) {
+	admin := &AdminServer{token: "s3cret"}
+	var statuses []shared.RouterStatus
+	var ack bool
+	for _, token := range []string{"", "wrong", "s3cret "} {
+		req := shared.AdminRequest{Token: token, Seconds: 5}
+		if admin.ListNodes(req, &statuses) != unauthorizedError || admin.DumpConsensus(req, &statuses) != unauthorizedError ||
+			admin.ExpireNode(req, &ack) != unauthorizedError || admin.SetHeartBeatInterval(req, &ack) != unauthorizedError {
+			t.Fatalf("token %q was accepted", token)
+		}
+	}
+}
+
+func TestAdminNodes(t *testing.T) {
+	admin := &AdminServer{token: "s3cret"}
+	now := time.Now().Unix()
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {RegisteredAt: now, MostRecentHeartBeat: now, Reachable: true},
+		"127.0.0.1:8002": {RegisteredAt: now, MostRecentHeartBeat: now},
+	}
+	activeORs.Unlock()
+
+	var statuses []shared.RouterStatus
+	if err := admin.ListNodes(shared.AdminRequest{Token: "s3cret"}, &statuses); err != nil || len(statuses) != 2 || statuses[0].Address != "127.0.0.1:8001" {
+		t.Fatalf("listed %+v, %v", statuses, err)
+	}
+	if err := admin.DumpConsensus(shared.AdminRequest{Token: "s3cret"}, &statuses); err != nil || len(statuses) != 1 || statuses[0].Weight != 1 {
+		t.Fatalf("the consensus is %+v, %v", statuses, err)
+	}
+
+	var ack bool
+	if err := admin.ExpireNode(shared.AdminRequest{Token: "s3cret", Address: "127.0.0.1:8002"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ExpireNode(shared.AdminRequest{Token: "s3cret", Address: "127.0.0.1:8002"}, &ack); err != unregisteredAddrError {
+		t.Fatalf("expiring a router twice gave %v, want %v", err, unregisteredAddrError)
+	}
+}
+
+func TestAdminHeartBeatInterval(t *testing.T) {
+	admin := &AdminServer{token: "s3cret"}
+	defer func(interval int64) { heartBeatInterval = interval }(getHeartBeatInterval())
+
+	var ack bool
+	if err := admin.SetHeartBeatInterval(shared.AdminRequest{Token: "s3cret", Seconds: 0}, &ack); err != invalidIntervalError {
+		t.Fatalf("an interval of 0 gave %v, want %v", err, invalidIntervalError)
+	}
+	if err := admin.SetHeartBeatInterval(shared.AdminRequest{Token: "s3cret", Seconds: 9}, &ack); err != nil || getHeartBeatInterval() != 9 {
+		t.Fatalf("the interval is %d, %v", getHeartBeatInterval(), err)
+	}
+}
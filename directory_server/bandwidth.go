@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	// Bandwidth weighting configurations. Bounded so a router can't draw
+	// most circuits by overstating its bandwidth, and slow ones are still used.
+	minBandwidthFactor float64 = 0.25
+	maxBandwidthFactor float64 = 4
+)
+
+// Heartbeat from ORs that report their measured bandwidth, signed by ORs
+// that sign heartbeats. ORs from before bandwidth reports call
+// KeepNodeOnline instead.
+func (s *DServer) SendHeartbeat(heartbeat shared.Heartbeat, ack *bool) error {
+	activeORs.Lock()
+	defer activeORs.Unlock()
+
+	or, ok := activeORs.all[canonical(heartbeat.Address)]
+	if !ok {
+		return unregisteredAddrError
+	}
+	if err := or.verifyHeartbeat(heartbeat); err != nil {
+		util.OutLog.Printf("Refused heartbeat for %s: %v\n", canonical(heartbeat.Address), err)
+		return err
+	}
+
+	or.MostRecentHeartBeat = time.Now().Unix()
+	or.Bandwidth = heartbeat.Bandwidth
+	or.SelfTest = heartbeat.SelfTest
+	or.Accounting = heartbeat.Accounting
+
+	// ORs that used up their traffic cap leave until their next period, and
+	// register again then
+	if heartbeat.Accounting != nil && heartbeat.Accounting.Hibernating {
+		util.OutLog.Printf("OR %s hibernates until %v, dropping it\n", canonical(heartbeat.Address), time.Unix(heartbeat.Accounting.PeriodEnd, 0).Format(time.RFC3339))
+		removeOR(canonical(heartbeat.Address))
+	}
+
+	*ack = true
+	return nil
+}
+
+// Median bandwidth of the usable ORs that were measured or reported one, 0
+// if none were.
+// Caller must hold the activeORs lock.
+func medianBandwidth() uint64 {
+	var measured []uint64
+	for orAddress, or := range activeORs.all {
+		if or.Reachable && !isBlacklisted(orAddress) && or.weightBandwidth() > 0 {
+			measured = append(measured, or.weightBandwidth())
+		}
+	}
+	if len(measured) == 0 {
+		return 0
+	}
+
+	sort.Slice(measured, func(i, j int) bool { return measured[i] < measured[j] })
+	return measured[len(measured)/2]
+}
+
+// How much more often than a median router an OR is picked for its bandwidth.
+// ORs that were neither measured nor reported a bandwidth yet count as median.
+// Caller must hold the activeORs lock.
+func bandwidthFactor(orAddress string, median uint64) float64 {
+	or, ok := activeORs.all[orAddress]
+	if !ok || or.weightBandwidth() == 0 || median == 0 {
+		return 1
+	}
+
+	factor := float64(or.weightBandwidth()) / float64(median)
+	if factor < minBandwidthFactor {
+		return minBandwidthFactor
+	}
+	if factor > maxBandwidthFactor {
+		return maxBandwidthFactor
+	}
+	return factor
+}
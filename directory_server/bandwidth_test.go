@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestSendHeartbeat(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {Reachable: true}}
+	activeORs.Unlock()
+
+	var ack bool
+	if err := new(DServer).SendHeartbeat(shared.Heartbeat{Address: "127.0.0.1:8009", Bandwidth: 100}, &ack); err != unregisteredAddrError {
+		t.Fatalf("a heartbeat from an unregistered router gave %v, want %v", err, unregisteredAddrError)
+	}
+	if err := new(DServer).SendHeartbeat(shared.Heartbeat{Address: "127.0.0.1:8001", Bandwidth: 100}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	activeORs.RLock()
+	or := activeORs.all["127.0.0.1:8001"]
+	activeORs.RUnlock()
+	if or.Bandwidth != 100 || time.Now().Unix()-or.MostRecentHeartBeat > 1 {
+		t.Fatalf("the router is %+v after its heartbeat", or)
+	}
+}
+
+func TestHibernatingRouterIsDropped(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {Reachable: true}}
+	activeORs.Unlock()
+
+	var ack bool
+	awake := shared.Heartbeat{Address: "127.0.0.1:8001", Accounting: &shared.AccountingReport{Max: 1000, Used: 10}}
+	if err := new(DServer).SendHeartbeat(awake, &ack); err != nil {
+		t.Fatal(err)
+	}
+	activeORs.RLock()
+	or := activeORs.all["127.0.0.1:8001"]
+	activeORs.RUnlock()
+	if or == nil || or.Accounting == nil || or.Accounting.Remaining() != 990 {
+		t.Fatalf("the router is %+v after its heartbeat", or)
+	}
+
+	hibernating := awake
+	hibernating.Accounting = &shared.AccountingReport{Max: 1000, Used: 1000, Hibernating: true}
+	if err := new(DServer).SendHeartbeat(hibernating, &ack); err != nil {
+		t.Fatal(err)
+	}
+	activeORs.RLock()
+	_, listed := activeORs.all["127.0.0.1:8001"]
+	activeORs.RUnlock()
+	if listed {
+		t.Fatal("a hibernating router is still listed")
+	}
+}
+
+func TestBandwidthFactor(t *testing.T) {
+	activeORs.Lock()
+	defer activeORs.Unlock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, Bandwidth: 100},
+		"127.0.0.1:8002": {Reachable: true, Bandwidth: 200},
+		"127.0.0.1:8003": {Reachable: true, Bandwidth: 10000},
+		"127.0.0.1:8004": {Reachable: true, Bandwidth: 1},
+		"127.0.0.1:8005": {Reachable: true},
+		"127.0.0.1:8006": {Bandwidth: 1000000}, // not reachable, so not in the median
+	}
+
+	median := medianBandwidth()
+	if median != 200 {
+		t.Fatalf("the median is %d, want 200", median)
+	}
+	for orAddress, want := range map[string]float64{
+		"127.0.0.1:8001": 0.5,
+		"127.0.0.1:8002": 1,
+		"127.0.0.1:8003": maxBandwidthFactor,
+		"127.0.0.1:8004": minBandwidthFactor,
+		"127.0.0.1:8005": 1,
+		"127.0.0.1:8009": 1,
+	} {
+		if factor := bandwidthFactor(orAddress, median); factor != want {
+			t.Errorf("%s has factor %v, want %v", orAddress, factor, want)
+		}
+	}
+	if factor := bandwidthFactor("127.0.0.1:8001", 0); factor != 1 {
+		t.Fatalf("without any measurements the factor is %v, want 1", factor)
+	}
+}
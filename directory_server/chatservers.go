@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/faults"
+)
+
+type ChatServerError error
+
+const (
+	// Chat server configurations
+	chatServerDialTimeout time.Duration = 3 * time.Second
+)
+
+var (
+	// Chat Server Errors
+	badChatServerTokenError     ChatServerError = errors.New("Chat server token is wrong")
+	chatServerNameTakenError    ChatServerError = errors.New("Another chat server is registered under this name")
+	unregisteredChatServerError ChatServerError = errors.New("No chat server is registered under this name and address")
+	unreachableChatServerError  ChatServerError = errors.New("Could not dial the chat server back on its address")
+
+	// Chat servers advertised to OPs; set by -chat-server
+	chatServers = make(chatServerFlags)
+
+	// Required from chat servers that register themselves, if set; set by
+	// -chat-server-token
+	chatServerToken string
+
+	// Chat servers that registered themselves, by name
+	registeredChatServers = struct {
+		sync.Mutex
+		byName map[string]*registeredChatServer
+	}{byName: make(map[string]*registeredChatServer)}
+)
+
+type registeredChatServer struct {
+	address         string
+	protocolVersion int
+	lastHeartbeat   time.Time
+}
+
+// -chat-server values: chat server address by name
+type chatServerFlags map[string]string
+
+func (f chatServerFlags) String() string {
+	var pairs []string
+	for name, address := range f {
+		pairs = append(pairs, name+"="+address)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f chatServerFlags) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected name=ip:port, got %q", value)
+	}
+	address, err := shared.CanonicalAddress(kv[1])
+	if err != nil {
+		return fmt.Errorf("invalid chat server address %q: %s", kv[1], err)
+	}
+	f[kv[0]] = address
+	return nil
+}
+
+// Advertises a chat server under reg.Name once it answers on reg.Address.
+// Names given with -chat-server can't be taken, and a registered name is
+// only given to another address once its heartbeats stop.
+func (s *DServer) RegisterChatServer(reg shared.ChatServerRegistration, ack *bool) error {
+	if err := authorizeChatServer(reg.Token); err != nil {
+		return err
+	}
+	address, err := shared.CanonicalAddress(reg.Address)
+	if err != nil {
+		return err
+	}
+	if reg.Name == "" {
+		return fmt.Errorf("chat server name is empty")
+	}
+	if _, ok := chatServers[reg.Name]; ok {
+		return chatServerNameTakenError
+	}
+
+	// Like ORs, chat servers are only listed once the directory reached them
+	conn, err := faults.DialTimeout("tcp", address, chatServerDialTimeout)
+	if err != nil {
+		util.OutLog.Printf("Chat server %s at %s is unreachable: %s\n", reg.Name, address, err)
+		return unreachableChatServerError
+	}
+	conn.Close()
+
+	registeredChatServers.Lock()
+	defer registeredChatServers.Unlock()
+
+	if other, ok := registeredChatServers.byName[reg.Name]; ok && other.address != address && time.Since(other.lastHeartbeat) < shared.ChatServerTimeout {
+		return chatServerNameTakenError
+	}
+	registeredChatServers.byName[reg.Name] = &registeredChatServer{
+		address:         address,
+		protocolVersion: shared.PeerVersion(reg.ProtocolVersion),
+		lastHeartbeat:   time.Now(),
+	}
+	util.OutLog.Printf("Got register from chat server %s at %s (protocol version %d)\n", reg.Name, address, shared.PeerVersion(reg.ProtocolVersion))
+
+	*ack = true
+	return nil
+}
+
+// Keeps a registered chat server advertised. A chat server the directory
+// forgot gets unregisteredChatServerError and registers again.
+func (s *DServer) SendChatServerHeartbeat(reg shared.ChatServerRegistration, ack *bool) error {
+	if err := authorizeChatServer(reg.Token); err != nil {
+		return err
+	}
+
+	registeredChatServers.Lock()
+	defer registeredChatServers.Unlock()
+
+	server, ok := registeredChatServers.byName[reg.Name]
+	if !ok || server.address != canonical(reg.Address) {
+		return unregisteredChatServerError
+	}
+	server.lastHeartbeat = time.Now()
+
+	*ack = true
+	return nil
+}
+
+func authorizeChatServer(token string) error {
+	if chatServerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(chatServerToken)) != 1 {
+		return badChatServerTokenError
+	}
+	return nil
+}
+
+// Forgets registered chat servers whose heartbeats stopped
+func expireChatServers() {
+	for {
+		time.Sleep(shared.ChatServerHeartbeatInterval)
+
+		registeredChatServers.Lock()
+		for name, server := range registeredChatServers.byName {
+			if time.Since(server.lastHeartbeat) > shared.ChatServerTimeout {
+				util.OutLog.Printf("Chat server %s timed out\n", name)
+				delete(registeredChatServers.byName, name)
+			}
+		}
+		registeredChatServers.Unlock()
+	}
+}
+
+// Returns the advertised chat servers sorted by name, signed so OPs can check
+// they came from this directory server: those given with -chat-server and
+// those registered and sending heartbeats
+func (s *DServer) GetChatServers(_ignored bool, list *shared.ChatServerList) error {
+	servers := advertisedChatServers()
+	hashBytes, err := shared.ChatServersHash(servers)
+	util.HandleFatalError("error marshalling chat servers", err)
+	sigR, sigS, _ := ecdsa.Sign(util.Random, privKey, hashBytes)
+
+	*list = shared.ChatServerList{
+		PubKey:  &pubKey,
+		Hash:    hashBytes,
+		SigS:    sigS,
+		SigR:    sigR,
+		Servers: servers,
+	}
+	return nil
+}
+
+// The chat servers given with -chat-server and those registered and sending
+// heartbeats, sorted by name
+func advertisedChatServers() []shared.ChatServerInfo {
+	servers := make([]shared.ChatServerInfo, 0, len(chatServers))
+	for name, address := range chatServers {
+		servers = append(servers, shared.ChatServerInfo{Name: name, Address: address})
+	}
+	registeredChatServers.Lock()
+	for name, server := range registeredChatServers.byName {
+		if time.Since(server.lastHeartbeat) <= shared.ChatServerTimeout {
+			servers = append(servers, shared.ChatServerInfo{Name: name, Address: server.address})
+		}
+	}
+	registeredChatServers.Unlock()
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestChatServerFlags(t *testing.T) {
+	flags := make(chatServerFlags)
+	for _, value := range []string{"main=127.0.0.1:6667", "backup=[::1]:6668"} {
+		if err := flags.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flags.String() != "backup=[::1]:6668,main=127.0.0.1:6667" {
+		t.Fatalf("parsed %s", flags)
+	}
+	for _, value := range []string{"main", "=127.0.0.1:6667", "main=127.0.0.1"} {
+		if err := flags.Set(value); err == nil {
+			t.Fatalf("%q parsed", value)
+		}
+	}
+}
+
+func TestGetChatServers(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	defer func(servers chatServerFlags) { chatServers = servers }(chatServers)
+	chatServers = chatServerFlags{"main": "127.0.0.1:6667", "backup": "127.0.0.1:6668"}
+
+	var list shared.ChatServerList
+	if err = new(DServer).GetChatServers(true, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Servers) != 2 || list.Servers[0].Name != "backup" || list.Servers[1].Address != "127.0.0.1:6667" {
+		t.Fatalf("advertised %+v", list.Servers)
+	}
+	hash, err := shared.ChatServersHash(list.Servers)
+	if err != nil || string(hash) != string(list.Hash) || !ecdsa.Verify(list.PubKey, list.Hash, list.SigR, list.SigS) {
+		t.Fatal("the chat server list isn't signed")
+	}
+}
+
+// Accepts connections on a loopback port like a chat server would, closing
+// them straight away
+func serveTestChatServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRegisterChatServer(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	defer func(servers chatServerFlags, token string) { chatServers, chatServerToken = servers, token }(chatServers, chatServerToken)
+	chatServers, chatServerToken = chatServerFlags{"main": "127.0.0.1:6667"}, "secret"
+	registeredChatServers.Lock()
+	registeredChatServers.byName = make(map[string]*registeredChatServer)
+	registeredChatServers.Unlock()
+
+	reg := shared.ChatServerRegistration{Name: "second", Address: serveTestChatServer(t), Token: "secret"}
+
+	var ack bool
+	if err = new(DServer).RegisterChatServer(shared.ChatServerRegistration{Name: "second", Address: reg.Address, Token: "guess"}, &ack); err != badChatServerTokenError {
+		t.Fatalf("a wrong token gave %v, want %v", err, badChatServerTokenError)
+	}
+	if err = new(DServer).RegisterChatServer(shared.ChatServerRegistration{Name: "main", Address: reg.Address, Token: "secret"}, &ack); err != chatServerNameTakenError {
+		t.Fatalf("taking a -chat-server name gave %v, want %v", err, chatServerNameTakenError)
+	}
+	if err = new(DServer).RegisterChatServer(shared.ChatServerRegistration{Name: "third", Address: "127.0.0.1:1", Token: "secret"}, &ack); err != unreachableChatServerError {
+		t.Fatalf("an unreachable chat server gave %v, want %v", err, unreachableChatServerError)
+	}
+	if err = new(DServer).RegisterChatServer(reg, &ack); err != nil || !ack {
+		t.Fatal(err)
+	}
+	if err = new(DServer).SendChatServerHeartbeat(reg, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	var list shared.ChatServerList
+	if err = new(DServer).GetChatServers(true, &list); err != nil || len(list.Servers) != 2 || list.Servers[1].Name != "second" {
+		t.Fatalf("advertised %+v, %v", list.Servers, err)
+	}
+
+	// A name stays with its address until the heartbeats stop
+	other := shared.ChatServerRegistration{Name: "second", Address: serveTestChatServer(t), Token: "secret"}
+	if err = new(DServer).RegisterChatServer(other, &ack); err != chatServerNameTakenError {
+		t.Fatalf("taking a live name gave %v, want %v", err, chatServerNameTakenError)
+	}
+	registeredChatServers.Lock()
+	registeredChatServers.byName["second"].lastHeartbeat = time.Now().Add(-2 * shared.ChatServerTimeout)
+	registeredChatServers.Unlock()
+	if err = new(DServer).GetChatServers(true, &list); err != nil || len(list.Servers) != 1 {
+		t.Fatalf("a timed out chat server is advertised: %+v, %v", list.Servers, err)
+	}
+	if err = new(DServer).SendChatServerHeartbeat(other, &ack); err != unregisteredChatServerError {
+		t.Fatalf("a heartbeat from another address gave %v, want %v", err, unregisteredChatServerError)
+	}
+	if err = new(DServer).RegisterChatServer(other, &ack); err != nil {
+		t.Fatalf("taking a timed out name gave %v", err)
+	}
+}
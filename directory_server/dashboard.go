@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Dashboard configurations
+const (
+	dashboardRefresh = 5 * time.Second // how often the page fetches /v1/status
+)
+
+// GET /v1/status: what the dashboard shows
+func serveStatus(r *http.Request) (int, interface{}) {
+	return http.StatusOK, networkStatus()
+}
+
+func networkStatus() shared.NetworkStatus {
+	status := shared.NetworkStatus{Stats: networkStats(), Relays: relayStatuses()}
+	status.Health = consensusHealth(status.Stats, status.Relays)
+	return status
+}
+
+// Every registered OR with its flags, sorted by address
+func relayStatuses() []shared.RelayStatus {
+	routers := routerStatuses(false)
+
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	relays := make([]shared.RelayStatus, 0, len(routers))
+	for _, router := range routers {
+		relay := shared.RelayStatus{RouterStatus: router}
+		if or, ok := activeORs.all[router.Address]; ok {
+			relay.InConsensus = inConsensus(router.Address, or)
+		}
+		if router.Reachable {
+			relay.Flags = append(relay.Flags, "Running")
+		}
+		if router.Stable {
+			relay.Flags = append(relay.Flags, "Stable")
+		}
+		if router.Measured > 0 {
+			relay.Flags = append(relay.Flags, "Measured")
+		}
+		if router.Accounting != nil {
+			relay.Flags = append(relay.Flags, "Capped")
+		}
+		if router.Blacklisted {
+			relay.Flags = append(relay.Flags, "Blacklisted")
+		}
+		if router.SelfTest == shared.SelfTestFailed {
+			relay.Flags = append(relay.Flags, "SelfTestFailed")
+		}
+		relay.Flags = append(relay.Flags, router.Capabilities.Names()...)
+		relays = append(relays, relay)
+	}
+	sort.Slice(relays, func(i, j int) bool { return relays[i].Address < relays[j].Address })
+	return relays
+}
+
+// The readiness checks, and warnings about relays that don't make it into
+// the consensus or lag behind
+func consensusHealth(stats shared.NetworkStats, relays []shared.RelayStatus) shared.ConsensusHealth {
+	checks, ready := util.RunHealthChecks(healthChecks)
+	health := shared.ConsensusHealth{Ready: ready, Checks: checks.Checks, Warnings: []string{}}
+
+	unreachable, failed, outdated := 0, 0, 0
+	for _, relay := range relays {
+		if !relay.Reachable {
+			unreachable++
+		}
+		if relay.SelfTest == shared.SelfTestFailed {
+			failed++
+		}
+		if relay.InConsensus && relay.ProtocolVersion < shared.ProtocolVersion {
+			outdated++
+		}
+	}
+	if unreachable > 0 {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d registered relays are not reachable", unreachable))
+	}
+	if failed > 0 {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d relays failed their self-test and are left out of the consensus", failed))
+	}
+	if outdated > 0 {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d relays in the consensus run a protocol version older than %d", outdated, shared.ProtocolVersion))
+	}
+	if stats.InConsensus > 0 && stats.Stable == 0 {
+		health.Warnings = append(health.Warnings, "No relay in the consensus is Stable, so OPs keeping an entry guard pick any")
+	}
+	if stats.PendingEnrollment > 0 {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d relays are waiting for enrollment approval", stats.PendingEnrollment))
+	}
+	return health
+}
+
+// GET /: the dashboard page. It holds no data itself, so it is served
+// without the API token, which the page asks for and sends with its requests.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIResponse(w, http.StatusMethodNotAllowed, apiError{Error: apiMethodError.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	fmt.Fprintf(w, dashboardHTML, dashboardRefresh.Milliseconds())
+}
+
+// Relay data is only ever put in the page as text, never as HTML, as
+// relays choose their own contact strings
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TorChat network status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #eee; }
+.ok { color: #070; }
+.bad { color: #b00; }
+.out { color: #888; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>TorChat network status</h1>
+<p id="error"></p>
+<h2>Consensus health <span id="ready"></span></h2>
+<table id="checks"></table>
+<ul id="warnings"></ul>
+<h2>Network</h2>
+<table id="stats"></table>
+<h2>Protocol versions</h2>
+<table id="versions"></table>
+<h2>Relays</h2>
+<table id="relays"></table>
+<script>
+var token = sessionStorage.getItem("torchat-api-token");
+
+function row(table, cells, header, cls) {
+	var tr = table.insertRow();
+	if (cls) tr.className = cls;
+	cells.forEach(function (text) {
+		var cell = document.createElement(header ? "th" : "td");
+		cell.textContent = text;
+		tr.appendChild(cell);
+	});
+}
+
+function clear(id) {
+	var el = document.getElementById(id);
+	el.textContent = "";
+	return el;
+}
+
+function bytes(n) {
+	if (n >= 1048576) return (n / 1048576).toFixed(1) + " MB/s";
+	if (n >= 1024) return (n / 1024).toFixed(1) + " kB/s";
+	return n + " B/s";
+}
+
+function duration(ns) {
+	var s = Math.round(ns / 1e9);
+	if (s >= 86400) return Math.floor(s / 86400) + "d " + Math.floor(s %% 86400 / 3600) + "h";
+	if (s >= 3600) return Math.floor(s / 3600) + "h " + Math.floor(s %% 3600 / 60) + "m";
+	if (s >= 60) return Math.floor(s / 60) + "m " + s %% 60 + "s";
+	return s + "s";
+}
+
+function render(status) {
+	var ready = clear("ready");
+	ready.textContent = status.Health.Ready ? "ready" : "not ready";
+	ready.className = status.Health.Ready ? "ok" : "bad";
+
+	var checks = clear("checks");
+	row(checks, ["Check", "Result"], true);
+	Object.keys(status.Health.Checks).sort().forEach(function (name) {
+		var result = status.Health.Checks[name];
+		row(checks, [name, result], false, result == "ok" ? "ok" : "bad");
+	});
+	var warnings = clear("warnings");
+	status.Health.Warnings.forEach(function (warning) {
+		var li = document.createElement("li");
+		li.textContent = warning;
+		warnings.appendChild(li);
+	});
+
+	var s = status.Stats;
+	var stats = clear("stats");
+	[["Registered relays", s.Registered], ["In the consensus", s.InConsensus], ["Stable", s.Stable],
+	 ["Stream exits", s.StreamExits], ["Waiting for approval", s.PendingEnrollment],
+	 ["Reported bandwidth", bytes(s.Bandwidth)], ["Measured bandwidth", bytes(s.Measured)],
+	 ["Median bandwidth", bytes(s.MedianBandwidth)], ["Chat servers", s.ChatServers],
+	 ["Heartbeat interval", duration(s.HeartbeatInterval)], ["Updated", new Date(s.Time).toLocaleString()]
+	].forEach(function (r) { row(stats, [r[0], String(r[1])]); });
+
+	var versions = clear("versions");
+	row(versions, ["Protocol version", "Relays in the consensus"], true);
+	Object.keys(s.Versions).sort(function (a, b) { return b - a; }).forEach(function (v) {
+		row(versions, [v, String(s.Versions[v])]);
+	});
+
+	var relays = clear("relays");
+	row(relays, ["Address", "Flags", "Version", "Bandwidth", "Measured", "Weight", "Uptime", "MTBF", "Failure score", "Self-test", "Contact"], true);
+	status.Relays.forEach(function (r) {
+		row(relays, [r.Address, (r.Flags || []).join(" "), String(r.ProtocolVersion), bytes(r.Bandwidth),
+			r.Measured ? bytes(r.Measured) : "-", r.Weight.toFixed(3), duration(r.Uptime), duration(r.MTBF),
+			r.FailureScore.toFixed(2), r.SelfTest || "-", r.Contact || ""], false, r.InConsensus ? "" : "out");
+	});
+}
+
+function refresh() {
+	if (!token) {
+		token = prompt("API token");
+		if (!token) return;
+		sessionStorage.setItem("torchat-api-token", token);
+	}
+	fetch("/v1/status", { headers: { "Authorization": "Bearer " + token } }).then(function (resp) {
+		return resp.json().then(function (body) {
+			if (resp.status == 401) {
+				token = null;
+				sessionStorage.removeItem("torchat-api-token");
+			}
+			if (!resp.ok) throw new Error(body.Error || resp.statusText);
+			return body;
+		});
+	}).then(function (status) {
+		clear("error");
+		render(status);
+	}).catch(function (err) {
+		clear("error").textContent = "Could not get the network status: " + err.message;
+	});
+}
+
+refresh();
+setInterval(refresh, %d);
+</script>
+</body>
+</html>
+`
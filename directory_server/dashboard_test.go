@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"../shared"
+)
+
+func TestNetworkStatus(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, Measured: 80, ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement},
+		"127.0.0.1:8002": {Reachable: true, ProtocolVersion: 1, Accounting: &shared.AccountingReport{Max: 1000}},
+		"127.0.0.1:8003": {SelfTest: shared.SelfTestFailed, ProtocolVersion: shared.ProtocolVersion},
+	}
+	activeORs.Unlock()
+
+	status := networkStatus()
+	if len(status.Relays) != 3 || status.Relays[0].Address != "127.0.0.1:8001" {
+		t.Fatalf("the relays are %+v", status.Relays)
+	}
+	want := [][]string{
+		{"Running", "Measured", shared.CapabilityMeasurement.Names()[0]},
+		{"Running", "Capped"},
+		{"SelfTestFailed"},
+	}
+	for i, relay := range status.Relays {
+		if strings.Join(relay.Flags, " ") != strings.Join(want[i], " ") {
+			t.Errorf("%s has flags %v, want %v", relay.Address, relay.Flags, want[i])
+		}
+	}
+	if !status.Relays[1].InConsensus || status.Relays[2].InConsensus {
+		t.Fatalf("in the consensus: %v, %v", status.Relays[1].InConsensus, status.Relays[2].InConsensus)
+	}
+
+	// Too few relays, one unreachable one that failed its self-test, one
+	// outdated, none stable
+	if status.Health.Ready || len(status.Health.Checks) != len(healthChecks) || len(status.Health.Warnings) != 4 {
+		t.Fatalf("the health is %+v", status.Health)
+	}
+}
+
+func TestServeDashboard(t *testing.T) {
+	for path, want := range map[string]int{"/": http.StatusOK, "/other": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		serveDashboard(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Fatalf("%s gave %d, want %d", path, w.Code, want)
+		}
+	}
+
+	// The page needs no token, holds no data, and is filled in completely
+	w := httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	body := w.Body.String()
+	if strings.Contains(body, "%!") || !strings.Contains(body, "setInterval(refresh, 5000)") || strings.Contains(body, "innerHTML") {
+		t.Fatal("the page wasn't filled in as expected")
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "default-src 'none'") {
+		t.Fatalf("the page is served with policy %q", csp)
+	}
+
+	w = httptest.NewRecorder()
+	serveDashboard(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("a POST gave %d", w.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"sort"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type DescriptorError error
+
+var (
+	// Descriptor Errors
+	unsignedDescriptorError     DescriptorError = errors.New("Onion router did not send a signed descriptor, and its version publishes one")
+	badDescriptorSignatureError DescriptorError = errors.New("Descriptor signature does not verify with the OR's registered key")
+	mismatchedDescriptorError   DescriptorError = errors.New("Descriptor does not match what the OR registered, register again to change it")
+	staleDescriptorError        DescriptorError = errors.New("Descriptor is no later than the one stored, or too far from the directory server's time")
+	noDescriptorError           DescriptorError = errors.New("Onion router registered without a descriptor")
+)
+
+// Checks the descriptor an OR registers with: signed by the key it
+// registers, and saying what it registers. ORs from before descriptors
+// register without one.
+func checkRegisteredDescriptor(address string, or shared.OnionRouterInfo) error {
+	if or.Descriptor == nil {
+		if shared.SupportsFeature(or.ProtocolVersion, shared.FeatureDescriptors) {
+			return unsignedDescriptorError
+		}
+		return nil
+	}
+	if err := verifyDescriptor(*or.Descriptor, or.PubKey, 0); err != nil {
+		return err
+	}
+
+	d := or.Descriptor.Descriptor
+	if canonical(d.Address) != address || d.ProtocolVersion != or.ProtocolVersion || d.ExitPolicy != or.ExitPolicy ||
+		d.ExitStreams != or.ExitStreams || d.Capabilities != or.Capabilities || d.Contact != or.Contact {
+		return mismatchedDescriptorError
+	}
+	return nil
+}
+
+// Checks a descriptor's signature by key, and that it was published after
+// the one stored and near the directory's time
+func verifyDescriptor(signed shared.SignedDescriptor, key *rsa.PublicKey, lastPublished int64) error {
+	data, err := shared.DescriptorSigningBytes(signed.Descriptor)
+	if err != nil {
+		return shared.EncodingError("descriptor", err)
+	}
+	if key == nil || util.RSAVerify(key, data, signed.Signature) != nil {
+		return badDescriptorSignatureError
+	}
+	skew := time.Since(time.Unix(0, signed.Descriptor.Published))
+	if signed.Descriptor.Published <= lastPublished || skew > heartbeatMaxSkew || skew < -heartbeatMaxSkew {
+		return staleDescriptorError
+	}
+	return nil
+}
+
+// Replaces the stored descriptor of an OR with a later one. Only the
+// bandwidth and platform may differ from the registered descriptor; other
+// changes need the OR to register again.
+func (s *DServer) PublishDescriptor(signed shared.SignedDescriptor, ack *bool) error {
+	activeORs.Lock()
+	defer activeORs.Unlock()
+
+	address := canonical(signed.Descriptor.Address)
+	or, ok := activeORs.all[address]
+	if !ok {
+		return unregisteredAddrError
+	}
+	if or.Descriptor == nil {
+		return noDescriptorError
+	}
+	if err := verifyDescriptor(signed, or.PubKey, or.Descriptor.Descriptor.Published); err != nil {
+		return err
+	}
+
+	stored := or.Descriptor.Descriptor
+	updated := signed.Descriptor
+	updated.Bandwidth, updated.Platform, updated.Published = stored.Bandwidth, stored.Platform, stored.Published
+	data, err := shared.DescriptorSigningBytes(updated)
+	if err != nil {
+		return shared.EncodingError("descriptor", err)
+	}
+	storedData, err := shared.DescriptorSigningBytes(stored)
+	if err != nil {
+		return shared.EncodingError("descriptor", err)
+	}
+	if string(data) != string(storedData) {
+		return mismatchedDescriptorError
+	}
+
+	signed.PubKey = or.PubKey
+	or.Descriptor = &signed
+	*ack = true
+	return nil
+}
+
+// The latest descriptor of a registered OR, as it signed it
+func (s *DServer) GetDescriptor(orAddress string, descriptor *shared.SignedDescriptor) error {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	or, ok := activeORs.all[canonical(orAddress)]
+	if !ok {
+		return unregisteredAddrError
+	}
+	if or.Descriptor == nil {
+		return noDescriptorError
+	}
+	*descriptor = *or.Descriptor
+	return nil
+}
+
+// The descriptors of the usable ORs that match filter, by address
+func (s *DServer) GetDescriptors(filter shared.DescriptorFilter, descriptors *[]shared.SignedDescriptor) error {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	matching := []shared.SignedDescriptor{}
+	for orAddress, or := range activeORs.all {
+		if or.Descriptor == nil || !or.Reachable || isBlacklisted(orAddress) {
+			continue
+		}
+		if filter.Matches(or.Descriptor.Descriptor) {
+			matching = append(matching, *or.Descriptor)
+		}
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].Descriptor.Address < matching[j].Descriptor.Address
+	})
+	*descriptors = matching
+	return nil
+}
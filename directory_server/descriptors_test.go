@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func signedDescriptor(t *testing.T, key *rsa.PrivateKey, d shared.Descriptor) shared.SignedDescriptor {
+	data, err := shared.DescriptorSigningBytes(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := util.RSASign(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shared.SignedDescriptor{Descriptor: d, Signature: signature}
+}
+
+func TestCheckRegisteredDescriptor(t *testing.T) {
+	key := testRSAKey(t)
+	d := shared.Descriptor{Address: "127.0.0.1:8001", ProtocolVersion: shared.ProtocolVersion, Published: time.Now().UnixNano(), Contact: "ops"}
+	signed := signedDescriptor(t, key, d)
+	info := shared.OnionRouterInfo{Address: d.Address, PubKey: &key.PublicKey, ProtocolVersion: shared.ProtocolVersion, Contact: "ops", Descriptor: &signed}
+	if err := checkRegisteredDescriptor("127.0.0.1:8001", info); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Contact = "someone else"
+	if err := checkRegisteredDescriptor("127.0.0.1:8001", info); err != mismatchedDescriptorError {
+		t.Fatalf("registering other than the descriptor says gave %v, want %v", err, mismatchedDescriptorError)
+	}
+	info.Contact, info.PubKey = "ops", &testRSAKey(t).PublicKey
+	if err := checkRegisteredDescriptor("127.0.0.1:8001", info); err != badDescriptorSignatureError {
+		t.Fatalf("a descriptor signed by another key gave %v, want %v", err, badDescriptorSignatureError)
+	}
+	info.Descriptor = nil
+	if err := checkRegisteredDescriptor("127.0.0.1:8001", info); err != unsignedDescriptorError {
+		t.Fatalf("a current router without a descriptor gave %v, want %v", err, unsignedDescriptorError)
+	}
+	info.ProtocolVersion = 1
+	if err := checkRegisteredDescriptor("127.0.0.1:8001", info); err != nil {
+		t.Fatalf("an old router without a descriptor gave %v", err)
+	}
+}
+
+func TestPublishDescriptor(t *testing.T) {
+	key := testRSAKey(t)
+	published := time.Now().UnixNano()
+	d := shared.Descriptor{Address: "127.0.0.1:8001", ProtocolVersion: shared.ProtocolVersion, Published: published, Platform: "go linux/amd64", Bandwidth: 100}
+	registered := signedDescriptor(t, key, d)
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, PubKey: &key.PublicKey, Descriptor: &registered},
+		"127.0.0.1:8002": {Reachable: true},
+	}
+	activeORs.Unlock()
+
+	s := new(DServer)
+	var ack bool
+	d.Published, d.Bandwidth = published+1, 200
+	if err := s.PublishDescriptor(signedDescriptor(t, key, d), &ack); err != nil {
+		t.Fatal(err)
+	}
+	var stored shared.SignedDescriptor
+	if err := s.GetDescriptor("127.0.0.1:8001", &stored); err != nil || stored.Descriptor.Bandwidth != 200 || stored.PubKey != &key.PublicKey {
+		t.Fatalf("the stored descriptor is %+v, %v", stored, err)
+	}
+
+	changed := d
+	changed.Published, changed.Capabilities = published+2, shared.CapabilityExitStreams
+	for _, c := range []struct {
+		signed shared.SignedDescriptor
+		want   error
+	}{
+		{signedDescriptor(t, key, d), staleDescriptorError},
+		{signedDescriptor(t, key, changed), mismatchedDescriptorError},
+		{signedDescriptor(t, testRSAKey(t), changed), badDescriptorSignatureError},
+	} {
+		if err := s.PublishDescriptor(c.signed, &ack); err != c.want {
+			t.Errorf("publishing %+v gave %v, want %v", c.signed.Descriptor, err, c.want)
+		}
+	}
+	if err := s.GetDescriptor("127.0.0.1:8002", &stored); err != noDescriptorError {
+		t.Fatalf("a router without a descriptor gave %v, want %v", err, noDescriptorError)
+	}
+
+	var descriptors []shared.SignedDescriptor
+	if err := s.GetDescriptors(shared.DescriptorFilter{Platform: "linux"}, &descriptors); err != nil || len(descriptors) != 1 {
+		t.Fatalf("linux routers are %+v, %v", descriptors, err)
+	}
+	if err := s.GetDescriptors(shared.DescriptorFilter{Platform: "windows"}, &descriptors); err != nil || len(descriptors) != 0 {
+		t.Fatalf("windows routers are %+v, %v", descriptors, err)
+	}
+}
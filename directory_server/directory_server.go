@@ -1,37 +1,59 @@
-//go run directory_server.go
+// go run directory_server.go
 package main
 
 import (
+	"bytes"
 	"crypto/elliptic"
 	"crypto/rsa"
 	"encoding/gob"
 	"errors"
-	"fmt"
-	math_rand "math/rand"
+	"flag"
 	"net"
 	"net/rpc"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"crypto/ecdsa"
-	"crypto/md5"
-	"crypto/rand"
 	"crypto/x509"
 	"encoding/hex"
-	"encoding/json"
 
 	"../shared"
 	"../util"
+	"../util/faults"
 )
 
 type UnregisteredAddrError error
 type NotEnoughORsError error
+type FailedHandshakeError error
+type NoCompatibleExitError error
 
-type DServer int
+type DServer struct {
+	remoteHost string // host the connection came from, "" for calls not over RPC
+}
 
 type OnionRouter struct {
-	PubKey              *rsa.PublicKey
-	MostRecentHeartBeat int64
+	PubKey                *rsa.PublicKey
+	RegisteredAt          int64
+	MostRecentHeartBeat   int64
+	LastHeartbeatSignedAt int64 // Heartbeat.SignedAt of the latest signed heartbeat
+	Reachable             bool  // set once the directory has dialed back and completed a handshake
+	ReachabilityTested    bool  // set once the reachability test passed or ran out of attempts
+	Rechecking            bool  // set while a failure report has the directory dial the OR back again
+	ProtocolVersion       int
+	Bandwidth             uint64 // bytes per second, from the latest SendHeartbeat
+	Measured              uint64 // bytes per second through a test circuit, 0 until measured
+	SelfTest              string // from the latest SendHeartbeat, see shared.SelfTestPassed
+	Transports            map[string]string
+	AltAddresses          []string // addresses in the other family that passed the reachability test too
+	ExitPolicy            string   // in canonical form, "" for the default
+	ExitStreams           bool
+	Capabilities          shared.Capabilities
+	Contact               string
+	Descriptor            *shared.SignedDescriptor // latest one the OR published, nil for ORs from before descriptors
+	Accounting            *shared.AccountingReport // from the latest SendHeartbeat, nil for ORs without a traffic cap
 }
 
 type ActiveORs struct {
@@ -41,30 +63,105 @@ type ActiveORs struct {
 
 const (
 	// Server configurations
-	privKeyStr        string = "3081a40201010430aeb7b244cf5ee8a952ff378a140275a0d7f98a7c44faca12357867c667b860fa2aaf7bf9039d3b481479bf0fd512097fa00706052b81040022a1640362000449e30da789d5b12a9487a96d70d69b6b8cbd6821d7a647f35c18a8d5f0969054ae3130e7a2a813363eb578747bc77048b700badea328df20ce68a58fcd0e4166f538f9393e0b4072d069cc4cc631271660dc5ebebb20531f11eeb4bd5aa6a5ca"
-	serverPort        string = ":12345"
-	heartBeatInterval int64  = 2 // seconds
-	numHops           int    = 3 // how many ORs will be in the circuit
+	privKeyStr string = "3081a40201010430aeb7b244cf5ee8a952ff378a140275a0d7f98a7c44faca12357867c667b860fa2aaf7bf9039d3b481479bf0fd512097fa00706052b81040022a1640362000449e30da789d5b12a9487a96d70d69b6b8cbd6821d7a647f35c18a8d5f0969054ae3130e7a2a813363eb578747bc77048b700badea328df20ce68a58fcd0e4166f538f9393e0b4072d069cc4cc631271660dc5ebebb20531f11eeb4bd5aa6a5ca"
+	serverPort string = ":12345"
+	numHops    int    = 3 // how many ORs will be in the circuit
+
+	// How long OPs may use a consensus after it was signed, cached or not
+	consensusLifetime time.Duration = 3 * time.Hour
+
+	// Reachability test configurations
+	reachabilityAttempts int           = 3
+	reachabilityTimeout  time.Duration = 3 * time.Second
+	handshakeNonceSize   int           = 32
 )
 
 var (
 	// Directory Server Errors
 	unregisteredAddrError UnregisteredAddrError = errors.New("Given OR ip:port is not registered")
 	notEnoughORsError     NotEnoughORsError     = errors.New("Not enough ORs")
+	failedHandshakeError  FailedHandshakeError  = errors.New("OR did not return the handshake nonce")
+	noCompatibleExitError NoCompatibleExitError = errors.New("No usable OR exits to the requested destination")
 
 	// All the active onion routers in the system mapped by ip:port of OR
 	activeORs ActiveORs = ActiveORs{all: make(map[string]*OnionRouter)}
 
+	// seconds without a heartbeat before an OR is dropped; adjustable via the admin RPC
+	heartBeatInterval int64 = 2
+
 	pubKey  ecdsa.PublicKey
 	privKey *ecdsa.PrivateKey
 )
 
+// go run *.go [-blacklist blacklist.txt] [-chat-server name=ip:port] [-chat-server-token secret] [-enrollment-token secret] [-enrollment-approval] [-enrollments path] [-api-addr ip:port -api-token secret [-api-cert pem -api-key pem]] [-distinct-subnets=true] [-measure-interval 10m] [-require-signed-heartbeats] [-stable-mtbf 1h] [-health-addr :9301] [-faults spec] [-deterministic-seed n]
 func main() {
 	gob.Register(&elliptic.CurveParams{})
 
-	dserver := new(DServer)
-	server := rpc.NewServer()
-	server.Register(dserver)
+	blacklistPath := flag.String("blacklist", "", "file of OR addresses to exclude from circuits")
+	flag.BoolVar(&distinctSubnets, "distinct-subnets", true, "never put two ORs in the same IPv4 /16 or IPv6 /32 in one circuit")
+	flag.Var(chatServers, "chat-server", "advertise a chat server OPs can home channels on, as name=ip:port (repeatable)")
+	flag.StringVar(&chatServerToken, "chat-server-token", os.Getenv("TORCHAT_CHAT_SERVER_TOKEN"), "token chat servers must present to register themselves (any chat server may if empty; env TORCHAT_CHAT_SERVER_TOKEN)")
+	flag.StringVar(&enrollments.token, "enrollment-token", os.Getenv("TORCHAT_ENROLLMENT_TOKEN"), "token ORs must present to be listed (env TORCHAT_ENROLLMENT_TOKEN)")
+	flag.BoolVar(&enrollments.approval, "enrollment-approval", false, "queue ORs without the enrollment token until an admin approves them")
+	enrollmentsPath := flag.String("enrollments", "", "file of approved OR addresses, kept up to date as the admin approves ORs (memory only if empty)")
+	adminToken := flag.String("admin-token", os.Getenv("TORCHAT_ADMIN_TOKEN"), "token required by the admin RPC (disabled if empty)")
+	apiAddr := flag.String("api-addr", "", "ip:port to serve the REST API on over HTTPS: the consensus, node list and network statistics as JSON (disabled if empty)")
+	apiToken := flag.String("api-token", os.Getenv("TORCHAT_API_TOKEN"), "bearer token every REST API request must present (env TORCHAT_API_TOKEN)")
+	apiCert := flag.String("api-cert", "", "PEM certificate the REST API serves, with -api-key (self-signed if empty)")
+	apiKey := flag.String("api-key", "", "PEM private key of -api-cert")
+	flag.DurationVar(&clientParams.params.MinPollInterval, "recommend-poll-interval", 100*time.Millisecond, "shortest interval between polls recommended to OPs")
+	flag.StringVar(&clientParams.params.PaddingClass, "recommend-padding", "none", "padding class recommended to OPs")
+	flag.DurationVar(&clientParams.params.MinRotationInterval, "recommend-rotation-min", 2*time.Minute, "shortest circuit lifetime recommended to OPs")
+	flag.DurationVar(&clientParams.params.MaxRotationInterval, "recommend-rotation-max", 2*time.Minute, "longest circuit lifetime recommended to OPs")
+	flag.BoolVar(&requireSignedHeartbeats, "require-signed-heartbeats", false, "refuse unsigned heartbeats from ORs from before signed heartbeats too, dropping them from the directory")
+	flag.DurationVar(&stableMTBF, "stable-mtbf", defaultStableMTBF, "mean time between failures that always makes an OR Stable, fit for the guard position and long lived circuits; ORs at the median are Stable too")
+	flag.DurationVar(&measureInterval, "measure-interval", measureInterval, "measure the bandwidth of every OR through test circuits this often, and weight ORs by it (0 weights them by the bandwidth they report)")
+	healthAddr := util.HealthFlag()
+	faultSpec := faults.Flag()
+	seed := util.DeterministicFlag()
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
+	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+	faults.Setup(*faultSpec)
+	util.SetupDeterministic(*seed, shared.ComponentDirectoryServer)
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentDirectoryServer, *showFeatures))
+		return
+	}
+	if clientParams.params.MinRotationInterval <= 0 || clientParams.params.MaxRotationInterval < clientParams.params.MinRotationInterval {
+		util.ErrLog.Fatalln("[FATAL ERROR] -recommend-rotation-max must be at least -recommend-rotation-min, which must be positive")
+	}
+	if *blacklistPath != "" {
+		go watchBlacklist(*blacklistPath)
+	}
+	go expireChatServers()
+	if measureInterval > 0 {
+		go measureBandwidths()
+	}
+	if *enrollmentsPath != "" {
+		util.HandleFatalError("Could not load enrollments", loadEnrollments(*enrollmentsPath))
+	}
+	if enrollments.approval && *adminToken == "" {
+		util.ErrLog.Fatalln("[FATAL ERROR] -enrollment-approval needs an -admin-token to approve ORs with")
+	}
+	if *adminToken != "" {
+		go startAdminServer(*adminToken)
+	}
+	if *apiAddr != "" {
+		if *apiToken == "" {
+			util.ErrLog.Fatalln("[FATAL ERROR] -api-addr needs an -api-token, which every REST API request must present")
+		}
+		if (*apiCert == "") != (*apiKey == "") {
+			util.ErrLog.Fatalln("[FATAL ERROR] -api-cert and -api-key must be given together")
+		}
+	}
+	if *healthAddr != "" {
+		go util.ServeHealth(*healthAddr, healthChecks)
+	}
 
 	// Decode keys from strings
 	var err error
@@ -73,99 +170,369 @@ func main() {
 	util.HandleFatalError("Can not parse private key", err)
 	pubKey = privKey.PublicKey
 
+	// Signs consensuses, so it starts once the key is decoded
+	if *apiAddr != "" {
+		go startRESTAPI(*apiAddr, *apiToken, *apiCert, *apiKey)
+	}
+
 	listener, err := net.Listen("tcp", serverPort)
-	printError(err)
-	fmt.Println("Server is listening on addr/port: ", listener.Addr(), "\n")
+	util.HandleFatalError("Error starting server", err)
+	listener = faults.Listen(listener)
+	util.OutLog.Println("Server is listening on addr/port: ", listener.Addr())
 
 	for {
-		conn, _ := listener.Accept()
+		conn, err := listener.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Error accepting", err)
+			continue
+		}
+		remoteHost, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		server := rpc.NewServer()
+		server.Register(&DServer{remoteHost: remoteHost})
 		go server.ServeConn(conn)
 	}
 }
 
 func (s *DServer) RegisterNode(or shared.OnionRouterInfo, ack *bool) error {
+	address, err := shared.CanonicalAddress(or.Address)
+	if err != nil {
+		return err
+	}
+	var altAddresses []string
+	for _, alt := range or.AltAddresses {
+		if alt, err = shared.CanonicalAddress(alt); err == nil && alt != address {
+			altAddresses = append(altAddresses, alt)
+		}
+	}
+	// The default policy is published as "", so descriptors of ORs that keep
+	// it hash the same for OPs from before exit policies
+	var exitPolicy string
+	if or.ExitPolicy != "" {
+		policy, err := shared.ParseExitPolicy(or.ExitPolicy)
+		if err != nil {
+			return err
+		}
+		if exitPolicy = policy.String(); exitPolicy == shared.DefaultExitPolicy {
+			exitPolicy = ""
+		}
+	}
+	if err = checkRegisteredDescriptor(address, or); err != nil {
+		return err
+	}
+	if err = enroll(address, or); err != nil {
+		return err
+	}
+	if or.Descriptor != nil {
+		or.Descriptor.PubKey = or.PubKey
+	}
+
 	activeORs.Lock()
 	defer activeORs.Unlock()
 
-	activeORs.all[or.Address] = &OnionRouter{
-		or.PubKey,
-		time.Now().Unix(),
+	now := time.Now().Unix()
+	old, registered := activeORs.all[address]
+	if registered && !sameKey(old.PubKey, or.PubKey) && now-old.MostRecentHeartBeat <= getHeartBeatInterval() {
+		if old.PubKey == nil || util.RSAVerify(old.PubKey, shared.KeyChangeSigningBytes(address, or.PubKey), or.KeyChangeSignature) != nil {
+			util.ErrLog.Printf("[WARNING] %s registered with a new key while its old one is live\n", address)
+			return shared.AddressInUseError
+		}
+	}
+	activeORs.all[address] = &OnionRouter{
+		PubKey:              or.PubKey,
+		RegisteredAt:        now,
+		MostRecentHeartBeat: now,
+		ProtocolVersion:     shared.PeerVersion(or.ProtocolVersion),
+		Transports:          or.Transports,
+		ExitPolicy:          exitPolicy,
+		ExitStreams:         or.ExitStreams,
+		Capabilities:        or.Capabilities,
+		Contact:             or.Contact,
+		Descriptor:          or.Descriptor,
 	}
+	startRun(address, time.Unix(now, 0))
 
-	go monitor(or.Address)
-	fmt.Printf("Got register from %s\n", or.Address)
+	// The monitor of a registered address watches the new entry too
+	if !registered {
+		go monitor(address)
+	}
+	go testReachability(address, or.PubKey, altAddresses)
+	util.OutLog.Printf("Got register from %s (protocol version %d)\n", address, shared.PeerVersion(or.ProtocolVersion))
 
 	return nil
 }
 
-// The RPC call to GetNodes does not require any arguments
-func (s *DServer) GetNodes(_ignored string, dsORSet *shared.OnionRouterInfos) error {
-	if len(activeORs.all) < numHops {
-		return notEnoughORsError
+// Whether a and b are the same key, or both missing as for ORs from before keys
+func sameKey(a, b *rsa.PublicKey) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(b)
+}
+
+// Address as the directory keys it, or address itself if it doesn't parse
+func canonical(address string) string {
+	if c, err := shared.CanonicalAddress(address); err == nil {
+		return c
+	}
+	return address
+}
+
+// Reports the reachability test of a registered OR, so an OR behind NAT can
+// tell whether other nodes reach it
+func (s *DServer) GetReachability(orAddress string, reachability *shared.Reachability) error {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	or, ok := activeORs.all[canonical(orAddress)]
+	if !ok {
+		return unregisteredAddrError
+	}
+	*reachability = shared.Reachability{Tested: or.ReachabilityTested, Reachable: or.Reachable}
+	return nil
+}
+
+// Dials the OR back on its registered address and checks that it can decrypt a
+// nonce sent to its registered public key before listing it in GetNodes.
+// Alternate addresses of a reachable OR are listed once they pass one test.
+func testReachability(orAddress string, orPubKey *rsa.PublicKey, altAddresses []string) {
+	for attempt := 1; attempt <= reachabilityAttempts; attempt++ {
+		err := handshake(orAddress, orPubKey)
+		if err == nil {
+			var reachableAlts []string
+			for _, alt := range altAddresses {
+				if err := handshake(alt, orPubKey); err != nil {
+					util.OutLog.Printf("Reachability test for %s at %s failed: %s\n", orAddress, alt, err)
+					continue
+				}
+				reachableAlts = append(reachableAlts, alt)
+			}
+
+			activeORs.Lock()
+			if or, ok := activeORs.all[orAddress]; ok && or.PubKey == orPubKey {
+				or.Reachable = true
+				or.ReachabilityTested = true
+				or.AltAddresses = reachableAlts
+				util.OutLog.Printf("%s is reachable\n", orAddress)
+			}
+			activeORs.Unlock()
+			return
+		}
+
+		util.OutLog.Printf("Reachability test %d/%d for %s failed: %s\n", attempt, reachabilityAttempts, orAddress, err)
+		if attempt < reachabilityAttempts {
+			time.Sleep(reachabilityTimeout)
+		}
+	}
+
+	activeORs.Lock()
+	if or, ok := activeORs.all[orAddress]; ok && or.PubKey == orPubKey {
+		or.ReachabilityTested = true
+	}
+	activeORs.Unlock()
+}
+
+func handshake(orAddress string, orPubKey *rsa.PublicKey) error {
+	conn, err := faults.DialTimeout("tcp", orAddress, reachabilityTimeout)
+	if err != nil {
+		return err
+	}
+	orServer := rpc.NewClient(conn)
+	defer orServer.Close()
+
+	nonce := make([]byte, handshakeNonceSize)
+	if _, err = util.Random.Read(nonce); err != nil {
+		return err
+	}
+	encryptedNonce, err := util.RSAEncrypt(orPubKey, nonce)
+	if err != nil {
+		return err
+	}
+
+	var decryptedNonce []byte
+	call := orServer.Go("ORServer.Handshake", encryptedNonce, &decryptedNonce, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+	case <-time.After(reachabilityTimeout):
+		return errors.New("handshake timed out")
 	}
 
+	if !bytes.Equal(nonce, decryptedNonce) {
+		return failedHandshakeError
+	}
+	return nil
+}
+
+// Returns numHops ORs to build a circuit from, the first one Stable and the
+// last one an exit whose policy accepts req.Destination. If fewer are usable
+// and the OP opted in with req.MinHops, returns as many as are available down
+// to MinHops.
+func (s *DServer) GetNodes(req shared.CircuitRequest, dsORSet *shared.OnionRouterInfos) error {
 	activeORs.RLock()
 	defer activeORs.RUnlock()
 
+	now := time.Now()
+	threshold := stableThreshold(now)
 	var orAddresses []string
+	var stableAddresses []string
+	var exitAddresses []string
+
+	// list of all OR addresses that passed the reachability test and are not blacklisted
+	for orAddress, or := range activeORs.all {
+		if or.Reachable && !isBlacklisted(orAddress) && or.SelfTest != shared.SelfTestFailed {
+			stable := isStable(orAddress, threshold, now)
+			if req.Stable && !stable {
+				continue
+			}
+			orAddresses = append(orAddresses, orAddress)
+			if stable {
+				stableAddresses = append(stableAddresses, orAddress)
+			}
+			if orInfo(orAddress, or).ExitsTo(req.Destination, req.Streams) {
+				exitAddresses = append(exitAddresses, orAddress)
+			}
+		}
+	}
 
-	// list of all OR addresses
-	for orAddress, _ := range activeORs.all {
-		orAddresses = append(orAddresses, orAddress)
+	// return random array of OR IP addresses to be used in constructing circuit,
+	// favouring ORs with fewer recent failure reports. Sorted first so the
+	// choice only depends on util.Random.
+	sort.Strings(orAddresses)
+	sort.Strings(stableAddresses)
+	sort.Strings(exitAddresses)
+	exit := weightedSample(exitAddresses, 1)
+	if len(exit) == 0 {
+		return noCompatibleExitError
+	}
+	chosen := exit
+	if guard := weightedSample(withoutOR(stableAddresses, exit[0]), 1); len(guard) > 0 {
+		middle := weightedSample(withoutOR(withoutOR(orAddresses, exit[0]), guard[0]), numHops-2)
+		chosen = append(append(guard, middle...), exit[0])
 	}
+	if len(chosen) < numHops {
+		if req.MinHops < 1 || len(chosen) < req.MinHops {
+			return notEnoughORsError
+		}
+		util.OutLog.Printf("Only %d usable ORs in distinct subnets, returning a %d hop circuit\n", len(chosen), len(chosen))
+	}
+
+	var orInfos []shared.OnionRouterInfo
+	for _, randomORip := range chosen {
+		info := orInfo(randomORip, activeORs.all[randomORip])
+		info.Stable = isStable(randomORip, threshold, now)
+		orInfos = append(orInfos, info)
+	}
+
+	*dsORSet = signORInfos(orInfos)
+	util.OutLog.Printf("New Circuit: %v\n", *dsORSet)
+
+	return nil
+}
 
-	// return random array of OR IP addresses to be used in constructing circuit
-	math_rand.Seed(time.Now().UnixNano())
-	randomIndexes := math_rand.Perm(len(activeORs.all))
+// Returns every usable OR with its selection weight, for OPs that pick their
+// own paths
+func (s *DServer) GetConsensus(_ignored bool, dsORSet *shared.OnionRouterInfos) error {
+	*dsORSet = signedConsensus()
+	return nil
+}
 
+// Every OR in the consensus sorted by address, signed
+func signedConsensus() shared.OnionRouterInfos {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	median := medianBandwidth()
+	now := time.Now()
+	threshold := stableThreshold(now)
 	var orInfos []shared.OnionRouterInfo
-	for i := 0; i < numHops; i++ {
-		randomORip := orAddresses[randomIndexes[i]]
-		orInfos = append(orInfos, shared.OnionRouterInfo{
-			Address: randomORip,
-			PubKey:  activeORs.all[randomORip].PubKey,
-		})
+	for orAddress, or := range activeORs.all {
+		if inConsensus(orAddress, or) {
+			info := orInfo(orAddress, or)
+			info.Weight = selectionWeight(orAddress, median)
+			info.Stable = isStable(orAddress, threshold, now)
+			orInfos = append(orInfos, info)
+		}
 	}
 
-	orBytes, err := json.Marshal(orInfos)
-	util.HandleFatalError("error marshalling OR info", err)
-	hash := md5.New()
-	hash.Write(orBytes)
-	hashBytes := hash.Sum(nil)
+	sort.Slice(orInfos, func(i, j int) bool { return orInfos[i].Address < orInfos[j].Address })
+	return signORInfos(orInfos)
+}
 
-	// sign the hash
-	sigR, sigS, _ := ecdsa.Sign(rand.Reader, privKey, hashBytes)
+// Whether OPs get the OR in the consensus: it is reachable, not blacklisted,
+// and didn't fail its self-test.
+// Caller must hold the activeORs lock.
+func inConsensus(orAddress string, or *OnionRouter) bool {
+	return or.Reachable && !isBlacklisted(orAddress) && or.SelfTest != shared.SelfTestFailed
+}
 
-	dsORInfo := shared.OnionRouterInfos{
-		SigS:    sigS,
-		SigR:    sigR,
-		Hash:    hashBytes,
-		PubKey:  &pubKey,
-		ORInfos: orInfos[:numHops],
+// The descriptor of a registered OR as OPs get it
+func orInfo(orAddress string, or *OnionRouter) shared.OnionRouterInfo {
+	return shared.OnionRouterInfo{
+		Address:         orAddress,
+		PubKey:          or.PubKey,
+		ProtocolVersion: or.ProtocolVersion,
+		Bandwidth:       or.weightBandwidth(),
+		Transports:      or.Transports,
+		AltAddresses:    or.AltAddresses,
+		ExitPolicy:      or.ExitPolicy,
+		ExitStreams:     or.ExitStreams,
+		Capabilities:    or.Capabilities,
+		Contact:         or.Contact,
 	}
+}
 
-	*dsORSet = dsORInfo
-	fmt.Printf("New Circuit: %v ", *dsORSet)
+// Signs a list of ORs and the recommended client params so OPs can check
+// they came from this directory server
+func signORInfos(orInfos []shared.OnionRouterInfo) shared.OnionRouterInfos {
+	params := getClientParams()
+	hashBytes, err := shared.ConsensusHash(orInfos, params)
+	util.HandleFatalError("error marshalling OR info", err)
 
-	return nil
+	// sign the hash
+	sigR, sigS, _ := ecdsa.Sign(util.Random, privKey, hashBytes)
+
+	validAfter := time.Now().Truncate(time.Second)
+	validUntil := validAfter.Add(consensusLifetime)
+	validityR, validityS, _ := ecdsa.Sign(util.Random, privKey, shared.ConsensusValidityHash(hashBytes, validAfter, validUntil))
+
+	return shared.OnionRouterInfos{
+		SigS:         sigS,
+		SigR:         sigR,
+		Hash:         hashBytes,
+		PubKey:       &pubKey,
+		ORInfos:      orInfos,
+		Params:       params,
+		ValidAfter:   validAfter,
+		ValidUntil:   validUntil,
+		ValiditySigS: validityS,
+		ValiditySigR: validityR,
+	}
 }
 
+// Heartbeat from ORs from before bandwidth reports. Refused for ORs that
+// sign their heartbeats, as it takes only an address.
 func (s *DServer) KeepNodeOnline(orAddress string, ack *bool) error {
 	activeORs.Lock()
 	defer activeORs.Unlock()
 
-	if _, ok := activeORs.all[orAddress]; !ok {
+	or, ok := activeORs.all[canonical(orAddress)]
+	if !ok {
 		return unregisteredAddrError
 	}
+	if or.signsHeartbeats() {
+		return unsignedHeartbeatError
+	}
 
-	activeORs.all[orAddress].MostRecentHeartBeat = time.Now().Unix()
+	or.MostRecentHeartBeat = time.Now().Unix()
 
 	return nil
 }
 
 func printError(err error) {
 	if err != nil {
-		fmt.Println("Error: ", err)
+		util.ErrLog.Println("[ERROR]", err)
 	}
 }
 
@@ -173,14 +540,38 @@ func printError(err error) {
 func monitor(orAddress string) {
 	for {
 		activeORs.Lock()
-		if time.Now().Unix()-activeORs.all[orAddress].MostRecentHeartBeat > heartBeatInterval {
-			fmt.Printf("%s timed out\n", orAddress)
-			delete(activeORs.all, orAddress)
+		or, ok := activeORs.all[orAddress]
+		if !ok {
+			// expired by an admin
 			activeORs.Unlock()
 			return
 		}
-		fmt.Printf("%s is alive\n", orAddress)
+		if time.Now().Unix()-or.MostRecentHeartBeat > getHeartBeatInterval() {
+			util.OutLog.Printf("%s timed out\n", orAddress)
+			removeOR(orAddress)
+			activeORs.Unlock()
+			return
+		}
+		util.OutLog.Printf("%s is alive\n", orAddress)
 		activeORs.Unlock()
-		time.Sleep(time.Duration(heartBeatInterval) * time.Second)
+		time.Sleep(time.Duration(getHeartBeatInterval()) * time.Second)
 	}
 }
+
+func getHeartBeatInterval() int64 {
+	return atomic.LoadInt64(&heartBeatInterval)
+}
+
+// Recommended client params published with every OR list
+type ClientParamsConfig struct {
+	sync.RWMutex
+	params shared.ClientParams
+}
+
+var clientParams ClientParamsConfig
+
+func getClientParams() shared.ClientParams {
+	clientParams.RLock()
+	defer clientParams.RUnlock()
+	return clientParams.params
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Answers the reachability handshake like an onion router, with the given
+// key; if echo is set it answers with that instead
+type testOR struct {
+	privKey *rsa.PrivateKey
+	echo    []byte
+}
+
+func (s *testOR) Handshake(encryptedNonce []byte, nonce *[]byte) error {
+	if s.echo != nil {
+		*nonce = s.echo
+		return nil
+	}
+	decrypted, err := util.RSADecrypt(s.privKey, encryptedNonce)
+	*nonce = decrypted
+	return err
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Serves or on a loopback port and returns its address
+func serveTestOR(t *testing.T, or *testOR) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("ORServer", or); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Accept(listener)
+	return listener.Addr().String()
+}
+
+func TestHandshake(t *testing.T) {
+	key := testRSAKey(t)
+	if err := handshake(serveTestOR(t, &testOR{privKey: key}), &key.PublicKey); err != nil {
+		t.Fatalf("a router holding its key failed the handshake: %v", err)
+	}
+	if err := handshake(serveTestOR(t, &testOR{privKey: testRSAKey(t)}), &key.PublicKey); err == nil {
+		t.Fatal("a router with another key passed the handshake")
+	}
+	if err := handshake(serveTestOR(t, &testOR{echo: []byte("a guess")}), &key.PublicKey); err != failedHandshakeError {
+		t.Fatalf("a wrong nonce gave %v, want %v", err, failedHandshakeError)
+	}
+}
+
+func TestGetNodesListsReachableRouters(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	key := &testRSAKey(t).PublicKey
+
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {PubKey: key, Reachable: true},
+		"127.0.0.1:8002": {PubKey: key, Reachable: true},
+		"127.0.0.1:8003": {PubKey: key},
+	}
+	startTestRuns()
+	activeORs.Unlock()
+
+	var orSet shared.OnionRouterInfos
+	if err = new(DServer).GetNodes(shared.CircuitRequest{}, &orSet); err != notEnoughORsError {
+		t.Fatalf("two reachable routers gave %v, want %v", err, notEnoughORsError)
+	}
+	if err = new(DServer).GetNodes(shared.CircuitRequest{MinHops: 3}, &orSet); err != notEnoughORsError {
+		t.Fatalf("two reachable routers for three hops gave %v, want %v", err, notEnoughORsError)
+	}
+	// An OP that opted in gets a shorter circuit
+	if err = new(DServer).GetNodes(shared.CircuitRequest{MinHops: 2}, &orSet); err != nil || len(orSet.ORInfos) != 2 {
+		t.Fatalf("two reachable routers for two hops gave %d routers, %v", len(orSet.ORInfos), err)
+	}
+
+	activeORs.Lock()
+	activeORs.all["127.0.0.1:8004"] = &OnionRouter{PubKey: key, Reachable: true}
+	startTestRuns()
+	activeORs.Unlock()
+	if err = new(DServer).GetNodes(shared.CircuitRequest{MinHops: 2}, &orSet); err != nil {
+		t.Fatal(err)
+	}
+	for _, or := range orSet.ORInfos {
+		if or.Address == "127.0.0.1:8003" {
+			t.Fatal("a router that failed its reachability test was listed")
+		}
+	}
+	if len(orSet.ORInfos) != numHops {
+		t.Fatalf("%d routers listed, want %d", len(orSet.ORInfos), numHops)
+	}
+}
+
+func TestGetNodesEndsInCompatibleExit(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	key := &testRSAKey(t).PublicKey
+
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {PubKey: key, Reachable: true, ExitPolicy: "reject *:*"},
+		"127.0.0.1:8002": {PubKey: key, Reachable: true, ExitPolicy: "reject *:*"},
+		"127.0.0.1:8003": {PubKey: key, Reachable: true, ExitPolicy: "accept *:6667,reject *:*"},
+		"127.0.0.1:8004": {PubKey: key, Reachable: true, ExitPolicy: "reject *:*", ExitStreams: true},
+	}
+	startTestRuns()
+	activeORs.Unlock()
+
+	var orSet shared.OnionRouterInfos
+	for i := 0; i < 10; i++ {
+		if err = new(DServer).GetNodes(shared.CircuitRequest{Destination: "1.2.3.4:6667"}, &orSet); err != nil {
+			t.Fatal(err)
+		}
+		if exit := orSet.ORInfos[len(orSet.ORInfos)-1]; exit.Address != "127.0.0.1:8003" || exit.ExitPolicy != "accept *:6667,reject *:*" {
+			t.Fatalf("the circuit ends in %+v", exit)
+		}
+	}
+	if err = new(DServer).GetNodes(shared.CircuitRequest{Destination: "1.2.3.4:80"}, &orSet); err != noCompatibleExitError {
+		t.Fatalf("no exit to the destination gave %v, want %v", err, noCompatibleExitError)
+	}
+	if err = new(DServer).GetNodes(shared.CircuitRequest{Destination: "1.2.3.4:6667", Streams: true}, &orSet); err != noCompatibleExitError {
+		t.Fatalf("no exit opening streams gave %v, want %v", err, noCompatibleExitError)
+	}
+}
+
+func TestGetConsensus(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	key := &testRSAKey(t).PublicKey
+
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {PubKey: key, Reachable: true, Transports: map[string]string{"ws": "127.0.0.1:9001"}},
+		"127.0.0.1:8002": {PubKey: key},
+	}
+	activeORs.Unlock()
+
+	// Every reachable router is listed, however few there are
+	var orSet shared.OnionRouterInfos
+	if err = new(DServer).GetConsensus(true, &orSet); err != nil {
+		t.Fatal(err)
+	}
+	if len(orSet.ORInfos) != 1 || orSet.ORInfos[0].Address != "127.0.0.1:8001" || orSet.ORInfos[0].Weight != 1 || orSet.ORInfos[0].Transports["ws"] != "127.0.0.1:9001" {
+		t.Fatalf("the consensus is %+v", orSet.ORInfos)
+	}
+	if !ecdsa.Verify(orSet.PubKey, orSet.Hash, orSet.SigR, orSet.SigS) {
+		t.Fatal("the consensus isn't signed")
+	}
+	validity := shared.ConsensusValidityHash(orSet.Hash, orSet.ValidAfter, orSet.ValidUntil)
+	if orSet.ValidUntil.Sub(orSet.ValidAfter) != consensusLifetime || !ecdsa.Verify(orSet.PubKey, validity, orSet.ValiditySigR, orSet.ValiditySigS) {
+		t.Fatalf("the consensus is valid from %v to %v, unsigned", orSet.ValidAfter, orSet.ValidUntil)
+	}
+
+	// The recommended params are covered by the signature
+	clientParams.params = shared.ClientParams{MinPollInterval: time.Second}
+	defer func() { clientParams.params = shared.ClientParams{} }()
+	if err = new(DServer).GetConsensus(true, &orSet); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := shared.ConsensusHash(orSet.ORInfos, orSet.Params)
+	if err != nil || orSet.Params.MinPollInterval != time.Second || string(hash) != string(orSet.Hash) {
+		t.Fatalf("the consensus has params %+v and hash %x, want %x", orSet.Params, orSet.Hash, hash)
+	}
+}
+
+func TestGetReachability(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {},
+		"127.0.0.1:8002": {ReachabilityTested: true, Reachable: true},
+	}
+	activeORs.Unlock()
+
+	var reachability shared.Reachability
+	if err := new(DServer).GetReachability("127.0.0.1:8001", &reachability); err != nil || reachability.Tested {
+		t.Fatalf("a router still being tested gave %+v, %v", reachability, err)
+	}
+	if err := new(DServer).GetReachability("127.0.0.1:8002", &reachability); err != nil || !reachability.Tested || !reachability.Reachable {
+		t.Fatalf("a reachable router gave %+v, %v", reachability, err)
+	}
+	if err := new(DServer).GetReachability("127.0.0.1:8003", &reachability); err != unregisteredAddrError {
+		t.Fatalf("an unregistered router gave %v, want %v", err, unregisteredAddrError)
+	}
+}
+
+func TestRegisterNodeKeepsLiveKeys(t *testing.T) {
+	const address = "127.0.0.1:8009"
+	oldKey, newKey := testRSAKey(t), testRSAKey(t)
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{address: {PubKey: &oldKey.PublicKey, MostRecentHeartBeat: time.Now().Unix()}}
+	activeORs.Unlock()
+	registeredKey := func() *rsa.PublicKey {
+		activeORs.RLock()
+		defer activeORs.RUnlock()
+		return activeORs.all[address].PubKey
+	}
+
+	var ack bool
+	if err := new(DServer).RegisterNode(shared.OnionRouterInfo{Address: address, PubKey: &newKey.PublicKey}, &ack); !shared.IsAddressInUseError(err) {
+		t.Fatalf("a new key for a live router gave %v, want %v", err, shared.AddressInUseError)
+	}
+	if registeredKey() != &oldKey.PublicKey {
+		t.Fatal("a refused key replaced the live one")
+	}
+	if err := new(DServer).RegisterNode(shared.OnionRouterInfo{Address: address, PubKey: &oldKey.PublicKey}, &ack); err != nil {
+		t.Fatalf("registering again with the same key gave %v", err)
+	}
+
+	// The old key may hand the address over
+	signature, err := util.RSASign(oldKey, shared.KeyChangeSigningBytes(address, &newKey.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = new(DServer).RegisterNode(shared.OnionRouterInfo{Address: address, PubKey: &newKey.PublicKey, KeyChangeSignature: signature}, &ack); err != nil || registeredKey() != &newKey.PublicKey {
+		t.Fatalf("a key change signed by the old key gave %v", err)
+	}
+	other := &testRSAKey(t).PublicKey
+	if err = new(DServer).RegisterNode(shared.OnionRouterInfo{Address: address, PubKey: other, KeyChangeSignature: signature}, &ack); !shared.IsAddressInUseError(err) {
+		t.Fatalf("a signature for another key gave %v, want %v", err, shared.AddressInUseError)
+	}
+
+	// Once the old entry times out any key may take the address
+	activeORs.Lock()
+	activeORs.all[address].MostRecentHeartBeat -= 2*getHeartBeatInterval() + 1
+	activeORs.Unlock()
+	if err = new(DServer).RegisterNode(shared.OnionRouterInfo{Address: address, PubKey: other}, &ack); err != nil || registeredKey() != other {
+		t.Fatalf("a new key for a timed out router gave %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type EnrollmentError error
+
+// ORs the directory lists. With neither a token nor the approval queue
+// configured, every OR that registers is enrolled.
+type Enrollments struct {
+	sync.Mutex
+	token    string            // -enrollment-token, enrolls an OR presenting it straight away
+	approval bool              // -enrollment-approval, queues other ORs for the admin
+	path     string            // file approvals are kept in, memory only if empty
+	approved map[string]string // OR ip:port -> fingerprint of the key approved for it
+	pending  map[string]*shared.PendingRouter
+}
+
+const (
+	// Enrollment configurations
+	pendingEnrollmentTTL  time.Duration = time.Hour // queued ORs that stopped registering are dropped after this
+	maxPendingEnrollments int           = 1000
+)
+
+var (
+	// Enrollment Errors
+	enrollmentRequiredError  EnrollmentError = errors.New("Directory server only lists enrolled onion routers, register with an -enrollment-token")
+	badEnrollmentTokenError  EnrollmentError = errors.New("Invalid enrollment token")
+	notPendingError          EnrollmentError = errors.New("Given OR ip:port is neither waiting for approval nor approved")
+	enrollmentQueueFullError EnrollmentError = errors.New("Too many onion routers are waiting for approval, try again later")
+	enrolledKeyError         EnrollmentError = errors.New("This OR address was approved for another key")
+	missingRouterKeyError    EnrollmentError = errors.New("Onion router registered without a public key")
+
+	enrollments = Enrollments{approved: make(map[string]string), pending: make(map[string]*shared.PendingRouter)}
+)
+
+func (e *Enrollments) required() bool {
+	return e.token != "" || e.approval
+}
+
+// Checks that the OR registering as address may be listed: it presents the
+// enrollment token or its address was approved for its key. Otherwise, with
+// the approval queue on, it waits in the queue and
+// shared.EnrollmentPendingError is returned.
+func enroll(address string, or shared.OnionRouterInfo) error {
+	if !enrollments.required() {
+		return nil
+	}
+	if or.EnrollmentToken != "" && enrollments.token != "" {
+		if subtle.ConstantTimeCompare([]byte(or.EnrollmentToken), []byte(enrollments.token)) != 1 {
+			return badEnrollmentTokenError
+		}
+		return nil
+	}
+
+	if or.PubKey == nil {
+		return missingRouterKeyError
+	}
+	fingerprint := util.Fingerprint(or.PubKey)
+
+	enrollments.Lock()
+	defer enrollments.Unlock()
+
+	if approved, ok := enrollments.approved[address]; ok {
+		// Approvals from before keys were kept take the key of the first
+		// registration after the upgrade
+		if approved == "" {
+			enrollments.approved[address] = fingerprint
+			util.OutLog.Printf("%s enrollment pinned to key %s\n", address, fingerprint)
+			return enrollments.save()
+		}
+		if subtle.ConstantTimeCompare([]byte(approved), []byte(fingerprint)) == 1 {
+			return nil
+		}
+		// A new key waits for approval like a new OR, the old one stays approved
+		if _, queued := enrollments.pending[address]; !queued {
+			util.ErrLog.Printf("[WARNING] %s registered with key %s, but was approved for %s\n", address, fingerprint, approved)
+		}
+		if !enrollments.approval {
+			return enrolledKeyError
+		}
+	} else if !enrollments.approval {
+		return enrollmentRequiredError
+	}
+
+	now := time.Now()
+	pending, ok := enrollments.pending[address]
+	if !ok {
+		if enrollments.expirePending(); len(enrollments.pending) >= maxPendingEnrollments {
+			return enrollmentQueueFullError
+		}
+		pending = &shared.PendingRouter{Address: address, RequestedAt: now}
+		enrollments.pending[address] = pending
+		util.OutLog.Printf("%s is waiting for enrollment approval (contact %q)\n", address, or.Contact)
+	}
+	pending.Fingerprint = fingerprint
+	pending.Contact = or.Contact
+	pending.ProtocolVersion = shared.PeerVersion(or.ProtocolVersion)
+	pending.LastAttempt = now
+	return shared.EnrollmentPendingError
+}
+
+// Approves or rejects address. Approving a queued OR approves the key it last
+// registered with. Rejecting an approved OR revokes its approval and drops it
+// from the directory, unless it is a new key of the OR that is rejected.
+// Caller must hold the enrollments lock.
+func (e *Enrollments) decide(address string, approve bool) error {
+	pending, isPending := e.pending[address]
+	_, isApproved := e.approved[address]
+	if !isPending && !isApproved {
+		return notPendingError
+	}
+	delete(e.pending, address)
+	if approve {
+		if isPending {
+			e.approved[address] = pending.Fingerprint
+		}
+	} else if isPending && isApproved {
+		// Rejects the new key an approved OR queued with, keeping the old one
+		return nil
+	} else {
+		delete(e.approved, address)
+	}
+	return e.save()
+}
+
+// Drops queued ORs that gave up registering. Caller must hold the
+// enrollments lock.
+func (e *Enrollments) expirePending() {
+	for address, pending := range e.pending {
+		if time.Since(pending.LastAttempt) > pendingEnrollmentTTL {
+			delete(e.pending, address)
+		}
+	}
+}
+
+// Enrollment files list one approved ip:port and key fingerprint per line;
+// blank lines and lines starting with # are ignored. A line without a
+// fingerprint takes the key the OR next registers with. A missing file starts
+// an empty list.
+func loadEnrollments(path string) error {
+	enrollments.path = path
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		fingerprint := ""
+		if len(fields) > 1 {
+			fingerprint = fields[1]
+		}
+		enrollments.approved[canonical(fields[0])] = fingerprint
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	util.OutLog.Printf("Loaded %d enrolled ORs\n", len(enrollments.approved))
+	return nil
+}
+
+// Caller must hold the enrollments lock.
+func (e *Enrollments) save() error {
+	if e.path == "" {
+		return nil
+	}
+
+	var lines []string
+	for address, fingerprint := range e.approved {
+		lines = append(lines, strings.TrimSpace(address+" "+fingerprint))
+	}
+	sort.Strings(lines)
+
+	data := "# Onion routers approved by the directory operator, and their key fingerprints\n" + strings.Join(lines, "\n") + "\n"
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.path)
+}
+
+// Lists the ORs whose enrollment waits for approval
+func (a *AdminServer) ListPendingNodes(req shared.AdminRequest, resp *[]shared.PendingRouter) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	enrollments.Lock()
+	defer enrollments.Unlock()
+
+	enrollments.expirePending()
+	pending := make([]shared.PendingRouter, 0, len(enrollments.pending))
+	for _, router := range enrollments.pending {
+		pending = append(pending, *router)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Address < pending[j].Address })
+
+	*resp = pending
+	return nil
+}
+
+// Enrolls a queued OR. It is listed after its next registration attempt.
+func (a *AdminServer) ApproveNode(req shared.AdminRequest, ack *bool) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	enrollments.Lock()
+	defer enrollments.Unlock()
+
+	address := canonical(req.Address)
+	if err := enrollments.decide(address, true); err != nil {
+		return err
+	}
+	util.OutLog.Printf("%s enrolled by admin with key %s\n", address, enrollments.approved[address])
+
+	*ack = true
+	return nil
+}
+
+// Turns down a queued OR, or revokes the approval of an enrolled one
+func (a *AdminServer) RejectNode(req shared.AdminRequest, ack *bool) error {
+	if err := a.authorize(req.Token); err != nil {
+		return err
+	}
+
+	address := canonical(req.Address)
+	enrollments.Lock()
+	err := enrollments.decide(address, false)
+	_, stillApproved := enrollments.approved[address]
+	enrollments.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if stillApproved {
+		util.OutLog.Printf("New key of %s rejected by admin\n", address)
+		*ack = true
+		return nil
+	}
+	activeORs.Lock()
+	removeOR(address)
+	activeORs.Unlock()
+	util.OutLog.Printf("%s rejected by admin\n", address)
+
+	*ack = true
+	return nil
+}
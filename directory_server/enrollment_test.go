@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"../shared"
+	"../util"
+)
+
+func resetEnrollments(token string, approval bool) {
+	enrollments.Lock()
+	enrollments.token, enrollments.approval, enrollments.path = token, approval, ""
+	enrollments.approved = make(map[string]string)
+	enrollments.pending = make(map[string]*shared.PendingRouter)
+	enrollments.Unlock()
+}
+
+func TestEnrollByToken(t *testing.T) {
+	defer resetEnrollments("", false)
+	key := &testRSAKey(t).PublicKey
+
+	resetEnrollments("", false)
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: key}); err != nil {
+		t.Fatalf("without enrollment an OR gave %v", err)
+	}
+
+	resetEnrollments("s3cret", false)
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: key}); err != enrollmentRequiredError {
+		t.Fatalf("an OR without the token gave %v, want %v", err, enrollmentRequiredError)
+	}
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: key, EnrollmentToken: "guess"}); err != badEnrollmentTokenError {
+		t.Fatalf("a wrong token gave %v, want %v", err, badEnrollmentTokenError)
+	}
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: key, EnrollmentToken: "s3cret"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnrollByApproval(t *testing.T) {
+	defer resetEnrollments("", false)
+	resetEnrollments("", true)
+	admin := &AdminServer{token: "admin"}
+	key := &testRSAKey(t).PublicKey
+	or := shared.OnionRouterInfo{PubKey: key, Contact: "ops@example.org"}
+
+	if err := enroll("127.0.0.1:8001", or); !shared.IsEnrollmentPendingError(err) {
+		t.Fatalf("a new OR gave %v, want it queued", err)
+	}
+	var pending []shared.PendingRouter
+	if err := admin.ListPendingNodes(shared.AdminRequest{Token: "admin"}, &pending); err != nil || len(pending) != 1 || pending[0].Contact != "ops@example.org" {
+		t.Fatalf("the queue is %+v, %v", pending, err)
+	}
+
+	var ack bool
+	if err := admin.ApproveNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8002"}, &ack); err != notPendingError {
+		t.Fatalf("approving an OR that never registered gave %v, want %v", err, notPendingError)
+	}
+	if err := admin.ApproveNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8001"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := enroll("127.0.0.1:8001", or); err != nil {
+		t.Fatalf("an approved OR gave %v", err)
+	}
+
+	// Rejecting revokes the approval and drops the OR
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {PubKey: key, Reachable: true}}
+	activeORs.Unlock()
+	if err := admin.RejectNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8001"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	activeORs.RLock()
+	_, listed := activeORs.all["127.0.0.1:8001"]
+	activeORs.RUnlock()
+	if listed || !shared.IsEnrollmentPendingError(enroll("127.0.0.1:8001", or)) {
+		t.Fatal("a rejected OR is still enrolled")
+	}
+}
+
+func TestEnrollmentFile(t *testing.T) {
+	defer resetEnrollments("", false)
+	resetEnrollments("", true)
+	path := filepath.Join(t.TempDir(), "enrollments.txt")
+	if err := os.WriteFile(path, []byte("# approved\n127.0.0.1:8001\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadEnrollments(path); err != nil {
+		t.Fatal(err)
+	}
+	first, second := &testRSAKey(t).PublicKey, &testRSAKey(t).PublicKey
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: first}); err != nil {
+		t.Fatalf("an OR listed in the file gave %v", err)
+	}
+	// A line without a fingerprint is pinned to the first key registered
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{PubKey: second}); !shared.IsEnrollmentPendingError(err) {
+		t.Fatalf("another key for a pinned OR gave %v, want it queued", err)
+	}
+
+	// Approvals are written back
+	enroll("127.0.0.1:8002", shared.OnionRouterInfo{PubKey: second})
+	var ack bool
+	if err := (&AdminServer{token: "admin"}).ApproveNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8002"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	want := "127.0.0.1:8001 " + util.Fingerprint(first) + "\n127.0.0.1:8002 " + util.Fingerprint(second) + "\n"
+	if err != nil || !strings.Contains(string(data), want) {
+		t.Fatalf("the file holds %q, %v", data, err)
+	}
+}
+
+func TestEnrollmentIsForAKey(t *testing.T) {
+	defer resetEnrollments("", false)
+	resetEnrollments("", true)
+	admin := &AdminServer{token: "admin"}
+	old, replacement := shared.OnionRouterInfo{PubKey: &testRSAKey(t).PublicKey}, shared.OnionRouterInfo{PubKey: &testRSAKey(t).PublicKey}
+
+	if err := enroll("127.0.0.1:8001", shared.OnionRouterInfo{}); err != missingRouterKeyError {
+		t.Fatalf("an OR without a key gave %v, want %v", err, missingRouterKeyError)
+	}
+	enroll("127.0.0.1:8001", old)
+	var ack bool
+	if err := admin.ApproveNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8001"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another key at the approved address waits for the admin
+	if err := enroll("127.0.0.1:8001", replacement); !shared.IsEnrollmentPendingError(err) {
+		t.Fatalf("a new key gave %v, want it queued", err)
+	}
+	if err := admin.RejectNode(shared.AdminRequest{Token: "admin", Address: "127.0.0.1:8001"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := enroll("127.0.0.1:8001", old); err != nil {
+		t.Fatalf("rejecting the new key revoked the old one: %v", err)
+	}
+
+	// Without the queue it is refused outright
+	enrollments.Lock()
+	enrollments.approval = false
+	enrollments.token = "s3cret"
+	enrollments.Unlock()
+	if err := enroll("127.0.0.1:8001", replacement); err != enrolledKeyError {
+		t.Fatalf("a new key gave %v, want %v", err, enrolledKeyError)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type GossipError error
+
+const (
+	// Failure gossip configurations
+	gossipReportInterval  time.Duration = 30 * time.Second // one report per reporter and router counts in this period
+	gossipRecheckInterval time.Duration = 30 * time.Second // a router that failed its recheck is tested again this often
+)
+
+var (
+	// Failure Gossip Errors
+	unknownReporterError    GossipError = errors.New("Failure report is from an OR that is not registered")
+	badGossipSignatureError GossipError = errors.New("Failure report signature does not verify with the reporter's registered key")
+	skewedGossipError       GossipError = errors.New("Failure report was signed too far from the directory server's time")
+	selfReportError         GossipError = errors.New("Onion routers can't report failures of their own")
+
+	// When each reporter last reported each router, by reporter and router address
+	gossipReports = struct {
+		sync.Mutex
+		last map[[2]string]time.Time
+	}{last: make(map[[2]string]time.Time)}
+)
+
+// Failure report from a router that repeatedly failed to reach a next hop.
+// Signed by the reporter and counted once per gossipReportInterval for each
+// reporter and router. Unlike anonymous reports to ReportFailure, it has
+// the directory recheck the router at once, and drop it from the consensus
+// while it fails, rather than wait for its heartbeats to time out.
+func (s *DServer) ReportRouterFailure(report shared.RouterFailureReport, ack *bool) error {
+	reporter := canonical(report.Reporter)
+	address := canonical(report.Report.Address)
+	if reporter == address {
+		return selfReportError
+	}
+
+	activeORs.RLock()
+	or, ok := activeORs.all[reporter]
+	if !ok {
+		activeORs.RUnlock()
+		return unknownReporterError
+	}
+	err := util.RSAVerify(or.PubKey, shared.RouterFailureSigningBytes(report), report.Signature)
+	activeORs.RUnlock()
+	if err != nil {
+		return badGossipSignatureError
+	}
+	if skew := time.Since(time.Unix(0, report.SignedAt)); skew > heartbeatMaxSkew || skew < -heartbeatMaxSkew {
+		return skewedGossipError
+	}
+
+	pair := [2]string{reporter, address}
+	gossipReports.Lock()
+	if since := time.Since(gossipReports.last[pair]); since < gossipReportInterval {
+		gossipReports.Unlock()
+		return shared.ThrottledError{Scope: "router", RetryAfter: gossipReportInterval - since}
+	}
+	gossipReports.last[pair] = time.Now()
+	expireGossip()
+	gossipReports.Unlock()
+
+	util.OutLog.Printf("%s failed to reach %s %d times in a row\n", reporter, address, report.Failures)
+	recordFailure(shared.FailureReport{Address: address, Kind: shared.FailureUnreachable})
+	go recheckReachability(address)
+
+	*ack = true
+	return nil
+}
+
+// Forgets reports older than gossipReportInterval.
+// Caller must hold the gossipReports lock.
+func expireGossip() {
+	for pair, at := range gossipReports.last {
+		if time.Since(at) >= gossipReportInterval {
+			delete(gossipReports.last, pair)
+		}
+	}
+}
+
+// Dials a reported router back. While it fails the handshake it is left out
+// of the consensus and tested again every gossipRecheckInterval, until it
+// passes or its heartbeats time out.
+func recheckReachability(orAddress string) {
+	activeORs.Lock()
+	or, ok := activeORs.all[orAddress]
+	if !ok || !or.Reachable || or.Rechecking {
+		activeORs.Unlock()
+		return
+	}
+	or.Rechecking = true
+	orPubKey := or.PubKey
+	activeORs.Unlock()
+
+	for {
+		err := handshake(orAddress, orPubKey)
+
+		activeORs.Lock()
+		or, ok := activeORs.all[orAddress]
+		if !ok || or.PubKey != orPubKey {
+			// timed out or registered again meanwhile
+			activeORs.Unlock()
+			return
+		}
+		if err == nil {
+			if !or.Reachable {
+				util.OutLog.Printf("%s passed its recheck, listing it again\n", orAddress)
+			}
+			or.Reachable = true
+			or.Rechecking = false
+			activeORs.Unlock()
+			return
+		}
+		if or.Reachable {
+			util.OutLog.Printf("%s failed its recheck, leaving it out of the consensus: %v\n", orAddress, err)
+		}
+		or.Reachable = false
+		activeORs.Unlock()
+
+		time.Sleep(gossipRecheckInterval)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func signedRouterFailure(t *testing.T, key *rsa.PrivateKey, report shared.RouterFailureReport) shared.RouterFailureReport {
+	signature, err := util.RSASign(key, shared.RouterFailureSigningBytes(report))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.Signature = signature
+	return report
+}
+
+func TestReportRouterFailure(t *testing.T) {
+	reporter, other := testRSAKey(t), testRSAKey(t)
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, PubKey: &reporter.PublicKey},
+		"127.0.0.1:8002": {Reachable: true, PubKey: &other.PublicKey},
+	}
+	activeORs.Unlock()
+	reputations.Lock()
+	reputations.all = make(map[string]*Reputation)
+	reputations.Unlock()
+	gossipReports.Lock()
+	gossipReports.last = make(map[[2]string]time.Time)
+	gossipReports.Unlock()
+
+	// Reports about a router that isn't listed don't start a recheck
+	report := shared.RouterFailureReport{
+		Reporter: "127.0.0.1:8001",
+		Report:   shared.FailureReport{Address: "127.0.0.1:8009", Kind: shared.FailureUnreachable},
+		Failures: 3,
+		SignedAt: time.Now().UnixNano(),
+	}
+	s := new(DServer)
+	var ack bool
+	if err := s.ReportRouterFailure(signedRouterFailure(t, reporter, report), &ack); err != nil || !ack {
+		t.Fatal(err)
+	}
+	if score := failureScore("127.0.0.1:8009"); score < 0.99 {
+		t.Fatalf("the reported router has score %v, want about 1", score)
+	}
+	if _, ok := shared.ParseThrottledError(s.ReportRouterFailure(signedRouterFailure(t, reporter, report), &ack)); !ok {
+		t.Fatal("a second report within the interval wasn't throttled")
+	}
+
+	unknown := report
+	unknown.Reporter = "127.0.0.1:8003"
+	self := report
+	self.Report.Address = "127.0.0.1:8001"
+	skewed := report
+	skewed.SignedAt = time.Now().Add(time.Hour).UnixNano()
+	for _, c := range []struct {
+		report shared.RouterFailureReport
+		want   error
+	}{
+		{signedRouterFailure(t, reporter, unknown), unknownReporterError},
+		{signedRouterFailure(t, reporter, self), selfReportError},
+		{signedRouterFailure(t, other, report), badGossipSignatureError},
+		{signedRouterFailure(t, reporter, skewed), skewedGossipError},
+	} {
+		if err := s.ReportRouterFailure(c.report, &ack); err != c.want {
+			t.Errorf("a report from %s about %s gave %v, want %v", c.report.Reporter, c.report.Report.Address, err, c.want)
+		}
+	}
+}
+
+func TestRecheckReachability(t *testing.T) {
+	key := testRSAKey(t)
+	orAddress := serveTestOR(t, &testOR{privKey: key})
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{orAddress: {Reachable: true, PubKey: &key.PublicKey}}
+	activeORs.Unlock()
+
+	// A router that still holds its key is listed on
+	recheckReachability(orAddress)
+	activeORs.RLock()
+	or := *activeORs.all[orAddress]
+	activeORs.RUnlock()
+	if !or.Reachable || or.Rechecking {
+		t.Fatalf("after passing its recheck the router is %+v", or)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"../util"
+)
+
+// The directory server is ready while it can hand out full circuits
+var healthChecks = []util.HealthCheck{
+	{Name: "consensus", Check: func() error {
+		activeORs.RLock()
+		defer activeORs.RUnlock()
+
+		usable := 0
+		for orAddress, or := range activeORs.all {
+			if or.Reachable && !isBlacklisted(orAddress) {
+				usable++
+			}
+		}
+		if usable < numHops {
+			return notEnoughORsError
+		}
+		return nil
+	}},
+}
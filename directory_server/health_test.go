@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestConsensusHealthCheck(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true},
+		"127.0.0.1:8002": {Reachable: true},
+		"127.0.0.1:8003": {},
+	}
+	activeORs.Unlock()
+	if err := healthChecks[0].Check(); err != notEnoughORsError {
+		t.Fatalf("two usable routers gave %v, want %v", err, notEnoughORsError)
+	}
+
+	activeORs.Lock()
+	activeORs.all["127.0.0.1:8003"].Reachable = true
+	activeORs.Unlock()
+	if err := healthChecks[0].Check(); err != nil {
+		t.Fatalf("three usable routers gave %v", err)
+	}
+}
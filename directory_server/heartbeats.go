@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type HeartbeatError error
+
+const (
+	// Heartbeat configurations
+	heartbeatMaxSkew time.Duration = 5 * time.Minute // signed heartbeats further off the directory's clock are refused
+)
+
+var (
+	// Heartbeat Errors
+	unsignedHeartbeatError     HeartbeatError = errors.New("Heartbeat is not signed, and this OR signs its heartbeats")
+	badHeartbeatSignatureError HeartbeatError = errors.New("Heartbeat signature does not verify with the OR's registered key")
+	replayedHeartbeatError     HeartbeatError = errors.New("Heartbeat is no later than one already accepted")
+	skewedHeartbeatError       HeartbeatError = errors.New("Heartbeat was signed too far from the directory server's time")
+
+	// -require-signed-heartbeats, refuses unsigned heartbeats from ORs from
+	// before signed heartbeats too
+	requireSignedHeartbeats bool
+)
+
+// Whether an OR must sign its heartbeats: those that registered with a
+// version that signs them, so nobody else can keep them listed, and all of
+// them with -require-signed-heartbeats.
+// Caller must hold the activeORs lock.
+func (or *OnionRouter) signsHeartbeats() bool {
+	return requireSignedHeartbeats || shared.SupportsFeature(or.ProtocolVersion, shared.FeatureSignedHeartbeats)
+}
+
+// Checks that a heartbeat was signed by or's registered key and is later than
+// the last one accepted, then remembers it as the last one.
+// Caller must hold the activeORs lock.
+func (or *OnionRouter) verifyHeartbeat(heartbeat shared.Heartbeat) error {
+	if len(heartbeat.Signature) == 0 {
+		if or.signsHeartbeats() {
+			return unsignedHeartbeatError
+		}
+		return nil
+	}
+	if err := util.RSAVerify(or.PubKey, shared.HeartbeatSigningBytes(heartbeat), heartbeat.Signature); err != nil {
+		return badHeartbeatSignatureError
+	}
+	if heartbeat.SignedAt <= or.LastHeartbeatSignedAt {
+		return replayedHeartbeatError
+	}
+	if skew := time.Since(time.Unix(0, heartbeat.SignedAt)); skew > heartbeatMaxSkew || skew < -heartbeatMaxSkew {
+		return skewedHeartbeatError
+	}
+
+	or.LastHeartbeatSignedAt = heartbeat.SignedAt
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func signedHeartbeat(t *testing.T, key *rsa.PrivateKey, heartbeat shared.Heartbeat) shared.Heartbeat {
+	signature, err := util.RSASign(key, shared.HeartbeatSigningBytes(heartbeat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	heartbeat.Signature = signature
+	return heartbeat
+}
+
+func TestSignedHeartbeats(t *testing.T) {
+	or, other := testRSAKey(t), testRSAKey(t)
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {Reachable: true, PubKey: &or.PublicKey, ProtocolVersion: shared.ProtocolVersion}}
+	activeORs.Unlock()
+
+	s := new(DServer)
+	var ack bool
+	now := time.Now().UnixNano()
+	heartbeat := shared.Heartbeat{Address: "127.0.0.1:8001", Bandwidth: 100, SignedAt: now}
+	if err := s.SendHeartbeat(signedHeartbeat(t, or, heartbeat), &ack); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		heartbeat shared.Heartbeat
+		want      error
+	}{
+		{heartbeat, unsignedHeartbeatError},
+		{signedHeartbeat(t, or, heartbeat), replayedHeartbeatError},
+		{signedHeartbeat(t, other, shared.Heartbeat{Address: "127.0.0.1:8001", SignedAt: now + 1}), badHeartbeatSignatureError},
+		{signedHeartbeat(t, or, shared.Heartbeat{Address: "127.0.0.1:8001", SignedAt: now + int64(time.Hour)}), skewedHeartbeatError},
+	} {
+		if err := s.SendHeartbeat(c.heartbeat, &ack); err != c.want {
+			t.Errorf("a heartbeat signed at %d gave %v, want %v", c.heartbeat.SignedAt, err, c.want)
+		}
+	}
+	if err := s.KeepNodeOnline("127.0.0.1:8001", &ack); err != unsignedHeartbeatError {
+		t.Fatalf("an unsigned keepalive gave %v, want %v", err, unsignedHeartbeatError)
+	}
+
+	// A bad heartbeat changes nothing
+	activeORs.RLock()
+	bandwidth := activeORs.all["127.0.0.1:8001"].Bandwidth
+	activeORs.RUnlock()
+	if bandwidth != 100 {
+		t.Fatalf("the OR's bandwidth is %d after refused heartbeats", bandwidth)
+	}
+}
+
+func TestUnsignedHeartbeatsFromOldRouters(t *testing.T) {
+	defer func() { requireSignedHeartbeats = false }()
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {Reachable: true, ProtocolVersion: 1}}
+	activeORs.Unlock()
+
+	var ack bool
+	if err := new(DServer).SendHeartbeat(shared.Heartbeat{Address: "127.0.0.1:8001"}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	requireSignedHeartbeats = true
+	if err := new(DServer).SendHeartbeat(shared.Heartbeat{Address: "127.0.0.1:8001"}, &ack); err != unsignedHeartbeatError {
+		t.Fatalf("with -require-signed-heartbeats an unsigned heartbeat gave %v, want %v", err, unsignedHeartbeatError)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"sort"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/faults"
+	"../util/secmem"
+)
+
+type MeasurementError error
+
+const (
+	// Bandwidth measurement configurations
+	measurementSize    int           = 256 << 10 // bytes sent each way through a router
+	measurementTimeout time.Duration = 30 * time.Second
+)
+
+var (
+	// Bandwidth Measurement Errors
+	shortMeasurementError MeasurementError = errors.New("Exit node answered the measurement with too few bytes")
+	measurementTimedOut   MeasurementError = errors.New("Measurement timed out")
+
+	measureInterval time.Duration = 10 * time.Minute // set by -measure-interval, 0 never measures
+)
+
+// A router to measure, as listed when a measurement round starts
+type measurable struct {
+	address   string
+	or        *OnionRouter
+	bandwidth uint64
+}
+
+// The bandwidth an OR is weighted by: as the directory measured it, or as
+// the OR reported it until it was measured
+func (or *OnionRouter) weightBandwidth() uint64 {
+	if or.Measured > 0 {
+		return or.Measured
+	}
+	return or.Bandwidth
+}
+
+// Every measureInterval, measures the bandwidth of every usable router that
+// answers measurements, one after another
+func measureBandwidths() {
+	for {
+		time.Sleep(measureInterval)
+
+		routers := measurableRouters()
+		for _, target := range routers {
+			helper, ok := measurementHelper(routers, target.address)
+			if !ok {
+				break
+			}
+			bandwidth, err := measure(target, helper)
+			if err != nil {
+				util.OutLog.Printf("Could not measure %s through %s: %v\n", target.address, helper.address, err)
+				continue
+			}
+
+			activeORs.Lock()
+			if or, ok := activeORs.all[target.address]; ok && or == target.or {
+				or.Measured = bandwidth
+			}
+			activeORs.Unlock()
+			util.OutLog.Printf("Measured %s at %d bytes/s through %s\n", target.address, bandwidth, helper.address)
+		}
+	}
+}
+
+// The reachable routers that answer measurements, sorted by address
+func measurableRouters() []measurable {
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	var routers []measurable
+	for orAddress, or := range activeORs.all {
+		if or.Reachable && !isBlacklisted(orAddress) && orInfo(orAddress, or).Offers(shared.CapabilityMeasurement) {
+			routers = append(routers, measurable{address: orAddress, or: or, bandwidth: or.weightBandwidth()})
+		}
+	}
+	sort.Slice(routers, func(i, j int) bool { return routers[i].address < routers[j].address })
+	return routers
+}
+
+// The fastest router besides the target, the exit of its test circuit, so the
+// circuit is only as slow as the target
+func measurementHelper(routers []measurable, target string) (measurable, bool) {
+	var helper measurable
+	found := false
+	for _, router := range routers {
+		if router.address != target && (!found || router.bandwidth > helper.bandwidth) {
+			helper, found = router, true
+		}
+	}
+	return helper, found
+}
+
+// One hop of a test circuit
+type testHop struct {
+	key       []byte
+	block     cipher.Block
+	circuitId uint32
+}
+
+// Builds a two hop circuit through target to helper, sends measurementSize
+// random bytes to helper and times how long they take to come back. Returns
+// the bytes per second through target, both ways.
+func measure(target, helper measurable) (uint64, error) {
+	conn, err := faults.DialTimeout("tcp", target.address, measurementTimeout)
+	if err != nil {
+		return 0, err
+	}
+	targetServer := rpc.NewClient(conn)
+	defer targetServer.Close()
+
+	entry, err := createTestHop(targetServer, target.or)
+	if err != nil {
+		return 0, err
+	}
+	defer secmem.Wipe(entry.key)
+	defer targetServer.Go("ORServer.DestroyCircuit", shared.DestroyNotice{CircuitId: entry.circuitId, Reason: shared.DestroyMeasurement, Token: shared.DestroyToken(entry.key)}, new(bool), nil)
+
+	conn, err = faults.DialTimeout("tcp", helper.address, measurementTimeout)
+	if err != nil {
+		return 0, err
+	}
+	helperServer := rpc.NewClient(conn)
+	exit, err := createTestHop(helperServer, helper.or)
+	helperServer.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer secmem.Wipe(exit.key)
+
+	req := shared.MeasureRequest{Data: make([]byte, measurementSize)}
+	if _, err := util.Random.Read(req.Data); err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(&req)
+	if err != nil {
+		return 0, err
+	}
+	inner, err := shared.SealBinaryOnion(exit.block, shared.Onion{IsExitNode: true, Command: shared.CommandMeasure, Data: payload}, util.Random)
+	if err != nil {
+		return 0, err
+	}
+	layer := shared.Onion{NextAddress: helper.address, NextCircuitId: exit.circuitId, Data: inner}
+	if shared.SupportsFeature(target.or.ProtocolVersion, shared.FeatureDestroyTokens) {
+		layer.DestroyToken = shared.DestroyToken(exit.key)
+	}
+	onion, err := shared.SealBinaryOnion(entry.block, layer, util.Random)
+	if err != nil {
+		return 0, err
+	}
+
+	started := time.Now()
+	var resp shared.PollingResponse
+	call := targetServer.Go("ORServer.DecryptPollingCell", shared.Cell{CircuitId: entry.circuitId, Data: onion}, &resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return 0, call.Error
+		}
+	case <-time.After(measurementTimeout):
+		return 0, measurementTimedOut
+	}
+	elapsed := time.Since(started)
+
+	if len(resp.Measurement) < measurementSize {
+		return 0, shortMeasurementError
+	}
+	return uint64(float64(len(onion)+len(resp.Measurement)) / elapsed.Seconds()), nil
+}
+
+// Sends a router a shared key for a new test circuit
+func createTestHop(orServer *rpc.Client, or *OnionRouter) (testHop, error) {
+	key := util.GenerateAESKey()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		secmem.Wipe(key)
+		return testHop{}, err
+	}
+	encryptedKey, err := util.RSAEncrypt(or.PubKey, key)
+	if err != nil {
+		secmem.Wipe(key)
+		return testHop{}, err
+	}
+
+	hop := testHop{key: key, block: block}
+	if err := orServer.Call("ORServer.CreateCircuit", shared.CircuitInfo{EncryptedSharedKey: encryptedKey}, &hop.circuitId); err != nil {
+		secmem.Wipe(key)
+		return testHop{}, err
+	}
+	return hop, nil
+}
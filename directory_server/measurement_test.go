@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestMeasuredBandwidthIsWeighted(t *testing.T) {
+	activeORs.Lock()
+	defer activeORs.Unlock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, Bandwidth: 100000, Measured: 100}, // reported far more than was measured
+		"127.0.0.1:8002": {Reachable: true, Bandwidth: 200},
+		"127.0.0.1:8003": {Reachable: true, Measured: 400},
+	}
+
+	if median := medianBandwidth(); median != 200 {
+		t.Fatalf("the median is %d, want 200", median)
+	}
+	if factor := bandwidthFactor("127.0.0.1:8001", 200); factor != 0.5 {
+		t.Fatalf("a router measured at half the median has factor %v, want 0.5", factor)
+	}
+}
+
+func TestMeasurableRouters(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8003": {Reachable: true, ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement, Bandwidth: 300},
+		"127.0.0.1:8001": {Reachable: true, ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement, Bandwidth: 100},
+		"127.0.0.1:8002": {Reachable: true, ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement, Measured: 900},
+		"127.0.0.1:8004": {Reachable: true, ProtocolVersion: 1, Bandwidth: 5000}, // doesn't answer measurements
+		"127.0.0.1:8005": {ProtocolVersion: shared.ProtocolVersion},
+	}
+	activeORs.Unlock()
+
+	routers := measurableRouters()
+	if len(routers) != 3 || routers[0].address != "127.0.0.1:8001" || routers[2].address != "127.0.0.1:8003" {
+		t.Fatalf("measurable routers are %+v", routers)
+	}
+
+	// The fastest other router is the exit, never the router measured
+	if helper, ok := measurementHelper(routers, "127.0.0.1:8001"); !ok || helper.address != "127.0.0.1:8002" {
+		t.Fatalf("measuring through %+v", helper)
+	}
+	if helper, ok := measurementHelper(routers, "127.0.0.1:8002"); !ok || helper.address != "127.0.0.1:8003" {
+		t.Fatalf("measuring the fastest router through %+v", helper)
+	}
+	if _, ok := measurementHelper(routers[:1], "127.0.0.1:8001"); ok {
+		t.Fatal("a lone router was given a helper")
+	}
+}
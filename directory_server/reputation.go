@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	// Reputation configurations
+	reputationHalfLife      time.Duration = 10 * time.Minute // failure scores halve over this period
+	maxFailureScore         float64       = 20               // caps the damage false reports can do
+	blacklistReloadInterval time.Duration = 10 * time.Second
+	failureReportInterval   time.Duration = 30 * time.Second // one anonymous report per source and router counts in this period
+)
+
+type ReputationError error
+
+// Failure history of a router, kept by address so it survives re-registration
+type Reputation struct {
+	FailureScore  float64
+	LastUpdated   time.Time
+	ReportsByKind map[string]int
+}
+
+type Reputations struct {
+	sync.Mutex
+	all map[string]*Reputation
+}
+
+// Operator-managed list of OR addresses excluded from every consensus
+type Blacklist struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	all     map[string]bool
+}
+
+var (
+	// Reputation Errors
+	unknownFailureKindError ReputationError = errors.New("Failure report is of a kind ReportFailure does not take")
+
+	// Kinds ReportFailure takes; FailureUnreachable comes only from signed
+	// reports to ReportRouterFailure
+	reportableKinds = map[string]bool{shared.FailureExtend: true, shared.FailureDecrypt: true, shared.FailureDroppedCircuit: true}
+
+	// When each source host last reported each router, by host and router address
+	failureReports = struct {
+		sync.Mutex
+		last map[[2]string]time.Time
+	}{last: make(map[[2]string]time.Time)}
+
+	reputations Reputations = Reputations{all: make(map[string]*Reputation)}
+	blacklist   Blacklist   = Blacklist{all: make(map[string]bool)}
+
+	// never put two ORs of one diversity subnet in a circuit; set by -distinct-subnets
+	distinctSubnets = true
+)
+
+// Anonymous failure report from an OP or OR, about a registered router.
+// Counted once per failureReportInterval for each source host and router, so
+// one source can't talk a router's score up to the cap.
+func (s *DServer) ReportFailure(report shared.FailureReport, ack *bool) error {
+	if !reportableKinds[report.Kind] {
+		return unknownFailureKindError
+	}
+	address := canonical(report.Address)
+	activeORs.RLock()
+	_, ok := activeORs.all[address]
+	activeORs.RUnlock()
+	if !ok {
+		return unregisteredAddrError
+	}
+
+	pair := [2]string{s.remoteHost, address}
+	failureReports.Lock()
+	if since := time.Since(failureReports.last[pair]); since < failureReportInterval {
+		failureReports.Unlock()
+		return shared.ThrottledError{Scope: "router", RetryAfter: failureReportInterval - since}
+	}
+	failureReports.last[pair] = time.Now()
+	expireFailureReports()
+	failureReports.Unlock()
+
+	recordFailure(shared.FailureReport{Address: address, Kind: report.Kind})
+	*ack = true
+	return nil
+}
+
+// Forgets reports older than failureReportInterval.
+// Caller must hold the failureReports lock.
+func expireFailureReports() {
+	for pair, at := range failureReports.last {
+		if time.Since(at) >= failureReportInterval {
+			delete(failureReports.last, pair)
+		}
+	}
+}
+
+// Adds a failure report to the reputation of the OR it is about
+func recordFailure(report shared.FailureReport) {
+	reputations.Lock()
+	defer reputations.Unlock()
+
+	address := canonical(report.Address)
+	rep, ok := reputations.all[address]
+	if !ok {
+		rep = &Reputation{ReportsByKind: make(map[string]int)}
+		reputations.all[address] = rep
+	}
+
+	rep.decay(time.Now())
+	rep.FailureScore = math.Min(rep.FailureScore+1, maxFailureScore)
+	rep.ReportsByKind[report.Kind]++
+
+	util.OutLog.Printf("Failure report for %s: %s (score %.2f)\n", address, report.Kind, rep.FailureScore)
+}
+
+func (rep *Reputation) decay(now time.Time) {
+	if !rep.LastUpdated.IsZero() {
+		halfLives := float64(now.Sub(rep.LastUpdated)) / float64(reputationHalfLife)
+		rep.FailureScore *= math.Pow(0.5, halfLives)
+	}
+	rep.LastUpdated = now
+}
+
+func failureScore(orAddress string) float64 {
+	reputations.Lock()
+	defer reputations.Unlock()
+
+	rep, ok := reputations.all[orAddress]
+	if !ok {
+		return 0
+	}
+	rep.decay(time.Now())
+
+	return rep.FailureScore
+}
+
+// Selection weight of a router: 1 for a router with no recent failures and
+// median bandwidth, less for failures, more or less for its bandwidth.
+// Caller must hold the activeORs lock.
+func selectionWeight(orAddress string, median uint64) float64 {
+	return bandwidthFactor(orAddress, median) / (1 + failureScore(orAddress))
+}
+
+// Picks n distinct addresses, each draw weighted by the router's reputation
+// and bandwidth. With distinctSubnets no two share a diversity subnet, so
+// fewer than n may be picked. Caller must hold the activeORs lock.
+func weightedSample(orAddresses []string, n int) []string {
+	median := medianBandwidth()
+	remaining := append([]string(nil), orAddresses...)
+	weights := make([]float64, len(remaining))
+	for i, orAddress := range remaining {
+		weights[i] = selectionWeight(orAddress, median)
+	}
+
+	var chosen []string
+	usedSubnets := make(map[string]bool)
+	for len(chosen) < n && len(remaining) > 0 {
+		total := 0.0
+		for _, w := range weights {
+			total += w
+		}
+
+		r := util.Random.Float64() * total
+		i := 0
+		for ; i < len(weights)-1 && r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+
+		chosen = append(chosen, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		weights = append(weights[:i], weights[i+1:]...)
+		if !distinctSubnets {
+			continue
+		}
+
+		for _, subnet := range orSubnets(chosen[len(chosen)-1]) {
+			usedSubnets[subnet] = true
+		}
+		for j := 0; j < len(remaining); j++ {
+			if sharesSubnet(orSubnets(remaining[j]), usedSubnets) {
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				weights = append(weights[:j], weights[j+1:]...)
+				j--
+			}
+		}
+	}
+
+	return chosen
+}
+
+// Diversity subnets of a registered OR's addresses. Caller must hold the
+// activeORs lock.
+func orSubnets(orAddress string) []string {
+	info := shared.OnionRouterInfo{Address: orAddress}
+	if or, ok := activeORs.all[orAddress]; ok {
+		info.AltAddresses = or.AltAddresses
+	}
+	return info.DiversitySubnets()
+}
+
+// The ORs besides exit that can share a circuit with it. Caller must hold the
+// activeORs lock.
+func withoutOR(orAddresses []string, exit string) []string {
+	exitSubnets := make(map[string]bool)
+	if distinctSubnets {
+		for _, subnet := range orSubnets(exit) {
+			exitSubnets[subnet] = true
+		}
+	}
+	var others []string
+	for _, orAddress := range orAddresses {
+		if orAddress != exit && !sharesSubnet(orSubnets(orAddress), exitSubnets) {
+			others = append(others, orAddress)
+		}
+	}
+	return others
+}
+
+func sharesSubnet(subnets []string, used map[string]bool) bool {
+	for _, subnet := range subnets {
+		if used[subnet] {
+			return true
+		}
+	}
+	return false
+}
+
+func isBlacklisted(orAddress string) bool {
+	blacklist.RLock()
+	defer blacklist.RUnlock()
+
+	return blacklist.all[orAddress]
+}
+
+// Reloads the blacklist file whenever it changes, so operators can edit it
+// without restarting the directory server.
+func watchBlacklist(path string) {
+	blacklist.path = path
+	for {
+		if err := reloadBlacklist(); err != nil {
+			printError(err)
+		}
+		time.Sleep(blacklistReloadInterval)
+	}
+}
+
+// Blacklist files list one ip:port per line; blank lines and lines starting with # are ignored
+func reloadBlacklist() error {
+	info, err := os.Stat(blacklist.path)
+	if err != nil {
+		return err
+	}
+
+	blacklist.RLock()
+	unchanged := info.ModTime().Equal(blacklist.modTime)
+	blacklist.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	file, err := os.Open(blacklist.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	all := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		all[canonical(line)] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	blacklist.Lock()
+	blacklist.all = all
+	blacklist.modTime = info.ModTime()
+	blacklist.Unlock()
+
+	util.OutLog.Printf("Loaded blacklist with %d ORs\n", len(all))
+	return nil
+}
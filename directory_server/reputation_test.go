@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func TestFailureScoresDecayAndCap(t *testing.T) {
+	const address = "127.0.0.1:9001"
+	reputations.Lock()
+	delete(reputations.all, address)
+	reputations.Unlock()
+
+	for i := 0; i < 2*int(maxFailureScore); i++ {
+		recordFailure(shared.FailureReport{Address: address, Kind: shared.FailureExtend})
+	}
+	reputations.Lock()
+	rep := reputations.all[address]
+	score, reports := rep.FailureScore, rep.ReportsByKind[shared.FailureExtend]
+	reputations.Unlock()
+	if math.Abs(score-maxFailureScore) > 0.01 || reports != 2*int(maxFailureScore) {
+		t.Fatalf("score %.2f after %d reports, want %.0f", score, reports, maxFailureScore)
+	}
+
+	decayed := Reputation{FailureScore: 8, LastUpdated: time.Now().Add(-2 * reputationHalfLife)}
+	decayed.decay(time.Now())
+	if math.Abs(decayed.FailureScore-2) > 0.01 {
+		t.Fatalf("a score of 8 decayed to %.2f over two half lives, want 2", decayed.FailureScore)
+	}
+	if weight := selectionWeight("127.0.0.1:9002", 0); weight != 1 {
+		t.Fatalf("a router without reports has weight %v, want 1", weight)
+	}
+}
+
+func TestReportFailureChecks(t *testing.T) {
+	const address = "127.0.0.1:9006"
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{address: {}}
+	activeORs.Unlock()
+	reputations.Lock()
+	delete(reputations.all, address)
+	reputations.Unlock()
+	reports := func() int {
+		reputations.Lock()
+		defer reputations.Unlock()
+		if rep, ok := reputations.all[address]; ok {
+			return rep.ReportsByKind[shared.FailureExtend]
+		}
+		return 0
+	}
+
+	var ack bool
+	s := &DServer{remoteHost: "192.0.2.1"}
+	if err := s.ReportFailure(shared.FailureReport{Address: "127.0.0.1:9007", Kind: shared.FailureExtend}, &ack); err != unregisteredAddrError {
+		t.Fatalf("a report about an unregistered router gave %v, want %v", err, unregisteredAddrError)
+	}
+	for _, kind := range []string{"", "MADE_UP", shared.FailureUnreachable} {
+		if err := s.ReportFailure(shared.FailureReport{Address: address, Kind: kind}, &ack); err != unknownFailureKindError {
+			t.Fatalf("a report of kind %q gave %v, want %v", kind, err, unknownFailureKindError)
+		}
+	}
+
+	// One report per source and router counts
+	if err := s.ReportFailure(shared.FailureReport{Address: address, Kind: shared.FailureExtend}, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := shared.ParseThrottledError(s.ReportFailure(shared.FailureReport{Address: address, Kind: shared.FailureExtend}, &ack)); !ok || reports() != 1 {
+		t.Fatalf("a second report from one source counted, %d reports", reports())
+	}
+	other := &DServer{remoteHost: "192.0.2.2"}
+	if err := other.ReportFailure(shared.FailureReport{Address: address, Kind: shared.FailureExtend}, &ack); err != nil || reports() != 2 {
+		t.Fatalf("a report from another source gave %v, %d reports", err, reports())
+	}
+}
+
+func TestWeightedSampleFavoursReliableRouters(t *testing.T) {
+	const failing = "127.0.0.1:9003"
+	reputations.Lock()
+	reputations.all[failing] = &Reputation{FailureScore: maxFailureScore, LastUpdated: time.Now(), ReportsByKind: map[string]int{}}
+	reputations.Unlock()
+
+	addresses := []string{failing, "127.0.0.1:9004", "127.0.0.1:9005"}
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		chosen := weightedSample(addresses, 1)
+		if len(chosen) != 1 {
+			t.Fatalf("sampled %v", chosen)
+		}
+		if chosen[0] == failing {
+			picked++
+		}
+	}
+	// Its weight is 1/21 against 1 for each of the others, so about 2%
+	if picked > 100 {
+		t.Fatalf("a failing router was picked %d times in 1000", picked)
+	}
+	if all := weightedSample(addresses, 5); len(all) != len(addresses) {
+		t.Fatalf("sampling more than there are gave %v", all)
+	}
+}
+
+func TestBlacklistReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blacklist.txt")
+	if err := ioutil.WriteFile(path, []byte("# bad routers\n127.0.0.1:9006\n\n  127.0.0.1:9007  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	blacklist.path = path
+	defer func() {
+		blacklist.Lock()
+		blacklist.path, blacklist.modTime, blacklist.all = "", time.Time{}, make(map[string]bool)
+		blacklist.Unlock()
+	}()
+
+	if err := reloadBlacklist(); err != nil {
+		t.Fatal(err)
+	}
+	if !isBlacklisted("127.0.0.1:9006") || !isBlacklisted("127.0.0.1:9007") || isBlacklisted("# bad routers") {
+		t.Fatalf("loaded %v", blacklist.all)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("127.0.0.1:9008\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadBlacklist(); err != nil {
+		t.Fatal(err)
+	}
+	if isBlacklisted("127.0.0.1:9006") || !isBlacklisted("127.0.0.1:9008") {
+		t.Fatalf("the changed blacklist wasn't reloaded: %v", blacklist.all)
+	}
+}
+
+func TestWeightedSampleIsReproducible(t *testing.T) {
+	defer util.SetRandom(util.Random)
+	addresses := []string{"127.0.0.1:9011", "127.0.0.1:9012", "127.0.0.1:9013", "127.0.0.1:9014"}
+
+	util.SetRandom(util.NewSeededRNG(7))
+	first := weightedSample(addresses, 3)
+	util.SetRandom(util.NewSeededRNG(7))
+	second := weightedSample(addresses, 3)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("the same seed picked %v and %v", first, second)
+		}
+	}
+}
+
+func TestWeightedSampleDistinctSubnets(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"10.1.0.1:8001":      {},
+		"10.1.0.2:8001":      {},
+		"10.2.0.1:8001":      {AltAddresses: []string{"[2001:db8::1]:8001"}},
+		"[2001:db8::2]:8001": {},
+	}
+	addresses := []string{"10.1.0.1:8001", "10.1.0.2:8001", "10.2.0.1:8001", "[2001:db8::2]:8001"}
+	for i := 0; i < 100; i++ {
+		if chosen := weightedSample(addresses, 4); len(chosen) != 2 {
+			activeORs.Unlock()
+			t.Fatalf("sampled %v from two /16s and one /32", chosen)
+		}
+	}
+	activeORs.Unlock()
+}
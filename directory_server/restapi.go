@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type RESTAPIError error
+
+// REST API configurations
+const (
+	apiReadHeaderTimeout time.Duration = 10 * time.Second
+	apiNodePrefix        string        = "/v1/nodes/"
+)
+
+var (
+	// REST API Errors
+	badAPITokenError   RESTAPIError = errors.New("Invalid API token")
+	apiMethodError     RESTAPIError = errors.New("Only GET is supported")
+	invalidUsableError RESTAPIError = errors.New("usable must be true or false")
+)
+
+// The consensus, node list and network statistics as JSON over HTTPS, beside
+// the net/rpc DServer, for dashboards, scripts and tools not written in Go.
+// Every request needs the API token as a bearer token.
+type restAPI struct {
+	token string
+}
+
+// Answer to a request the REST API refused
+type apiError struct {
+	Error string
+}
+
+// Serves the REST API and the dashboard on addr with the certificate in
+// certFile and keyFile, or a self-signed one if they are empty
+func startRESTAPI(addr string, token string, certFile string, keyFile string) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = util.SelfSignedCertificate()
+	}
+	util.HandleFatalError("Could not load REST API certificate", err)
+
+	api := &restAPI{token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/consensus", api.handle(serveConsensus))
+	mux.HandleFunc("/v1/nodes", api.handle(serveNodes))
+	mux.HandleFunc(apiNodePrefix, api.handle(serveNode))
+	mux.HandleFunc("/v1/stats", api.handle(serveStats))
+	mux.HandleFunc("/v1/status", api.handle(serveStatus))
+	mux.HandleFunc("/", serveDashboard)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+	util.OutLog.Printf("REST API available at https://%s/v1/ and the dashboard at https://%s/, certificate SHA-256 %s\n", addr, addr, util.CertificateFingerprint(cert))
+	util.HandleFatalError("REST API stopped", server.ListenAndServeTLS("", ""))
+}
+
+// Wraps a handler so it only gets GET requests with the API token
+func (api *restAPI) handle(handler func(r *http.Request) (int, interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIResponse(w, http.StatusUnauthorized, apiError{Error: badAPITokenError.Error()})
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIResponse(w, http.StatusMethodNotAllowed, apiError{Error: apiMethodError.Error()})
+			return
+		}
+		status, body := handler(r)
+		writeAPIResponse(w, status, body)
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /v1/consensus: what DServer.GetConsensus returns, with the signature
+// and key in standard encodings
+func serveConsensus(r *http.Request) (int, interface{}) {
+	consensus := signedConsensus()
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{consensus.SigR, consensus.SigS})
+	if err != nil {
+		return http.StatusInternalServerError, apiError{Error: err.Error()}
+	}
+	validitySignature, err := asn1.Marshal(struct{ R, S *big.Int }{consensus.ValiditySigR, consensus.ValiditySigS})
+	if err != nil {
+		return http.StatusInternalServerError, apiError{Error: err.Error()}
+	}
+	key, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return http.StatusInternalServerError, apiError{Error: err.Error()}
+	}
+
+	routers := consensus.ORInfos
+	if routers == nil {
+		routers = []shared.OnionRouterInfo{}
+	}
+	return http.StatusOK, shared.APIConsensus{
+		Routers:   routers,
+		Params:    consensus.Params,
+		Hash:      consensus.Hash,
+		Signature: signature,
+		PubKey:    key,
+
+		ValidAfter:        consensus.ValidAfter,
+		ValidUntil:        consensus.ValidUntil,
+		ValiditySignature: validitySignature,
+	}
+}
+
+// GET /v1/nodes[?usable=true]: every registered OR like AdminServer.ListNodes,
+// or only the usable ones like DumpConsensus
+func serveNodes(r *http.Request) (int, interface{}) {
+	usableOnly := false
+	if usable := r.URL.Query().Get("usable"); usable != "" {
+		var err error
+		if usableOnly, err = strconv.ParseBool(usable); err != nil {
+			return http.StatusBadRequest, apiError{Error: invalidUsableError.Error()}
+		}
+	}
+	return http.StatusOK, routerStatuses(usableOnly)
+}
+
+// GET /v1/nodes/<ip:port>: one registered OR
+func serveNode(r *http.Request) (int, interface{}) {
+	address := canonical(strings.TrimPrefix(r.URL.Path, apiNodePrefix))
+	for _, status := range routerStatuses(false) {
+		if status.Address == address {
+			return http.StatusOK, status
+		}
+	}
+	return http.StatusNotFound, apiError{Error: unregisteredAddrError.Error()}
+}
+
+// GET /v1/stats
+func serveStats(r *http.Request) (int, interface{}) {
+	return http.StatusOK, networkStats()
+}
+
+func networkStats() shared.NetworkStats {
+	now := time.Now()
+	stats := shared.NetworkStats{
+		Time:              now,
+		Versions:          make(map[int]int),
+		ChatServers:       len(advertisedChatServers()),
+		HeartbeatInterval: time.Duration(getHeartBeatInterval()) * time.Second,
+	}
+
+	enrollments.Lock()
+	stats.PendingEnrollment = len(enrollments.pending)
+	enrollments.Unlock()
+
+	activeORs.RLock()
+	defer activeORs.RUnlock()
+
+	threshold := stableThreshold(now)
+	stats.MedianBandwidth = medianBandwidth()
+	for orAddress, or := range activeORs.all {
+		stats.Registered++
+		if !inConsensus(orAddress, or) {
+			continue
+		}
+		stats.InConsensus++
+		if isStable(orAddress, threshold, now) {
+			stats.Stable++
+		}
+		if or.ExitStreams {
+			stats.StreamExits++
+		}
+		stats.Bandwidth += or.Bandwidth
+		stats.Measured += or.Measured
+		stats.Versions[or.ProtocolVersion]++
+	}
+	return stats
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"../shared"
+)
+
+// Serves the REST API with token "secret" without TLS
+func serveTestAPI(t *testing.T) *httptest.Server {
+	api := &restAPI{token: "secret"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/consensus", api.handle(serveConsensus))
+	mux.HandleFunc("/v1/nodes", api.handle(serveNodes))
+	mux.HandleFunc(apiNodePrefix, api.handle(serveNode))
+	mux.HandleFunc("/v1/stats", api.handle(serveStats))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// GETs path with token, decoding the answer into v
+func getAPI(t *testing.T, server *httptest.Server, method string, path string, token string, v interface{}) int {
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestRESTAPIAuthentication(t *testing.T) {
+	server := serveTestAPI(t)
+	var refused apiError
+	for _, token := range []string{"", "wrong", "secret2"} {
+		if status := getAPI(t, server, http.MethodGet, "/v1/stats", token, &refused); status != http.StatusUnauthorized || refused.Error != badAPITokenError.Error() {
+			t.Fatalf("token %q gave %d, %+v", token, status, refused)
+		}
+	}
+	if status := getAPI(t, server, http.MethodPost, "/v1/stats", "secret", &refused); status != http.StatusMethodNotAllowed {
+		t.Fatalf("a POST gave %d", status)
+	}
+}
+
+func TestRESTAPINodes(t *testing.T) {
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true, Bandwidth: 100, ProtocolVersion: shared.ProtocolVersion},
+		"127.0.0.1:8002": {Bandwidth: 50},
+	}
+	startTestRuns()
+	activeORs.Unlock()
+	server := serveTestAPI(t)
+
+	var nodes []shared.RouterStatus
+	if status := getAPI(t, server, http.MethodGet, "/v1/nodes", "secret", &nodes); status != http.StatusOK || len(nodes) != 2 {
+		t.Fatalf("the nodes are %d, %+v", status, nodes)
+	}
+	if status := getAPI(t, server, http.MethodGet, "/v1/nodes?usable=true", "secret", &nodes); status != http.StatusOK || len(nodes) != 1 || nodes[0].Address != "127.0.0.1:8001" {
+		t.Fatalf("the usable nodes are %d, %+v", status, nodes)
+	}
+	if status := getAPI(t, server, http.MethodGet, "/v1/nodes?usable=maybe", "secret", nil); status != http.StatusBadRequest {
+		t.Fatalf("an invalid usable gave %d", status)
+	}
+
+	var node shared.RouterStatus
+	if status := getAPI(t, server, http.MethodGet, "/v1/nodes/127.0.0.1:8002", "secret", &node); status != http.StatusOK || node.Bandwidth != 50 {
+		t.Fatalf("the node is %d, %+v", status, node)
+	}
+	if status := getAPI(t, server, http.MethodGet, "/v1/nodes/127.0.0.1:8009", "secret", nil); status != http.StatusNotFound {
+		t.Fatalf("an unregistered node gave %d", status)
+	}
+
+	var stats shared.NetworkStats
+	if status := getAPI(t, server, http.MethodGet, "/v1/stats", "secret", &stats); status != http.StatusOK {
+		t.Fatalf("the stats gave %d", status)
+	}
+	if stats.Registered != 2 || stats.InConsensus != 1 || stats.Bandwidth != 100 || stats.Versions[shared.ProtocolVersion] != 1 {
+		t.Fatalf("the stats are %+v", stats)
+	}
+}
+
+func TestRESTAPIConsensus(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{"127.0.0.1:8001": {Reachable: true}}
+	activeORs.Unlock()
+
+	var consensus shared.APIConsensus
+	if status := getAPI(t, serveTestAPI(t), http.MethodGet, "/v1/consensus", "secret", &consensus); status != http.StatusOK || len(consensus.Routers) != 1 {
+		t.Fatalf("the consensus is %d, %+v", status, consensus)
+	}
+
+	// The signature checks out with nothing but the standard encodings
+	key, err := x509.ParsePKIXPublicKey(consensus.PubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := shared.ConsensusHash(consensus.Routers, consensus.Params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), hash, consensus.Signature) {
+		t.Fatal("the consensus signature doesn't verify")
+	}
+	validity := shared.ConsensusValidityHash(hash, consensus.ValidAfter, consensus.ValidUntil)
+	if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), validity, consensus.ValiditySignature) {
+		t.Fatal("the validity signature doesn't verify")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Stability configurations
+	uptimeHalfLife    time.Duration = 24 * time.Hour // finished runs count half as much after this period
+	defaultStableMTBF time.Duration = time.Hour
+)
+
+// Run history of a router, kept by address so it survives re-registration.
+// A run lasts from registering to the last heartbeat before the OR timed out
+// or was expired.
+type Uptime struct {
+	RunStarted    time.Time // zero while the OR isn't registered
+	WeightedRuns  float64   // decayed number of finished runs
+	WeightedTotal float64   // decayed total length of finished runs, in seconds
+	LastDecayed   time.Time
+}
+
+type Uptimes struct {
+	sync.Mutex
+	all map[string]*Uptime
+}
+
+var (
+	uptimes Uptimes = Uptimes{all: make(map[string]*Uptime)}
+
+	// ORs with a mean time between failures this long are always Stable; set by -stable-mtbf
+	stableMTBF = defaultStableMTBF
+)
+
+// Starts a run of the OR at address, unless one is going on already
+func startRun(address string, now time.Time) {
+	uptimes.Lock()
+	defer uptimes.Unlock()
+
+	up, ok := uptimes.all[address]
+	if !ok {
+		up = &Uptime{}
+		uptimes.all[address] = up
+	}
+	if up.RunStarted.IsZero() {
+		up.RunStarted = now
+	}
+}
+
+// Ends the run of the OR at address at its last heartbeat
+func endRun(address string, lastHeartbeat time.Time) {
+	uptimes.Lock()
+	defer uptimes.Unlock()
+
+	up, ok := uptimes.all[address]
+	if !ok || up.RunStarted.IsZero() {
+		return
+	}
+	up.decay(lastHeartbeat)
+	if run := lastHeartbeat.Sub(up.RunStarted); run > 0 {
+		up.WeightedTotal += run.Seconds()
+	}
+	up.WeightedRuns++
+	up.RunStarted = time.Time{}
+}
+
+func (up *Uptime) decay(now time.Time) {
+	if !up.LastDecayed.IsZero() && now.After(up.LastDecayed) {
+		factor := math.Pow(0.5, float64(now.Sub(up.LastDecayed))/float64(uptimeHalfLife))
+		up.WeightedRuns *= factor
+		up.WeightedTotal *= factor
+	}
+	up.LastDecayed = now
+}
+
+// Weighted mean time between failures of the OR at address, counting the
+// run going on as if it ended now; 0 for ORs never seen
+func mtbf(address string, now time.Time) time.Duration {
+	uptimes.Lock()
+	defer uptimes.Unlock()
+
+	up, ok := uptimes.all[address]
+	if !ok {
+		return 0
+	}
+	up.decay(now)
+	runs, total := up.WeightedRuns, up.WeightedTotal
+	if !up.RunStarted.IsZero() {
+		runs++
+		total += now.Sub(up.RunStarted).Seconds()
+	}
+	if runs == 0 {
+		return 0
+	}
+	return time.Duration(total / runs * float64(time.Second))
+}
+
+// The MTBF an OR needs to be Stable: stableMTBF, or the median MTBF of the
+// usable ORs if that is lower, so a young network still has Stable ORs.
+// Caller must hold the activeORs lock.
+func stableThreshold(now time.Time) time.Duration {
+	var all []time.Duration
+	for orAddress, or := range activeORs.all {
+		if or.Reachable && !isBlacklisted(orAddress) {
+			all = append(all, mtbf(orAddress, now))
+		}
+	}
+	if len(all) == 0 {
+		return stableMTBF
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	if median := all[len(all)/2]; median < stableMTBF {
+		return median
+	}
+	return stableMTBF
+}
+
+// Whether the OR at address is Stable, fit for the guard position and long
+// lived circuits
+func isStable(address string, threshold time.Duration, now time.Time) bool {
+	m := mtbf(address, now)
+	return m > 0 && m >= threshold
+}
+
+// Drops an OR from the directory, ending its run.
+// Caller must hold the activeORs lock.
+func removeOR(address string) {
+	if or, ok := activeORs.all[address]; ok {
+		endRun(address, time.Unix(or.MostRecentHeartBeat, 0))
+		delete(activeORs.all, address)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Starts a run a minute ago for every OR in activeORs, as registering does.
+// Caller must hold the activeORs lock.
+func startTestRuns() {
+	uptimes.Lock()
+	uptimes.all = make(map[string]*Uptime)
+	uptimes.Unlock()
+	started := time.Now().Add(-time.Minute)
+	for orAddress := range activeORs.all {
+		startRun(orAddress, started)
+	}
+}
+
+func TestMTBF(t *testing.T) {
+	uptimes.Lock()
+	uptimes.all = make(map[string]*Uptime)
+	uptimes.Unlock()
+	start := time.Now().Add(-3 * time.Hour)
+
+	if m := mtbf("127.0.0.1:8001", start); m != 0 {
+		t.Fatalf("an OR never seen has MTBF %v", m)
+	}
+	startRun("127.0.0.1:8001", start)
+	startRun("127.0.0.1:8001", start.Add(time.Hour)) // still the same run
+	endRun("127.0.0.1:8001", start.Add(2*time.Hour))
+	if m := mtbf("127.0.0.1:8001", start.Add(2*time.Hour)); m != 2*time.Hour {
+		t.Fatalf("after one run of 2h the MTBF is %v", m)
+	}
+
+	// The run going on counts as if it ended now
+	startRun("127.0.0.1:8001", start.Add(2*time.Hour))
+	if m := mtbf("127.0.0.1:8001", start.Add(2*time.Hour)); m != time.Hour {
+		t.Fatalf("after a run of 2h and one just started the MTBF is %v, want 1h", m)
+	}
+
+	// Finished runs count half after uptimeHalfLife
+	later := start.Add(2*time.Hour + uptimeHalfLife)
+	endRun("127.0.0.1:8001", later)
+	if m, want := mtbf("127.0.0.1:8001", later), (time.Hour+uptimeHalfLife)*2/3; m < want-time.Second || m > want+time.Second {
+		t.Fatalf("the decayed MTBF is %v, want %v", m, want)
+	}
+}
+
+func TestStableThreshold(t *testing.T) {
+	defer func() { stableMTBF = defaultStableMTBF }()
+	activeORs.Lock()
+	defer activeORs.Unlock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {Reachable: true},
+		"127.0.0.1:8002": {Reachable: true},
+		"127.0.0.1:8003": {Reachable: true},
+	}
+	uptimes.Lock()
+	uptimes.all = make(map[string]*Uptime)
+	uptimes.Unlock()
+	now := time.Now()
+	startRun("127.0.0.1:8001", now.Add(-10*time.Minute))
+	startRun("127.0.0.1:8002", now.Add(-20*time.Minute))
+	startRun("127.0.0.1:8003", now.Add(-2*time.Hour))
+
+	// A young network has Stable ORs from its median
+	threshold := stableThreshold(now)
+	if threshold != 20*time.Minute || isStable("127.0.0.1:8001", threshold, now) || !isStable("127.0.0.1:8002", threshold, now) {
+		t.Fatalf("the threshold is %v", threshold)
+	}
+	stableMTBF = 5 * time.Minute
+	if threshold = stableThreshold(now); threshold != stableMTBF || !isStable("127.0.0.1:8001", threshold, now) {
+		t.Fatalf("with -stable-mtbf 5m the threshold is %v", threshold)
+	}
+	if isStable("127.0.0.1:8009", 0, now) {
+		t.Fatal("an OR never seen is Stable")
+	}
+}
+
+func TestGetNodesStartsAtStableRouter(t *testing.T) {
+	var err error
+	if privKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	pubKey = privKey.PublicKey
+	key := &testRSAKey(t).PublicKey
+	activeORs.Lock()
+	activeORs.all = map[string]*OnionRouter{
+		"127.0.0.1:8001": {PubKey: key, Reachable: true},
+		"127.0.0.1:8002": {PubKey: key, Reachable: true},
+		"127.0.0.1:8003": {PubKey: key, Reachable: true},
+		"127.0.0.1:8004": {PubKey: key, Reachable: true},
+	}
+	uptimes.Lock()
+	uptimes.all = make(map[string]*Uptime)
+	uptimes.Unlock()
+	now := time.Now()
+	startRun("127.0.0.1:8001", now.Add(-3*time.Hour))
+	startRun("127.0.0.1:8002", now.Add(-2*time.Hour))
+	startRun("127.0.0.1:8003", now.Add(-time.Minute))
+	startRun("127.0.0.1:8004", now.Add(-time.Minute))
+	activeORs.Unlock()
+
+	var orSet shared.OnionRouterInfos
+	for i := 0; i < 10; i++ {
+		if err = new(DServer).GetNodes(shared.CircuitRequest{}, &orSet); err != nil {
+			t.Fatal(err)
+		}
+		if guard := orSet.ORInfos[0]; !guard.Stable {
+			t.Fatalf("the circuit starts at %+v", guard)
+		}
+	}
+	// Only the two Stable ORs are left for a long lived circuit
+	if err = new(DServer).GetNodes(shared.CircuitRequest{Stable: true}, &orSet); err != notEnoughORsError {
+		t.Fatalf("a Stable circuit from two Stable ORs gave %v, want %v", err, notEnoughORsError)
+	}
+}
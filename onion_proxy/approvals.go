@@ -0,0 +1,34 @@
+package main
+
+import (
+	"../shared"
+	"../util"
+)
+
+// Asks req.Contact to approve the session's user, or approves or declines
+// them. Users asked or accepted are added to the roster, if the proxy keeps
+// one.
+func (s *OPServer) ChangeContact(req shared.ContactRequest, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+
+	req.IRCServerAddr = s.OnionProxy.ircServerAddr
+	req.Namespace = s.OnionProxy.namespace
+	req.Username = username
+	req.UserToken = userToken
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandContactRequest, req); err != nil {
+		return err
+	}
+
+	if s.OnionProxy.roster != nil && req.Action != shared.ContactDeclined {
+		var added bool
+		if err := s.AddContact(shared.Contact{Username: req.Contact}, &added); err != nil {
+			util.HandleNonFatalError("Could not add contact to roster", err)
+		}
+	}
+	*ack = true
+	return nil
+}
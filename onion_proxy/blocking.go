@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+
+	"../shared"
+)
+
+// Blocks username on the default chat server, which stops delivering what
+// they send to the session user's inbox. Their channel messages are hidden
+// from now on.
+func (s *OPServer) BlockUser(username string, ack *bool) error {
+	return s.OnionProxy.changeBlock(s.session(), username, false, ack)
+}
+
+func (s *OPServer) UnblockUser(username string, ack *bool) error {
+	return s.OnionProxy.changeBlock(s.session(), username, true, ack)
+}
+
+// Returns the users the session user blocked, as of the last poll
+func (s *OPServer) GetBlocked(_ignored bool, resp *[]string) error {
+	sess := s.session()
+	sess.Lock()
+	defer sess.Unlock()
+
+	blocked := make([]string, 0, len(sess.blocked))
+	for username := range sess.blocked {
+		blocked = append(blocked, username)
+	}
+	sort.Strings(blocked)
+	*resp = blocked
+	return nil
+}
+
+func (op *OnionProxy) changeBlock(sess *session, username string, unblock bool, ack *bool) error {
+	self, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+
+	req := shared.BlockRequest{
+		IRCServerAddr: op.ircServerAddr,
+		Namespace:     op.namespace,
+		Username:      self,
+		UserToken:     userToken,
+		Blocked:       username,
+		Unblock:       unblock,
+	}
+	if err := op.sendCommand(op.purposeFor(sess, controlCircuit), shared.CommandBlockUser, req); err != nil {
+		return err
+	}
+
+	// The next poll brings the list as the chat server has it
+	sess.Lock()
+	if unblock {
+		delete(sess.blocked, username)
+	} else {
+		sess.blocked[username] = true
+	}
+	sess.Unlock()
+	*ack = true
+	return nil
+}
+
+// Replaces the session's block list with the one the default chat server
+// sent in a poll. Caller must hold the session lock.
+func (sess *session) setBlocked(usernames []string) {
+	sess.blocked = make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		sess.blocked[username] = true
+	}
+}
+
+func (sess *session) hides(username string) bool {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.blocked[username]
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"../shared"
+	"../util/transport"
+)
+
+// -bridge values: how to reach ORs whose transport addresses were shared out
+// of band instead of through the directory, by OR address
+type bridgeLinks map[string]bridgeLink
+
+type bridgeLink struct {
+	transport string
+	address   string
+}
+
+func (b bridgeLinks) String() string {
+	var pairs []string
+	for orAddr, link := range b {
+		pairs = append(pairs, orAddr+"="+link.transport+":"+link.address)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Parses or-ip:port=transport:address, as a router logs it on startup
+func (b bridgeLinks) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected or-ip:port=transport:address, got %q", value)
+	}
+	link := strings.SplitN(kv[1], ":", 2)
+	if len(link) != 2 || link[1] == "" {
+		return fmt.Errorf("expected transport:address, got %q", kv[1])
+	}
+	if _, err := transport.Lookup(link[0]); err != nil {
+		return err
+	}
+	orAddr, err := shared.CanonicalAddress(kv[0])
+	if err != nil {
+		return fmt.Errorf("invalid OR address %q: %s", kv[0], err)
+	}
+	b[orAddr] = bridgeLink{transport: link[0], address: link[1]}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestBridgeLinks(t *testing.T) {
+	bridges := make(bridgeLinks)
+	for _, value := range []string{"127.0.0.1:8001", "127.0.0.1:8001=obfs", "127.0.0.1:8001=quic:127.0.0.1:9001"} {
+		if err := bridges.Set(value); err == nil {
+			t.Fatalf("-bridge %s was accepted", value)
+		}
+	}
+	if err := bridges.Set("127.0.0.1:8001=obfs:127.0.0.1:9001#secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bridges.Set("[2001:DB8::1]:8001=obfs:[2001:db8::1]:9001#secret"); err != nil || bridges["[2001:db8::1]:8001"].transport != "obfs" {
+		t.Fatalf("an IPv6 bridge gave %v, %v", bridges, err)
+	}
+
+	// A bridge link wins over the directory's transports
+	op := &OnionProxy{transport: "ws", bridges: bridges}
+	info := shared.OnionRouterInfo{Address: "127.0.0.1:8001", Transports: map[string]string{"ws": "127.0.0.1:9002"}}
+	if name, addr := op.linkTo(info); name != "obfs" || addr != "127.0.0.1:9001#secret" {
+		t.Fatalf("linked over %s to %s", name, addr)
+	}
+}
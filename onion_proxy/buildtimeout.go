@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+type BuildTimeoutError error
+
+// Build timeout configurations
+const (
+	initialBuildTimeout time.Duration = 10 * time.Second // until enough builds were measured
+	minBuildTimeout     time.Duration = 500 * time.Millisecond
+	maxBuildTimeout     time.Duration = 60 * time.Second
+
+	// The cutoff is buildTimeoutMultiplier times the time in which
+	// buildTimeoutQuantile of the recent builds completed
+	buildTimeoutQuantile   float64 = 0.8
+	buildTimeoutMultiplier float64 = 2
+
+	buildTimeSamples    int = 100 // recent build times the cutoff is computed from
+	minBuildTimeSamples int = 10  // builds measured before the cutoff adapts
+	recentBuildOutcomes int = 20  // if more than half of these timed out, the cutoff backs off
+
+	maxBuildAttempts int = 3 // builds of one circuit before giving up on timeouts
+)
+
+var (
+	// Build Timeout Errors
+	buildTimeoutError BuildTimeoutError = errors.New("Circuit build took longer than the build timeout")
+)
+
+// Times of recent circuit builds, from extending the first hop to the last,
+// and the cutoff after which a build is abandoned
+type buildTimes struct {
+	sync.Mutex
+	fixed    time.Duration   // from -build-timeout, 0 adapts
+	base     time.Duration   // cutoff while too few builds are measured
+	samples  []time.Duration // ring of the last buildTimeSamples build times
+	next     int
+	outcomes []bool // ring of the last recentBuildOutcomes builds, true if timed out
+	nextOut  int
+}
+
+func newBuildTimes(fixed time.Duration) *buildTimes {
+	return &buildTimes{fixed: fixed, base: initialBuildTimeout}
+}
+
+// The time a build may take before it is abandoned
+func (b *buildTimes) cutoff() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	return b.cutoffLocked()
+}
+
+// Caller must hold the buildTimes lock.
+func (b *buildTimes) cutoffLocked() time.Duration {
+	if b.fixed > 0 {
+		return b.fixed
+	}
+	if len(b.samples) < minBuildTimeSamples {
+		return b.base
+	}
+
+	sorted := append([]time.Duration(nil), b.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	quantile := sorted[int(float64(len(sorted)-1)*buildTimeoutQuantile)]
+
+	cutoff := time.Duration(float64(quantile) * buildTimeoutMultiplier)
+	if cutoff < minBuildTimeout {
+		cutoff = minBuildTimeout
+	}
+	if cutoff > maxBuildTimeout {
+		cutoff = maxBuildTimeout
+	}
+	return cutoff
+}
+
+// Records a build that completed in time
+func (b *buildTimes) recordSuccess(duration time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.samples) < buildTimeSamples {
+		b.samples = append(b.samples, duration)
+	} else {
+		b.samples[b.next] = duration
+		b.next = (b.next + 1) % buildTimeSamples
+	}
+	b.recordOutcome(false)
+}
+
+// Records an abandoned build. When most recent builds time out the network
+// itself got slower, so the measurements are dropped and the cutoff doubles
+// until builds have been measured again.
+func (b *buildTimes) recordTimeout() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.recordOutcome(true)
+	if b.fixed > 0 || len(b.outcomes) < recentBuildOutcomes {
+		return
+	}
+	timeouts := 0
+	for _, timedOut := range b.outcomes {
+		if timedOut {
+			timeouts++
+		}
+	}
+	if timeouts <= recentBuildOutcomes/2 {
+		return
+	}
+
+	b.base = 2 * b.cutoffLocked()
+	if b.base > maxBuildTimeout {
+		b.base = maxBuildTimeout
+	}
+	b.samples = nil
+	b.next = 0
+	b.outcomes = nil
+	b.nextOut = 0
+	util.ErrLog.Printf("[WARNING] Most circuit builds timed out, raising the build timeout to %v\n", b.base)
+}
+
+// Caller must hold the buildTimes lock.
+func (b *buildTimes) recordOutcome(timedOut bool) {
+	if len(b.outcomes) < recentBuildOutcomes {
+		b.outcomes = append(b.outcomes, timedOut)
+		return
+	}
+	b.outcomes[b.nextOut] = timedOut
+	b.nextOut = (b.nextOut + 1) % recentBuildOutcomes
+}
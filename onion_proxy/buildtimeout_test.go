@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBuildTimeoutAdapts(t *testing.T) {
+	if cutoff := newBuildTimes(3 * time.Second).cutoff(); cutoff != 3*time.Second {
+		t.Fatalf("a fixed build timeout gave %v", cutoff)
+	}
+
+	b := newBuildTimes(0)
+	for i := 0; i < minBuildTimeSamples-1; i++ {
+		b.recordSuccess(time.Second)
+	}
+	if cutoff := b.cutoff(); cutoff != initialBuildTimeout {
+		t.Fatalf("too few builds gave %v, want %v", cutoff, initialBuildTimeout)
+	}
+
+	// Twice the time 80% of the builds completed in
+	for i := 0; i < 10; i++ {
+		b.recordSuccess(time.Duration(i+1) * 100 * time.Millisecond)
+	}
+	if cutoff := b.cutoff(); cutoff != 2*time.Second {
+		t.Fatalf("measured builds gave %v, want 2s", cutoff)
+	}
+
+	fast := newBuildTimes(0)
+	for i := 0; i < minBuildTimeSamples; i++ {
+		fast.recordSuccess(time.Millisecond)
+	}
+	if cutoff := fast.cutoff(); cutoff != minBuildTimeout {
+		t.Fatalf("fast builds gave %v, want %v", cutoff, minBuildTimeout)
+	}
+}
+
+func TestBuildTimeoutBacksOff(t *testing.T) {
+	b := newBuildTimes(0)
+	for i := 0; i < minBuildTimeSamples; i++ {
+		b.recordSuccess(time.Second)
+	}
+	before := b.cutoff()
+
+	// A few timeouts don't move the cutoff
+	for i := 0; i < recentBuildOutcomes/2; i++ {
+		b.recordTimeout()
+	}
+	if cutoff := b.cutoff(); cutoff != before {
+		t.Fatalf("a few timeouts moved the cutoff to %v", cutoff)
+	}
+
+	// Most recent builds timing out doubles it until builds are measured again
+	for i := 0; i < recentBuildOutcomes; i++ {
+		b.recordTimeout()
+	}
+	if cutoff := b.cutoff(); cutoff < 2*before || cutoff > maxBuildTimeout || len(b.samples) != 0 {
+		t.Fatalf("mostly timeouts gave %v with %d samples, want at least %v", cutoff, len(b.samples), 2*before)
+	}
+}
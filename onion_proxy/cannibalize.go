@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"../util"
+)
+
+const (
+	// A circuit of one purpose unused for this long may also serve another
+	cannibalizeIdleTime time.Duration = 30 * time.Second
+)
+
+// Marks the circuit as carrying traffic
+func (c *circuit) touch() {
+	atomic.StoreInt64(&c.lastUsed, util.Time.Now().UnixNano())
+}
+
+// How long the circuit has carried no traffic
+func (c *circuit) idleFor() time.Duration {
+	return util.Time.Now().Sub(time.Unix(0, atomic.LoadInt64(&c.lastUsed)))
+}
+
+// Whether some purpose uses the circuit. Caller must hold the circuits lock.
+func (op *OnionProxy) circuitInUseLocked(circ *circuit) bool {
+	for _, c := range op.circuits {
+		if c == circ {
+			return true
+		}
+	}
+	return false
+}
+
+// Gives purpose a circuit from the pool instead of building one when an
+// exit that accepts every destination (and opens streams, if asked to) is
+// already in use: the spare first, else a circuit of another purpose that
+// has been idle for cannibalizeIdleTime and then serves both, if both have
+// the same isolation key. The spare never carried traffic, so it may become
+// any purpose's. Circuits older
+// than the longest rotation interval and exits that left the last consensus
+// aren't reused. Returns whether a circuit was found.
+func (op *OnionProxy) reuseCircuit(purpose string, destinations []string, streams bool) bool {
+	// Any circuit in use may share relays with the data circuit
+	if purpose == redundantCircuit {
+		return false
+	}
+	consensus, haveConsensus := op.consensusCache.latest()
+	maxAge := op.clientParams().MaxRotationInterval
+
+	usable := func(circ *circuit) bool {
+		if util.Time.Now().Sub(circ.builtAt) >= maxAge {
+			return false
+		}
+		for _, destination := range destinations {
+			if !circ.exitsTo(destination, streams) {
+				return false
+			}
+		}
+		return !haveConsensus || exitAllowed(consensus.ORInfos, circ.exitAddress(), destinations)
+	}
+
+	op.circuitsMutex.Lock()
+	current := op.circuits[purpose]
+
+	var found *circuit
+	var from string
+	if spare, ok := op.circuits[spareCircuit]; ok && purpose != spareCircuit && spare != current && usable(spare) {
+		found, from = spare, spareCircuit
+		found.purpose = purpose
+		delete(op.circuits, spareCircuit)
+	} else if basePurpose(purpose) != anonymousCircuit {
+		var others []string
+		for other := range op.circuits {
+			if other != purpose && other != spareCircuit && basePurpose(other) != anonymousCircuit && other != redundantCircuit && isolationKeyOf(other) == isolationKeyOf(purpose) {
+				others = append(others, other)
+			}
+		}
+		sort.Strings(others)
+		for _, other := range others {
+			circ := op.circuits[other]
+			if circ != current && circ.idleFor() >= cannibalizeIdleTime && usable(circ) {
+				found, from = circ, other
+				break
+			}
+		}
+	}
+	if found == nil {
+		op.circuitsMutex.Unlock()
+		return false
+	}
+	op.circuits[purpose] = found
+	op.circuitsMutex.Unlock()
+
+	util.OutLog.Printf("Reusing %s circuit %v through exit %s for %s\n", from, found.id, found.exitAddress(), purpose)
+	if current != nil {
+		op.retireCircuit(current)
+	}
+
+	// The spare is there to be taken, build the next one
+	if from == spareCircuit {
+		go func() {
+			if err := op.GetCircuitFromDServer(spareCircuit); err != nil {
+				util.HandleNonFatalError("Could not build spare circuit", err)
+			}
+		}()
+	}
+	return true
+}
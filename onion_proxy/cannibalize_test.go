@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func TestReuseIdleCircuit(t *testing.T) {
+	data := testCircuit(t)
+	op := &OnionProxy{
+		circuits:       map[string]*circuit{dataCircuit: data},
+		consensusCache: newConsensusCache(""),
+	}
+	destinations := []string{"1.2.3.4:6667"}
+
+	// A circuit in use isn't shared
+	data.touch()
+	if op.reuseCircuit(controlCircuit, destinations, false) {
+		t.Fatal("a busy circuit was reused")
+	}
+
+	data.lastUsed = util.Time.Now().Add(-cannibalizeIdleTime).UnixNano()
+	if op.reuseCircuit(controlCircuit, destinations, true) {
+		t.Fatal("a circuit whose exit opens no streams was reused for streams")
+	}
+	if !op.reuseCircuit(controlCircuit, destinations, false) || op.circuits[controlCircuit] != data || op.circuits[dataCircuit] != data {
+		t.Fatalf("the idle data circuit wasn't shared: %v", op.circuits)
+	}
+	op.circuitsMutex.RLock()
+	inUse := op.circuitInUseLocked(data)
+	op.circuitsMutex.RUnlock()
+	if !inUse {
+		t.Fatal("a shared circuit isn't in use")
+	}
+}
+
+func TestReuseChecksAgeAndConsensus(t *testing.T) {
+	data := testCircuit(t)
+	data.lastUsed = util.Time.Now().Add(-cannibalizeIdleTime).UnixNano()
+	op := &OnionProxy{
+		circuits:       map[string]*circuit{dataCircuit: data},
+		consensusCache: newConsensusCache(""),
+	}
+	destinations := []string{"1.2.3.4:6667"}
+
+	// Its exit left the consensus
+	op.consensusCache.store(shared.OnionRouterInfos{ORInfos: []shared.OnionRouterInfo{{Address: "127.0.0.1:8001"}}})
+	if op.reuseCircuit(controlCircuit, destinations, false) {
+		t.Fatal("a circuit whose exit left the consensus was reused")
+	}
+
+	op.consensusCache.store(shared.OnionRouterInfos{ORInfos: []shared.OnionRouterInfo{{Address: data.exitAddress()}}})
+	data.builtAt = util.Time.Now().Add(-op.clientParams().MaxRotationInterval - time.Second)
+	if op.reuseCircuit(controlCircuit, destinations, false) {
+		t.Fatal("a circuit due for rotation was reused")
+	}
+	data.builtAt = util.Time.Now()
+	if !op.reuseCircuit(controlCircuit, destinations, false) {
+		t.Fatal("a usable idle circuit wasn't reused")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+type UnknownChatServerError error
+
+var (
+	unknownChatServerError UnknownChatServerError = errors.New("The directory server does not advertise this chat server")
+)
+
+// Where polling a chat server besides the default one left off
+type pollCursor struct {
+	lastMessageId uint32
+	lastEventId   uint32
+	lastUpdateId  uint32
+	lastInboxId   uint32
+}
+
+// The chat server a channel's traffic goes to: the one it was homed on, or
+// the proxy's default
+func (op *OnionProxy) homeOf(sess *session, channel string) string {
+	if channel == "" {
+		channel = shared.DefaultChannel
+	}
+
+	sess.Lock()
+	defer sess.Unlock()
+
+	if address, ok := sess.homes[channel]; ok {
+		return address
+	}
+	return op.ircServerAddr
+}
+
+// The chat servers besides the default one the session has channels on,
+// sorted
+func (sess *session) otherServers() []string {
+	sess.Lock()
+	defer sess.Unlock()
+
+	servers := make([]string, 0, len(sess.cursors))
+	for address := range sess.cursors {
+		servers = append(servers, address)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// Every chat server some session has channels on, the default one first.
+// Chat circuits need an exit that accepts all of them.
+func (op *OnionProxy) chatDestinations() []string {
+	seen := map[string]bool{op.ircServerAddr: true}
+	var others []string
+
+	op.sessionsMutex.Lock()
+	for _, sess := range op.sessions {
+		for _, address := range sess.otherServers() {
+			if !seen[address] {
+				seen[address] = true
+				others = append(others, address)
+			}
+		}
+	}
+	op.sessionsMutex.Unlock()
+
+	sort.Strings(others)
+	return append([]string{op.ircServerAddr}, others...)
+}
+
+// Fetches the chat servers the directory server advertises
+func (op *OnionProxy) fetchChatServers() ([]shared.ChatServerInfo, error) {
+	var list shared.ChatServerList
+	if err := op.dirServer.Call("DServer.GetChatServers", true, &list); err != nil {
+		return nil, err
+	}
+	if !verifyChatServerList(list, directoryServerPubKey) {
+		return nil, notTrustedDirectoryServerError
+	}
+	return list.Servers, nil
+}
+
+// Picks the proxy's default chat server from the directory's list, for
+// proxies started without an IRC server address: the one named name, or the
+// first if name is empty. Retries for a while, as chat servers may still be
+// registering.
+func (op *OnionProxy) discoverChatServer(name string) (string, error) {
+	var address string
+	err := retry.Do(context.Background(), retry.Startup, func() error {
+		servers, err := op.fetchChatServers()
+		if err != nil {
+			return err
+		}
+		for _, server := range servers {
+			if name == "" || server.Name == name {
+				address = server.Address
+				return nil
+			}
+		}
+		return unknownChatServerError
+	})
+	return address, err
+}
+
+// Checks a chat server list like verifyORSet checks an OR list
+func verifyChatServerList(list shared.ChatServerList, trustedPubKey string) bool {
+	pub, ok := trustedDirectoryKey(list.PubKey, trustedPubKey)
+	if !ok || list.SigR == nil || list.SigS == nil {
+		return false
+	}
+
+	hash, err := shared.ChatServersHash(list.Servers)
+	if err != nil || string(hash) != string(list.Hash) {
+		return false
+	}
+
+	return ecdsa.Verify(pub, list.Hash, list.SigR, list.SigS)
+}
+
+// Returns the chat servers channels can be homed on
+func (s *OPServer) ListChatServers(_ignored bool, resp *[]shared.ChatServerInfo) error {
+	servers, err := s.OnionProxy.fetchChatServers()
+	if err != nil {
+		return err
+	}
+
+	*resp = servers
+	return nil
+}
+
+// Carries a channel's traffic to another advertised chat server from now on,
+// claiming the session's username there first. Only the exit node learns the
+// server, from the innermost onion layer; circuits whose exit doesn't accept
+// it are rebuilt.
+func (s *OPServer) HomeChannel(req shared.ChannelHome, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	op := s.OnionProxy
+	channel := req.Channel
+	if channel == "" {
+		channel = shared.DefaultChannel
+	}
+
+	address := op.ircServerAddr
+	if req.Server != "" && req.Server != op.ircServerAddr {
+		servers, err := op.fetchChatServers()
+		if err != nil {
+			return err
+		}
+		// A name rather than an address only matches by name
+		canonicalServer, err := shared.CanonicalAddress(req.Server)
+		if err != nil {
+			canonicalServer = ""
+		}
+		address = ""
+		for _, server := range servers {
+			if server.Name == req.Server || server.Address == canonicalServer {
+				address = server.Address
+			}
+		}
+		if address == "" {
+			return unknownChatServerError
+		}
+	}
+
+	sess.Lock()
+	_, known := sess.cursors[address]
+	sess.Unlock()
+
+	if address != op.ircServerAddr && !known {
+		sess.Lock()
+		sess.cursors[address] = &pollCursor{}
+		sess.Unlock()
+
+		err := op.ensureExitsTo(address)
+		if err == nil {
+			err = op.registerUserName(op.purposeFor(sess, controlCircuit), shared.UserNameRequest{
+				IRCServerAddr: address,
+				Namespace:     op.namespace,
+				Username:      username,
+				UserToken:     userToken,
+				SigningKey:    sess.signingPublicKey(),
+			})
+		}
+		if err != nil {
+			sess.Lock()
+			delete(sess.cursors, address)
+			sess.Unlock()
+			util.HandleNonFatalError("Could not home "+channel+" on "+address, err)
+			return err
+		}
+	}
+
+	sess.Lock()
+	if address == op.ircServerAddr {
+		delete(sess.homes, channel)
+	} else {
+		sess.homes[channel] = address
+	}
+	sess.forgetUnusedServers()
+	sess.Unlock()
+
+	util.OutLog.Printf("Channel %s homed on %s\n", channel, address)
+	*ack = true
+	return nil
+}
+
+// Drops the cursors of chat servers no channel is homed on anymore. Caller
+// must hold the session's lock.
+func (sess *session) forgetUnusedServers() {
+	used := make(map[string]bool)
+	for _, address := range sess.homes {
+		used[address] = true
+	}
+	for address := range sess.cursors {
+		if !used[address] {
+			delete(sess.cursors, address)
+		}
+	}
+}
+
+// Rebuilds the data and control circuits if their exit doesn't accept a
+// chat server that is now in use, and drops such isolated circuits
+func (op *OnionProxy) ensureExitsTo(address string) error {
+	if err := op.start(); err != nil {
+		return err
+	}
+	for _, purpose := range []string{dataCircuit, controlCircuit} {
+		op.circuitsMutex.RLock()
+		circ, ok := op.circuits[purpose]
+		op.circuitsMutex.RUnlock()
+
+		if ok && circ.exitsTo(address, false) {
+			continue
+		}
+		if op.reuseCircuit(purpose, op.chatDestinations(), false) {
+			continue
+		}
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			return err
+		}
+	}
+	op.dropIsolatedCircuits(func(circ *circuit) bool {
+		return !circ.exitsTo(address, false)
+	})
+	return nil
+}
+
+// Sends a polling message over circ and returns the whole response,
+// fetching the rest of a fragmented one
+func pollOver(circ *circuit, pollingMessage shared.PollingMessage) (shared.PollingResponse, error) {
+	pollingMessage.AcceptsFragments = circ.exitSupports(shared.FeatureFragmentation)
+
+	jsonData, err := json.Marshal(&pollingMessage)
+	if err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	onion, err := circ.OnionizeData(shared.CommandChatMessage, jsonData)
+	if err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	messages, err := circ.SendPollingOnion(onion)
+	if err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if messages.Fragment != nil {
+		return circ.fetchFragments(*messages.Fragment)
+	}
+	return messages, nil
+}
+
+// Polls every chat server besides the default one the session has channels
+// on and adds what they sent to resp. A server that can't be reached is
+// skipped until the next poll.
+func (op *OnionProxy) pollOtherServers(sess *session, circ *circuit, limit int, resp *shared.PollResult, unreadCounts map[string]int) {
+	for _, address := range sess.otherServers() {
+		sess.Lock()
+		cursor, ok := sess.cursors[address]
+		if !ok {
+			sess.Unlock()
+			continue
+		}
+		pollingMessage := shared.PollingMessage{
+			IRCServerAddr: address,
+			Namespace:     op.namespace,
+			Username:      sess.username,
+			UserToken:     sess.userToken,
+			LastMessageId: cursor.lastMessageId,
+			LastEventId:   cursor.lastEventId,
+			LastUpdateId:  cursor.lastUpdateId,
+			LastInboxId:   cursor.lastInboxId,
+			DeviceId:      sess.deviceId,
+			Limit:         limit,
+		}
+		sess.Unlock()
+
+		messages, err := pollOver(circ, pollingMessage)
+		if err != nil {
+			util.HandleNonFatalError("Could not retrieve new messages from "+address, err)
+			continue
+		}
+
+		sess.Lock()
+		*cursor = pollCursor{
+			lastMessageId: messages.NextMessageId,
+			lastEventId:   messages.NextEventId,
+			lastUpdateId:  messages.NextUpdateId,
+			lastInboxId:   messages.NextInboxId,
+		}
+		for i, message := range messages.Messages {
+			polled := shared.PolledMessage{Text: message}
+			if i < len(messages.MessageMeta) {
+				polled.MessageMeta = messages.MessageMeta[i]
+				sess.lastShown[polled.Channel] = polled.Id
+			}
+			if sess.blocked[polled.From] {
+				continue
+			}
+			resp.Messages = append(resp.Messages, polled)
+		}
+		sess.Unlock()
+
+		for channel, count := range messages.UnreadCounts {
+			unreadCounts[channel] = count
+		}
+		resp.Notices = append(resp.Notices, messages.Inbox...)
+		resp.Updates = append(resp.Updates, messages.Updates...)
+		for _, event := range messages.Events {
+			if event.Kind == shared.PresenceTyping && !sess.hides(event.Username) {
+				resp.Events = append(resp.Events, event)
+			}
+		}
+		resp.More = resp.More || messages.More
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"testing"
+
+	"../shared"
+)
+
+func TestChannelHomes(t *testing.T) {
+	op := &OnionProxy{ircServerAddr: "127.0.0.1:6667", sessions: make(map[string]*session)}
+	alice, bob := testSession(op, "alice"), testSession(op, "bob")
+	alice.homes["#ops"] = "127.0.0.1:6668"
+	alice.cursors["127.0.0.1:6668"] = &pollCursor{}
+	bob.homes["#dev"] = "127.0.0.1:6669"
+	bob.homes["#ops"] = "127.0.0.1:6668"
+	bob.cursors["127.0.0.1:6669"] = &pollCursor{}
+	bob.cursors["127.0.0.1:6668"] = &pollCursor{}
+
+	if home := op.homeOf(alice, "#ops"); home != "127.0.0.1:6668" {
+		t.Fatalf("#ops is homed on %s", home)
+	}
+	if home := op.homeOf(alice, ""); home != op.ircServerAddr {
+		t.Fatalf("the default channel is homed on %s", home)
+	}
+
+	// Chat circuits must reach every server in use, the default one first
+	if destinations := op.chatDestinations(); len(destinations) != 3 || destinations[0] != op.ircServerAddr || destinations[1] != "127.0.0.1:6668" || destinations[2] != "127.0.0.1:6669" {
+		t.Fatalf("chat destinations %v", destinations)
+	}
+
+	// Servers no channel is homed on anymore stop being polled
+	delete(bob.homes, "#dev")
+	bob.forgetUnusedServers()
+	if servers := bob.otherServers(); len(servers) != 1 || servers[0] != "127.0.0.1:6668" {
+		t.Fatalf("bob still polls %v", servers)
+	}
+}
+
+func TestVerifyChatServerList(t *testing.T) {
+	key, trusted := testDirectoryKey(t)
+	servers := []shared.ChatServerInfo{{Name: "main", Address: "127.0.0.1:6667"}}
+	hash, err := shared.ChatServersHash(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.PublicKey
+	list := shared.ChatServerList{PubKey: &pub, Hash: hash, SigR: sigR, SigS: sigS, Servers: servers}
+
+	if !verifyChatServerList(list, trusted) {
+		t.Fatal("a list signed by the trusted directory server was rejected")
+	}
+	if _, untrusted := testDirectoryKey(t); verifyChatServerList(list, untrusted) {
+		t.Fatal("a list signed by another directory server was accepted")
+	}
+	list.Servers = []shared.ChatServerInfo{{Name: "main", Address: "10.0.0.1:6667"}}
+	if verifyChatServerList(list, trusted) {
+		t.Fatal("a list changed after signing was accepted")
+	}
+	if verifyChatServerList(shared.ChatServerList{Servers: servers}, trusted) {
+		t.Fatal("an unsigned list was accepted")
+	}
+
+	// A chat server list can never pass for a consensus
+	if consensusHash, _ := shared.ConsensusHash(nil, shared.ClientParams{}); string(consensusHash) == string(hash) {
+		t.Fatal("a chat server list hashes like a consensus")
+	}
+}
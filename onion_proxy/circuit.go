@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/padding"
+	"../util/retry"
+	"../util/secmem"
+	"../util/transport"
+)
+
+type NoCircuitError error
+
+// Purposes circuits are built for. Control traffic gets its own circuit so it
+// is not queued behind bulk traffic on the data circuit.
+const (
+	dataCircuit    string = "data"    // chat messages and other bulk traffic
+	controlCircuit string = "control" // polling and other small interactive requests
+
+	circuitRotationInterval time.Duration = 120 * time.Second
+	retiredCircuitLifetime  time.Duration = 10 * time.Second // lets in-flight calls on a replaced circuit finish
+
+	onionOverhead int = 256 // bytes of an onion layer besides its data, enough for every field
+)
+
+var (
+	noCircuitError NoCircuitError = errors.New("No circuit has been built")
+)
+
+type circuit struct {
+	lastUsed        int64 // unix nanoseconds of the last onion sent, see touch
+	rtt             int64 // nanoseconds the last ping took, see lastRTT
+	id              uint32
+	purpose         string
+	ORInfoByHopNum  map[int]*orInfo
+	guardMutex      sync.Mutex
+	guardNodeServer *rpc.Client
+	builtAt         time.Time
+	binaryLayers    bool          // every hop parses binary onion layers
+	padding         *padding.Link // on the link to the guard, nil if it isn't padded
+	errors          circuitErrors
+	latencies       hopLatencies
+}
+
+// The purposes circuits are built and rotated for, data first
+func (op *OnionProxy) circuitPurposes() []string {
+	purposes := []string{dataCircuit, controlCircuit, spareCircuit}
+	if op.redundant {
+		purposes = append(purposes, redundantCircuit)
+	}
+	return purposes
+}
+
+// Builds a circuit for every purpose. Only the data circuit is required,
+// other purposes fall back to it if their own circuit can't be built.
+func (op *OnionProxy) GetNewCircuit() error {
+	for _, purpose := range op.circuitPurposes() {
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			if purpose == dataCircuit {
+				return err
+			}
+			util.HandleNonFatalError("Could not create "+purpose+" circuit, falling back to data circuit", err)
+		}
+	}
+	return nil
+}
+
+// Rotates circuits every two minutes by default; the consensus or flags can
+// set a range to pick each rotation interval from
+func (op *OnionProxy) GetNewCircuitEveryTwoMinutes() {
+	for {
+		util.Time.Sleep(op.rotationInterval())
+		for _, purpose := range op.circuitPurposes() {
+			// Keep using the current circuit if a replacement can't be built
+			if err := op.GetCircuitFromDServer(purpose); err != nil {
+				util.HandleNonFatalError("Could not create new "+purpose+" circuit", err)
+			}
+		}
+		op.rotateIsolatedCircuits()
+	}
+}
+
+// Returns the circuit for a purpose, or the data circuit if it has none. An
+// isolated purpose without a circuit gets one built.
+func (op *OnionProxy) getCircuit(purpose string) (*circuit, error) {
+	op.circuitsMutex.RLock()
+	circ, ok := op.circuits[purpose]
+	if !ok && !isolated(purpose) {
+		circ, ok = op.circuits[dataCircuit]
+	}
+	op.circuitsMutex.RUnlock()
+
+	if ok {
+		return circ, nil
+	}
+	if isolated(purpose) {
+		return op.isolatedCircuit(purpose)
+	}
+	return nil, noCircuitError
+}
+
+func (op *OnionProxy) GetCircuitFromDServer(purpose string) error {
+	return op.buildCircuitTo(purpose, op.chatDestinations(), false)
+}
+
+// Builds a circuit whose exit accepts every destination, and opens streams
+// if asked to, and makes it the purpose's circuit. A build that times out is
+// abandoned and tried again on a path without the hop that stalled it.
+func (op *OnionProxy) buildCircuitTo(purpose string, destinations []string, streams bool) error {
+	var circ *circuit
+	var err error
+	avoid := op.avoidFor(purpose)
+	for attempt := 0; attempt < maxBuildAttempts; attempt++ {
+		util.OutLog.Printf("Generating new %s circuit...\n", purpose)
+		n := util.Random.Uint32()
+
+		receipt := &shared.CircuitBuildReceipt{
+			CircuitId: n,
+			Purpose:   purpose,
+			Started:   util.Time.Now(),
+		}
+		circ, err = op.buildCircuit(receipt, destinations, streams, avoid)
+		receipt.Duration = util.Time.Now().Sub(receipt.Started)
+		receipt.Succeeded = err == nil
+		if err != nil {
+			receipt.Error = err.Error()
+		}
+		op.lastBuildMutex.Lock()
+		op.lastBuildReceipt = receipt
+		op.lastBuildMutex.Unlock()
+
+		util.OutLog.Println(receipt)
+		if receipt.ErrorCode != shared.BuildErrTimeout || len(receipt.Hops) == 0 {
+			break
+		}
+		avoid[receipt.Hops[len(receipt.Hops)-1].Address] = true
+	}
+	if err != nil {
+		return err
+	}
+	op.startPadding(circ)
+
+	op.circuitsMutex.Lock()
+	old := op.circuits[purpose]
+	op.circuits[purpose] = circ
+	op.circuitsMutex.Unlock()
+
+	if old != nil {
+		op.retireCircuit(old)
+	}
+	return nil
+}
+
+// Closes a replaced circuit once calls still using it had time to finish,
+// unless another purpose has been using it too
+func (op *OnionProxy) retireCircuit(old *circuit) {
+	go func() {
+		util.Time.Sleep(retiredCircuitLifetime)
+
+		op.circuitsMutex.RLock()
+		inUse := op.circuitInUseLocked(old)
+		op.circuitsMutex.RUnlock()
+		if !inUse {
+			old.stopPadding()
+			old.guard().Close()
+			old.wipeKeys()
+		}
+	}()
+}
+
+// Builds a circuit, recording the outcome of every step in the receipt. The
+// current circuit is only replaced once every hop has accepted its shared key.
+func (op *OnionProxy) buildCircuit(receipt *shared.CircuitBuildReceipt, destinations []string, streams bool, avoid map[string]bool) (*circuit, error) {
+	orInfos, code, err := op.choosePath(destinations, streams, avoid, op.guardsFor(receipt.Purpose))
+	if err != nil {
+		receipt.ErrorCode = code
+		return nil, err
+	}
+
+	requiredHops := fullCircuitHops
+	if op.minHops > 0 {
+		requiredHops = op.minHops
+	}
+	if len(orInfos) < requiredHops {
+		receipt.ErrorCode = shared.BuildErrDirectory
+		return nil, tooFewHopsError
+	}
+	if len(orInfos) < fullCircuitHops {
+		warning := fmt.Sprintf("Too few relays online, using a %d hop circuit instead of %d. Your anonymity is reduced.", len(orInfos), fullCircuitHops)
+		receipt.Warnings = append(receipt.Warnings, warning)
+		util.ErrLog.Printf("[WARNING] %s\n", warning)
+		op.addNotice(warning)
+	}
+
+	circ := &circuit{
+		id:             receipt.CircuitId,
+		purpose:        receipt.Purpose,
+		ORInfoByHopNum: make(map[int]*orInfo),
+	}
+
+	// Each router picks the id for the link into it when every hop can
+	// translate ids. Otherwise the whole circuit shares the id chosen here.
+	perLink := true
+	for _, onionRouterInfo := range orInfos {
+		if !shared.SupportsFeature(onionRouterInfo.ProtocolVersion, shared.FeatureLinkCircuitIds) {
+			perLink = false
+		}
+	}
+
+	// Layers are binary when every hop can parse them, so middle hops
+	// forward cells without decoding them
+	circ.binaryLayers = true
+	for _, onionRouterInfo := range orInfos {
+		if !shared.SupportsFeature(onionRouterInfo.ProtocolVersion, shared.FeatureBinaryOnions) {
+			circ.binaryLayers = false
+		}
+	}
+
+	// Every hop must be extended before the build timeout
+	receipt.Timeout = op.buildTimes.cutoff()
+	extendStarted := time.Now()
+	deadline := time.NewTimer(receipt.Timeout)
+	defer deadline.Stop()
+
+	for hopNum, onionRouterInfo := range orInfos {
+		hopStarted := time.Now()
+		hop := shared.HopReceipt{
+			HopNum:  hopNum,
+			Address: onionRouterInfo.Address,
+		}
+
+		info, client, code, err := op.extendCircuitBefore(deadline.C, circ.id, perLink, hopNum, onionRouterInfo)
+		hop.Duration = time.Since(hopStarted)
+		if code == shared.BuildErrTimeout {
+			op.buildTimes.recordTimeout()
+		}
+		if err != nil {
+			hop.ErrorCode = code
+			hop.Error = err.Error()
+			receipt.Hops = append(receipt.Hops, hop)
+			receipt.ErrorCode = code
+
+			switch code {
+			case shared.BuildErrDial:
+				go op.reportFailure(onionRouterInfo.Address, shared.FailureExtend)
+			case shared.BuildErrCircuitInfo:
+				go op.reportFailure(onionRouterInfo.Address, shared.FailureDecrypt)
+			}
+
+			if circ.guardNodeServer != nil {
+				circ.guardNodeServer.Close()
+			}
+			circ.wipeKeys()
+			return nil, err
+		}
+		hop.CircuitId = info.circuitId
+		receipt.Hops = append(receipt.Hops, hop)
+
+		// Only save guard node server, and the id cells are sent to it with
+		if hopNum == 0 {
+			circ.guardNodeServer = client
+			circ.id = info.circuitId
+			receipt.CircuitId = info.circuitId
+		}
+		circ.ORInfoByHopNum[hopNum] = info
+	}
+
+	op.buildTimes.recordSuccess(time.Since(extendStarted))
+	circ.builtAt = util.Time.Now()
+	circ.touch()
+	util.OutLog.Println("Circuit generation completed")
+
+	return circ, nil
+}
+
+// Extends the circuit to a hop like extendCircuit, unless deadline fires
+// first. An abandoned hop's connection is closed once it completes.
+func (op *OnionProxy) extendCircuitBefore(deadline <-chan time.Time, circuitId uint32, perLink bool, hopNum int, onionRouterInfo shared.OnionRouterInfo) (*orInfo, *rpc.Client, string, error) {
+	type extended struct {
+		info   *orInfo
+		client *rpc.Client
+		code   string
+		err    error
+	}
+	done := make(chan extended, 1)
+	go func() {
+		info, client, code, err := op.extendCircuit(circuitId, perLink, hopNum, onionRouterInfo)
+		done <- extended{info, client, code, err}
+	}()
+
+	select {
+	case hop := <-done:
+		return hop.info, hop.client, hop.code, hop.err
+	case <-deadline:
+		go func() {
+			hop := <-done
+			if hop.client != nil {
+				hop.client.Close()
+			}
+			if hop.info != nil {
+				hop.info.wipeKey()
+			}
+		}()
+		return nil, nil, shared.BuildErrTimeout, buildTimeoutError
+	}
+}
+
+// Sends a shared key to the OR at hopNum. With perLink the OR picks the
+// circuit id, otherwise circuitId is used. The connection is kept open and
+// returned for the guard node only. Returns a build error code on failure.
+func (op *OnionProxy) extendCircuit(circuitId uint32, perLink bool, hopNum int, onionRouterInfo shared.OnionRouterInfo) (*orInfo, *rpc.Client, string, error) {
+	sharedKey := util.GenerateAESKey()
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		secmem.Wipe(sharedKey)
+		return nil, nil, shared.BuildErrEncrypt, err
+	}
+	encryptedSharedKey, err := util.RSAEncrypt(onionRouterInfo.PubKey, sharedKey)
+	if err != nil {
+		util.HandleNonFatalError("Could not encrypt shared key", err)
+		secmem.Wipe(sharedKey)
+		return nil, nil, shared.BuildErrEncrypt, err
+	}
+
+	circuitInfo := shared.CircuitInfo{
+		CircuitId:          circuitId,
+		EncryptedSharedKey: encryptedSharedKey,
+		Capabilities:       op.capabilities(),
+	}
+	capabilities := onionRouterInfo.Offered()
+
+	linkTransport, linkAddress := op.linkTo(onionRouterInfo)
+	client, err := op.DialOR(linkTransport, linkAddress)
+	if err != nil {
+		secmem.Wipe(sharedKey)
+		return nil, nil, shared.BuildErrDial, err
+	}
+
+	if perLink && shared.SupportsFeature(onionRouterInfo.ProtocolVersion, shared.FeatureCapabilities) {
+		var created shared.CircuitCreated
+		if err = client.Call("ORServer.NegotiateCircuit", circuitInfo, &created); err == nil {
+			circuitInfo.CircuitId, capabilities = created.CircuitId, created.Capabilities
+		}
+	} else if perLink {
+		err = client.Call("ORServer.CreateCircuit", circuitInfo, &circuitInfo.CircuitId)
+	} else {
+		var ack bool
+		err = client.Call("ORServer.SendCircuitInfo", circuitInfo, &ack)
+	}
+	if err != nil {
+		util.HandleNonFatalError("Could not send circuit info to ORs", err)
+		client.Close()
+		secmem.Wipe(sharedKey)
+		return nil, nil, shared.BuildErrCircuitInfo, err
+	}
+	// If not guard node, close client
+	if hopNum != 0 {
+		client.Close()
+		client = nil
+	}
+
+	info := &orInfo{
+		address:         onionRouterInfo.Address,
+		pubKey:          onionRouterInfo.PubKey,
+		sharedKey:       &sharedKey,
+		block:           block,
+		protocolVersion: onionRouterInfo.ProtocolVersion,
+		circuitId:       circuitInfo.CircuitId,
+		linkTransport:   linkTransport,
+		linkAddress:     linkAddress,
+		exitPolicy:      onionRouterInfo.Policy(),
+		capabilities:    capabilities,
+		destroyToken:    shared.DestroyToken(sharedKey),
+	}
+
+	util.OutLog.Printf("\nCircuitId %v:\n    Hop Number: %v\n    OR Address: %s\n    Shared Key: %s\n", circuitInfo.CircuitId, hopNum+1, onionRouterInfo.Address, util.LogKey(sharedKey))
+
+	return info, client, "", nil
+}
+
+// The transport and address to reach an OR on: a bridge link given for it,
+// the OP's transport if the OR offers it, tcp on its address otherwise
+func (op *OnionProxy) linkTo(onionRouterInfo shared.OnionRouterInfo) (string, string) {
+	if link, ok := op.bridges[onionRouterInfo.Address]; ok {
+		return link.transport, link.address
+	}
+	if addr, ok := onionRouterInfo.Transports[op.transport]; ok {
+		return op.transport, addr
+	}
+	if op.linkFamily != "" && shared.AddressFamily(onionRouterInfo.Address) != op.linkFamily {
+		for _, alt := range onionRouterInfo.AltAddresses {
+			if shared.AddressFamily(alt) == op.linkFamily {
+				return transport.TCP, alt
+			}
+		}
+	}
+	return transport.TCP, onionRouterInfo.Address
+}
+
+func (op *OnionProxy) DialOR(linkTransport string, ORAddr string) (*rpc.Client, error) {
+	orServer, err := retry.DialRPC(context.Background(), retry.Interactive, linkTransport, ORAddr)
+	if err != nil {
+		util.HandleNonFatalError("Could not dial onion router: "+ORAddr, err)
+		return nil, err
+	}
+	return orServer, nil
+}
+
+// Wraps coreData in one encrypted layer per hop. The command tells the exit
+// node what the core data is.
+func (c *circuit) OnionizeData(command string, coreData []byte) ([]byte, error) {
+	c.touch()
+	return c.onionize(command, coreData)
+}
+
+// Like OnionizeData, but doesn't count as traffic on the circuit
+func (c *circuit) onionize(command string, coreData []byte) ([]byte, error) {
+	return c.onionizeTo(len(c.ORInfoByHopNum)-1, command, coreData)
+}
+
+// Like onionize, but for the hop at exitHop, which takes the onion as if it
+// were the exit node, so cells can be sent to the hops before the exit
+func (c *circuit) onionizeTo(exitHop int, command string, coreData []byte) ([]byte, error) {
+	encryptedLayer := coreData
+
+	for hopNum := exitHop; hopNum >= 0; hopNum-- {
+		unencryptedLayer := shared.Onion{
+			Data: encryptedLayer,
+		}
+
+		// If layer is meant for an exit node, turn IsExitNode flag on
+		// Otherwise give it the address of the next OR o pass the onion on to.
+		if hopNum == exitHop {
+			unencryptedLayer.IsExitNode = true
+			unencryptedLayer.Command = command
+		} else {
+			next := c.ORInfoByHopNum[hopNum+1]
+			unencryptedLayer.NextAddress = next.address
+			if next.circuitId != c.ORInfoByHopNum[hopNum].circuitId {
+				unencryptedLayer.NextCircuitId = next.circuitId
+			}
+			if shared.SupportsFeature(c.ORInfoByHopNum[hopNum].protocolVersion, shared.FeatureDestroyTokens) {
+				unencryptedLayer.DestroyToken = next.destroyToken
+			}
+		}
+
+		// Encode the onion layer after room for the IV, into a buffer sized
+		// so it is allocated once. Inner layers come from the pool; the outer
+		// one is returned and may be resent, so it is allocated.
+		size := aes.BlockSize + shared.BinaryOnionSize(unencryptedLayer)
+		if !c.binaryLayers {
+			size = aes.BlockSize + base64.StdEncoding.EncodedLen(len(encryptedLayer)) + onionOverhead
+		}
+		var layerBuf []byte
+		if hopNum == 0 {
+			layerBuf = make([]byte, size)
+		} else {
+			layerBuf = util.GetBuffer(size)
+		}
+		ciphertext, err := c.encodeLayer(layerBuf[:aes.BlockSize], unencryptedLayer)
+		if err != nil {
+			return nil, err
+		}
+		if hopNum < exitHop {
+			// The inner layer is encoded into this one now
+			util.PutBuffer(encryptedLayer)
+		}
+
+		// Encrypt the onion layer in place
+		prefix := ciphertext[:aes.BlockSize]
+		if _, err := io.ReadFull(util.Random, prefix); err != nil {
+			return nil, err
+		}
+
+		cfb := cipher.NewCFBEncrypter(c.ORInfoByHopNum[hopNum].block, prefix)
+		cfb.XORKeyStream(ciphertext[aes.BlockSize:], ciphertext[aes.BlockSize:])
+
+		encryptedLayer = ciphertext
+	}
+
+	return encryptedLayer, nil
+}
+
+// Appends a layer to buf, as binary if every hop parses binary layers and
+// as JSON otherwise
+func (c *circuit) encodeLayer(buf []byte, layer shared.Onion) ([]byte, error) {
+	if c.binaryLayers {
+		return shared.AppendBinaryOnion(buf, layer)
+	}
+	encoded := bytes.NewBuffer(buf)
+	if err := json.NewEncoder(encoded).Encode(&layer); err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// Wipes the shared keys of every hop once the circuit is closed. Cells
+// already encrypted for it are unaffected, new ones can't be.
+func (c *circuit) wipeKeys() {
+	for _, info := range c.ORInfoByHopNum {
+		info.wipeKey()
+	}
+}
+
+func (info *orInfo) wipeKey() {
+	if info.sharedKey != nil {
+		secmem.Wipe(*info.sharedKey)
+	}
+	secmem.Wipe(info.destroyToken)
+}
+
+func (c *circuit) guard() *rpc.Client {
+	c.guardMutex.Lock()
+	defer c.guardMutex.Unlock()
+
+	return c.guardNodeServer
+}
+
+// Starts a call to the guard node. Guards close connections that were idle
+// for a while, so a connection found shut down is redialed once; nothing was
+// sent on it, so the cell can't be delivered twice.
+func (c *circuit) goGuard(method string, args interface{}, reply interface{}) *rpc.Call {
+	c.noteTraffic()
+	done := make(chan *rpc.Call, 1)
+	client := c.guard()
+	call := client.Go(method, args, reply, done)
+
+	// A shut down client fails the call before Go returns
+	select {
+	case finished := <-done:
+		if finished.Error != rpc.ErrShutdown {
+			done <- finished
+			return call
+		}
+	default:
+		return call
+	}
+
+	redialed, err := c.redialGuard(client)
+	if err != nil {
+		call.Error = err
+		done <- call
+		return call
+	}
+	return redialed.Go(method, args, reply, done)
+}
+
+// Sends a cell to the guard, see relayCall
+func (c *circuit) goCell(command shared.RelayCommand, cell shared.Cell, reply *shared.RelayReply) *rpc.Call {
+	method, args, methodReply := c.relayCall(command, cell, reply)
+	return c.goGuard(method, args, methodReply)
+}
+
+// The guard's RPC method, arguments and reply for a cell: a relay cell of
+// command, or the method of its kind on guards from before relay cells.
+// Replies of either land in reply.
+func (c *circuit) relayCall(command shared.RelayCommand, cell shared.Cell, reply *shared.RelayReply) (string, interface{}, interface{}) {
+	if shared.SupportsFeature(c.ORInfoByHopNum[0].protocolVersion, shared.FeatureRelayCells) {
+		return "ORServer.Relay", shared.RelayCell{Command: command, Cell: cell}, reply
+	}
+
+	switch command {
+	case shared.RelayPoll:
+		reply.Polling = new(shared.PollingResponse)
+		return "ORServer.DecryptPollingCell", cell, reply.Polling
+	case shared.RelayExport:
+		reply.Export = new(shared.ExportChunk)
+		return "ORServer.DecryptExportCell", cell, reply.Export
+	case shared.RelayBegin, shared.RelayData, shared.RelayEnd:
+		reply.Stream = new(shared.StreamResponse)
+		return "ORServer.DecryptStreamCell", cell, reply.Stream
+	case shared.RelayPadding:
+		return "ORServer.PaddingCell", cell, new(bool)
+	default:
+		return "ORServer.DecryptChatMessageCell", cell, new(bool)
+	}
+}
+
+// Replaces a shut down guard connection, unless another call already did
+func (c *circuit) redialGuard(broken *rpc.Client) (*rpc.Client, error) {
+	c.guardMutex.Lock()
+	defer c.guardMutex.Unlock()
+
+	if c.guardNodeServer != broken {
+		return c.guardNodeServer, nil
+	}
+	guard := c.ORInfoByHopNum[0]
+	client, err := retry.DialRPC(context.Background(), retry.Interactive, guard.linkTransport, guard.linkAddress)
+	if err != nil {
+		return nil, err
+	}
+	broken.Close()
+	c.guardNodeServer = client
+	return client, nil
+}
+
+func (c *circuit) SendPollingOnion(onionToSend []byte) (shared.PollingResponse, error) {
+	// Send onion to the guardNode via RPC
+	cell := shared.Cell{
+		CircuitId: c.id,
+		Data:      onionToSend,
+	}
+
+	var reply shared.RelayReply
+	err := (<-c.goCell(shared.RelayPoll, cell, &reply).Done).Error
+	if err != nil {
+		c.noteError(err)
+		util.HandleNonFatalError("Could not send onion to guard node", err)
+		return shared.PollingResponse{}, err
+	}
+	if reply.Polling == nil {
+		return shared.PollingResponse{}, nil
+	}
+
+	return *reply.Polling, nil
+}
+
+func (c *circuit) SendExportOnion(onionToSend []byte) (shared.ExportChunk, error) {
+	cell := shared.Cell{
+		CircuitId: c.id,
+		Data:      onionToSend,
+	}
+
+	var reply shared.RelayReply
+	err := (<-c.goCell(shared.RelayExport, cell, &reply).Done).Error
+	c.noteError(err)
+	if err != nil || reply.Export == nil {
+		return shared.ExportChunk{}, err
+	}
+	return *reply.Export, nil
+}
+
+// Sends a stream cell carrying the stream command
+func (c *circuit) SendStreamOnion(command string, onionToSend []byte) (shared.StreamResponse, error) {
+	cell := shared.Cell{
+		CircuitId: c.id,
+		Data:      onionToSend,
+	}
+
+	var reply shared.RelayReply
+	err := (<-c.goCell(shared.StreamRelayCommand(command), cell, &reply).Done).Error
+	c.noteError(err)
+	if err != nil || reply.Stream == nil {
+		return shared.StreamResponse{}, err
+	}
+	return *reply.Stream, nil
+}
+
+func (c *circuit) SendChatMessageOnion(onionToSend []byte) error {
+	return c.SendChatMessageOnionContext(context.Background(), onionToSend)
+}
+
+// Like SendChatMessageOnion, but stops waiting for the exit node's ack when
+// ctx is done. The onion may still be delivered after that.
+func (c *circuit) SendChatMessageOnionContext(ctx context.Context, onionToSend []byte) error {
+	// Send onion to the guardNode via RPC
+	cell := shared.Cell{ // Can add more in cell if each layer needs more info other (such as hopId)
+		CircuitId: c.id,
+		Data:      onionToSend,
+	}
+
+	util.OutLog.Println("Sending onion to guard node")
+
+	var reply shared.RelayReply
+	call := c.goCell(shared.RelayChat, cell, &reply)
+	handedOff(ctx)
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if call.Error != nil {
+		c.noteError(call.Error)
+		util.HandleNonFatalError("Could not send onion through onion network", call.Error)
+		return call.Error
+	}
+
+	return nil
+}
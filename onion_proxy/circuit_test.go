@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+
+	"../shared"
+	"../util"
+	"../util/transport"
+)
+
+// Stands in for the directory server, answering GetNodes with orSet or err
+type testDirectory struct {
+	orSet shared.OnionRouterInfos
+	err   error
+	calls int
+}
+
+func (d *testDirectory) GetNodes(req shared.CircuitRequest, orSet *shared.OnionRouterInfos) error {
+	d.calls++
+	*orSet = d.orSet
+	return d.err
+}
+
+func (d *testDirectory) GetConsensus(_ignored bool, orSet *shared.OnionRouterInfos) error {
+	d.calls++
+	*orSet = d.orSet
+	return d.err
+}
+
+// Serves directory on a loopback port and returns its address
+func serveTestDirectory(t *testing.T, directory *testDirectory) string {
+	server := rpc.NewServer()
+	if err := server.RegisterName("DServer", directory); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+// The directory servers at the comma separated addresses, closed when the
+// test ends
+func testDirectoryServers(t *testing.T, addresses string) *directoryServers {
+	d := newDirectoryServers(addresses, false)
+	t.Cleanup(func() {
+		for _, client := range d.clients {
+			client.Close()
+		}
+	})
+	return d
+}
+
+func testDirectoryClient(t *testing.T, directory *testDirectory) *directoryServers {
+	return testDirectoryServers(t, serveTestDirectory(t, directory))
+}
+
+func testRSAPublicKey(t *testing.T) *rsa.PublicKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &key.PublicKey
+}
+
+// An address nothing listens on
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestBuildReceipts(t *testing.T) {
+	current := &circuit{id: 7}
+	op := &OnionProxy{circuits: map[string]*circuit{dataCircuit: current}}
+	var receipt shared.CircuitBuildReceipt
+	if err := (&OPServer{OnionProxy: op}).GetLastBuildReceipt(true, &receipt); err != noBuildAttemptedError {
+		t.Fatalf("a receipt before any build gave %v, want %v", err, noBuildAttemptedError)
+	}
+
+	op.dirServer = testDirectoryClient(t, &testDirectory{err: errors.New("no routers")})
+	if op.GetCircuitFromDServer(dataCircuit) == nil || op.lastBuildReceipt.ErrorCode != shared.BuildErrDirectory || op.lastBuildReceipt.Succeeded {
+		t.Fatalf("a directory failure gave %+v", op.lastBuildReceipt)
+	}
+
+	op.dirServer = testDirectoryClient(t, &testDirectory{})
+	if err := op.GetCircuitFromDServer(dataCircuit); err != notTrustedDirectoryServerError || op.lastBuildReceipt.ErrorCode != shared.BuildErrUntrustedDirectory {
+		t.Fatalf("an unsigned router list gave %v and %+v", err, op.lastBuildReceipt)
+	}
+	if circ, _ := op.getCircuit(dataCircuit); circ != current {
+		t.Fatal("a failed build replaced the circuit")
+	}
+	if err := (&OPServer{OnionProxy: op}).GetLastBuildReceipt(true, &receipt); err != nil || receipt.CircuitId != op.lastBuildReceipt.CircuitId {
+		t.Fatalf("the last receipt is %+v, %v", receipt, err)
+	}
+}
+
+func TestExtendCircuitToUnreachableRouter(t *testing.T) {
+	op := &OnionProxy{}
+	info := shared.OnionRouterInfo{Address: closedAddress(t), PubKey: testRSAPublicKey(t)}
+	if _, _, code, err := op.extendCircuit(1, true, 0, info); err == nil || code != shared.BuildErrDial {
+		t.Fatalf("extending to a closed port gave %q, %v", code, err)
+	}
+}
+
+func TestGetCircuitFallsBackToData(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit)}
+	if _, err := op.getCircuit(controlCircuit); err != noCircuitError {
+		t.Fatalf("no circuits gave %v, want %v", err, noCircuitError)
+	}
+	data := &circuit{id: 1, purpose: dataCircuit}
+	op.circuits[dataCircuit] = data
+	if circ, err := op.getCircuit(controlCircuit); err != nil || circ != data {
+		t.Fatal("control traffic didn't fall back to the data circuit")
+	}
+	control := &circuit{id: 2, purpose: controlCircuit}
+	op.circuits[controlCircuit] = control
+	if circ, _ := op.getCircuit(controlCircuit); circ != control {
+		t.Fatal("control traffic didn't use its own circuit")
+	}
+}
+
+// A 3 hop circuit with made up keys
+func testCircuit(t testing.TB) *circuit {
+	circ := &circuit{id: 3, purpose: dataCircuit, ORInfoByHopNum: make(map[int]*orInfo), builtAt: util.Time.Now()}
+	for hopNum, address := range []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"} {
+		key := bytes.Repeat([]byte{byte(hopNum + 1)}, 32)
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		circ.ORInfoByHopNum[hopNum] = &orInfo{address: address, sharedKey: &key, block: block, linkTransport: transport.TCP, linkAddress: address, exitPolicy: shared.OnionRouterInfo{}.Policy()}
+	}
+	return circ
+}
+
+// Decrypts the layer under key without decoding it
+func decryptTestLayer(t *testing.T, key []byte, layer []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted := make([]byte, len(layer)-aes.BlockSize)
+	cipher.NewCFBDecrypter(block, layer[:aes.BlockSize]).XORKeyStream(decrypted, layer[aes.BlockSize:])
+	return decrypted
+}
+
+// Decrypts one layer the way an onion router does
+func peelLayer(t *testing.T, key []byte, layer []byte) shared.Onion {
+	decrypted := decryptTestLayer(t, key, layer)
+	if decrypted[0] == shared.BinaryOnionFormat {
+		onion, err := shared.ParseBinaryOnion(decrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return onion
+	}
+	var onion shared.Onion
+	if err := json.Unmarshal(decrypted, &onion); err != nil {
+		t.Fatal(err)
+	}
+	return onion
+}
+
+func TestOnionizeData(t *testing.T) {
+	for _, binaryLayers := range []bool{false, true} {
+		circ := testCircuit(t)
+		circ.binaryLayers = binaryLayers
+		onion, err := circ.OnionizeData(shared.CommandRegisterUserName, []byte(`{"Message":"hello"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if binary := decryptTestLayer(t, *circ.ORInfoByHopNum[0].sharedKey, onion)[0] == shared.BinaryOnionFormat; binary != binaryLayers {
+			t.Fatalf("the guard's layer is binary %v, want %v", binary, binaryLayers)
+		}
+
+		layer := onion
+		for hopNum := 0; hopNum < len(circ.ORInfoByHopNum); hopNum++ {
+			peeled := peelLayer(t, *circ.ORInfoByHopNum[hopNum].sharedKey, layer)
+			if exit := hopNum == len(circ.ORInfoByHopNum)-1; peeled.IsExitNode != exit {
+				t.Fatalf("hop %d has IsExitNode %v", hopNum, peeled.IsExitNode)
+			} else if exit && peeled.Command != shared.CommandRegisterUserName {
+				t.Fatalf("the exit layer has command %q", peeled.Command)
+			} else if !exit && peeled.NextAddress != circ.ORInfoByHopNum[hopNum+1].address {
+				t.Fatalf("hop %d passes the onion to %q", hopNum, peeled.NextAddress)
+			}
+			layer = peeled.Data
+		}
+		if string(layer) != `{"Message":"hello"}` {
+			t.Fatalf("the exit got %q with binary layers %v", layer, binaryLayers)
+		}
+	}
+}
+
+func TestOnionizeDataWithDestroyTokens(t *testing.T) {
+	for _, binaryLayers := range []bool{false, true} {
+		circ := testCircuit(t)
+		circ.binaryLayers = binaryLayers
+		for _, info := range circ.ORInfoByHopNum {
+			info.destroyToken = shared.DestroyToken(*info.sharedKey)
+		}
+		// The guard is from before destroy tokens, the middle hop isn't
+		circ.ORInfoByHopNum[1].protocolVersion = shared.ProtocolVersion
+
+		onion, err := circ.OnionizeData(shared.CommandChatMessage, []byte("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		guard := peelLayer(t, *circ.ORInfoByHopNum[0].sharedKey, onion)
+		middle := peelLayer(t, *circ.ORInfoByHopNum[1].sharedKey, guard.Data)
+		if guard.DestroyToken != nil || !bytes.Equal(middle.DestroyToken, circ.ORInfoByHopNum[2].destroyToken) {
+			t.Fatalf("binary %v: the guard got token %x, the middle hop %x", binaryLayers, guard.DestroyToken, middle.DestroyToken)
+		}
+	}
+}
+
+func TestOnionizeDataWithLinkCircuitIds(t *testing.T) {
+	circ := testCircuit(t)
+	for hopNum, circuitId := range []uint32{11, 22, 22} {
+		circ.ORInfoByHopNum[hopNum].circuitId = circuitId
+	}
+	onion, err := circ.OnionizeData(shared.CommandChatMessage, []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Routers only relay with a new id where the next link's id differs
+	first := peelLayer(t, *circ.ORInfoByHopNum[0].sharedKey, onion)
+	second := peelLayer(t, *circ.ORInfoByHopNum[1].sharedKey, first.Data)
+	if first.NextCircuitId != 22 || second.NextCircuitId != 0 {
+		t.Fatalf("the hops relay with ids %d and %d, want 22 and 0", first.NextCircuitId, second.NextCircuitId)
+	}
+}
+
+func TestRelayCall(t *testing.T) {
+	circ := testCircuit(t)
+	var reply shared.RelayReply
+	if method, _, _ := circ.relayCall(shared.RelayPoll, shared.Cell{}, &reply); method != "ORServer.DecryptPollingCell" || reply.Polling == nil {
+		t.Fatalf("a guard from before relay cells was polled with %s", method)
+	}
+	if method, _, _ := circ.relayCall(shared.RelayBegin, shared.Cell{}, &reply); method != "ORServer.DecryptStreamCell" {
+		t.Fatalf("a guard from before relay cells was sent a stream cell with %s", method)
+	}
+
+	circ.ORInfoByHopNum[0].protocolVersion = shared.ProtocolVersion
+	method, args, _ := circ.relayCall(shared.RelayExport, shared.Cell{CircuitId: 7}, &reply)
+	if relay, ok := args.(shared.RelayCell); method != "ORServer.Relay" || !ok || relay.Command != shared.RelayExport || relay.Cell.CircuitId != 7 {
+		t.Fatalf("a current guard was sent %s %+v", method, args)
+	}
+}
+
+func TestClosedGuardConnectionIsRedialed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	guard := &testGuard{}
+	server := rpc.NewServer()
+	if err = server.RegisterName("ORServer", guard); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+
+	// The guard closed the connection while it was idle
+	circ := testCircuit(t)
+	circ.ORInfoByHopNum[0].address = listener.Addr().String()
+	circ.ORInfoByHopNum[0].linkAddress = listener.Addr().String()
+	conn, _ := net.Pipe()
+	circ.guardNodeServer = rpc.NewClient(conn)
+	circ.guardNodeServer.Close()
+
+	if err = circ.SendChatMessageOnion([]byte("onion")); err != nil || guard.cells != 1 {
+		t.Fatalf("gave %v after delivering %d cells", err, guard.cells)
+	}
+	if err = circ.SendChatMessageOnion([]byte("onion")); err != nil || guard.cells != 2 {
+		t.Fatalf("the redialed connection gave %v after %d cells", err, guard.cells)
+	}
+}
+
+func BenchmarkOnionizeData(b *testing.B) {
+	for _, layers := range []string{"json", "binary"} {
+		for _, size := range []int{1024, 16 * 1024} {
+			b.Run(fmt.Sprintf("%s/%d", layers, size), func(b *testing.B) {
+				c := testCircuit(b)
+				c.binaryLayers = layers == "binary"
+				coreData := bytes.Repeat([]byte{'x'}, size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := c.OnionizeData(shared.CommandChatMessage, coreData); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLinkTo(t *testing.T) {
+	info := shared.OnionRouterInfo{Address: "127.0.0.1:8001", Transports: map[string]string{"ws": "127.0.0.1:9001"}}
+	if name, addr := (&OnionProxy{transport: "ws"}).linkTo(info); name != "ws" || addr != "127.0.0.1:9001" {
+		t.Fatalf("linked over %s to %s", name, addr)
+	}
+	if name, addr := (&OnionProxy{transport: "obfs"}).linkTo(info); name != transport.TCP || addr != "127.0.0.1:8001" {
+		t.Fatalf("a router without the transport was linked over %s to %s", name, addr)
+	}
+
+	info = shared.OnionRouterInfo{Address: "10.0.0.1:8001", AltAddresses: []string{"[2001:db8::1]:8001"}}
+	if _, addr := (&OnionProxy{linkFamily: shared.FamilyIPv6}).linkTo(info); addr != "[2001:db8::1]:8001" {
+		t.Fatalf("a dual-stack router was linked to %s over IPv6", addr)
+	}
+	if _, addr := (&OnionProxy{linkFamily: shared.FamilyIPv4}).linkTo(info); addr != "10.0.0.1:8001" {
+		t.Fatalf("a dual-stack router was linked to %s over IPv4", addr)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type NoSuchCircuitError error
+
+var (
+	// Circuit Status Errors
+	noSuchCircuitError NoSuchCircuitError = errors.New("No circuit is in use for the given purpose")
+)
+
+// Failed cells of a circuit, for GetCircuitStatus
+type circuitErrors struct {
+	sync.Mutex
+	total  uint64
+	recent []circuitError // oldest first, none older than shared.CircuitErrorWindow
+	last   string
+}
+
+type circuitError struct {
+	at   time.Time
+	code string
+}
+
+// Counts a cell that failed on the circuit; nil errors are ignored
+func (c *circuit) noteError(err error) {
+	if err == nil {
+		return
+	}
+	code := shared.ErrorCode(err)
+	if code == "" {
+		code = "OTHER"
+	}
+
+	c.errors.Lock()
+	defer c.errors.Unlock()
+
+	now := util.Time.Now()
+	c.errors.total++
+	c.errors.recent = append(c.errors.expire(now), circuitError{at: now, code: code})
+	c.errors.last = err.Error()
+}
+
+// The recent errors left once those older than the window are dropped.
+// Caller must hold the lock.
+func (e *circuitErrors) expire(now time.Time) []circuitError {
+	i := 0
+	for i < len(e.recent) && now.Sub(e.recent[i].at) > shared.CircuitErrorWindow {
+		i++
+	}
+	e.recent = e.recent[i:]
+	return e.recent
+}
+
+func (c *circuit) status(purposes []string) shared.CircuitStatus {
+	now := util.Time.Now()
+	status := shared.CircuitStatus{
+		CircuitId:    c.id,
+		Purposes:     purposes,
+		BuiltAt:      c.builtAt,
+		Age:          now.Sub(c.builtAt),
+		Idle:         c.idleFor(),
+		RTT:          c.lastRTT(),
+		RecentErrors: make(map[string]int),
+	}
+	latencies := c.hopLatencies()
+	for hopNum := 0; hopNum < len(c.ORInfoByHopNum); hopNum++ {
+		info := c.ORInfoByHopNum[hopNum]
+		hop := shared.CircuitHop{
+			Address:         info.address,
+			Fingerprint:     util.Fingerprint(info.pubKey),
+			ProtocolVersion: info.protocolVersion,
+			Capabilities:    info.capabilities,
+		}
+		if hopNum < len(latencies) {
+			hop.Latency = latencies[hopNum]
+		}
+		status.Hops = append(status.Hops, hop)
+	}
+
+	c.errors.Lock()
+	defer c.errors.Unlock()
+	status.Errors = c.errors.total
+	for _, e := range c.errors.expire(now) {
+		status.RecentErrors[e.code]++
+	}
+	status.LastError = c.errors.last
+	return status
+}
+
+// Reports the circuit used for purpose, the data circuit if it is empty, or
+// every circuit in use for "all". With -isolate, isolated circuits of other
+// sessions are left out.
+func (s *OPServer) GetCircuitStatus(purpose string, resp *[]shared.CircuitStatus) error {
+	if purpose == "" {
+		purpose = dataCircuit
+	}
+	key := isolationKeyOf(s.OnionProxy.purposeFor(s.session(), purpose))
+
+	var statuses []shared.CircuitStatus
+	for circ, purposes := range s.OnionProxy.circuitsInUse() {
+		sort.Strings(purposes)
+		for _, p := range purposes {
+			if isolated(p) && isolationKeyOf(p) != key {
+				continue
+			}
+			if purpose == "all" || basePurpose(p) == purpose {
+				statuses = append(statuses, circ.status(purposes))
+				break
+			}
+		}
+	}
+	if len(statuses) == 0 {
+		return noSuchCircuitError
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].BuiltAt.Before(statuses[j].BuiltAt) })
+	*resp = statuses
+	return nil
+}
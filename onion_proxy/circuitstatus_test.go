@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func TestCircuitErrors(t *testing.T) {
+	defer util.SetClock(util.Time)
+	clock := util.NewManualClock(time.Now())
+	util.SetClock(clock)
+	circ := testCircuit(t)
+	for _, info := range circ.ORInfoByHopNum {
+		info.pubKey = testRSAPublicKey(t)
+	}
+
+	circ.noteError(nil)
+	circ.noteError(shared.ExpiredError)
+	clock.Advance(shared.CircuitErrorWindow + time.Second)
+	circ.noteError(errors.New("connection reset"))
+	circ.noteError(shared.UnavailableError("onion router 127.0.0.1:8002", errors.New("refused")))
+
+	status := circ.status([]string{dataCircuit})
+	if status.Errors != 3 || len(status.RecentErrors) != 2 || status.RecentErrors["OTHER"] != 1 || status.RecentErrors[shared.CodeUnavailable] != 1 {
+		t.Fatalf("the circuit has %d errors, recently %v", status.Errors, status.RecentErrors)
+	}
+	if len(status.Hops) != 3 || status.Hops[0].Address != "127.0.0.1:8001" || status.Hops[0].Fingerprint != util.Fingerprint(circ.ORInfoByHopNum[0].pubKey) {
+		t.Fatalf("the hops are %+v", status.Hops)
+	}
+	if status.LastError == "" || status.Age != shared.CircuitErrorWindow+time.Second {
+		t.Fatalf("the status is %+v", status)
+	}
+}
+
+func TestGetCircuitStatus(t *testing.T) {
+	data, control := testCircuit(t), testCircuit(t)
+	for _, info := range append(hopsOf(data), hopsOf(control)...) {
+		info.pubKey = testRSAPublicKey(t)
+	}
+	control.id = 4
+	op := &OnionProxy{circuits: map[string]*circuit{dataCircuit: data, controlCircuit: control, redundantCircuit: data}, sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}
+
+	var statuses []shared.CircuitStatus
+	if err := s.GetCircuitStatus("", &statuses); err != nil || len(statuses) != 1 || statuses[0].CircuitId != 3 || len(statuses[0].Purposes) != 2 {
+		t.Fatalf("the data circuit is %+v, %v", statuses, err)
+	}
+	if err := s.GetCircuitStatus("all", &statuses); err != nil || len(statuses) != 2 {
+		t.Fatalf("every circuit is %+v, %v", statuses, err)
+	}
+	if err := s.GetCircuitStatus(streamCircuit, &statuses); err != noSuchCircuitError {
+		t.Fatalf("a purpose without a circuit gave %v, want %v", err, noSuchCircuitError)
+	}
+}
+
+func hopsOf(circ *circuit) []*orInfo {
+	var hops []*orInfo
+	for _, info := range circ.ORInfoByHopNum {
+		hops = append(hops, info)
+	}
+	return hops
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+const (
+	// How far the proxy's clock may be behind the directory server's for a
+	// consensus to be valid already
+	maxConsensusClockSkew time.Duration = 10 * time.Minute
+	// An unchanged consensus is written to disk again after this, to keep
+	// its validity current
+	consensusCacheRewriteInterval time.Duration = 5 * time.Minute
+)
+
+// The directory servers the proxy was configured with. They all sign with
+// the same key; calls go to one after another until one answers, starting
+// with the one that answered last.
+type directoryServers struct {
+	sync.Mutex
+	clients []*retry.Client
+	current int // index of the one tried first
+}
+
+// Parses a comma separated list of directory server addresses, shuffled if
+// shuffle is set so proxies spread over the directories
+func newDirectoryServers(list string, shuffle bool) *directoryServers {
+	var addresses []string
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		util.ErrLog.Fatalln("[FATAL ERROR] No directory server address given")
+	}
+	if shuffle {
+		for i := len(addresses) - 1; i > 0; i-- {
+			j := int(util.Random.Uint32() % uint32(i+1))
+			addresses[i], addresses[j] = addresses[j], addresses[i]
+		}
+	}
+
+	d := &directoryServers{}
+	for _, address := range addresses {
+		// Few retries each, the next directory is tried instead
+		d.clients = append(d.clients, retry.NewClient(retry.Interactive, "tcp", address))
+	}
+	return d
+}
+
+func (d *directoryServers) Call(method string, args interface{}, reply interface{}) error {
+	return d.CallContext(context.Background(), method, args, reply)
+}
+
+// Calls method on each directory server in turn until one answers. An error
+// returned by a directory server itself is returned without trying the
+// others, as they would give the same answer.
+func (d *directoryServers) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	d.Lock()
+	start := d.current
+	d.Unlock()
+
+	var err error
+	for i := range d.clients {
+		n := (start + i) % len(d.clients)
+		err = d.clients[n].CallContext(ctx, method, args, reply)
+		if _, ok := err.(rpc.ServerError); ok {
+			return err
+		}
+		if err == nil {
+			d.Lock()
+			if d.current != n {
+				util.OutLog.Printf("Switched to directory server %s\n", d.clients[n].Address())
+				d.current = n
+			}
+			d.Unlock()
+			return nil
+		}
+		util.HandleNonFatalError("Could not reach directory server "+d.clients[n].Address(), err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return err
+}
+
+// The last consensus a directory server sent, written to disk so a restarted
+// proxy can build circuits even if no directory server is reachable. Only
+// consensuses with a signed validity are cached, they are verified again
+// when loaded, and used only while the directory server said they are valid.
+type consensusCache struct {
+	sync.Mutex
+	path      string // kept in memory only if empty
+	consensus *shared.OnionRouterInfos
+	written   time.Time // when the cache file was last written
+	inUse     bool      // the directory servers are unreachable and the cache is used
+}
+
+// What the cache file holds
+type cachedConsensus struct {
+	Consensus shared.OnionRouterInfos
+}
+
+// Loads the consensus cached at path, if there is one
+func newConsensusCache(path string) *consensusCache {
+	cache := &consensusCache{path: path}
+	if path == "" {
+		return cache
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cache
+	}
+	if err != nil {
+		util.HandleNonFatalError("Could not open consensus cache", err)
+		return cache
+	}
+	defer file.Close()
+
+	var cached cachedConsensus
+	if err := gob.NewDecoder(file).Decode(&cached); err != nil {
+		util.HandleNonFatalError("Could not read consensus cache", err)
+		return cache
+	}
+	// Expired ones are kept, for checking circuits like latest
+	if !verifyORSet(cached.Consensus, directoryServerPubKey) || !signsValidity(cached.Consensus) {
+		util.ErrLog.Println("[ERROR] Ignoring consensus cache:", notTrustedDirectoryServerError)
+		return cache
+	}
+	cache.consensus = &cached.Consensus
+	util.OutLog.Printf("Loaded consensus of %d ORs cached, valid until %s\n", len(cached.Consensus.ORInfos), cached.Consensus.ValidUntil.Format(time.RFC3339))
+	return cache
+}
+
+// Remembers a consensus that was just fetched and verified
+func (c *consensusCache) store(ORSet shared.OnionRouterInfos) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.inUse {
+		util.OutLog.Println("Directory servers are reachable again")
+		c.inUse = false
+	}
+	unchanged := c.consensus != nil && string(c.consensus.Hash) == string(ORSet.Hash)
+	c.consensus = &ORSet
+	if c.path == "" || !signsValidity(ORSet) || (unchanged && time.Since(c.written) < consensusCacheRewriteInterval) {
+		return
+	}
+	c.written = time.Now()
+
+	// Written next to the cache and renamed over it, so a crash never
+	// leaves half a consensus behind
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		util.HandleNonFatalError("Could not write consensus cache", err)
+		return
+	}
+	err = gob.NewEncoder(tmp).Encode(cachedConsensus{Consensus: ORSet})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		util.HandleNonFatalError("Could not write consensus cache", err)
+	}
+}
+
+// Returns the cached consensus if the directory server signed it valid for
+// now, so no one can have the proxy build circuits from an old one
+func (c *consensusCache) load() (shared.OnionRouterInfos, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.consensus == nil || !signsValidity(*c.consensus) || consensusExpired(*c.consensus, time.Now()) {
+		return shared.OnionRouterInfos{}, false
+	}
+	if !c.inUse {
+		util.ErrLog.Printf("[WARNING] No directory server reachable, using the cached consensus valid until %s\n", c.consensus.ValidUntil.Format(time.RFC3339))
+		c.inUse = true
+	}
+	return *c.consensus, true
+}
+
+// The last consensus fetched, however old, for checking circuits already built
+func (c *consensusCache) latest() (shared.OnionRouterInfos, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.consensus == nil {
+		return shared.OnionRouterInfos{}, false
+	}
+	return *c.consensus, true
+}
+
+// Fetches the consensus from the directory servers and caches it. While none
+// of them is reachable, returns the cached consensus instead.
+func (op *OnionProxy) fetchConsensus(ctx context.Context) (shared.OnionRouterInfos, error) {
+	var ORSet shared.OnionRouterInfos
+	err := op.dirServer.CallContext(ctx, "DServer.GetConsensus", true, &ORSet)
+	if err == nil {
+		if !trustedORSet(ORSet) {
+			return ORSet, notTrustedDirectoryServerError
+		}
+		op.consensusCache.store(ORSet)
+		return ORSet, nil
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return ORSet, err
+	}
+	if cached, ok := op.consensusCache.load(); ok {
+		return cached, nil
+	}
+	return ORSet, err
+}
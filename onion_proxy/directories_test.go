@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/gob"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// An address nothing listens on
+func deadAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return listener.Addr().String()
+}
+
+func TestDirectoryFailover(t *testing.T) {
+	live := &testDirectory{orSet: shared.OnionRouterInfos{ORInfos: testORInfos}}
+	d := testDirectoryServers(t, deadAddress(t)+", "+serveTestDirectory(t, live))
+	if len(d.clients) != 2 {
+		t.Fatalf("parsed %d directory servers", len(d.clients))
+	}
+
+	var orSet shared.OnionRouterInfos
+	if err := d.Call("DServer.GetConsensus", true, &orSet); err != nil || len(orSet.ORInfos) != len(testORInfos) {
+		t.Fatalf("got %d ORs, %v", len(orSet.ORInfos), err)
+	}
+	if d.current != 1 {
+		t.Fatal("the directory server that answered isn't tried first next time")
+	}
+
+	// A directory server's own error is the answer, the others aren't asked
+	failing, other := &testDirectory{err: errors.New("no routers")}, &testDirectory{}
+	d = testDirectoryServers(t, serveTestDirectory(t, failing)+","+serveTestDirectory(t, other))
+	if err := d.Call("DServer.GetNodes", shared.CircuitRequest{}, &orSet); err == nil || err.Error() != "no routers" || other.calls != 0 {
+		t.Fatalf("gave %v after %d calls to the other directory", err, other.calls)
+	}
+}
+
+func TestConsensusCache(t *testing.T) {
+	gob.Register(&elliptic.CurveParams{})
+	key, _ := testDirectoryKey(t)
+	consensus := testConsensus(t, key, testORInfos, time.Now())
+
+	cache := newConsensusCache("")
+	if _, ok := cache.load(); ok {
+		t.Fatal("an empty cache gave a consensus")
+	}
+	cache.store(consensus)
+	if cached, ok := cache.load(); !ok || string(cached.Hash) != string(consensus.Hash) {
+		t.Fatal("the stored consensus wasn't loaded")
+	}
+	cache.store(testConsensus(t, key, testORInfos, time.Now().Add(-4*time.Hour)))
+	if _, ok := cache.load(); ok {
+		t.Fatal("an expired consensus was loaded")
+	}
+	unsigned := consensus
+	unsigned.ValiditySigR, unsigned.ValiditySigS = nil, nil
+	cache.store(unsigned)
+	if _, ok := cache.load(); ok {
+		t.Fatal("a consensus without a signed validity was loaded")
+	}
+
+	// The cache file holds the consensus, but it is only used once it
+	// verifies against the trusted directory key
+	path := filepath.Join(t.TempDir(), "consensus.cache")
+	newConsensusCache(path).store(consensus)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var cached cachedConsensus
+	if err = gob.NewDecoder(file).Decode(&cached); err != nil || string(cached.Consensus.Hash) != string(consensus.Hash) {
+		t.Fatalf("the cache file holds %x, %v", cached.Consensus.Hash, err)
+	}
+	if newConsensusCache(path).consensus != nil {
+		t.Fatal("a consensus from an untrusted directory server was loaded from disk")
+	}
+}
+
+func TestFetchConsensusFallsBackToCache(t *testing.T) {
+	key, _ := testDirectoryKey(t)
+	consensus := testConsensus(t, key, testORInfos, time.Now())
+	op := &OnionProxy{dirServer: testDirectoryServers(t, deadAddress(t)), consensusCache: newConsensusCache("")}
+
+	if _, err := op.fetchConsensus(context.Background()); err == nil {
+		t.Fatal("a consensus was fetched from an unreachable directory server")
+	}
+	op.consensusCache.store(consensus)
+	if ORSet, err := op.fetchConsensus(context.Background()); err != nil || string(ORSet.Hash) != string(consensus.Hash) {
+		t.Fatalf("the cached consensus wasn't used: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type BadFragmentError error
+
+var (
+	// Fragment Errors
+	badFragmentError BadFragmentError = errors.New("Exit node sent a fragment that does not fit the response")
+)
+
+// Sends a command too large for one cell as fragments, in order, each waiting
+// for its ack. The exit delivers the command on the last one, so that ack
+// carries the IRC server's answer.
+func (c *circuit) sendFragmentsContext(ctx context.Context, command string, data []byte) error {
+	fragments := shared.SplitFragments(util.Random.Uint32(), command, data)
+	// Handed off once the last fragment is, the message is published then
+	pieceCtx := withHandOff(ctx, nil)
+	for i, fragment := range fragments {
+		if i == len(fragments)-1 {
+			pieceCtx = ctx
+		}
+		jsonData, err := json.Marshal(&fragment)
+		if err != nil {
+			return err
+		}
+		onion, err := c.OnionizeData(shared.CommandFragment, jsonData)
+		secmem.Wipe(jsonData)
+		if err != nil {
+			return err
+		}
+		if err = c.SendChatMessageOnionContext(pieceCtx, onion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fetches the rest of a fragmented polling response from the exit node and
+// decodes the whole response
+func (c *circuit) fetchFragments(first shared.Fragment) (shared.PollingResponse, error) {
+	var resp shared.PollingResponse
+	if first.Seq != 0 || first.Total < 1 {
+		return resp, badFragmentError
+	}
+
+	data := append([]byte(nil), first.Data...)
+	for seq := 1; seq < first.Total; seq++ {
+		jsonData, err := json.Marshal(&shared.FragmentRequest{Id: first.Id, Seq: seq})
+		if err != nil {
+			return resp, err
+		}
+		onion, err := c.OnionizeData(shared.CommandFetchFragment, jsonData)
+		if err != nil {
+			return resp, err
+		}
+		next, err := c.SendPollingOnion(onion)
+		if err != nil {
+			return resp, err
+		}
+		if next.Fragment == nil || next.Fragment.Id != first.Id || next.Fragment.Seq != seq || next.Fragment.Total != first.Total {
+			return resp, badFragmentError
+		}
+		data = append(data, next.Fragment.Data...)
+	}
+
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, shared.EncodingError("reassembled polling response", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type GroupKeyError error
+
+const (
+	// Group key configurations
+	memberRefreshInterval time.Duration = 30 * time.Second // how stale a channel's member list may get before sending to it
+)
+
+// An end-to-end encrypted channel: the session's own sender key for it and
+// the members that have been sent it. The key is replaced when a member
+// leaves, so they can't read what is sent after.
+type channelGroup struct {
+	own         *shared.SenderKey
+	sentTo      map[string]bool
+	lastRefresh time.Time
+}
+
+var (
+	// Group Key Errors
+	encryptedOffHomeError   GroupKeyError = errors.New("Only channels on the default chat server can be encrypted")
+	badChannelKeysError     GroupKeyError = errors.New("Exit node did not answer with the channel's member keys")
+	encryptedAnonymousError GroupKeyError = errors.New("Anonymous messages can't be sent to an encrypted channel")
+)
+
+// Encrypts what the session sends to channel from now on. The other members'
+// proxies start encrypting too once they receive the session's sender key.
+func (s *OPServer) EncryptChannel(channel string, ack *bool) error {
+	sess := s.session()
+	if _, _, err := sess.identity(); err != nil {
+		return err
+	}
+	if s.OnionProxy.homeOf(sess, channel) != s.OnionProxy.ircServerAddr {
+		return encryptedOffHomeError
+	}
+
+	sess.Lock()
+	sess.groupOf(channelOrDefault(channel))
+	sess.Unlock()
+
+	*ack = true
+	return nil
+}
+
+func channelOrDefault(channel string) string {
+	if channel == "" {
+		return shared.DefaultChannel
+	}
+	return channel
+}
+
+// The channel's group, made if the channel wasn't encrypted yet. Caller must
+// hold the session lock.
+func (sess *session) groupOf(channel string) *channelGroup {
+	group, ok := sess.groups[channel]
+	if !ok {
+		group = &channelGroup{sentTo: make(map[string]bool)}
+		sess.groups[channel] = group
+	}
+	return group
+}
+
+func (sess *session) encrypted(channel string) bool {
+	sess.Lock()
+	defer sess.Unlock()
+	_, ok := sess.groups[channelOrDefault(channel)]
+	return ok
+}
+
+// Encrypts chatMessage's text with the session's sender key for the channel,
+// first handing the key to members who don't have it
+func (op *OnionProxy) encryptForChannel(sess *session, chatMessage *shared.ChatMessage) error {
+	channel := channelOrDefault(chatMessage.Channel)
+	if err := op.distributeSenderKey(sess, channel); err != nil {
+		return err
+	}
+
+	sess.Lock()
+	own := *sess.groups[channel].own
+	sess.Unlock()
+
+	encrypted, err := own.Encrypt(chatMessage.Message, util.Random)
+	if err != nil {
+		return err
+	}
+	chatMessage.Message = ""
+	chatMessage.Encrypted = &encrypted
+	return nil
+}
+
+// Makes sure every member of channel has the session's sender key, looking
+// the members up again if the list is stale and replacing the key if someone
+// who had it left
+func (op *OnionProxy) distributeSenderKey(sess *session, channel string) error {
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+
+	sess.Lock()
+	group := sess.groupOf(channel)
+	fresh := group.own != nil && util.Time.Now().Sub(group.lastRefresh) < memberRefreshInterval
+	sess.Unlock()
+	if fresh {
+		return nil
+	}
+
+	members, err := op.getChannelKeys(sess, shared.ChannelKeysRequest{
+		IRCServerAddr: op.ircServerAddr,
+		Namespace:     op.namespace,
+		Username:      username,
+		UserToken:     userToken,
+		Channel:       channel,
+	})
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, member := range members {
+		current[member.Username] = true
+	}
+
+	sess.Lock()
+	rotate := group.own == nil || group.own.Owner != username
+	for member := range group.sentTo {
+		if !current[member] {
+			rotate = true
+		}
+	}
+	if rotate {
+		key, err := shared.NewSenderKey(channel, username, util.Random)
+		if err != nil {
+			sess.Unlock()
+			return err
+		}
+		group.own = &key
+		group.sentTo = make(map[string]bool)
+		// Our own messages come back from the server like everyone else's.
+		// Older keys are kept so the messages sent with them stay readable.
+		sess.senderKeys[senderKeyIndex(key.Owner, key.KeyId)] = key
+	}
+	own := *group.own
+	var unsent []shared.MemberKey
+	for _, member := range members {
+		if member.Username != username && !group.sentTo[member.Username] {
+			unsent = append(unsent, member)
+		}
+	}
+	sess.Unlock()
+
+	for _, member := range unsent {
+		if err := op.checkContactKeys(sess, member.Username, nil, member.EncryptionKey); err != nil {
+			sess.addNotice("Not sending your key for " + channel + " to " + member.Username + ": " + err.Error())
+			continue
+		}
+		envelope, err := shared.SealSenderKey(member.EncryptionKey, own, util.Random)
+		if err != nil {
+			util.HandleNonFatalError("Could not seal sender key for "+member.Username, err)
+			continue
+		}
+		chatMessage := shared.ChatMessage{
+			IRCServerAddr: op.ircServerAddr,
+			Namespace:     op.namespace,
+			Username:      username,
+			UserToken:     userToken,
+			Recipient:     member.Username,
+			SenderKey:     &envelope,
+			SentAt:        time.Now(),
+		}
+		sess.sign(&chatMessage)
+		if err := op.sendCommand(op.purposeFor(sess, dataCircuit), shared.CommandChatMessage, chatMessage); err != nil {
+			// Tried again with the next message
+			util.HandleNonFatalError("Could not send sender key to "+member.Username, err)
+			continue
+		}
+		sess.Lock()
+		group.sentTo[member.Username] = true
+		sess.Unlock()
+	}
+
+	sess.Lock()
+	group.lastRefresh = util.Time.Now()
+	sess.Unlock()
+	return nil
+}
+
+// Sender keys are held by owner as well as id, so a member can't shadow
+// another's key by handing out one with the same id
+func senderKeyIndex(owner string, keyId string) string {
+	return owner + "\n" + keyId
+}
+
+func (op *OnionProxy) getChannelKeys(sess *session, req shared.ChannelKeysRequest) ([]shared.MemberKey, error) {
+	circ, err := op.getCircuit(op.purposeFor(sess, controlCircuit))
+	if err != nil {
+		return nil, err
+	}
+	if !circ.exitSupports(shared.FeatureGroupKeys) {
+		return nil, unsupportedByExitError(circ.exitAddress(), shared.FeatureGroupKeys)
+	}
+
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	onion, err := circ.OnionizeData(shared.CommandChannelKeys, jsonData)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := circ.SendPollingOnion(onion)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ChannelKeys == nil {
+		return nil, badChannelKeysError
+	}
+	return resp.ChannelKeys.Members, nil
+}
+
+// Opens the sender keys a poll brought and decrypts its encrypted messages.
+// Envelopes stay in the inbox until it is read, so one already opened is only
+// noticed the first time.
+func (sess *session) applyGroupKeys(envelopes []shared.SenderKeyEnvelope, resp *shared.PollResult) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.encryptionKey != nil {
+		for _, envelope := range envelopes {
+			key, err := shared.OpenSenderKey(sess.encryptionKey, envelope)
+			if err != nil {
+				util.OutLog.Printf("Dropping sender key from %s: %v\n", envelope.From, err)
+				continue
+			}
+			if _, seen := sess.senderKeys[senderKeyIndex(key.Owner, key.KeyId)]; seen {
+				secmem.Wipe(key.Key)
+				continue
+			}
+			sess.senderKeys[senderKeyIndex(key.Owner, key.KeyId)] = key
+			if _, ok := sess.groups[key.Channel]; !ok {
+				sess.groupOf(key.Channel)
+				resp.Notices = append(resp.Notices, "*** "+key.Owner+" encrypted "+key.Channel+"; your messages to it are now encrypted too")
+			}
+		}
+	}
+
+	messages := resp.Messages
+	for i := range messages {
+		encrypted := messages[i].Encrypted
+		if encrypted == nil {
+			continue
+		}
+		// A key is only good for its owner's messages in its channel
+		key, ok := sess.senderKeys[senderKeyIndex(messages[i].From, encrypted.KeyId)]
+		if !ok || key.Channel != messages[i].Channel {
+			continue
+		}
+		text, err := key.Decrypt(*encrypted)
+		if err != nil {
+			continue
+		}
+		messages[i].Text = strings.TrimSuffix(messages[i].Text, shared.EncryptedPlaceholder) + text
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type TooFewRelaysError error
+
+const (
+	healthCheckTimeout time.Duration = 2 * time.Second
+)
+
+var (
+	// Health Errors
+	tooFewRelaysError TooFewRelaysError = errors.New("Too few relays in the consensus to build a circuit")
+)
+
+// The proxy is ready while the directory server lists enough relays for a
+// circuit and, once circuits were built, it still has one
+func (op *OnionProxy) healthChecks() []util.HealthCheck {
+	return []util.HealthCheck{
+		{Name: "directory", Check: op.checkDirectory},
+		{Name: "circuits", Check: op.checkCircuits},
+	}
+}
+
+func (op *OnionProxy) checkDirectory() error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	var ORSet shared.OnionRouterInfos
+	if err := op.dirServer.CallContext(ctx, "DServer.GetConsensus", true, &ORSet); err != nil {
+		return err
+	}
+	if !trustedORSet(ORSet) {
+		return notTrustedDirectoryServerError
+	}
+
+	hops := fullCircuitHops
+	if op.minHops > 0 {
+		hops = op.minHops
+	}
+	if len(ORSet.ORInfos) < hops {
+		return tooFewRelaysError
+	}
+	return nil
+}
+
+// Circuits are only built once the first client connects, until then the
+// directory check tells whether they can be
+func (op *OnionProxy) checkCircuits() error {
+	op.startMutex.Lock()
+	started := op.started
+	op.startMutex.Unlock()
+
+	if !started {
+		return nil
+	}
+	_, err := op.getCircuit(dataCircuit)
+	return err
+}
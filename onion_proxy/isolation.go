@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"../util"
+)
+
+// Isolation configurations
+const (
+	isolateUsername = "username" // sessions of different usernames never share a circuit
+	isolateClient   = "client"   // every client session has circuits of its own
+
+	isolationSeparator = "/" // between a purpose and the isolation key of its circuit
+	isolationKeyBytes  = 8
+)
+
+// Parses -isolate: a comma separated list of username and client, or none
+func parseIsolation(spec string) ([]string, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	var isolation []string
+	for _, by := range strings.Split(spec, ",") {
+		by = strings.TrimSpace(by)
+		if by != isolateUsername && by != isolateClient {
+			return nil, fmt.Errorf("unknown isolation %q, expected %s, %s or none", by, isolateUsername, isolateClient)
+		}
+		isolation = append(isolation, by)
+	}
+	return isolation, nil
+}
+
+// The purpose sess's traffic of purpose goes over: purpose itself, or with
+// -isolate or a profile, a purpose only sessions with the same isolation key
+// use
+func (op *OnionProxy) purposeFor(sess *session, purpose string) string {
+	sess.Lock()
+	username, token, p := sess.username, sess.token, sess.profile
+	sess.Unlock()
+	return op.isolatedPurpose(purpose, username, token, p)
+}
+
+// The purpose of a session by its username, token and profile, for a session
+// that is still claiming its username
+func (op *OnionProxy) isolatedPurpose(purpose string, username string, token string, p *profile) string {
+	if len(op.isolation) == 0 && p == nil {
+		return purpose
+	}
+
+	// Keyed by a secret of this proxy, so the keys shown in logs and circuit
+	// status don't give usernames away
+	mac := hmac.New(sha256.New, op.isolationSecret)
+	for _, by := range op.isolation {
+		switch by {
+		case isolateUsername:
+			fmt.Fprintf(mac, "username %s\n", username)
+		case isolateClient:
+			fmt.Fprintf(mac, "client %s\n", token)
+		}
+	}
+	if p == nil {
+		return purpose + isolationSeparator + hex.EncodeToString(mac.Sum(nil)[:isolationKeyBytes])
+	}
+
+	// Profiles never share circuits, whatever -isolate says, and start them
+	// at their own guard
+	fmt.Fprintf(mac, "profile %s\n", p.name)
+	key := hex.EncodeToString(mac.Sum(nil)[:isolationKeyBytes])
+	op.profilesMutex.Lock()
+	op.profileKeys[key] = p
+	op.profilesMutex.Unlock()
+	return purpose + isolationSeparator + key
+}
+
+// The isolation key of a purpose, empty for the shared ones
+func isolationKeyOf(purpose string) string {
+	if i := strings.Index(purpose, isolationSeparator); i >= 0 {
+		return purpose[i+1:]
+	}
+	return ""
+}
+
+// The purpose without its isolation key
+func basePurpose(purpose string) string {
+	if i := strings.Index(purpose, isolationSeparator); i >= 0 {
+		return purpose[:i]
+	}
+	return purpose
+}
+
+func isolated(purpose string) bool {
+	return isolationKeyOf(purpose) != ""
+}
+
+// The profile whose sessions use purpose, nil for none
+func (op *OnionProxy) profileOf(purpose string) *profile {
+	key := isolationKeyOf(purpose)
+	if key == "" {
+		return nil
+	}
+	op.profilesMutex.Lock()
+	defer op.profilesMutex.Unlock()
+
+	return op.profileKeys[key]
+}
+
+// Builds the circuit of an isolated purpose when it is first used. Unlike
+// the shared purposes it never falls back to the data circuit, so traffic of
+// different isolation keys never shares a path.
+func (op *OnionProxy) isolatedCircuit(purpose string) (*circuit, error) {
+	op.isolatedCircuitMutex.Lock()
+	defer op.isolatedCircuitMutex.Unlock()
+
+	op.circuitsMutex.RLock()
+	circ, ok := op.circuits[purpose]
+	op.circuitsMutex.RUnlock()
+	if ok {
+		return circ, nil
+	}
+
+	// The spare starts at the proxy's guard, not a profile's
+	if op.profileOf(purpose) != nil || !op.reuseCircuit(purpose, op.chatDestinations(), false) {
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			return nil, err
+		}
+	}
+
+	op.circuitsMutex.RLock()
+	defer op.circuitsMutex.RUnlock()
+	if circ, ok := op.circuits[purpose]; ok {
+		return circ, nil
+	}
+	return nil, noCircuitError
+}
+
+// Rotates the isolated circuits used since the last rotation and drops the
+// others, whose sessions went quiet or away
+func (op *OnionProxy) rotateIsolatedCircuits() {
+	maxIdle := op.clientParams().MaxRotationInterval
+	op.dropIsolatedCircuits(func(circ *circuit) bool {
+		return circ.idleFor() >= maxIdle
+	})
+
+	op.circuitsMutex.RLock()
+	var rotate []string
+	for purpose := range op.circuits {
+		if isolated(purpose) {
+			rotate = append(rotate, purpose)
+		}
+	}
+	op.circuitsMutex.RUnlock()
+
+	for _, purpose := range rotate {
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			util.HandleNonFatalError("Could not create new "+purpose+" circuit", err)
+		}
+	}
+}
+
+// Drops the isolated circuits drop is true for. They are built again when
+// next used.
+func (op *OnionProxy) dropIsolatedCircuits(drop func(circ *circuit) bool) {
+	op.circuitsMutex.Lock()
+	var dropped []*circuit
+	for purpose, circ := range op.circuits {
+		if isolated(purpose) && drop(circ) {
+			delete(op.circuits, purpose)
+			dropped = append(dropped, circ)
+		}
+	}
+	op.circuitsMutex.Unlock()
+
+	for _, circ := range dropped {
+		op.retireCircuit(circ)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"../shared"
+)
+
+func TestParseIsolation(t *testing.T) {
+	for spec, want := range map[string]int{"": 0, "none": 0, "username": 1, "username, client": 2} {
+		if isolation, err := parseIsolation(spec); err != nil || len(isolation) != want {
+			t.Fatalf("%q parsed as %v, %v", spec, isolation, err)
+		}
+	}
+	if _, err := parseIsolation("username,device"); err == nil {
+		t.Fatal("an unknown isolation was accepted")
+	}
+}
+
+func TestIsolatedPurpose(t *testing.T) {
+	op := &OnionProxy{isolationSecret: []byte("secret")}
+	if purpose := op.isolatedPurpose(dataCircuit, "alice", "token", nil); purpose != dataCircuit {
+		t.Fatalf("without -isolate the purpose is %q", purpose)
+	}
+
+	op.isolation = []string{isolateUsername}
+	alice, bob := op.isolatedPurpose(dataCircuit, "alice", "one", nil), op.isolatedPurpose(dataCircuit, "bob", "one", nil)
+	if alice == bob || !isolated(alice) || basePurpose(alice) != dataCircuit {
+		t.Fatalf("alice uses %q and bob %q", alice, bob)
+	}
+	if again := op.isolatedPurpose(dataCircuit, "alice", "two", nil); again != alice {
+		t.Fatalf("another session of alice uses %q, want %q", again, alice)
+	}
+	if control := op.isolatedPurpose(controlCircuit, "alice", "one", nil); isolationKeyOf(control) != isolationKeyOf(alice) {
+		t.Fatal("a username's purposes have different isolation keys")
+	}
+
+	op.isolation = []string{isolateUsername, isolateClient}
+	if other := op.isolatedPurpose(dataCircuit, "alice", "two", nil); other == op.isolatedPurpose(dataCircuit, "alice", "one", nil) {
+		t.Fatal("isolated by client, two sessions of alice share a purpose")
+	}
+}
+
+func TestIsolatedCircuitIsNotShared(t *testing.T) {
+	data := testCircuit(t)
+	op := &OnionProxy{
+		circuits:        map[string]*circuit{dataCircuit: data},
+		sessions:        make(map[string]*session),
+		consensusCache:  newConsensusCache(""),
+		isolation:       []string{isolateUsername},
+		isolationSecret: []byte("secret"),
+	}
+	op.dirServer = testDirectoryClient(t, &testDirectory{err: errors.New("no routers")})
+	purpose := op.purposeFor(testSession(op, "alice"), dataCircuit)
+
+	// Without a circuit of its own it gets none, not the shared one
+	if circ, err := op.getCircuit(purpose); err == nil || circ == data {
+		t.Fatalf("an isolated purpose got circuit %v, %v", circ, err)
+	}
+
+	own := testCircuit(t)
+	own.id = 4
+	op.circuits[purpose] = own
+	if circ, err := op.getCircuit(purpose); err != nil || circ != own {
+		t.Fatalf("an isolated purpose got circuit %v, %v", circ, err)
+	}
+	op.dropIsolatedCircuits(func(circ *circuit) bool { return true })
+	if _, ok := op.circuits[purpose]; ok || op.circuits[dataCircuit] != data {
+		t.Fatalf("dropping isolated circuits left %v", op.circuits)
+	}
+}
+
+func TestCircuitStatusOfOtherSessionsIsHidden(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session), isolation: []string{isolateUsername}, isolationSecret: []byte("secret")}
+	alice, bob := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}, &OPServer{OnionProxy: op, sess: testSession(op, "bob")}
+	own := testCircuit(t)
+	for _, info := range hopsOf(own) {
+		info.pubKey = testRSAPublicKey(t)
+	}
+	op.circuits[op.purposeFor(alice.sess, dataCircuit)] = own
+
+	var statuses []shared.CircuitStatus
+	if err := alice.GetCircuitStatus("", &statuses); err != nil || len(statuses) != 1 {
+		t.Fatalf("alice sees %+v, %v", statuses, err)
+	}
+	if err := bob.GetCircuitStatus("all", &statuses); err != noSuchCircuitError {
+		t.Fatalf("bob sees %+v, %v", statuses, err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type KeepaliveError error
+
+// Keepalive configurations
+const (
+	defaultKeepaliveInterval time.Duration = 10 * time.Second
+	keepaliveTimeout         time.Duration = 5 * time.Second
+	keepaliveProbeSize       int           = 16 // bytes the exit echoes, like a short poll
+	keepaliveMisses          int           = 2  // probes failed in a row before a circuit counts as dead
+)
+
+var (
+	// Keepalive Errors
+	keepaliveTimeoutError KeepaliveError = errors.New("Keepalive probe was not answered in time")
+	keepaliveAnswerError  KeepaliveError = errors.New("Exit node answered the keepalive probe with the wrong number of bytes")
+
+	keepaliveInterval = defaultKeepaliveInterval // set by -keepalive-interval, 0 sends no probes
+)
+
+// Sends a probe along every idle circuit each keepaliveInterval, and replaces
+// circuits that missed keepaliveMisses probes in a row, before a message is
+// lost on them
+func (op *OnionProxy) keepCircuitsAlive() {
+	misses := make(map[*circuit]int)
+	for {
+		util.Time.Sleep(keepaliveInterval)
+
+		for circ, purposes := range op.circuitsInUse() {
+			if circ.idleFor() < keepaliveInterval || !circ.probeable() {
+				delete(misses, circ)
+				continue
+			}
+			err := circ.probe()
+			circ.noteError(err)
+			if err == nil {
+				delete(misses, circ)
+				continue
+			}
+			misses[circ]++
+			util.OutLog.Printf("Circuit %v missed keepalive probe %d of %d: %v\n", circ.id, misses[circ], keepaliveMisses, err)
+			if misses[circ] >= keepaliveMisses {
+				delete(misses, circ)
+				op.replaceDeadCircuit(circ, purposes)
+			}
+		}
+
+		// Forget circuits that were rotated away meanwhile
+		current := op.circuitsInUse()
+		for circ := range misses {
+			if _, ok := current[circ]; !ok {
+				delete(misses, circ)
+			}
+		}
+	}
+}
+
+// The circuits in use and the purposes each serves
+func (op *OnionProxy) circuitsInUse() map[*circuit][]string {
+	op.circuitsMutex.RLock()
+	defer op.circuitsMutex.RUnlock()
+
+	circuits := make(map[*circuit][]string)
+	for purpose, circ := range op.circuits {
+		circuits[circ] = append(circuits[circ], purpose)
+	}
+	return circuits
+}
+
+// Whether the exit answers probes. Exits that don't would have to ask the
+// IRC server, so their circuits are left to fail on the next real cell.
+func (c *circuit) probeable() bool {
+	return c.pingable() || c.ORInfoByHopNum[len(c.ORInfoByHopNum)-1].capabilities.Has(shared.CapabilityMeasurement)
+}
+
+// Pings the exit, or sends it a small measure cell on circuits through
+// routers from before ping cells. Either is answered without contacting the
+// IRC server.
+func (c *circuit) probe() error {
+	if c.pingable() {
+		_, err := c.ping()
+		return err
+	}
+	_, err := c.probeHop(len(c.ORInfoByHopNum) - 1)
+	return err
+}
+
+// Sends a small measure cell that the hop at hopNum answers as if it were
+// the exit, and returns how long the answer took
+func (c *circuit) probeHop(hopNum int) (time.Duration, error) {
+	req := shared.MeasureRequest{Data: make([]byte, keepaliveProbeSize)}
+	if _, err := util.Random.Read(req.Data); err != nil {
+		return 0, shared.InternalError("Could not generate keepalive probe", err)
+	}
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return 0, shared.EncodingError("keepalive probe", err)
+	}
+	// Probes don't keep a circuit from counting as idle
+	onion, err := c.onionizeTo(hopNum, shared.CommandMeasure, jsonData)
+	if err != nil {
+		return 0, err
+	}
+
+	// Not through SendPollingOnion, which would wait for as long as the
+	// guard keeps the call open
+	var reply shared.RelayReply
+	started := time.Now()
+	call := c.goCell(shared.RelayPoll, shared.Cell{CircuitId: c.id, Data: onion}, &reply)
+	timeout := time.NewTimer(keepaliveTimeout)
+	defer timeout.Stop()
+	select {
+	case <-call.Done:
+	case <-timeout.C:
+		return 0, keepaliveTimeoutError
+	}
+	if call.Error != nil {
+		return 0, call.Error
+	}
+	if reply.Polling == nil || len(reply.Polling.Measurement) != keepaliveProbeSize {
+		return 0, keepaliveAnswerError
+	}
+	return time.Since(started), nil
+}
+
+// Builds new circuits for the purposes a dead circuit served. The stream,
+// anonymous and isolated circuits are only dropped, and built again when
+// next needed.
+func (op *OnionProxy) replaceDeadCircuit(dead *circuit, purposes []string) {
+	util.ErrLog.Printf("[WARNING] Circuit %v through exit %s missed %d keepalive probes, replacing it\n", dead.id, dead.exitAddress(), keepaliveMisses)
+
+	dropped := false
+	for _, purpose := range purposes {
+		op.circuitsMutex.Lock()
+		if op.circuits[purpose] != dead {
+			op.circuitsMutex.Unlock()
+			continue
+		}
+		if purpose == streamCircuit || purpose == anonymousCircuit || isolated(purpose) {
+			delete(op.circuits, purpose)
+			dropped = true
+			op.circuitsMutex.Unlock()
+			continue
+		}
+		op.circuitsMutex.Unlock()
+
+		// Retires the dead circuit once no purpose uses it
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			util.HandleNonFatalError("Could not replace dead "+purpose+" circuit", err)
+		}
+	}
+
+	if dropped {
+		op.retireCircuit(dead)
+	}
+}
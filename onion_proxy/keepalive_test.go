@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"../shared"
+)
+
+// Stands in for a guard whose exit answers probes with answer bytes
+type testProbedGuard struct {
+	answer int
+	polls  int
+}
+
+func (g *testProbedGuard) DecryptPollingCell(cell shared.Cell, resp *shared.PollingResponse) error {
+	g.polls++
+	resp.Measurement = make([]byte, g.answer)
+	return nil
+}
+
+func TestProbe(t *testing.T) {
+	circ := testCircuit(t)
+	if circ.probeable() {
+		t.Fatal("an exit that doesn't answer measurements was probed")
+	}
+	circ.ORInfoByHopNum[2].capabilities = shared.CapabilityMeasurement
+	if !circ.probeable() {
+		t.Fatal("an exit that answers measurements wasn't probed")
+	}
+
+	guard := &testProbedGuard{answer: keepaliveProbeSize}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	idle := circ.idleFor()
+	if err := circ.probe(); err != nil || guard.polls != 1 {
+		t.Fatalf("a probe answered in full gave %v after %d polls", err, guard.polls)
+	}
+	if circ.idleFor() < idle {
+		t.Fatal("a probe kept the circuit from counting as idle")
+	}
+	guard.answer = 3
+	if err := circ.probe(); err != keepaliveAnswerError {
+		t.Fatalf("a short answer gave %v, want %v", err, keepaliveAnswerError)
+	}
+}
+
+func TestReplaceDeadCircuit(t *testing.T) {
+	dead, other := testCircuit(t), testCircuit(t)
+	dead.guardNodeServer = testGuardClient(t, &testGuard{})
+	op := &OnionProxy{
+		circuits:       map[string]*circuit{dataCircuit: dead, streamCircuit: dead, controlCircuit: other},
+		sessions:       make(map[string]*session),
+		consensusCache: newConsensusCache(""),
+	}
+	// The data circuit can't be built again, which only logs
+	op.dirServer = testDirectoryClient(t, &testDirectory{err: errors.New("no routers")})
+
+	probed := op.circuitsInUse()
+	if len(probed) != 2 || len(probed[dead]) != 2 || len(probed[other]) != 1 {
+		t.Fatalf("probing %v", probed)
+	}
+	op.replaceDeadCircuit(dead, probed[dead])
+	if _, ok := op.circuits[streamCircuit]; ok {
+		t.Fatal("the dead stream circuit was kept")
+	}
+	if op.circuits[controlCircuit] != other {
+		t.Fatal("a circuit that answered was replaced")
+	}
+}
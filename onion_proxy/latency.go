@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Latency configurations
+const (
+	defaultLatencyInterval time.Duration = 30 * time.Second
+	latencyWeight          float64       = 0.3 // of a new sample in a relay's average latency
+	slowRelaySamples       int           = 3   // samples of a relay before it can count as slow
+)
+
+// Latency of a relay, averaged over every circuit through it
+type relayLatency struct {
+	average time.Duration
+	samples int
+}
+
+// Latest latency of each hop of a circuit
+type hopLatencies struct {
+	sync.Mutex
+	byHop []time.Duration // 0 for hops not measured yet
+}
+
+var (
+	latencyInterval  = defaultLatencyInterval // set by -latency-interval, 0 measures nothing
+	slowRelayLatency time.Duration            // set by -slow-relay-latency, 0 never avoids relays
+
+	relayLatencies = struct {
+		sync.Mutex
+		byAddress map[string]*relayLatency
+	}{byAddress: make(map[string]*relayLatency)}
+)
+
+// Measures the latency of every hop of the circuits in use each
+// latencyInterval
+func (op *OnionProxy) measureLatencies() {
+	for {
+		util.Time.Sleep(latencyInterval)
+
+		for circ := range op.circuitsInUse() {
+			circ.measureLatencies()
+		}
+	}
+}
+
+// Sends a probe to each hop in turn, which answers it as if it were the
+// exit. The hop's latency is the round trip to it less the round trip to
+// the hop before: the link into it and the time it took to answer.
+func (c *circuit) measureLatencies() {
+	for _, info := range c.ORInfoByHopNum {
+		if !info.capabilities.Has(shared.CapabilityMeasurement) {
+			return
+		}
+	}
+
+	latencies := make([]time.Duration, len(c.ORInfoByHopNum))
+	var before time.Duration
+	for hopNum := range latencies {
+		rtt, err := c.probeHop(hopNum)
+		if err != nil {
+			c.noteError(err)
+			util.OutLog.Printf("Could not measure the latency of hop %d of circuit %v: %v\n", hopNum+1, c.id, err)
+			return
+		}
+		// Round trips vary, so the difference may be below zero for a
+		// fast hop; it counts as the shortest latency measured
+		latencies[hopNum] = time.Microsecond
+		if rtt-before > latencies[hopNum] {
+			latencies[hopNum] = rtt - before
+		}
+		before = rtt
+		noteRelayLatency(c.ORInfoByHopNum[hopNum].address, latencies[hopNum])
+	}
+
+	c.latencies.Lock()
+	c.latencies.byHop = latencies
+	c.latencies.Unlock()
+}
+
+func (c *circuit) hopLatencies() []time.Duration {
+	c.latencies.Lock()
+	defer c.latencies.Unlock()
+	return append([]time.Duration(nil), c.latencies.byHop...)
+}
+
+func noteRelayLatency(address string, latency time.Duration) {
+	relayLatencies.Lock()
+	defer relayLatencies.Unlock()
+
+	relay, ok := relayLatencies.byAddress[address]
+	if !ok {
+		relay = &relayLatency{average: latency}
+		relayLatencies.byAddress[address] = relay
+	}
+	relay.average = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(relay.average))
+	relay.samples++
+}
+
+// Relays whose average latency is above slowRelayLatency, by address
+func slowRelays() map[string]bool {
+	slow := make(map[string]bool)
+	if slowRelayLatency <= 0 {
+		return slow
+	}
+
+	relayLatencies.Lock()
+	defer relayLatencies.Unlock()
+	for address, relay := range relayLatencies.byAddress {
+		if relay.samples >= slowRelaySamples && relay.average > slowRelayLatency {
+			slow[address] = true
+		}
+	}
+	return slow
+}
+
+// The candidates and exits that aren't slow relays, or all of them if too
+// few are left for a circuit of hops
+func withoutSlowRelays(candidates []shared.OnionRouterInfo, exits []shared.OnionRouterInfo, hops int) ([]shared.OnionRouterInfo, []shared.OnionRouterInfo) {
+	slow := slowRelays()
+	if len(slow) == 0 {
+		return candidates, exits
+	}
+
+	var fastCandidates, fastExits []shared.OnionRouterInfo
+	for _, info := range candidates {
+		if !slow[info.Address] {
+			fastCandidates = append(fastCandidates, info)
+		}
+	}
+	for _, info := range exits {
+		if !slow[info.Address] {
+			fastExits = append(fastExits, info)
+		}
+	}
+	if len(fastCandidates) < hops || len(fastExits) == 0 {
+		return candidates, exits
+	}
+	return fastCandidates, fastExits
+}
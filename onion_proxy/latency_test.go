@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func resetRelayLatencies() {
+	relayLatencies.Lock()
+	relayLatencies.byAddress = make(map[string]*relayLatency)
+	relayLatencies.Unlock()
+}
+
+func TestOnionizeToMiddleHop(t *testing.T) {
+	circ := testCircuit(t)
+	onion, err := circ.onionizeTo(1, shared.CommandMeasure, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := peelLayer(t, *circ.ORInfoByHopNum[0].sharedKey, onion)
+	if guard.IsExitNode || guard.NextAddress != "127.0.0.1:8002" {
+		t.Fatalf("the guard passes the onion on as %+v", guard)
+	}
+	if middle := peelLayer(t, *circ.ORInfoByHopNum[1].sharedKey, guard.Data); !middle.IsExitNode || middle.Command != shared.CommandMeasure {
+		t.Fatalf("the middle hop got %+v", middle)
+	}
+}
+
+func TestMeasureLatencies(t *testing.T) {
+	defer resetRelayLatencies()
+	resetRelayLatencies()
+	circ := testCircuit(t)
+	guard := &testProbedGuard{answer: keepaliveProbeSize}
+	circ.guardNodeServer = testGuardClient(t, guard)
+
+	// Hops that don't answer measure cells aren't probed
+	circ.measureLatencies()
+	if guard.polls != 0 || len(circ.hopLatencies()) != 0 {
+		t.Fatalf("probed %d times, measured %v", guard.polls, circ.hopLatencies())
+	}
+
+	for _, info := range circ.ORInfoByHopNum {
+		info.capabilities, info.pubKey = shared.CapabilityMeasurement, testRSAPublicKey(t)
+	}
+	circ.measureLatencies()
+	latencies := circ.hopLatencies()
+	if guard.polls != 3 || len(latencies) != 3 {
+		t.Fatalf("probed %d times, measured %v", guard.polls, latencies)
+	}
+	for hopNum, latency := range latencies {
+		if latency <= 0 {
+			t.Fatalf("hop %d has latency %v", hopNum, latency)
+		}
+	}
+	if status := circ.status(nil); status.Hops[2].Latency != latencies[2] {
+		t.Fatalf("the exit's latency is reported as %v", status.Hops[2].Latency)
+	}
+}
+
+func TestWithoutSlowRelays(t *testing.T) {
+	defer func() { slowRelayLatency = 0 }()
+	defer resetRelayLatencies()
+	resetRelayLatencies()
+	candidates := []shared.OnionRouterInfo{{Address: "127.0.0.1:8001"}, {Address: "127.0.0.1:8002"}, {Address: "127.0.0.1:8003"}, {Address: "127.0.0.1:8004"}}
+	exits := candidates[2:]
+
+	for i := 0; i < slowRelaySamples; i++ {
+		noteRelayLatency("127.0.0.1:8001", time.Second)
+		noteRelayLatency("127.0.0.1:8003", 10*time.Millisecond)
+	}
+	noteRelayLatency("127.0.0.1:8002", time.Second) // too few samples to count as slow
+	if slow := slowRelays(); len(slow) != 0 {
+		t.Fatalf("without -slow-relay-latency %v are slow", slow)
+	}
+
+	slowRelayLatency = 100 * time.Millisecond
+	if slow := slowRelays(); len(slow) != 1 || !slow["127.0.0.1:8001"] {
+		t.Fatalf("%v are slow", slow)
+	}
+	if fast, fastExits := withoutSlowRelays(candidates, exits, 3); len(fast) != 3 || len(fastExits) != 2 {
+		t.Fatalf("left %v and exits %v", fast, fastExits)
+	}
+	// Slow relays are used rather than building no circuit
+	if fast, _ := withoutSlowRelays(candidates, exits, 4); len(fast) != 4 {
+		t.Fatalf("for 4 hops left %v", fast)
+	}
+}
@@ -1,86 +1,247 @@
 package main
 
 import (
-	"crypto/aes"
+	"context"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/elliptic"
-	"crypto/rand"
 	"crypto/rsa"
-	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"net"
-	"net/rpc"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"crypto/ecdsa"
 	"errors"
 
 	"../shared"
 	"../util"
+	"../util/faults"
+	"../util/padding"
+	"../util/retry"
+	"../util/secmem"
+	"../util/transport"
 )
 
 type NotTrustedDirectoryServerError error
+type NoBuildAttemptedError error
+type TooFewHopsError error
+type UnsupportedByExitError error
+type PartlyForgottenError error
 
+// Serves one client connection
 type OPServer struct {
 	OnionProxy *OnionProxy
+
+	sessMutex sync.Mutex
+	sess      *session
 }
 
 type OnionProxy struct {
-	addr            string
-	username        string
-	circuitId       uint32
-	ircServerAddr   string
-	ircServer       *rpc.Client
-	ORInfoByHopNum  map[int]*orInfo
-	dirServer       *rpc.Client
-	lastMessageId   uint32
-	guardNodeServer *rpc.Client
+	addr          string
+	userToken     string // from -user-token, shared by the sessions of this proxy if set
+	deviceId      string // tells this proxy apart from the user's other devices
+	ircServerAddr string
+	namespace     string
+	dirServer     *directoryServers
+
+	consensusCache *consensusCache
+
+	paramsMutex     sync.RWMutex
+	consensusParams shared.ClientParams // recommended by the directory server
+	paramOverrides  shared.ClientParams // from flags, zero fields follow the consensus
+
+	paddingMachines map[string]padding.Machine // by padding class, builtin and from -padding-machines
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]*session // by session token
+
+	startMutex sync.Mutex
+	started    bool // circuits are built and rotating
+
+	circuitsMutex sync.RWMutex
+	circuits      map[string]*circuit // by purpose
+
+	streamCircuitMutex    sync.Mutex // held while picking or building the stream circuit
+	anonymousCircuitMutex sync.Mutex // and the anonymous circuit
+	isolatedCircuitMutex  sync.Mutex // and isolated circuits
+
+	isolation       []string // from -isolate, what keeps sessions off each other's circuits; nil shares them
+	isolationSecret []byte   // keys the isolation keys in purposes
+
+	lastBuildMutex   sync.Mutex // builds of different purposes run at once
+	lastBuildReceipt *shared.CircuitBuildReceipt
+	buildTimes       *buildTimes // recent build times, and the timeout they give
+
+	signingKey ed25519.PrivateKey // from -signing-key, shared by the sessions of this proxy if set
+
+	registrationToken string // from -registration-token, spent on the first username registered with it
+
+	state *stateFile // from -state, nil keeps nothing across restarts
+
+	roster *roster // from -roster, nil keeps no contacts
+
+	profilesDir   string // from -profiles, "" keeps no profiles
+	profilesMutex sync.Mutex
+	profiles      map[string]*profile // opened since the proxy started, by name
+	profileKeys   map[string]*profile // by the isolation key of their circuits
+
+	redundant bool // from -redundant, chat messages also go over the redundant circuit
+
+	minHops       int // shortest circuit accepted when relays are scarce, 0 never shortens
+	excludeRelays *relayFilter
+	onlyRelays    *relayFilter // any relay may be used if empty
+	transport     string       // reach ORs over this transport where they offer it, tcp otherwise
+	bridges       bridgeLinks  // links to ORs shared out of band, used before transport
+	linkFamily    string       // dial dual-stack ORs on their address in this family, if set
 }
 
 type orInfo struct {
-	address   string
-	pubKey    *rsa.PublicKey
-	sharedKey *[]byte
+	address         string
+	pubKey          *rsa.PublicKey
+	sharedKey       *[]byte
+	block           cipher.Block // expanded from sharedKey once, used for every cell
+	protocolVersion int
+	circuitId       uint32 // id on the link into this hop, chosen by the OR with per-link ids
+	linkTransport   string // transport and address the OP dials this hop on
+	linkAddress     string
+	exitPolicy      shared.ExitPolicy   // as the hop published it when the circuit was built
+	capabilities    shared.Capabilities // from the circuit handshake, or the descriptor for older ORs
+	destroyToken    []byte              // shared.DestroyToken of sharedKey, told to the hop before
 }
 
 const (
-	directoryServerPubKey string = "0449e30da789d5b12a9487a96d70d69b6b8cbd6821d7a647f35c18a8d5f0969054ae3130e7a2a813363eb578747bc77048b700badea328df20ce68a58fcd0e4166f538f9393e0b4072d069cc4cc631271660dc5ebebb20531f11eeb4bd5aa6a5ca"
+	maxThrottleWait       time.Duration = 30 * time.Second // a throttled message is held this long at most before its send fails
+	fullCircuitHops       int           = 3                // hops in a circuit when enough relays are online
+	directoryServerPubKey string        = "0449e30da789d5b12a9487a96d70d69b6b8cbd6821d7a647f35c18a8d5f0969054ae3130e7a2a813363eb578747bc77048b700badea328df20ce68a58fcd0e4166f538f9393e0b4072d069cc4cc631271660dc5ebebb20531f11eeb4bd5aa6a5ca"
 )
 
 var (
+	// Retries of messages with a deadline, until the deadline passes
+	deadlineRetryPolicy = retry.Policy{
+		InitialDelay: 200 * time.Millisecond,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+
 	notTrustedDirectoryServerError NotTrustedDirectoryServerError = errors.New("Circuit received from non-trusted directory server")
+	noBuildAttemptedError          NoBuildAttemptedError          = errors.New("No circuit has been built yet")
+	tooFewHopsError                TooFewHopsError                = errors.New("Directory server returned fewer hops than allowed")
 )
 
 // Example Commands
 // go run onion_proxy.go localhost:12345 127.0.0.1:7000 127.0.0.1:9000
+// go run onion_proxy.go -namespace=uni localhost:12345 127.0.0.1:7000 127.0.0.1:9000
+// go run *.go -consensus-cache consensus.cache 1.2.3.4:12345,5.6.7.8:12345 127.0.0.1:7000 127.0.0.1:9000
 
 func main() {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{}) // TODO: this may be diff for rsa key?
 
 	// Command line input parsing
+	namespace := flag.String("namespace", shared.DefaultNamespace, "IRC server namespace to chat in")
+	minHops := flag.Int("min-hops", 0, "accept circuits down to this many hops when too few relays are online")
+	excludeRelays := flag.String("exclude-relays", "", "comma separated relays never to use: ip:port, fingerprint or {country}")
+	onlyRelays := flag.String("only-relays", "", "comma separated relays to build circuits from exclusively: ip:port, fingerprint or {country}")
+	userToken := flag.String("user-token", os.Getenv("TORCHAT_USER_TOKEN"), "secret shared by all devices of a user so they can use the same username (env TORCHAT_USER_TOKEN)")
+	deviceId := flag.String("device", "", "name of this device among the user's devices (random if empty)")
+	var overrides shared.ClientParams
+	flag.DurationVar(&overrides.MinPollInterval, "poll-interval", 0, "shortest interval between polls of the IRC server (0 follows the consensus)")
+	flag.StringVar(&overrides.PaddingClass, "padding", "", "padding class for new circuits (empty follows the consensus)")
+	paddingMachinesPath := flag.String("padding-machines", "", "JSON file of padding machines to add to the builtin ones")
+	flag.DurationVar(&overrides.MinRotationInterval, "rotation-min", 0, "shortest circuit lifetime (0 follows the consensus)")
+	flag.DurationVar(&overrides.MaxRotationInterval, "rotation-max", 0, "longest circuit lifetime (0 follows the consensus)")
+	healthAddr := util.HealthFlag()
+	faultSpec := faults.Flag()
+	bridges := make(bridgeLinks)
+	flag.Var(bridges, "bridge", "reach an onion router over a link shared out of band, as or-ip:port=transport:address (repeatable)")
+	linkTransport := flag.String("transport", transport.TCP, "transport to reach onion routers over where they offer it, tcp otherwise")
+	forwards := make(streamForwards)
+	flag.Var(forwards, "forward", "carry connections to a local port through the onion network, as local-ip:port=host:port (repeatable)")
+	socksAddr := flag.String("socks", "", "ip:port to serve a SOCKS5 proxy on whose connections go through the onion network (disabled if empty)")
+	linkFamily := flag.String("link-family", "", "dial dual-stack onion routers over ipv4 or ipv6 (their registered address if empty)")
+	flag.BoolVar(&distinctSubnets, "distinct-subnets", true, "when picking paths locally, never use two ORs in the same IPv4 /16 or IPv6 /32")
+	chatServerName := flag.String("chat-server", "", "without an irc-server argument, the advertised chat server to use by default (the first if empty)")
+	shuffleDirectories := flag.Bool("shuffle-directories", false, "try the directory servers in random order instead of the order given")
+	consensusCachePath := flag.String("consensus-cache", "", "file to keep the last consensus in, used while no directory server is reachable (memory only if empty)")
+	signingKeyPath := flag.String("signing-key", "", "file with the key messages are signed with, created if missing; share it between a user's devices like -user-token (a new key per session if empty)")
+	isolate := flag.String("isolate", "none", "give sessions circuits of their own by username, client or both (comma separated), or share them (none)")
+	redundant := flag.Bool("redundant", false, "send every chat message over two circuits without relays in common, for flaky relays, at twice the bandwidth")
+	rosterPath := flag.String("roster", "", "file to keep contacts and their pinned keys in, encrypted with the -signing-key (no contacts if empty)")
+	rosterSync := flag.Bool("roster-sync", false, "sync the -roster between the user's devices through the chat server, which only sees it encrypted")
+	profilesDir := flag.String("profiles", "", "directory of identity profiles clients connect with by name and passphrase, each in its own encrypted directory (none if empty)")
+	statePath := flag.String("state", "", "file to keep sessions, pending messages and the entry guard in across restarts (nothing is kept if empty)")
+	registrationToken := flag.String("registration-token", "", "token from the chat server operator to register usernames with where the namespace requires one")
+	flag.DurationVar(&latencyInterval, "latency-interval", defaultLatencyInterval, "measure the latency of every hop of the circuits in use this often (0 disables)")
+	flag.DurationVar(&slowRelayLatency, "slow-relay-latency", 0, "leave relays averaging a hop latency above this out of locally picked paths (0 never does)")
+	flag.DurationVar(&keepaliveInterval, "keepalive-interval", defaultKeepaliveInterval, "probe idle circuits this often and replace those that stop answering (0 disables)")
+	buildTimeout := flag.Duration("build-timeout", 0, "abandon circuit builds taking longer than this (0 adapts to the measured build times)")
+	geoIPPath := flag.String("geoip", "", "file of \"cidr country\" lines used to match {country} relay filters")
+	seed := util.DeterministicFlag()
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
 	flag.Parse()
-	if len(flag.Args()) != 3 {
-		fmt.Fprintln(os.Stderr, "go run onion_proxy.go [dir-server ip:port] [irc-server ip:port] [op ip:port]")
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+	faults.Setup(*faultSpec)
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentOnionProxy, *showFeatures))
+		return
+	}
+	if len(flag.Args()) != 2 && len(flag.Args()) != 3 {
+		fmt.Fprintln(os.Stderr, "go run onion_proxy.go [-namespace name] [-min-hops n] [-user-token secret] [-device name] [-exclude-relays list] [-only-relays list] [-geoip file] [-transport name] [-bridge or=transport:address] [-link-family ipv6] [-distinct-subnets=true] [-forward local=host:port] [-socks ip:port] [-chat-server name] [-shuffle-directories] [-consensus-cache path] [-build-timeout d] [-padding class] [-padding-machines path] [-signing-key path] [-roster path] [-roster-sync] [-profiles dir] [-redundant] [-isolate username,client] [-registration-token secret] [-state path] [-health-addr ip:port] [-faults spec] [-deterministic-seed n] [dir-server ip:port[,ip:port...]] [[irc-server ip:port]] [op ip:port]")
 		os.Exit(1)
 	}
+	opAddr := flag.Arg(flag.NArg() - 1)
+	util.SetupDeterministic(*seed, opAddr)
+	if _, err := transport.Lookup(*linkTransport); err != nil {
+		util.HandleFatalError("Invalid -transport", err)
+	}
+	if *linkFamily != "" && *linkFamily != shared.FamilyIPv4 && *linkFamily != shared.FamilyIPv6 {
+		util.ErrLog.Fatalf("[FATAL ERROR] -link-family must be %s or %s, got %q\n", shared.FamilyIPv4, shared.FamilyIPv6, *linkFamily)
+	}
 
-	dirServerAddr := flag.Arg(0)
-	ircServerAddr := flag.Arg(1)
-	opAddr := flag.Arg(2)
+	isolation, err := parseIsolation(*isolate)
+	util.HandleFatalError("Invalid -isolate", err)
+	isolationSecret := make([]byte, 32)
+	_, err = util.Random.Read(isolationSecret)
+	util.HandleFatalError("Could not generate isolation secret", err)
 
-	// Establish RPC channel to server
-	dirServer, err := rpc.Dial("tcp", dirServerAddr)
-	util.HandleFatalError("Could not dial directory server", err)
+	if *deviceId == "" {
+		token, err := newUserToken()
+		util.HandleFatalError("Could not generate device id", err)
+		*deviceId = token[:8]
+	}
+
+	paddingMachines, err := padding.Load(*paddingMachinesPath)
+	util.HandleFatalError("Could not load padding machines", err)
+	if _, ok := paddingMachines[overrides.PaddingClass]; overrides.PaddingClass != "" && !ok {
+		util.ErrLog.Fatalf("[FATAL ERROR] No padding machine %q, known: %s\n", overrides.PaddingClass, strings.Join(padding.Names(paddingMachines), ", "))
+	}
 
-	ircServer, err := rpc.Dial("tcp", ircServerAddr)
-	util.HandleFatalError("Could not dial irc server", err)
+	if *geoIPPath != "" {
+		ranges, err := loadGeoIP(*geoIPPath)
+		util.HandleFatalError("Could not load GeoIP file", err)
+		geoIP = ranges
+	}
+
+	dirServers := newDirectoryServers(flag.Arg(0), *shuffleDirectories)
+
+	// Only exit nodes dial the IRC server, so the address is just checked.
+	// Without one, the directory server's list of chat servers is used.
+	var ircServerAddr string
+	if flag.NArg() == 3 {
+		ircServerAddr, err = shared.CanonicalAddress(flag.Arg(1))
+		util.HandleFatalError("Invalid irc server address", err)
+	}
 
 	addr, err := net.ResolveTCPAddr("tcp", opAddr)
 	util.HandleFatalError("Could not resolve onion_proxy address", err)
@@ -91,277 +252,858 @@ func main() {
 	util.OutLog.Println("OP Address: ", opAddr)
 	util.OutLog.Println("Full Address: ", inbound.Addr().String())
 
-	ORInfoByHopNum := make(map[int]*orInfo)
 	// Create OnionProxy instance
 	onionProxy := &OnionProxy{
-		addr:           opAddr,
-		dirServer:      dirServer,
-		ircServerAddr:  ircServerAddr,
-		ORInfoByHopNum: ORInfoByHopNum,
-		lastMessageId:  uint32(0),
-		ircServer:      ircServer,
+		addr:            opAddr,
+		dirServer:       dirServers,
+		consensusCache:  newConsensusCache(*consensusCachePath),
+		buildTimes:      newBuildTimes(*buildTimeout),
+		ircServerAddr:   ircServerAddr,
+		namespace:       *namespace,
+		minHops:         *minHops,
+		userToken:       *userToken,
+		deviceId:        *deviceId,
+		excludeRelays:   parseRelayFilter(*excludeRelays),
+		onlyRelays:      parseRelayFilter(*onlyRelays),
+		transport:       *linkTransport,
+		bridges:         bridges,
+		linkFamily:      *linkFamily,
+		circuits:        make(map[string]*circuit),
+		sessions:        make(map[string]*session),
+		paramOverrides:  overrides,
+		paddingMachines: paddingMachines,
+
+		registrationToken: *registrationToken,
+		redundant:         *redundant,
+		isolation:         isolation,
+		isolationSecret:   isolationSecret,
+		profilesDir:       *profilesDir,
+		profiles:          make(map[string]*profile),
+		profileKeys:       make(map[string]*profile),
+	}
+	if *statePath != "" {
+		onionProxy.state = newStateFile(*statePath)
+	}
+	if *signingKeyPath != "" {
+		onionProxy.signingKey, err = loadSigningKey(*signingKeyPath)
+		util.HandleFatalError("Could not load signing key", err)
+	}
+	if *rosterPath != "" {
+		if onionProxy.signingKey == nil {
+			util.ErrLog.Fatalln("[FATAL ERROR] -roster needs -signing-key, which its encryption key is derived from")
+		}
+		onionProxy.roster, err = openRoster(*rosterPath, onionProxy.signingKey, *rosterSync)
+		util.HandleFatalError("Could not open roster", err)
+	}
+	if *profilesDir != "" {
+		if onionProxy.roster != nil {
+			util.ErrLog.Fatalln("[FATAL ERROR] -profiles can't be used with -roster, whose contacts every profile would share")
+		}
+		util.HandleFatalError("Could not create profiles directory", os.MkdirAll(*profilesDir, 0700))
 	}
 
-	// Start listening for RPC calls from ORs
-	opServer := new(OPServer)
-	opServer.OnionProxy = onionProxy
+	// Wait for a directory server, unless a cached consensus will do
+	err = retry.Do(context.Background(), retry.Startup, func() error {
+		_, err := onionProxy.fetchConsensus(context.Background())
+		return err
+	})
+	util.HandleFatalError("Could not reach a directory server", err)
 
-	onionProxyServer := rpc.NewServer()
-	onionProxyServer.Register(opServer)
+	if ircServerAddr == "" {
+		ircServerAddr, err = onionProxy.discoverChatServer(*chatServerName)
+		util.HandleFatalError("Could not find a chat server through the directory server", err)
+		onionProxy.ircServerAddr = ircServerAddr
+	}
+	util.OutLog.Println("Chat server: ", ircServerAddr)
+
+	if onionProxy.state != nil {
+		restored, err := onionProxy.loadState()
+		util.HandleFatalError("Could not load proxy state", err)
+		go onionProxy.persistState()
+		go onionProxy.resumeSessions(restored)
+	}
+	go onionProxy.expireSessions()
+	if *healthAddr != "" {
+		go util.ServeHealth(*healthAddr, onionProxy.healthChecks())
+	}
+
+	for localAddr, destination := range forwards {
+		go onionProxy.serveForward(localAddr, destination)
+	}
+	if *socksAddr != "" {
+		go onionProxy.serveSOCKS(*socksAddr)
+	}
 
-	util.HandleFatalError("Listen error", err)
 	util.OutLog.Printf("OPServer started. Receiving on %s\n", opAddr)
 
-	// new OP connection for each incoming client
+	// A session for each incoming client
 	for {
-		conn, _ := inbound.Accept()
-		go onionProxyServer.ServeConn(conn)
+		conn, err := inbound.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Could not accept client", err)
+			continue
+		}
+		go onionProxy.serveClient(conn)
 	}
 
 }
 
+// Sets the username the session chats as, building the proxy's circuits if
+// this is its first client
 func (s *OPServer) Connect(username string, ack *bool) error {
-	// Register username to OP
-	s.OnionProxy.username = username
+	// Devices sharing a user token can use the same username at once
+	userToken := s.OnionProxy.userToken
+	if userToken == "" {
+		var err error
+		if userToken, err = newUserToken(); err != nil {
+			return err
+		}
+	}
+
+	signingKey, err := s.OnionProxy.sessionSigningKey()
+	if err != nil {
+		return err
+	}
+	if err := s.connect(username, userToken, s.OnionProxy.deviceId, signingKey, nil); err != nil {
+		return err
+	}
+	*ack = true
+	return nil
+}
+
+// Claims username for the session and sets it up to chat as it, with p the
+// profile it connected with, if any
+func (s *OPServer) connect(username string, userToken string, deviceId string, signingKey ed25519.PrivateKey, p *profile) error {
+	sess := s.session()
+
+	encryptionKey, err := shared.EncryptionKeyFromSigningKey(signingKey)
+	if err != nil {
+		return err
+	}
 
 	util.OutLog.Printf("Client username: %s \n", username)
 
-	// First, wait to establish first new circuit
-	if err := s.OnionProxy.GetNewCircuit(); err != nil {
+	if err := s.OnionProxy.start(); err != nil {
 		util.HandleNonFatalError("Could not create new circuit", err)
 		return err
 	}
 
-	// Then, start loop to establish new circuit every 2 mins
-	go s.OnionProxy.GetNewCircuitEveryTwoMinutes()
+	// Claim the username so nobody else can use it while we are connected
+	req := shared.UserNameRequest{
+		IRCServerAddr: s.OnionProxy.ircServerAddr,
+		Namespace:     s.OnionProxy.namespace,
+		Username:      username,
+		UserToken:     userToken,
+		SigningKey:    signingKey.Public().(ed25519.PublicKey),
+		EncryptionKey: encryptionKey.PublicKey().Bytes(),
+	}
+	if err := s.OnionProxy.registerUserName(s.OnionProxy.isolatedPurpose(controlCircuit, username, sess.token, p), req); err != nil {
+		util.HandleNonFatalError("Could not register username", err)
+		return err
+	}
+
+	deviceId = s.OnionProxy.sessionDeviceId(sess, username, deviceId)
+	sess.Lock()
+	sess.profile = p
+	sess.username = username
+	sess.userToken = userToken
+	sess.deviceId = deviceId
+	sess.signingKey = signingKey
+	sess.encryptionKey = encryptionKey
+	sess.Unlock()
+
+	// Tokens are handed out to registered users, so get some while we are
+	go func() {
+		if err := s.OnionProxy.fetchPostingTokens(sess); err != nil {
+			util.OutLog.Printf("No posting tokens for anonymous messages: %v\n", err)
+		}
+	}()
+	go s.OnionProxy.uploadPrekeys(sess, true)
+	go s.OnionProxy.syncRoster(sess)
 	return nil
 }
 
-func (op *OnionProxy) GetNewCircuit() error {
-	if err := op.GetCircuitFromDServer(); err != nil {
+// Builds the first data and control circuits, then rotates them every two
+// minutes. Only the first client to connect waits for the build.
+func (op *OnionProxy) start() error {
+	op.startMutex.Lock()
+	defer op.startMutex.Unlock()
+
+	if op.started {
+		return nil
+	}
+	if err := op.GetNewCircuit(); err != nil {
 		return err
 	}
+
+	go op.GetNewCircuitEveryTwoMinutes()
+	go op.watchExits()
+	if keepaliveInterval > 0 {
+		go op.keepCircuitsAlive()
+	}
+	if latencyInterval > 0 {
+		go op.measureLatencies()
+	}
+	go op.deliverOutboxes()
+	op.started = true
 	return nil
 }
 
-func (op *OnionProxy) GetNewCircuitEveryTwoMinutes() error {
-	for {
-		select {
-		case <-time.After(120 * time.Second): //get new circuit after 2 minutes
-			if err := op.GetCircuitFromDServer(); err != nil {
-				util.HandleNonFatalError("Could not create new circuit", err)
-				return err
-			}
-		}
+// Tells the directory server that an OR failed so it is picked less often
+func (op *OnionProxy) reportFailure(orAddress string, kind string) {
+	report := shared.FailureReport{
+		Address: orAddress,
+		Kind:    kind,
 	}
+
+	var ignoredResp bool // there is no response for this RPC call
+	err := op.dirServer.Call("DServer.ReportFailure", report, &ignoredResp)
+	util.HandleNonFatalError("Could not report OR failure to directory server", err)
 }
 
-func (op *OnionProxy) GetCircuitFromDServer() error {
-	util.OutLog.Println("Generating new circuit...")
-	var n uint32
-	binary.Read(rand.Reader, binary.LittleEndian, &n)
-	op.circuitId = n
+// Debug RPC returning the receipt of the most recent circuit build attempt
+func (s *OPServer) GetLastBuildReceipt(_ignored bool, resp *shared.CircuitBuildReceipt) error {
+	s.OnionProxy.lastBuildMutex.Lock()
+	defer s.OnionProxy.lastBuildMutex.Unlock()
+
+	if s.OnionProxy.lastBuildReceipt == nil {
+		return noBuildAttemptedError
+	}
 
-	var ORSet shared.OnionRouterInfos //ORSet can be a struct containing the OR address and pubkey
-	err := op.dirServer.Call("DServer.GetNodes", "", &ORSet)
-	util.HandleFatalError("Could not get circuit from directory server", err)
+	*resp = *s.OnionProxy.lastBuildReceipt
+	return nil
+}
 
-	// Verify that the circuit came from a trusted directory server
-	if util.PubKeyToString(*ORSet.PubKey) != directoryServerPubKey || !ecdsa.Verify(ORSet.PubKey, ORSet.Hash, ORSet.SigR, ORSet.SigS) {
-		return notTrustedDirectoryServerError
+// Returns everything new as display lines, a default sized page at a time
+func (s *OPServer) GetNewMessages(_ignored bool, resp *[]string) error {
+	var result shared.PollResult
+	if err := s.PollMessages(shared.PollRequest{}, &result); err != nil {
+		return err
 	}
 
-	for hopNum, onionRouterInfo := range ORSet.ORInfos {
-		sharedKey := util.GenerateAESKey()
-		encryptedSharedKey, err := util.RSAEncrypt(onionRouterInfo.PubKey, sharedKey)
-		if err != nil {
-			util.HandleNonFatalError("Could not encrypt shared key", err)
-			return err
-		}
+	*resp = result.Lines()
+	return nil
+}
 
-		circuitInfo := shared.CircuitInfo{
-			CircuitId:          op.circuitId,
-			EncryptedSharedKey: encryptedSharedKey,
-		}
+// Returns a page of at most req.Limit new messages. With req.Cursor set it
+// reads on from that cursor instead of from where the last poll stopped.
+func (s *OPServer) PollMessages(req shared.PollRequest, resp *shared.PollResult) error {
+	sess := s.session()
+	if _, _, err := sess.identity(); err != nil {
+		return err
+	}
 
-		client, err := op.DialOR(onionRouterInfo.Address)
-		if err != nil {
-			return err
-		}
-		// Only save guard node server
-		if hopNum == 0 {
-			op.guardNodeServer = client
+	sess.pollMutex.Lock()
+	defer sess.pollMutex.Unlock()
+
+	// Clients polling faster than the network recommends only get local notices
+	if !sess.mayPoll(s.OnionProxy.clientParams().MinPollInterval) {
+		sess.Lock()
+		next := sess.lastMessageId + 1
+		sess.Unlock()
+		*resp = shared.PollResult{
+			Notices:    sess.takeNotices(),
+			NextCursor: next,
 		}
+		return nil
+	}
 
-		var ack bool
-		if err := client.Call("ORServer.SendCircuitInfo", circuitInfo, &ack); err != nil {
-			util.HandleNonFatalError("Could not send circuit info to ORs", err)
-			return err
+	sess.Lock()
+	if req.Cursor > 0 {
+		sess.lastMessageId = req.Cursor - 1
+	}
+	pollingMessage := shared.PollingMessage{
+		IRCServerAddr: s.OnionProxy.ircServerAddr,
+		Namespace:     s.OnionProxy.namespace,
+		Username:      sess.username,
+		UserToken:     sess.userToken,
+		LastMessageId: sess.lastMessageId,
+		LastEventId:   sess.lastEventId,
+		LastUpdateId:  sess.lastUpdateId,
+		LastInboxId:   sess.lastInboxId,
+		DeviceId:      sess.deviceId,
+		Limit:         req.Limit,
+	}
+	sess.Unlock()
+
+	// Polling is interactive so it goes over the control circuit
+	circ, err := s.OnionProxy.getCircuit(s.OnionProxy.purposeFor(sess, controlCircuit))
+	if err != nil {
+		util.HandleNonFatalError("Could not retrieve new messages", err)
+		return err
+	}
+
+	messages, err := pollOver(circ, pollingMessage)
+	if err != nil {
+		util.HandleNonFatalError("Could not retrieve new messages", err)
+		return err
+	}
+
+	sess.Lock()
+	sess.lastMessageId = messages.NextMessageId
+	sess.lastEventId = messages.NextEventId
+	sess.lastUpdateId = messages.NextUpdateId
+	sess.lastInboxId = messages.NextInboxId
+	renamed := messages.Username != "" && messages.Username != sess.username
+	if renamed {
+		sess.username = messages.Username
+	}
+	sess.setBlocked(messages.Blocked)
+	sess.Unlock()
+	if renamed {
+		sess.addNotice("You are now known as " + messages.Username + " (changed on another device)")
+	}
+
+	*resp = shared.PollResult{
+		Notices:       append(sess.takeNotices(), messages.Inbox...),
+		ContactEvents: messages.ContactEvents,
+		Messages:      make([]shared.PolledMessage, 0, len(messages.Messages)),
+		Updates:       messages.Updates,
+		NextCursor:    messages.NextMessageId + 1,
+		More:          messages.More,
+	}
+	sess.Lock()
+	for i, message := range messages.Messages {
+		polled := shared.PolledMessage{Text: message}
+		if i < len(messages.MessageMeta) {
+			polled.MessageMeta = messages.MessageMeta[i]
+			sess.lastShown[polled.Channel] = polled.Id
 		}
-		// If not guard node, close client
-		if hopNum != 0 {
-			client.Close()
+		if sess.blocked[polled.From] {
+			continue
 		}
-
-		op.ORInfoByHopNum[hopNum] = &orInfo{
-			address:   onionRouterInfo.Address,
-			pubKey:    onionRouterInfo.PubKey,
-			sharedKey: &sharedKey,
+		resp.Messages = append(resp.Messages, polled)
+	}
+	sess.Unlock()
+	sess.applyGroupKeys(messages.SenderKeys, resp)
+	sess.applyRatchetMessages(messages.RatchetMessages, resp)
+	s.OnionProxy.replenishPrekeys(sess, messages)
+
+	for _, event := range messages.Events {
+		// Clients only show someone starting to type
+		if event.Kind == shared.PresenceTyping && !sess.hides(event.Username) {
+			resp.Events = append(resp.Events, event)
 		}
+	}
 
-		util.OutLog.Printf("\nCircuitId %v:\n    Hop Number: %v\n    OR Address: %s\n    Shared Key: %s\n", circuitInfo.CircuitId, hopNum+1, onionRouterInfo.Address, hex.EncodeToString(sharedKey))
+	unreadCounts := make(map[string]int)
+	for channel, count := range messages.UnreadCounts {
+		unreadCounts[channel] = count
 	}
+	s.OnionProxy.pollOtherServers(sess, circ, req.Limit, resp, unreadCounts)
+	sess.Lock()
+	sess.unreadCounts = unreadCounts
+	sess.Unlock()
 
-	util.OutLog.Println("Circuit generation completed")
+	return nil
+}
 
+func (s *OPServer) SendMessage(message string, ack *bool) error {
+	return s.SendMessageWithDeadline(shared.ChatMessage{Message: message}, ack)
+}
+
+// Sends req.Message. Without a deadline it is tried once, or queued in the
+// outbox while no circuit can carry it. With one it is retried until it is
+// delivered or the deadline passes, in which case shared.ExpiredError is
+// returned and the message is given up on.
+func (s *OPServer) SendMessageWithDeadline(req shared.ChatMessage, ack *bool) error {
+	var result shared.SendResult
+	if err := s.SendChatMessage(req, &result); err != nil {
+		return err
+	}
+	*ack = true
 	return nil
 }
 
-func (op *OnionProxy) DialOR(ORAddr string) (*rpc.Client, error) {
-	orServer, err := rpc.Dial("tcp", ORAddr)
+// Like SendMessageWithDeadline, and tells the client whether the message was
+// sent or queued in the outbox
+func (s *OPServer) SendChatMessage(req shared.ChatMessage, result *shared.SendResult) error {
+	sess := s.session()
+	// Every way out lets the client's next send go, the send itself as soon
+	// as its cell is on the way
+	release := sess.awaitSendTurn(req.SendSeq)
+	defer release()
+	if _, _, err := sess.identity(); err != nil {
+		return err
+	}
+
+	// Behind the messages queued already, so they arrive in order
+	if req.Deadline.IsZero() && sess.outboxLen() > 0 {
+		return sess.queueMessage(req, result)
+	}
+
+	chatMessage, err := s.OnionProxy.prepareChatMessage(sess, req)
 	if err != nil {
-		util.HandleNonFatalError("Could not dial onion router: "+ORAddr, err)
-		return nil, err
+		return err
 	}
-	return orServer, nil
-}
 
-func (s *OPServer) GetNewMessages(_ignored bool, resp *[]string) error {
-	pollingMessage := shared.PollingMessage{
-		IRCServerAddr: s.OnionProxy.ircServerAddr,
-		LastMessageId: s.OnionProxy.lastMessageId,
+	util.OutLog.Printf("Recieved Message from Client for sending: %s \n", util.LogText(req.Message))
+
+	if req.Deadline.IsZero() {
+		ctx := withHandOff(context.Background(), release)
+		err = s.OnionProxy.sendWithinRateLimit(ctx, sess, chatMessage)
+		if circuitUnavailable(err) {
+			util.HandleNonFatalError("Could not send message, queueing it", err)
+			return sess.queueMessage(req, result)
+		}
+	} else {
+		// Kept in the proxy's state until it is delivered or expires
+		id := sess.trackPending(chatMessage)
+		err = s.OnionProxy.deliverBefore(withHandOff(context.Background(), release), sess, chatMessage)
+		sess.untrackPending(id)
 	}
-	jsonData, err := json.Marshal(&pollingMessage)
 	if err != nil {
-		util.HandleFatalError("Could not retrieve new messages", err)
+		util.HandleNonFatalError("Could not send message", err)
 		return err
 	}
 
-	onion, err := s.OnionProxy.OnionizeData(jsonData)
+	util.OutLog.Println("Message successfully sent!")
+	return nil
+}
+
+// The chat message for req from the session's user, encrypted for the
+// channel if it is an encrypted one, and signed
+func (op *OnionProxy) prepareChatMessage(sess *session, req shared.ChatMessage) (shared.ChatMessage, error) {
+	username, userToken, err := sess.identity()
 	if err != nil {
-		util.HandleFatalError("Could not retrieve new messages", err)
+		return shared.ChatMessage{}, err
+	}
+
+	chatMessage := shared.ChatMessage{
+		IRCServerAddr: op.homeOf(sess, req.Channel),
+		Namespace:     op.namespace,
+		Channel:       req.Channel,
+		Username:      username,
+		UserToken:     userToken,
+		Message:       req.Message,
+		Deadline:      req.Deadline,
+		SentAt:        time.Now(),
+		TTL:           req.TTL,
+	}
+	if chatMessage.MessageId, err = op.newMessageId(); err != nil {
+		return shared.ChatMessage{}, err
+	}
+	if sess.encrypted(req.Channel) {
+		if err := op.encryptForChannel(sess, &chatMessage); err != nil {
+			util.HandleNonFatalError("Could not encrypt message", err)
+			return shared.ChatMessage{}, err
+		}
+	}
+	sess.sign(&chatMessage)
+	return chatMessage, nil
+}
+
+// Sends a chat message, waiting out the chat server's rate limit for up to
+// maxThrottleWait rather than failing the send at once. The message is sent
+// again as it was: a throttled one was not published, so neither its id nor
+// its signature count as seen.
+func (op *OnionProxy) sendWithinRateLimit(ctx context.Context, sess *session, chatMessage shared.ChatMessage) error {
+	var waited time.Duration
+	for {
+		err := op.sendCommandContext(ctx, op.purposeFor(sess, dataCircuit), shared.CommandChatMessage, chatMessage)
+		throttled, ok := shared.ParseThrottledError(err)
+		if !ok || waited+throttled.RetryAfter > maxThrottleWait {
+			return err
+		}
+		util.OutLog.Printf("Chat server throttled a message (%s limit), sending it again in %v\n", throttled.Scope, throttled.RetryAfter)
+		util.Time.Sleep(throttled.RetryAfter)
+		waited += throttled.RetryAfter
+	}
+}
+
+// Sends a chat message until it is delivered or its deadline passes
+func (op *OnionProxy) deliverBefore(parent context.Context, sess *session, chatMessage shared.ChatMessage) error {
+	ctx, cancel := context.WithDeadline(parent, chatMessage.Deadline)
+	defer cancel()
+
+	err := retry.Do(ctx, deadlineRetryPolicy, func() error {
+		err := op.sendCommandContext(ctx, op.purposeFor(sess, dataCircuit), shared.CommandChatMessage, chatMessage)
+		// Resending a cell an OR found malformed or that doesn't encode won't help
+		if shared.IsPermanentError(err) {
+			return retry.Permanent(err)
+		}
 		return err
+	})
+	if err != nil && (shared.IsExpiredError(err) || !time.Now().Before(chatMessage.Deadline)) {
+		err = shared.ExpiredError
 	}
+	return err
+}
 
-	messages, err := s.OnionProxy.SendPollingOnion(onion, s.OnionProxy.circuitId)
+// Tells the other members of the default channel that the client started or
+// stopped typing. kind is shared.PresenceTyping or shared.PresenceStoppedTyping.
+func (s *OPServer) SendPresence(kind string, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
 	if err != nil {
-		util.HandleFatalError("Could not retrieve new messages", err)
 		return err
 	}
 
-	s.OnionProxy.lastMessageId = s.OnionProxy.lastMessageId + uint32(len(messages))
-	*resp = messages
+	req := shared.PresenceRequest{
+		IRCServerAddr: s.OnionProxy.homeOf(sess, shared.DefaultChannel),
+		Namespace:     s.OnionProxy.namespace,
+		Username:      username,
+		UserToken:     userToken,
+		Kind:          kind,
+	}
+
+	// Presence is small and time sensitive like polling
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandPresence, req); err != nil {
+		util.HandleNonFatalError("Could not send presence event", err)
+		return err
+	}
+
+	*ack = true
+	return nil
+}
+
+// Sends a direct message to req.Recipient. It is queued in their inbox on the
+// IRC server until their proxy picks it up.
+func (s *OPServer) SendDirectMessage(req shared.ChatMessage, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	req.IRCServerAddr = s.OnionProxy.ircServerAddr
+	req.Namespace = s.OnionProxy.namespace
+	req.Username = username
+	req.UserToken = userToken
+	req.SentAt = time.Now()
+	if req.MessageId, err = s.OnionProxy.newMessageId(); err != nil {
+		return err
+	}
+	if err := s.OnionProxy.encryptDirect(sess, &req); err != nil {
+		util.HandleNonFatalError("Could not encrypt direct message", err)
+		return err
+	}
+	sess.sign(&req)
+
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, dataCircuit), shared.CommandChatMessage, req); err != nil {
+		util.HandleNonFatalError("Could not send direct message", err)
+		return err
+	}
 
+	*ack = true
 	return nil
 }
 
-func (op *OnionProxy) SendPollingOnion(onionToSend []byte, circId uint32) ([]string, error) {
-	// Send onion to the guardNode via RPC
-	cell := shared.Cell{
-		CircuitId: circId,
-		Data:      onionToSend,
+// Marks every message shown so far in channel (the default channel if empty)
+// as read, for all of the user's devices
+func (s *OPServer) MarkRead(channel string, ack *bool) error {
+	if channel == "" {
+		channel = shared.DefaultChannel
 	}
 
-	var messages []string
-	err := op.guardNodeServer.Call("ORServer.DecryptPollingCell", cell, &messages)
+	sess := s.session()
+	username, userToken, err := sess.identity()
 	if err != nil {
-		util.HandleNonFatalError("Could not send onion to guard node", err)
-		return nil, err
+		return err
+	}
+
+	sess.Lock()
+	lastShown, ok := sess.lastShown[channel]
+	sess.Unlock()
+	if !ok {
+		*ack = true
+		return nil
+	}
+
+	req := shared.ReadMarkerRequest{
+		IRCServerAddr: s.OnionProxy.homeOf(sess, channel),
+		Namespace:     s.OnionProxy.namespace,
+		Username:      username,
+		UserToken:     userToken,
+		Channel:       channel,
+		MessageId:     lastShown,
+	}
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandMarkRead, req); err != nil {
+		util.HandleNonFatalError("Could not mark messages read", err)
+		return err
 	}
 
-	return messages, nil
+	*ack = true
+	return nil
 }
 
-func (s *OPServer) SendMessage(message string, ack *bool) error {
-	chatMessage := shared.ChatMessage{
-		IRCServerAddr: s.OnionProxy.ircServerAddr,
-		Username:      s.OnionProxy.username,
-		Message:       message,
+// Returns unread message counts by channel as of the latest poll
+func (s *OPServer) GetUnreadCounts(_ignored bool, resp *map[string]int) error {
+	sess := s.session()
+	sess.Lock()
+	defer sess.Unlock()
+
+	*resp = sess.unreadCounts
+	return nil
+}
+
+// Fetches one chunk of an export archive over the control circuit. The
+// client sets what to export and the cursor; the OP fills in who is asking.
+func (s *OPServer) ExportLog(req shared.ExportRequest, resp *shared.ExportChunk) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	req.IRCServerAddr = s.OnionProxy.ircServerAddr
+	if !req.DirectMessages {
+		req.IRCServerAddr = s.OnionProxy.homeOf(sess, req.Channel)
 	}
+	req.Namespace = s.OnionProxy.namespace
+	req.Username = username
+	req.UserToken = userToken
 
-	util.OutLog.Printf("Recieved Message from Client for sending: %s \n", message)
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
 
-	jsonData, err := json.Marshal(&chatMessage)
+	circ, err := s.OnionProxy.getCircuit(s.OnionProxy.purposeFor(sess, controlCircuit))
 	if err != nil {
-		util.HandleNonFatalError("Could not send message", err)
 		return err
 	}
+	if !circ.exitSupports(shared.FeatureExport) {
+		return unsupportedByExitError(circ.exitAddress(), shared.FeatureExport)
+	}
 
-	onion, err := s.OnionProxy.OnionizeData(jsonData)
+	onion, err := circ.OnionizeData(shared.CommandChatMessage, jsonData)
 	if err != nil {
-		util.HandleNonFatalError("Could not send message", err)
 		return err
 	}
 
-	if err = s.OnionProxy.SendChatMessageOnion(onion, s.OnionProxy.circuitId); err != nil {
-		util.HandleNonFatalError("Could not send message", err)
+	chunk, err := circ.SendExportOnion(onion)
+	if err != nil {
 		return err
 	}
 
-	util.OutLog.Println("Message successfully sent!")
+	*resp = chunk
+	return nil
+}
+
+// Changes the text of a message the client sent
+func (s *OPServer) EditMessage(req shared.MessageEditRequest, ack *bool) error {
+	return s.changeMessage(shared.CommandEditMessage, req, ack)
+}
+
+func (s *OPServer) DeleteMessage(messageId uint32, ack *bool) error {
+	return s.changeMessage(shared.CommandDeleteMessage, shared.MessageEditRequest{MessageId: messageId}, ack)
+}
+
+func (s *OPServer) changeMessage(command string, req shared.MessageEditRequest, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	req.IRCServerAddr = s.OnionProxy.ircServerAddr
+	req.Namespace = s.OnionProxy.namespace
+	req.Username = username
+	req.UserToken = userToken
+
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, dataCircuit), command, req); err != nil {
+		util.HandleNonFatalError("Could not "+command+" message", err)
+		return err
+	}
 
 	*ack = true
 	return nil
 }
 
-func (op *OnionProxy) OnionizeData(coreData []byte) ([]byte, error) {
-	encryptedLayer := coreData
+// Renames the client's user on the IRC server
+func (s *OPServer) ChangeUsername(newUsername string, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
 
-	for hopNum := len(op.ORInfoByHopNum) - 1; hopNum >= 0; hopNum-- {
-		unencryptedLayer := shared.Onion{
-			Data: encryptedLayer,
-		}
+	req := shared.UserNameRequest{
+		IRCServerAddr: s.OnionProxy.ircServerAddr,
+		Namespace:     s.OnionProxy.namespace,
+		Username:      username,
+		NewUsername:   newUsername,
+		UserToken:     userToken,
+	}
 
-		// If layer is meant for an exit node, turn IsExitNode flag on
-		// Otherwise give it the address of the next OR o pass the onion on to.
-		if hopNum == len(op.ORInfoByHopNum)-1 {
-			unencryptedLayer.IsExitNode = true
-		} else {
-			unencryptedLayer.NextAddress = op.ORInfoByHopNum[hopNum+1].address
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandChangeUserName, req); err != nil {
+		util.HandleNonFatalError("Could not change username", err)
+		return err
+	}
+	// Channels homed elsewhere follow on a best effort basis
+	for _, address := range sess.otherServers() {
+		req.IRCServerAddr = address
+		if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandChangeUserName, req); err != nil {
+			util.HandleNonFatalError("Could not change username on "+address, err)
+			sess.addNotice("Your username on " + address + " is still " + username + ": " + err.Error())
 		}
+	}
 
-		// json marshal the onion layer
-		jsonData, err := json.Marshal(&unencryptedLayer)
-		if err != nil {
-			return nil, err
+	util.OutLog.Printf("Client username changed from %s to %s\n", username, newUsername)
+	sess.Lock()
+	sess.username = newUsername
+	p := sess.profile
+	sess.Unlock()
+	if p != nil {
+		if err := p.setUsername(newUsername); err != nil {
+			util.HandleNonFatalError("Could not save profile "+p.name, err)
+			sess.addNotice("The profile still has the old username, it will connect as " + username + ": " + err.Error())
 		}
+	}
 
-		// Encrypt the onion layer
-		key := *op.ORInfoByHopNum[hopNum].sharedKey
-		cipherkey, err := aes.NewCipher(key)
-		if err != nil {
-			return nil, err
-		}
+	*ack = true
+	return nil
+}
 
-		ciphertext := make([]byte, aes.BlockSize+len(jsonData))
-		prefix := ciphertext[:aes.BlockSize]
-		if _, err = io.ReadFull(rand.Reader, prefix); err != nil {
-			return nil, err
+// Deletes the client's user from every chat server it has channels on: its
+// registration, messages and inbox. The session is disconnected afterwards,
+// so the client has to Connect again to keep chatting.
+func (s *OPServer) ForgetUser(_ignored bool, ack *bool) error {
+	sess := s.session()
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+
+	req := shared.ForgetRequest{
+		IRCServerAddr: s.OnionProxy.ircServerAddr,
+		Namespace:     s.OnionProxy.namespace,
+		Username:      username,
+		UserToken:     userToken,
+	}
+	if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandForgetUser, req); err != nil {
+		util.HandleNonFatalError("Could not forget user", err)
+		return err
+	}
+	// The session drops the user token below, so it can't try again later
+	var failed []string
+	for _, address := range sess.otherServers() {
+		req.IRCServerAddr = address
+		if err := s.OnionProxy.sendCommand(s.OnionProxy.purposeFor(sess, controlCircuit), shared.CommandForgetUser, req); err != nil {
+			util.HandleNonFatalError("Could not forget user on "+address, err)
+			failed = append(failed, address)
 		}
+	}
 
-		cfb := cipher.NewCFBEncrypter(cipherkey, prefix)
-		cfb.XORKeyStream(ciphertext[aes.BlockSize:], jsonData)
+	util.OutLog.Printf("Client user %s forgotten\n", username)
+	sess.Lock()
+	sess.username = ""
+	sess.userToken = ""
+	sess.signingKey = nil
+	sess.encryptionKey = nil
+	sess.groups = make(map[string]*channelGroup)
+	sess.senderKeys = make(map[string]shared.SenderKey)
+	sess.ratchets = make(map[string]*shared.Ratchet)
+	sess.crossedRatchets = make(map[string]*shared.Ratchet)
+	sess.blocked = make(map[string]bool)
+	sess.pending = make(map[uint64]shared.ChatMessage)
+	sess.homes = make(map[string]string)
+	sess.cursors = make(map[string]*pollCursor)
+	sess.Unlock()
+
+	if len(failed) > 0 {
+		return partlyForgottenError(failed)
+	}
+	*ack = true
+	return nil
+}
+
+// Sends coreData to the exit node of the purpose's circuit, which hands it to
+// the IRC server according to command. Returns once the IRC server accepted it.
+func (op *OnionProxy) sendCommand(purpose string, command string, coreData interface{}) error {
+	return op.sendCommandContext(context.Background(), purpose, command, coreData)
+}
+
+func (op *OnionProxy) sendCommandContext(ctx context.Context, purpose string, command string, coreData interface{}) error {
+	jsonData, err := json.Marshal(coreData)
+	if err != nil {
+		return shared.EncodingError(command+" payload", err)
+	}
+	// The onion holds its own encrypted copy
+	defer secmem.Wipe(jsonData)
+
+	circ, err := op.getCircuit(purpose)
+	if err != nil {
+		return err
+	}
+
+	// An older exit would pass an unknown command on as a chat message
+	features := []string{shared.CommandFeature(command)}
+	messageId := ""
+	switch data := coreData.(type) {
+	case shared.ChatMessage:
+		features = append(features, chatMessageFeatures(data)...)
+		messageId = data.MessageId
+	case shared.UserNameRequest:
+		// and drop the proof of work of a registration
+		if data.RegistrationToken != "" || !data.PowStamp.IsZero() {
+			features = append(features, shared.FeatureRegistrationGate)
+		}
+	}
+	if feature := circ.missingFeature(features); feature != "" {
+		return unsupportedByExitError(circ.exitAddress(), feature)
+	}
 
-		encryptedLayer = ciphertext
+	if second := op.redundantLeg(purpose, circ, command, messageId); second != nil && second.missingFeature(features) == "" {
+		return sendRedundantly(ctx, command, jsonData, circ, second)
 	}
+	return circ.sendCommandContext(ctx, command, jsonData)
+}
 
-	return encryptedLayer, nil
+// Features an exit needs to pass msg on intact. An older exit would drop its
+// signature, its encrypted text, sender key or ratchet header, leaving an
+// empty message, or its TTL, keeping it for good.
+func chatMessageFeatures(msg shared.ChatMessage) []string {
+	var features []string
+	if len(msg.Signature) > 0 {
+		features = append(features, shared.FeatureMessageSigning)
+	}
+	if msg.Encrypted != nil || msg.SenderKey != nil {
+		features = append(features, shared.FeatureGroupKeys)
+	}
+	if msg.Ratchet != nil {
+		features = append(features, shared.FeatureDoubleRatchet)
+	}
+	if msg.TTL != 0 {
+		features = append(features, shared.FeatureMessageTTL)
+	}
+	return features
 }
 
-func (op *OnionProxy) SendChatMessageOnion(onionToSend []byte, circId uint32) error {
-	// Send onion to the guardNode via RPC
-	cell := shared.Cell{ // Can add more in cell if each layer needs more info other (such as hopId)
-		CircuitId: circId,
-		Data:      onionToSend,
+// The first of features the circuit's exit lacks, "" if it has them all
+func (c *circuit) missingFeature(features []string) string {
+	for _, feature := range features {
+		if !c.exitSupports(feature) {
+			return feature
+		}
 	}
+	return ""
+}
 
-	util.OutLog.Println("Sending onion to guard node")
+// Sends jsonData over the circuit, in fragments if it is too large for a cell
+func (c *circuit) sendCommandContext(ctx context.Context, command string, jsonData []byte) error {
+	if len(jsonData) > shared.MaxFragmentData && c.exitSupports(shared.FeatureFragmentation) {
+		return c.sendFragmentsContext(ctx, command, jsonData)
+	}
 
-	var _ignored bool
-	if err := op.guardNodeServer.Call("ORServer.DecryptChatMessageCell", cell, &_ignored); err != nil {
-		util.HandleNonFatalError("Could not send onion through onion network", err)
+	onion, err := c.OnionizeData(command, jsonData)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.SendChatMessageOnionContext(ctx, onion)
+}
+
+func unsupportedByExitError(exitAddress string, feature string) UnsupportedByExitError {
+	return errors.New("Exit " + exitAddress + " speaks a protocol version without " + feature)
+}
+
+func partlyForgottenError(failed []string) PartlyForgottenError {
+	return errors.New("User was forgotten except on " + strings.Join(failed, ", ") + ", which could not be reached")
+}
+
+func newUserToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := util.Random.Read(token); err != nil {
+		return "", shared.InternalError("Could not generate user token", err)
+	}
+	return hex.EncodeToString(token), nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Stands in for a guard node, answering chat message cells with err
+type testGuard struct {
+	err   error
+	cells int
+}
+
+func (g *testGuard) DecryptChatMessageCell(cell shared.Cell, ack *bool) error {
+	g.cells++
+	return g.err
+}
+
+// Serves guard, a testGuard or another stand in, as the guard node
+func testGuardClient(t *testing.T, guard interface{}) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.RegisterName("ORServer", guard); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSendMessageWithDeadline(t *testing.T) {
+	// Without a circuit every try fails until the deadline passes
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}
+	var ack bool
+	started := time.Now()
+	err := s.SendMessageWithDeadline(shared.ChatMessage{Message: "hi", Deadline: started.Add(300 * time.Millisecond)}, &ack)
+	if err != shared.ExpiredError || time.Since(started) < 300*time.Millisecond {
+		t.Fatalf("gave %v after %v, want %v after the deadline", err, time.Since(started), shared.ExpiredError)
+	}
+	// Without one it is queued
+	var result shared.SendResult
+	if err = s.SendChatMessage(shared.ChatMessage{Message: "hi"}, &result); err != nil || !result.Queued || result.Outbox != 1 {
+		t.Fatalf("a send without a deadline gave %+v, %v, want it queued", result, err)
+	}
+	s.sess.outbox = nil
+
+	// The IRC server rejecting it as expired is final
+	circ := testCircuit(t)
+	guard := &testGuard{err: shared.ExpiredError}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	s.OnionProxy.circuits[dataCircuit] = circ
+	err = s.SendMessageWithDeadline(shared.ChatMessage{Message: "hi", Deadline: time.Now().Add(time.Minute)}, &ack)
+	if err != shared.ExpiredError || guard.cells != 1 {
+		t.Fatalf("gave %v after %d tries, want %v after 1", err, guard.cells, shared.ExpiredError)
+	}
+}
+
+func TestOldExitsGetNoNewCommands(t *testing.T) {
+	circ := testCircuit(t)
+	guard := &testGuard{}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	op := &OnionProxy{circuits: map[string]*circuit{dataCircuit: circ}}
+
+	// The exit speaks version 1, from before presence
+	err := op.sendCommand(dataCircuit, shared.CommandPresence, shared.PresenceRequest{Kind: shared.PresenceTyping})
+	if err == nil || !strings.Contains(err.Error(), shared.FeaturePresence) || guard.cells != 0 {
+		t.Fatalf("gave %v after sending %d cells", err, guard.cells)
+	}
+	circ.ORInfoByHopNum[2].protocolVersion = shared.ProtocolVersion
+	if err = op.sendCommand(dataCircuit, shared.CommandPresence, shared.PresenceRequest{Kind: shared.PresenceTyping}); err != nil || guard.cells != 1 {
+		t.Fatalf("gave %v after sending %d cells", err, guard.cells)
+	}
+}
+
+// Stands in for a guard whose chat server throttles the first throttles cells
+type testThrottlingGuard struct {
+	throttles int
+	cells     int
+}
+
+func (g *testThrottlingGuard) DecryptChatMessageCell(cell shared.Cell, ack *bool) error {
+	g.cells++
+	if g.cells <= g.throttles {
+		return shared.ThrottledError{Scope: "user", RetryAfter: 10 * time.Second}
+	}
+	return nil
+}
+
+func TestSendWithinRateLimit(t *testing.T) {
+	defer util.SetClock(util.Time)
+	clock := util.NewManualClock(time.Now())
+	util.SetClock(clock)
+
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}
+	circ := testCircuit(t)
+	guard := &testThrottlingGuard{throttles: 1}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	op.circuits[dataCircuit] = circ
+
+	sent := make(chan error, 1)
+	go func() {
+		var result shared.SendResult
+		sent <- s.SendChatMessage(shared.ChatMessage{Message: "hi"}, &result)
+	}()
+	for clock.Sleepers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(10 * time.Second)
+	if err := <-sent; err != nil || guard.cells != 2 {
+		t.Fatalf("gave %v after %d tries, want it sent on the second", err, guard.cells)
+	}
+
+	// Throttling that outlasts maxThrottleWait fails the send
+	guard.cells, guard.throttles = 0, 10
+	go func() {
+		var result shared.SendResult
+		sent <- s.SendChatMessage(shared.ChatMessage{Message: "hi"}, &result)
+	}()
+	var err error
+	for done := false; !done; {
+		select {
+		case err = <-sent:
+			done = true
+		default:
+			if clock.Sleepers() > 0 {
+				clock.Advance(10 * time.Second)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, ok := shared.ParseThrottledError(err); !ok || guard.cells != int(maxThrottleWait/(10*time.Second))+1 {
+		t.Fatalf("gave %v after %d tries", err, guard.cells)
+	}
+}
+
+func TestMissingFeature(t *testing.T) {
+	circ := testCircuit(t)
+	if feature := circ.missingFeature([]string{shared.FeatureMessageTTL, shared.FeaturePresence}); feature != shared.FeatureMessageTTL {
+		t.Fatalf("a version 1 exit lacks %q, want %q", feature, shared.FeatureMessageTTL)
+	}
+	circ.ORInfoByHopNum[2].protocolVersion = shared.ProtocolVersion
+	if feature := circ.missingFeature([]string{shared.FeatureMessageTTL, shared.FeaturePresence}); feature != "" {
+		t.Fatalf("a current exit lacks %q", feature)
+	}
+}
+
+// Commands an exit from before a feature they need would mangle are refused
+func TestOldExitsAreNotSentWhatTheyWouldDrop(t *testing.T) {
+	for _, test := range []struct {
+		command  string
+		coreData interface{}
+		feature  string
+	}{
+		{shared.CommandChatMessage, shared.ChatMessage{Message: "hi", Signature: []byte("signed")}, shared.FeatureMessageSigning},
+		{shared.CommandRegisterUserName, shared.UserNameRequest{Username: "alice", RegistrationToken: "invite"}, shared.FeatureRegistrationGate},
+		{shared.CommandChatMessage, shared.ChatMessage{Message: "hi", TTL: time.Minute}, shared.FeatureMessageTTL},
+		{shared.CommandChatMessage, shared.ChatMessage{Encrypted: &shared.EncryptedMessage{}}, shared.FeatureGroupKeys},
+		{shared.CommandChatMessage, shared.ChatMessage{Ratchet: &shared.RatchetMessage{}}, shared.FeatureDoubleRatchet},
+	} {
+		// The exit speaks the version before the feature
+		circ := testCircuit(t)
+		feature, _ := shared.FeatureByName(test.feature)
+		circ.ORInfoByHopNum[2].protocolVersion = feature.MinVersion - 1
+		guard := &testGuard{}
+		circ.guardNodeServer = testGuardClient(t, guard)
+		op := &OnionProxy{circuits: map[string]*circuit{dataCircuit: circ}}
+
+		err := op.sendCommand(dataCircuit, test.command, test.coreData)
+		if err == nil || !strings.Contains(err.Error(), test.feature) || guard.cells != 0 {
+			t.Fatalf("a command needing %s gave %v after sending %d cells", test.feature, err, guard.cells)
+		}
+		circ.ORInfoByHopNum[2].protocolVersion = shared.ProtocolVersion
+		if err = op.sendCommand(dataCircuit, test.command, test.coreData); err != nil || guard.cells != 1 {
+			t.Fatalf("a current exit gave %v after sending %d cells", err, guard.cells)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type OutboxError error
+
+// Outbox configurations
+const (
+	outboxRetryInterval time.Duration = 5 * time.Second
+	maxOutboxMessages   int           = 100
+	outboxMaxAge        time.Duration = 24 * time.Hour // queued messages older than this are given up on
+
+	// What a hop answers for a circuit it lost, having restarted, until the
+	// circuit is replaced
+	unknownCircuitMessage = "No circuit with this id on this onion router"
+)
+
+var (
+	// Outbox Errors
+	outboxFullError OutboxError = errors.New("Too many messages are waiting in the outbox already")
+)
+
+// Whether err says no circuit could carry a cell, rather than that the cell
+// itself was refused, so the same cell may get through later
+func circuitUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == noCircuitError || err == rpc.ErrShutdown || shared.ErrorCode(err) == shared.CodeUnavailable || err.Error() == unknownCircuitMessage {
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
+}
+
+// Keeps req in the outbox until a circuit can carry it. Only what the client
+// sent is kept: the message is signed, and encrypted for its channel, when it
+// is sent, as the IRC server refuses signatures much older than that.
+func (sess *session) queueMessage(req shared.ChatMessage, result *shared.SendResult) error {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if len(sess.outbox) >= maxOutboxMessages {
+		return outboxFullError
+	}
+	sess.outbox = append(sess.outbox, shared.ChatMessage{
+		Channel: req.Channel,
+		Message: req.Message,
+		TTL:     req.TTL,
+		SentAt:  time.Now(), // when it was queued
+	})
+	result.Queued = true
+	result.Outbox = len(sess.outbox)
+	util.OutLog.Printf("Queued message in the outbox, %d waiting\n", len(sess.outbox))
+	return nil
+}
+
+func (sess *session) outboxLen() int {
+	sess.Lock()
+	defer sess.Unlock()
+
+	return len(sess.outbox)
+}
+
+// The oldest queued message, if there is one
+func (sess *session) outboxHead() (shared.ChatMessage, bool) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if len(sess.outbox) == 0 {
+		return shared.ChatMessage{}, false
+	}
+	return sess.outbox[0], true
+}
+
+func (sess *session) popOutbox() {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if len(sess.outbox) > 0 {
+		sess.outbox = sess.outbox[1:]
+	}
+}
+
+// Sends the messages in every session's outbox every outboxRetryInterval,
+// oldest first, until a circuit can't carry one
+func (op *OnionProxy) deliverOutboxes() {
+	for {
+		util.Time.Sleep(outboxRetryInterval)
+
+		op.sessionsMutex.Lock()
+		var sessions []*session
+		for _, sess := range op.sessions {
+			sessions = append(sessions, sess)
+		}
+		op.sessionsMutex.Unlock()
+
+		for _, sess := range sessions {
+			op.deliverOutbox(sess)
+		}
+	}
+}
+
+func (op *OnionProxy) deliverOutbox(sess *session) {
+	delivered := 0
+	for {
+		req, ok := sess.outboxHead()
+		if !ok {
+			break
+		}
+		if time.Since(req.SentAt) > outboxMaxAge {
+			sess.popOutbox()
+			sess.addNotice(fmt.Sprintf("A queued message was given up on after %v: %s", outboxMaxAge, req.Message))
+			continue
+		}
+
+		chatMessage, err := op.prepareChatMessage(sess, req)
+		if err == nil {
+			err = op.sendCommand(op.purposeFor(sess, dataCircuit), shared.CommandChatMessage, chatMessage)
+		}
+		if circuitUnavailable(err) {
+			break
+		}
+		sess.popOutbox()
+		if err != nil {
+			util.HandleNonFatalError("Could not send queued message", err)
+			sess.addNotice("A queued message was not delivered: " + err.Error())
+			continue
+		}
+		delivered++
+	}
+
+	if delivered > 0 {
+		util.OutLog.Printf("Delivered %d queued messages\n", delivered)
+		sess.addNotice(fmt.Sprintf("Delivered %d queued messages", delivered))
+	}
+}
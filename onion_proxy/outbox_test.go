@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestCircuitUnavailable(t *testing.T) {
+	for _, err := range []error{noCircuitError, rpc.ErrShutdown, errors.New(unknownCircuitMessage), shared.UnavailableError("guard", errors.New("down"))} {
+		if !circuitUnavailable(err) {
+			t.Fatalf("%v doesn't count as no circuit", err)
+		}
+	}
+	for _, err := range []error{nil, shared.ExpiredError, errors.New("Not in channel")} {
+		if circuitUnavailable(err) {
+			t.Fatalf("%v counts as no circuit", err)
+		}
+	}
+}
+
+func TestQueueMessage(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}
+
+	var result shared.SendResult
+	if err := s.SendChatMessage(shared.ChatMessage{Channel: "#general", Message: "first"}, &result); err != nil || !result.Queued {
+		t.Fatalf("without a circuit a send gave %+v, %v", result, err)
+	}
+	queued := s.sess.outbox[0]
+	if queued.Message != "first" || queued.Username != "" || queued.Signature != nil {
+		t.Fatalf("queued %+v, want only what the client sent", queued)
+	}
+
+	// Later messages queue behind it even once a circuit is up
+	circ := testCircuit(t)
+	guard := &testGuard{}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	op.circuits[dataCircuit] = circ
+	if err := s.SendChatMessage(shared.ChatMessage{Channel: "#general", Message: "second"}, &result); err != nil || result.Outbox != 2 || guard.cells != 0 {
+		t.Fatalf("a send behind a queued message gave %+v, %v after %d cells", result, err, guard.cells)
+	}
+
+	for len(s.sess.outbox) < maxOutboxMessages {
+		s.sess.outbox = append(s.sess.outbox, queued)
+	}
+	if err := s.sess.queueMessage(shared.ChatMessage{Message: "one too many"}, &result); err != outboxFullError {
+		t.Fatalf("a full outbox gave %v, want %v", err, outboxFullError)
+	}
+}
+
+func TestDeliverOutbox(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	sess := testSession(op, "alice")
+	sess.outbox = []shared.ChatMessage{
+		{Channel: "#general", Message: "stale", SentAt: time.Now().Add(-2 * outboxMaxAge)},
+		{Channel: "#general", Message: "first", SentAt: time.Now()},
+		{Channel: "#general", Message: "second", SentAt: time.Now()},
+	}
+
+	// Nothing can carry them yet
+	op.deliverOutbox(sess)
+	if len(sess.outbox) != 2 || sess.outbox[0].Message != "first" {
+		t.Fatalf("without a circuit the outbox is %+v", sess.outbox)
+	}
+
+	circ := testCircuit(t)
+	guard := &testGuard{}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	op.circuits[dataCircuit] = circ
+	op.deliverOutbox(sess)
+	if len(sess.outbox) != 0 || guard.cells != 2 {
+		t.Fatalf("sent %d cells, leaving %+v", guard.cells, sess.outbox)
+	}
+	if notices := sess.takeNotices(); len(notices) != 2 {
+		t.Fatalf("the client was told %q", notices)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"../shared"
+	"../util"
+	"../util/padding"
+)
+
+// Starts the padding machine of the padding class in effect on the link to
+// the circuit's guard. Guards from before link padding aren't padded, and
+// neither are circuits when the consensus recommends a class this proxy has
+// no machine for.
+func (op *OnionProxy) startPadding(circ *circuit) {
+	class := op.clientParams().PaddingClass
+	machine, ok := op.paddingMachines[class]
+	if !ok {
+		util.OutLog.Printf("No padding machine %q, circuit %v isn't padded\n", class, circ.id)
+		return
+	}
+	if len(machine.States) == 0 || !circ.ORInfoByHopNum[0].capabilities.Has(shared.CapabilityLinkPadding) {
+		return
+	}
+	circ.padding = padding.Start(machine, 0, circ.sendPaddingCell)
+}
+
+// What this proxy tells routers in circuit handshakes: that it pads its
+// links when the padding class in effect has a machine that sends cells
+func (op *OnionProxy) capabilities() shared.Capabilities {
+	if machine, ok := op.paddingMachines[op.clientParams().PaddingClass]; ok && len(machine.States) > 0 {
+		return shared.CapabilityLinkPadding
+	}
+	return 0
+}
+
+// Sends a padding cell of size random bytes to the guard. Padding stops with
+// the first one that fails, as when the circuit was closed.
+func (c *circuit) sendPaddingCell(size int) error {
+	cell := shared.Cell{
+		CircuitId: c.id,
+		Data:      make([]byte, size),
+	}
+	if _, err := util.Random.Read(cell.Data); err != nil {
+		return err
+	}
+
+	// Not through goGuard, which would count the cell as real traffic
+	var reply shared.RelayReply
+	method, args, methodReply := c.relayCall(shared.RelayPadding, cell, &reply)
+	return c.guard().Call(method, args, methodReply)
+}
+
+// Tells the padding machine, if any, that a real cell goes to the guard
+func (c *circuit) noteTraffic() {
+	if c.padding != nil {
+		c.padding.Traffic()
+	}
+}
+
+func (c *circuit) stopPadding() {
+	if c.padding != nil {
+		c.padding.Stop()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Used until the first consensus arrives, and for params it leaves out
+var defaultClientParams = shared.ClientParams{
+	MinPollInterval:     100 * time.Millisecond,
+	PaddingClass:        "none",
+	MinRotationInterval: circuitRotationInterval,
+	MaxRotationInterval: circuitRotationInterval,
+}
+
+// Takes on the params the directory server recommends
+func (op *OnionProxy) adoptParams(params shared.ClientParams) {
+	op.paramsMutex.Lock()
+	defer op.paramsMutex.Unlock()
+
+	if params != op.consensusParams {
+		util.OutLog.Printf("Adopting client params from consensus: %+v\n", params)
+	}
+	op.consensusParams = params
+}
+
+// Returns the params in effect: flags first, then the consensus, then defaults
+func (op *OnionProxy) clientParams() shared.ClientParams {
+	op.paramsMutex.RLock()
+	defer op.paramsMutex.RUnlock()
+
+	params := defaultClientParams
+	for _, source := range []shared.ClientParams{op.consensusParams, op.paramOverrides} {
+		if source.MinPollInterval > 0 {
+			params.MinPollInterval = source.MinPollInterval
+		}
+		if source.PaddingClass != "" {
+			params.PaddingClass = source.PaddingClass
+		}
+		if source.MinRotationInterval > 0 && source.MaxRotationInterval >= source.MinRotationInterval {
+			params.MinRotationInterval = source.MinRotationInterval
+			params.MaxRotationInterval = source.MaxRotationInterval
+		}
+	}
+	return params
+}
+
+// Picks how long the next circuits are used for
+func (op *OnionProxy) rotationInterval() time.Duration {
+	params := op.clientParams()
+	spread := params.MaxRotationInterval - params.MinRotationInterval
+	return params.MinRotationInterval + time.Duration(util.Random.Float64()*float64(spread))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestClientParamsPrecedence(t *testing.T) {
+	op := &OnionProxy{}
+	if op.clientParams() != defaultClientParams {
+		t.Fatalf("without a consensus the params are %+v", op.clientParams())
+	}
+
+	op.adoptParams(shared.ClientParams{MinPollInterval: time.Second, PaddingClass: "constant", MinRotationInterval: time.Minute, MaxRotationInterval: 3 * time.Minute})
+	op.paramOverrides = shared.ClientParams{PaddingClass: "none", MinRotationInterval: 5 * time.Minute, MaxRotationInterval: time.Minute}
+	params := op.clientParams()
+	// A flag overrides the consensus, and an invalid rotation range is ignored
+	if params.MinPollInterval != time.Second || params.PaddingClass != "none" || params.MinRotationInterval != time.Minute || params.MaxRotationInterval != 3*time.Minute {
+		t.Fatalf("the params are %+v", params)
+	}
+	for i := 0; i < 100; i++ {
+		if interval := op.rotationInterval(); interval < time.Minute || interval > 3*time.Minute {
+			t.Fatalf("rotating after %v", interval)
+		}
+	}
+}
+
+func TestMayPoll(t *testing.T) {
+	op := &OnionProxy{paramOverrides: shared.ClientParams{MinPollInterval: time.Hour}, sessions: make(map[string]*session)}
+	sess := testSession(op, "alice")
+	if !sess.mayPoll(time.Hour) || sess.mayPoll(time.Hour) {
+		t.Fatal("only the first poll in the interval may go out")
+	}
+	op.addNotice("Circuit rebuilt")
+	var resp []string
+	if err := (&OPServer{OnionProxy: op, sess: sess}).GetNewMessages(true, &resp); err != nil || len(resp) != 1 {
+		t.Fatalf("a held back poll gave %q, %v", resp, err)
+	}
+}
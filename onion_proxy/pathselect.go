@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type NoMatchingRelaysError error
+type NoCompatibleExitError error
+
+var (
+	noMatchingRelaysError NoMatchingRelaysError = errors.New("Not enough relays match the relay filters")
+	noCompatibleExitError NoCompatibleExitError = errors.New("No relay exits to the destination")
+
+	geoIP []geoIPRange // from -geoip, needed for {cc} filter entries
+
+	// never put two ORs of one diversity subnet in a locally picked path; set by -distinct-subnets
+	distinctSubnets = true
+)
+
+// Relays a user never or only wants to use. Entries are OR addresses
+// (ip:port, or [ipv6]:port), fingerprints (40 hex digits, see util.Fingerprint) or country
+// codes in braces, e.g. "127.0.0.1:8000,4f3c...,{ca}".
+type relayFilter struct {
+	addresses    map[string]bool
+	fingerprints map[string]bool
+	countries    map[string]bool
+}
+
+type geoIPRange struct {
+	network *net.IPNet
+	country string
+}
+
+func parseRelayFilter(spec string) *relayFilter {
+	filter := &relayFilter{
+		addresses:    make(map[string]bool),
+		fingerprints: make(map[string]bool),
+		countries:    make(map[string]bool),
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "{") && strings.HasSuffix(entry, "}"):
+			filter.countries[strings.Trim(entry, "{}")] = true
+		case strings.Contains(entry, ":"):
+			if address, err := shared.CanonicalAddress(entry); err == nil {
+				entry = address
+			}
+			filter.addresses[entry] = true
+		default:
+			filter.fingerprints[entry] = true
+		}
+	}
+	return filter
+}
+
+func (f *relayFilter) empty() bool {
+	return f == nil || len(f.addresses) == 0 && len(f.fingerprints) == 0 && len(f.countries) == 0
+}
+
+func (f *relayFilter) matches(info shared.OnionRouterInfo) bool {
+	if f == nil {
+		return false
+	}
+	for _, address := range append([]string{info.Address}, info.AltAddresses...) {
+		if f.addresses[strings.ToLower(address)] {
+			return true
+		}
+	}
+	if info.PubKey != nil && f.fingerprints[util.Fingerprint(info.PubKey)] {
+		return true
+	}
+	if len(f.countries) > 0 {
+		for _, address := range append([]string{info.Address}, info.AltAddresses...) {
+			if country := countryOf(address); country != "" && f.countries[country] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Loads a GeoIP file with one "cidr country-code" pair per line. Blank lines
+// and lines starting with # are skipped.
+func loadGeoIP(path string) ([]geoIPRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ranges []geoIPRange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Invalid GeoIP line: " + line)
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, geoIPRange{network: network, country: strings.ToLower(fields[1])})
+	}
+	return ranges, scanner.Err()
+}
+
+// Returns the country code of an OR address, or "" if it is unknown
+func countryOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	for _, r := range geoIP {
+		if r.network.Contains(ip) {
+			return r.country
+		}
+	}
+	return ""
+}
+
+func (op *OnionProxy) selectsPathLocally() bool {
+	return !op.excludeRelays.empty() || !op.onlyRelays.empty() || op.state != nil
+}
+
+// Returns the ORs to build a circuit through, ending in an exit that accepts
+// every destination. Without relay filters the directory server picks the
+// path; with them the OP picks from the consensus so the filters never leave
+// this machine. So do paths to more than one destination: the directory
+// server only ever learns the first, the proxy's default chat server for
+// chat circuits, and not which other chat servers the user has channels on.
+// ORs in avoid, which stalled an earlier build, are left out, also picking
+// the path locally, and so are slow relays where enough others are left. A proxy keeping state starts every path at its entry
+// guard, so it picks all its paths locally, and so do circuits of a profile,
+// at the profile's guard. guards keeps the entry guard, nil for none.
+func (op *OnionProxy) choosePath(destinations []string, streams bool, avoid map[string]bool, guards guardKeeper) ([]shared.OnionRouterInfo, string, error) {
+	// Streams outlive chat circuits, so their circuits only use Stable ORs
+	req := shared.CircuitRequest{MinHops: op.minHops, Destination: destinations[0], Streams: streams, Stable: streams}
+	local := op.selectsPathLocally() || guards != nil || len(destinations) > 1 || len(avoid) > 0 || len(slowRelays()) > 0
+
+	var ORSet shared.OnionRouterInfos //ORSet can be a struct containing the OR address and pubkey
+	var err error
+	if local {
+		ORSet, err = op.fetchConsensus(context.Background())
+	} else {
+		err = op.dirServer.Call("DServer.GetNodes", req, &ORSet)
+		if _, ok := err.(rpc.ServerError); err != nil && !ok {
+			// No directory server to pick the path, pick it from the cache
+			if cached, ok := op.consensusCache.load(); ok {
+				ORSet, err, local = cached, nil, true
+			}
+		}
+	}
+	if err == notTrustedDirectoryServerError {
+		return nil, shared.BuildErrUntrustedDirectory, err
+	}
+	if err != nil {
+		util.HandleNonFatalError("Could not get circuit from directory server", err)
+		return nil, shared.BuildErrDirectory, err
+	}
+
+	if !trustedORSet(ORSet) {
+		return nil, shared.BuildErrUntrustedDirectory, notTrustedDirectoryServerError
+	}
+
+	op.adoptParams(ORSet.Params)
+
+	if !local {
+		// Directory servers from before exit policies pick any exit
+		if n := len(ORSet.ORInfos); n > 0 && !exitsToAll(ORSet.ORInfos[n-1], destinations, streams) {
+			return nil, shared.BuildErrDirectory, noCompatibleExitError
+		}
+		return ORSet.ORInfos, "", nil
+	}
+
+	// Directory servers from before the Stable flag mark no OR Stable
+	flagsStable := false
+	for _, info := range ORSet.ORInfos {
+		flagsStable = flagsStable || info.Stable
+	}
+
+	var candidates []shared.OnionRouterInfo
+	var exits []shared.OnionRouterInfo
+	for _, info := range ORSet.ORInfos {
+		if op.excludeRelays.matches(info) || avoid[info.Address] {
+			continue
+		}
+		if req.Stable && flagsStable && !info.Stable {
+			continue
+		}
+		if !op.onlyRelays.empty() && !op.onlyRelays.matches(info) {
+			continue
+		}
+		candidates = append(candidates, info)
+		if exitsToAll(info, destinations, streams) {
+			exits = append(exits, info)
+		}
+	}
+
+	hops := fullCircuitHops
+	candidates, exits = withoutSlowRelays(candidates, exits, hops)
+	if len(candidates) < hops {
+		if op.minHops < 1 || len(candidates) < op.minHops {
+			return nil, shared.BuildErrDirectory, noMatchingRelaysError
+		}
+		hops = len(candidates)
+	}
+
+	var guard []shared.OnionRouterInfo
+	if guards != nil && hops > 1 {
+		eligible := candidates
+		if flagsStable {
+			eligible = stableOnly(candidates)
+		}
+		if len(eligible) == 0 {
+			return nil, shared.BuildErrDirectory, noMatchingRelaysError
+		}
+		guard = []shared.OnionRouterInfo{entryGuard(guards, eligible)}
+		exits = withoutOR(exits, guard[0])
+		candidates = withoutOR(candidates, guard[0])
+	}
+
+	exit := weightedSample(exits, 1)
+	if len(exit) == 0 {
+		return nil, shared.BuildErrDirectory, noCompatibleExitError
+	}
+	if guard == nil && hops > 1 && flagsStable {
+		// The first hop is Stable like the directory server picks it
+		guard = weightedSample(stableOnly(withoutOR(candidates, exit[0])), 1)
+		if len(guard) == 0 {
+			return nil, shared.BuildErrDirectory, noMatchingRelaysError
+		}
+		candidates = withoutOR(candidates, guard[0])
+	}
+	path := append(guard, weightedSample(withoutOR(candidates, exit[0]), hops-1-len(guard))...)
+	path = append(path, exit[0])
+	if len(path) < hops && (op.minHops < 1 || len(path) < op.minHops) {
+		return nil, shared.BuildErrDirectory, noMatchingRelaysError
+	}
+	return path, "", nil
+}
+
+// The OR every locally picked path starts at. Keeping the same first hop
+// means an adversary running some ORs only sees where the proxy's circuits
+// come from if it runs the guard, instead of eventually for some circuit. It
+// is replaced when it leaves the candidates: it left the consensus, a relay
+// filter excludes it, or it stalled a build. candidates must not be empty.
+func entryGuard(guards guardKeeper, candidates []shared.OnionRouterInfo) shared.OnionRouterInfo {
+	current := guards.entryGuard()
+	for _, info := range candidates {
+		if info.Address == current {
+			return info
+		}
+	}
+
+	guard := weightedSample(candidates, 1)[0]
+	guards.setEntryGuard(guard.Address)
+	util.OutLog.Printf("New entry guard %s\n", guard.Address)
+	return guard
+}
+
+// Keeps an entry guard: the proxy's state file, or a profile
+type guardKeeper interface {
+	entryGuard() string
+	setEntryGuard(address string)
+}
+
+// What keeps the entry guard of purpose's circuits: the profile of its
+// isolation key, else the state file, or nil if nothing does
+func (op *OnionProxy) guardsFor(purpose string) guardKeeper {
+	if p := op.profileOf(purpose); p != nil {
+		return p
+	}
+	if op.state != nil {
+		return op.state
+	}
+	return nil
+}
+
+// Checks that an OR list was signed by the trusted directory server, was
+// not changed after signing and, if the directory signed its validity, is
+// valid now
+func trustedORSet(ORSet shared.OnionRouterInfos) bool {
+	return verifyORSet(ORSet, directoryServerPubKey) && !consensusExpired(ORSet, time.Now())
+}
+
+// Whether a consensus' signed validity doesn't cover now, allowing for
+// maxConsensusClockSkew. Consensuses without one, from directory servers from
+// before signed validity, never expire here; they are never cached either.
+func consensusExpired(ORSet shared.OnionRouterInfos, now time.Time) bool {
+	if !signsValidity(ORSet) {
+		return false
+	}
+	return now.Add(maxConsensusClockSkew).Before(ORSet.ValidAfter) || now.After(ORSet.ValidUntil)
+}
+
+// The key a signed list names, on P-384, if it is trustedPubKey. The curve
+// the list names is decoded like the rest of it, so any curve could come
+// with it; it is ignored rather than computed with.
+func trustedDirectoryKey(pub *ecdsa.PublicKey, trustedPubKey string) (*ecdsa.PublicKey, bool) {
+	if pub == nil || pub.X == nil || pub.Y == nil {
+		return nil, false
+	}
+	key := &ecdsa.PublicKey{Curve: elliptic.P384(), X: pub.X, Y: pub.Y}
+	if !key.Curve.IsOnCurve(key.X, key.Y) || util.PubKeyToString(*key) != trustedPubKey {
+		return nil, false
+	}
+	return key, true
+}
+
+// Whether the directory server signed when the consensus may be used
+func signsValidity(ORSet shared.OnionRouterInfos) bool {
+	return ORSet.ValiditySigR != nil && ORSet.ValiditySigS != nil
+}
+
+// Checks an OR list against the hex encoded key of the directory server that
+// must have signed it. Depends on nothing but its arguments, so it can be
+// fuzzed, and rejects lists with missing keys or signatures instead of
+// panicking on them.
+func verifyORSet(ORSet shared.OnionRouterInfos, trustedPubKey string) bool {
+	pub, ok := trustedDirectoryKey(ORSet.PubKey, trustedPubKey)
+	if !ok || ORSet.SigR == nil || ORSet.SigS == nil {
+		return false
+	}
+
+	hash, err := shared.ConsensusHash(ORSet.ORInfos, ORSet.Params)
+	if err != nil || string(hash) != string(ORSet.Hash) {
+		return false
+	}
+	if !ecdsa.Verify(pub, ORSet.Hash, ORSet.SigR, ORSet.SigS) {
+		return false
+	}
+
+	// Half a validity signature is a forged one
+	if ORSet.ValiditySigR == nil && ORSet.ValiditySigS == nil {
+		return true
+	}
+	if !signsValidity(ORSet) {
+		return false
+	}
+	validity := shared.ConsensusValidityHash(ORSet.Hash, ORSet.ValidAfter, ORSet.ValidUntil)
+	return ecdsa.Verify(pub, validity, ORSet.ValiditySigR, ORSet.ValiditySigS)
+}
+
+// Picks n distinct ORs, each with a chance proportional to its weight. With
+// distinctSubnets no two share a diversity subnet, so fewer than n may be
+// picked.
+func weightedSample(orInfos []shared.OnionRouterInfo, n int) []shared.OnionRouterInfo {
+	remaining := append([]shared.OnionRouterInfo(nil), orInfos...)
+
+	var chosen []shared.OnionRouterInfo
+	usedSubnets := make(map[string]bool)
+	for len(chosen) < n && len(remaining) > 0 {
+		total := 0.0
+		for _, info := range remaining {
+			total += info.Weight
+		}
+
+		r := util.Random.Float64() * total
+		i := 0
+		for ; i < len(remaining)-1 && r >= remaining[i].Weight; i++ {
+			r -= remaining[i].Weight
+		}
+
+		chosen = append(chosen, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+		if !distinctSubnets {
+			continue
+		}
+
+		for _, subnet := range chosen[len(chosen)-1].DiversitySubnets() {
+			usedSubnets[subnet] = true
+		}
+		var diverse []shared.OnionRouterInfo
+		for _, info := range remaining {
+			if !sharesSubnet(info, usedSubnets) {
+				diverse = append(diverse, info)
+			}
+		}
+		remaining = diverse
+	}
+
+	return chosen
+}
+
+// The Stable ORs of orInfos
+func stableOnly(orInfos []shared.OnionRouterInfo) []shared.OnionRouterInfo {
+	var stable []shared.OnionRouterInfo
+	for _, info := range orInfos {
+		if info.Stable {
+			stable = append(stable, info)
+		}
+	}
+	return stable
+}
+
+// Whether the OR can exit to every destination
+func exitsToAll(info shared.OnionRouterInfo, destinations []string, streams bool) bool {
+	for _, destination := range destinations {
+		if !info.ExitsTo(destination, streams) {
+			return false
+		}
+	}
+	return true
+}
+
+// The ORs besides exit that can share a circuit with it
+func withoutOR(orInfos []shared.OnionRouterInfo, exit shared.OnionRouterInfo) []shared.OnionRouterInfo {
+	exitSubnets := make(map[string]bool)
+	if distinctSubnets {
+		for _, subnet := range exit.DiversitySubnets() {
+			exitSubnets[subnet] = true
+		}
+	}
+	var others []shared.OnionRouterInfo
+	for _, info := range orInfos {
+		if info.Address != exit.Address && !sharesSubnet(info, exitSubnets) {
+			others = append(others, info)
+		}
+	}
+	return others
+}
+
+func sharesSubnet(info shared.OnionRouterInfo, used map[string]bool) bool {
+	for _, subnet := range info.DiversitySubnets() {
+		if used[subnet] {
+			return true
+		}
+	}
+	return false
+}
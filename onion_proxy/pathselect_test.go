@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+func TestRelayFilter(t *testing.T) {
+	pub := testRSAPublicKey(t)
+	filter := parseRelayFilter(" 127.0.0.1:8001, " + util.Fingerprint(pub) + ",{CA},")
+	if filter.empty() || !parseRelayFilter(" , ").empty() {
+		t.Fatal("filters are empty only without entries")
+	}
+
+	geoIP = []geoIPRange{}
+	defer func() { geoIP = nil }()
+	path := filepath.Join(t.TempDir(), "geoip.txt")
+	if err := ioutil.WriteFile(path, []byte("# test ranges\n10.0.0.0/8 CA\n\n192.168.0.0/16 us\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ranges, err := loadGeoIP(path)
+	if err != nil || len(ranges) != 2 {
+		t.Fatalf("loaded %v, %v", ranges, err)
+	}
+	geoIP = ranges
+
+	for _, test := range []struct {
+		info shared.OnionRouterInfo
+		want bool
+	}{
+		{shared.OnionRouterInfo{Address: "127.0.0.1:8001"}, true},
+		{shared.OnionRouterInfo{Address: "127.0.0.1:8002", PubKey: pub}, true},
+		{shared.OnionRouterInfo{Address: "10.1.2.3:8000"}, true},
+		{shared.OnionRouterInfo{Address: "192.168.1.1:8000"}, false},
+		{shared.OnionRouterInfo{Address: "127.0.0.1:8003", PubKey: testRSAPublicKey(t)}, false},
+	} {
+		if got := filter.matches(test.info); got != test.want {
+			t.Fatalf("%s matched %v, want %v", test.info.Address, got, test.want)
+		}
+	}
+}
+
+// Signs orInfos like the directory server, valid for three hours from validAfter
+func testConsensus(t testing.TB, key *ecdsa.PrivateKey, orInfos []shared.OnionRouterInfo, validAfter time.Time) shared.OnionRouterInfos {
+	hash, err := shared.ConsensusHash(orInfos, shared.ClientParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigR, sigS, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validUntil := validAfter.Add(3 * time.Hour)
+	validityR, validityS, err := ecdsa.Sign(rand.Reader, key, shared.ConsensusValidityHash(hash, validAfter, validUntil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoded from gob, the key's curve is its params
+	pub := key.PublicKey
+	pub.Curve = pub.Curve.Params()
+	return shared.OnionRouterInfos{
+		PubKey:       &pub,
+		Hash:         hash,
+		SigR:         sigR,
+		SigS:         sigS,
+		ORInfos:      orInfos,
+		ValidAfter:   validAfter,
+		ValidUntil:   validUntil,
+		ValiditySigR: validityR,
+		ValiditySigS: validityS,
+	}
+}
+
+func testDirectoryKey(t testing.TB) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, util.PubKeyToString(key.PublicKey)
+}
+
+var testORInfos = []shared.OnionRouterInfo{
+	{Address: "127.0.0.1:8001", Weight: 1, ProtocolVersion: shared.ProtocolVersion},
+	{Address: "127.0.0.1:8002", Weight: 2, ProtocolVersion: shared.ProtocolVersion},
+}
+
+func TestVerifyORSet(t *testing.T) {
+	key, trusted := testDirectoryKey(t)
+	now := time.Now().Truncate(time.Second)
+	consensus := testConsensus(t, key, testORInfos, now)
+	if !verifyORSet(consensus, trusted) {
+		t.Fatal("a signed consensus didn't verify")
+	}
+
+	other, untrusted := testDirectoryKey(t)
+	if verifyORSet(testConsensus(t, other, testORInfos, now), trusted) || verifyORSet(consensus, untrusted) {
+		t.Fatal("a consensus verified against another key")
+	}
+	if trustedORSet(consensus) {
+		t.Fatal("a consensus not signed by the trusted directory server was trusted")
+	}
+
+	changed := consensus
+	changed.ORInfos = append([]shared.OnionRouterInfo(nil), testORInfos...)
+	changed.ORInfos[0].Weight = 100
+	if verifyORSet(changed, trusted) {
+		t.Fatal("a changed consensus verified")
+	}
+	extended := consensus
+	extended.ValidUntil = extended.ValidUntil.Add(time.Hour)
+	if verifyORSet(extended, trusted) {
+		t.Fatal("a consensus with a changed validity verified")
+	}
+	half := consensus
+	half.ValiditySigS = nil
+	if verifyORSet(half, trusted) {
+		t.Fatal("a consensus with half a validity signature verified")
+	}
+	unsigned := consensus
+	unsigned.ValidAfter, unsigned.ValidUntil, unsigned.ValiditySigR, unsigned.ValiditySigS = time.Time{}, time.Time{}, nil, nil
+	if !verifyORSet(unsigned, trusted) {
+		t.Fatal("a consensus from before signed validity didn't verify")
+	}
+
+	// Parts missing are rejected rather than panicked on
+	for _, broken := range []func(*shared.OnionRouterInfos){
+		func(c *shared.OnionRouterInfos) { c.PubKey = nil },
+		func(c *shared.OnionRouterInfos) { c.PubKey = &ecdsa.PublicKey{} },
+		func(c *shared.OnionRouterInfos) { c.SigR = nil },
+		func(c *shared.OnionRouterInfos) { c.SigS = nil },
+	} {
+		missing := consensus
+		pub := *consensus.PubKey
+		missing.PubKey = &pub
+		broken(&missing)
+		if verifyORSet(missing, trusted) {
+			t.Fatalf("an incomplete consensus verified: %+v", missing)
+		}
+	}
+}
+
+// A key off its curve is rejected rather than panicked on, whatever curve
+// the list names
+func TestTrustedDirectoryKey(t *testing.T) {
+	key, trusted := testDirectoryKey(t)
+	consensus := testConsensus(t, key, testORInfos, time.Now())
+	if pub, ok := trustedDirectoryKey(consensus.PubKey, trusted); !ok || pub.Curve != elliptic.P384() {
+		t.Fatal("the trusted key wasn't taken on P-384")
+	}
+	offCurve := *consensus.PubKey
+	offCurve.Y = new(big.Int).Add(offCurve.Y, big.NewInt(1))
+	consensus.PubKey = &offCurve
+	if _, ok := trustedDirectoryKey(&offCurve, trusted); ok || verifyORSet(consensus, trusted) {
+		t.Fatal("a key off the curve was trusted")
+	}
+	other := key.PublicKey
+	other.Curve = elliptic.P256().Params()
+	if _, ok := trustedDirectoryKey(&other, trusted); !ok {
+		t.Fatal("the curve the list names wasn't ignored")
+	}
+	if verifyChatServerList(shared.ChatServerList{PubKey: &offCurve}, trusted) {
+		t.Fatal("a chat server list with a key off the curve verified")
+	}
+}
+
+func TestConsensusExpired(t *testing.T) {
+	key, _ := testDirectoryKey(t)
+	now := time.Now()
+	consensus := testConsensus(t, key, testORInfos, now)
+	if consensusExpired(consensus, now) || consensusExpired(consensus, now.Add(-maxConsensusClockSkew/2)) {
+		t.Fatal("a consensus in its validity expired")
+	}
+	if !consensusExpired(consensus, now.Add(4*time.Hour)) || !consensusExpired(consensus, now.Add(-2*maxConsensusClockSkew)) {
+		t.Fatal("a consensus outside its validity didn't expire")
+	}
+	consensus.ValiditySigR, consensus.ValiditySigS = nil, nil
+	if consensusExpired(consensus, now.Add(4*time.Hour)) {
+		t.Fatal("a consensus without a signed validity expired")
+	}
+}
+
+func FuzzVerifyORSet(f *testing.F) {
+	gob.Register(&elliptic.CurveParams{})
+	key, trusted := testDirectoryKey(f)
+	for _, consensus := range []shared.OnionRouterInfos{
+		testConsensus(f, key, testORInfos, time.Now()),
+		testConsensus(f, key, nil, time.Now()),
+	} {
+		// As a directory server sends it, and as the consensus cache holds it
+		var encoded bytes.Buffer
+		if err := gob.NewEncoder(&encoded).Encode(cachedConsensus{Consensus: consensus}); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var cached cachedConsensus
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(&cached) != nil {
+			return
+		}
+		consensus := cached.Consensus
+		if !verifyORSet(consensus, trusted) {
+			return
+		}
+		hash, err := shared.ConsensusHash(consensus.ORInfos, consensus.Params)
+		if err != nil || !bytes.Equal(hash, consensus.Hash) {
+			t.Fatal("verified a consensus whose hash doesn't match it")
+		}
+	})
+}
+
+func TestWeightedSample(t *testing.T) {
+	orInfos := []shared.OnionRouterInfo{
+		{Address: "127.0.0.1:8001", Weight: 0.01},
+		{Address: "127.0.0.1:8002", Weight: 1},
+		{Address: "127.0.0.1:8003", Weight: 1},
+	}
+	light := 0
+	for i := 0; i < 1000; i++ {
+		chosen := weightedSample(orInfos, 2)
+		if len(chosen) != 2 || chosen[0].Address == chosen[1].Address {
+			t.Fatalf("sampled %v", chosen)
+		}
+		if chosen[0].Address == "127.0.0.1:8001" {
+			light++
+		}
+	}
+	if light > 50 {
+		t.Fatalf("a relay with 1%% of the weight was picked first %d times in 1000", light)
+	}
+	if all := weightedSample(orInfos, 5); len(all) != len(orInfos) {
+		t.Fatalf("sampling more than there are gave %v", all)
+	}
+}
+
+func TestWeightedSampleDistinctSubnets(t *testing.T) {
+	orInfos := []shared.OnionRouterInfo{
+		{Address: "10.1.0.1:8001", Weight: 1},
+		{Address: "10.1.0.2:8001", Weight: 1},
+		{Address: "10.2.0.1:8001", Weight: 1, AltAddresses: []string{"[2001:db8::1]:8001"}},
+		{Address: "[2001:db8::2]:8001", Weight: 1},
+	}
+	for i := 0; i < 100; i++ {
+		chosen := weightedSample(orInfos, 4)
+		if len(chosen) != 2 {
+			t.Fatalf("sampled %v from two /16s and one /32", chosen)
+		}
+		used := make(map[string]bool)
+		for _, info := range chosen {
+			if sharesSubnet(info, used) {
+				t.Fatalf("sampled %v, which share a subnet", chosen)
+			}
+			for _, subnet := range info.DiversitySubnets() {
+				used[subnet] = true
+			}
+		}
+	}
+
+	defer func() { distinctSubnets = true }()
+	distinctSubnets = false
+	if chosen := weightedSample(orInfos, 4); len(chosen) != 4 {
+		t.Fatalf("without -distinct-subnets sampled %v", chosen)
+	}
+}
+
+func TestChoosePathWithFilters(t *testing.T) {
+	op := &OnionProxy{onlyRelays: parseRelayFilter("127.0.0.1:8001")}
+	op.dirServer = testDirectoryClient(t, &testDirectory{})
+	if _, code, err := op.choosePath([]string{"1.2.3.4:6667"}, false, nil, nil); err != notTrustedDirectoryServerError || code != shared.BuildErrUntrustedDirectory {
+		t.Fatalf("an unsigned consensus gave %q, %v", code, err)
+	}
+}
+
+func TestWithoutOR(t *testing.T) {
+	defer func(distinct bool) { distinctSubnets = distinct }(distinctSubnets)
+	orInfos := []shared.OnionRouterInfo{{Address: "10.1.0.1:8001"}, {Address: "10.1.0.2:8001"}, {Address: "10.2.0.1:8001"}}
+
+	distinctSubnets = false
+	if others := withoutOR(orInfos, orInfos[0]); len(others) != 2 || others[0].Address != "10.1.0.2:8001" {
+		t.Fatalf("left %v", others)
+	}
+	// ORs sharing a subnet with the exit can't share its circuit
+	distinctSubnets = true
+	if others := withoutOR(orInfos, orInfos[0]); len(others) != 1 || others[0].Address != "10.2.0.1:8001" {
+		t.Fatalf("with -distinct-subnets left %v", others)
+	}
+}
+
+func TestStableOnly(t *testing.T) {
+	orInfos := []shared.OnionRouterInfo{{Address: "127.0.0.1:8001", Stable: true}, {Address: "127.0.0.1:8002"}, {Address: "127.0.0.1:8003", Stable: true}}
+	if stable := stableOnly(orInfos); len(stable) != 2 || stable[0].Address != "127.0.0.1:8001" || stable[1].Address != "127.0.0.1:8003" {
+		t.Fatalf("kept %v", stable)
+	}
+}
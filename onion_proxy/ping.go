@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type PingError error
+
+// Ping configurations
+const (
+	pingTimeout   time.Duration = 5 * time.Second
+	pingNonceSize int           = 16
+)
+
+var (
+	// Ping Errors
+	pingTimeoutError     PingError = errors.New("Ping was not answered in time")
+	pingAnswerError      PingError = errors.New("Exit node answered the ping with the wrong nonce")
+	pingUnsupportedError PingError = errors.New("A router on the circuit predates ping cells")
+)
+
+// Whether every hop relays ping cells. Middle hops pass them on as relay
+// cells, so the guard and the middle need the feature as much as the exit.
+func (c *circuit) pingable() bool {
+	for _, info := range c.ORInfoByHopNum {
+		if !shared.SupportsFeature(info.protocolVersion, shared.FeaturePing) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends a PING cell to the exit and waits for its echo. The round trip is
+// kept for GetCircuitStatus. Pings don't keep a circuit from counting as
+// idle.
+func (c *circuit) ping() (time.Duration, error) {
+	if !c.pingable() {
+		return 0, pingUnsupportedError
+	}
+	ping := shared.Ping{Nonce: make([]byte, pingNonceSize)}
+	if _, err := util.Random.Read(ping.Nonce); err != nil {
+		return 0, shared.InternalError("Could not generate ping nonce", err)
+	}
+	jsonData, err := json.Marshal(&ping)
+	if err != nil {
+		return 0, shared.EncodingError("ping", err)
+	}
+	onion, err := c.onionize(shared.CommandPing, jsonData)
+	if err != nil {
+		return 0, err
+	}
+
+	var reply shared.RelayReply
+	started := time.Now()
+	call := c.goCell(shared.RelayPing, shared.Cell{CircuitId: c.id, Data: onion}, &reply)
+	timeout := time.NewTimer(pingTimeout)
+	defer timeout.Stop()
+	select {
+	case <-call.Done:
+	case <-timeout.C:
+		return 0, pingTimeoutError
+	}
+	if call.Error != nil {
+		return 0, call.Error
+	}
+	if reply.Pong == nil || !bytes.Equal(reply.Pong.Nonce, ping.Nonce) {
+		return 0, pingAnswerError
+	}
+
+	rtt := time.Since(started)
+	atomic.StoreInt64(&c.rtt, int64(rtt))
+	return rtt, nil
+}
+
+// The round trip of the last answered ping, 0 if none was
+func (c *circuit) lastRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// Pings the circuit used for purpose, the data circuit if it is empty, and
+// returns the round trip to its exit. The session's isolated circuit for
+// the purpose goes first.
+func (s *OPServer) PingCircuit(purpose string, rtt *time.Duration) error {
+	if purpose == "" {
+		purpose = dataCircuit
+	}
+	s.OnionProxy.circuitsMutex.RLock()
+	circ, ok := s.OnionProxy.circuits[s.OnionProxy.purposeFor(s.session(), purpose)]
+	if !ok {
+		circ, ok = s.OnionProxy.circuits[purpose]
+	}
+	s.OnionProxy.circuitsMutex.RUnlock()
+	if !ok {
+		return noSuchCircuitError
+	}
+
+	var err error
+	*rtt, err = circ.ping()
+	circ.noteError(err)
+	return err
+}
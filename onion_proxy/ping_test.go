@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"../shared"
+)
+
+// Stands in for a guard whose exit echoes pings, or answers them with
+// nonce if it is set
+type testPingGuard struct {
+	t     *testing.T
+	keys  [][]byte
+	nonce []byte
+	pings int
+}
+
+func (g *testPingGuard) Relay(relay shared.RelayCell, reply *shared.RelayReply) error {
+	g.pings++
+	layer := shared.Onion{Data: relay.Cell.Data}
+	for _, key := range g.keys {
+		layer = peelLayer(g.t, key, layer.Data)
+	}
+	var ping shared.Ping
+	if err := json.Unmarshal(layer.Data, &ping); err != nil {
+		return err
+	}
+	if relay.Command != shared.RelayPing || layer.Command != shared.CommandPing || !layer.IsExitNode {
+		return shared.MalformedCellError{Reason: "not a ping"}
+	}
+	if g.nonce != nil {
+		ping.Nonce = g.nonce
+	}
+	reply.Pong = &ping
+	return nil
+}
+
+func TestPing(t *testing.T) {
+	circ := testCircuit(t)
+	if _, err := circ.ping(); err != pingUnsupportedError {
+		t.Fatalf("pinging through old routers gave %v, want %v", err, pingUnsupportedError)
+	}
+
+	guard := &testPingGuard{t: t}
+	for hopNum := 0; hopNum < len(circ.ORInfoByHopNum); hopNum++ {
+		info := circ.ORInfoByHopNum[hopNum]
+		info.protocolVersion = shared.ProtocolVersion
+		guard.keys = append(guard.keys, *info.sharedKey)
+	}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	idle := circ.idleFor()
+	rtt, err := circ.ping()
+	if err != nil || rtt <= 0 || circ.lastRTT() != rtt || guard.pings != 1 {
+		t.Fatalf("a ping took %v, kept %v, %v", rtt, circ.lastRTT(), err)
+	}
+	if circ.idleFor() < idle {
+		t.Fatal("a ping kept the circuit from counting as idle")
+	}
+	if !circ.probeable() {
+		t.Fatal("a pingable circuit isn't probed")
+	}
+
+	guard.nonce = bytes.Repeat([]byte{1}, pingNonceSize)
+	if _, err = circ.ping(); err != pingAnswerError {
+		t.Fatalf("a pong with the wrong nonce gave %v, want %v", err, pingAnswerError)
+	}
+	if circ.lastRTT() != rtt {
+		t.Fatal("an unanswered ping replaced the round trip")
+	}
+}
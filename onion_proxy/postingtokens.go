@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type PostingTokenError error
+
+const (
+	// Posting token configurations
+	postingTokenBatch        int = 8 // tokens asked for at once, few enough for one polling cell
+	postingTokensFetchRounds int = 2 // a changed key costs a round to learn it
+
+	// Anonymous messages go through a circuit of their own, built for them
+	// and never shared, so their exit can't tie them to the user's other traffic
+	anonymousCircuit string = "anonymous"
+)
+
+// An unspent posting token and the key messages spent with it are signed with
+type postingToken struct {
+	token shared.PostingToken
+	key   ed25519.PrivateKey
+}
+
+var (
+	// Posting Token Errors
+	noPostingTokensError  PostingTokenError = errors.New("The chat server issued no posting tokens; the allowance may be used up until its key changes")
+	badPostingTokensError PostingTokenError = errors.New("Exit node did not answer with posting tokens")
+	anonymousOffHomeError PostingTokenError = errors.New("Anonymous messages can only be sent to channels on the default chat server")
+)
+
+// Sends req.Message to req.Channel under no username, spending a posting
+// token of the session's. The chat server only learns that some registered
+// user sent it.
+func (s *OPServer) SendAnonymousMessage(req shared.ChatMessage, ack *bool) error {
+	sess := s.session()
+	if _, _, err := sess.identity(); err != nil {
+		return err
+	}
+	if s.OnionProxy.homeOf(sess, req.Channel) != s.OnionProxy.ircServerAddr {
+		return anonymousOffHomeError
+	}
+	// The server would publish the text in the clear
+	if sess.encrypted(req.Channel) {
+		return encryptedAnonymousError
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var token postingToken
+		if token, err = s.OnionProxy.takePostingToken(sess); err != nil {
+			break
+		}
+
+		chatMessage := shared.ChatMessage{
+			IRCServerAddr: s.OnionProxy.ircServerAddr,
+			Namespace:     s.OnionProxy.namespace,
+			Channel:       req.Channel,
+			Message:       req.Message,
+			Deadline:      req.Deadline,
+			SentAt:        time.Now(),
+			TTL:           req.TTL,
+		}
+		err = shared.SignAnonymousMessage(&chatMessage, token.token, token.key)
+		secmem.Wipe(token.key)
+		if err != nil {
+			break
+		}
+
+		err = s.OnionProxy.sendAnonymous(s.OnionProxy.purposeFor(sess, anonymousCircuit), chatMessage)
+		// The server rotated keys twice since the tokens were signed
+		if !shared.IsPostingKeyExpiredError(err) {
+			break
+		}
+		sess.dropPostingTokens(token.token.KeyId)
+	}
+	if err != nil {
+		util.HandleNonFatalError("Could not send anonymous message", err)
+		return err
+	}
+
+	util.OutLog.Println("Anonymous message successfully sent!")
+	*ack = true
+	return nil
+}
+
+// Sends an anonymous message over the anonymous circuit, or the session's
+// with -isolate, building it first if there is none or it is due for rotation
+func (op *OnionProxy) sendAnonymous(purpose string, chatMessage shared.ChatMessage) error {
+	op.anonymousCircuitMutex.Lock()
+	op.circuitsMutex.RLock()
+	circ, ok := op.circuits[purpose]
+	op.circuitsMutex.RUnlock()
+	if !ok || util.Time.Now().Sub(circ.builtAt) >= op.clientParams().MaxRotationInterval {
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			op.anonymousCircuitMutex.Unlock()
+			return err
+		}
+	}
+	op.anonymousCircuitMutex.Unlock()
+
+	return op.sendCommand(purpose, shared.CommandChatMessage, chatMessage)
+}
+
+// Takes one of the session's posting tokens, fetching more from the default
+// chat server if it has none left
+func (op *OnionProxy) takePostingToken(sess *session) (postingToken, error) {
+	sess.Lock()
+	if len(sess.postingTokens) == 0 {
+		sess.Unlock()
+		if err := op.fetchPostingTokens(sess); err != nil {
+			return postingToken{}, err
+		}
+		sess.Lock()
+	}
+	defer sess.Unlock()
+
+	if len(sess.postingTokens) == 0 {
+		return postingToken{}, noPostingTokensError
+	}
+	token := sess.postingTokens[0]
+	sess.postingTokens = sess.postingTokens[1:]
+	return token, nil
+}
+
+// Asks the default chat server to sign a batch of tokens blinded for its
+// current posting key, learning the key first if the session doesn't know it
+// or it changed. Called after registering, and whenever the tokens run out.
+func (op *OnionProxy) fetchPostingTokens(sess *session) error {
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	circ, err := op.getCircuit(op.purposeFor(sess, controlCircuit))
+	if err != nil {
+		return err
+	}
+	if !circ.exitSupports(shared.FeaturePostingTokens) {
+		return unsupportedByExitError(circ.exitAddress(), shared.FeaturePostingTokens)
+	}
+
+	sess.Lock()
+	key := sess.postingKey
+	sess.Unlock()
+
+	req := shared.PostingTokenRequest{
+		IRCServerAddr: op.ircServerAddr,
+		Namespace:     op.namespace,
+		Username:      username,
+		UserToken:     userToken,
+	}
+	for round := 0; round < postingTokensFetchRounds; round++ {
+		var blinded []shared.BlindedToken
+		req.KeyId, req.Blinded = "", nil
+		if key != nil && util.Time.Now().Before(key.ExpiresAt) {
+			req.KeyId = key.Id()
+			for i := 0; i < postingTokenBatch; i++ {
+				b, err := shared.BlindPostingToken(*key, op.namespace, util.Random)
+				if err != nil {
+					return err
+				}
+				blinded = append(blinded, b)
+				req.Blinded = append(req.Blinded, b.Blinded)
+			}
+		}
+
+		resp, err := requestPostingTokens(circ, req)
+		if err != nil {
+			return err
+		}
+		if resp.Key.Id() != req.KeyId {
+			key = &resp.Key
+			sess.Lock()
+			sess.postingKey = key
+			sess.Unlock()
+			continue
+		}
+
+		var tokens []postingToken
+		for i, signature := range resp.Signatures {
+			if i >= len(blinded) {
+				break
+			}
+			token, err := blinded[i].Unblind(signature)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, postingToken{token: token, key: blinded[i].PrivateKey})
+		}
+		for _, b := range blinded[len(tokens):] {
+			secmem.Wipe(b.PrivateKey)
+		}
+		if len(tokens) == 0 {
+			return noPostingTokensError
+		}
+
+		sess.Lock()
+		sess.postingTokens = append(sess.postingTokens, tokens...)
+		sess.Unlock()
+		util.OutLog.Printf("Got %d posting tokens, %d more may be issued\n", len(tokens), resp.Remaining)
+		return nil
+	}
+	return noPostingTokensError
+}
+
+func requestPostingTokens(circ *circuit, req shared.PostingTokenRequest) (shared.PostingTokenResponse, error) {
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return shared.PostingTokenResponse{}, err
+	}
+	onion, err := circ.OnionizeData(shared.CommandIssuePostingTokens, jsonData)
+	if err != nil {
+		return shared.PostingTokenResponse{}, err
+	}
+	resp, err := circ.SendPollingOnion(onion)
+	if err != nil {
+		return shared.PostingTokenResponse{}, err
+	}
+	if resp.PostingTokens == nil {
+		return shared.PostingTokenResponse{}, badPostingTokensError
+	}
+	return *resp.PostingTokens, nil
+}
+
+// Throws away tokens of a key the chat server no longer redeems
+func (sess *session) dropPostingTokens(keyId string) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	kept := sess.postingTokens[:0]
+	for _, token := range sess.postingTokens {
+		if token.token.KeyId == keyId {
+			secmem.Wipe(token.key)
+		} else {
+			kept = append(kept, token)
+		}
+	}
+	sess.postingTokens = kept
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"../shared"
+	"../util"
+)
+
+type ProfileError error
+
+// Profile configurations
+const (
+	profileFileName      = "profile"
+	profileKDFIterations = 600000
+	profileSaltBytes     = 16
+	profileKeyBytes      = 32
+)
+
+var (
+	// Profile Errors
+	noProfilesError         ProfileError = errors.New("This proxy keeps no profiles, start it with -profiles")
+	noSuchProfileError      ProfileError = errors.New("No profile with this name")
+	profileExistsError      ProfileError = errors.New("A profile with this name exists already")
+	invalidProfileNameError ProfileError = errors.New("Profile names are 1 to 32 letters, digits, - or _")
+	emptyPassphraseError    ProfileError = errors.New("A profile needs a passphrase")
+	wrongPassphraseError    ProfileError = errors.New("Wrong passphrase for this profile")
+	invalidProfileFileError ProfileError = errors.New("Profile file is damaged")
+)
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// A saved identity: the username, user token, device id and signing key a
+// session connected with it chats as, and the entry guard of its circuits.
+// Every profile lives in a directory of its own, sealed with a key derived
+// from its passphrase, so neither the files nor the circuits tie one persona
+// to another.
+type profile struct {
+	sync.Mutex
+	name string
+	path string
+	salt []byte
+	aead cipher.AEAD
+	data profileData
+}
+
+// What a profile file holds, sealed
+type profileData struct {
+	Username       string
+	UserToken      string
+	DeviceId       string
+	SigningKeySeed []byte
+	Guard          string // address of the first hop of the profile's circuits, "" until one is picked
+}
+
+// A profile file
+type sealedProfile struct {
+	Iterations int
+	Salt       []byte
+	Sealed     []byte // nonce, then profileData as JSON sealed with AES-GCM
+}
+
+func profileAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, profileKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (op *OnionProxy) profilePath(name string) (string, error) {
+	if op.profilesDir == "" {
+		return "", noProfilesError
+	}
+	if !profileNamePattern.MatchString(name) {
+		return "", invalidProfileNameError
+	}
+	return filepath.Join(op.profilesDir, name, profileFileName), nil
+}
+
+// Creates the profile name, chatting as username with a new user token,
+// device id and signing key
+func (op *OnionProxy) createProfile(name string, username string, passphrase string) error {
+	path, err := op.profilePath(name)
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return emptyPassphraseError
+	}
+	if err := os.Mkdir(filepath.Dir(path), 0700); err != nil {
+		if os.IsExist(err) {
+			return profileExistsError
+		}
+		return err
+	}
+
+	userToken, err := newUserToken()
+	if err != nil {
+		return err
+	}
+	deviceId, err := newUserToken()
+	if err != nil {
+		return err
+	}
+	_, signingKey, err := ed25519.GenerateKey(util.Random)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, profileSaltBytes)
+	if _, err := util.Random.Read(salt); err != nil {
+		return err
+	}
+	aead, err := profileAEAD(passphrase, salt, profileKDFIterations)
+	if err != nil {
+		return err
+	}
+
+	p := &profile{
+		name: name,
+		path: path,
+		salt: salt,
+		aead: aead,
+		data: profileData{
+			Username:       username,
+			UserToken:      userToken,
+			DeviceId:       deviceId[:8],
+			SigningKeySeed: signingKey.Seed(),
+		},
+	}
+	p.Lock()
+	defer p.Unlock()
+	if err := p.save(); err != nil {
+		os.RemoveAll(filepath.Dir(path))
+		return err
+	}
+	util.OutLog.Printf("Created profile %s\n", name)
+	return nil
+}
+
+// Opens the profile name with its passphrase. Sessions connecting with the
+// same profile share one, so a guard picked for one is kept for all.
+func (op *OnionProxy) openProfile(name string, passphrase string) (*profile, error) {
+	path, err := op.profilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, noSuchProfileError
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sealed sealedProfile
+	if err := json.Unmarshal(raw, &sealed); err != nil || sealed.Iterations < 1 {
+		return nil, invalidProfileFileError
+	}
+
+	// The passphrase is checked every time, even for a profile already open
+	aead, err := profileAEAD(passphrase, sealed.Salt, sealed.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed.Sealed) < aead.NonceSize() {
+		return nil, invalidProfileFileError
+	}
+	nonce, ciphertext := sealed.Sealed[:aead.NonceSize()], sealed.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, wrongPassphraseError
+	}
+
+	op.profilesMutex.Lock()
+	defer op.profilesMutex.Unlock()
+	if p, ok := op.profiles[name]; ok {
+		return p, nil
+	}
+
+	p := &profile{name: name, path: path, salt: sealed.Salt, aead: aead}
+	if err := json.Unmarshal(plaintext, &p.data); err != nil || len(p.data.SigningKeySeed) != ed25519.SeedSize {
+		return nil, invalidProfileFileError
+	}
+	op.profiles[name] = p
+	return p, nil
+}
+
+// Names of the profiles in -profiles, sorted
+func (op *OnionProxy) listProfiles() ([]string, error) {
+	if op.profilesDir == "" {
+		return nil, noProfilesError
+	}
+	entries, err := os.ReadDir(op.profilesDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !profileNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(op.profilesDir, entry.Name(), profileFileName)); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Seals the profile with a new nonce and writes it. Caller must hold the
+// profile lock.
+func (p *profile) save() error {
+	plaintext, err := json.Marshal(p.data)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := util.Random.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.Marshal(sealedProfile{
+		Iterations: profileKDFIterations,
+		Salt:       p.salt,
+		Sealed:     p.aead.Seal(nonce, nonce, plaintext, []byte(p.name)),
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// The identity sessions of the profile chat as
+func (p *profile) identity() (username string, userToken string, deviceId string, signingKey ed25519.PrivateKey) {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.data.Username, p.data.UserToken, p.data.DeviceId, ed25519.NewKeyFromSeed(p.data.SigningKeySeed)
+}
+
+func (p *profile) setUsername(username string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.data.Username = username
+	return p.save()
+}
+
+func (p *profile) entryGuard() string {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.data.Guard
+}
+
+func (p *profile) setEntryGuard(address string) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.data.Guard = address
+	if err := p.save(); err != nil {
+		util.HandleNonFatalError("Could not save profile "+p.name, err)
+	}
+}
+
+// Creates a profile. The client connects with it through ConnectProfile.
+func (s *OPServer) CreateProfile(req shared.ProfileRequest, ack *bool) error {
+	if err := s.OnionProxy.createProfile(req.Name, req.Username, req.Passphrase); err != nil {
+		return err
+	}
+	*ack = true
+	return nil
+}
+
+// Connects the session with a profile instead of a username: it chats as the
+// profile's username, signs with its key, and its circuits are its own and
+// start at the profile's entry guard. Replies with the username.
+func (s *OPServer) ConnectProfile(req shared.ProfileRequest, username *string) error {
+	p, err := s.OnionProxy.openProfile(req.Name, req.Passphrase)
+	if err != nil {
+		return err
+	}
+	name, userToken, deviceId, signingKey := p.identity()
+	if err := s.connect(name, userToken, deviceId, signingKey, p); err != nil {
+		return err
+	}
+	*username = name
+	return nil
+}
+
+func (s *OPServer) ListProfiles(_ignored bool, names *[]string) error {
+	list, err := s.OnionProxy.listProfiles()
+	if err != nil {
+		return err
+	}
+	*names = list
+	return nil
+}
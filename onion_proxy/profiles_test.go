@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testProfileProxy(t *testing.T) *OnionProxy {
+	return &OnionProxy{
+		sessions:        make(map[string]*session),
+		profilesDir:     t.TempDir(),
+		profiles:        make(map[string]*profile),
+		profileKeys:     make(map[string]*profile),
+		isolationSecret: []byte("secret"),
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	op := testProfileProxy(t)
+	if err := op.createProfile("work", "alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name, passphrase string
+		want             error
+	}{
+		{"work", "correct horse", profileExistsError},
+		{"../work", "correct horse", invalidProfileNameError},
+		{"home", "", emptyPassphraseError},
+	} {
+		if err := op.createProfile(c.name, "alice", c.passphrase); err != c.want {
+			t.Errorf("creating %q gave %v, want %v", c.name, err, c.want)
+		}
+	}
+	if names, err := op.listProfiles(); err != nil || len(names) != 1 || names[0] != "work" {
+		t.Fatalf("listed %v, %v", names, err)
+	}
+
+	// The file gives nothing away without the passphrase
+	raw, err := os.ReadFile(filepath.Join(op.profilesDir, "work", profileFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filepath.Join(op.profilesDir, "work")); info.Mode().Perm() != 0700 {
+		t.Fatalf("the profile directory is %v", info.Mode())
+	}
+	for _, secret := range []string{"alice", "correct horse"} {
+		if bytes.Contains(raw, []byte(secret)) {
+			t.Fatalf("the profile file holds %q in the clear", secret)
+		}
+	}
+
+	if _, err = op.openProfile("work", "wrong"); err != wrongPassphraseError {
+		t.Fatalf("a wrong passphrase gave %v, want %v", err, wrongPassphraseError)
+	}
+	if _, err = op.openProfile("play", "correct horse"); err != noSuchProfileError {
+		t.Fatalf("a missing profile gave %v, want %v", err, noSuchProfileError)
+	}
+	p, err := op.openProfile("work", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := op.openProfile("work", "correct horse"); again != p {
+		t.Fatal("opening a profile twice gave two profiles")
+	}
+	p.setEntryGuard("127.0.0.1:8001")
+	if err = p.setUsername("carol"); err != nil {
+		t.Fatal(err)
+	}
+
+	// What was saved is there after a restart
+	restarted := testProfileProxy(t)
+	restarted.profilesDir = op.profilesDir
+	reopened, err := restarted.openProfile("work", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, userToken, deviceId, signingKey := reopened.identity()
+	wantUsername, wantToken, wantDevice, wantKey := p.identity()
+	if username != "carol" || userToken != wantToken || deviceId != wantDevice || !signingKey.Equal(wantKey) || reopened.entryGuard() != "127.0.0.1:8001" {
+		t.Fatalf("reopened %+v, want %s", reopened.data, wantUsername)
+	}
+
+	if _, err = (&OnionProxy{}).listProfiles(); err != noProfilesError {
+		t.Fatalf("without -profiles listing gave %v, want %v", err, noProfilesError)
+	}
+}
+
+func TestProfileCircuitsAreIsolated(t *testing.T) {
+	op := testProfileProxy(t)
+	p := &profile{name: "work"}
+	plain, withProfile := testSession(op, "alice"), testSession(op, "alice")
+	withProfile.profile = p
+
+	if purpose := op.purposeFor(plain, dataCircuit); purpose != dataCircuit {
+		t.Fatalf("without a profile or -isolate the purpose is %q", purpose)
+	}
+	purpose := op.purposeFor(withProfile, dataCircuit)
+	if !isolated(purpose) || op.profileOf(purpose) != p || op.profileOf(dataCircuit) != nil {
+		t.Fatalf("a profile's purpose is %q", purpose)
+	}
+	if guards, ok := op.guardsFor(purpose).(*profile); !ok || guards != p {
+		t.Fatal("a profile's circuits don't start at its guard")
+	}
+	if op.guardsFor(dataCircuit) != nil {
+		t.Fatal("without a state file the shared circuits keep a guard")
+	}
+}
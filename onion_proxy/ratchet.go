@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type RatchetError error
+
+const (
+	// Double ratchet configurations
+	prekeyBatch         int           = 10 // one-time prekeys left on the chat server at once
+	prekeyLowWater      int           = 3  // more are left once fewer than this remain
+	prekeyRetryInterval time.Duration = time.Minute
+)
+
+var (
+	// Double Ratchet Errors
+	badPrekeyBundleError RatchetError = errors.New("Exit node did not answer with a prekey bundle")
+	notEncryptingError   RatchetError = errors.New("Connect again to send encrypted direct messages")
+	noRatchetError       RatchetError = errors.New("No encrypted session with the sender; the next message either of you sends starts one")
+)
+
+// Encrypts a direct message in the session's double ratchet session with the
+// recipient, starting one from their prekey bundle if there is none. A
+// recipient who left no prekeys gets the message in the clear, with a notice
+// saying so.
+func (op *OnionProxy) encryptDirect(sess *session, chatMessage *shared.ChatMessage) error {
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return err
+	}
+	sess.Lock()
+	identity := sess.encryptionKey
+	ratchet := sess.ratchets[chatMessage.Recipient]
+	sess.Unlock()
+	if identity == nil {
+		return notEncryptingError
+	}
+
+	if ratchet == nil {
+		bundle, err := op.getPrekeyBundle(sess, shared.PrekeyBundleRequest{
+			IRCServerAddr: op.ircServerAddr,
+			Namespace:     op.namespace,
+			Username:      username,
+			UserToken:     userToken,
+			Owner:         chatMessage.Recipient,
+		})
+		if shared.IsNoPrekeysError(err) {
+			sess.addNotice(chatMessage.Recipient + " can't receive encrypted direct messages; this one was sent unencrypted")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := op.checkContactKeys(sess, bundle.Owner, bundle.SigningKey, bundle.IdentityKey); err != nil {
+			return err
+		}
+		if ratchet, err = shared.NewInitiatorRatchet(identity, bundle, util.Random); err != nil {
+			return err
+		}
+	}
+
+	sess.Lock()
+	defer sess.Unlock()
+	// A session a poll set up meanwhile wins over the one just started
+	if current, ok := sess.ratchets[chatMessage.Recipient]; ok {
+		ratchet = current
+	}
+	sess.ratchets[chatMessage.Recipient] = ratchet
+	encrypted, err := ratchet.Encrypt(chatMessage.Message, util.Random)
+	if err != nil {
+		return err
+	}
+	chatMessage.Message = ""
+	chatMessage.Ratchet = &encrypted
+	return nil
+}
+
+func (op *OnionProxy) getPrekeyBundle(sess *session, req shared.PrekeyBundleRequest) (shared.PrekeyBundle, error) {
+	circ, err := op.getCircuit(op.purposeFor(sess, controlCircuit))
+	if err != nil {
+		return shared.PrekeyBundle{}, err
+	}
+	if !circ.exitSupports(shared.FeatureDoubleRatchet) {
+		return shared.PrekeyBundle{}, unsupportedByExitError(circ.exitAddress(), shared.FeatureDoubleRatchet)
+	}
+
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return shared.PrekeyBundle{}, err
+	}
+	onion, err := circ.OnionizeData(shared.CommandPrekeyBundle, jsonData)
+	if err != nil {
+		return shared.PrekeyBundle{}, err
+	}
+	resp, err := circ.SendPollingOnion(onion)
+	if err != nil {
+		return shared.PrekeyBundle{}, err
+	}
+	if resp.PrekeyBundle == nil || resp.PrekeyBundle.Owner != req.Owner {
+		return shared.PrekeyBundle{}, badPrekeyBundleError
+	}
+	return *resp.PrekeyBundle, nil
+}
+
+// Leaves more prekeys if a poll says they are running out, at most once a
+// prekeyRetryInterval so a chat server without them isn't asked every poll
+func (op *OnionProxy) replenishPrekeys(sess *session, messages shared.PollingResponse) {
+	if messages.SignedPrekeyId != 0 && messages.OneTimePrekeys >= prekeyLowWater {
+		return
+	}
+	sess.Lock()
+	due := util.Time.Now().Sub(sess.prekeysUploadedAt) >= prekeyRetryInterval
+	sess.Unlock()
+	if due {
+		go op.uploadPrekeys(sess, messages.SignedPrekeyId == 0)
+	}
+}
+
+// Leaves a batch of one-time prekeys on the default chat server, and a new
+// signed prekey with them if rotate is set. Called after registering and
+// whenever a poll says the prekeys are running out.
+func (op *OnionProxy) uploadPrekeys(sess *session, rotate bool) {
+	sess.Lock()
+	if sess.uploadingPrekeys {
+		sess.Unlock()
+		return
+	}
+	sess.uploadingPrekeys = true
+	sess.prekeysUploadedAt = util.Time.Now()
+	identity := sess.encryptionKey
+	signingKey := sess.signingKey
+	sess.Unlock()
+	defer func() {
+		sess.Lock()
+		sess.uploadingPrekeys = false
+		sess.Unlock()
+	}()
+
+	username, userToken, err := sess.identity()
+	if err != nil || identity == nil || signingKey == nil {
+		return
+	}
+	upload := shared.PrekeyUpload{
+		IRCServerAddr: op.ircServerAddr,
+		Namespace:     op.namespace,
+		Username:      username,
+		UserToken:     userToken,
+	}
+	if rotate {
+		id, err := randomPrekeyId()
+		if err != nil {
+			util.HandleNonFatalError("Could not make signed prekey", err)
+			return
+		}
+		signed, err := shared.NewPrekey(id, identity, util.Random)
+		if err != nil {
+			util.HandleNonFatalError("Could not make signed prekey", err)
+			return
+		}
+		upload.SignedPrekey = &signed
+		upload.Signature = ed25519.Sign(signingKey, shared.SignedPrekeyBytes(signed))
+	}
+	for i := 0; i < prekeyBatch; i++ {
+		id, err := randomPrekeyId()
+		if err != nil {
+			util.HandleNonFatalError("Could not make one-time prekey", err)
+			return
+		}
+		oneTime, err := shared.NewPrekey(id, identity, util.Random)
+		if err != nil {
+			util.HandleNonFatalError("Could not make one-time prekey", err)
+			return
+		}
+		upload.OneTimePrekeys = append(upload.OneTimePrekeys, oneTime)
+	}
+
+	if err := op.sendCommand(op.purposeFor(sess, controlCircuit), shared.CommandUploadPrekeys, upload); err != nil {
+		util.OutLog.Printf("No prekeys left for encrypted direct messages: %v\n", err)
+		return
+	}
+	util.OutLog.Printf("Left %d one-time prekeys on the chat server\n", len(upload.OneTimePrekeys))
+}
+
+// Nonzero, and random so the ids of different devices don't collide
+func randomPrekeyId() (uint32, error) {
+	var id [4]byte
+	for binary.BigEndian.Uint32(id[:]) == 0 {
+		if _, err := util.Random.Read(id[:]); err != nil {
+			return 0, shared.InternalError("Could not generate prekey id", err)
+		}
+	}
+	return binary.BigEndian.Uint32(id[:]), nil
+}
+
+// Decrypts the encrypted direct messages a poll brought into resp's notices,
+// formatted like the chat server formats direct messages. One that doesn't
+// decrypt shows up as a placeholder.
+func (sess *session) applyRatchetMessages(envelopes []shared.RatchetEnvelope, resp *shared.PollResult) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	for _, envelope := range envelopes {
+		text, err := sess.decryptDirect(envelope)
+		if err != nil {
+			util.OutLog.Printf("Could not decrypt direct message from %s: %v\n", envelope.From, err)
+			text = shared.EncryptedPlaceholder
+		}
+		resp.Notices = append(resp.Notices, "[DM] "+envelope.From+": "+text)
+	}
+}
+
+// Caller must hold the session lock.
+func (sess *session) decryptDirect(envelope shared.RatchetEnvelope) (string, error) {
+	if sess.encryptionKey == nil {
+		return "", notEncryptingError
+	}
+	ratchet := sess.ratchets[envelope.From]
+	init := envelope.Message.Init
+
+	// A new session from the sender, who lost theirs or started one at the
+	// same time as us. When both sides started one, the one started by the
+	// user whose name sorts first is kept.
+	if init != nil && (ratchet == nil || !ratchet.BeganWith(*init)) {
+		kept := ratchet == nil || ratchet.Confirmed() || sess.username > envelope.From
+		// The sender's messages in the losing session are still read, until
+		// they see ours and switch
+		if !kept {
+			if crossed := sess.crossedRatchets[envelope.From]; crossed != nil && crossed.BeganWith(*init) {
+				return crossed.Decrypt(envelope.Message, util.Random)
+			}
+		}
+		fresh, err := shared.NewResponderRatchet(sess.encryptionKey, envelope)
+		if err != nil {
+			return "", err
+		}
+		text, err := fresh.Decrypt(envelope.Message, util.Random)
+		if err != nil {
+			return "", err
+		}
+		if kept {
+			sess.ratchets[envelope.From] = fresh
+			delete(sess.crossedRatchets, envelope.From)
+		} else {
+			sess.crossedRatchets[envelope.From] = fresh
+		}
+		return text, nil
+	}
+
+	if ratchet == nil {
+		return "", noRatchetError
+	}
+	return ratchet.Decrypt(envelope.Message, util.Random)
+}
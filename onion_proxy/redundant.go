@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+const (
+	// With -redundant, carries a second copy of every chat message, over
+	// relays the data circuit doesn't use
+	redundantCircuit string = "redundant"
+)
+
+// The relays a new circuit for purpose must leave out. The redundant circuit
+// shares no relay with the data circuit, but for the entry guard of a proxy
+// keeping state, which every circuit starts at.
+func (op *OnionProxy) avoidFor(purpose string) map[string]bool {
+	avoid := make(map[string]bool)
+	if purpose != redundantCircuit {
+		return avoid
+	}
+
+	op.circuitsMutex.RLock()
+	data, ok := op.circuits[dataCircuit]
+	op.circuitsMutex.RUnlock()
+	if !ok {
+		return avoid
+	}
+	for hopNum, info := range data.ORInfoByHopNum {
+		if hopNum == 0 && op.state != nil {
+			continue
+		}
+		avoid[info.address] = true
+	}
+	return avoid
+}
+
+// Id the IRC server publishes a message once by, empty without -redundant
+func (op *OnionProxy) newMessageId() (string, error) {
+	if !op.redundant {
+		return "", nil
+	}
+	id := make([]byte, 16)
+	if _, err := util.Random.Read(id); err != nil {
+		return "", shared.InternalError("Could not generate message id", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// The circuit a second copy of a command goes over: the redundant circuit,
+// for chat messages with an id sent over the data circuit, if it was built
+// apart from the data circuit in use and its exit publishes messages once
+func (op *OnionProxy) redundantLeg(purpose string, primary *circuit, command string, messageId string) *circuit {
+	if !op.redundant || purpose != dataCircuit || command != shared.CommandChatMessage || messageId == "" {
+		return nil
+	}
+
+	op.circuitsMutex.RLock()
+	circ, ok := op.circuits[redundantCircuit]
+	op.circuitsMutex.RUnlock()
+	if !ok || circ == primary || !circ.exitSupports(shared.FeatureRedundantDelivery) {
+		return nil
+	}
+	// The data circuit may have been replaced since
+	avoid := op.avoidFor(redundantCircuit)
+	for _, info := range circ.ORInfoByHopNum {
+		if avoid[info.address] {
+			return nil
+		}
+	}
+	return circ
+}
+
+// Sends jsonData over every circuit at once, returning as soon as one got it
+// through, or the first error once all failed. Each send gets its own copy,
+// as jsonData is wiped when the caller returns.
+func sendRedundantly(ctx context.Context, command string, jsonData []byte, circuits ...*circuit) error {
+	errs := make(chan error, len(circuits))
+	for _, circ := range circuits {
+		data := append([]byte(nil), jsonData...)
+		go func(circ *circuit) {
+			defer secmem.Wipe(data)
+			errs <- circ.sendCommandContext(ctx, command, data)
+		}(circ)
+	}
+
+	var first error
+	for range circuits {
+		err := <-errs
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// A circuit over other relays than testCircuit, whose exit speaks the current protocol
+func testRedundantCircuit(t *testing.T, guard *testGuard) *circuit {
+	circ := testCircuit(t)
+	circ.purpose = redundantCircuit
+	for hopNum, address := range []string{"127.0.0.1:9001", "127.0.0.1:9002", "127.0.0.1:9003"} {
+		circ.ORInfoByHopNum[hopNum].address = address
+	}
+	circ.ORInfoByHopNum[2].protocolVersion = shared.ProtocolVersion
+	circ.guardNodeServer = testGuardClient(t, guard)
+	return circ
+}
+
+func TestRedundantLeg(t *testing.T) {
+	data := testCircuit(t)
+	second := testRedundantCircuit(t, &testGuard{})
+	op := &OnionProxy{redundant: true, circuits: map[string]*circuit{dataCircuit: data, redundantCircuit: second}}
+	id, err := op.newMessageId()
+	if err != nil || id == "" {
+		t.Fatalf("made message id %q, %v", id, err)
+	}
+	msg := shared.ChatMessage{Message: "hi", MessageId: id}
+
+	if leg := op.redundantLeg(dataCircuit, data, shared.CommandChatMessage, msg.MessageId); leg != second {
+		t.Fatal("a chat message wasn't sent over the redundant circuit too")
+	}
+	if avoid := op.avoidFor(redundantCircuit); len(avoid) != 3 || !avoid["127.0.0.1:8001"] {
+		t.Fatalf("the redundant circuit avoids %v", avoid)
+	}
+	if leg := op.redundantLeg(controlCircuit, data, shared.CommandChatMessage, msg.MessageId); leg != nil {
+		t.Fatal("a command on another purpose was sent twice")
+	}
+	if leg := op.redundantLeg(dataCircuit, data, shared.CommandChatMessage, ""); leg != nil {
+		t.Fatal("a message without an id was sent twice")
+	}
+
+	// The data circuit was replaced by one through a relay of the redundant circuit
+	data.ORInfoByHopNum[1].address = "127.0.0.1:9002"
+	if leg := op.redundantLeg(dataCircuit, data, shared.CommandChatMessage, msg.MessageId); leg != nil {
+		t.Fatal("a message was sent over circuits sharing a relay")
+	}
+
+	// A proxy keeping state starts both at its entry guard
+	op.state = newStateFile("")
+	if avoid := op.avoidFor(redundantCircuit); avoid["127.0.0.1:8001"] {
+		t.Fatalf("the entry guard is avoided: %v", avoid)
+	}
+	op.redundant = false
+	if id, _ = op.newMessageId(); id != "" {
+		t.Fatal("a message id was made without -redundant")
+	}
+}
+
+func TestSendRedundantly(t *testing.T) {
+	failing, working := &testGuard{err: errors.New("relay went away")}, &testGuard{}
+	first, second := testRedundantCircuit(t, failing), testRedundantCircuit(t, working)
+	if err := sendRedundantly(context.Background(), shared.CommandChatMessage, []byte(`{"Message":"hi"}`), first, second); err != nil {
+		t.Fatalf("one circuit getting a message through gave %v", err)
+	}
+	if working.cells != 1 {
+		t.Fatalf("the working circuit was sent %d cells", working.cells)
+	}
+	if err := sendRedundantly(context.Background(), shared.CommandChatMessage, []byte(`{"Message":"hi"}`), first); err == nil {
+		t.Fatal("every circuit failing gave no error")
+	}
+}
+
+// sendCommand takes the message id from the chat message, and sends the
+// second copy once both exits pass the message on intact
+func TestSendCommandRedundantly(t *testing.T) {
+	dataGuard, secondGuard := &testGuard{}, &testGuard{}
+	data, second := testRedundantCircuit(t, dataGuard), testRedundantCircuit(t, secondGuard)
+	for hopNum, address := range []string{"127.0.0.1:8001", "127.0.0.1:8002", "127.0.0.1:8003"} {
+		data.ORInfoByHopNum[hopNum].address = address
+	}
+	op := &OnionProxy{redundant: true, circuits: map[string]*circuit{dataCircuit: data, redundantCircuit: second}}
+
+	id, _ := op.newMessageId()
+	if err := op.sendCommand(dataCircuit, shared.CommandChatMessage, shared.ChatMessage{Message: "hi", MessageId: id, TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	// The send returns once either copy got through
+	for waited := time.Duration(0); (dataGuard.cells == 0 || secondGuard.cells == 0) && waited < time.Second; waited += 10 * time.Millisecond {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dataGuard.cells != 1 || secondGuard.cells != 1 {
+		t.Fatalf("sent %d cells over the data circuit and %d over the redundant one", dataGuard.cells, secondGuard.cells)
+	}
+	if err := op.sendCommand(dataCircuit, shared.CommandChatMessage, shared.ChatMessage{Message: "hi"}); err != nil || secondGuard.cells != 1 {
+		t.Fatalf("a message without an id gave %v after %d cells over the redundant circuit", err, secondGuard.cells)
+	}
+}
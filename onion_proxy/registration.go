@@ -0,0 +1,29 @@
+package main
+
+import (
+	"../shared"
+	"../util"
+)
+
+const (
+	// Difficulty above which the proxy won't solve an IRC server's puzzle,
+	// about a minute of work for one core
+	maxProofOfWorkBits int = 28
+)
+
+// Registers a username, solving the IRC server's proof of work if the
+// namespace asks for one before registering new usernames. The work is done
+// once per registration; a server asking again gets its error passed on.
+func (op *OnionProxy) registerUserName(purpose string, req shared.UserNameRequest) error {
+	req.RegistrationToken = op.registrationToken
+	err := op.sendCommand(purpose, shared.CommandRegisterUserName, req)
+	pow, ok := shared.ParseProofOfWorkError(err)
+	if !ok || req.PowNonce != 0 || !req.PowStamp.IsZero() || pow.Bits > maxProofOfWorkBits {
+		return err
+	}
+
+	util.OutLog.Printf("Solving a proof of work of %d bits to register %s\n", pow.Bits, req.Username)
+	req.PowStamp = util.Time.Now()
+	req.PowNonce = shared.SolveProofOfWork(req.Namespace, req.Username, req.PowStamp, pow.Bits)
+	return op.sendCommand(purpose, shared.CommandRegisterUserName, req)
+}
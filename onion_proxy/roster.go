@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"../shared"
+	"../util"
+)
+
+type RosterError error
+
+const (
+	// Roster configurations
+	rosterFormat         int    = 1
+	rosterSyncAttempts   int    = 3 // puts tried when other devices keep changing the roster
+	rosterAdditionalData string = "torchat-roster"
+)
+
+// The user's contacts, kept in a file sealed with a key derived from the
+// proxy's signing key. Devices sharing the signing key can open each other's
+// rosters, so the same sealed bytes are what is synced through the IRC server.
+type roster struct {
+	sync.Mutex
+	path     string
+	aead     cipher.AEAD
+	sync     bool                       // from -roster-sync
+	contacts map[string]*shared.Contact // by username, removed ones included
+	version  uint64                     // of the blob on the IRC server this roster was last merged with
+
+	syncMutex sync.Mutex // held through a sync so two don't race each other's puts
+}
+
+// The roster as it is encrypted into its file
+type rosterData struct {
+	Contacts []shared.Contact
+	Version  uint64 `json:",omitempty"`
+}
+
+// A roster file, and the blob synced through the IRC server. Data is the
+// rosterData as JSON, sealed with AES-GCM.
+type rosterFile struct {
+	Format int
+	Nonce  []byte
+	Data   []byte
+}
+
+var (
+	// Roster Errors
+	rosterDisabledError   RosterError = errors.New("Start the proxy with -roster to keep contacts")
+	rosterFileError       RosterError = errors.New("Roster file is not in a known format")
+	badContactError       RosterError = errors.New("Contact must have a username")
+	unknownContactError   RosterError = errors.New("No such contact")
+	badRosterBlobError    RosterError = errors.New("Exit node did not answer with a roster")
+	rosterSyncGaveUpError RosterError = errors.New("Roster kept changing on another device")
+)
+
+func contactKeyChangedError(username string) RosterError {
+	return fmt.Errorf("The keys the chat server has for %s are not the ones in your roster; if %s says their keys changed, /contact trust %s", username, username, username)
+}
+
+// Opens the roster at path, starting an empty one if it doesn't exist. A file
+// that doesn't decrypt is an error, so a wrong key doesn't get the roster
+// overwritten with an empty one.
+func openRoster(path string, signingKey ed25519.PrivateKey, sync bool) (*roster, error) {
+	key, err := hkdf.Key(sha256.New, signingKey.Seed(), nil, "torchat-roster", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	r := &roster{path: path, aead: aead, sync: sync, contacts: make(map[string]*shared.Contact)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved, err := r.open(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := range saved.Contacts {
+		contact := saved.Contacts[i]
+		r.contacts[contact.Username] = &contact
+	}
+	r.version = saved.Version
+	util.OutLog.Printf("Loaded %d contacts from %s\n", len(saved.Contacts), path)
+	return r, nil
+}
+
+// Caller must hold the roster lock.
+func (r *roster) seal(withVersion bool) ([]byte, error) {
+	saved := rosterData{Contacts: r.list(true)}
+	if withVersion {
+		saved.Version = r.version
+	}
+	plaintext, err := json.Marshal(saved)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := io.ReadFull(util.Random, nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rosterFile{
+		Format: rosterFormat,
+		Nonce:  nonce,
+		Data:   r.aead.Seal(nil, nonce, plaintext, []byte(rosterAdditionalData)),
+	})
+}
+
+func (r *roster) open(data []byte) (rosterData, error) {
+	var file rosterFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return rosterData{}, rosterFileError
+	}
+	if file.Format != rosterFormat || len(file.Nonce) != r.aead.NonceSize() {
+		return rosterData{}, rosterFileError
+	}
+	plaintext, err := r.aead.Open(nil, file.Nonce, file.Data, []byte(rosterAdditionalData))
+	if err != nil {
+		return rosterData{}, err
+	}
+	var saved rosterData
+	if err := json.Unmarshal(plaintext, &saved); err != nil {
+		return rosterData{}, rosterFileError
+	}
+	return saved, nil
+}
+
+// Writes the roster to its file, replacing it only once the write is
+// complete. Caller must hold the roster lock.
+func (r *roster) save() error {
+	data, err := r.seal(true)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// Contacts sorted by username. Caller must hold the roster lock.
+func (r *roster) list(removed bool) []shared.Contact {
+	contacts := make([]shared.Contact, 0, len(r.contacts))
+	for _, contact := range r.contacts {
+		if removed || !contact.Removed {
+			contacts = append(contacts, *contact)
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Username < contacts[j].Username })
+	return contacts
+}
+
+// Takes each contact changed more recently on another device. Removals win
+// the same way, so a contact removed on one device goes from all of them.
+// Caller must hold the roster lock.
+func (r *roster) merge(remote []shared.Contact) {
+	for i := range remote {
+		contact := remote[i]
+		local, ok := r.contacts[contact.Username]
+		if !ok || contact.Updated.After(local.Updated) {
+			r.contacts[contact.Username] = &contact
+		}
+	}
+}
+
+// Returns the session user's contacts
+func (s *OPServer) GetContacts(_ignored bool, resp *[]shared.Contact) error {
+	r := s.OnionProxy.roster
+	if r == nil {
+		return rosterDisabledError
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	*resp = r.list(false)
+	return nil
+}
+
+// Adds a contact, or changes the alias of one. Keys given replace the pinned
+// ones, which is how a contact's new keys are accepted after they changed.
+func (s *OPServer) AddContact(req shared.Contact, ack *bool) error {
+	r := s.OnionProxy.roster
+	if r == nil {
+		return rosterDisabledError
+	}
+	if req.Username == "" {
+		return badContactError
+	}
+
+	r.Lock()
+	contact, ok := r.contacts[req.Username]
+	if !ok || contact.Removed {
+		contact = &shared.Contact{Username: req.Username}
+		r.contacts[req.Username] = contact
+	}
+	if req.Alias != "" {
+		contact.Alias = req.Alias
+	}
+	if req.SigningKey != nil || req.EncryptionKey != nil {
+		contact.SigningKey = req.SigningKey
+		contact.EncryptionKey = req.EncryptionKey
+	}
+	contact.Updated = util.Time.Now()
+	err := r.save()
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go s.OnionProxy.syncRoster(s.session())
+	*ack = true
+	return nil
+}
+
+// Unpins a contact's keys, so the next ones the IRC server gives out are
+// pinned instead. For contacts whose keys changed, after checking with them.
+func (s *OPServer) TrustContactKeys(username string, ack *bool) error {
+	r := s.OnionProxy.roster
+	if r == nil {
+		return rosterDisabledError
+	}
+
+	r.Lock()
+	contact, ok := r.contacts[username]
+	if !ok || contact.Removed {
+		r.Unlock()
+		return unknownContactError
+	}
+	contact.SigningKey = nil
+	contact.EncryptionKey = nil
+	contact.Updated = util.Time.Now()
+	err := r.save()
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go s.OnionProxy.syncRoster(s.session())
+	*ack = true
+	return nil
+}
+
+// Removes a contact from the roster, and from the user's other devices at
+// their next sync
+func (s *OPServer) RemoveContact(username string, ack *bool) error {
+	r := s.OnionProxy.roster
+	if r == nil {
+		return rosterDisabledError
+	}
+
+	r.Lock()
+	contact, ok := r.contacts[username]
+	if !ok || contact.Removed {
+		r.Unlock()
+		return unknownContactError
+	}
+	*contact = shared.Contact{Username: username, Updated: util.Time.Now(), Removed: true}
+	err := r.save()
+	r.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go s.OnionProxy.syncRoster(s.session())
+	*ack = true
+	return nil
+}
+
+// Checks keys the IRC server gave out for a user against the ones pinned in
+// the roster. A contact's keys are pinned the first time they are seen; users
+// who aren't contacts aren't checked. Either key may be nil when the server
+// only gave out the other.
+func (op *OnionProxy) checkContactKeys(sess *session, username string, signingKey []byte, encryptionKey []byte) error {
+	r := op.roster
+	if r == nil {
+		return nil
+	}
+
+	r.Lock()
+	contact, ok := r.contacts[username]
+	if !ok || contact.Removed {
+		r.Unlock()
+		return nil
+	}
+	if contact.SigningKey == nil && contact.EncryptionKey == nil {
+		if signingKey == nil || encryptionKey == nil {
+			r.Unlock()
+			return nil
+		}
+		contact.SigningKey = signingKey
+		contact.EncryptionKey = encryptionKey
+		contact.Updated = util.Time.Now()
+		err := r.save()
+		r.Unlock()
+		if err != nil {
+			util.HandleNonFatalError("Could not save roster", err)
+		}
+		util.OutLog.Printf("Pinned keys of %s, fingerprint %s\n", username, shared.Fingerprint(signingKey))
+		go op.syncRoster(sess)
+		return nil
+	}
+	mismatch := (signingKey != nil && !bytes.Equal(contact.SigningKey, signingKey)) ||
+		(encryptionKey != nil && !bytes.Equal(contact.EncryptionKey, encryptionKey))
+	r.Unlock()
+
+	if mismatch {
+		return contactKeyChangedError(username)
+	}
+	return nil
+}
+
+// Merges the roster with the one the user's other devices synced to the
+// default chat server, then syncs the result back. Does nothing unless the
+// proxy was started with -roster-sync.
+func (op *OnionProxy) syncRoster(sess *session) {
+	r := op.roster
+	if r == nil || !r.sync {
+		return
+	}
+	username, userToken, err := sess.identity()
+	if err != nil {
+		return
+	}
+	req := shared.RosterRequest{
+		IRCServerAddr: op.ircServerAddr,
+		Namespace:     op.namespace,
+		Username:      username,
+		UserToken:     userToken,
+	}
+
+	r.syncMutex.Lock()
+	defer r.syncMutex.Unlock()
+
+	for attempt := 0; attempt < rosterSyncAttempts; attempt++ {
+		remote, err := op.getRoster(sess, req)
+		if err != nil {
+			util.OutLog.Printf("Could not fetch synced roster: %v\n", err)
+			return
+		}
+
+		r.Lock()
+		if remote.Version != 0 {
+			saved, err := r.open(remote.Blob)
+			if err != nil {
+				// Synced by a device with another signing key, which is left be
+				r.Unlock()
+				util.HandleNonFatalError("Could not decrypt synced roster", err)
+				return
+			}
+			r.merge(saved.Contacts)
+		}
+		blob, err := r.seal(false)
+		r.Unlock()
+		if err != nil {
+			util.HandleNonFatalError("Could not seal roster", err)
+			return
+		}
+
+		put := req
+		put.BaseVersion = remote.Version
+		put.Blob = blob
+		err = op.sendCommand(op.purposeFor(sess, controlCircuit), shared.CommandPutRoster, put)
+		if shared.IsRosterConflictError(err) {
+			continue
+		}
+		if err != nil {
+			util.OutLog.Printf("Could not sync roster: %v\n", err)
+			return
+		}
+
+		r.Lock()
+		r.version = remote.Version + 1
+		err = r.save()
+		r.Unlock()
+		util.HandleNonFatalError("Could not save roster", err)
+		util.OutLog.Printf("Synced roster version %d\n", remote.Version+1)
+		return
+	}
+	util.HandleNonFatalError("Could not sync roster", rosterSyncGaveUpError)
+}
+
+func (op *OnionProxy) getRoster(sess *session, req shared.RosterRequest) (shared.RosterBlob, error) {
+	circ, err := op.getCircuit(op.purposeFor(sess, controlCircuit))
+	if err != nil {
+		return shared.RosterBlob{}, err
+	}
+	if !circ.exitSupports(shared.FeatureRosterSync) {
+		return shared.RosterBlob{}, unsupportedByExitError(circ.exitAddress(), shared.FeatureRosterSync)
+	}
+	req.AcceptsFragments = circ.exitSupports(shared.FeatureFragmentation)
+
+	jsonData, err := json.Marshal(&req)
+	if err != nil {
+		return shared.RosterBlob{}, err
+	}
+	onion, err := circ.OnionizeData(shared.CommandGetRoster, jsonData)
+	if err != nil {
+		return shared.RosterBlob{}, err
+	}
+	resp, err := circ.SendPollingOnion(onion)
+	if err != nil {
+		return shared.RosterBlob{}, err
+	}
+	if resp.Fragment != nil {
+		if resp, err = circ.fetchFragments(*resp.Fragment); err != nil {
+			return shared.RosterBlob{}, err
+		}
+	}
+	if resp.Roster == nil {
+		return shared.RosterBlob{}, badRosterBlobError
+	}
+	return *resp.Roster, nil
+}
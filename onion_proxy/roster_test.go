@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func testRoster(t *testing.T) (*roster, ed25519.PrivateKey) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRoster(filepath.Join(t.TempDir(), "roster"), key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, key
+}
+
+func TestRosterFile(t *testing.T) {
+	r, key := testRoster(t)
+	op := &OnionProxy{sessions: make(map[string]*session), roster: r}
+	s := &OPServer{OnionProxy: op, sess: testSession(op, "alice")}
+	var ack bool
+	if err := s.AddContact(shared.Contact{}, &ack); err != badContactError {
+		t.Fatalf("a contact without a username gave %v, want %v", err, badContactError)
+	}
+	for _, username := range []string{"bob", "carol"} {
+		if err := s.AddContact(shared.Contact{Username: username, Alias: username + "by"}, &ack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.RemoveContact("carol", &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RemoveContact("carol", &ack); err != unknownContactError {
+		t.Fatalf("removing a contact twice gave %v, want %v", err, unknownContactError)
+	}
+
+	reopened, err := openRoster(r.path, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts := reopened.list(true)
+	if len(contacts) != 2 || contacts[0].Alias != "bobby" || !contacts[1].Removed || len(reopened.list(false)) != 1 {
+		t.Fatalf("reopened %+v", contacts)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err = openRoster(r.path, other, false); err == nil {
+		t.Fatal("a roster was opened with another signing key")
+	}
+}
+
+func TestRosterMerge(t *testing.T) {
+	r, _ := testRoster(t)
+	now := time.Now()
+	r.contacts["bob"] = &shared.Contact{Username: "bob", Alias: "local", Updated: now}
+	r.contacts["carol"] = &shared.Contact{Username: "carol", Updated: now}
+	r.merge([]shared.Contact{
+		{Username: "bob", Alias: "older", Updated: now.Add(-time.Minute)},
+		{Username: "carol", Updated: now.Add(time.Minute), Removed: true},
+		{Username: "dave", Updated: now},
+	})
+	if r.contacts["bob"].Alias != "local" || !r.contacts["carol"].Removed || r.contacts["dave"] == nil {
+		t.Fatalf("merged into %+v", r.list(true))
+	}
+}
+
+func TestContactKeysArePinned(t *testing.T) {
+	r, _ := testRoster(t)
+	op := &OnionProxy{sessions: make(map[string]*session), roster: r}
+	sess := testSession(op, "alice")
+	r.contacts["bob"] = &shared.Contact{Username: "bob"}
+	signing, encryption := []byte("bob's signing key"), []byte("bob's encryption key")
+
+	if err := op.checkContactKeys(sess, "mallory", []byte("any"), []byte("any")); err != nil {
+		t.Fatalf("a user who isn't a contact gave %v", err)
+	}
+	if err := op.checkContactKeys(sess, "bob", signing, encryption); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.checkContactKeys(sess, "bob", signing, nil); err != nil {
+		t.Fatalf("the pinned signing key gave %v", err)
+	}
+	if err := op.checkContactKeys(sess, "bob", []byte("a new key"), encryption); err == nil {
+		t.Fatal("a changed key was accepted")
+	}
+
+	var ack bool
+	if err := (&OPServer{OnionProxy: op, sess: sess}).TrustContactKeys("bob", &ack); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.checkContactKeys(sess, "bob", []byte("a new key"), encryption); err != nil {
+		t.Fatalf("the new keys weren't pinned after trusting them: %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type NoSuchSessionError error
+type NotConnectedError error
+
+const (
+	sessionLifetime      time.Duration = 30 * time.Minute // sessions unused this long can't be resumed
+	sessionSweepInterval time.Duration = time.Minute
+	sendOrderTimeout     time.Duration = 30 * time.Second // a send waits at most this long for the client's earlier ones
+)
+
+var (
+	// Session Errors
+	noSuchSessionError NoSuchSessionError = errors.New("No session with this token, it may have expired")
+	notConnectedError  NotConnectedError  = errors.New("Connect with a username first")
+)
+
+// One client of the proxy. Every client connection starts with a new session
+// and may take an earlier one back with its token after reconnecting.
+type session struct {
+	token string
+
+	sync.Mutex // guards the fields below
+	username   string
+	userToken  string // proves ownership of username to the IRC server
+	deviceId   string // tells this session apart from the user's other devices
+	lastUsed   time.Time
+
+	signingKey    ed25519.PrivateKey // signs the user's messages, registered with the username
+	encryptionKey *ecdh.PrivateKey   // sender keys for encrypted channels are sealed to it
+
+	lastMessageId uint32
+	lastEventId   uint32
+	lastUpdateId  uint32
+	lastInboxId   uint32
+	lastPoll      time.Time
+
+	lastShown    map[string]uint32 // id of the newest message shown per channel
+	unreadCounts map[string]int    // from the latest poll
+	notices      []string          // warnings shown to the client with its next batch of messages
+
+	homes   map[string]string      // chat server address by channel, for channels homed off the proxy's default server
+	cursors map[string]*pollCursor // polling cursors on those chat servers, by address
+
+	pending       map[uint64]shared.ChatMessage // messages with a deadline still being sent, by id
+	nextPendingId uint64
+
+	outbox []shared.ChatMessage // messages waiting for a circuit, oldest first, see queueMessage
+
+	nextSend  uint64        // SendSeq of the client's send that may go now, counted from 1 per client connection
+	sendEpoch uint64        // counts client connections, whose sends are ordered apart
+	sendTurn  chan struct{} // closed when nextSend moves on
+
+	postingKey    *shared.PostingKey // the default chat server's, once it told us
+	postingTokens []postingToken     // unspent, for anonymous messages
+
+	groups     map[string]*channelGroup    // encrypted channels, by name
+	senderKeys map[string]shared.SenderKey // every sender key seen, by senderKeyIndex
+
+	ratchets        map[string]*shared.Ratchet // encrypted direct message sessions, by username of the other side
+	crossedRatchets map[string]*shared.Ratchet // sessions the other side started along with ours, which lost the tie
+
+	blocked           map[string]bool // usernames whose channel messages are hidden
+	uploadingPrekeys  bool
+	prekeysUploadedAt time.Time
+
+	pollMutex sync.Mutex // one poll at a time, so cursors aren't raced
+
+	profile *profile // the identity the session connected with, nil for Connect
+}
+
+// Serves one client connection with its own OPServer, bound to a new session
+func (op *OnionProxy) serveClient(conn net.Conn) {
+	defer conn.Close()
+	sess, err := op.newSession()
+	if err != nil {
+		util.HandleNonFatalError("Could not start a session for a client", err)
+		return
+	}
+	server := rpc.NewServer()
+	if err := server.Register(&OPServer{OnionProxy: op, sess: sess}); err != nil {
+		util.HandleNonFatalError("Could not register OPServer", err)
+		return
+	}
+	server.ServeConn(conn)
+}
+
+func (op *OnionProxy) newSession() (*session, error) {
+	token := make([]byte, 16)
+	if _, err := util.Random.Read(token); err != nil {
+		return nil, shared.InternalError("Could not generate session token", err)
+	}
+
+	sess := &session{
+		token:      hex.EncodeToString(token),
+		lastUsed:   time.Now(),
+		lastShown:  make(map[string]uint32),
+		homes:      make(map[string]string),
+		cursors:    make(map[string]*pollCursor),
+		pending:    make(map[uint64]shared.ChatMessage),
+		groups:     make(map[string]*channelGroup),
+		senderKeys: make(map[string]shared.SenderKey),
+		ratchets:   make(map[string]*shared.Ratchet),
+
+		crossedRatchets: make(map[string]*shared.Ratchet),
+		blocked:         make(map[string]bool),
+		nextSend:        1,
+		sendTurn:        make(chan struct{}),
+	}
+
+	op.sessionsMutex.Lock()
+	op.sessions[sess.token] = sess
+	op.sessionsMutex.Unlock()
+	return sess, nil
+}
+
+// The connection's session, counted as used
+func (s *OPServer) session() *session {
+	s.sessMutex.Lock()
+	sess := s.sess
+	s.sessMutex.Unlock()
+
+	sess.Lock()
+	sess.lastUsed = time.Now()
+	sess.Unlock()
+	return sess
+}
+
+// Who the session chats as, or notConnectedError before Connect
+func (sess *session) identity() (string, string, error) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.username == "" {
+		return "", "", notConnectedError
+	}
+	return sess.username, sess.userToken, nil
+}
+
+// Remembers a message being sent with a deadline, so it's sent again if the
+// proxy restarts first. Returns the id to untrack it with.
+func (sess *session) trackPending(chatMessage shared.ChatMessage) uint64 {
+	sess.Lock()
+	defer sess.Unlock()
+
+	sess.nextPendingId++
+	sess.pending[sess.nextPendingId] = chatMessage
+	return sess.nextPendingId
+}
+
+func (sess *session) untrackPending(id uint64) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	delete(sess.pending, id)
+}
+
+func (sess *session) addNotice(notice string) {
+	sess.Lock()
+	defer sess.Unlock()
+
+	sess.notices = append(sess.notices, "*** "+notice)
+}
+
+func (sess *session) takeNotices() []string {
+	sess.Lock()
+	defer sess.Unlock()
+
+	notices := sess.notices
+	sess.notices = nil
+	return notices
+}
+
+// Whether enough time passed since the session's last poll to poll the IRC
+// server again
+func (sess *session) mayPoll(minInterval time.Duration) bool {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if time.Since(sess.lastPoll) < minInterval {
+		return false
+	}
+	sess.lastPoll = time.Now()
+	return true
+}
+
+// A device id for a session of username, based on deviceId. Sessions of one
+// user on this proxy each need their own, or they would share cursors on the
+// IRC server.
+func (op *OnionProxy) sessionDeviceId(sess *session, username string, deviceId string) string {
+	op.sessionsMutex.Lock()
+	defer op.sessionsMutex.Unlock()
+
+	for _, other := range op.sessions {
+		if other == sess {
+			continue
+		}
+		other.Lock()
+		taken := other.username == username && other.deviceId == deviceId
+		other.Unlock()
+		if taken {
+			return deviceId + "-" + sess.token[:8]
+		}
+	}
+	return deviceId
+}
+
+// Shows a notice about the proxy itself, such as a circuit warning, to every
+// client
+func (op *OnionProxy) addNotice(notice string) {
+	op.sessionsMutex.Lock()
+	defer op.sessionsMutex.Unlock()
+
+	for _, sess := range op.sessions {
+		sess.addNotice(notice)
+	}
+}
+
+// Drops sessions nobody used for sessionLifetime
+func (op *OnionProxy) expireSessions() {
+	for {
+		time.Sleep(sessionSweepInterval)
+		cutoff := time.Now().Add(-sessionLifetime)
+
+		op.sessionsMutex.Lock()
+		for token, sess := range op.sessions {
+			sess.Lock()
+			expired := sess.lastUsed.Before(cutoff)
+			sess.Unlock()
+			if expired {
+				delete(op.sessions, token)
+			}
+		}
+		op.sessionsMutex.Unlock()
+	}
+}
+
+// Returns the token that takes this session back after reconnecting
+func (s *OPServer) GetSessionToken(_ignored bool, token *string) error {
+	*token = s.session().token
+	return nil
+}
+
+// Binds this connection to an earlier session, with its username and cursors
+func (s *OPServer) ResumeSession(token string, ack *bool) error {
+	s.OnionProxy.sessionsMutex.Lock()
+	sess, ok := s.OnionProxy.sessions[token]
+	s.OnionProxy.sessionsMutex.Unlock()
+	if !ok {
+		return noSuchSessionError
+	}
+
+	s.sessMutex.Lock()
+	s.sess = sess
+	s.sessMutex.Unlock()
+	sess.restartSends()
+
+	*ack = true
+	return nil
+}
+
+// The client counts its sends from 1 again on a new connection. Sends of the
+// old one still waiting for their turn go straight away.
+func (sess *session) restartSends() {
+	sess.Lock()
+	defer sess.Unlock()
+
+	sess.nextSend = 1
+	sess.sendEpoch++
+	close(sess.sendTurn)
+	sess.sendTurn = make(chan struct{})
+}
+
+// Waits for the client's sends numbered before seq to be handed to a circuit
+// or queued, so sends the client pipelines are published in the order it
+// made them, though net/rpc serves them concurrently. A send whose
+// predecessor never came goes after sendOrderTimeout. Returns the function
+// that lets the next send go, which may be called more than once.
+func (sess *session) awaitSendTurn(seq uint64) func() {
+	if seq == 0 {
+		return func() {}
+	}
+
+	timeout := time.NewTimer(sendOrderTimeout)
+	defer timeout.Stop()
+	sess.Lock()
+	epoch := sess.sendEpoch
+	sess.Unlock()
+	for waiting := true; waiting; {
+		sess.Lock()
+		waiting = seq > sess.nextSend && epoch == sess.sendEpoch
+		turn := sess.sendTurn
+		sess.Unlock()
+		if !waiting {
+			break
+		}
+
+		select {
+		case <-turn:
+		case <-timeout.C:
+			util.ErrLog.Printf("[WARNING] Send %d waited %v for the ones before it, sending it anyway\n", seq, sendOrderTimeout)
+			waiting = false
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sess.Lock()
+			defer sess.Unlock()
+
+			if epoch == sess.sendEpoch && seq >= sess.nextSend {
+				sess.nextSend = seq + 1
+				close(sess.sendTurn)
+				sess.sendTurn = make(chan struct{})
+			}
+		})
+	}
+}
+
+type handOffKey struct{}
+
+// A context whose chat message cells call handOff once the last of them is
+// written to the guard, see awaitSendTurn
+func withHandOff(ctx context.Context, handOff func()) context.Context {
+	return context.WithValue(ctx, handOffKey{}, handOff)
+}
+
+// Calls the hand off of ctx, if it has one
+func handedOff(ctx context.Context) {
+	if handOff, ok := ctx.Value(handOffKey{}).(func()); ok && handOff != nil {
+		handOff()
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// A session of op that hasn't connected yet
+func testNewSession(op *OnionProxy) *session {
+	sess, err := op.newSession()
+	if err != nil {
+		panic(err)
+	}
+	return sess
+}
+
+// A session of op that has connected as username
+func testSession(op *OnionProxy, username string) *session {
+	sess := testNewSession(op)
+	sess.username, sess.userToken, sess.deviceId = username, "token-"+username, op.sessionDeviceId(sess, username, op.deviceId)
+	return sess
+}
+
+func TestNoticesAreTakenOnce(t *testing.T) {
+	op := &OnionProxy{sessions: make(map[string]*session)}
+	first, second := testSession(op, "alice"), testSession(op, "bob")
+	op.addNotice("Too few relays online")
+	first.addNotice("You are now known as carol")
+
+	if notices := first.takeNotices(); len(notices) != 2 || notices[0] != "*** Too few relays online" {
+		t.Fatalf("took %q", notices)
+	}
+	if notices := first.takeNotices(); len(notices) != 0 {
+		t.Fatalf("took %q again", notices)
+	}
+	if notices := second.takeNotices(); len(notices) != 1 {
+		t.Fatalf("the other session took %q", notices)
+	}
+}
+
+func TestSessionsNeedAUsername(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testNewSession(op)}
+	var ack bool
+	if err := s.SendMessage("hi", &ack); err != notConnectedError {
+		t.Fatalf("sending before Connect gave %v, want %v", err, notConnectedError)
+	}
+	var unread map[string]int
+	if err := s.MarkRead("", &ack); err != notConnectedError {
+		t.Fatalf("marking read before Connect gave %v, want %v", err, notConnectedError)
+	}
+	if err := s.GetUnreadCounts(true, &unread); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionDeviceIds(t *testing.T) {
+	op := &OnionProxy{deviceId: "laptop", sessions: make(map[string]*session)}
+	first, second, other := testSession(op, "alice"), testSession(op, "alice"), testSession(op, "bob")
+	if first.deviceId != "laptop" || other.deviceId != "laptop" {
+		t.Fatalf("the first sessions got device ids %q and %q", first.deviceId, other.deviceId)
+	}
+	if second.deviceId == first.deviceId {
+		t.Fatal("two sessions of alice share a device id, and so their cursors")
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	op := &OnionProxy{sessions: make(map[string]*session)}
+	earlier := testSession(op, "alice")
+	earlier.lastMessageId = 42
+
+	s := &OPServer{OnionProxy: op, sess: testNewSession(op)}
+	var ack bool
+	if err := s.ResumeSession("no such token", &ack); err != noSuchSessionError {
+		t.Fatalf("an unknown token gave %v, want %v", err, noSuchSessionError)
+	}
+	var token string
+	(&OPServer{OnionProxy: op, sess: earlier}).GetSessionToken(true, &token)
+	if err := s.ResumeSession(token, &ack); err != nil || !ack {
+		t.Fatal(err)
+	}
+	if sess := s.session(); sess != earlier || sess.lastMessageId != 42 {
+		t.Fatal("the connection didn't take the earlier session back")
+	}
+	if username, _, err := s.session().identity(); err != nil || username != "alice" {
+		t.Fatalf("the resumed session chats as %q, %v", username, err)
+	}
+}
+
+// Whether the send numbered seq gets its turn within wait
+func sendTurnWithin(sess *session, seq uint64, wait time.Duration) (func(), bool) {
+	turn := make(chan func(), 1)
+	go func() { turn <- sess.awaitSendTurn(seq) }()
+	select {
+	case release := <-turn:
+		return release, true
+	case <-time.After(wait):
+		return nil, false
+	}
+}
+
+func TestAwaitSendTurn(t *testing.T) {
+	op := &OnionProxy{sessions: make(map[string]*session)}
+	sess := testSession(op, "alice")
+
+	first, ok := sendTurnWithin(sess, 1, time.Second)
+	if !ok {
+		t.Fatal("the first send waited")
+	}
+	if _, ok = sendTurnWithin(sess, 2, 100*time.Millisecond); ok {
+		t.Fatal("the second send went before the first let it")
+	}
+	first()
+	first()
+	second, ok := sendTurnWithin(sess, 2, time.Second)
+	if !ok {
+		t.Fatal("the second send didn't go after the first")
+	}
+
+	// A new client connection counts from 1, and frees sends of the old one
+	waiting := make(chan func(), 1)
+	go func() { waiting <- sess.awaitSendTurn(5) }()
+	time.Sleep(50 * time.Millisecond)
+	sess.restartSends()
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("a send of the old connection still waits")
+	}
+	second()
+	if _, ok = sendTurnWithin(sess, 1, time.Second); !ok {
+		t.Fatal("the new connection's first send waited")
+	}
+}
+
+// Stands in for a guard holding chat message cells until release is closed
+type testSlowGuard struct {
+	cells   chan shared.Cell
+	release chan struct{}
+}
+
+func (g *testSlowGuard) DecryptChatMessageCell(cell shared.Cell, ack *bool) error {
+	g.cells <- cell
+	<-g.release
+	return nil
+}
+
+func TestSendTurnIsReleasedAtHandOff(t *testing.T) {
+	op := &OnionProxy{circuits: make(map[string]*circuit), sessions: make(map[string]*session)}
+	s := &OPServer{OnionProxy: op, sess: testNewSession(op)}
+
+	// A send refused for want of a username lets the next one go
+	var result shared.SendResult
+	if err := s.SendChatMessage(shared.ChatMessage{Message: "hi", SendSeq: 1}, &result); err != notConnectedError {
+		t.Fatalf("a send before connecting gave %v, want %v", err, notConnectedError)
+	}
+	if _, ok := sendTurnWithin(s.sess, 2, time.Second); !ok {
+		t.Fatal("a refused send kept the next one waiting")
+	}
+
+	s.sess = testSession(op, "alice")
+	circ := testCircuit(t)
+	guard := &testSlowGuard{cells: make(chan shared.Cell, 1), release: make(chan struct{})}
+	circ.guardNodeServer = testGuardClient(t, guard)
+	op.circuits[dataCircuit] = circ
+	sent := make(chan error, 1)
+	go func() { sent <- s.SendChatMessage(shared.ChatMessage{Message: "hi", SendSeq: 1}, &result) }()
+	<-guard.cells
+
+	// The next send goes once the cell is with the guard, not once it is delivered
+	if _, ok := sendTurnWithin(s.sess, 2, time.Second); !ok {
+		t.Fatal("the next send waited for the first to be delivered")
+	}
+	close(guard.release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	"../shared"
+	"../util"
+)
+
+type InvalidSigningKeyFileError error
+
+var (
+	// Signing Errors
+	invalidSigningKeyFileError InvalidSigningKeyFileError = errors.New("Signing key file must hold a hex encoded 32 byte Ed25519 seed")
+)
+
+// Loads the key messages are signed with from path, creating the file with a
+// new key if it doesn't exist. Devices of a user share the file like they
+// share the user token.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(util.Random)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		util.OutLog.Printf("Created signing key %s\n", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, invalidSigningKeyFileError
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// The key a new session signs with: the proxy's own from -signing-key, or a
+// new one for the session
+func (op *OnionProxy) sessionSigningKey() (ed25519.PrivateKey, error) {
+	if op.signingKey != nil {
+		return op.signingKey, nil
+	}
+	_, key, err := ed25519.GenerateKey(util.Random)
+	return key, err
+}
+
+// Signs a message from the session's user, if the session has a key
+func (sess *session) sign(chatMessage *shared.ChatMessage) {
+	sess.Lock()
+	key := sess.signingKey
+	sess.Unlock()
+
+	if key != nil {
+		shared.SignMessage(chatMessage, key)
+	}
+}
+
+// The public half of the session's signing key, registered with its username
+func (sess *session) signingPublicKey() []byte {
+	sess.Lock()
+	defer sess.Unlock()
+
+	if sess.signingKey == nil {
+		return nil
+	}
+	return sess.signingKey.Public().(ed25519.PublicKey)
+}
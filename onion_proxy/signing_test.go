@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../shared"
+)
+
+func TestLoadSigningKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing.key")
+	created, err := loadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSigningKey(path)
+	if err != nil || !bytes.Equal(created, loaded) {
+		t.Fatalf("the key loaded again differs: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the key file has mode %v, %v", info.Mode(), err)
+	}
+
+	if err = os.WriteFile(path, []byte("not hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSigningKey(path); err != invalidSigningKeyFileError {
+		t.Fatalf("a corrupt key file gave %v, want %v", err, invalidSigningKeyFileError)
+	}
+}
+
+func TestSessionSigning(t *testing.T) {
+	op := &OnionProxy{sessions: make(map[string]*session)}
+	sess := testSession(op, "alice")
+	m := shared.ChatMessage{Username: "alice", Message: "hi"}
+	sess.sign(&m)
+	if m.Signature != nil || sess.signingPublicKey() != nil {
+		t.Fatal("a session without a key signed")
+	}
+
+	key, err := op.sessionSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.signingKey = key
+	sess.sign(&m)
+	if !shared.VerifyMessage(m, sess.signingPublicKey()) {
+		t.Fatal("the session's signature doesn't verify with its public key")
+	}
+}
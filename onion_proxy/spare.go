@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	// Kept built but unused so a circuit whose exit becomes unusable can be
+	// replaced without waiting for a new build
+	spareCircuit string = "spare"
+
+	exitCheckInterval time.Duration = 30 * time.Second
+)
+
+func (c *circuit) exitAddress() string {
+	return c.ORInfoByHopNum[len(c.ORInfoByHopNum)-1].address
+}
+
+// Whether the circuit's exit speaks a protocol version with the feature
+func (c *circuit) exitSupports(feature string) bool {
+	return shared.SupportsFeature(c.ORInfoByHopNum[len(c.ORInfoByHopNum)-1].protocolVersion, feature)
+}
+
+// Whether the circuit's exit accepted destination when the circuit was built
+func (c *circuit) exitsTo(destination string, streams bool) bool {
+	exit := c.ORInfoByHopNum[len(c.ORInfoByHopNum)-1]
+	return (!streams || exit.capabilities.Has(shared.CapabilityExitStreams)) && exit.exitPolicy.Accepts(destination)
+}
+
+// Whether the consensus still lets exitAddress carry our traffic to the
+// chat servers in destinations. The consensus only lists usable ORs, so an
+// exit that dropped out of it (went offline, failed reachability or was
+// blacklisted) no longer is, and neither is one whose exit policy now rejects
+// one of them.
+func exitAllowed(consensus []shared.OnionRouterInfo, exitAddress string, destinations []string) bool {
+	for _, info := range consensus {
+		if info.Address == exitAddress {
+			return exitsToAll(info, destinations, false)
+		}
+	}
+	return false
+}
+
+// Periodically checks the exits of the circuits in use against the consensus.
+// A circuit whose exit is no longer allowed is swapped for the spare before
+// the next send fails on it.
+func (op *OnionProxy) watchExits() {
+	for {
+		time.Sleep(exitCheckInterval)
+
+		ORSet, err := op.fetchConsensus(context.Background())
+		if err != nil {
+			util.HandleNonFatalError("Could not fetch consensus to check exits", err)
+			continue
+		}
+		op.adoptParams(ORSet.Params)
+
+		destinations := op.chatDestinations()
+		for _, purpose := range []string{dataCircuit, controlCircuit} {
+			op.circuitsMutex.RLock()
+			circ, ok := op.circuits[purpose]
+			op.circuitsMutex.RUnlock()
+
+			if ok && !exitAllowed(ORSet.ORInfos, circ.exitAddress(), destinations) {
+				op.migrateFromExit(purpose, circ, destinations)
+			}
+		}
+		op.dropStreamCircuit(ORSet.ORInfos)
+		op.dropIsolatedCircuits(func(circ *circuit) bool {
+			return !exitAllowed(ORSet.ORInfos, circ.exitAddress(), destinations)
+		})
+	}
+}
+
+// Replaces the purpose's circuit with the spare or another circuit from the
+// pool, or a fresh circuit if no exit in use is usable, and tells the client
+func (op *OnionProxy) migrateFromExit(purpose string, old *circuit, destinations []string) {
+	oldExit := old.exitAddress()
+
+	if !op.reuseCircuit(purpose, destinations, false) {
+		if err := op.GetCircuitFromDServer(purpose); err != nil {
+			util.HandleNonFatalError("Could not replace "+purpose+" circuit with unusable exit "+oldExit, err)
+			return
+		}
+	}
+
+	op.circuitsMutex.RLock()
+	newExit := op.circuits[purpose].exitAddress()
+	op.circuitsMutex.RUnlock()
+
+	notice := "Exit " + oldExit + " can no longer reach " + strings.Join(destinations, ", ") + ", moved " + purpose + " traffic to exit " + newExit
+	util.OutLog.Println(notice)
+	op.addNotice(notice)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"strings"
+	"testing"
+
+	"../shared"
+)
+
+func TestExitAllowed(t *testing.T) {
+	consensus := []shared.OnionRouterInfo{{Address: "127.0.0.1:8001"}, {Address: "127.0.0.1:8003"}, {Address: "127.0.0.1:8004", ExitPolicy: "reject *:*"}}
+	if !exitAllowed(consensus, "127.0.0.1:8003", []string{"1.2.3.4:6667"}) || exitAllowed(consensus, "127.0.0.1:8002", []string{"1.2.3.4:6667"}) {
+		t.Fatal("only exits in the consensus are allowed")
+	}
+	if exitAllowed(nil, "127.0.0.1:8003", []string{"1.2.3.4:6667"}) {
+		t.Fatal("an exit is allowed by an empty consensus")
+	}
+	if exitAllowed(consensus, "127.0.0.1:8004", []string{"1.2.3.4:6667"}) {
+		t.Fatal("an exit whose policy now rejects the IRC server is allowed")
+	}
+}
+
+func TestCircuitExitsTo(t *testing.T) {
+	circ := testCircuit(t)
+	exit := circ.ORInfoByHopNum[len(circ.ORInfoByHopNum)-1]
+	exit.exitPolicy = shared.OnionRouterInfo{ExitPolicy: "accept *:6667,reject *:*"}.Policy()
+	if !circ.exitsTo("1.2.3.4:6667", false) || circ.exitsTo("1.2.3.4:80", false) {
+		t.Fatal("the exit's policy wasn't followed")
+	}
+	if circ.exitsTo("1.2.3.4:6667", true) {
+		t.Fatal("an exit that opens no streams was used for one")
+	}
+	exit.capabilities = shared.CapabilityExitStreams
+	if !circ.exitsTo("1.2.3.4:6667", true) {
+		t.Fatal("an exit that opens streams wasn't used for one")
+	}
+}
+
+func TestMigrateToSpare(t *testing.T) {
+	old := testCircuit(t)
+	// Retiring the old circuit closes its connection later
+	conn, _ := net.Pipe()
+	old.guardNodeServer = rpc.NewClient(conn)
+	spare := testCircuit(t)
+	spare.purpose = spareCircuit
+	spare.ORInfoByHopNum[2].address = "127.0.0.1:8004"
+	op := &OnionProxy{
+		ircServerAddr:  "127.0.0.1:6667",
+		circuits:       map[string]*circuit{dataCircuit: old, spareCircuit: spare},
+		sessions:       make(map[string]*session),
+		consensusCache: newConsensusCache(""),
+	}
+	sess := testSession(op, "alice")
+	// The next spare can't be built, which only logs
+	op.dirServer = testDirectoryClient(t, &testDirectory{err: errors.New("no routers")})
+
+	op.migrateFromExit(dataCircuit, old, []string{op.ircServerAddr})
+
+	circ, err := op.getCircuit(dataCircuit)
+	if err != nil || circ != spare || circ.purpose != dataCircuit {
+		t.Fatalf("the data circuit is %+v, %v", circ, err)
+	}
+	notices := sess.takeNotices()
+	if len(notices) != 1 || !strings.Contains(notices[0], "127.0.0.1:8003") || !strings.Contains(notices[0], "127.0.0.1:8004") {
+		t.Fatalf("the client was told %q", notices)
+	}
+}
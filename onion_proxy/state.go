@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+const (
+	// State configurations
+	stateSaveInterval time.Duration = 5 * time.Second
+)
+
+// What the proxy keeps across restarts with -state. Saved as JSON, which
+// writes maps in a stable order, so an unchanged state isn't written again.
+type proxyState struct {
+	Guard    string `json:",omitempty"`
+	Sessions []persistedSession
+}
+
+type persistedSession struct {
+	Token          string
+	Username       string
+	UserToken      string
+	DeviceId       string
+	SigningKeySeed []byte
+	LastUsed       time.Time
+
+	LastMessageId uint32
+	LastEventId   uint32
+	LastUpdateId  uint32
+	LastInboxId   uint32
+	LastShown     map[string]uint32
+
+	Homes   map[string]string
+	Cursors map[string]persistedCursor
+
+	Pending []shared.ChatMessage // signed messages with a deadline, sent again on restore
+	Outbox  []shared.ChatMessage // messages waiting for a circuit, as the client sent them
+}
+
+type persistedCursor struct {
+	LastMessageId uint32
+	LastEventId   uint32
+	LastUpdateId  uint32
+	LastInboxId   uint32
+}
+
+// The proxy's state file and the entry guard kept in it
+type stateFile struct {
+	sync.Mutex
+	path    string
+	guard   string // address of the first hop of every locally picked path, "" until one is picked
+	written []byte // the state last saved
+}
+
+func newStateFile(path string) *stateFile {
+	return &stateFile{path: path}
+}
+
+func (s *stateFile) entryGuard() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.guard
+}
+
+func (s *stateFile) setEntryGuard(address string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.guard = address
+}
+
+// Loads the state file, if there is one: the entry guard, and the sessions
+// that hadn't expired, which clients take back with their session tokens.
+// Returns the restored sessions.
+func (op *OnionProxy) loadState() ([]*session, error) {
+	data, err := os.ReadFile(op.state.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state proxyState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+
+	op.state.Lock()
+	op.state.guard = state.Guard
+	op.state.written = data
+	op.state.Unlock()
+
+	var restored []*session
+	op.sessionsMutex.Lock()
+	defer op.sessionsMutex.Unlock()
+
+	for _, saved := range state.Sessions {
+		if time.Since(saved.LastUsed) > sessionLifetime || len(saved.SigningKeySeed) != ed25519.SeedSize {
+			continue
+		}
+		sess := &session{
+			token:         saved.Token,
+			username:      saved.Username,
+			userToken:     saved.UserToken,
+			deviceId:      saved.DeviceId,
+			signingKey:    ed25519.NewKeyFromSeed(saved.SigningKeySeed),
+			lastUsed:      saved.LastUsed,
+			lastMessageId: saved.LastMessageId,
+			lastEventId:   saved.LastEventId,
+			lastUpdateId:  saved.LastUpdateId,
+			lastInboxId:   saved.LastInboxId,
+			lastShown:     make(map[string]uint32),
+			homes:         make(map[string]string),
+			cursors:       make(map[string]*pollCursor),
+			pending:       make(map[uint64]shared.ChatMessage),
+			nextSend:      1,
+			sendTurn:      make(chan struct{}),
+		}
+		for channel, id := range saved.LastShown {
+			sess.lastShown[channel] = id
+		}
+		for channel, address := range saved.Homes {
+			sess.homes[channel] = address
+		}
+		for address, cursor := range saved.Cursors {
+			sess.cursors[address] = &pollCursor{
+				lastMessageId: cursor.LastMessageId,
+				lastEventId:   cursor.LastEventId,
+				lastUpdateId:  cursor.LastUpdateId,
+				lastInboxId:   cursor.LastInboxId,
+			}
+		}
+		for _, chatMessage := range saved.Pending {
+			if time.Now().Before(chatMessage.Deadline) {
+				sess.nextPendingId++
+				sess.pending[sess.nextPendingId] = chatMessage
+			}
+		}
+		sess.outbox = saved.Outbox
+		op.sessions[sess.token] = sess
+		restored = append(restored, sess)
+	}
+
+	util.OutLog.Printf("Restored %d sessions from %s\n", len(restored), op.state.path)
+	return restored, nil
+}
+
+// The state of the proxy as it would be saved now
+func (op *OnionProxy) snapshotState() proxyState {
+	state := proxyState{Guard: op.state.entryGuard(), Sessions: []persistedSession{}}
+
+	op.sessionsMutex.Lock()
+	for _, sess := range op.sessions {
+		sess.Lock()
+		// Sessions of a profile are only kept in its own encrypted file
+		if sess.username != "" && sess.signingKey != nil && sess.profile == nil {
+			saved := persistedSession{
+				Token:          sess.token,
+				Username:       sess.username,
+				UserToken:      sess.userToken,
+				DeviceId:       sess.deviceId,
+				SigningKeySeed: sess.signingKey.Seed(),
+				LastUsed:       sess.lastUsed,
+				LastMessageId:  sess.lastMessageId,
+				LastEventId:    sess.lastEventId,
+				LastUpdateId:   sess.lastUpdateId,
+				LastInboxId:    sess.lastInboxId,
+				LastShown:      make(map[string]uint32),
+				Homes:          make(map[string]string),
+				Cursors:        make(map[string]persistedCursor),
+			}
+			for channel, id := range sess.lastShown {
+				saved.LastShown[channel] = id
+			}
+			for channel, address := range sess.homes {
+				saved.Homes[channel] = address
+			}
+			for address, cursor := range sess.cursors {
+				saved.Cursors[address] = persistedCursor{
+					LastMessageId: cursor.lastMessageId,
+					LastEventId:   cursor.lastEventId,
+					LastUpdateId:  cursor.lastUpdateId,
+					LastInboxId:   cursor.lastInboxId,
+				}
+			}
+			var ids []uint64
+			for id := range sess.pending {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			for _, id := range ids {
+				saved.Pending = append(saved.Pending, sess.pending[id])
+			}
+			saved.Outbox = append(saved.Outbox, sess.outbox...)
+			state.Sessions = append(state.Sessions, saved)
+		}
+		sess.Unlock()
+	}
+	op.sessionsMutex.Unlock()
+
+	sort.Slice(state.Sessions, func(i, j int) bool { return state.Sessions[i].Token < state.Sessions[j].Token })
+	return state
+}
+
+// Writes the state file if the state changed since it was last written. The
+// file holds signing keys and user tokens, so only the user may read it.
+func (op *OnionProxy) saveState() error {
+	data, err := json.MarshalIndent(op.snapshotState(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	op.state.Lock()
+	defer op.state.Unlock()
+
+	if bytes.Equal(data, op.state.written) {
+		return nil
+	}
+	tmp := op.state.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, op.state.path); err != nil {
+		return err
+	}
+	op.state.written = data
+	return nil
+}
+
+// Saves the state every stateSaveInterval, and once more before the proxy
+// exits on SIGINT or SIGTERM
+func (op *OnionProxy) persistState() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	ticker := time.NewTicker(stateSaveInterval)
+
+	for {
+		select {
+		case <-ticker.C:
+			util.HandleNonFatalError("Could not save proxy state", op.saveState())
+		case sig := <-signals:
+			util.HandleNonFatalError("Could not save proxy state", op.saveState())
+			util.OutLog.Printf("Saved proxy state, exiting on %v\n", sig)
+			os.Exit(0)
+		}
+	}
+}
+
+// Registers the usernames of restored sessions again, in case the IRC
+// servers forgot them too, and sends their pending messages on. Problems are
+// shown to the clients as notices when they resume.
+func (op *OnionProxy) resumeSessions(sessions []*session) {
+	if len(sessions) == 0 {
+		return
+	}
+	if err := retry.Do(context.Background(), retry.Background, op.start); err != nil {
+		util.HandleNonFatalError("Could not build circuits for restored sessions", err)
+		return
+	}
+
+	for _, sess := range sessions {
+		username, userToken, err := sess.identity()
+		if err != nil {
+			continue
+		}
+		for _, address := range append([]string{op.ircServerAddr}, sess.otherServers()...) {
+			if address != op.ircServerAddr {
+				err = op.ensureExitsTo(address)
+			}
+			if err == nil {
+				err = op.registerUserName(op.purposeFor(sess, controlCircuit), shared.UserNameRequest{
+					IRCServerAddr: address,
+					Namespace:     op.namespace,
+					Username:      username,
+					UserToken:     userToken,
+					SigningKey:    sess.signingPublicKey(),
+				})
+			}
+			if err != nil {
+				util.HandleNonFatalError("Could not register "+username+" again on "+address, err)
+				sess.addNotice("Could not register " + username + " again on " + address + " after the proxy restarted: " + err.Error())
+			}
+		}
+
+		sess.Lock()
+		pending := make(map[uint64]shared.ChatMessage, len(sess.pending))
+		for id, chatMessage := range sess.pending {
+			pending[id] = chatMessage
+		}
+		sess.Unlock()
+
+		// Sent again as they were signed, so ones that got through before
+		// the restart aren't published twice
+		for id, chatMessage := range pending {
+			go func(sess *session, id uint64, chatMessage shared.ChatMessage) {
+				err := op.deliverBefore(context.Background(), sess, chatMessage)
+				sess.untrackPending(id)
+				if err != nil {
+					util.HandleNonFatalError("Could not send restored message", err)
+					sess.addNotice("A message queued before the proxy restarted was not delivered: " + err.Error())
+				}
+			}(sess, id, chatMessage)
+		}
+	}
+}
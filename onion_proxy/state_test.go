@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func testStatefulProxy(t *testing.T) *OnionProxy {
+	return &OnionProxy{sessions: make(map[string]*session), state: newStateFile(filepath.Join(t.TempDir(), "state.json"))}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	op := testStatefulProxy(t)
+	op.state.setEntryGuard("127.0.0.1:8001")
+	sess := testSession(op, "alice")
+	_, sess.signingKey, _ = ed25519.GenerateKey(nil)
+	sess.lastMessageId, sess.lastShown["#general"] = 7, 5
+	sess.homes["#other"] = "127.0.0.1:9001"
+	sess.cursors["127.0.0.1:9001"] = &pollCursor{lastMessageId: 3}
+	sess.trackPending(shared.ChatMessage{Message: "later", Deadline: time.Now().Add(time.Hour)})
+	sess.trackPending(shared.ChatMessage{Message: "too late", Deadline: time.Now().Add(-time.Second)})
+	sess.outbox = []shared.ChatMessage{{Channel: "#general", Message: "queued", SentAt: time.Now()}}
+	testSession(op, "") // no username, so nothing to keep
+
+	expired := testSession(op, "bob")
+	_, expired.signingKey, _ = ed25519.GenerateKey(nil)
+	expired.lastUsed = time.Now().Add(-2 * sessionLifetime)
+
+	if err := op.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(op.state.path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the state file is %v, %v", info.Mode(), err)
+	}
+
+	restarted := &OnionProxy{sessions: make(map[string]*session), state: newStateFile(op.state.path)}
+	restored, err := restarted.loadState()
+	if err != nil || len(restored) != 1 {
+		t.Fatalf("restored %d sessions, %v", len(restored), err)
+	}
+	got := restored[0]
+	if restarted.sessions[sess.token] != got || got.username != "alice" || got.userToken != "token-alice" || !got.signingKey.Equal(sess.signingKey) {
+		t.Fatalf("restored %+v", got)
+	}
+	if got.lastMessageId != 7 || got.lastShown["#general"] != 5 || got.homes["#other"] != "127.0.0.1:9001" || got.cursors["127.0.0.1:9001"].lastMessageId != 3 {
+		t.Fatalf("the cursors restored are %+v", got)
+	}
+	if len(got.pending) != 1 || got.pending[1].Message != "later" {
+		t.Fatalf("the pending messages restored are %+v", got.pending)
+	}
+	if len(got.outbox) != 1 || got.outbox[0].Message != "queued" {
+		t.Fatalf("the outbox restored is %+v", got.outbox)
+	}
+	if restarted.state.entryGuard() != "127.0.0.1:8001" {
+		t.Fatalf("the entry guard restored is %q", restarted.state.entryGuard())
+	}
+}
+
+func TestStateIsOnlyWrittenWhenChanged(t *testing.T) {
+	op := testStatefulProxy(t)
+	if restored, err := op.loadState(); err != nil || restored != nil {
+		t.Fatalf("a missing state file gave %v, %v", restored, err)
+	}
+	if err := op.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(op.state.path); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(op.state.path); !os.IsNotExist(err) {
+		t.Fatal("an unchanged state was written again")
+	}
+	op.state.setEntryGuard("127.0.0.1:8001")
+	if err := op.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(op.state.path); err != nil {
+		t.Fatal("a changed state wasn't written")
+	}
+}
+
+func TestEntryGuard(t *testing.T) {
+	op := testStatefulProxy(t)
+	guard := entryGuard(op.state, testORInfos)
+	for i := 0; i < 10; i++ {
+		if again := entryGuard(op.state, testORInfos); again.Address != guard.Address {
+			t.Fatalf("the guard moved from %s to %s", guard.Address, again.Address)
+		}
+	}
+
+	// Replaced once it leaves the candidates
+	if next := entryGuard(op.state, withoutOR(testORInfos, guard)); next.Address == guard.Address || op.state.entryGuard() != next.Address {
+		t.Fatalf("the guard %s wasn't replaced", guard.Address)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// SOCKS5 (RFC 1928) configurations, CONNECT without authentication only
+const (
+	socksVersion          byte          = 5
+	socksNoAuth           byte          = 0
+	socksNoAcceptable     byte          = 0xff
+	socksConnect          byte          = 1
+	socksAddrIPv4         byte          = 1
+	socksAddrDomain       byte          = 3
+	socksAddrIPv6         byte          = 4
+	socksSucceeded        byte          = 0
+	socksGeneralFailure   byte          = 1
+	socksCommandNotSup    byte          = 7
+	socksAddrTypeNotSup   byte          = 8
+	socksHandshakeTimeout time.Duration = 10 * time.Second
+
+	// Streams go through a circuit of their own, built lazily towards an exit
+	// whose policy accepts the destination
+	streamCircuit string = "stream"
+)
+
+// A TCP connection carried through a circuit to its exit node. A stream
+// stays on the circuit it was opened on when that circuit is replaced.
+type proxyStream struct {
+	circ        *circuit
+	id          uint32
+	destination string
+}
+
+// Asks the exit node of a stream circuit to connect to destination
+func (op *OnionProxy) openStream(destination string) (*proxyStream, error) {
+	if err := op.start(); err != nil {
+		return nil, err
+	}
+	circ, err := op.streamCircuitTo(destination)
+	if err != nil {
+		return nil, err
+	}
+	if !circ.exitSupports(shared.FeatureStreams) {
+		return nil, unsupportedByExitError(circ.exitAddress(), shared.FeatureStreams)
+	}
+
+	idBytes := make([]byte, 4)
+	if _, err := util.Random.Read(idBytes); err != nil {
+		return nil, err
+	}
+	stream := &proxyStream{circ: circ, id: binary.BigEndian.Uint32(idBytes), destination: destination}
+	if _, err := stream.send(shared.CommandStreamBegin, shared.StreamBegin{StreamId: stream.id, Address: destination}); err != nil {
+		return nil, err
+	}
+	util.OutLog.Printf("Opened stream to %s through %s\n", destination, circ.exitAddress())
+	return stream, nil
+}
+
+// Returns the stream circuit if its exit accepts destination and it is not
+// older than the longest rotation interval, or builds a new one whose exit
+// does. Streams already open stay on the circuit they were opened on.
+func (op *OnionProxy) streamCircuitTo(destination string) (*circuit, error) {
+	op.streamCircuitMutex.Lock()
+	defer op.streamCircuitMutex.Unlock()
+
+	op.circuitsMutex.RLock()
+	circ, ok := op.circuits[streamCircuit]
+	op.circuitsMutex.RUnlock()
+	if ok && circ.exitsTo(destination, true) && util.Time.Now().Sub(circ.builtAt) < op.clientParams().MaxRotationInterval {
+		return circ, nil
+	}
+
+	if !op.reuseCircuit(streamCircuit, []string{destination}, true) {
+		if err := op.buildCircuitTo(streamCircuit, []string{destination}, true); err != nil {
+			return nil, err
+		}
+	}
+	op.circuitsMutex.RLock()
+	defer op.circuitsMutex.RUnlock()
+	return op.circuits[streamCircuit], nil
+}
+
+// Forgets the stream circuit if its exit left the consensus or stopped
+// opening streams, so the next stream is opened through a new one
+func (op *OnionProxy) dropStreamCircuit(consensus []shared.OnionRouterInfo) {
+	op.circuitsMutex.Lock()
+	circ, ok := op.circuits[streamCircuit]
+	if !ok {
+		op.circuitsMutex.Unlock()
+		return
+	}
+	for _, info := range consensus {
+		if info.Address == circ.exitAddress() && info.Offers(shared.CapabilityExitStreams) {
+			op.circuitsMutex.Unlock()
+			return
+		}
+	}
+	delete(op.circuits, streamCircuit)
+	op.circuitsMutex.Unlock()
+
+	util.OutLog.Printf("Exit %s of the stream circuit is no longer usable\n", circ.exitAddress())
+	op.retireCircuit(circ)
+}
+
+func (stream *proxyStream) send(command string, coreData interface{}) (shared.StreamResponse, error) {
+	jsonData, err := json.Marshal(coreData)
+	if err != nil {
+		return shared.StreamResponse{}, shared.EncodingError(command+" payload", err)
+	}
+	onion, err := stream.circ.OnionizeData(command, jsonData)
+	if err != nil {
+		return shared.StreamResponse{}, err
+	}
+	return stream.circ.SendStreamOnion(command, onion)
+}
+
+// Tells the exit to close the stream. An exit that can't be told closes it
+// with the circuit, or once the destination closes its side.
+func (stream *proxyStream) end() {
+	if _, err := stream.send(shared.CommandStreamEnd, shared.StreamEnd{StreamId: stream.id}); err != nil {
+		util.OutLog.Printf("Could not end stream to %s: %v\n", stream.destination, err)
+	}
+}
+
+// Copies between local and the stream until either side closes. Each round
+// trip sends what local wrote and brings back what the destination sent; the
+// exit node holds a round trip without data until some arrives, briefly.
+func (stream *proxyStream) carry(local net.Conn) {
+	defer local.Close()
+
+	upstream := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(upstream)
+		for {
+			buf := make([]byte, shared.MaxStreamData)
+			n, err := local.Read(buf)
+			if n > 0 {
+				select {
+				case upstream <- buf[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		var data []byte
+		select {
+		case chunk, ok := <-upstream:
+			if !ok {
+				stream.end()
+				return
+			}
+			data = chunk
+		default:
+		}
+
+		resp, err := stream.send(shared.CommandStreamData, shared.StreamData{StreamId: stream.id, Data: data})
+		if err != nil {
+			util.HandleNonFatalError("Lost stream to "+stream.destination, err)
+			return
+		}
+		if len(resp.Data) > 0 {
+			if _, err := local.Write(resp.Data); err != nil {
+				stream.end()
+				return
+			}
+		}
+		if resp.Closed {
+			return
+		}
+	}
+}
+
+// -forward values: local ip:port to destination host:port
+type streamForwards map[string]string
+
+func (f streamForwards) String() string {
+	var pairs []string
+	for local, destination := range f {
+		pairs = append(pairs, local+"="+destination)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f streamForwards) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected local-ip:port=host:port, got %q", value)
+	}
+	for _, address := range kv {
+		if _, err := shared.CanonicalAddress(address); err != nil {
+			return fmt.Errorf("invalid address %q: %s", address, err)
+		}
+	}
+	f[kv[0]] = kv[1]
+	return nil
+}
+
+// Carries every connection to localAddr through a stream to destination
+func (op *OnionProxy) serveForward(localAddr string, destination string) {
+	inbound, err := net.Listen("tcp", localAddr)
+	util.HandleFatalError("Could not listen for forwarded connections", err)
+	util.OutLog.Printf("Forwarding %s to %s through the onion network\n", localAddr, destination)
+
+	for {
+		local, err := inbound.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Could not accept forwarded connection", err)
+			continue
+		}
+		go func() {
+			stream, err := op.openStream(destination)
+			if err != nil {
+				util.HandleNonFatalError("Could not open stream to "+destination, err)
+				local.Close()
+				return
+			}
+			stream.carry(local)
+		}()
+	}
+}
+
+// Serves SOCKS5 CONNECT requests on addr, each carried through a stream
+func (op *OnionProxy) serveSOCKS(addr string) {
+	inbound, err := net.Listen("tcp", addr)
+	util.HandleFatalError("Could not listen for SOCKS connections", err)
+	util.OutLog.Printf("SOCKS5 proxy available on %s\n", addr)
+
+	for {
+		conn, err := inbound.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Could not accept SOCKS connection", err)
+			continue
+		}
+		go op.handleSOCKS(conn)
+	}
+}
+
+func (op *OnionProxy) handleSOCKS(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	destination, err := readSOCKSRequest(conn)
+	if err != nil {
+		util.HandleNonFatalError("Invalid SOCKS request", err)
+		conn.Close()
+		return
+	}
+
+	stream, err := op.openStream(destination)
+	if err != nil {
+		util.HandleNonFatalError("Could not open stream to "+destination, err)
+		writeSOCKSReply(conn, socksGeneralFailure)
+		conn.Close()
+		return
+	}
+	if err = writeSOCKSReply(conn, socksSucceeded); err != nil {
+		stream.end()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	stream.carry(conn)
+}
+
+// Negotiates no authentication and reads a CONNECT request, returning its
+// destination as host:port
+func readSOCKSRequest(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("SOCKS version %d, only 5 is supported", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if !strings.ContainsRune(string(methods), rune(socksNoAuth)) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", fmt.Errorf("SOCKS client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != socksConnect {
+		writeSOCKSReply(conn, socksCommandNotSup)
+		return "", fmt.Errorf("SOCKS command %d, only CONNECT is supported", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(conn, socksAddrTypeNotSup)
+		return "", fmt.Errorf("SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// Replies to a CONNECT. The exit node's local address isn't known here, so
+// the bound address is always 0.0.0.0:0.
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
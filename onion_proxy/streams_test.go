@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// Runs a SOCKS handshake sending request after the greeting, returning what
+// readSOCKSRequest read and what the client was sent
+func testSOCKSRequest(t *testing.T, greeting []byte, request []byte) (string, []byte, error) {
+	client, server := net.Pipe()
+	defer client.Close()
+	type result struct {
+		destination string
+		err         error
+	}
+	results := make(chan result, 1)
+	go func() {
+		destination, err := readSOCKSRequest(server)
+		server.Close()
+		results <- result{destination, err}
+	}()
+
+	var replies bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&replies, client)
+		close(copied)
+	}()
+	client.Write(greeting)
+	client.Write(request)
+	r := <-results
+	<-copied
+	return r.destination, replies.Bytes(), r.err
+}
+
+func TestReadSOCKSRequest(t *testing.T) {
+	greeting := []byte{socksVersion, 1, socksNoAuth}
+	for _, c := range []struct {
+		request     []byte
+		destination string
+	}{
+		{[]byte{socksVersion, socksConnect, 0, socksAddrIPv4, 10, 0, 0, 1, 0, 80}, "10.0.0.1:80"},
+		{append(append([]byte{socksVersion, socksConnect, 0, socksAddrDomain, 11}, "example.com"...), 1, 187), "example.com:443"},
+		{[]byte{socksVersion, socksConnect, 0, socksAddrIPv6, 0x20, 1, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 22}, "[2001:db8::1]:22"},
+	} {
+		destination, replies, err := testSOCKSRequest(t, greeting, c.request)
+		if err != nil || destination != c.destination || !bytes.Equal(replies, []byte{socksVersion, socksNoAuth}) {
+			t.Fatalf("read %q and replied %v, %v, want %q", destination, replies, err, c.destination)
+		}
+	}
+
+	// Clients wanting authentication, or other commands, are refused
+	if _, replies, err := testSOCKSRequest(t, []byte{socksVersion, 1, 2}, nil); err == nil || !bytes.Equal(replies, []byte{socksVersion, socksNoAcceptable}) {
+		t.Fatalf("a client requiring authentication was replied %v, %v", replies, err)
+	}
+	if _, replies, err := testSOCKSRequest(t, greeting, []byte{socksVersion, 2, 0, socksAddrIPv4}); err == nil || len(replies) < 4 || replies[3] != socksCommandNotSup {
+		t.Fatalf("a BIND was replied %v, %v", replies, err)
+	}
+	if _, _, err := testSOCKSRequest(t, []byte{4, 1, socksNoAuth}, nil); err == nil {
+		t.Fatal("a SOCKS4 client was accepted")
+	}
+}
+
+func TestStreamForwards(t *testing.T) {
+	forwards := make(streamForwards)
+	if err := forwards.Set("127.0.0.1:8080=example.com:80"); err != nil || forwards["127.0.0.1:8080"] != "example.com:80" {
+		t.Fatalf("parsed %v, %v", forwards, err)
+	}
+	for _, value := range []string{"127.0.0.1:8080", "127.0.0.1=example.com:80", "127.0.0.1:8080=example.com"} {
+		if err := forwards.Set(value); err == nil {
+			t.Fatalf("%q parsed", value)
+		}
+	}
+}
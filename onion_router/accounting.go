@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type HibernatingError error
+
+// Accounting configurations
+const (
+	accountingCheckInterval time.Duration = 10 * time.Second
+	accountingSoftLimit     float64       = 0.9 // share of the cap after which no new circuits are taken
+)
+
+// What a router with a traffic cap does in its accounting period
+const (
+	accountingAwake       = iota // listed in the directory, taking circuits
+	accountingDraining           // left the directory, relaying the circuits it has
+	accountingHibernating        // cap used up, every circuit torn down
+)
+
+var (
+	// Accounting Errors
+	hibernatingError HibernatingError = errors.New("Onion router is hibernating until its next accounting period")
+
+	accountingMax    byteSize // set by -accounting-max, 0 relays without a cap
+	accountingPeriod = "month"
+
+	accounting Accounting
+)
+
+// Bytes of cells relayed in the current accounting period, against the cap.
+// Relaying stops once it is used up, until the next period starts.
+type Accounting struct {
+	sync.Mutex
+	used      uint64
+	periodEnd time.Time
+	state     int
+}
+
+// A -accounting-max value: bytes with an optional KB, MB, GB or TB suffix
+type byteSize uint64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   uint64
+}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	unit := uint64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value, unit = strings.TrimSpace(strings.TrimSuffix(value, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected bytes with an optional KB, MB, GB or TB suffix, got %q", value)
+	}
+	*b = byteSize(n * unit)
+	return nil
+}
+
+// The accounting period around now: the calendar month, week from Monday or
+// day, in UTC
+func accountingBounds(period string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch period {
+	case "month":
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0), nil
+	case "week":
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7), nil
+	case "day":
+		return day, day.AddDate(0, 0, 1), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("unknown accounting period %q, expected month, week or day", period)
+	}
+}
+
+// Counts bytes relayed against the cap
+func (a *Accounting) record(size int) {
+	if accountingMax == 0 {
+		return
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	a.used += uint64(size)
+}
+
+// Whether the router is listed and takes new circuits
+func (a *Accounting) awake() bool {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.state == accountingAwake
+}
+
+// Refuses new circuits once the router stopped taking them
+func refuseWhileHibernating() error {
+	if !accounting.awake() {
+		return hibernatingError
+	}
+	return nil
+}
+
+// The report heartbeats carry, nil without a cap
+func (a *Accounting) report() *shared.AccountingReport {
+	if accountingMax == 0 {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	return &shared.AccountingReport{
+		Max:         uint64(accountingMax),
+		Used:        a.used,
+		PeriodEnd:   a.periodEnd.Unix(),
+		Hibernating: a.state != accountingAwake,
+	}
+}
+
+// Moves to the state the bytes used call for, or back to awake once a new
+// period started. Returns the state before and after.
+func (a *Accounting) advance(now time.Time) (int, int) {
+	a.Lock()
+	defer a.Unlock()
+
+	before := a.state
+	if !now.Before(a.periodEnd) {
+		_, a.periodEnd, _ = accountingBounds(accountingPeriod, now)
+		a.used = 0
+		a.state = accountingAwake
+	}
+	switch {
+	case a.used >= uint64(accountingMax):
+		a.state = accountingHibernating
+	case a.state == accountingAwake && float64(a.used) >= accountingSoftLimit*float64(accountingMax):
+		a.state = accountingDraining
+	}
+	return before, a.state
+}
+
+// Checks the bytes relayed every accountingCheckInterval. Near the cap the
+// router leaves the directory and takes no new circuits, but relays those it
+// has; at the cap it tears them down. It registers again when the next
+// period starts.
+func (or OnionRouter) runAccounting() {
+	_, end, _ := accountingBounds(accountingPeriod, util.Time.Now())
+	accounting.Lock()
+	accounting.periodEnd = end
+	accounting.Unlock()
+	util.OutLog.Printf("Relaying at most %d bytes until %v\n", uint64(accountingMax), end.Format(time.RFC3339))
+
+	for {
+		util.Time.Sleep(accountingCheckInterval)
+
+		before, after := accounting.advance(util.Time.Now())
+		if before == after {
+			continue
+		}
+		report := accounting.report()
+		switch after {
+		case accountingDraining:
+			util.OutLog.Printf("Relayed %d of %d bytes, hibernating until %v once current circuits drain\n", report.Used, report.Max, time.Unix(report.PeriodEnd, 0).Format(time.RFC3339))
+			// Tells the directory to drop this router
+			if err := or.sendHeartBeat(); err != nil {
+				util.HandleNonFatalError("Could not tell directory server this router hibernates", err)
+			}
+		case accountingHibernating:
+			destroyed := destroyCircuitsWithNotice(shared.DestroyHibernating)
+			util.OutLog.Printf("Relayed %d of %d bytes, tore down %d circuits, hibernating until %v\n", report.Used, report.Max, destroyed, time.Unix(report.PeriodEnd, 0).Format(time.RFC3339))
+			if before == accountingAwake {
+				if err := or.sendHeartBeat(); err != nil {
+					util.HandleNonFatalError("Could not tell directory server this router hibernates", err)
+				}
+			}
+		case accountingAwake:
+			util.OutLog.Printf("New accounting period until %v, registering again\n", time.Unix(report.PeriodEnd, 0).Format(time.RFC3339))
+			if err := or.registerNode(); err != nil {
+				util.HandleNonFatalError("Could not register again after hibernating", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	for value, want := range map[string]byteSize{"500": 500, "2KB": 2 << 10, "500 gb": 500 << 30, "1TB": 1 << 40, "7B": 7} {
+		var size byteSize
+		if err := size.Set(value); err != nil || size != want {
+			t.Fatalf("%q parsed as %d, %v, want %d", value, size, err, want)
+		}
+	}
+	var size byteSize
+	if err := size.Set("lots"); err == nil {
+		t.Fatal("a size without a number parsed")
+	}
+}
+
+func TestAccountingBounds(t *testing.T) {
+	now := time.Date(2024, time.February, 14, 15, 4, 5, 0, time.UTC) // a Wednesday
+	for _, c := range []struct {
+		period     string
+		start, end time.Time
+	}{
+		{"month", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)},
+		{"week", time.Date(2024, time.February, 12, 0, 0, 0, 0, time.UTC), time.Date(2024, time.February, 19, 0, 0, 0, 0, time.UTC)},
+		{"day", time.Date(2024, time.February, 14, 0, 0, 0, 0, time.UTC), time.Date(2024, time.February, 15, 0, 0, 0, 0, time.UTC)},
+	} {
+		start, end, err := accountingBounds(c.period, now)
+		if err != nil || !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Fatalf("a %s is %v to %v, %v", c.period, start, end, err)
+		}
+	}
+	if _, _, err := accountingBounds("year", now); err == nil {
+		t.Fatal("an unknown period was accepted")
+	}
+}
+
+func TestAccountingAdvance(t *testing.T) {
+	defer func() { accountingMax = 0 }()
+	accountingMax = 1000
+	now := time.Date(2024, time.February, 14, 0, 0, 0, 0, time.UTC)
+	a := &Accounting{periodEnd: time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)}
+
+	a.record(899)
+	if _, after := a.advance(now); after != accountingAwake {
+		t.Fatalf("below the soft limit the router is in state %d", after)
+	}
+	a.record(1)
+	if _, after := a.advance(now); after != accountingDraining || a.awake() {
+		t.Fatalf("at the soft limit the router is in state %d", after)
+	}
+	a.record(100)
+	if before, after := a.advance(now); before != accountingDraining || after != accountingHibernating {
+		t.Fatalf("at the cap the router went from state %d to %d", before, after)
+	}
+	if report := a.report(); !report.Hibernating || report.Remaining() != 0 || report.Max != 1000 {
+		t.Fatalf("a hibernating router reports %+v", report)
+	}
+
+	// A new period starts awake with nothing used
+	if _, after := a.advance(a.periodEnd); after != accountingAwake || a.report().Used != 0 || !a.awake() {
+		t.Fatalf("in the next period the router is in state %d with %+v", after, a.report())
+	}
+}
+
+func TestRefuseWhileHibernating(t *testing.T) {
+	defer func() { accounting.state = accountingAwake }()
+	if err := refuseWhileHibernating(); err != nil {
+		t.Fatal(err)
+	}
+	accounting.state = accountingDraining
+	if err := refuseWhileHibernating(); err != hibernatingError {
+		t.Fatalf("a draining router gave %v, want %v", err, hibernatingError)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Bandwidth measurement configurations
+	bandwidthSampleInterval time.Duration = time.Second
+	bandwidthWindow         int           = 10 // samples averaged into one throughput reading
+	bandwidthHistory        int           = 60 // minutes the best reading is remembered for
+)
+
+// Measures how fast this router relays. Throughput is averaged over
+// bandwidthWindow seconds so bursts don't count, and the best average of
+// every minute is kept for bandwidthHistory minutes, so a router that was
+// busy recently still reports what it can do while traffic is low.
+type BandwidthMeter struct {
+	sync.Mutex
+	relayed uint64   // bytes since the last sample
+	samples []uint64 // bytes relayed per sample interval, newest last
+	peaks   []uint64 // best average per minute, newest last
+	minute  time.Time
+}
+
+var bandwidthMeter BandwidthMeter
+
+func (m *BandwidthMeter) record(size int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.relayed += uint64(size)
+}
+
+func (m *BandwidthMeter) sample(now time.Time) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.samples = append(m.samples, m.relayed)
+	m.relayed = 0
+	if len(m.samples) > bandwidthWindow {
+		m.samples = m.samples[len(m.samples)-bandwidthWindow:]
+	}
+
+	var total uint64
+	for _, n := range m.samples {
+		total += n
+	}
+	average := total * uint64(time.Second/bandwidthSampleInterval) / uint64(len(m.samples))
+
+	if minute := now.Truncate(time.Minute); !minute.Equal(m.minute) || len(m.peaks) == 0 {
+		m.minute = minute
+		m.peaks = append(m.peaks, 0)
+		if len(m.peaks) > bandwidthHistory {
+			m.peaks = m.peaks[len(m.peaks)-bandwidthHistory:]
+		}
+	}
+	if last := len(m.peaks) - 1; average > m.peaks[last] {
+		m.peaks[last] = average
+	}
+}
+
+// The highest throughput, in bytes per second, sustained for bandwidthWindow
+// samples during the last bandwidthHistory minutes
+func (m *BandwidthMeter) observed() uint64 {
+	m.Lock()
+	defer m.Unlock()
+
+	var best uint64
+	for _, peak := range m.peaks {
+		if peak > best {
+			best = peak
+		}
+	}
+	return best
+}
+
+func measureBandwidth() {
+	for {
+		time.Sleep(bandwidthSampleInterval)
+		bandwidthMeter.sample(time.Now())
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthMeter(t *testing.T) {
+	var m BandwidthMeter
+	start := time.Date(2020, 1, 2, 15, 4, 0, 0, time.UTC)
+
+	// A one second burst is averaged over the whole window
+	m.record(10000)
+	m.sample(start)
+	for i := 1; i < bandwidthWindow; i++ {
+		m.sample(start.Add(time.Duration(i) * time.Second))
+	}
+	if observed := m.observed(); observed != 10000 {
+		t.Fatalf("observed %d after the first sample, want 10000", observed)
+	}
+	m.sample(start.Add(time.Duration(bandwidthWindow) * time.Second))
+	if observed := m.observed(); observed != 10000 {
+		t.Fatalf("the first minute's peak was lost: %d", observed)
+	}
+
+	// A sustained rate is what the window averages to
+	for i := 0; i < bandwidthWindow; i++ {
+		m.record(500)
+		m.sample(start.Add(time.Minute + time.Duration(i)*time.Second))
+	}
+	if observed := m.observed(); observed != 10000 {
+		t.Fatalf("a lower rate replaced the peak: %d", observed)
+	}
+
+	// Peaks are forgotten after bandwidthHistory minutes
+	for minute := 2; minute <= bandwidthHistory+1; minute++ {
+		m.record(500)
+		m.sample(start.Add(time.Duration(minute) * time.Minute))
+	}
+	if observed := m.observed(); observed != 500 {
+		t.Fatalf("observed %d after the peak expired, want 500", observed)
+	}
+}
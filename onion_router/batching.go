@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"../util"
+)
+
+const (
+	// Batching configurations
+	defaultBatchSize int = 8
+)
+
+var (
+	batchDelay  time.Duration // set by -batch-delay, 0 forwards cells at once
+	batchSize   = defaultBatchSize
+	batchJitter time.Duration // set by -batch-jitter
+
+	// Cells waiting to be forwarded
+	cellBatch = struct {
+		sync.Mutex
+		waiting    []chan struct{}
+		generation uint64 // of the batch filling up, so a late timer can't flush the next one
+		timerSet   bool
+	}{}
+)
+
+// Holds a cell about to be forwarded, to the next router or the chat server,
+// until its batch is flushed: once batchSize cells wait, or a random delay up
+// to batchDelay after the first. Cells of a batch leave in random order, each
+// after a random jitter up to batchJitter, so their order and timing don't
+// match how they arrived.
+func waitForBatch() {
+	if batchDelay <= 0 {
+		return
+	}
+
+	release := make(chan struct{})
+	cellBatch.Lock()
+	cellBatch.waiting = append(cellBatch.waiting, release)
+	if len(cellBatch.waiting) >= batchSize {
+		flushBatchLocked()
+	} else if !cellBatch.timerSet {
+		cellBatch.timerSet = true
+		generation := cellBatch.generation
+		time.AfterFunc(randomDuration(batchDelay), func() {
+			cellBatch.Lock()
+			defer cellBatch.Unlock()
+			if cellBatch.generation == generation {
+				flushBatchLocked()
+			}
+		})
+	}
+	cellBatch.Unlock()
+
+	<-release
+}
+
+// Releases the cells of the batch. Caller must hold the batch lock.
+func flushBatchLocked() {
+	waiting := cellBatch.waiting
+	cellBatch.waiting = nil
+	cellBatch.generation++
+	cellBatch.timerSet = false
+
+	for i := len(waiting) - 1; i > 0; i-- {
+		j := int(util.Random.Uint32() % uint32(i+1))
+		waiting[i], waiting[j] = waiting[j], waiting[i]
+	}
+	for _, release := range waiting {
+		if batchJitter <= 0 {
+			close(release)
+			continue
+		}
+		release := release
+		time.AfterFunc(randomDuration(batchJitter), func() { close(release) })
+	}
+}
+
+// Uniformly from 0 to max
+func randomDuration(max time.Duration) time.Duration {
+	return time.Duration(util.Random.Float64() * float64(max))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func setBatching(t *testing.T, delay time.Duration, size int) {
+	oldDelay, oldSize := batchDelay, batchSize
+	batchDelay, batchSize = delay, size
+	t.Cleanup(func() { batchDelay, batchSize = oldDelay, oldSize })
+}
+
+// Starts n cells waiting for their batch, and returns when each was released
+func waitingCells(n int) <-chan time.Time {
+	released := make(chan time.Time, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			waitForBatch()
+			released <- time.Now()
+		}()
+	}
+	return released
+}
+
+func TestBatchFlushesWhenFull(t *testing.T) {
+	setBatching(t, time.Hour, 3)
+	started := time.Now()
+	released := waitingCells(3)
+	for i := 0; i < 3; i++ {
+		select {
+		case at := <-released:
+			if at.Sub(started) > time.Second {
+				t.Fatalf("a full batch was held %v", at.Sub(started))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("a full batch wasn't flushed")
+		}
+	}
+}
+
+func TestBatchFlushesAfterDelay(t *testing.T) {
+	setBatching(t, 100*time.Millisecond, 100)
+	select {
+	case <-waitingCells(1):
+	case <-time.After(3 * time.Second):
+		t.Fatal("a batch that didn't fill up was never flushed")
+	}
+
+	// Without a delay cells are forwarded at once
+	batchDelay = 0
+	started := time.Now()
+	waitForBatch()
+	if time.Since(started) > 50*time.Millisecond {
+		t.Fatalf("a cell was held %v without batching", time.Since(started))
+	}
+}
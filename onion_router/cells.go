@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+// Exit commands each cell type may carry. Fetching fragments, posting tokens
+// and channel keys happens in polling cells, stream commands in stream cells,
+// pings in ping cells, every other command in relay cells.
+var cellCommands = map[string]func(command string) bool{
+	cellRelayData: func(command string) bool {
+		return shared.KnownCommand(command) && !pollingCommand(command) && !shared.StreamCommand(command) && command != shared.CommandPing
+	},
+	cellPolling: func(command string) bool {
+		return command == shared.CommandChatMessage || pollingCommand(command)
+	},
+	cellExport: func(command string) bool {
+		return command == shared.CommandChatMessage
+	},
+	cellStream: shared.StreamCommand,
+	cellPing: func(command string) bool {
+		return command == shared.CommandPing
+	},
+}
+
+// Commands answered with a PollingResponse besides polling itself
+func pollingCommand(command string) bool {
+	return command == shared.CommandFetchFragment || command == shared.CommandIssuePostingTokens || command == shared.CommandChannelKeys || command == shared.CommandPrekeyBundle || command == shared.CommandGetRoster || command == shared.CommandMeasure
+}
+
+func malformed(format string, args ...interface{}) error {
+	return shared.MalformedCellError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Decrypts this router's layer of a cell in place and checks that it is an
+// onion a cell of cellType may carry. Counts the cell as activity on its
+// circuit. The next layer of a binary onion is a slice of cell.Data, so a
+// middle hop forwards it without copying. Waits for a scheduler slot first,
+// which is given up before the cell is relayed on, so routers never wait on
+// each other's slots.
+func decryptCell(cell shared.Cell, cellType string) (shared.Onion, error) {
+	if err := checkCellSize(cell.Data); err != nil {
+		return shared.Onion{}, err
+	}
+	release, err := scheduler.acquire(cell.CircuitId)
+	if err != nil {
+		return shared.Onion{}, err
+	}
+	defer release()
+
+	block, err := circuitCipher(cell.CircuitId, cellType, len(cell.Data))
+	if err != nil {
+		return shared.Onion{}, err
+	}
+	layer := cell.Data[aes.BlockSize:]
+	cipher.NewCFBDecrypter(block, cell.Data[:aes.BlockSize]).XORKeyStream(layer, layer)
+	return parseOnionLayer(layer, cellType)
+}
+
+// Wipes a cell's decrypted layer and the payload it carried once the cell was
+// handled. A JSON onion's payload was decoded into a buffer of its own.
+// Relaying is synchronous, so the next layer has been sent on by then.
+func wipeLayer(cell shared.Cell, onion shared.Onion) {
+	secmem.WipeAll(cell.Data, onion.Data)
+}
+
+func checkCellSize(data []byte) error {
+	if len(data) < aes.BlockSize {
+		return malformed("cell of %d bytes is shorter than its IV", len(data))
+	}
+	if len(data) > shared.MaxCellData {
+		return malformed("cell of %d bytes is larger than %d", len(data), shared.MaxCellData)
+	}
+	return nil
+}
+
+// Decrypts one onion layer with key and validates it for cellType. Depends on
+// nothing but its arguments and leaves data untouched, so it can be fuzzed.
+func openOnionLayer(key []byte, data []byte, cellType string) (shared.Onion, error) {
+	if err := checkCellSize(data); err != nil {
+		return shared.Onion{}, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		util.HandleNonFatalError("Could not create cipher key", err)
+		return shared.Onion{}, err
+	}
+
+	layer := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCFBDecrypter(block, data[:aes.BlockSize]).XORKeyStream(layer, data[aes.BlockSize:])
+	return parseOnionLayer(layer, cellType)
+}
+
+// Decodes a decrypted layer, binary or JSON, and validates it for cellType
+func parseOnionLayer(layer []byte, cellType string) (shared.Onion, error) {
+	var onion shared.Onion
+	var err error
+	if len(layer) > 0 && layer[0] == shared.BinaryOnionFormat {
+		if onion, err = shared.ParseBinaryOnion(layer); err != nil {
+			return onion, malformed("%v", err)
+		}
+	} else if err = json.Unmarshal(layer, &onion); err != nil {
+		util.HandleNonFatalError("Could not unmarshal onion", err)
+		return onion, malformed("onion layer does not decode: %v", err)
+	}
+	return onion, validateOnion(onion, cellType)
+}
+
+func validateOnion(onion shared.Onion, cellType string) error {
+	allowed, ok := cellCommands[cellType]
+	if !ok {
+		return malformed("unknown cell type %q", cellType)
+	}
+	if onion.IsExitNode {
+		if !allowed(onion.Command) {
+			return malformed("%s cell can't carry command %q", cellType, onion.Command)
+		}
+		return nil
+	}
+
+	if onion.Command != "" {
+		return malformed("command %q outside the exit layer", onion.Command)
+	}
+	if onion.DestroyToken != nil && len(onion.DestroyToken) != shared.DestroyTokenSize {
+		return malformed("destroy token of %d bytes, expected %d", len(onion.DestroyToken), shared.DestroyTokenSize)
+	}
+	if !validAddress(onion.NextAddress) {
+		return malformed("next address %q is not ip:port", onion.NextAddress)
+	}
+	if len(onion.Data) < aes.BlockSize {
+		return malformed("next layer of %d bytes is shorter than its IV", len(onion.Data))
+	}
+	return nil
+}
+
+// Decodes the core data of an exit command into v
+func decodePayload(data []byte, v interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return malformed("payload does not decode: %v", err)
+	}
+	return nil
+}
+
+// Checks an IRC server address from a payload before the exit node dials it
+func checkIRCServerAddr(addr string) error {
+	if !validAddress(addr) {
+		return malformed("IRC server address %q is not ip:port", addr)
+	}
+	_, err := checkExitPolicy(addr)
+	return err
+}
+
+func validAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != ""
+}
+
+// Turns a panic while handling a cell into an error, so one bad cell can't
+// take the router down. Deferred by every cell handler.
+func recoverCell(err *error) {
+	if r := recover(); r != nil {
+		util.ErrLog.Printf("[ERROR] Panic handling cell: %v\n%s", r, debug.Stack())
+		*err = malformed("cell could not be handled")
+	}
+}
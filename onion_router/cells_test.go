@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"../shared"
+)
+
+var testLayerKey = []byte("0123456789abcdef0123456789abcdef")
+
+// A middle hop's layer and an exit's, as the proxy onionizes them
+func testOnions(t testing.TB) []shared.Onion {
+	message, err := json.Marshal(shared.ChatMessage{Username: "alice", Message: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []shared.Onion{
+		{NextAddress: "127.0.0.1:8002", NextCircuitId: 7, Data: bytes.Repeat([]byte{0xa5}, 2*aes.BlockSize)},
+		{IsExitNode: true, Command: shared.CommandChatMessage, Data: message},
+	}
+}
+
+// Encrypts a decrypted layer under testLayerKey after an IV
+func sealTestLayer(t testing.TB, layer []byte) []byte {
+	block, err := aes.NewCipher(testLayerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cell := make([]byte, aes.BlockSize+len(layer))
+	copy(cell, "an iv of 16 byte")
+	cipher.NewCFBEncrypter(block, cell[:aes.BlockSize]).XORKeyStream(cell[aes.BlockSize:], layer)
+	return cell
+}
+
+func sameOnion(a shared.Onion, b shared.Onion) bool {
+	return a.IsExitNode == b.IsExitNode && a.NextAddress == b.NextAddress && a.NextCircuitId == b.NextCircuitId &&
+		a.Command == b.Command && bytes.Equal(a.Data, b.Data)
+}
+
+func TestDecryptCell(t *testing.T) {
+	circuitId := allocateCircuit(append([]byte(nil), testLayerKey...))
+	defer destroyCircuit(circuitId)
+
+	for i, layer := range testLayers(t) {
+		onion := testOnions(t)[i/2]
+		decrypted, err := decryptCell(shared.Cell{CircuitId: circuitId, Data: sealTestLayer(t, layer)}, cellRelayData)
+		if err != nil || !sameOnion(decrypted, onion) {
+			t.Fatalf("decrypted %+v, %v, want %+v", decrypted, err, onion)
+		}
+	}
+
+	for _, data := range [][]byte{
+		[]byte("short"),
+		make([]byte, shared.MaxCellData+1),
+		sealTestLayer(t, []byte("not json")),
+	} {
+		if _, err := decryptCell(shared.Cell{CircuitId: circuitId, Data: data}, cellRelayData); !shared.IsMalformedCellError(err) {
+			t.Errorf("a cell of %d bytes gave %v, want a malformed cell error", len(data), err)
+		}
+	}
+	if _, err := decryptCell(shared.Cell{CircuitId: 0, Data: make([]byte, 2*aes.BlockSize)}, cellRelayData); err != unknownCircuitError {
+		t.Fatalf("a cell on no circuit gave %v, want %v", err, unknownCircuitError)
+	}
+}
+
+func TestValidateOnion(t *testing.T) {
+	next := bytes.Repeat([]byte{1}, aes.BlockSize)
+	for _, onion := range []shared.Onion{
+		{IsExitNode: true, Command: "no such command"},
+		{IsExitNode: true, Command: shared.CommandFetchFragment},
+		{NextAddress: "127.0.0.1:8002", Command: shared.CommandPresence, Data: next},
+		{NextAddress: "127.0.0.1", Data: next},
+		{NextAddress: ":8002", Data: next},
+		{NextAddress: "127.0.0.1:8002", Data: next[:4]},
+	} {
+		if err := validateOnion(onion, cellRelayData); !shared.IsMalformedCellError(err) {
+			t.Errorf("%+v gave %v, want a malformed cell error", onion, err)
+		}
+	}
+
+	// Polling cells fetch fragments, relay cells carry everything else
+	if err := validateOnion(shared.Onion{IsExitNode: true, Command: shared.CommandFetchFragment}, cellPolling); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateOnion(shared.Onion{IsExitNode: true, Command: shared.CommandPresence}, cellPolling); err == nil {
+		t.Fatal("a polling cell carried presence")
+	}
+	if err := validateOnion(shared.Onion{NextAddress: "127.0.0.1:8002", Data: next}, cellExport); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodePayload(t *testing.T) {
+	var message shared.ChatMessage
+	if err := decodePayload([]byte(`{"Username":"alice"}`), &message); err != nil || message.Username != "alice" {
+		t.Fatalf("decoded %+v, %v", message, err)
+	}
+	if err := decodePayload([]byte(`{"Username":`), &message); !shared.IsMalformedCellError(err) {
+		t.Fatalf("a truncated payload gave %v, want a malformed cell error", err)
+	}
+	if err := checkIRCServerAddr("localhost"); !shared.IsMalformedCellError(err) {
+		t.Fatalf("an address without a port gave %v", err)
+	}
+	if err := checkIRCServerAddr("127.0.0.1:12346"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverCell(t *testing.T) {
+	handle := func() (err error) {
+		defer recoverCell(&err)
+		var onion *shared.Onion
+		return validateOnion(*onion, cellRelayData)
+	}
+	if err := handle(); !shared.IsMalformedCellError(err) {
+		t.Fatalf("a panicking handler gave %v, want a malformed cell error", err)
+	}
+}
+
+// The binary and JSON encodings of the test onions
+func testLayers(t testing.TB) [][]byte {
+	var layers [][]byte
+	for _, onion := range testOnions(t) {
+		binary, err := shared.AppendBinaryOnion(nil, onion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := json.Marshal(onion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, binary, encoded)
+	}
+	return layers
+}
+
+func TestOpenOnionLayer(t *testing.T) {
+	for i, layer := range testLayers(t) {
+		cell := sealTestLayer(t, layer)
+		sealed := append([]byte(nil), cell...)
+		opened, err := openOnionLayer(testLayerKey, cell, cellRelayData)
+		if err != nil || !sameOnion(opened, testOnions(t)[i/2]) {
+			t.Fatalf("opened %+v, %v", opened, err)
+		}
+		if !bytes.Equal(cell, sealed) {
+			t.Fatal("openOnionLayer changed the cell")
+		}
+	}
+	if _, err := openOnionLayer(testLayerKey, sealTestLayer(t, testLayers(t)[0]), "unknown"); !shared.IsMalformedCellError(err) {
+		t.Fatalf("an unknown cell type gave %v, want a malformed cell error", err)
+	}
+}
+
+// Circuits the directory and routers build themselves open like the proxy's
+func TestSealBinaryOnion(t *testing.T) {
+	block, err := aes.NewCipher(testLayerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, onion := range testOnions(t) {
+		cell, err := shared.SealBinaryOnion(block, onion, bytes.NewReader(bytes.Repeat([]byte{1}, aes.BlockSize)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened, err := openOnionLayer(testLayerKey, cell, cellRelayData); err != nil || !sameOnion(opened, onion) {
+			t.Fatalf("opened %+v, %v, want %+v", opened, err, onion)
+		}
+	}
+	if _, err := shared.SealBinaryOnion(block, testOnions(t)[0], bytes.NewReader(nil)); err == nil {
+		t.Fatal("an onion was sealed without an IV")
+	}
+}
+
+func TestParseOnionLayerChecksCellType(t *testing.T) {
+	presence, err := shared.AppendBinaryOnion(nil, shared.Onion{IsExitNode: true, Command: shared.CommandPresence})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseOnionLayer(presence, cellPolling); !shared.IsMalformedCellError(err) {
+		t.Fatalf("a polling cell carrying presence gave %v, want a malformed cell error", err)
+	}
+	for _, layer := range [][]byte{{shared.BinaryOnionFormat}, testLayers(t)[0][:9]} {
+		if _, err := parseOnionLayer(layer, cellRelayData); !shared.IsMalformedCellError(err) {
+			t.Fatalf("a truncated binary layer gave %v, want a malformed cell error", err)
+		}
+	}
+}
+
+func FuzzOpenOnionLayer(f *testing.F) {
+	for _, layer := range testLayers(f) {
+		f.Add(sealTestLayer(f, layer), cellRelayData)
+		f.Add(sealTestLayer(f, layer), cellPolling)
+	}
+	f.Add([]byte("short"), cellRelayData)
+
+	f.Fuzz(func(t *testing.T, data []byte, cellType string) {
+		sealed := append([]byte(nil), data...)
+		onion, err := openOnionLayer(testLayerKey, data, cellType)
+		if !bytes.Equal(data, sealed) {
+			t.Fatal("openOnionLayer changed its input")
+		}
+		if err == nil {
+			if err = validateOnion(onion, cellType); err != nil {
+				t.Fatalf("opened an onion that doesn't validate: %v", err)
+			}
+		} else if _, ok := err.(shared.MalformedCellError); !ok {
+			t.Fatalf("error of type %T, want MalformedCellError", err)
+		}
+	})
+}
+
+func FuzzParseOnionLayer(f *testing.F) {
+	for _, layer := range testLayers(f) {
+		f.Add(layer, cellRelayData)
+		f.Add(layer, cellPolling)
+		f.Add(layer, cellStream)
+	}
+
+	f.Fuzz(func(t *testing.T, layer []byte, cellType string) {
+		onion, err := parseOnionLayer(append([]byte(nil), layer...), cellType)
+		if err != nil {
+			if _, ok := err.(shared.MalformedCellError); !ok {
+				t.Fatalf("error of type %T, want MalformedCellError", err)
+			}
+			return
+		}
+		if layer[0] != shared.BinaryOnionFormat {
+			return
+		}
+		// What a binary layer parsed to encodes to a layer parsing the same
+		encoded, err := shared.AppendBinaryOnion(nil, onion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := parseOnionLayer(encoded, cellType)
+		if err != nil {
+			t.Fatalf("layer %x parsed to %+v, which encodes to %x that doesn't parse: %v", layer, onion, encoded, err)
+		}
+		if !sameOnion(parsed, onion) {
+			t.Fatalf("layer %x parsed to %+v, and its encoding to %+v", layer, onion, parsed)
+		}
+	})
+}
+
+func FuzzDecodePayload(f *testing.F) {
+	for _, payload := range []interface{}{
+		shared.ChatMessage{Username: "alice", Message: "hello", Channel: "#general"},
+		shared.PollingMessage{Username: "alice", LastMessageId: 3},
+	} {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte("null"))
+	f.Add([]byte(`{"Username":`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var message shared.ChatMessage
+		if err := decodePayload(data, &message); err != nil {
+			if _, ok := err.(shared.MalformedCellError); !ok {
+				t.Fatalf("error of type %T, want MalformedCellError", err)
+			}
+		}
+		var request shared.PollingMessage
+		if err := decodePayload(data, &request); err != nil {
+			if _, ok := err.(shared.MalformedCellError); !ok {
+				t.Fatalf("error of type %T, want MalformedCellError", err)
+			}
+		}
+	})
+}
+
+// The cell a middle hop gets, carrying a next layer of size bytes
+func testMiddleCell(b *testing.B, binary bool, size int) []byte {
+	onion := shared.Onion{NextAddress: "127.0.0.1:8003", Data: bytes.Repeat([]byte{0xa5}, size)}
+	layer, err := json.Marshal(onion)
+	if binary {
+		layer, err = shared.AppendBinaryOnion(nil, onion)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	return sealTestLayer(b, layer)
+}
+
+func BenchmarkDecryptCell(b *testing.B) {
+	for _, layers := range []string{"json", "binary"} {
+		for _, size := range []int{1024, 16 * 1024} {
+			b.Run(fmt.Sprintf("%s/%d", layers, size), func(b *testing.B) {
+				circuitId := uint32(size)
+				if layers == "binary" {
+					circuitId++
+				}
+				// Run again for every b.N tried, the circuit may be there already
+				if err := addCircuit(circuitId, append([]byte(nil), testLayerKey...)); err != nil && err != circuitIdInUseError {
+					b.Fatal(err)
+				}
+				sealed := testMiddleCell(b, layers == "binary", size)
+				cell := shared.Cell{CircuitId: circuitId, Data: make([]byte, len(sealed))}
+				b.SetBytes(int64(len(sealed) - aes.BlockSize))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					// Decrypted in place, so every cell is a fresh copy
+					copy(cell.Data, sealed)
+					if _, err := decryptCell(cell, cellRelayData); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type CircuitIdInUseError error
+type UnknownCircuitError error
+
+const (
+	defaultCircuitIdleTimeout time.Duration = 10 * time.Minute // proxies rotate circuits well before this
+	circuitSweepInterval      time.Duration = 30 * time.Second
+)
+
+// What this router knows about one circuit
+type circuitState struct {
+	key      []byte
+	block    cipher.Block // expanded from key on the first cell, then reused
+	created  time.Time
+	lastUsed time.Time
+	cells    map[string]uint64 // by cell type
+	bytes    uint64
+
+	peerCapabilities shared.Capabilities // sent by the onion proxy, 0 from older proxies
+
+	// Where cells are relayed to, learned from the first relayed cell. Empty
+	// at the exit node.
+	nextAddress   string
+	nextCircuitId uint32
+
+	// What a teardown is passed on with, from the first relayed cell that
+	// carried it; nil from proxies from before destroy tokens
+	nextDestroyToken []byte
+}
+
+var (
+	// Circuit Errors
+	circuitIdInUseError CircuitIdInUseError = errors.New("Circuit id is already in use on this onion router")
+	unknownCircuitError UnknownCircuitError = errors.New("No circuit with this id on this onion router")
+
+	// Circuits by the id cells arrive with. Ids are allocated by this router,
+	// so they are unique across every link it has.
+	circuits = struct {
+		sync.Mutex
+		byId map[uint32]*circuitState
+	}{byId: make(map[uint32]*circuitState)}
+
+	circuitIdleTimeout = defaultCircuitIdleTimeout
+	propagateExpiry    = true // tell the next router when a circuit expires here
+)
+
+func newCircuitState(sharedKey []byte) *circuitState {
+	now := util.Time.Now()
+	return &circuitState{
+		key:      sharedKey,
+		created:  now,
+		lastUsed: now,
+		cells:    make(map[string]uint64),
+	}
+}
+
+// Stores the key of a new circuit under a fresh id of this router's choosing
+func allocateCircuit(sharedKey []byte) uint32 {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	for {
+		circuitId := util.Random.Uint32()
+		if _, ok := circuits.byId[circuitId]; circuitId != 0 && !ok {
+			circuits.byId[circuitId] = newCircuitState(sharedKey)
+			return circuitId
+		}
+	}
+}
+
+func setPeerCapabilities(circuitId uint32, c shared.Capabilities) {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	if circ, ok := circuits.byId[circuitId]; ok {
+		circ.peerCapabilities = c
+	}
+}
+
+// Stores the key of a circuit under the id the onion proxy chose, for proxies
+// from before per-link ids. These ids are random, so they rarely collide.
+func addCircuit(circuitId uint32, sharedKey []byte) error {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	if _, ok := circuits.byId[circuitId]; ok {
+		secmem.Wipe(sharedKey)
+		return circuitIdInUseError
+	}
+	circuits.byId[circuitId] = newCircuitState(sharedKey)
+	return nil
+}
+
+// Returns the circuit's cipher and counts the cell as activity on it
+func circuitCipher(circuitId uint32, cellType string, size int) (cipher.Block, error) {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	circ, ok := circuits.byId[circuitId]
+	if !ok {
+		return nil, unknownCircuitError
+	}
+	circ.lastUsed = util.Time.Now()
+	circ.cells[cellType]++
+	circ.bytes += uint64(size)
+
+	if circ.block == nil {
+		block, err := aes.NewCipher(circ.key)
+		if err != nil {
+			return nil, err
+		}
+		circ.block = block
+	}
+	return circ.block, nil
+}
+
+// Statistics of every circuit through this router, oldest first
+func circuitStats() []shared.CircuitStats {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	stats := make([]shared.CircuitStats, 0, len(circuits.byId))
+	for circuitId, circ := range circuits.byId {
+		cells := make(map[string]uint64, len(circ.cells))
+		var total uint64
+		for cellType, n := range circ.cells {
+			cells[cellType] = n
+			total += n
+		}
+		stats = append(stats, shared.CircuitStats{
+			CircuitId:     circuitId,
+			NextAddress:   circ.nextAddress,
+			NextCircuitId: circ.nextCircuitId,
+			Created:       circ.created,
+			LastActivity:  circ.lastUsed,
+			Cells:         total,
+			CellsByType:   cells,
+			Bytes:         circ.bytes,
+			Capabilities:  circ.peerCapabilities,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Created.Before(stats[j].Created) })
+	return stats
+}
+
+// The id to relay a cell with on the link to the next router, remembered
+// along with the next router and its destroy token so an expiry can be passed
+// on. Onions from proxies before per-link ids don't set one, so the cell
+// keeps its id.
+func relayCircuitId(circuitId uint32, onion shared.Onion) uint32 {
+	nextId := circuitId
+	if onion.NextCircuitId != 0 {
+		nextId = onion.NextCircuitId
+	}
+
+	circuits.Lock()
+	if circ, ok := circuits.byId[circuitId]; ok {
+		if circ.nextAddress == "" {
+			circ.nextAddress = onion.NextAddress
+			circ.nextCircuitId = nextId
+		}
+		// A binary layer's token is part of the cell, which is wiped
+		if circ.nextDestroyToken == nil && onion.DestroyToken != nil {
+			circ.nextDestroyToken = append([]byte(nil), onion.DestroyToken...)
+		}
+	}
+	circuits.Unlock()
+
+	return nextId
+}
+
+// Forgets a circuit and zeroizes its key. Returns the circuit so the caller
+// can pass the teardown on, or nil if there was no such circuit.
+func destroyCircuit(circuitId uint32) *circuitState {
+	circuits.Lock()
+	circ, ok := circuits.byId[circuitId]
+	delete(circuits.byId, circuitId)
+	circuits.Unlock()
+
+	if !ok {
+		return nil
+	}
+	secmem.Wipe(circ.key)
+	circ.block = nil
+	dropCircuitFragments(circuitId)
+	closeCircuitStreams(circuitId)
+	scheduler.forget(circuitId)
+	return circ
+}
+
+// Destroys the circuit of a notice carrying its destroy token. A notice
+// without it is refused as if there were no such circuit, so ids can't be
+// probed for.
+func destroyCircuitFor(notice shared.DestroyNotice) (*circuitState, error) {
+	circuits.Lock()
+	circ, ok := circuits.byId[notice.CircuitId]
+	ok = ok && hmac.Equal(notice.Token, shared.DestroyToken(circ.key))
+	circuits.Unlock()
+
+	if !ok {
+		return nil, unknownCircuitError
+	}
+	if circ = destroyCircuit(notice.CircuitId); circ == nil {
+		return nil, unknownCircuitError
+	}
+	return circ, nil
+}
+
+// A destroy relay cell's data: the token, then the reason
+func destroyCellData(token []byte, reason string) []byte {
+	return append(append([]byte(nil), token...), reason...)
+}
+
+func destroyNoticeOf(cell shared.Cell) shared.DestroyNotice {
+	notice := shared.DestroyNotice{CircuitId: cell.CircuitId}
+	if len(cell.Data) >= shared.DestroyTokenSize {
+		notice.Token = cell.Data[:shared.DestroyTokenSize]
+		notice.Reason = string(cell.Data[shared.DestroyTokenSize:])
+	}
+	return notice
+}
+
+// Destroys every circuit, as the router shuts down. Returns how many there were.
+func destroyAllCircuits() int {
+	destroyed := 0
+	for _, circuitId := range circuitIds() {
+		if destroyCircuit(circuitId) != nil {
+			destroyed++
+		}
+	}
+	return destroyed
+}
+
+// Destroys every circuit and tells the next routers why, as the router stops
+// relaying but keeps running. Returns how many there were.
+func destroyCircuitsWithNotice(reason string) int {
+	destroyed := 0
+	for _, circuitId := range circuitIds() {
+		if circ := destroyCircuit(circuitId); circ != nil {
+			destroyed++
+			recordCell(cellDestroy, 0)
+			go notifyNextHop(circ, reason)
+		}
+	}
+	return destroyed
+}
+
+func circuitIds() []uint32 {
+	circuits.Lock()
+	defer circuits.Unlock()
+
+	var ids []uint32
+	for circuitId := range circuits.byId {
+		ids = append(ids, circuitId)
+	}
+	return ids
+}
+
+// Tells the next router that a circuit through it is gone. Routers from before
+// circuit expiry don't know the notice and simply keep the circuit. Without
+// the next router's destroy token it can't be told, and expires the circuit
+// once it is idle there too.
+func notifyNextHop(circ *circuitState, reason string) {
+	defer secmem.Wipe(circ.nextDestroyToken)
+	if !propagateExpiry || circ.nextAddress == "" || circ.nextDestroyToken == nil {
+		return
+	}
+
+	nextORServer, err := DialOR(circ.nextAddress)
+	if err != nil {
+		return
+	}
+	defer nextORServer.Close()
+
+	cell := shared.Cell{
+		CircuitId: circ.nextCircuitId,
+		Data:      destroyCellData(circ.nextDestroyToken, reason),
+	}
+	// The next router may have expired the circuit on its own already
+	_, err = callRelay(nextORServer, circ.nextAddress, shared.RelayDestroy, cell)
+	if err != nil && err.Error() != unknownCircuitError.Error() {
+		util.HandleNonFatalError("Could not tell "+circ.nextAddress+" about a torn down circuit", err)
+	}
+}
+
+// Tears down circuits that have carried no cells for circuitIdleTimeout
+func expireIdleCircuits() {
+	interval := circuitSweepInterval
+	if circuitIdleTimeout < interval {
+		interval = circuitIdleTimeout
+	}
+
+	for {
+		util.Time.Sleep(interval)
+		cutoff := util.Time.Now().Add(-circuitIdleTimeout)
+		scheduler.prune(util.Time.Now())
+
+		var idle []uint32
+		circuits.Lock()
+		for circuitId, circ := range circuits.byId {
+			if circ.lastUsed.Before(cutoff) {
+				idle = append(idle, circuitId)
+			}
+		}
+		circuits.Unlock()
+
+		for _, circuitId := range idle {
+			if circ := destroyCircuit(circuitId); circ != nil {
+				util.OutLog.Printf("Circuit %d expired after %v idle\n", circuitId, circuitIdleTimeout)
+				recordCell(cellDestroy, 0)
+				go notifyNextHop(circ, shared.DestroyIdle)
+			}
+		}
+	}
+}
+
+// Tears down a circuit when its creator or the previous router expired it,
+// and passes the notice on towards the exit node. The notice must carry the
+// circuit's destroy token.
+func (s *ORServer) DestroyCircuit(notice shared.DestroyNotice, ack *bool) (err error) {
+	defer func() { recordCellResult(cellDestroy, 0, err) }()
+
+	circ, err := destroyCircuitFor(notice)
+	if err != nil {
+		return err
+	}
+	util.OutLog.Printf("Circuit %d torn down by the previous router (%s)\n", notice.CircuitId, notice.Reason)
+	go notifyNextHop(circ, notice.Reason)
+
+	*ack = true
+	return nil
+}
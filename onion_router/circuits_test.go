@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+func TestCircuitIds(t *testing.T) {
+	first, second := allocateCircuit([]byte("key one")), allocateCircuit(append([]byte(nil), testLayerKey...))
+	if first == 0 || first == second {
+		t.Fatalf("allocated ids %d and %d", first, second)
+	}
+	block, err := circuitCipher(second, cellRelayData, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := circuitCipher(second, cellRelayData, 0); again != block {
+		t.Fatal("the cipher was expanded again for the second cell")
+	}
+	if err := addCircuit(first, []byte("key three")); err != circuitIdInUseError {
+		t.Fatalf("reusing an allocated id gave %v, want %v", err, circuitIdInUseError)
+	}
+
+	destroyCircuit(7)
+	if _, err := circuitCipher(7, cellRelayData, 0); err != unknownCircuitError {
+		t.Fatalf("an unknown circuit gave %v, want %v", err, unknownCircuitError)
+	}
+	if err := addCircuit(7, []byte("key four")); err != nil {
+		t.Fatal(err)
+	}
+	destroyCircuit(7)
+}
+
+func TestRelayCircuitId(t *testing.T) {
+	circuitId := allocateCircuit([]byte("key"))
+	defer destroyCircuit(circuitId)
+
+	if id := relayCircuitId(circuitId, shared.Onion{NextAddress: "127.0.0.1:8002", NextCircuitId: 9}); id != 9 {
+		t.Fatalf("relayed with id %d, want 9", id)
+	}
+	if id := relayCircuitId(5, shared.Onion{NextAddress: "127.0.0.1:8002"}); id != 5 {
+		t.Fatalf("an onion without a next id relayed with %d, want 5", id)
+	}
+
+	// The first relayed cell fixes where a teardown is passed on to
+	relayCircuitId(circuitId, shared.Onion{NextAddress: "127.0.0.1:8003", NextCircuitId: 10})
+	circ := destroyCircuit(circuitId)
+	if circ == nil || circ.nextAddress != "127.0.0.1:8002" || circ.nextCircuitId != 9 {
+		t.Fatalf("the teardown goes to %+v", circ)
+	}
+}
+
+// Stands in for the next router, recording the teardowns it is told about
+type testNextHop struct {
+	notices chan shared.DestroyNotice
+}
+
+func (h *testNextHop) DestroyCircuit(notice shared.DestroyNotice, ack *bool) error {
+	h.notices <- notice
+	*ack = true
+	return nil
+}
+
+func TestDestroyCircuit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	next := &testNextHop{notices: make(chan shared.DestroyNotice, 1)}
+	server := rpc.NewServer()
+	if err = server.RegisterName("ORServer", next); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+
+	key := []byte("secret key")
+	circuitId := allocateCircuit(key)
+	token := shared.DestroyToken(key)
+	nextToken := shared.DestroyToken([]byte("next key"))
+	relayCircuitId(circuitId, shared.Onion{NextAddress: listener.Addr().String(), NextCircuitId: 42, DestroyToken: nextToken})
+
+	// Only the circuit's destroy token tears it down
+	var ack bool
+	for _, bad := range [][]byte{nil, nextToken} {
+		if err = new(ORServer).DestroyCircuit(shared.DestroyNotice{CircuitId: circuitId, Reason: shared.DestroyIdle, Token: bad}, &ack); err != unknownCircuitError {
+			t.Fatalf("a notice with token %x gave %v, want %v", bad, err, unknownCircuitError)
+		}
+	}
+	if _, err = circuitCipher(circuitId, cellRelayData, 0); err == unknownCircuitError {
+		t.Fatal("a refused notice tore the circuit down")
+	}
+	if err = new(ORServer).DestroyCircuit(shared.DestroyNotice{CircuitId: circuitId, Reason: shared.DestroyIdle, Token: token}, &ack); err != nil || !ack {
+		t.Fatalf("gave %v", err)
+	}
+	if string(key) != string(make([]byte, len(key))) {
+		t.Fatalf("the key wasn't zeroized: %q", key)
+	}
+	if _, err = circuitCipher(circuitId, cellRelayData, 0); err != unknownCircuitError {
+		t.Fatalf("a torn down circuit gave %v, want %v", err, unknownCircuitError)
+	}
+	select {
+	case notice := <-next.notices:
+		if notice.CircuitId != 42 || notice.Reason != shared.DestroyIdle || !bytes.Equal(notice.Token, shared.DestroyToken([]byte("next key"))) {
+			t.Fatalf("the next router was told %+v", notice)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the next router wasn't told")
+	}
+
+	if err = new(ORServer).DestroyCircuit(shared.DestroyNotice{CircuitId: circuitId, Token: token}, &ack); err != unknownCircuitError {
+		t.Fatalf("tearing down a circuit twice gave %v, want %v", err, unknownCircuitError)
+	}
+}
+
+func TestDestroyAllCircuits(t *testing.T) {
+	keys := [][]byte{[]byte("key one"), []byte("key two")}
+	ids := []uint32{allocateCircuit(keys[0]), allocateCircuit(keys[1])}
+	if destroyed := destroyAllCircuits(); destroyed < len(ids) {
+		t.Fatalf("destroyed %d circuits, want at least %d", destroyed, len(ids))
+	}
+	for i, circuitId := range ids {
+		if _, err := circuitCipher(circuitId, cellRelayData, 0); err != unknownCircuitError {
+			t.Fatalf("circuit %d is still open: %v", circuitId, err)
+		}
+		if !bytes.Equal(keys[i], make([]byte, len(keys[i]))) {
+			t.Fatalf("the key of circuit %d wasn't wiped: %q", circuitId, keys[i])
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Introspection RPCs for the relay operator, served apart from ORServer
+type ORControl struct {
+	OnionRouter *OnionRouter
+	started     time.Time
+}
+
+// Exits unless addr is a loopback address. What is served there describes
+// this relay's traffic, so it must not be reachable from the network.
+func requireLoopback(addr string, what string) {
+	host, _, err := net.SplitHostPort(addr)
+	util.HandleFatalError("Invalid "+what+" address", err)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		util.ErrLog.Fatalf("[FATAL ERROR] %s address must be a loopback address, got %s\n", what, addr)
+	}
+}
+
+func startControlServer(controlAddr string, or *OnionRouter) {
+	requireLoopback(controlAddr, "Control")
+
+	server := rpc.NewServer()
+	util.HandleFatalError("Could not register ORControl", server.Register(&ORControl{OnionRouter: or, started: time.Now()}))
+
+	inbound, err := net.Listen("tcp", controlAddr)
+	util.HandleFatalError("Could not listen for control connections", err)
+
+	util.OutLog.Printf("Control RPC available on %s\n", controlAddr)
+	server.Accept(inbound)
+}
+
+// Returns the router's circuits with their cell counts and last activity
+func (c *ORControl) Status(_ignored bool, resp *shared.RouterStatusReport) error {
+	*resp = shared.RouterStatusReport{
+		Address:         c.OnionRouter.addr,
+		ProtocolVersion: shared.ProtocolVersion,
+		Started:         c.started,
+		Bandwidth:       bandwidthMeter.observed(),
+		Capabilities:    capabilities(),
+		Circuits:        circuitStats(),
+	}
+	return nil
+}
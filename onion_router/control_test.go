@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestControlStatus(t *testing.T) {
+	circuitId := allocateCircuit([]byte("key"))
+	defer destroyCircuit(circuitId)
+	circuitCipher(circuitId, cellPolling, 10)
+	circuitCipher(circuitId, cellPolling, 20)
+	circuitCipher(circuitId, cellRelayData, 5)
+	relayCircuitId(circuitId, shared.Onion{NextAddress: "127.0.0.1:8002", NextCircuitId: 9})
+
+	control := &ORControl{OnionRouter: &OnionRouter{addr: "127.0.0.1:8001"}}
+	var report shared.RouterStatusReport
+	if err := control.Status(true, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Address != "127.0.0.1:8001" || report.ProtocolVersion != shared.ProtocolVersion {
+		t.Fatalf("the report is %+v", report)
+	}
+	for _, stats := range report.Circuits {
+		if stats.CircuitId != circuitId {
+			continue
+		}
+		if stats.Cells != 3 || stats.CellsByType[cellPolling] != 2 || stats.Bytes != 35 || stats.NextAddress != "127.0.0.1:8002" || stats.NextCircuitId != 9 {
+			t.Fatalf("circuit %d has stats %+v", circuitId, stats)
+		}
+		return
+	}
+	t.Fatalf("circuit %d isn't in %+v", circuitId, report.Circuits)
+}
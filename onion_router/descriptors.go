@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	// Descriptor configurations
+	descriptorRepublishInterval time.Duration = 10 * time.Minute // so the directory's copy carries recent bandwidth
+)
+
+// This router's descriptor as it runs now, signed with its identity key
+func (or OnionRouter) signedDescriptor() (*shared.SignedDescriptor, error) {
+	descriptor := shared.Descriptor{
+		Address:         or.addr,
+		ProtocolVersion: shared.ProtocolVersion,
+		Platform:        shared.Platform(),
+		Published:       time.Now().UnixNano(),
+		Contact:         or.contact,
+		ExitPolicy:      exitPolicy.String(),
+		ExitStreams:     exitStreams,
+		Capabilities:    capabilities(),
+		Bandwidth:       bandwidthMeter.observed(),
+		Transports:      or.transports,
+		AltAddresses:    or.altAddrs,
+	}
+	data, err := shared.DescriptorSigningBytes(descriptor)
+	if err != nil {
+		return nil, shared.EncodingError("descriptor", err)
+	}
+	signature, err := util.RSASign(or.privKey, data)
+	if err != nil {
+		return nil, shared.InternalError("Could not sign descriptor", err)
+	}
+	return &shared.SignedDescriptor{Descriptor: descriptor, PubKey: or.pubKey, Signature: signature}, nil
+}
+
+// Publishes a fresh descriptor every descriptorRepublishInterval
+func (or OnionRouter) republishDescriptors() {
+	for {
+		time.Sleep(descriptorRepublishInterval)
+		if !accounting.awake() {
+			continue
+		}
+
+		descriptor, err := or.signedDescriptor()
+		if err != nil {
+			util.HandleNonFatalError("Could not make descriptor", err)
+			continue
+		}
+		var ignoredResp bool // there is no response for this RPC call
+		err = or.dirServer.Call("DServer.PublishDescriptor", *descriptor, &ignoredResp)
+		if missingMethod(err) {
+			// Directory servers from before descriptors never take them
+			return
+		}
+		util.HandleNonFatalError("Could not publish descriptor", err)
+	}
+}
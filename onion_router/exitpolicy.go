@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"../shared"
+)
+
+// Destinations this router connects to as an exit node; set by -exit-policy
+var exitPolicy, _ = shared.ParseExitPolicy(shared.DefaultExitPolicy)
+
+// Checks a destination against the exit policy and returns the ip:port to
+// dial. A host name is resolved first, so rules on addresses apply to it and
+// the address checked is the one dialed.
+func checkExitPolicy(addr string) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", malformed("destination %q is not host:port", addr)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return "", malformed("destination %q has an invalid port", addr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+		ip = ips[0]
+	}
+	if err := exitPolicy.Check(host, ip, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), portStr), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"../shared"
+)
+
+func TestCheckExitPolicy(t *testing.T) {
+	defer func(policy shared.ExitPolicy) { exitPolicy = policy }(exitPolicy)
+	var err error
+	if exitPolicy, err = shared.ParseExitPolicy("reject 10.0.0.0/8:*,accept *:6667,reject *:*"); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr, err := checkExitPolicy("1.2.3.4:6667"); err != nil || addr != "1.2.3.4:6667" {
+		t.Fatalf("an accepted destination gave %q, %v", addr, err)
+	}
+	for _, addr := range []string{"1.2.3.4:80", "10.0.0.1:6667", "1.2.3.4", "1.2.3.4:0"} {
+		if _, err := checkExitPolicy(addr); err == nil {
+			t.Fatalf("%q was accepted", addr)
+		}
+	}
+	// A name is checked by the address it resolves to, which is dialed
+	if addr, err := checkExitPolicy("localhost:6667"); err != nil || (addr != "127.0.0.1:6667" && addr != "[::1]:6667") {
+		t.Fatalf("localhost gave %q, %v", addr, err)
+	}
+	if err := checkIRCServerAddr("1.2.3.4:80"); err == nil {
+		t.Fatal("an IRC server the policy rejects was accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type BadFragmentError error
+type UnknownFragmentError error
+type TooManyFragmentedError error
+
+const (
+	fragmentTimeout       time.Duration = 30 * time.Second // partial messages and unfetched responses are dropped after this
+	fragmentSweepInterval time.Duration = 10 * time.Second
+	maxFragments          int           = 256 // caps a reassembled message at MaxFragmentData * 256 bytes
+	maxReassemblies       int           = 16  // messages a circuit may have partly sent at once
+)
+
+// Fragments of one message, per circuit so circuits can't touch each other's
+type fragmentKey struct {
+	circuitId uint32
+	id        uint32
+}
+
+// A command being put back together at the exit node
+type reassembly struct {
+	command  string
+	pieces   [][]byte
+	received int
+	started  time.Time
+}
+
+// Wipes the plaintext of the pieces received so far
+func (r *reassembly) wipe() {
+	secmem.WipeAll(r.pieces...)
+}
+
+// A response waiting for the OP to fetch its remaining fragments
+type fragmentedResponse struct {
+	fragments []shared.Fragment
+	fetched   int
+	created   time.Time
+}
+
+var (
+	// Fragment Errors
+	badFragmentError       BadFragmentError       = errors.New("Fragment does not fit the message it belongs to")
+	unknownFragmentError   UnknownFragmentError   = errors.New("No such fragmented response, it may have timed out")
+	tooManyFragmentedError TooManyFragmentedError = errors.New("Too many fragmented messages in progress on this circuit")
+
+	fragments = struct {
+		sync.Mutex
+		incoming   map[fragmentKey]*reassembly
+		outgoing   map[fragmentKey]*fragmentedResponse
+		inProgress map[uint32]int // reassemblies in incoming by circuit
+	}{
+		incoming:   make(map[fragmentKey]*reassembly),
+		outgoing:   make(map[fragmentKey]*fragmentedResponse),
+		inProgress: make(map[uint32]int),
+	}
+)
+
+// Stores one fragment of a command. Once the last one arrives the command is
+// delivered, and its error is what the OP's ack for that fragment reports.
+func (or OnionRouter) receiveFragment(circuitId uint32, fragmentByteArray []byte) error {
+	var fragment shared.Fragment
+	if err := decodePayload(fragmentByteArray, &fragment); err != nil {
+		return err
+	}
+	if fragment.Total < 1 || fragment.Total > maxFragments || fragment.Seq < 0 || fragment.Seq >= fragment.Total ||
+		len(fragment.Data) > shared.MaxFragmentData || fragment.Command == shared.CommandFragment {
+		return badFragmentError
+	}
+
+	key := fragmentKey{circuitId, fragment.Id}
+	fragments.Lock()
+	r, ok := fragments.incoming[key]
+	if !ok {
+		if fragments.inProgress[circuitId] >= maxReassemblies {
+			fragments.Unlock()
+			return tooManyFragmentedError
+		}
+		fragments.inProgress[circuitId]++
+		r = &reassembly{
+			command: fragment.Command,
+			pieces:  make([][]byte, fragment.Total),
+			started: time.Now(),
+		}
+		fragments.incoming[key] = r
+	}
+	if len(r.pieces) != fragment.Total || r.command != fragment.Command {
+		fragments.Unlock()
+		return badFragmentError
+	}
+	if r.pieces[fragment.Seq] == nil {
+		// An empty piece is kept non-nil, or it would count again
+		if fragment.Data == nil {
+			fragment.Data = []byte{}
+		}
+		r.pieces[fragment.Seq] = fragment.Data
+		r.received++
+	}
+	complete := r.received == len(r.pieces)
+	if complete {
+		dropReassembly(key)
+	}
+	fragments.Unlock()
+
+	if !complete {
+		return nil
+	}
+
+	// Sized up front so append leaves no partial copies behind to wipe
+	size := 0
+	for _, piece := range r.pieces {
+		size += len(piece)
+	}
+	data := make([]byte, 0, size)
+	for _, piece := range r.pieces {
+		data = append(data, piece...)
+	}
+	r.wipe()
+	defer secmem.Wipe(data)
+	return or.DeliverCommand(circuitId, r.command, data)
+}
+
+// Caller must hold the fragments lock.
+func dropReassembly(key fragmentKey) {
+	delete(fragments.incoming, key)
+	if fragments.inProgress[key.circuitId]--; fragments.inProgress[key.circuitId] <= 0 {
+		delete(fragments.inProgress, key.circuitId)
+	}
+}
+
+// Returns the response as is if it fits in a cell, or else keeps its
+// fragments for the OP to fetch and returns the first one
+func fragmentResponse(circuitId uint32, resp shared.PollingResponse) (shared.PollingResponse, error) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return resp, shared.EncodingError("polling response", err)
+	}
+	if len(data) <= shared.MaxFragmentData {
+		return resp, nil
+	}
+
+	id := util.Random.Uint32()
+	split := shared.SplitFragments(id, "", data)
+	fragments.Lock()
+	fragments.outgoing[fragmentKey{circuitId, id}] = &fragmentedResponse{
+		fragments: split,
+		fetched:   1,
+		created:   time.Now(),
+	}
+	fragments.Unlock()
+
+	return shared.PollingResponse{Fragment: &split[0]}, nil
+}
+
+// Answers CommandFetchFragment. The response is dropped once every fragment
+// has been fetched.
+func fetchFragment(circuitId uint32, requestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.FragmentRequest
+	if err := decodePayload(requestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	fragments.Lock()
+	defer fragments.Unlock()
+
+	key := fragmentKey{circuitId, req.Id}
+	stored, ok := fragments.outgoing[key]
+	if !ok {
+		return shared.PollingResponse{}, unknownFragmentError
+	}
+	if req.Seq < 0 || req.Seq >= len(stored.fragments) {
+		return shared.PollingResponse{}, badFragmentError
+	}
+
+	stored.fetched++
+	if stored.fetched >= len(stored.fragments) {
+		delete(fragments.outgoing, key)
+	}
+	return shared.PollingResponse{Fragment: &stored.fragments[req.Seq]}, nil
+}
+
+// Drops everything kept for a circuit that was torn down
+func dropCircuitFragments(circuitId uint32) {
+	fragments.Lock()
+	defer fragments.Unlock()
+
+	for key, r := range fragments.incoming {
+		if key.circuitId == circuitId {
+			r.wipe()
+			dropReassembly(key)
+		}
+	}
+	for key := range fragments.outgoing {
+		if key.circuitId == circuitId {
+			delete(fragments.outgoing, key)
+		}
+	}
+}
+
+// Drops partial messages and responses nobody came back for
+func sweepFragments() {
+	for {
+		time.Sleep(fragmentSweepInterval)
+		cutoff := time.Now().Add(-fragmentTimeout)
+
+		fragments.Lock()
+		for key, r := range fragments.incoming {
+			if r.started.Before(cutoff) {
+				util.OutLog.Printf("Dropping message on circuit %d, got %d of %d fragments\n", key.circuitId, r.received, len(r.pieces))
+				r.wipe()
+				dropReassembly(key)
+			}
+		}
+		for key, stored := range fragments.outgoing {
+			if stored.created.Before(cutoff) {
+				delete(fragments.outgoing, key)
+			}
+		}
+		fragments.Unlock()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"../shared"
+)
+
+func encodeFragment(t *testing.T, fragment shared.Fragment) []byte {
+	data, err := json.Marshal(fragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// A response too large for a cell is fragmented, fetched piece by piece and
+// dropped once every piece was fetched
+func TestFragmentResponse(t *testing.T) {
+	const circuitId = 101
+	resp := shared.PollingResponse{NextMessageId: 42}
+	for i := 0; i < 100; i++ {
+		resp.Messages = append(resp.Messages, string(bytes.Repeat([]byte{'a' + byte(i%26)}, 200)))
+	}
+
+	first, err := fragmentResponse(circuitId, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Fragment == nil || first.Fragment.Seq != 0 || first.Fragment.Total < 2 {
+		t.Fatalf("a large response wasn't fragmented: %+v", first.Fragment)
+	}
+
+	data := append([]byte(nil), first.Fragment.Data...)
+	for seq := 1; seq < first.Fragment.Total; seq++ {
+		next, err := fetchFragment(circuitId, encodeFragment(t, shared.Fragment{Id: first.Fragment.Id, Seq: seq}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, next.Fragment.Data...)
+	}
+	var reassembled shared.PollingResponse
+	if err := json.Unmarshal(data, &reassembled); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reassembled, resp) {
+		t.Fatal("the reassembled response differs")
+	}
+
+	if _, err := fetchFragment(circuitId, encodeFragment(t, shared.Fragment{Id: first.Fragment.Id, Seq: 1})); err != unknownFragmentError {
+		t.Fatalf("fetching a fragment again gave %v, want %v", err, unknownFragmentError)
+	}
+	if small, err := fragmentResponse(circuitId, shared.PollingResponse{NextMessageId: 1}); err != nil || small.Fragment != nil {
+		t.Fatal("a small response was fragmented")
+	}
+}
+
+func TestReceiveFragmentChecks(t *testing.T) {
+	const circuitId = 102
+	defer dropCircuitFragments(circuitId)
+
+	var or OnionRouter
+	for _, fragment := range []shared.Fragment{
+		{Id: 1, Seq: 0, Total: 0},
+		{Id: 1, Seq: 2, Total: 2},
+		{Id: 1, Seq: 0, Total: maxFragments + 1},
+		{Id: 1, Seq: 0, Total: 2, Command: shared.CommandFragment},
+		{Id: 1, Seq: 0, Total: 2, Data: make([]byte, shared.MaxFragmentData+1)},
+	} {
+		if err := or.receiveFragment(circuitId, encodeFragment(t, fragment)); err != badFragmentError {
+			t.Errorf("fragment %+v gave %v, want %v", fragment, err, badFragmentError)
+		}
+	}
+
+	// Later fragments must fit the message the first one started
+	if err := or.receiveFragment(circuitId, encodeFragment(t, shared.Fragment{Id: 2, Seq: 0, Total: 3, Command: shared.CommandChatMessage})); err != nil {
+		t.Fatal(err)
+	}
+	if err := or.receiveFragment(circuitId, encodeFragment(t, shared.Fragment{Id: 2, Seq: 1, Total: 4, Command: shared.CommandChatMessage})); err != badFragmentError {
+		t.Fatalf("a fragment of another size gave %v, want %v", err, badFragmentError)
+	}
+	if err := or.receiveFragment(circuitId, encodeFragment(t, shared.Fragment{Id: 2, Seq: 1, Total: 3, Command: shared.CommandPresence})); err != badFragmentError {
+		t.Fatalf("a fragment of another command gave %v, want %v", err, badFragmentError)
+	}
+}
+
+// A circuit may only have maxReassemblies messages partly sent, and other
+// circuits aren't held back by it
+func TestReassemblyCap(t *testing.T) {
+	const circuitId, otherCircuitId = 103, 104
+	defer dropCircuitFragments(otherCircuitId)
+
+	var or OnionRouter
+	piece := func(circuitId uint32, id uint32, seq int) error {
+		return or.receiveFragment(circuitId, encodeFragment(t, shared.Fragment{Id: id, Seq: seq, Total: 3, Command: shared.CommandChatMessage}))
+	}
+	start := func(circuitId uint32, id uint32) error { return piece(circuitId, id, 0) }
+	for id := uint32(0); id < uint32(maxReassemblies); id++ {
+		if err := start(circuitId, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := start(circuitId, uint32(maxReassemblies)); err != tooManyFragmentedError {
+		t.Fatalf("message %d gave %v, want %v", maxReassemblies+1, err, tooManyFragmentedError)
+	}
+	// More pieces of messages in progress are still taken
+	if err := piece(circuitId, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := start(otherCircuitId, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dropCircuitFragments(circuitId)
+	fragments.Lock()
+	inProgress := fragments.inProgress[circuitId]
+	fragments.Unlock()
+	if inProgress != 0 {
+		t.Fatalf("%d reassemblies left after the circuit was dropped", inProgress)
+	}
+	if err := start(circuitId, uint32(maxReassemblies)); err != nil {
+		t.Fatal(err)
+	}
+	dropCircuitFragments(circuitId)
+}
+
+// An empty fragment sent again counts once, so it can't stand in for the
+// pieces still missing
+func TestRepeatedEmptyFragment(t *testing.T) {
+	const circuitId = 105
+	defer dropCircuitFragments(circuitId)
+
+	var or OnionRouter
+	for i := 0; i < 2; i++ {
+		if err := or.receiveFragment(circuitId, encodeFragment(t, shared.Fragment{Id: 1, Seq: 0, Total: 2, Command: shared.CommandChatMessage})); err != nil {
+			t.Fatalf("the empty fragment gave %v the %d. time", err, i+1)
+		}
+	}
+	fragments.Lock()
+	reassembly := fragments.incoming[fragmentKey{circuitId, 1}]
+	fragments.Unlock()
+	if reassembly == nil || reassembly.received != 1 {
+		t.Fatalf("the message is reassembled as %+v", reassembly)
+	}
+}
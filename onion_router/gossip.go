@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const (
+	// Failure gossip configurations
+	gossipFailureThreshold int           = 3                // dials failed in a row before a next hop is reported
+	gossipReportInterval   time.Duration = 30 * time.Second // reports about one next hop are sent at most this often
+)
+
+// Dials to each next hop that failed in a row, and when each was last
+// reported, by address
+var hopFailures = struct {
+	sync.Mutex
+	inARow   map[string]int
+	reported map[string]time.Time
+}{inARow: make(map[string]int), reported: make(map[string]time.Time)}
+
+// Counts a failed dial to a next hop, and reports the hop to the directory
+// once gossipFailureThreshold dials failed in a row
+func (or OnionRouter) noteHopFailure(orAddress string) {
+	hopFailures.Lock()
+	hopFailures.inARow[orAddress]++
+	failures := hopFailures.inARow[orAddress]
+	report := failures >= gossipFailureThreshold && time.Since(hopFailures.reported[orAddress]) >= gossipReportInterval
+	if report {
+		hopFailures.reported[orAddress] = time.Now()
+	}
+	hopFailures.Unlock()
+
+	if report {
+		go or.gossipFailure(orAddress, failures)
+	}
+}
+
+// Forgets the failed dials to a next hop that answered again
+func noteHopSuccess(orAddress string) {
+	hopFailures.Lock()
+	delete(hopFailures.inARow, orAddress)
+	hopFailures.Unlock()
+}
+
+// Sends a signed report of a next hop this router failed to reach to the
+// directory server, or an anonymous one to directories from before failure
+// gossip
+func (or OnionRouter) gossipFailure(orAddress string, failures int) {
+	report := shared.RouterFailureReport{
+		Reporter: or.addr,
+		Report:   shared.FailureReport{Address: orAddress, Kind: shared.FailureUnreachable},
+		Failures: failures,
+		SignedAt: time.Now().UnixNano(),
+	}
+	signature, err := util.RSASign(or.privKey, shared.RouterFailureSigningBytes(report))
+	if err != nil {
+		util.HandleNonFatalError("Could not sign failure report", err)
+		return
+	}
+	report.Signature = signature
+
+	util.OutLog.Printf("Reporting %s to the directory server after %d failed dials\n", orAddress, failures)
+	var ignoredResp bool // there is no response for this RPC call
+	err = or.dirServer.Call("DServer.ReportRouterFailure", report, &ignoredResp)
+	if missingMethod(err) {
+		or.reportFailure(orAddress, shared.FailureUnreachable)
+		return
+	}
+	util.HandleNonFatalError("Could not report OR failure to directory server", err)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+// Stands in for the directory server, passing on the failure reports it gets
+type testGossipDirectory struct {
+	reports chan shared.RouterFailureReport
+}
+
+func (d *testGossipDirectory) ReportRouterFailure(report shared.RouterFailureReport, ack *bool) error {
+	d.reports <- report
+	*ack = true
+	return nil
+}
+
+func TestNoteHopFailure(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &testGossipDirectory{reports: make(chan shared.RouterFailureReport, 1)}
+	or := OnionRouter{addr: "127.0.0.1:8001", privKey: privKey, dirServer: testDirectoryClient(t, dir)}
+
+	// Failures only count in a row
+	const next = "127.0.0.1:8102"
+	or.noteHopFailure(next)
+	noteHopSuccess(next)
+	for i := 0; i < gossipFailureThreshold; i++ {
+		or.noteHopFailure(next)
+	}
+	select {
+	case report := <-dir.reports:
+		if report.Report.Address != next || report.Failures != gossipFailureThreshold {
+			t.Fatalf("reported %+v", report)
+		}
+		if err := util.RSAVerify(&privKey.PublicKey, shared.RouterFailureSigningBytes(report), report.Signature); err != nil {
+			t.Fatalf("the report doesn't verify: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the next hop wasn't reported")
+	}
+
+	// Further failures within the interval aren't reported again
+	or.noteHopFailure(next)
+	select {
+	case report := <-dir.reports:
+		t.Fatalf("reported %+v again", report)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"../util"
+)
+
+type StaleHeartbeatError error
+type NoConnectionSlotsError error
+
+const (
+	heartbeatStaleAfter time.Duration = 5 * time.Second // several missed heartbeats
+)
+
+var (
+	// Health Errors
+	staleHeartbeatError    StaleHeartbeatError    = errors.New("No heartbeat accepted by the directory server recently")
+	noConnectionSlotsError NoConnectionSlotsError = errors.New("Every connection slot is taken")
+
+	lastHeartbeat int64 // unix nanoseconds of the last heartbeat the directory server accepted
+)
+
+// The router is ready while the directory server lists it, a circuit through
+// it delivered and it can take more connections for circuits
+var healthChecks = []util.HealthCheck{
+	{Name: "directory", Check: func() error {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&lastHeartbeat))) > heartbeatStaleAfter {
+			return staleHeartbeatError
+		}
+		return nil
+	}},
+	{Name: "self-test", Check: checkSelfTest},
+	{Name: "circuits", Check: func() error {
+		if int(atomic.LoadInt32(&openConns)) >= maxConns {
+			return noConnectionSlotsError
+		}
+		return nil
+	}},
+}
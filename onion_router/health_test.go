@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testHealthCheck(t *testing.T, name string) func() error {
+	for _, check := range healthChecks {
+		if check.Name == name {
+			return check.Check
+		}
+	}
+	t.Fatalf("no %s health check", name)
+	return nil
+}
+
+func TestHealthChecks(t *testing.T) {
+	defer atomic.StoreInt64(&lastHeartbeat, 0)
+	directory, circuits := testHealthCheck(t, "directory"), testHealthCheck(t, "circuits")
+
+	atomic.StoreInt64(&lastHeartbeat, time.Now().Add(-time.Minute).UnixNano())
+	if err := directory(); err != staleHeartbeatError {
+		t.Fatalf("an old heartbeat gave %v, want %v", err, staleHeartbeatError)
+	}
+	atomic.StoreInt64(&lastHeartbeat, time.Now().UnixNano())
+	if err := directory(); err != nil {
+		t.Fatalf("a recent heartbeat gave %v", err)
+	}
+
+	defer func(conns int) { maxConns = conns }(maxConns)
+	maxConns = 0
+	if err := circuits(); err != noConnectionSlotsError {
+		t.Fatalf("a full listener gave %v, want %v", err, noConnectionSlotsError)
+	}
+	maxConns = int(atomic.LoadInt32(&openConns)) + 1000
+	if err := circuits(); err != nil {
+		t.Fatalf("a free slot gave %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"../util"
+)
+
+const (
+	defaultMaxConns        int           = 256
+	defaultMaxWorkers      int           = 64
+	defaultConnIdleTimeout time.Duration = 5 * time.Minute // longer than proxies keep a guard connection idle
+	defaultMaxLinkCells    int           = 128
+
+	minAcceptBackoff time.Duration = 5 * time.Millisecond
+	maxAcceptBackoff time.Duration = time.Second
+)
+
+var (
+	maxConns        = defaultMaxConns
+	maxWorkers      = defaultMaxWorkers
+	connIdleTimeout = defaultConnIdleTimeout
+	maxLinkCells    = defaultMaxLinkCells // set by -max-link-cells, 0 reads links without a limit
+
+	openConns int32 // connections being served by serveRPC
+
+	workerPool     chan struct{} // one token per request being handled, shared by every listener
+	workerPoolOnce sync.Once
+)
+
+// The worker pool, made once -workers is parsed
+func workers() chan struct{} {
+	workerPoolOnce.Do(func() { workerPool = make(chan struct{}, maxWorkers) })
+	return workerPool
+}
+
+// Called by a request handler holding a worker before it waits for the next
+// router, so routers relaying to each other under load can't take up each
+// other's workers and deadlock. The handler takes a worker back with
+// acquireWorker before it carries on.
+func releaseWorker() {
+	<-workers()
+}
+
+func acquireWorker() {
+	workers() <- struct{}{}
+}
+
+// Serves RPCs on inbound with at most maxConns connections open and, across
+// every listener, maxWorkers requests being handled at once, not counting
+// those waiting for the next router. Connections wait in the listen backlog
+// while all connection slots are taken, and requests wait unread on their
+// connection while all workers are busy or the connection has maxLinkCells
+// requests not answered yet.
+func serveRPC(server *rpc.Server, inbound net.Listener) {
+	connSlots := make(chan struct{}, maxConns)
+
+	backoff := minAcceptBackoff
+	for {
+		connSlots <- struct{}{}
+		conn, err := inbound.Accept()
+		if err != nil {
+			<-connSlots
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				util.HandleNonFatalError("Could not accept connection, retrying in "+backoff.String(), err)
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				continue
+			}
+			util.HandleFatalError("Could not accept connection", err)
+		}
+		backoff = minAcceptBackoff
+
+		atomic.AddInt32(&openConns, 1)
+		go func() {
+			defer func() {
+				atomic.AddInt32(&openConns, -1)
+				<-connSlots
+			}()
+			idle := &idleConn{Conn: conn, timeout: connIdleTimeout}
+			codec := &workerCodec{
+				ServerCodec: newGobServerCodec(idle),
+				conn:        idle,
+				workers:     workers(),
+			}
+			if maxLinkCells > 0 {
+				codec.linkCells = make(chan struct{}, maxLinkCells)
+			}
+			server.ServeCodec(codec)
+		}()
+	}
+}
+
+// A connection that is closed once it has been idle for timeout: no request
+// arrived and none is being handled
+type idleConn struct {
+	net.Conn
+	timeout  time.Duration
+	inFlight int32 // requests read but not answered yet
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 && atomic.LoadInt32(&c.inFlight) > 0 {
+			continue
+		}
+		return n, err
+	}
+}
+
+// Takes a worker for each request from when its header is read until its
+// response is written, but for while the handler waits for the next router.
+// net/rpc writes exactly one response per header read.
+// With linkCells set, also stops reading the connection while it has that
+// many requests in flight, so a link whose cells wait for room in their
+// circuit's queue pushes back on the router or proxy sending them.
+type workerCodec struct {
+	rpc.ServerCodec
+	conn      *idleConn
+	workers   chan struct{}
+	linkCells chan struct{} // nil reads without a limit
+}
+
+func (c *workerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if c.linkCells != nil {
+		c.linkCells <- struct{}{}
+	}
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		if c.linkCells != nil {
+			<-c.linkCells
+		}
+		return err
+	}
+	c.workers <- struct{}{}
+	atomic.AddInt32(&c.conn.inFlight, 1)
+	return nil
+}
+
+func (c *workerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer func() {
+		atomic.AddInt32(&c.conn.inFlight, -1)
+		<-c.workers
+		if c.linkCells != nil {
+			<-c.linkCells
+		}
+	}()
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// The codec rpc.ServeConn uses, which net/rpc doesn't export
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser) *gobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Couldn't encode the header, shut down the connection
+			c.Close()
+		}
+		return err
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Couldn't encode the body, shut down the connection
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// Answers with what it was sent, after release lets it if it was given one
+type testEcho struct {
+	release chan struct{}
+}
+
+func (e *testEcho) Echo(arg string, reply *string) error {
+	if e.release != nil {
+		<-e.release
+	}
+	*reply = arg
+	return nil
+}
+
+// Serves e with serveRPC on a loopback port. The listener is left open, as
+// serveRPC exits the process when it can't accept any more.
+func serveTestEcho(t *testing.T, e *testEcho) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	if err = server.RegisterName("Echo", e); err != nil {
+		t.Fatal(err)
+	}
+	go serveRPC(server, listener)
+	return listener.Addr().String()
+}
+
+func dialTestEcho(t *testing.T, addr string) *rpc.Client {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Whether a call finishes within wait
+func echoWithin(client *rpc.Client, wait time.Duration) (bool, error) {
+	var reply string
+	call := client.Go("Echo.Echo", "hi", &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return true, call.Error
+	case <-time.After(wait):
+		return false, nil
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	defer func(conns int) { maxConns = conns }(maxConns)
+	maxConns = 1
+	addr := serveTestEcho(t, &testEcho{})
+
+	first := dialTestEcho(t, addr)
+	if done, err := echoWithin(first, time.Second); !done || err != nil {
+		t.Fatalf("the first connection wasn't served: %v", err)
+	}
+	second := dialTestEcho(t, addr)
+	if done, _ := echoWithin(second, 200*time.Millisecond); done {
+		t.Fatal("a connection over the limit was served")
+	}
+	first.Close()
+	if done, err := echoWithin(second, time.Second); !done || err != nil {
+		t.Fatalf("the waiting connection wasn't served once a slot was free: %v", err)
+	}
+}
+
+func TestWorkerLimit(t *testing.T) {
+	defer func(workers int) { maxWorkers = workers }(maxWorkers)
+	maxWorkers = 1
+	echo := &testEcho{release: make(chan struct{})}
+	addr := serveTestEcho(t, echo)
+
+	busy := dialTestEcho(t, addr)
+	var reply string
+	blocked := busy.Go("Echo.Echo", "first", &reply, make(chan *rpc.Call, 1))
+	waiting := dialTestEcho(t, addr)
+	if done, _ := echoWithin(waiting, 200*time.Millisecond); done {
+		t.Fatal("a request was handled while every worker was busy")
+	}
+	close(echo.release)
+	<-blocked.Done
+	if done, err := echoWithin(waiting, time.Second); !done || err != nil {
+		t.Fatalf("the waiting request wasn't handled once a worker was free: %v", err)
+	}
+}
+
+func TestLinkCellLimit(t *testing.T) {
+	defer func(cells int) { maxLinkCells = cells }(maxLinkCells)
+	maxLinkCells = 1
+	echo := &testEcho{release: make(chan struct{})}
+	addr := serveTestEcho(t, echo)
+
+	// A second request on the link isn't read until the first is answered
+	client := dialTestEcho(t, addr)
+	var reply string
+	first := client.Go("Echo.Echo", "first", &reply, make(chan *rpc.Call, 1))
+	if done, _ := echoWithin(client, 200*time.Millisecond); done {
+		t.Fatal("a request over the link's limit was handled")
+	}
+	close(echo.release)
+	<-first.Done
+	if done, err := echoWithin(client, time.Second); !done || err != nil {
+		t.Fatalf("the link wasn't read again once its request was answered: %v", err)
+	}
+}
+
+func TestIdleConnectionsAreClosed(t *testing.T) {
+	defer func(timeout time.Duration) { connIdleTimeout = timeout }(connIdleTimeout)
+	connIdleTimeout = 100 * time.Millisecond
+	echo := &testEcho{release: make(chan struct{})}
+	addr := serveTestEcho(t, echo)
+
+	// A request still being handled keeps its connection open
+	client := dialTestEcho(t, addr)
+	var reply string
+	slow := client.Go("Echo.Echo", "slow", &reply, make(chan *rpc.Call, 1))
+	time.Sleep(300 * time.Millisecond)
+	close(echo.release)
+	if call := <-slow.Done; call.Error != nil || reply != "slow" {
+		t.Fatalf("a slow request gave %q, %v", reply, call.Error)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if done, err := echoWithin(client, time.Second); !done || err == nil {
+		t.Fatal("an idle connection was kept open")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"../util"
+)
+
+// Cell types counted in the relay metrics
+const (
+	cellCreate    = "create"     // SendCircuitInfo, CreateCircuit and NegotiateCircuit
+	cellRelayData = "relay_data" // CHAT relay cells and DecryptChatMessageCell
+	cellPolling   = "polling"    // POLL relay cells and DecryptPollingCell
+	cellExport    = "export"     // EXPORT relay cells and DecryptExportCell
+	cellStream    = "stream"     // BEGIN, DATA and END relay cells and DecryptStreamCell
+	cellPing      = "ping"       // PING relay cells
+	cellPadding   = "padding"    // PADDING relay cells and PaddingCell
+	cellDestroy   = "destroy"    // idle expiry, DESTROY relay cells and DestroyCircuit
+	cellError     = "error"      // any cell that could not be handled
+)
+
+var cellTypes = []string{cellCreate, cellRelayData, cellPolling, cellExport, cellStream, cellPing, cellPadding, cellDestroy, cellError}
+
+type CellStats struct {
+	sync.Mutex
+	cells map[string]uint64
+	bytes map[string]uint64
+}
+
+var cellStats = CellStats{
+	cells: make(map[string]uint64),
+	bytes: make(map[string]uint64),
+}
+
+func recordCell(cellType string, size int) {
+	cellStats.Lock()
+	defer cellStats.Unlock()
+
+	cellStats.cells[cellType]++
+	cellStats.bytes[cellType] += uint64(size)
+	if cellType != cellError {
+		bandwidthMeter.record(size)
+		accounting.record(size)
+	}
+}
+
+// Records a handled cell, or an error cell if handling it failed
+func recordCellResult(cellType string, size int, err error) {
+	if err != nil {
+		cellType = cellError
+	}
+	recordCell(cellType, size)
+}
+
+// Serves metrics in the Prometheus text format
+func startMetricsServer(metricsAddr string) {
+	requireLoopback(metricsAddr, "Metrics")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	util.OutLog.Printf("Metrics available at http://%s/metrics\n", metricsAddr)
+	util.HandleFatalError("Metrics server stopped", http.ListenAndServe(metricsAddr, mux))
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	cellStats.Lock()
+	defer cellStats.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP torchat_or_cells_total Cells handled by this relay, by cell type.")
+	fmt.Fprintln(w, "# TYPE torchat_or_cells_total counter")
+	for _, cellType := range cellTypes {
+		fmt.Fprintf(w, "torchat_or_cells_total{type=%q} %d\n", cellType, cellStats.cells[cellType])
+	}
+
+	fmt.Fprintln(w, "# HELP torchat_or_cell_bytes_total Cell payload bytes handled by this relay, by cell type.")
+	fmt.Fprintln(w, "# TYPE torchat_or_cell_bytes_total counter")
+	for _, cellType := range cellTypes {
+		fmt.Fprintf(w, "torchat_or_cell_bytes_total{type=%q} %d\n", cellType, cellStats.bytes[cellType])
+	}
+
+	queued, killed := scheduler.stats()
+	fmt.Fprintln(w, "# HELP torchat_or_scheduler_queued Relay cells waiting for a scheduler slot.")
+	fmt.Fprintln(w, "# TYPE torchat_or_scheduler_queued gauge")
+	fmt.Fprintf(w, "torchat_or_scheduler_queued %d\n", queued)
+	fmt.Fprintln(w, "# HELP torchat_or_circuit_queue_kills_total Circuits torn down for queueing too many cells.")
+	fmt.Fprintln(w, "# TYPE torchat_or_circuit_queue_kills_total counter")
+	fmt.Fprintf(w, "torchat_or_circuit_queue_kills_total %d\n", killed)
+
+	if report := accounting.report(); report != nil {
+		hibernating := 0
+		if report.Hibernating {
+			hibernating = 1
+		}
+		fmt.Fprintln(w, "# HELP torchat_or_accounting_used_bytes Bytes relayed in the current accounting period.")
+		fmt.Fprintln(w, "# TYPE torchat_or_accounting_used_bytes gauge")
+		fmt.Fprintf(w, "torchat_or_accounting_used_bytes %d\n", report.Used)
+		fmt.Fprintln(w, "# HELP torchat_or_accounting_max_bytes Bytes this relay relays per accounting period.")
+		fmt.Fprintln(w, "# TYPE torchat_or_accounting_max_bytes gauge")
+		fmt.Fprintf(w, "torchat_or_accounting_max_bytes %d\n", report.Max)
+		fmt.Fprintln(w, "# HELP torchat_or_hibernating Whether this relay left the directory until its next accounting period.")
+		fmt.Fprintln(w, "# TYPE torchat_or_hibernating gauge")
+		fmt.Fprintf(w, "torchat_or_hibernating %d\n", hibernating)
+	}
+}
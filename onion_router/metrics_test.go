@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func cellCount(cellType string) (uint64, uint64) {
+	cellStats.Lock()
+	defer cellStats.Unlock()
+	return cellStats.cells[cellType], cellStats.bytes[cellType]
+}
+
+func TestRecordCellResult(t *testing.T) {
+	cells, bytes := cellCount(cellRelayData)
+	errors0, _ := cellCount(cellError)
+	recordCellResult(cellRelayData, 100, nil)
+	recordCellResult(cellRelayData, 50, errors.New("bad cell"))
+
+	if c, b := cellCount(cellRelayData); c != cells+1 || b != bytes+100 {
+		t.Fatalf("relay_data counted %d cells and %d bytes, want %d and %d", c, b, cells+1, bytes+100)
+	}
+	if c, _ := cellCount(cellError); c != errors0+1 {
+		t.Fatal("a failed cell wasn't counted as an error")
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	recordCell(cellPolling, 7)
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := w.Body.String()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("served %q", w.Header().Get("Content-Type"))
+	}
+	for _, cellType := range cellTypes {
+		if !strings.Contains(body, `torchat_or_cells_total{type="`+cellType+`"}`) || !strings.Contains(body, `torchat_or_cell_bytes_total{type="`+cellType+`"}`) {
+			t.Fatalf("no %s counters in\n%s", cellType, body)
+		}
+	}
+	if !strings.Contains(body, "# TYPE torchat_or_cells_total counter") {
+		t.Fatalf("no TYPE line in\n%s", body)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/nat"
+)
+
+// Reachability self-test configurations
+const (
+	reachabilityWait         time.Duration = 30 * time.Second // longer than all of the directory's attempts
+	reachabilityPollInterval time.Duration = time.Duration(1000) / HeartbeatMultiplier * time.Millisecond
+)
+
+// Asks the home router to forward the OR port with method and returns the
+// address other nodes reach it on, or "" if the router would not
+func mapPort(method string, listenAddr *net.TCPAddr) string {
+	mapping, err := nat.Map(method, listenAddr.Port)
+	if err != nil {
+		util.HandleNonFatalError("Could not map OR port on home router", err)
+		return ""
+	}
+	util.OutLog.Printf("Home router forwards %s to this router (%s)\n", mapping.ExternalAddress, mapping.Method)
+	return mapping.ExternalAddress
+}
+
+// Waits for the directory server's reachability test of the registered
+// address, sending heartbeats meanwhile so the registration doesn't expire.
+// An old directory server that can't report the test counts as reachable.
+func (or OnionRouter) awaitReachability() (bool, error) {
+	deadline := util.Time.Now().Add(reachabilityWait)
+	for {
+		var reachability shared.Reachability
+		err := or.dirServer.Call("DServer.GetReachability", or.addr, &reachability)
+		if err != nil && missingMethod(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if reachability.Tested {
+			return reachability.Reachable, nil
+		}
+		if util.Time.Now().After(deadline) {
+			return false, nil
+		}
+		if err = or.sendHeartBeat(); err != nil {
+			util.HandleNonFatalError("Could not send heartbeat to directory server", err)
+		}
+		util.Time.Sleep(reachabilityPollInterval)
+	}
+}
+
+// Checks that other nodes reach the registered address. If they don't and
+// relayAddr is set, serves relayed connections on server and registers again
+// behind the NAT relay.
+func (or *OnionRouter) ensureReachable(relayAddr string, server *rpc.Server) {
+	reachable, err := or.awaitReachability()
+	if err != nil {
+		util.HandleNonFatalError("Could not run reachability self-test", err)
+		return
+	}
+	if reachable {
+		util.OutLog.Printf("Self-test: directory server reaches %s\n", or.addr)
+		return
+	}
+	if relayAddr == "" {
+		util.ErrLog.Printf("[WARNING] Self-test: directory server can't reach %s, so no circuit will use this router. Forward the port, try -nat, or use -nat-relay\n", or.addr)
+		return
+	}
+
+	util.OutLog.Printf("Self-test: directory server can't reach %s, relaying through %s\n", or.addr, relayAddr)
+	relayed, err := listenRelayed(relayAddr)
+	if err != nil {
+		util.HandleNonFatalError("Could not register with NAT relay", err)
+		return
+	}
+	go serveRPC(server, relayed)
+
+	or.addr = relayed.Addr().String()
+	if err = or.registerNode(); err != nil {
+		util.HandleNonFatalError("Could not register relayed address with directory server", err)
+		return
+	}
+	if reachable, err = or.awaitReachability(); err != nil {
+		util.HandleNonFatalError("Could not learn whether the relayed address is reachable", err)
+	} else if !reachable {
+		util.ErrLog.Printf("[WARNING] Self-test: directory server can't reach relayed address %s either\n", or.addr)
+	} else {
+		util.OutLog.Printf("Self-test: directory server reaches relayed address %s\n", or.addr)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../util"
+)
+
+type NATRelayError error
+
+// NAT relay configurations. A router behind NAT keeps a control connection
+// to a relay, which listens on a public port for it. For every connection
+// to that port the relay asks, over the control connection, for a fresh
+// connection from the router and splices the two.
+const (
+	defaultMaxRelayed   int           = 16
+	relayPendingTimeout time.Duration = 10 * time.Second
+	relayConnIdSize     int           = 16
+
+	relayRegister = "REGISTER" // REGISTER [port], answered with PORT ip:port or ERROR reason
+	relayPort     = "PORT"
+	relayConnect  = "CONNECT" // CONNECT id, from the relay over the control connection
+	relayAccept   = "ACCEPT"  // ACCEPT id, first line of the router's connection for id
+	relayError    = "ERROR"
+)
+
+var (
+	// NAT Relay Errors
+	relayFullError    NATRelayError = errors.New("NAT relay serves as many routers as it can")
+	relayClosedError  NATRelayError = errors.New("NAT relay listener closed")
+	relayUnknownError NATRelayError = errors.New("No pending relayed connection with this id")
+
+	maxRelayed = defaultMaxRelayed
+)
+
+// Relays public ports to routers behind NAT that register on controlAddr.
+// Ports are opened on the host of controlAddr.
+type natRelay struct {
+	sync.Mutex
+	host    string
+	relayed int
+	pending map[string]net.Conn // client connections waiting for the router's, by id
+}
+
+func serveNATRelay(controlAddr string) {
+	host, _, err := net.SplitHostPort(controlAddr)
+	util.HandleFatalError("Invalid NAT relay address", err)
+	inbound, err := net.Listen("tcp", controlAddr)
+	util.HandleFatalError("Could not listen for NAT relay", err)
+
+	relay := &natRelay{host: host, pending: make(map[string]net.Conn)}
+	util.OutLog.Printf("Relaying for onion routers behind NAT on %s\n", controlAddr)
+	for {
+		conn, err := inbound.Accept()
+		if err != nil {
+			util.HandleNonFatalError("Could not accept NAT relay connection", err)
+			continue
+		}
+		go relay.serve(conn)
+	}
+}
+
+func (r *natRelay) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(relayPendingTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 1 && fields[0] == relayRegister:
+		port := "0"
+		if len(fields) == 2 {
+			port = fields[1]
+		}
+		r.register(conn, reader, port)
+	case len(fields) == 2 && fields[0] == relayAccept:
+		r.accept(conn, reader, fields[1])
+	default:
+		conn.Close()
+	}
+}
+
+// Opens a public port for the router on control and relays it until the
+// control connection closes
+func (r *natRelay) register(control net.Conn, reader *bufio.Reader, port string) {
+	defer control.Close()
+
+	r.Lock()
+	if r.relayed >= maxRelayed {
+		r.Unlock()
+		fmt.Fprintf(control, "%s %s\n", relayError, relayFullError)
+		return
+	}
+	r.relayed++
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		r.relayed--
+		r.Unlock()
+	}()
+
+	public, err := net.Listen("tcp", net.JoinHostPort(r.host, port))
+	if err != nil {
+		fmt.Fprintf(control, "%s %s\n", relayError, err)
+		return
+	}
+	defer public.Close()
+
+	var controlMutex sync.Mutex
+	fmt.Fprintf(control, "%s %s\n", relayPort, public.Addr())
+	util.OutLog.Printf("Relaying %s to %s\n", public.Addr(), control.RemoteAddr())
+
+	// The router never writes on the control connection, so reading only
+	// notices it closing
+	go func() {
+		reader.WriteTo(discard{})
+		public.Close()
+	}()
+
+	for {
+		client, err := public.Accept()
+		if err != nil {
+			return
+		}
+		id, err := r.addPending(client)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		controlMutex.Lock()
+		_, err = fmt.Fprintf(control, "%s %s\n", relayConnect, id)
+		controlMutex.Unlock()
+		if err != nil {
+			r.takePending(id)
+			client.Close()
+			return
+		}
+	}
+}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (r *natRelay) addPending(client net.Conn) (string, error) {
+	idBytes := make([]byte, relayConnIdSize)
+	if _, err := util.Random.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	r.Lock()
+	r.pending[id] = client
+	r.Unlock()
+
+	time.AfterFunc(relayPendingTimeout, func() {
+		if client := r.takePending(id); client != nil {
+			client.Close()
+		}
+	})
+	return id, nil
+}
+
+func (r *natRelay) takePending(id string) net.Conn {
+	r.Lock()
+	defer r.Unlock()
+
+	client := r.pending[id]
+	delete(r.pending, id)
+	return client
+}
+
+// Splices the router's connection for id with the waiting client connection
+func (r *natRelay) accept(conn net.Conn, reader *bufio.Reader, id string) {
+	client := r.takePending(id)
+	if client == nil {
+		util.HandleNonFatalError("Could not relay connection", relayUnknownError)
+		conn.Close()
+		return
+	}
+
+	go func() {
+		reader.WriteTo(client)
+		client.Close()
+	}()
+	io.Copy(conn, client)
+	conn.Close()
+}
+
+// Connections relayed to this router, as a listener. Addr is the public
+// address the relay opened. If the control connection drops, the listener
+// registers again for the same public port.
+type relayListener struct {
+	sync.Mutex
+	relayAddr string
+	control   net.Conn
+	public    *net.TCPAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Registers with the relay at relayAddr and returns the listener for the
+// public port it opened
+func listenRelayed(relayAddr string) (*relayListener, error) {
+	l := &relayListener{
+		relayAddr: relayAddr,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	reader, err := l.register("0")
+	if err != nil {
+		return nil, err
+	}
+	go l.readControl(reader)
+	return l, nil
+}
+
+// Asks the relay for port ("0" for any) over a new control connection
+func (l *relayListener) register(port string) (*bufio.Reader, error) {
+	control, err := net.DialTimeout("tcp", l.relayAddr, relayPendingTimeout)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(control, "%s %s\n", relayRegister, port)
+
+	reader := bufio.NewReader(control)
+	control.SetReadDeadline(time.Now().Add(relayPendingTimeout))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	control.SetReadDeadline(time.Time{})
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != relayPort {
+		control.Close()
+		return nil, fmt.Errorf("NAT relay refused: %s", strings.TrimSpace(line))
+	}
+	public, err := net.ResolveTCPAddr("tcp", fields[1])
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.control = control
+	l.public = public
+	return reader, nil
+}
+
+func (l *relayListener) readControl(reader *bufio.Reader) {
+	backoff := minAcceptBackoff
+	for {
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == relayConnect {
+				go l.dialBack(fields[1])
+			}
+			continue
+		}
+
+		select {
+		case <-l.done:
+			return
+		default:
+		}
+		util.HandleNonFatalError("Lost NAT relay control connection, registering again", err)
+		for {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			if reader, err = l.register(strconv.Itoa(l.Addr().(*net.TCPAddr).Port)); err == nil {
+				break
+			}
+			util.HandleNonFatalError("Could not register with NAT relay", err)
+		}
+		backoff = minAcceptBackoff
+	}
+}
+
+func (l *relayListener) dialBack(id string) {
+	conn, err := net.DialTimeout("tcp", l.relayAddr, relayPendingTimeout)
+	if err != nil {
+		util.HandleNonFatalError("Could not dial NAT relay back", err)
+		return
+	}
+	if _, err = fmt.Fprintf(conn, "%s %s\n", relayAccept, id); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *relayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, relayClosedError
+	}
+}
+
+func (l *relayListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	l.Lock()
+	defer l.Unlock()
+	return l.control.Close()
+}
+
+func (l *relayListener) Addr() net.Addr {
+	l.Lock()
+	defer l.Unlock()
+	return l.public
+}
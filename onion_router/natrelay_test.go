@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs a NAT relay on a loopback port
+func serveTestNATRelay(t *testing.T) string {
+	inbound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { inbound.Close() })
+	relay := &natRelay{host: "127.0.0.1", pending: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := inbound.Accept()
+			if err != nil {
+				return
+			}
+			go relay.serve(conn)
+		}
+	}()
+	return inbound.Addr().String()
+}
+
+func TestNATRelay(t *testing.T) {
+	relayed, err := listenRelayed(serveTestNATRelay(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relayed.Close()
+	go func() {
+		conn, err := relayed.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	// A client of the public port reaches the router behind the relay
+	client, err := net.Dial("tcp", relayed.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = client.Write([]byte("through the relay\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(client).ReadString('\n'); err != nil || line != "through the relay\n" {
+		t.Fatalf("the router echoed %q, %v", line, err)
+	}
+}
+
+func TestNATRelayLimits(t *testing.T) {
+	defer func(relayed int) { maxRelayed = relayed }(maxRelayed)
+	maxRelayed = 0
+	relayAddr := serveTestNATRelay(t)
+	if _, err := listenRelayed(relayAddr); err == nil || !strings.Contains(err.Error(), relayFullError.Error()) {
+		t.Fatalf("registering with a full relay gave %v", err)
+	}
+
+	// A connection for an id the relay never handed out is closed
+	conn, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(relayAccept + " 00\n"))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("an unknown id gave %v, want the connection closed", err)
+	}
+}
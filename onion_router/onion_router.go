@@ -1,67 +1,166 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
 	"encoding/gob"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"net"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rsa"
-	"encoding/json"
 
 	"../shared"
 	"../util"
+	"../util/faults"
+	"../util/padding"
+	"../util/retry"
+	"../util/secmem"
 )
 
 const HeartbeatMultiplier = 2
 const RSAKeySize = 2048
 
 type OnionRouter struct {
-	addr      string
-	dirServer *rpc.Client
-	pubKey    *rsa.PublicKey
-	privKey   *rsa.PrivateKey
+	addr       string
+	altAddrs   []string // tcp addresses in the other family, for dual-stack routers
+	dirServer  *retry.Client
+	pubKey     *rsa.PublicKey
+	privKey    *rsa.PrivateKey
+	transports transportAddrs
+
+	enrollmentToken string // presented to directories that only list enrolled ORs
+	contact         string // operator contact published in the descriptor
 }
 
 type OnionRouterInfo struct {
-	Address string
-	PubKey  *rsa.PublicKey
+	Address         string
+	PubKey          *rsa.PublicKey
+	ProtocolVersion int
+	Transports      map[string]string
+	AltAddresses    []string
+	ExitPolicy      string
+	ExitStreams     bool
+	Capabilities    shared.Capabilities
+	Contact         string
+	EnrollmentToken string
+	Descriptor      *shared.SignedDescriptor
 }
 
-var sharedKeysByCircuitId = make(map[uint32][]byte)
-
 // Start the onion router.
-// go run onion_router.go localhost:12345 127.0.0.1:8000
+// go run *.go localhost:12345 127.0.0.1:8000
+// go run *.go -metrics-addr 127.0.0.1:9100 localhost:12345 127.0.0.1:8000
+// go run *.go -control-addr 127.0.0.1:9101 localhost:12345 127.0.0.1:8000
 func main() {
 	gob.Register(&net.TCPAddr{})
 	gob.Register(&elliptic.CurveParams{})
 
 	// Command line input parsing
+	metricsAddr := flag.String("metrics-addr", "", "loopback ip:port to serve /metrics on (disabled if empty)")
+	healthAddr := util.HealthFlag()
+	faultSpec := faults.Flag()
+	controlAddr := flag.String("control-addr", "", "loopback ip:port to serve the ORControl introspection RPC on (disabled if empty)")
+	flag.DurationVar(&circuitIdleTimeout, "circuit-idle-timeout", defaultCircuitIdleTimeout, "tear down circuits that carried no cells for this long")
+	flag.BoolVar(&propagateExpiry, "propagate-expiry", true, "tell the next router when a circuit expires here")
+	flag.IntVar(&maxConns, "max-conns", defaultMaxConns, "most connections open at once, more wait to be accepted")
+	flag.IntVar(&maxWorkers, "workers", defaultMaxWorkers, "most requests handled at once, more wait unread")
+	flag.IntVar(&schedulerSlots, "scheduler-slots", defaultSchedulerSlots, "most relay cells handled at once, more wait in per-circuit queues with quiet circuits first (0 handles them in arrival order)")
+	flag.DurationVar(&circuitEWMAHalfLife, "circuit-ewma-halflife", defaultCircuitEWMAHalfLife, "how fast a circuit's cell count decays for scheduling")
+	flag.IntVar(&maxCircuitQueue, "max-circuit-queue", defaultMaxCircuitQueue, "most cells of one circuit waiting for a scheduler slot (0 for no limit)")
+	flag.StringVar(&circuitQueuePolicy, "circuit-queue-policy", queueBackpressure, "what a cell for a circuit with a full queue does: backpressure waits for room, kill tears the circuit down")
+	flag.IntVar(&maxLinkCells, "max-link-cells", defaultMaxLinkCells, "most cells read from one connection and not answered yet, more wait unread (0 for no limit)")
+	flag.DurationVar(&connIdleTimeout, "conn-idle-timeout", defaultConnIdleTimeout, "close connections that sent no request for this long")
+	transports := make(transportAddrs)
+	flag.Var(transports, "transport", "also accept links over a transport, as name=ip:port (repeatable)")
+	publishTransports := flag.Bool("publish-transports", true, "list the transport addresses in the directory; if false, share them out of band")
+	flag.BoolVar(&exitStreams, "exit-streams", false, "as an exit node, open TCP streams to any destination proxies ask for")
+	exitPolicySpec := flag.String("exit-policy", shared.DefaultExitPolicy, "destinations to exit to, as comma separated accept|reject host:port rules, first match wins")
+	flag.IntVar(&maxStreamsPerCircuit, "max-streams", defaultMaxStreamsPerCircuit, "most streams open at once on one circuit")
+	altAddr := flag.String("alt-addr", "", "[ipv6]:port or ip:port in the other address family to also accept connections on, for dual-stack routers")
+	publicAddr := flag.String("public-addr", "", "ip:port other nodes reach this router on, if not the listen address (e.g. a forwarded port)")
+	natMethod := flag.String("nat", "", "ask the home router to forward the OR port: auto, natpmp or upnp (disabled if empty)")
+	natRelayAddr := flag.String("nat-relay", "", "ip:port of a NAT relay to accept connections through if the self-test fails (disabled if empty)")
+	serveRelayAddr := flag.String("serve-nat-relay", "", "ip:port to relay connections to routers behind NAT on (disabled if empty)")
+	enrollmentToken := flag.String("enrollment-token", os.Getenv("TORCHAT_ENROLLMENT_TOKEN"), "token from the directory operator, where the directory only lists enrolled ORs (env TORCHAT_ENROLLMENT_TOKEN)")
+	contact := flag.String("contact", "", "how to reach this router's operator, published in its descriptor")
+	flag.Var(&accountingMax, "accounting-max", "bytes to relay per accounting period before hibernating, e.g. 500GB (0 relays without a cap)")
+	flag.StringVar(&accountingPeriod, "accounting-period", accountingPeriod, "accounting period the cap is for: month, week or day, starting at 00:00 UTC")
+	flag.DurationVar(&batchDelay, "batch-delay", 0, "hold cells up to this long to forward them in batches of random order (0 forwards them at once)")
+	flag.IntVar(&batchSize, "batch-size", defaultBatchSize, "forward a batch as soon as this many cells wait")
+	flag.DurationVar(&batchJitter, "batch-jitter", 0, "delay each cell of a batch by a random time up to this long")
+	paddingClass := flag.String("padding", "none", "padding machine to run on the links to other routers")
+	paddingMachinesPath := flag.String("padding-machines", "", "JSON file of padding machines to add to the builtin ones")
+	seed := util.DeterministicFlag()
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
 	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+	faults.Setup(*faultSpec)
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentOnionRouter, *showFeatures))
+		return
+	}
 	if len(flag.Args()) != 2 {
-		fmt.Fprintln(os.Stderr, "Usage: go run onion_router.go [dir-server ip:port] [or ip:port]")
+		fmt.Fprintln(os.Stderr, "Usage: go run *.go [-metrics-addr ip:port] [-control-addr ip:port] [-health-addr ip:port] [-faults spec] [-deterministic-seed n] [-transport name=ip:port] [-publish-transports=true] [-public-addr ip:port] [-alt-addr [ipv6]:port] [-nat auto] [-nat-relay ip:port] [-serve-nat-relay ip:port] [-exit-streams] [-exit-policy rules] [-enrollment-token secret] [-contact info] [-accounting-max 500GB] [-accounting-period month] [-padding burst] [-padding-machines path] [-batch-delay 50ms] [-batch-size 8] [-batch-jitter 5ms] [-max-streams 16] [-circuit-idle-timeout 10m] [-propagate-expiry=true] [-max-conns 256] [-workers 64] [-scheduler-slots 16] [-circuit-ewma-halflife 30s] [-max-circuit-queue 64] [-circuit-queue-policy backpressure] [-max-link-cells 128] [-conn-idle-timeout 5m] [dir-server ip:port] [or ip:port]")
 		os.Exit(1)
 	}
 
+	if *metricsAddr != "" {
+		go startMetricsServer(*metricsAddr)
+	}
+	if *healthAddr != "" {
+		go util.ServeHealth(*healthAddr, healthChecks)
+	}
+	if *serveRelayAddr != "" {
+		go serveNATRelay(*serveRelayAddr)
+	}
+
+	if circuitEWMAHalfLife <= 0 {
+		util.ErrLog.Fatalf("[FATAL ERROR] -circuit-ewma-halflife must be positive, got %v\n", circuitEWMAHalfLife)
+	}
+	util.HandleFatalError("Invalid -circuit-queue-policy", checkCircuitQueuePolicy(circuitQueuePolicy))
+	if batchSize < 1 {
+		util.ErrLog.Fatalf("[FATAL ERROR] -batch-size must be at least 1, got %d\n", batchSize)
+	}
+
+	machines, err := padding.Load(*paddingMachinesPath)
+	util.HandleFatalError("Could not load padding machines", err)
+	machine, ok := machines[*paddingClass]
+	if !ok {
+		util.HandleFatalError("Invalid -padding", fmt.Errorf("no padding machine %q, known: %s", *paddingClass, strings.Join(padding.Names(machines), ", ")))
+	}
+	linkPaddingMachine = machine
+
+	if _, _, err := accountingBounds(accountingPeriod, time.Now()); err != nil {
+		util.HandleFatalError("Invalid -accounting-period", err)
+	}
+
+	policy, err := shared.ParseExitPolicy(*exitPolicySpec)
+	util.HandleFatalError("Invalid exit policy", err)
+	exitPolicy = policy
+
 	dirServerAddr := flag.Arg(0)
 	orAddr := flag.Arg(1)
+	util.SetupDeterministic(*seed, orAddr)
 
 	// Generate RSA PublicKey and PrivateKey
-	priv, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	priv, err := rsa.GenerateKey(util.Random, RSAKeySize)
 	util.HandleFatalError("Could not generate RSA key", err)
 	pub := &priv.PublicKey
 
 	// Establish RPC channel to server
-	dirServer, err := rpc.Dial("tcp", dirServerAddr)
+	dirServer, err := retry.Dial(context.Background(), retry.Startup, "tcp", dirServerAddr)
 	util.HandleFatalError("Could not dial directory server", err)
 
 	addr, err := net.ResolveTCPAddr("tcp", orAddr)
@@ -72,6 +171,9 @@ func main() {
 
 	util.OutLog.Println("OR Address: ", orAddr)
 	util.OutLog.Println("Full Address: ", inbound.Addr().String())
+	util.OutLog.Println("Fingerprint: ", util.Fingerprint(pub))
+	util.OutLog.Println("Protocol version: ", shared.ProtocolVersion)
+	util.OutLog.Println("Exit policy: ", exitPolicy)
 
 	// Create OnionRouter instance
 	onionRouter := &OnionRouter{
@@ -79,27 +181,112 @@ func main() {
 		dirServer: dirServer,
 		pubKey:    pub,
 		privKey:   priv,
+
+		enrollmentToken: *enrollmentToken,
+		contact:         *contact,
 	}
 
-	if err = onionRouter.registerNode(); err != nil {
-		util.HandleFatalError("Could not register onion router with directory server", err)
+	if *publicAddr != "" {
+		onionRouter.addr = *publicAddr
+	}
+	if *natMethod != "" {
+		if external := mapPort(*natMethod, addr); external != "" {
+			onionRouter.addr = external
+		}
+	}
+	onionRouter.addr, err = shared.CanonicalAddress(onionRouter.addr)
+	util.HandleFatalError("Invalid onion-router address", err)
+
+	var altInbound net.Listener
+	if *altAddr != "" {
+		alt, err := shared.CanonicalAddress(*altAddr)
+		util.HandleFatalError("Invalid -alt-addr", err)
+		altInbound, err = listenAlt(addr, alt)
+		util.HandleFatalError("Could not listen on -alt-addr", err)
+		onionRouter.altAddrs = []string{alt}
 	}
 
-	go onionRouter.startSendingHeartbeatsToServer()
+	transportListeners, advertised := listenTransports(transports)
+	if *publishTransports {
+		onionRouter.transports = advertised
+	}
 
-	// Start listening for RPC calls from other onion routers
+	// Start listening for RPC calls from other onion routers, before
+	// registering so the directory server's reachability test is answered
 	orServer := new(ORServer)
 	orServer.OnionRouter = onionRouter
 
 	onionRouterServer := rpc.NewServer()
-	onionRouterServer.Register(orServer)
+	util.HandleFatalError("Could not register ORServer", onionRouterServer.Register(orServer))
 
 	util.OutLog.Printf("ORServer started. Receiving on %s\n", orAddr)
+	serveTransports(onionRouterServer, transportListeners)
+	go serveRPC(onionRouterServer, faults.Listen(inbound))
+	if altInbound != nil {
+		util.OutLog.Printf("ORServer also receiving on %s\n", altInbound.Addr())
+		go serveRPC(onionRouterServer, faults.Listen(altInbound))
+	}
 
-	for {
-		conn, _ := inbound.Accept()
-		go onionRouterServer.ServeConn(conn)
+	err = onionRouter.registerNode()
+	if shared.IsEnrollmentPendingError(err) || shared.IsAddressInUseError(err) {
+		if shared.IsAddressInUseError(err) {
+			util.OutLog.Println("Waiting for the directory server to time out this address's previous key")
+		} else {
+			util.OutLog.Println("Waiting for the directory operator to approve this onion router")
+		}
+		err = retry.Do(context.Background(), retry.Background, func() error {
+			err := onionRouter.registerNode()
+			if err != nil && !shared.IsEnrollmentPendingError(err) && !shared.IsAddressInUseError(err) {
+				return retry.Permanent(err)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		util.HandleFatalError("Could not register onion router with directory server", err)
+	}
+	onionRouter.ensureReachable(*natRelayAddr, onionRouterServer)
+	go onionRouter.runSelfTest()
+
+	go measureBandwidth()
+	if accountingMax > 0 {
+		go onionRouter.runAccounting()
+	}
+	go onionRouter.startSendingHeartbeatsToServer()
+	go onionRouter.republishDescriptors()
+	if *controlAddr != "" {
+		go startControlServer(*controlAddr, onionRouter)
 	}
+	go sweepFragments()
+	go expireIdleCircuits()
+
+	onionRouter.wipeKeysOnExit()
+}
+
+// Waits for SIGINT or SIGTERM, then wipes the circuit keys and this router's
+// private key before exiting
+func (or OnionRouter) wipeKeysOnExit() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	destroyed := destroyAllCircuits()
+	secmem.WipeRSAKey(or.privKey)
+	util.OutLog.Printf("Wiped keys of %d circuits, exiting on %v\n", destroyed, sig)
+	os.Exit(0)
+}
+
+// Listens on a dual-stack router's alternate address, unless the OR address
+// is a wildcard whose socket already accepts it (nil listener then)
+func listenAlt(listenAddr *net.TCPAddr, alt string) (net.Listener, error) {
+	altAddr, err := net.ResolveTCPAddr("tcp", alt)
+	if err != nil {
+		return nil, err
+	}
+	if listenAddr.IP.IsUnspecified() && altAddr.Port == listenAddr.Port {
+		return nil, nil
+	}
+	return net.ListenTCP("tcp", altAddr)
 }
 
 // Registers the onion router on the directory server by making an RPC call.
@@ -108,9 +295,22 @@ func (or OnionRouter) registerNode() error {
 		return err
 	}
 
+	descriptor, err := or.signedDescriptor()
+	if err != nil {
+		return err
+	}
 	req := OnionRouterInfo{
-		Address: or.addr,
-		PubKey:  or.pubKey,
+		Address:         or.addr,
+		PubKey:          or.pubKey,
+		ProtocolVersion: shared.ProtocolVersion,
+		Transports:      or.transports,
+		AltAddresses:    or.altAddrs,
+		ExitPolicy:      exitPolicy.String(),
+		ExitStreams:     exitStreams,
+		Capabilities:    capabilities(),
+		Contact:         or.contact,
+		EnrollmentToken: or.enrollmentToken,
+		Descriptor:      descriptor,
 	}
 
 	var resp bool // there is no response for this RPC call
@@ -124,16 +324,47 @@ func (or OnionRouter) registerNode() error {
 // Periodically send heartbeats to the server at period defined by server times a frequency multiplier
 func (or OnionRouter) startSendingHeartbeatsToServer() {
 	for {
-		or.sendHeartBeat()
+		// Hibernating routers stay out of the directory
+		if accounting.awake() {
+			if err := or.sendHeartBeat(); err != nil {
+				util.HandleNonFatalError("Could not send heartbeat to directory server", err)
+			} else {
+				atomic.StoreInt64(&lastHeartbeat, time.Now().UnixNano())
+			}
+		}
 		time.Sleep(time.Duration(1000) / HeartbeatMultiplier * time.Millisecond)
 	}
 }
 
-// Send a single heartbeat to the server
-func (or OnionRouter) sendHeartBeat() {
+// Send a single heartbeat, signed with this router's identity key, to the
+// server. If the directory server no longer knows this node (it restarted or
+// expired us), register again.
+func (or OnionRouter) sendHeartBeat() error {
+	heartbeat := shared.Heartbeat{
+		Address:   or.addr,
+		Bandwidth: bandwidthMeter.observed(),
+		SelfTest:  selfTestResult(),
+		SignedAt:  time.Now().UnixNano(),
+
+		Accounting: accounting.report(),
+	}
+	signature, err := util.RSASign(or.privKey, shared.HeartbeatSigningBytes(heartbeat))
+	if err != nil {
+		return shared.InternalError("Could not sign heartbeat", err)
+	}
+	heartbeat.Signature = signature
+
 	var ignoredResp bool // there is no response for this RPC call
-	err := or.dirServer.Call("DServer.KeepNodeOnline", or.addr, &ignoredResp)
-	util.HandleFatalError("Could not send heartbeat to directory server", err)
+	err = or.dirServer.Call("DServer.SendHeartbeat", heartbeat, &ignoredResp)
+	if err != nil && missingMethod(err) {
+		// Directory servers from before bandwidth reports only take the address
+		err = or.dirServer.Call("DServer.KeepNodeOnline", or.addr, &ignoredResp)
+	}
+	if _, rejected := err.(rpc.ServerError); rejected {
+		util.OutLog.Println("Directory server rejected heartbeat, registering again")
+		return retry.Do(context.Background(), retry.Background, or.registerNode)
+	}
+	return err
 }
 
 func (or OnionRouter) markNodeOffline(pubKey *ecdsa.PublicKey) {
@@ -142,104 +373,358 @@ func (or OnionRouter) markNodeOffline(pubKey *ecdsa.PublicKey) {
 	util.HandleNonFatalError("Could not mark node offline", err)
 }
 
-func (or OnionRouter) registerUser(userName string) {
-	var ignoredResp bool // there is no response for this RPC call
-	err := or.dirServer.Call("IRCServer.RegisterUserName", userName, &ignoredResp)
-	util.HandleNonFatalError("Could not register user with IRC", err)
-}
+// Tells the directory server that an OR failed so it is picked less often
+func (or OnionRouter) reportFailure(orAddress string, kind string) {
+	report := shared.FailureReport{
+		Address: orAddress,
+		Kind:    kind,
+	}
 
-func (or OnionRouter) publishMessage(userName string, msg string) {
 	var ignoredResp bool // there is no response for this RPC call
-	err := or.dirServer.Call("IRCServer.PublishMessage", userName+msg, &ignoredResp)
-	util.HandleNonFatalError("Could not publish message to IRC", err)
+	err := or.dirServer.Call("DServer.ReportFailure", report, &ignoredResp)
+	util.HandleNonFatalError("Could not report OR failure to directory server", err)
 }
 
 type ORServer struct {
 	OnionRouter *OnionRouter
 }
 
-func (or OnionRouter) DeliverChatMessage(chatMessageByteArray []byte) error {
-	var chatMessage shared.ChatMessage
-	if err := json.Unmarshal(chatMessageByteArray, &chatMessage); err != nil {
+// Passes the core data of an exit node's onion layer to the IRC server RPC for its command
+func (or OnionRouter) DeliverCommand(circuitId uint32, command string, data []byte) error {
+	switch command {
+	case shared.CommandFragment:
+		return or.receiveFragment(circuitId, data)
+	case shared.CommandRegisterUserName:
+		return or.DeliverUserNameRequest("CServer.RegisterUserName", data)
+	case shared.CommandChangeUserName:
+		return or.DeliverUserNameRequest("CServer.ChangeUserName", data)
+	case shared.CommandPresence:
+		return or.DeliverPresence(data)
+	case shared.CommandEditMessage:
+		return or.DeliverMessageEdit("CServer.EditMessage", data)
+	case shared.CommandDeleteMessage:
+		return or.DeliverMessageEdit("CServer.DeleteMessage", data)
+	case shared.CommandMarkRead:
+		return or.DeliverReadMarker(data)
+	case shared.CommandForgetUser:
+		return or.DeliverForgetRequest(data)
+	case shared.CommandUploadPrekeys:
+		return or.DeliverPrekeyUpload(data)
+	case shared.CommandPutRoster:
+		return or.DeliverRosterPut(data)
+	case shared.CommandContactRequest:
+		return or.DeliverContactRequest(data)
+	case shared.CommandBlockUser:
+		return or.DeliverBlockRequest(data)
+	case shared.CommandChatMessage:
+		return or.DeliverChatMessage(data)
+	default:
+		// decryptCell lets only known commands through, but reassembled
+		// fragments name theirs in the fragments
+		return malformed("unknown command %q", command)
+	}
+}
+
+func (or OnionRouter) DeliverUserNameRequest(method string, userNameRequestByteArray []byte) error {
+	var req shared.UserNameRequest
+	if err := decodePayload(userNameRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
 		return err
 	}
 
-	ircServer, err := rpc.Dial("tcp", chatMessage.IRCServerAddr)
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
 	if err != nil {
 		return err
 	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call(method, req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver username request to IRC server", err)
+		return err
+	}
 
-	message := chatMessage.Username + ": " + chatMessage.Message
+	util.OutLog.Printf("Deliver %s to IRC server: [%s] %s\n", method, req.Namespace, req.Username)
+
+	return nil
+}
+
+func (or OnionRouter) DeliverMessageEdit(method string, messageEditRequestByteArray []byte) error {
+	var req shared.MessageEditRequest
+	if err := decodePayload(messageEditRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
 
 	var ack bool
-	if err = ircServer.Call("CServer.PublishMessage", message, &ack); err != nil {
-		util.HandleNonFatalError("Could not publish message to IRC server", err)
+	if err = ircServer.Call(method, req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver message edit to IRC server", err)
 		return err
 	}
-	ircServer.Close()
 
-	util.OutLog.Printf("Deliver chat message to IRC server: %s\n", message)
+	util.OutLog.Printf("Deliver %s to IRC server: [%s] message %d\n", method, req.Namespace, req.MessageId)
+
+	return nil
+}
+
+func (or OnionRouter) DeliverReadMarker(readMarkerRequestByteArray []byte) error {
+	var req shared.ReadMarkerRequest
+	if err := decodePayload(readMarkerRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.MarkRead", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver read marker to IRC server", err)
+		return err
+	}
+
+	return nil
+}
+
+func (or OnionRouter) DeliverForgetRequest(forgetRequestByteArray []byte) error {
+	var req shared.ForgetRequest
+	if err := decodePayload(forgetRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.ForgetUser", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver forget request to IRC server", err)
+		return err
+	}
+
+	util.OutLog.Printf("Deliver forget request to IRC server: [%s] %s\n", req.Namespace, req.Username)
+	return nil
+}
+
+func (or OnionRouter) DeliverPrekeyUpload(prekeyUploadByteArray []byte) error {
+	var req shared.PrekeyUpload
+	if err := decodePayload(prekeyUploadByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.UploadPrekeys", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver prekeys to IRC server", err)
+		return err
+	}
+
+	util.OutLog.Printf("Deliver prekeys to IRC server: [%s] %s\n", req.Namespace, req.Username)
+	return nil
+}
+
+func (or OnionRouter) DeliverRosterPut(rosterRequestByteArray []byte) error {
+	var req shared.RosterRequest
+	if err := decodePayload(rosterRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.PutRoster", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver roster to IRC server", err)
+		return err
+	}
+
+	util.OutLog.Printf("Deliver roster to IRC server: [%s] %s\n", req.Namespace, req.Username)
+	return nil
+}
+
+func (or OnionRouter) DeliverContactRequest(contactRequestByteArray []byte) error {
+	var req shared.ContactRequest
+	if err := decodePayload(contactRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.ChangeContact", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver contact request to IRC server", err)
+		return err
+	}
+
+	util.OutLog.Printf("Deliver contact request to IRC server: [%s] %s\n", req.Namespace, req.Username)
+	return nil
+}
+
+func (or OnionRouter) DeliverBlockRequest(blockRequestByteArray []byte) error {
+	var req shared.BlockRequest
+	if err := decodePayload(blockRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.BlockUser", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver block request to IRC server", err)
+		return err
+	}
+
+	util.OutLog.Printf("Deliver block request to IRC server: [%s] %s\n", req.Namespace, req.Username)
+	return nil
+}
+
+func (or OnionRouter) DeliverPresence(presenceRequestByteArray []byte) error {
+	var req shared.PresenceRequest
+	if err := decodePayload(presenceRequestByteArray, &req); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return err
+	}
+	defer ircServer.Close()
+
+	var ack bool
+	if err = ircServer.Call("CServer.PublishPresence", req, &ack); err != nil {
+		util.HandleNonFatalError("Could not deliver presence event to IRC server", err)
+		return err
+	}
 
 	return nil
 }
 
-func (or OnionRouter) RelayChatMessageOnion(nextORAddress string, nextOnion []byte, circuitId uint32) error {
-	util.OutLog.Printf("\nRelay chat message:\n    Circuit ID: %v\n    Next OR: %s\n", circuitId, nextORAddress)
-	cell := shared.Cell{
-		CircuitId: circuitId,
-		Data:      nextOnion,
+func (or OnionRouter) DeliverChatMessage(chatMessageByteArray []byte) error {
+	var chatMessage shared.ChatMessage
+	if err := decodePayload(chatMessageByteArray, &chatMessage); err != nil {
+		return err
+	}
+	if err := checkIRCServerAddr(chatMessage.IRCServerAddr); err != nil {
+		return err
 	}
 
-	nextORServer, err := DialOR(nextORAddress)
+	ircServer, err := dialIRCServer(chatMessage.IRCServerAddr)
 	if err != nil {
 		return err
 	}
 
 	var ack bool
-	if err := nextORServer.Call("ORServer.DecryptChatMessageCell", cell, &ack); err != nil {
+	if err = ircServer.Call("CServer.PublishMessage", chatMessage, &ack); err != nil {
+		util.HandleNonFatalError("Could not publish message to IRC server", err)
 		return err
 	}
-	nextORServer.Close()
+	ircServer.Close()
+
+	sender := chatMessage.Username
+	if chatMessage.PostingToken != nil {
+		sender = "(posting token)"
+	}
+	util.OutLog.Printf("Deliver chat message to IRC server: [%s] %s: %s\n", chatMessage.Namespace, sender, util.LogText(chatMessage.Message))
 
 	return nil
 }
 
+func dialIRCServer(ircServerAddr string) (*rpc.Client, error) {
+	waitForBatch()
+	ircServer, err := retry.DialRPC(context.Background(), retry.Interactive, "tcp", ircServerAddr)
+	if err != nil {
+		util.HandleNonFatalError("Could not dial IRC server: "+ircServerAddr, err)
+		return nil, shared.UnavailableError("IRC server "+ircServerAddr, err)
+	}
+	return ircServer, nil
+}
+
 func DialOR(ORAddr string) (*rpc.Client, error) {
-	orServer, err := rpc.Dial("tcp", ORAddr)
+	waitForBatch()
+	orServer, err := retry.DialRPC(context.Background(), retry.Interactive, "tcp", ORAddr)
 	if err != nil {
 		util.HandleNonFatalError("Could not dial onion router: "+ORAddr, err)
-		return nil, err
+		return nil, shared.UnavailableError("onion router "+ORAddr, err)
 	}
+	noteLinkTraffic(ORAddr)
 	return orServer, nil
 }
 
-func (s *ORServer) DecryptChatMessageCell(cell shared.Cell, ack *bool) error {
+func (s *ORServer) DecryptChatMessageCell(cell shared.Cell, ack *bool) (err error) {
+	defer func() { recordCellResult(cellRelayData, len(cell.Data), err) }()
+	defer recoverCell(&err)
+
 	util.OutLog.Println("Recieved chat message cell, decrypting...")
-	key := sharedKeysByCircuitId[cell.CircuitId]
-	cipherkey, err := aes.NewCipher(key)
+	currOnion, err := decryptCell(cell, cellRelayData)
+	defer wipeLayer(cell, currOnion)
 	if err != nil {
-		util.HandleNonFatalError("Could not create cipher key", err)
 		return err
 	}
-
-	prefix := cell.Data[:aes.BlockSize]
-	jsonData := cell.Data[aes.BlockSize:]
-	cfb := cipher.NewCFBDecrypter(cipherkey, prefix)
-	cfb.XORKeyStream(jsonData, jsonData)
-
-	var currOnion shared.Onion
-	if err = json.Unmarshal(jsonData, &currOnion); err != nil {
-		util.HandleNonFatalError("Could not unmarshal onion", err)
-	}
 	nextOnion := currOnion.Data
 
+	// Errors are returned so the ack reaching the OP means the exit delivered the message
 	if currOnion.IsExitNode {
-		if err = s.OnionRouter.DeliverChatMessage(currOnion.Data); err != nil {
+		if err = s.OnionRouter.DeliverCommand(cell.CircuitId, currOnion.Command, currOnion.Data); err != nil {
 			util.HandleNonFatalError("Could not deliver chat message", err)
+			return err
 		}
 	} else {
-		if err = s.OnionRouter.RelayChatMessageOnion(currOnion.NextAddress, nextOnion, cell.CircuitId); err != nil {
+		util.OutLog.Printf("\nRelay chat message:\n    Circuit ID: %v\n    Next OR: %s\n", cell.CircuitId, currOnion.NextAddress)
+		next := shared.Cell{CircuitId: relayCircuitId(cell.CircuitId, currOnion), Data: nextOnion}
+		if _, err = s.OnionRouter.forwardCell(currOnion.NextAddress, shared.RelayChat, next); err != nil {
 			util.HandleNonFatalError("Could not relay chat message", err)
+			return err
 		}
 	}
 
@@ -247,96 +732,371 @@ func (s *ORServer) DecryptChatMessageCell(cell shared.Cell, ack *bool) error {
 	return nil
 }
 
-func (s *ORServer) DecryptPollingCell(cell shared.Cell, resp *[]string) error {
-	key := sharedKeysByCircuitId[cell.CircuitId]
-	cipherkey, err := aes.NewCipher(key)
-	if err != nil {
-		util.HandleNonFatalError("Could not create cipher key", err)
-		return err
-	}
+func (s *ORServer) DecryptPollingCell(cell shared.Cell, resp *shared.PollingResponse) (err error) {
+	defer func() { recordCellResult(cellPolling, len(cell.Data), err) }()
+	defer recoverCell(&err)
 
-	prefix := cell.Data[:aes.BlockSize]
-	jsonData := cell.Data[aes.BlockSize:]
-	cfb := cipher.NewCFBDecrypter(cipherkey, prefix)
-	cfb.XORKeyStream(jsonData, jsonData)
-
-	var currOnion shared.Onion
-	err = json.Unmarshal(jsonData, &currOnion)
+	currOnion, err := decryptCell(cell, cellPolling)
+	defer wipeLayer(cell, currOnion)
 	if err != nil {
-		util.HandleNonFatalError("Could not unmarshal onion", err)
 		return err
 	}
 	nextOnion := currOnion.Data
 
-	var messages []string
-	if currOnion.IsExitNode {
-		messages, err = s.OnionRouter.DeliverPollingMessage(currOnion.Data)
+	var messages shared.PollingResponse
+	if currOnion.IsExitNode && currOnion.Command == shared.CommandFetchFragment {
+		messages, err = fetchFragment(cell.CircuitId, currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not fetch response fragment", err)
+			return err
+		}
+	} else if currOnion.IsExitNode && currOnion.Command == shared.CommandIssuePostingTokens {
+		messages, err = s.OnionRouter.DeliverPostingTokenRequest(currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not get posting tokens from IRC server", err)
+			return err
+		}
+	} else if currOnion.IsExitNode && currOnion.Command == shared.CommandChannelKeys {
+		messages, err = s.OnionRouter.DeliverChannelKeysRequest(currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not get channel keys from IRC server", err)
+			return err
+		}
+	} else if currOnion.IsExitNode && currOnion.Command == shared.CommandPrekeyBundle {
+		messages, err = s.OnionRouter.DeliverPrekeyBundleRequest(currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not get prekey bundle from IRC server", err)
+			return err
+		}
+	} else if currOnion.IsExitNode && currOnion.Command == shared.CommandGetRoster {
+		messages, err = s.OnionRouter.DeliverRosterRequest(cell.CircuitId, currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not get roster from IRC server", err)
+			return err
+		}
+	} else if currOnion.IsExitNode && currOnion.Command == shared.CommandMeasure {
+		if messages, err = answerMeasurement(currOnion.Data); err != nil {
+			return err
+		}
+	} else if currOnion.IsExitNode {
+		messages, err = s.OnionRouter.DeliverPollingMessage(cell.CircuitId, currOnion.Data)
 		if err != nil {
 			util.HandleNonFatalError("Could not retrieve new messages from IRC server", err)
 			return err
 		}
 	} else {
-		messages, err = s.OnionRouter.RelayPollingOnion(currOnion.NextAddress, nextOnion, cell.CircuitId)
+		next := shared.Cell{CircuitId: relayCircuitId(cell.CircuitId, currOnion), Data: nextOnion}
+		reply, err := s.OnionRouter.forwardCell(currOnion.NextAddress, shared.RelayPoll, next)
 		if err != nil {
 			util.HandleNonFatalError("Could not relay polling message to next OR: "+currOnion.NextAddress, err)
 			return err
 		}
+		if reply.Polling != nil {
+			messages = *reply.Polling
+		}
 	}
 
 	*resp = messages
 	return nil
 }
 
-func (or OnionRouter) DeliverPollingMessage(pollingMessageByteArray []byte) ([]string, error) {
+func (or OnionRouter) DeliverPollingMessage(circuitId uint32, pollingMessageByteArray []byte) (shared.PollingResponse, error) {
+	var messages shared.PollingResponse
 	var pollingMessage shared.PollingMessage
-	if err := json.Unmarshal(pollingMessageByteArray, &pollingMessage); err != nil {
-		return nil, err
+	if err := decodePayload(pollingMessageByteArray, &pollingMessage); err != nil {
+		return messages, err
+	}
+	if err := checkIRCServerAddr(pollingMessage.IRCServerAddr); err != nil {
+		return messages, err
 	}
 
-	ircServer, err := rpc.Dial("tcp", pollingMessage.IRCServerAddr)
+	ircServer, err := dialIRCServer(pollingMessage.IRCServerAddr)
 	if err != nil {
-		return nil, err
+		return messages, err
 	}
 
-	var messages []string
-	if err = ircServer.Call("CServer.GetNewMessages", pollingMessage.LastMessageId, &messages); err != nil {
+	if err = ircServer.Call("CServer.GetNewMessages", pollingMessage, &messages); err != nil {
 		util.HandleNonFatalError("Could not retrieve new messages from IRC server", err)
-		return nil, err
+		return messages, err
 	}
 	ircServer.Close()
 
+	// Older proxies can't reassemble, so they get the response whole
+	if pollingMessage.AcceptsFragments {
+		return fragmentResponse(circuitId, messages)
+	}
 	return messages, nil
 }
 
-func (or OnionRouter) RelayPollingOnion(nextORAddress string, nextOnion []byte, circuitId uint32) ([]string, error) {
-	cell := shared.Cell{
-		CircuitId: circuitId,
-		Data:      nextOnion,
+// Answers the directory server's bandwidth measurement with as many random
+// bytes as it sent
+func answerMeasurement(measureRequestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.MeasureRequest
+	if err := decodePayload(measureRequestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if len(req.Data) > shared.MaxMeasureData {
+		return shared.PollingResponse{}, malformed("measurement of %d bytes is larger than %d", len(req.Data), shared.MaxMeasureData)
+	}
+
+	measurement := make([]byte, len(req.Data))
+	if _, err := util.Random.Read(measurement); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	return shared.PollingResponse{Measurement: measurement}, nil
+}
+
+// Asks the IRC server to sign blinded posting tokens. The response is a few
+// kilobytes at most, so it is never fragmented.
+func (or OnionRouter) DeliverPostingTokenRequest(postingTokenRequestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.PostingTokenRequest
+	if err := decodePayload(postingTokenRequestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return shared.PollingResponse{}, err
 	}
 
-	nextORServer, err := DialOR(nextORAddress)
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
 	if err != nil {
-		return nil, err
+		return shared.PollingResponse{}, err
 	}
+	defer ircServer.Close()
 
-	var resp []string
-	if err := nextORServer.Call("ORServer.DecryptPollingCell", cell, &resp); err != nil {
-		return nil, err
+	var tokens shared.PostingTokenResponse
+	if err = ircServer.Call("CServer.IssuePostingTokens", req, &tokens); err != nil {
+		return shared.PollingResponse{}, err
 	}
-	nextORServer.Close()
+	return shared.PollingResponse{PostingTokens: &tokens}, nil
+}
 
-	return resp, nil
+// Asks the IRC server for the encryption keys of a channel's members
+func (or OnionRouter) DeliverChannelKeysRequest(channelKeysRequestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.ChannelKeysRequest
+	if err := decodePayload(channelKeysRequestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return shared.PollingResponse{}, err
+	}
+	defer ircServer.Close()
+
+	var keys shared.ChannelKeysResponse
+	if err = ircServer.Call("CServer.GetChannelKeys", req, &keys); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	return shared.PollingResponse{ChannelKeys: &keys}, nil
 }
 
-func (s *ORServer) SendCircuitInfo(circuitInfo shared.CircuitInfo, ack *bool) error {
-	sharedKey, err := util.RSADecrypt(s.OnionRouter.privKey, circuitInfo.EncryptedSharedKey)
+// Asks the IRC server for a user's prekey bundle
+func (or OnionRouter) DeliverPrekeyBundleRequest(prekeyBundleRequestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.PrekeyBundleRequest
+	if err := decodePayload(prekeyBundleRequestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
 	if err != nil {
-		util.HandleNonFatalError("Could not decrypt shared key", err)
+		return shared.PollingResponse{}, err
+	}
+	defer ircServer.Close()
+
+	var bundle shared.PrekeyBundle
+	if err = ircServer.Call("CServer.GetPrekeyBundle", req, &bundle); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	return shared.PollingResponse{PrekeyBundle: &bundle}, nil
+}
+
+// Like DecryptPollingCell, but the exit node asks the IRC server for a chunk
+// of an export archive
+func (s *ORServer) DecryptExportCell(cell shared.Cell, resp *shared.ExportChunk) (err error) {
+	defer func() { recordCellResult(cellExport, len(cell.Data), err) }()
+	defer recoverCell(&err)
+
+	currOnion, err := decryptCell(cell, cellExport)
+	defer wipeLayer(cell, currOnion)
+	if err != nil {
+		return err
+	}
+
+	var chunk shared.ExportChunk
+	if currOnion.IsExitNode {
+		chunk, err = s.OnionRouter.DeliverExportRequest(currOnion.Data)
+		if err != nil {
+			util.HandleNonFatalError("Could not export from IRC server", err)
+			return err
+		}
+	} else {
+		next := shared.Cell{CircuitId: relayCircuitId(cell.CircuitId, currOnion), Data: currOnion.Data}
+		reply, err := s.OnionRouter.forwardCell(currOnion.NextAddress, shared.RelayExport, next)
+		if err != nil {
+			util.HandleNonFatalError("Could not relay export request to next OR: "+currOnion.NextAddress, err)
+			return err
+		}
+		if reply.Export != nil {
+			chunk = *reply.Export
+		}
+	}
+
+	*resp = chunk
+	return nil
+}
+
+func (or OnionRouter) DeliverExportRequest(exportRequestByteArray []byte) (shared.ExportChunk, error) {
+	var chunk shared.ExportChunk
+	var req shared.ExportRequest
+	if err := decodePayload(exportRequestByteArray, &req); err != nil {
+		return chunk, err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return chunk, err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return chunk, err
+	}
+	defer ircServer.Close()
+
+	err = ircServer.Call("CServer.ExportLog", req, &chunk)
+	return chunk, err
+}
+
+// Answers the directory server's reachability test by decrypting the nonce it
+// encrypted with this router's public key.
+func (s *ORServer) Handshake(encryptedNonce []byte, nonce *[]byte) error {
+	if len(encryptedNonce) != s.OnionRouter.privKey.Size() {
+		return malformed("handshake of %d bytes, expected %d", len(encryptedNonce), s.OnionRouter.privKey.Size())
+	}
+	decrypted, err := util.RSADecrypt(s.OnionRouter.privKey, encryptedNonce)
+	if err != nil {
+		return err
+	}
+
+	*nonce = decrypted
+	return nil
+}
+
+func (s *ORServer) SendCircuitInfo(circuitInfo shared.CircuitInfo, ack *bool) (err error) {
+	defer func() { recordCellResult(cellCreate, len(circuitInfo.EncryptedSharedKey), err) }()
+	if err = refuseWhileHibernating(); err != nil {
+		return err
+	}
+
+	sharedKey, err := s.OnionRouter.decryptSharedKey(circuitInfo)
+	if err != nil {
+		return err
+	}
+	if err = addCircuit(circuitInfo.CircuitId, sharedKey); err != nil {
+		return err
 	}
-	sharedKeysByCircuitId[circuitInfo.CircuitId] = sharedKey
 
-	util.OutLog.Printf("\nReceived circuit info:\n    Circuit ID %v\n    Shared Key: %s\n", circuitInfo.CircuitId, hex.EncodeToString(sharedKey))
+	util.OutLog.Printf("\nReceived circuit info:\n    Circuit ID %v\n    Shared Key: %s\n", circuitInfo.CircuitId, util.LogKey(sharedKey))
 
 	*ack = true
 	return nil
 }
+
+// Like SendCircuitInfo, but this router picks the circuit id, which the onion
+// proxy then uses on the link into this router. CircuitInfo.CircuitId is ignored.
+func (s *ORServer) CreateCircuit(circuitInfo shared.CircuitInfo, circuitId *uint32) (err error) {
+	defer func() { recordCellResult(cellCreate, len(circuitInfo.EncryptedSharedKey), err) }()
+	if err = refuseWhileHibernating(); err != nil {
+		return err
+	}
+
+	sharedKey, err := s.OnionRouter.decryptSharedKey(circuitInfo)
+	if err != nil {
+		return err
+	}
+	*circuitId = allocateCircuit(sharedKey)
+
+	util.OutLog.Printf("\nCreated circuit:\n    Circuit ID %v\n    Shared Key: %s\n", *circuitId, util.LogKey(sharedKey))
+	return nil
+}
+
+// Like CreateCircuit, and answers with this router's capabilities, noting
+// those of the onion proxy with the circuit
+func (s *ORServer) NegotiateCircuit(circuitInfo shared.CircuitInfo, created *shared.CircuitCreated) (err error) {
+	defer func() { recordCellResult(cellCreate, len(circuitInfo.EncryptedSharedKey), err) }()
+	if err = refuseWhileHibernating(); err != nil {
+		return err
+	}
+
+	sharedKey, err := s.OnionRouter.decryptSharedKey(circuitInfo)
+	if err != nil {
+		return err
+	}
+	created.CircuitId = allocateCircuit(sharedKey)
+	created.Capabilities = capabilities()
+	setPeerCapabilities(created.CircuitId, circuitInfo.Capabilities)
+
+	util.OutLog.Printf("\nCreated circuit:\n    Circuit ID %v\n    Shared Key: %s\n    Proxy capabilities: %v\n", created.CircuitId, util.LogKey(sharedKey), circuitInfo.Capabilities)
+	return nil
+}
+
+// What this router does, as published in its descriptor and circuit
+// handshakes. Padding cells and measurements are always taken.
+func capabilities() shared.Capabilities {
+	c := shared.CapabilityLinkPadding | shared.CapabilityMeasurement
+	if exitStreams {
+		c |= shared.CapabilityExitStreams
+	}
+	return c
+}
+
+// Decrypts the shared key of a new circuit and checks it is an AES key
+func (or OnionRouter) decryptSharedKey(circuitInfo shared.CircuitInfo) ([]byte, error) {
+	if len(circuitInfo.EncryptedSharedKey) != or.privKey.Size() {
+		return nil, malformed("encrypted shared key of %d bytes, expected %d", len(circuitInfo.EncryptedSharedKey), or.privKey.Size())
+	}
+
+	sharedKey, err := util.RSADecrypt(or.privKey, circuitInfo.EncryptedSharedKey)
+	if err != nil {
+		util.HandleNonFatalError("Could not decrypt shared key", err)
+		return nil, err
+	}
+	switch len(sharedKey) {
+	case 16, 24, 32:
+		return sharedKey, nil
+	}
+	secmem.Wipe(sharedKey)
+	return nil, malformed("shared key of %d bytes is not an AES key", len(sharedKey))
+}
+
+// Asks the IRC server for the sender's roster blob. It can be larger than a
+// polling cell, so it is fragmented like a polling response.
+func (or OnionRouter) DeliverRosterRequest(circuitId uint32, rosterRequestByteArray []byte) (shared.PollingResponse, error) {
+	var req shared.RosterRequest
+	if err := decodePayload(rosterRequestByteArray, &req); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	if err := checkIRCServerAddr(req.IRCServerAddr); err != nil {
+		return shared.PollingResponse{}, err
+	}
+
+	ircServer, err := dialIRCServer(req.IRCServerAddr)
+	if err != nil {
+		return shared.PollingResponse{}, err
+	}
+	defer ircServer.Close()
+
+	var roster shared.RosterBlob
+	if err = ircServer.Call("CServer.GetRoster", req, &roster); err != nil {
+		return shared.PollingResponse{}, err
+	}
+	resp := shared.PollingResponse{Roster: &roster}
+	if req.AcceptsFragments {
+		return fragmentResponse(circuitId, resp)
+	}
+	return resp, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"testing"
+
+	"../shared"
+	"../util"
+)
+
+func TestAnswerMeasurement(t *testing.T) {
+	payload, err := json.Marshal(shared.MeasureRequest{Data: make([]byte, 1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := answerMeasurement(payload)
+	if err != nil || len(resp.Measurement) != 1000 {
+		t.Fatalf("answered %d bytes, %v", len(resp.Measurement), err)
+	}
+
+	// An exit never sends more than it was sent, nor more than it allows
+	payload, err = json.Marshal(shared.MeasureRequest{Data: make([]byte, shared.MaxMeasureData+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = answerMeasurement(payload); !shared.IsMalformedCellError(err) {
+		t.Fatalf("an oversized measurement gave %v, want a malformed cell error", err)
+	}
+}
+
+func TestNegotiateCircuit(t *testing.T) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789abcdef")
+	encryptedKey, err := util.RSAEncrypt(&privKey.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ORServer{OnionRouter: &OnionRouter{privKey: privKey}}
+
+	var created shared.CircuitCreated
+	if err = s.NegotiateCircuit(shared.CircuitInfo{EncryptedSharedKey: encryptedKey, Capabilities: shared.CapabilityLinkPadding}, &created); err != nil {
+		t.Fatal(err)
+	}
+	defer destroyCircuit(created.CircuitId)
+	if created.CircuitId == 0 || created.Capabilities != capabilities() {
+		t.Fatalf("the router answered %+v", created)
+	}
+	for _, stats := range circuitStats() {
+		if stats.CircuitId == created.CircuitId && stats.Capabilities != shared.CapabilityLinkPadding {
+			t.Fatalf("the circuit noted the proxy's capabilities as %v", stats.Capabilities)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/padding"
+	"../util/retry"
+)
+
+const (
+	// A link's padding machine stops once no real cell went over it for this
+	// long, and starts again with the next
+	linkPaddingIdle time.Duration = 5 * time.Minute
+)
+
+var (
+	linkPaddingMachine padding.Machine // set by -padding, pads no link without states
+
+	// Padding machines running on the links to other routers, by address
+	linkPadding = struct {
+		sync.Mutex
+		links    map[string]*padding.Link
+		unpadded map[string]bool // routers from before link padding
+	}{links: make(map[string]*padding.Link), unpadded: make(map[string]bool)}
+)
+
+// Tells the padding machine of the link to orAddr that a real cell is going
+// over it, starting the machine if it isn't running
+func noteLinkTraffic(orAddr string) {
+	if len(linkPaddingMachine.States) == 0 {
+		return
+	}
+
+	linkPadding.Lock()
+	if linkPadding.unpadded[orAddr] {
+		linkPadding.Unlock()
+		return
+	}
+	link := linkPadding.links[orAddr]
+	if link == nil || link.Stopped() {
+		link = padding.Start(linkPaddingMachine, linkPaddingIdle, func(size int) error {
+			return sendPaddingCell(orAddr, size)
+		})
+		linkPadding.links[orAddr] = link
+	}
+	linkPadding.Unlock()
+
+	link.Traffic()
+}
+
+// Sends a padding cell of size random bytes to orAddr. Like every other cell
+// it goes over a connection of its own. The cell is encoded by the time the
+// relay call returns, so its buffer goes back to the pool then.
+func sendPaddingCell(orAddr string, size int) error {
+	cell := shared.Cell{Data: util.GetBuffer(size)}
+	defer util.PutBuffer(cell.Data)
+	if _, err := util.Random.Read(cell.Data); err != nil {
+		return err
+	}
+
+	nextORServer, err := retry.DialRPC(context.Background(), retry.Interactive, "tcp", orAddr)
+	if err != nil {
+		return err
+	}
+	defer nextORServer.Close()
+
+	_, err = callRelay(nextORServer, orAddr, shared.RelayPadding, cell)
+	if missingMethod(err) {
+		linkPadding.Lock()
+		linkPadding.unpadded[orAddr] = true
+		linkPadding.Unlock()
+		util.OutLog.Printf("Onion router %s predates link padding, not padding the link\n", orAddr)
+	}
+	return err
+}
+
+// Drops a padding cell from a proxy or another router, after counting it
+func (s *ORServer) PaddingCell(cell shared.Cell, ack *bool) (err error) {
+	defer func() { recordCellResult(cellPadding, len(cell.Data), err) }()
+
+	if err := checkCellSize(cell.Data); err != nil {
+		return err
+	}
+	*ack = true
+	return nil
+}
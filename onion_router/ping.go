@@ -0,0 +1,47 @@
+package main
+
+import (
+	"../shared"
+	"../util"
+)
+
+// Echoes a ping at the exit, or passes it on to the next router. Exits
+// answer pings themselves, so their round trip doesn't include the IRC
+// server.
+func (s *ORServer) decryptPingCell(cell shared.Cell) (pong shared.Ping, err error) {
+	defer func() { recordCellResult(cellPing, len(cell.Data), err) }()
+	defer recoverCell(&err)
+
+	currOnion, err := decryptCell(cell, cellPing)
+	defer wipeLayer(cell, currOnion)
+	if err != nil {
+		return pong, err
+	}
+
+	if currOnion.IsExitNode {
+		return answerPing(currOnion.Data)
+	}
+
+	next := shared.Cell{CircuitId: relayCircuitId(cell.CircuitId, currOnion), Data: currOnion.Data}
+	reply, err := s.OnionRouter.forwardCell(currOnion.NextAddress, shared.RelayPing, next)
+	if err != nil {
+		util.HandleNonFatalError("Could not relay ping to next OR: "+currOnion.NextAddress, err)
+		return pong, err
+	}
+	if reply.Pong == nil {
+		return pong, malformed("next OR %s answered a ping without a pong", currOnion.NextAddress)
+	}
+	return *reply.Pong, nil
+}
+
+// Sends the ping's nonce back
+func answerPing(pingByteArray []byte) (shared.Ping, error) {
+	var ping shared.Ping
+	if err := decodePayload(pingByteArray, &ping); err != nil {
+		return ping, err
+	}
+	if len(ping.Nonce) > shared.MaxPingNonce {
+		return shared.Ping{}, malformed("ping nonce of %d bytes is larger than %d", len(ping.Nonce), shared.MaxPingNonce)
+	}
+	return ping, nil
+}
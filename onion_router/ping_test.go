@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"../shared"
+)
+
+// A ping cell for the exit of circuitId
+func testPingCell(t *testing.T, circuitId uint32, nonce []byte) shared.Cell {
+	ping, err := json.Marshal(shared.Ping{Nonce: nonce})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := shared.AppendBinaryOnion(nil, shared.Onion{IsExitNode: true, Command: shared.CommandPing, Data: ping})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shared.Cell{CircuitId: circuitId, Data: sealTestLayer(t, layer)}
+}
+
+func TestDecryptPingCell(t *testing.T) {
+	circuitId := allocateCircuit(append([]byte(nil), testLayerKey...))
+	defer destroyCircuit(circuitId)
+	s := new(ORServer)
+
+	nonce := []byte("sixteen byte nce")
+	var reply shared.RelayReply
+	if err := s.Relay(shared.RelayCell{Command: shared.RelayPing, Cell: testPingCell(t, circuitId, nonce)}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Pong == nil || !bytes.Equal(reply.Pong.Nonce, nonce) {
+		t.Fatalf("the exit answered %+v", reply.Pong)
+	}
+
+	// Only pings travel in ping cells
+	message := testOnions(t)[1]
+	layer, err := shared.AppendBinaryOnion(nil, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.decryptPingCell(shared.Cell{CircuitId: circuitId, Data: sealTestLayer(t, layer)}); !shared.IsMalformedCellError(err) {
+		t.Fatalf("a chat message in a ping cell gave %v, want a malformed cell error", err)
+	}
+}
+
+func TestAnswerPing(t *testing.T) {
+	ping, err := json.Marshal(shared.Ping{Nonce: make([]byte, shared.MaxPingNonce+1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = answerPing(ping); !shared.IsMalformedCellError(err) {
+		t.Fatalf("an oversized nonce gave %v, want a malformed cell error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/rpc"
+	"strings"
+	"sync"
+
+	"../shared"
+	"../util"
+)
+
+// A stream cell that came in through DecryptStreamCell, from a proxy or
+// router from before relay cells, so which stream command it carries isn't
+// known until the exit peels it
+const untypedStreamCell shared.RelayCommand = 0
+
+var (
+	// Routers that don't know ORServer.Relay, by address. Cells to them go to
+	// the RPC method of their kind instead.
+	legacyRelays = struct {
+		sync.Mutex
+		byAddress map[string]bool
+	}{byAddress: make(map[string]bool)}
+)
+
+// Handles a relay cell by its command. The legacy methods, DecryptPollingCell
+// and the like, are kept for proxies and routers from before relay cells.
+func (s *ORServer) Relay(relay shared.RelayCell, reply *shared.RelayReply) error {
+	var ack bool
+	switch relay.Command {
+	case shared.RelayChat:
+		return s.DecryptChatMessageCell(relay.Cell, &ack)
+	case shared.RelayPoll:
+		var resp shared.PollingResponse
+		if err := s.DecryptPollingCell(relay.Cell, &resp); err != nil {
+			return err
+		}
+		reply.Polling = &resp
+	case shared.RelayExport:
+		var chunk shared.ExportChunk
+		if err := s.DecryptExportCell(relay.Cell, &chunk); err != nil {
+			return err
+		}
+		reply.Export = &chunk
+	case shared.RelayBegin, shared.RelayData, shared.RelayEnd:
+		resp, err := s.decryptStreamCell(relay.Command, relay.Cell)
+		if err != nil {
+			return err
+		}
+		reply.Stream = &resp
+	case shared.RelayPing:
+		pong, err := s.decryptPingCell(relay.Cell)
+		if err != nil {
+			return err
+		}
+		reply.Pong = &pong
+	case shared.RelayPadding:
+		return s.PaddingCell(relay.Cell, &ack)
+	case shared.RelayDestroy:
+		return s.DestroyCircuit(destroyNoticeOf(relay.Cell), &ack)
+	default:
+		recordCell(cellError, len(relay.Cell.Data))
+		return malformed("unknown relay command %v", relay.Command)
+	}
+	return nil
+}
+
+// Passes a cell on to the next router on its circuit
+func (or OnionRouter) forwardCell(nextORAddress string, command shared.RelayCommand, cell shared.Cell) (shared.RelayReply, error) {
+	// Only called by handlers of cells, which hold a worker
+	releaseWorker()
+	defer acquireWorker()
+
+	nextORServer, err := DialOR(nextORAddress)
+	if err != nil {
+		or.noteHopFailure(nextORAddress)
+		return shared.RelayReply{}, err
+	}
+	defer nextORServer.Close()
+	noteHopSuccess(nextORAddress)
+
+	return callRelay(nextORServer, nextORAddress, command, cell)
+}
+
+// Sends a cell to the router at orAddr as a relay cell, or to the method of
+// its kind if the router predates relay cells
+func callRelay(client *rpc.Client, orAddr string, command shared.RelayCommand, cell shared.Cell) (shared.RelayReply, error) {
+	var reply shared.RelayReply
+	legacyRelays.Lock()
+	legacy := legacyRelays.byAddress[orAddr]
+	legacyRelays.Unlock()
+
+	if command != untypedStreamCell && !legacy {
+		err := client.Call("ORServer.Relay", shared.RelayCell{Command: command, Cell: cell}, &reply)
+		if !missingMethod(err) {
+			return reply, err
+		}
+		legacyRelays.Lock()
+		legacyRelays.byAddress[orAddr] = true
+		legacyRelays.Unlock()
+		util.OutLog.Printf("Onion router %s predates relay cells, sending it cells by kind\n", orAddr)
+	}
+
+	var ack bool
+	var err error
+	switch command {
+	case shared.RelayChat:
+		err = client.Call("ORServer.DecryptChatMessageCell", cell, &ack)
+	case shared.RelayPoll:
+		reply.Polling = new(shared.PollingResponse)
+		err = client.Call("ORServer.DecryptPollingCell", cell, reply.Polling)
+	case shared.RelayExport:
+		reply.Export = new(shared.ExportChunk)
+		err = client.Call("ORServer.DecryptExportCell", cell, reply.Export)
+	case untypedStreamCell, shared.RelayBegin, shared.RelayData, shared.RelayEnd:
+		reply.Stream = new(shared.StreamResponse)
+		err = client.Call("ORServer.DecryptStreamCell", cell, reply.Stream)
+	case shared.RelayPing:
+		err = malformed("onion router %s predates ping cells", orAddr)
+	case shared.RelayPadding:
+		err = client.Call("ORServer.PaddingCell", cell, &ack)
+	case shared.RelayDestroy:
+		err = client.Call("ORServer.DestroyCircuit", destroyNoticeOf(cell), &ack)
+	default:
+		err = malformed("unknown relay command %v", command)
+	}
+	return reply, err
+}
+
+// Whether err says the peer has no such RPC method, as peers from before it
+func missingMethod(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "rpc: can't find method")
+}
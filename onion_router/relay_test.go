@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+
+	"../shared"
+)
+
+// Stands in for the next router: a current one takes relay cells, a legacy
+// one only the method of each kind
+type testRelayRouter struct {
+	commands []shared.RelayCommand
+}
+
+func (r *testRelayRouter) Relay(relay shared.RelayCell, reply *shared.RelayReply) error {
+	r.commands = append(r.commands, relay.Command)
+	reply.Polling = &shared.PollingResponse{}
+	return nil
+}
+
+type testLegacyRouter struct {
+	polls int
+}
+
+func (r *testLegacyRouter) DecryptPollingCell(cell shared.Cell, resp *shared.PollingResponse) error {
+	r.polls++
+	resp.Measurement = []byte("legacy")
+	return nil
+}
+
+func testRouterClient(t *testing.T, router interface{}) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.RegisterName("ORServer", router); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCallRelay(t *testing.T) {
+	current := &testRelayRouter{}
+	reply, err := callRelay(testRouterClient(t, current), "127.0.0.1:8101", shared.RelayPoll, shared.Cell{CircuitId: 1})
+	if err != nil || reply.Polling == nil || len(current.commands) != 1 || current.commands[0] != shared.RelayPoll {
+		t.Fatalf("a current router was sent %v, answering %+v, %v", current.commands, reply, err)
+	}
+
+	// A router without Relay is sent cells by kind from then on
+	legacy := &testLegacyRouter{}
+	for i := 0; i < 2; i++ {
+		reply, err = callRelay(testRouterClient(t, legacy), "127.0.0.1:8102", shared.RelayPoll, shared.Cell{CircuitId: 1})
+		if err != nil || reply.Polling == nil || string(reply.Polling.Measurement) != "legacy" {
+			t.Fatalf("a legacy router answered %+v, %v", reply, err)
+		}
+	}
+	legacyRelays.Lock()
+	remembered := legacyRelays.byAddress["127.0.0.1:8102"]
+	legacyRelays.Unlock()
+	if !remembered || legacy.polls != 2 {
+		t.Fatalf("the legacy router was polled %d times, remembered %v", legacy.polls, remembered)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s := new(ORServer)
+	var reply shared.RelayReply
+	if err := s.Relay(shared.RelayCell{Command: 99}, &reply); !shared.IsMalformedCellError(err) {
+		t.Fatalf("an unknown relay command gave %v, want a malformed cell error", err)
+	}
+
+	key := []byte("key")
+	circuitId := allocateCircuit(key)
+	// A bare circuit id destroys nothing
+	if err := s.Relay(shared.RelayCell{Command: shared.RelayDestroy, Cell: shared.Cell{CircuitId: circuitId, Data: []byte(shared.DestroyIdle)}}, &reply); err != unknownCircuitError {
+		t.Fatalf("a destroy without the token gave %v, want %v", err, unknownCircuitError)
+	}
+	data := destroyCellData(shared.DestroyToken(key), shared.DestroyIdle)
+	if err := s.Relay(shared.RelayCell{Command: shared.RelayDestroy, Cell: shared.Cell{CircuitId: circuitId, Data: data}}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := circuitCipher(circuitId, cellRelayData, 0); err != unknownCircuitError {
+		t.Fatalf("a destroy relay cell left the circuit open: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+type CircuitQueueError error
+
+const (
+	// Scheduler configurations
+	defaultSchedulerSlots      int           = 16
+	defaultCircuitEWMAHalfLife time.Duration = 30 * time.Second
+	ewmaForgottenBelow         float64       = 0.01 // counts decayed this far are dropped, as if the circuit were new
+	defaultMaxCircuitQueue     int           = 64
+
+	// What happens to a cell for a circuit whose queue is full
+	queueBackpressure = "backpressure" // it waits for room, and the link it came on isn't read meanwhile
+	queueKill         = "kill"         // the circuit is torn down
+)
+
+var (
+	// Scheduler Errors
+	circuitQueueFullError CircuitQueueError = errors.New("Circuit queued too many cells and was torn down")
+
+	schedulerSlots      = defaultSchedulerSlots      // set by -scheduler-slots, 0 handles cells in arrival order
+	circuitEWMAHalfLife = defaultCircuitEWMAHalfLife // set by -circuit-ewma-halflife
+	maxCircuitQueue     = defaultMaxCircuitQueue     // set by -max-circuit-queue, 0 queues without a limit
+	circuitQueuePolicy  = queueBackpressure          // set by -circuit-queue-policy
+
+	scheduler = newCellScheduler()
+)
+
+func newCellScheduler() *cellScheduler {
+	s := &cellScheduler{
+		queues: make(map[uint32][]chan struct{}),
+		counts: make(map[uint32]*ewmaCount),
+	}
+	s.room = sync.NewCond(&s.Mutex)
+	return s
+}
+
+func checkCircuitQueuePolicy(policy string) error {
+	if policy != queueBackpressure && policy != queueKill {
+		return fmt.Errorf("unknown policy %q, expected %s or %s", policy, queueBackpressure, queueKill)
+	}
+	return nil
+}
+
+// Hands out schedulerSlots slots to decrypt cells in. While every slot is
+// taken, cells wait in a queue per circuit, and a freed slot goes to the first
+// cell of the circuit that relayed the fewest cells lately, by an
+// exponentially weighted moving average. Quiet, interactive circuits then go
+// ahead of a chatty one instead of waiting behind all its cells.
+type cellScheduler struct {
+	sync.Mutex
+	busy    int
+	waiting int
+	queues  map[uint32][]chan struct{} // cells waiting, by circuit, oldest first
+	counts  map[uint32]*ewmaCount      // cells relayed, by circuit
+	room    *sync.Cond                 // signaled as cells leave the queues
+	killed  uint64                     // circuits torn down for a full queue
+}
+
+// Cells relayed on a circuit, halving every circuitEWMAHalfLife
+type ewmaCount struct {
+	value   float64
+	updated time.Time
+}
+
+func (c *ewmaCount) at(now time.Time) float64 {
+	if c.updated.IsZero() || !now.After(c.updated) {
+		return c.value
+	}
+	return c.value * math.Pow(0.5, float64(now.Sub(c.updated))/float64(circuitEWMAHalfLife))
+}
+
+// Waits for a slot to handle a cell of the circuit in, and returns the
+// function that frees it once the cell was handled. A cell that finds
+// maxCircuitQueue cells of its circuit waiting already waits for room, or
+// has the circuit torn down, by circuitQueuePolicy.
+func (s *cellScheduler) acquire(circuitId uint32) (func(), error) {
+	if schedulerSlots <= 0 {
+		return func() {}, nil
+	}
+
+	s.Lock()
+	for {
+		if s.busy < schedulerSlots && s.waiting == 0 {
+			s.busy++
+			s.countLocked(circuitId).add(util.Time.Now())
+			s.Unlock()
+			return s.release, nil
+		}
+		if maxCircuitQueue <= 0 || len(s.queues[circuitId]) < maxCircuitQueue {
+			break
+		}
+		if circuitQueuePolicy == queueKill {
+			s.killed++
+			s.Unlock()
+			killCircuit(circuitId)
+			return nil, circuitQueueFullError
+		}
+		s.room.Wait()
+	}
+	turn := make(chan struct{})
+	s.queues[circuitId] = append(s.queues[circuitId], turn)
+	s.waiting++
+	s.Unlock()
+
+	<-turn
+	return s.release, nil
+}
+
+// Tears down a circuit that overflowed its queue. Cells of it still queued
+// find it gone when their turn comes.
+func killCircuit(circuitId uint32) {
+	circ := destroyCircuit(circuitId)
+	if circ == nil {
+		return
+	}
+	util.ErrLog.Printf("[WARNING] Circuit %d queued more than %d cells, tearing it down\n", circuitId, maxCircuitQueue)
+	recordCell(cellDestroy, 0)
+	go notifyNextHop(circ, shared.DestroyQueueFull)
+}
+
+// Passes the slot on to the next cell, or frees it if none waits
+func (s *cellScheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+
+	now := util.Time.Now()
+	var next uint32
+	best := math.Inf(1)
+	for circuitId := range s.queues {
+		if value := s.countLocked(circuitId).at(now); value < best {
+			next, best = circuitId, value
+		}
+	}
+	if math.IsInf(best, 1) {
+		s.busy--
+		return
+	}
+
+	turn := s.queues[next][0]
+	if len(s.queues[next]) == 1 {
+		delete(s.queues, next)
+	} else {
+		s.queues[next] = s.queues[next][1:]
+	}
+	s.waiting--
+	s.countLocked(next).add(now)
+	s.room.Broadcast()
+	close(turn)
+}
+
+// The count of the circuit, a new one for circuits without cells yet.
+// Caller must hold the scheduler lock.
+func (s *cellScheduler) countLocked(circuitId uint32) *ewmaCount {
+	count, ok := s.counts[circuitId]
+	if !ok {
+		count = &ewmaCount{}
+		s.counts[circuitId] = count
+	}
+	return count
+}
+
+func (c *ewmaCount) add(now time.Time) {
+	c.value = c.at(now) + 1
+	c.updated = now
+}
+
+// Drops the count of a torn down circuit
+func (s *cellScheduler) forget(circuitId uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.counts, circuitId)
+}
+
+// Drops the counts that decayed to nothing, so cells for circuit ids that
+// were never created don't pile up counts
+func (s *cellScheduler) prune(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for circuitId, count := range s.counts {
+		if _, waiting := s.queues[circuitId]; !waiting && count.at(now) < ewmaForgottenBelow {
+			delete(s.counts, circuitId)
+		}
+	}
+}
+
+// Cells waiting for a slot, and circuits torn down for a full queue
+func (s *cellScheduler) stats() (int, uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.waiting, s.killed
+}
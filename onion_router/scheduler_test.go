@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Fails the test unless s comes to have queued cells waiting within a second
+func waitForQueued(t *testing.T, s *cellScheduler, queued int) {
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if waiting, _ := s.stats(); waiting >= queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("fewer than %d cells waited for a slot", queued)
+		}
+	}
+}
+
+func testAcquire(t *testing.T, s *cellScheduler, circuitId uint32) func() {
+	release, err := s.acquire(circuitId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return release
+}
+
+func TestEWMACount(t *testing.T) {
+	now := time.Now()
+	count := &ewmaCount{}
+	count.add(now)
+	count.add(now)
+	if value := count.at(now.Add(circuitEWMAHalfLife)); value < 0.99 || value > 1.01 {
+		t.Fatalf("two cells are worth %f after a half-life, want 1", value)
+	}
+	if value := count.at(now.Add(-time.Second)); value != 2 {
+		t.Fatalf("before its last cell the count is %f, want 2", value)
+	}
+}
+
+func TestSchedulerFavoursQuietCircuits(t *testing.T) {
+	defer func(slots int) { schedulerSlots = slots }(schedulerSlots)
+	schedulerSlots = 1
+	s := newCellScheduler()
+
+	// The chatty circuit holds the only slot and has relayed the most
+	release := testAcquire(t, s, 1)
+	for i := 0; i < 5; i++ {
+		s.countLocked(1).add(time.Now())
+	}
+	order := make(chan uint32, 2)
+	for _, circuitId := range []uint32{1, 2} {
+		go func(circuitId uint32) {
+			free := testAcquire(t, s, circuitId)
+			order <- circuitId
+			free()
+		}(circuitId)
+		waitForQueued(t, s, int(circuitId))
+	}
+	release()
+	if first, second := <-order, <-order; first != 2 || second != 1 {
+		t.Fatalf("the cells went in order %d, %d, want the quiet circuit first", first, second)
+	}
+	if waiting, _ := s.stats(); waiting != 0 || s.busy != 0 {
+		t.Fatalf("%d cells still wait with %d slots taken", waiting, s.busy)
+	}
+}
+
+func TestSchedulerOff(t *testing.T) {
+	defer func(slots int) { schedulerSlots = slots }(schedulerSlots)
+	schedulerSlots = 0
+	s := newCellScheduler()
+	testAcquire(t, s, 1)
+	testAcquire(t, s, 1)
+	if s.busy != 0 || len(s.counts) != 0 {
+		t.Fatal("cells were scheduled with the scheduler off")
+	}
+}
+
+func TestCircuitQueueKill(t *testing.T) {
+	defer func(slots, queue int, policy string) {
+		schedulerSlots, maxCircuitQueue, circuitQueuePolicy = slots, queue, policy
+	}(schedulerSlots, maxCircuitQueue, circuitQueuePolicy)
+	schedulerSlots, maxCircuitQueue, circuitQueuePolicy = 1, 1, queueKill
+	s := newCellScheduler()
+	circuitId := allocateCircuit([]byte("key"))
+	defer destroyCircuit(circuitId)
+
+	release := testAcquire(t, s, circuitId)
+	go func() { testAcquire(t, s, circuitId)() }()
+	waitForQueued(t, s, 1)
+	if _, err := s.acquire(circuitId); err != circuitQueueFullError {
+		t.Fatalf("a cell over the queue limit gave %v, want %v", err, circuitQueueFullError)
+	}
+	if _, err := circuitCipher(circuitId, cellRelayData, 0); err != unknownCircuitError {
+		t.Fatalf("the overflowing circuit is still open: %v", err)
+	}
+	if _, killed := s.stats(); killed != 1 {
+		t.Fatalf("%d circuits were counted as torn down", killed)
+	}
+	release()
+}
+
+func TestCircuitQueueBackpressure(t *testing.T) {
+	defer func(slots, queue int, policy string) {
+		schedulerSlots, maxCircuitQueue, circuitQueuePolicy = slots, queue, policy
+	}(schedulerSlots, maxCircuitQueue, circuitQueuePolicy)
+	schedulerSlots, maxCircuitQueue, circuitQueuePolicy = 1, 1, queueBackpressure
+	s := newCellScheduler()
+
+	release := testAcquire(t, s, 1)
+	go func() { testAcquire(t, s, 1)() }()
+	waitForQueued(t, s, 1)
+	admitted := make(chan struct{})
+	go func() {
+		testAcquire(t, s, 1)()
+		close(admitted)
+	}()
+	select {
+	case <-admitted:
+		t.Fatal("a cell over the queue limit didn't wait for room")
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	select {
+	case <-admitted:
+	case <-time.After(time.Second):
+		t.Fatal("a waiting cell wasn't let in once its queue had room")
+	}
+}
+
+func TestCheckCircuitQueuePolicy(t *testing.T) {
+	for _, policy := range []string{queueBackpressure, queueKill} {
+		if err := checkCircuitQueuePolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkCircuitQueuePolicy("drop"); err == nil {
+		t.Fatal("an unknown policy was accepted")
+	}
+}
+
+func TestSchedulerPrune(t *testing.T) {
+	s := newCellScheduler()
+	now := time.Now()
+	s.countLocked(1).add(now)
+	s.countLocked(2).add(now.Add(-20 * circuitEWMAHalfLife))
+	s.prune(now)
+	if _, ok := s.counts[2]; ok || len(s.counts) != 1 {
+		t.Fatalf("pruning left %v", s.counts)
+	}
+	s.forget(1)
+	if len(s.counts) != 0 {
+		t.Fatal("a torn down circuit's count was kept")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/secmem"
+)
+
+type SelfTestError error
+
+const (
+	// Self-test configurations
+	selfTestSize          int           = 1024 // random bytes sent through the test circuit
+	selfTestRetryInterval time.Duration = 30 * time.Second
+)
+
+var (
+	// Self-test Errors
+	selfTestPendingError  SelfTestError = errors.New("Self-test circuit through this router hasn't delivered yet")
+	selfTestFailedError   SelfTestError = errors.New("Self-test circuit through this router failed")
+	selfTestMismatchError SelfTestError = errors.New("Exit node answered the self-test with the wrong number of bytes")
+
+	// Outcome of the latest self-test, one of the shared.SelfTest results or
+	// empty before the first
+	selfTest = struct {
+		sync.Mutex
+		result string
+	}{}
+)
+
+func selfTestResult() string {
+	selfTest.Lock()
+	defer selfTest.Unlock()
+	return selfTest.result
+}
+
+func setSelfTestResult(result string) {
+	selfTest.Lock()
+	defer selfTest.Unlock()
+	selfTest.result = result
+}
+
+// Healthy once the self-test passed, or couldn't run for want of other routers
+func checkSelfTest() error {
+	switch selfTestResult() {
+	case shared.SelfTestPassed, shared.SelfTestUntestable:
+		return nil
+	case shared.SelfTestFailed:
+		return selfTestFailedError
+	default:
+		return selfTestPendingError
+	}
+}
+
+// Builds a three hop circuit with this router in the middle, between two
+// other routers from the consensus, and checks that a measure cell sent
+// through it comes back, every selfTestRetryInterval until one does. With
+// fewer than two other routers that answer measure cells the test is
+// untestable, and tried again later too.
+func (or *OnionRouter) runSelfTest() {
+	for {
+		result, err := or.selfTestOnce()
+		setSelfTestResult(result)
+		switch result {
+		case shared.SelfTestPassed:
+			util.OutLog.Printf("Self-test: a circuit through %s delivered end to end\n", or.addr)
+			return
+		case shared.SelfTestUntestable:
+			util.OutLog.Println("Self-test: too few other routers to build a test circuit through this one")
+		default:
+			util.ErrLog.Printf("[WARNING] Self-test: circuit through %s failed: %v\n", or.addr, err)
+		}
+		time.Sleep(selfTestRetryInterval)
+	}
+}
+
+func (or *OnionRouter) selfTestOnce() (string, error) {
+	var consensus shared.OnionRouterInfos
+	if err := or.dirServer.Call("DServer.GetConsensus", true, &consensus); err != nil {
+		return shared.SelfTestFailed, err
+	}
+	var others []shared.OnionRouterInfo
+	for _, info := range consensus.ORInfos {
+		if info.Address != or.addr && info.Offers(shared.CapabilityMeasurement) {
+			others = append(others, info)
+		}
+	}
+	if len(others) < 2 {
+		return shared.SelfTestUntestable, nil
+	}
+	first := int(util.Random.Uint32() % uint32(len(others)))
+	second := int(util.Random.Uint32() % uint32(len(others)-1))
+	if second >= first {
+		second++
+	}
+	path := []shared.OnionRouterInfo{
+		others[first],
+		{Address: or.addr, PubKey: or.pubKey},
+		others[second],
+	}
+
+	if err := sendSelfTest(path); err != nil {
+		return shared.SelfTestFailed, err
+	}
+	return shared.SelfTestPassed, nil
+}
+
+// One hop of the self-test circuit
+type selfTestHop struct {
+	block        cipher.Block
+	circuitId    uint32
+	destroyToken []byte
+}
+
+func sendSelfTest(path []shared.OnionRouterInfo) error {
+	hops := make([]selfTestHop, len(path))
+	var guard *rpc.Client
+	defer func() {
+		if guard != nil {
+			guard.Close()
+		}
+	}()
+	for i, info := range path {
+		client, err := DialOR(info.Address)
+		if err != nil {
+			return err
+		}
+		key := util.GenerateAESKey()
+		hops[i], err = createSelfTestHop(client, info, key)
+		secmem.Wipe(key)
+		if i == 0 {
+			guard = client
+		} else {
+			client.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	defer guard.Go("ORServer.DestroyCircuit", shared.DestroyNotice{CircuitId: hops[0].circuitId, Reason: shared.DestroySelfTest, Token: hops[0].destroyToken}, new(bool), nil)
+
+	req := shared.MeasureRequest{Data: make([]byte, selfTestSize)}
+	if _, err := util.Random.Read(req.Data); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	onion, err := shared.SealBinaryOnion(hops[len(hops)-1].block, shared.Onion{IsExitNode: true, Command: shared.CommandMeasure, Data: payload}, util.Random)
+	if err != nil {
+		return err
+	}
+	for i := len(hops) - 2; i >= 0; i-- {
+		next := shared.Onion{NextAddress: path[i+1].Address, NextCircuitId: hops[i+1].circuitId, Data: onion}
+		if shared.SupportsFeature(path[i].ProtocolVersion, shared.FeatureDestroyTokens) {
+			next.DestroyToken = hops[i+1].destroyToken
+		}
+		if onion, err = shared.SealBinaryOnion(hops[i].block, next, util.Random); err != nil {
+			return err
+		}
+	}
+
+	reply, err := callRelay(guard, path[0].Address, shared.RelayPoll, shared.Cell{CircuitId: hops[0].circuitId, Data: onion})
+	if err != nil {
+		return err
+	}
+	if reply.Polling == nil || len(reply.Polling.Measurement) != selfTestSize {
+		return selfTestMismatchError
+	}
+	return nil
+}
+
+// Sends a router the key of a new self-test circuit
+func createSelfTestHop(client *rpc.Client, info shared.OnionRouterInfo, key []byte) (selfTestHop, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return selfTestHop{}, err
+	}
+	encryptedKey, err := util.RSAEncrypt(info.PubKey, key)
+	if err != nil {
+		return selfTestHop{}, err
+	}
+
+	hop := selfTestHop{block: block, destroyToken: shared.DestroyToken(key)}
+	err = client.Call("ORServer.CreateCircuit", shared.CircuitInfo{EncryptedSharedKey: encryptedKey}, &hop.circuitId)
+	return hop, err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+
+	"../shared"
+	"../util/retry"
+)
+
+// Stands in for the directory server, answering with a fixed consensus
+type testDirectory struct {
+	consensus shared.OnionRouterInfos
+}
+
+func (d *testDirectory) GetConsensus(signed bool, consensus *shared.OnionRouterInfos) error {
+	*consensus = d.consensus
+	return nil
+}
+
+// Serves d, a testDirectory or another stand in, as the directory server
+func testDirectoryClient(t *testing.T, d interface{}) *retry.Client {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	if err = server.RegisterName("DServer", d); err != nil {
+		t.Fatal(err)
+	}
+	go server.Accept(listener)
+	client := retry.NewClient(retry.Interactive, "tcp", listener.Addr().String())
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCheckSelfTest(t *testing.T) {
+	defer setSelfTestResult("")
+	for result, want := range map[string]error{
+		"":                        selfTestPendingError,
+		shared.SelfTestPassed:     nil,
+		shared.SelfTestUntestable: nil,
+		shared.SelfTestFailed:     selfTestFailedError,
+	} {
+		setSelfTestResult(result)
+		if err := checkSelfTest(); err != want {
+			t.Errorf("a self-test result of %q gave %v, want %v", result, err, want)
+		}
+	}
+}
+
+func TestSelfTestOnce(t *testing.T) {
+	// A closed port, so building a circuit through it fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	dir := &testDirectory{consensus: shared.OnionRouterInfos{ORInfos: []shared.OnionRouterInfo{
+		{Address: "127.0.0.1:8001", ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement},
+		{Address: closed, ProtocolVersion: shared.ProtocolVersion, Capabilities: shared.CapabilityMeasurement},
+		{Address: "127.0.0.1:8003", ProtocolVersion: shared.ProtocolVersion}, // doesn't answer measure cells
+	}}}
+	or := &OnionRouter{addr: "127.0.0.1:8001", dirServer: testDirectoryClient(t, dir)}
+	if result, err := or.selfTestOnce(); result != shared.SelfTestUntestable || err != nil {
+		t.Fatalf("with one other router the self-test was %q, %v", result, err)
+	}
+
+	dir.consensus.ORInfos[2].Capabilities = shared.CapabilityMeasurement
+	dir.consensus.ORInfos[2].Address = closed
+	if result, err := or.selfTestOnce(); result != shared.SelfTestFailed || err == nil {
+		t.Fatalf("through unreachable routers the self-test was %q, %v", result, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/faults"
+)
+
+type StreamError error
+
+// Stream configurations
+const (
+	defaultMaxStreamsPerCircuit int           = 16
+	streamConnectTimeout        time.Duration = 10 * time.Second
+	streamWriteTimeout          time.Duration = 10 * time.Second
+	streamPollWait              time.Duration = 200 * time.Millisecond // a StreamData without data waits this long for some
+	streamBufferChunks          int           = 64                     // read ahead per stream, in chunks of shared.MaxStreamData
+)
+
+var (
+	// Stream Errors
+	streamsDisabledError StreamError = errors.New("This exit node does not open streams")
+	tooManyStreamsError  StreamError = errors.New("Circuit has too many open streams")
+	streamInUseError     StreamError = errors.New("Stream id is already in use on this circuit")
+	unknownStreamError   StreamError = errors.New("No stream with this id on this circuit")
+
+	// Streams the exit node has open, by circuit and stream id
+	streams = struct {
+		sync.Mutex
+		byCircuit map[uint32]map[uint32]*exitStream
+	}{byCircuit: make(map[uint32]map[uint32]*exitStream)}
+
+	exitStreams          = false // open streams proxies ask for; set by -exit-streams
+	maxStreamsPerCircuit = defaultMaxStreamsPerCircuit
+)
+
+// A TCP connection the exit node opened for a proxy. A goroutine reads ahead
+// into chunks, so the destination isn't read faster than the proxy polls.
+type exitStream struct {
+	sync.Mutex // held while a stream command is handled
+	conn       net.Conn
+	chunks     chan []byte // closed when the destination closes its side
+	pending    []byte      // rest of a chunk that didn't fit in the last response
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// Closes the connection and stops reading ahead
+func (stream *exitStream) close() {
+	stream.closeOnce.Do(func() {
+		close(stream.done)
+		stream.conn.Close()
+	})
+}
+
+// Like DecryptPollingCell, but the exit node handles a stream command itself
+func (s *ORServer) DecryptStreamCell(cell shared.Cell, resp *shared.StreamResponse) error {
+	streamResp, err := s.decryptStreamCell(untypedStreamCell, cell)
+	if err != nil {
+		return err
+	}
+	*resp = streamResp
+	return nil
+}
+
+// Handles a stream cell of the relay command, or untypedStreamCell, which
+// goes on to the next router untyped too
+func (s *ORServer) decryptStreamCell(command shared.RelayCommand, cell shared.Cell) (resp shared.StreamResponse, err error) {
+	defer func() { recordCellResult(cellStream, len(cell.Data), err) }()
+	defer recoverCell(&err)
+
+	currOnion, err := decryptCell(cell, cellStream)
+	defer wipeLayer(cell, currOnion)
+	if err != nil {
+		return resp, err
+	}
+
+	if currOnion.IsExitNode {
+		if command != untypedStreamCell && command != shared.StreamRelayCommand(currOnion.Command) {
+			return resp, malformed("%v cell carries stream command %q", command, currOnion.Command)
+		}
+		return handleStreamCommand(cell.CircuitId, currOnion.Command, currOnion.Data)
+	}
+
+	next := shared.Cell{CircuitId: relayCircuitId(cell.CircuitId, currOnion), Data: currOnion.Data}
+	reply, err := s.OnionRouter.forwardCell(currOnion.NextAddress, command, next)
+	if err != nil {
+		util.HandleNonFatalError("Could not relay stream cell to next OR: "+currOnion.NextAddress, err)
+		return resp, err
+	}
+	if reply.Stream != nil {
+		resp = *reply.Stream
+	}
+	return resp, nil
+}
+
+func handleStreamCommand(circuitId uint32, command string, data []byte) (shared.StreamResponse, error) {
+	if !exitStreams {
+		return shared.StreamResponse{}, streamsDisabledError
+	}
+
+	switch command {
+	case shared.CommandStreamBegin:
+		var begin shared.StreamBegin
+		if err := decodePayload(data, &begin); err != nil {
+			return shared.StreamResponse{}, err
+		}
+		return shared.StreamResponse{}, openStream(circuitId, begin)
+	case shared.CommandStreamData:
+		var streamData shared.StreamData
+		if err := decodePayload(data, &streamData); err != nil {
+			return shared.StreamResponse{}, err
+		}
+		if len(streamData.Data) > shared.MaxStreamData {
+			return shared.StreamResponse{}, malformed("stream data of %d bytes, at most %d allowed", len(streamData.Data), shared.MaxStreamData)
+		}
+		return exchangeStreamData(circuitId, streamData)
+	case shared.CommandStreamEnd:
+		var end shared.StreamEnd
+		if err := decodePayload(data, &end); err != nil {
+			return shared.StreamResponse{}, err
+		}
+		if stream := removeStream(circuitId, end.StreamId); stream != nil {
+			stream.close()
+		}
+		return shared.StreamResponse{Closed: true}, nil
+	default:
+		return shared.StreamResponse{}, malformed("unknown stream command %q", command)
+	}
+}
+
+func openStream(circuitId uint32, begin shared.StreamBegin) error {
+	if !validAddress(begin.Address) {
+		return malformed("stream address %q is not host:port", begin.Address)
+	}
+	dialAddr, err := checkExitPolicy(begin.Address)
+	if err != nil {
+		return err
+	}
+
+	streams.Lock()
+	open := streams.byCircuit[circuitId]
+	if _, ok := open[begin.StreamId]; ok {
+		streams.Unlock()
+		return streamInUseError
+	}
+	if len(open) >= maxStreamsPerCircuit {
+		streams.Unlock()
+		return tooManyStreamsError
+	}
+	streams.Unlock()
+
+	conn, err := faults.DialTimeout("tcp", dialAddr, streamConnectTimeout)
+	if err != nil {
+		return err
+	}
+	stream := &exitStream{conn: conn, chunks: make(chan []byte, streamBufferChunks), done: make(chan struct{})}
+
+	streams.Lock()
+	// The circuit may have been torn down or the id taken while dialing
+	circuits.Lock()
+	_, circuitOpen := circuits.byId[circuitId]
+	circuits.Unlock()
+	if _, taken := streams.byCircuit[circuitId][begin.StreamId]; taken || !circuitOpen {
+		streams.Unlock()
+		conn.Close()
+		if taken {
+			return streamInUseError
+		}
+		return unknownCircuitError
+	}
+	if streams.byCircuit[circuitId] == nil {
+		streams.byCircuit[circuitId] = make(map[uint32]*exitStream)
+	}
+	streams.byCircuit[circuitId][begin.StreamId] = stream
+	streams.Unlock()
+
+	go stream.readAhead()
+	util.OutLog.Printf("Opened stream %d on circuit %d to %s\n", begin.StreamId, circuitId, begin.Address)
+	return nil
+}
+
+func (stream *exitStream) readAhead() {
+	defer close(stream.chunks)
+	for {
+		buf := make([]byte, shared.MaxStreamData)
+		n, err := stream.conn.Read(buf)
+		if n > 0 {
+			select {
+			case stream.chunks <- buf[:n]:
+			case <-stream.done:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Writes data to the stream and returns what the destination sent since the
+// last call, waiting up to streamPollWait for some if data is empty
+func exchangeStreamData(circuitId uint32, streamData shared.StreamData) (shared.StreamResponse, error) {
+	streams.Lock()
+	stream, ok := streams.byCircuit[circuitId][streamData.StreamId]
+	streams.Unlock()
+	if !ok {
+		return shared.StreamResponse{}, unknownStreamError
+	}
+
+	stream.Lock()
+	defer stream.Unlock()
+
+	if len(streamData.Data) > 0 {
+		stream.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := stream.conn.Write(streamData.Data); err != nil {
+			removeStream(circuitId, streamData.StreamId)
+			stream.close()
+			return shared.StreamResponse{}, err
+		}
+	}
+
+	var resp shared.StreamResponse
+	if len(stream.pending) == 0 && len(streamData.Data) == 0 {
+		select {
+		case chunk, ok := <-stream.chunks:
+			if !ok {
+				return stream.closed(circuitId, streamData.StreamId), nil
+			}
+			stream.pending = chunk
+		case <-time.After(streamPollWait):
+		}
+	}
+
+	for len(resp.Data) < shared.MaxStreamData {
+		if len(stream.pending) == 0 {
+			select {
+			case chunk, ok := <-stream.chunks:
+				if !ok {
+					if len(resp.Data) == 0 {
+						return stream.closed(circuitId, streamData.StreamId), nil
+					}
+					return resp, nil
+				}
+				stream.pending = chunk
+			default:
+				return resp, nil
+			}
+		}
+		n := shared.MaxStreamData - len(resp.Data)
+		if n > len(stream.pending) {
+			n = len(stream.pending)
+		}
+		resp.Data = append(resp.Data, stream.pending[:n]...)
+		stream.pending = stream.pending[n:]
+	}
+	return resp, nil
+}
+
+// Forgets a stream whose destination closed its side. Caller must hold the
+// stream's lock.
+func (stream *exitStream) closed(circuitId uint32, streamId uint32) shared.StreamResponse {
+	removeStream(circuitId, streamId)
+	stream.close()
+	return shared.StreamResponse{Closed: true}
+}
+
+func removeStream(circuitId uint32, streamId uint32) *exitStream {
+	streams.Lock()
+	defer streams.Unlock()
+
+	stream, ok := streams.byCircuit[circuitId][streamId]
+	if !ok {
+		return nil
+	}
+	delete(streams.byCircuit[circuitId], streamId)
+	if len(streams.byCircuit[circuitId]) == 0 {
+		delete(streams.byCircuit, circuitId)
+	}
+	return stream
+}
+
+// Closes every stream of a circuit being torn down
+func closeCircuitStreams(circuitId uint32) {
+	streams.Lock()
+	open := streams.byCircuit[circuitId]
+	delete(streams.byCircuit, circuitId)
+	streams.Unlock()
+
+	for _, stream := range open {
+		stream.close()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Echoes every connection on a loopback port back to itself
+func serveTestEchoStream(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 64)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func streamCommand(t *testing.T, circuitId uint32, command string, payload interface{}) (shared.StreamResponse, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handleStreamCommand(circuitId, command, data)
+}
+
+func TestStreams(t *testing.T) {
+	defer func(enabled bool) { exitStreams = enabled }(exitStreams)
+	destination := serveTestEchoStream(t)
+	circuitId := allocateCircuit([]byte("key"))
+	defer destroyCircuit(circuitId)
+
+	exitStreams = false
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: destination}); err != streamsDisabledError {
+		t.Fatalf("an exit without -exit-streams gave %v, want %v", err, streamsDisabledError)
+	}
+
+	exitStreams = true
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: destination}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: destination}); err != streamInUseError {
+		t.Fatalf("reusing a stream id gave %v, want %v", err, streamInUseError)
+	}
+
+	// What was written comes back in this or a later round trip
+	resp, err := streamCommand(t, circuitId, shared.CommandStreamData, shared.StreamData{StreamId: 1, Data: []byte("hello")})
+	for deadline := time.Now().Add(3 * time.Second); err == nil && len(resp.Data) == 0 && time.Now().Before(deadline); {
+		resp, err = streamCommand(t, circuitId, shared.CommandStreamData, shared.StreamData{StreamId: 1})
+	}
+	if err != nil || string(resp.Data) != "hello" {
+		t.Fatalf("the stream gave %q, %v", resp.Data, err)
+	}
+
+	if resp, err = streamCommand(t, circuitId, shared.CommandStreamEnd, shared.StreamEnd{StreamId: 1}); err != nil || !resp.Closed {
+		t.Fatalf("ending the stream gave %+v, %v", resp, err)
+	}
+	if _, err = streamCommand(t, circuitId, shared.CommandStreamData, shared.StreamData{StreamId: 1}); err != unknownStreamError {
+		t.Fatalf("an ended stream gave %v, want %v", err, unknownStreamError)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	defer func(enabled bool, max int) { exitStreams, maxStreamsPerCircuit = enabled, max }(exitStreams, maxStreamsPerCircuit)
+	exitStreams, maxStreamsPerCircuit = true, 1
+	destination := serveTestEchoStream(t)
+	circuitId := allocateCircuit([]byte("key"))
+
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: "not an address"}); err == nil {
+		t.Fatal("a stream to an invalid address was opened")
+	}
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: destination}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 2, Address: destination}); err != tooManyStreamsError {
+		t.Fatalf("a stream over the limit gave %v, want %v", err, tooManyStreamsError)
+	}
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamData, shared.StreamData{StreamId: 1, Data: make([]byte, shared.MaxStreamData+1)}); err == nil {
+		t.Fatal("stream data over the limit was written")
+	}
+
+	// Tearing the circuit down closes its streams
+	destroyCircuit(circuitId)
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamData, shared.StreamData{StreamId: 1}); err != unknownStreamError {
+		t.Fatalf("a stream of a torn down circuit gave %v, want %v", err, unknownStreamError)
+	}
+	if _, err := streamCommand(t, circuitId, shared.CommandStreamBegin, shared.StreamBegin{StreamId: 1, Address: destination}); err != unknownCircuitError {
+		t.Fatalf("a stream on a torn down circuit gave %v, want %v", err, unknownCircuitError)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"strings"
+
+	"../util"
+	"../util/faults"
+	"../util/transport"
+)
+
+// -transport values: ip:port to listen on per transport, by name
+type transportAddrs map[string]string
+
+func (t transportAddrs) String() string {
+	var pairs []string
+	for name, addr := range t {
+		pairs = append(pairs, name+"="+addr)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (t transportAddrs) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || !validAddress(strings.SplitN(kv[1], "#", 2)[0]) {
+		return fmt.Errorf("expected name=ip:port, got %q", value)
+	}
+	if kv[0] == transport.TCP {
+		return fmt.Errorf("tcp is the onion router address")
+	}
+	if _, err := transport.Lookup(kv[0]); err != nil {
+		return err
+	}
+	t[kv[0]] = kv[1]
+	return nil
+}
+
+// Listens on every transport besides tcp the router was started with.
+// Returns the listeners and the addresses clients reach them on, which carry
+// more than ip:port for transports like obfs.
+func listenTransports(addrs transportAddrs) (map[string]net.Listener, transportAddrs) {
+	listeners := make(map[string]net.Listener)
+	advertised := make(transportAddrs)
+	for name, addr := range addrs {
+		inbound, err := transport.Listen(name, addr)
+		util.HandleFatalError("Could not listen on transport "+name, err)
+
+		listeners[name] = inbound
+		advertised[name] = addr
+		if advertiser, ok := inbound.(transport.Advertiser); ok {
+			advertised[name] = advertiser.Advertise()
+		}
+		util.OutLog.Printf("Accepting links over %s, reach this router with %s:%s\n", name, name, advertised[name])
+	}
+	return listeners, advertised
+}
+
+func serveTransports(server *rpc.Server, listeners map[string]net.Listener) {
+	for _, inbound := range listeners {
+		go serveRPC(server, faults.Listen(inbound))
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransportAddrs(t *testing.T) {
+	addrs := make(transportAddrs)
+	for _, value := range []string{"tcp=127.0.0.1:9001", "quic=127.0.0.1:9001", "ws", "ws=localhost", "=127.0.0.1:9001"} {
+		if err := addrs.Set(value); err == nil {
+			t.Fatalf("-transport %s was accepted", value)
+		}
+	}
+	if len(addrs) != 0 {
+		t.Fatalf("rejected values left %v", addrs)
+	}
+	if err := addrs.Set("ws=127.0.0.1:9001"); err != nil || addrs["ws"] != "127.0.0.1:9001" {
+		t.Fatalf("-transport ws=127.0.0.1:9001 gave %v, %v", addrs, err)
+	}
+	if err := addrs.Set("obfs=127.0.0.1:9002#secret"); err != nil {
+		t.Fatalf("an obfs address with a secret gave %v", err)
+	}
+}
+
+func TestListenTransportsAdvertiseSecrets(t *testing.T) {
+	listeners, advertised := listenTransports(transportAddrs{"obfs": "127.0.0.1:0"})
+	for _, inbound := range listeners {
+		defer inbound.Close()
+	}
+	if parts := strings.Split(advertised["obfs"], "#"); len(parts) != 2 || !validAddress(parts[0]) || len(parts[1]) != 64 {
+		t.Fatalf("obfs is advertised as %q", advertised["obfs"])
+	}
+}
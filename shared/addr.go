@@ -0,0 +1,107 @@
+package shared
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type InvalidAddressError error
+
+// Address families
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+
+	// Two routers in one circuit never share a subnet this large, as they
+	// are likely run by one operator or watched by one network
+	subnetBitsIPv4 int = 16
+	subnetBitsIPv6 int = 32
+
+	// IPv6 hosts usually get a whole /64, so limits per host apply to it
+	hostBitsIPv6 int = 64
+)
+
+var (
+	// Address Errors
+	invalidAddressError InvalidAddressError = errors.New("Address is not host:port, with IPv6 literals in brackets")
+)
+
+// Returns address in one spelling per endpoint, so an address can key a map
+// however it was typed: IP literals in their shortest form (IPv4-mapped IPv6
+// turned into IPv4), IPv6 in brackets, host names in lower case.
+func CanonicalAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return "", invalidAddressError
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", invalidAddressError
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), port), nil
+	}
+	if strings.Contains(host, ":") {
+		// Zoned or otherwise unparseable IPv6
+		return "", invalidAddressError
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// Returns FamilyIPv4 or FamilyIPv6 for an address with an IP literal, or ""
+// for a host name
+func AddressFamily(address string) string {
+	ip := addressIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+// Returns the subnet two routers in a circuit must not share: the /16 of an
+// IPv4 address or the /32 of an IPv6 one. Loopback addresses and host names
+// have none, so a test network on one machine can still build circuits.
+func DiversitySubnet(address string) string {
+	ip := addressIP(address)
+	if ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(subnetBitsIPv4, 32)), Mask: net.CIDRMask(subnetBitsIPv4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(subnetBitsIPv6, 128)), Mask: net.CIDRMask(subnetBitsIPv6, 128)}).String()
+}
+
+// Returns the diversity subnets of every address an OR is reached on
+func (info OnionRouterInfo) DiversitySubnets() []string {
+	var subnets []string
+	for _, address := range append([]string{info.Address}, info.AltAddresses...) {
+		if subnet := DiversitySubnet(address); subnet != "" {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// Returns the key per-host limits count host under: an IPv4 address itself,
+// or the /64 of an IPv6 one, which a host can hop around in freely
+func HostKey(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(hostBitsIPv6, 128)), Mask: net.CIDRMask(hostBitsIPv6, 128)}).String()
+}
+
+func addressIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.ParseIP(host)
+}
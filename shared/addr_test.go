@@ -0,0 +1,47 @@
+package shared
+
+import "testing"
+
+func TestCanonicalAddress(t *testing.T) {
+	for address, want := range map[string]string{
+		"127.0.0.1:8001":                   "127.0.0.1:8001",
+		"[2001:DB8:0:0::1]:8001":           "[2001:db8::1]:8001",
+		"[::ffff:10.0.0.1]:8001":           "10.0.0.1:8001",
+		"Router.Example.ORG:8001":          "router.example.org:8001",
+		"[2001:db8:0000:0000:0:0:0:1]:443": "[2001:db8::1]:443",
+	} {
+		if canonical, err := CanonicalAddress(address); err != nil || canonical != want {
+			t.Fatalf("%s is %q, %v, want %q", address, canonical, err, want)
+		}
+	}
+	for _, address := range []string{"127.0.0.1", "2001:db8::1:8001", ":8001", "127.0.0.1:70000", "[fe80::1%eth0]:8001"} {
+		if _, err := CanonicalAddress(address); err != invalidAddressError {
+			t.Fatalf("%s gave %v, want %v", address, err, invalidAddressError)
+		}
+	}
+}
+
+func TestDiversitySubnets(t *testing.T) {
+	for address, want := range map[string]string{
+		"10.1.2.3:8001":         "10.1.0.0/16",
+		"[2001:db8:1:2::1]:80":  "2001:db8::/32",
+		"127.0.0.1:8001":        "",
+		"[::1]:8001":            "",
+		"router.example.org:80": "",
+	} {
+		if subnet := DiversitySubnet(address); subnet != want {
+			t.Fatalf("%s is in %q, want %q", address, subnet, want)
+		}
+	}
+	info := OnionRouterInfo{Address: "10.1.2.3:8001", AltAddresses: []string{"[2001:db8::1]:8001"}}
+	if subnets := info.DiversitySubnets(); len(subnets) != 2 || subnets[1] != "2001:db8::/32" {
+		t.Fatalf("a dual-stack router is in %v", subnets)
+	}
+
+	if AddressFamily("10.1.2.3:8001") != FamilyIPv4 || AddressFamily("[2001:db8::1]:8001") != FamilyIPv6 || AddressFamily("example.org:80") != "" {
+		t.Fatal("address families are mixed up")
+	}
+	if HostKey("2001:db8::1") != "2001:db8::/64" || HostKey("2001:db8::2") != HostKey("2001:db8::1") || HostKey("10.0.0.1") != "10.0.0.1" {
+		t.Fatal("IPv6 hosts aren't counted per /64")
+	}
+}
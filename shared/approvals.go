@@ -0,0 +1,49 @@
+package shared
+
+// Actions of a ContactRequest, and kinds of ContactEvent
+const (
+	ContactRequested = "request"
+	ContactAccepted  = "accept"
+	ContactDeclined  = "decline"
+)
+
+// Asks the IRC server to approve Contact, or to ask Contact for approval. In
+// namespaces with ContactApproval set, users only get direct messages from
+// the contacts they approved. Sent in data cells as CommandContactRequest.
+type ContactRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	Contact       string
+	Action        string // ContactRequested, ContactAccepted or ContactDeclined
+}
+
+// Another user asked the polling user for approval, or answered their request
+type ContactEvent struct {
+	From string
+	Kind string // ContactRequested, ContactAccepted or ContactDeclined
+}
+
+func (e ContactEvent) String() string {
+	switch e.Kind {
+	case ContactRequested:
+		return "*** " + e.From + " asks to be your contact: /contact accept " + e.From + " or /contact decline " + e.From
+	case ContactAccepted:
+		return "*** " + e.From + " accepted you as a contact"
+	default:
+		return "*** " + e.From + " declined you as a contact"
+	}
+}
+
+// Asks the IRC server to drop what Blocked sends to the sender's inbox, or to
+// stop. Sent in data cells as CommandBlockUser. Channel messages are still
+// published; the blocker's proxy hides them.
+type BlockRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	Blocked       string
+	Unblock       bool `json:",omitempty"`
+}
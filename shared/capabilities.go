@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Optional abilities of a node, one bit each. A ProtocolVersion says what a
+// node's build understands; its capabilities say what it does with that
+// build and its configuration, so a feature can be turned on router by
+// router across a network running mixed builds.
+type Capabilities uint64
+
+const (
+	CapabilityExitStreams  Capabilities = 1 << iota // opens TCP streams as an exit
+	CapabilityLinkPadding                           // sends or takes padding cells on its links
+	CapabilityMeasurement                           // answers measurement cells as an exit
+	CapabilityPushDelivery                          // reserved: delivers messages without being polled
+	CapabilityGCMCells                              // reserved: cell layers sealed with AES-GCM
+	CapabilityQUIC                                  // reserved: links over QUIC
+	CapabilityCompression                           // reserved: compressed cell payloads
+)
+
+// Names of the capabilities, in bit order. Reserved ones are defined so
+// every build agrees on their bits, but no component sets them yet.
+var capabilityNames = []string{
+	"exit-streams",
+	"link-padding",
+	"measurement",
+	"push-delivery",
+	"gcm-cells",
+	"quic",
+	"compression",
+}
+
+func (c Capabilities) Has(capability Capabilities) bool {
+	return c&capability == capability
+}
+
+// Names of the set capabilities, and the bit number of unknown ones
+func (c Capabilities) Names() []string {
+	var names []string
+	for bit := uint(0); bit < 64; bit++ {
+		if c&(1<<bit) == 0 {
+			continue
+		}
+		if int(bit) < len(capabilityNames) {
+			names = append(names, capabilityNames[bit])
+		} else {
+			names = append(names, fmt.Sprintf("bit-%d", bit))
+		}
+	}
+	return names
+}
+
+func (c Capabilities) String() string {
+	if c == 0 {
+		return "none"
+	}
+	return strings.Join(c.Names(), ",")
+}
+
+// Parses a comma separated list of capability names
+func ParseCapabilities(spec string) (Capabilities, error) {
+	var c Capabilities
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for bit, known := range capabilityNames {
+			if known == name {
+				c |= 1 << uint(bit)
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q, expected one of %s", name, strings.Join(capabilityNames, ", "))
+		}
+	}
+	return c, nil
+}
+
+// What a node from before capability flags does, going by the features its
+// version has and the exit streams flag descriptors carried before
+func LegacyCapabilities(version int, exitStreams bool) Capabilities {
+	var c Capabilities
+	if exitStreams {
+		c |= CapabilityExitStreams
+	}
+	if SupportsFeature(version, FeatureLinkPadding) {
+		c |= CapabilityLinkPadding
+	}
+	if SupportsFeature(version, FeatureMeasurement) {
+		c |= CapabilityMeasurement
+	}
+	return c
+}
+
+// The capabilities the OR published, or those of its version for ORs from
+// before capability flags
+func (info OnionRouterInfo) Offered() Capabilities {
+	if SupportsFeature(info.ProtocolVersion, FeatureCapabilities) {
+		return info.Capabilities
+	}
+	return LegacyCapabilities(info.ProtocolVersion, info.ExitStreams)
+}
+
+func (info OnionRouterInfo) Offers(capability Capabilities) bool {
+	return info.Offered().Has(capability)
+}
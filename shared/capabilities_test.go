@@ -0,0 +1,43 @@
+package shared
+
+import "testing"
+
+func TestCapabilityNames(t *testing.T) {
+	c := CapabilityExitStreams | CapabilityMeasurement | 1<<40
+	if got, want := c.String(), "exit-streams,measurement,bit-40"; got != want {
+		t.Fatalf("rendered %q, want %q", got, want)
+	}
+	if got := Capabilities(0).String(); got != "none" {
+		t.Fatalf("no capabilities rendered as %q", got)
+	}
+	if !c.Has(CapabilityExitStreams|CapabilityMeasurement) || c.Has(CapabilityExitStreams|CapabilityLinkPadding) {
+		t.Fatal("Has doesn't need every capability asked for")
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	c, err := ParseCapabilities(" link-padding, quic,,")
+	if err != nil || c != CapabilityLinkPadding|CapabilityQUIC {
+		t.Fatalf("parsed %v, %v", c, err)
+	}
+	if _, err = ParseCapabilities("link-padding,teleport"); err == nil {
+		t.Fatal("an unknown capability parsed")
+	}
+}
+
+func TestOfferedCapabilities(t *testing.T) {
+	// Capability flags are only read from ORs that publish them
+	info := OnionRouterInfo{ProtocolVersion: ProtocolVersion, Capabilities: CapabilityLinkPadding, ExitStreams: true}
+	if got := info.Offered(); got != CapabilityLinkPadding {
+		t.Fatalf("a current OR offers %v", got)
+	}
+	capabilities, _ := FeatureByName(FeatureCapabilities)
+	info.ProtocolVersion = capabilities.MinVersion - 1
+	if got, want := info.Offered(), CapabilityExitStreams|CapabilityLinkPadding|CapabilityMeasurement; got != want {
+		t.Fatalf("an OR from before capabilities offers %v, want %v", got, want)
+	}
+	info.ProtocolVersion, info.ExitStreams = 1, false
+	if got := info.Offered(); got != 0 {
+		t.Fatalf("a first version OR offers %v", got)
+	}
+}
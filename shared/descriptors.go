@@ -0,0 +1,71 @@
+package shared
+
+import (
+	"crypto/rsa"
+	"runtime"
+	"strings"
+)
+
+// What a router says about itself, signed with its identity key. The
+// directory stores the latest one and serves it as signed, so filtering
+// routers on it, and holding operators to it, doesn't rest on the
+// directory's word.
+type Descriptor struct {
+	Address         string
+	ProtocolVersion int
+	Platform        string // Go version, OS and architecture, see Platform
+	Published       int64  // unix nanoseconds, later in every descriptor a router publishes
+	Contact         string `json:",omitempty"`
+	ExitPolicy      string `json:",omitempty"` // as in OnionRouterInfo
+	ExitStreams     bool   `json:",omitempty"`
+	Capabilities    Capabilities
+	Bandwidth       uint64            // bytes per second the router sustained when it published
+	Transports      map[string]string `json:",omitempty"`
+	AltAddresses    []string          `json:",omitempty"`
+}
+
+// A descriptor as the directory serves it, with the key that signed it
+type SignedDescriptor struct {
+	Descriptor Descriptor
+	PubKey     *rsa.PublicKey
+	Signature  []byte // over DescriptorSigningBytes
+}
+
+// Which descriptors DServer.GetDescriptors returns. Zero fields match every
+// descriptor.
+type DescriptorFilter struct {
+	Platform           string       // contained in the descriptor's platform, e.g. "linux"
+	MinProtocolVersion int          // lowest ProtocolVersion
+	Capabilities       Capabilities // all of which the router offers
+	ExitsTo            string       // ip:port the router's exit policy accepts
+	WithContact        bool         // only routers whose operator gave a contact
+}
+
+// The platform of this build, as descriptors publish it
+func Platform() string {
+	return runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// The descriptor's fields as a directory entry, to check them like one
+func (d Descriptor) Info() OnionRouterInfo {
+	return OnionRouterInfo{
+		Address:         d.Address,
+		ProtocolVersion: d.ProtocolVersion,
+		Bandwidth:       d.Bandwidth,
+		Transports:      d.Transports,
+		AltAddresses:    d.AltAddresses,
+		ExitPolicy:      d.ExitPolicy,
+		ExitStreams:     d.ExitStreams,
+		Capabilities:    d.Capabilities,
+		Contact:         d.Contact,
+	}
+}
+
+func (f DescriptorFilter) Matches(d Descriptor) bool {
+	info := d.Info()
+	return strings.Contains(d.Platform, f.Platform) &&
+		d.ProtocolVersion >= f.MinProtocolVersion &&
+		info.Offers(f.Capabilities) &&
+		info.ExitsTo(f.ExitsTo, false) &&
+		(!f.WithContact || d.Contact != "")
+}
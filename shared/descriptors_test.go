@@ -0,0 +1,37 @@
+package shared
+
+import "testing"
+
+func TestDescriptorFilter(t *testing.T) {
+	d := Descriptor{
+		Address:         "127.0.0.1:8001",
+		ProtocolVersion: ProtocolVersion,
+		Platform:        "go1.22 linux/amd64",
+		ExitPolicy:      "accept *:6667,reject *:*",
+		Capabilities:    CapabilityMeasurement | CapabilityLinkPadding,
+		Contact:         "ops@example.org",
+	}
+	for _, f := range []DescriptorFilter{
+		{},
+		{Platform: "linux", MinProtocolVersion: ProtocolVersion},
+		{Capabilities: CapabilityMeasurement, ExitsTo: "1.2.3.4:6667", WithContact: true},
+	} {
+		if !f.Matches(d) {
+			t.Errorf("%+v doesn't match", f)
+		}
+	}
+	for _, f := range []DescriptorFilter{
+		{Platform: "windows"},
+		{MinProtocolVersion: ProtocolVersion + 1},
+		{Capabilities: CapabilityExitStreams},
+		{ExitsTo: "1.2.3.4:80"},
+	} {
+		if f.Matches(d) {
+			t.Errorf("%+v matches", f)
+		}
+	}
+	d.Contact = ""
+	if (DescriptorFilter{WithContact: true}).Matches(d) {
+		t.Fatal("a router without a contact matched")
+	}
+}
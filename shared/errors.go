@@ -0,0 +1,213 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const throttledPrefix = "THROTTLED"
+const expiredPrefix = "EXPIRED"
+const malformedPrefix = "MALFORMED"
+const proofOfWorkPrefix = "POW_REQUIRED"
+const enrollmentPendingPrefix = "ENROLLMENT_PENDING"
+const postingKeyExpiredPrefix = "POSTING_KEY_EXPIRED"
+const noPrekeysPrefix = "NO_PREKEYS"
+const rosterConflictPrefix = "ROSTER_CONFLICT"
+const addressInUsePrefix = "ADDRESS_IN_USE"
+const encodingPrefix = "BAD_ENCODING"
+const unavailablePrefix = "UNAVAILABLE"
+const internalPrefix = "INTERNAL"
+
+// Codes of the errors in this file, each leading its Error() so it survives
+// being passed over RPC as a string. ErrorCode recovers it.
+const (
+	CodeThrottled         = throttledPrefix
+	CodeExpired           = expiredPrefix
+	CodeMalformed         = malformedPrefix
+	CodeProofOfWork       = proofOfWorkPrefix
+	CodeEnrollmentPending = enrollmentPendingPrefix
+	CodePostingKeyExpired = postingKeyExpiredPrefix
+	CodeNoPrekeys         = noPrekeysPrefix
+	CodeRosterConflict    = rosterConflictPrefix
+	CodeAddressInUse      = addressInUsePrefix
+	CodeEncoding          = encodingPrefix    // a payload did not marshal or unmarshal
+	CodeUnavailable       = unavailablePrefix // the next hop or the chat server could not be reached
+	CodeInternal          = internalPrefix    // a failure unrelated to the request, safe to retry
+)
+
+var errorCodes = []string{CodeThrottled, CodeExpired, CodeMalformed, CodeProofOfWork, CodeEnrollmentPending,
+	CodePostingKeyExpired, CodeNoPrekeys, CodeRosterConflict, CodeAddressInUse, CodeEncoding, CodeUnavailable, CodeInternal}
+
+// An error with one of the codes above, for failures without an error type
+// of their own
+type CodedError struct {
+	Code   string
+	Reason string
+}
+
+func (e CodedError) Error() string {
+	return e.Code + ": " + e.Reason
+}
+
+func EncodingError(what string, err error) error {
+	return CodedError{Code: CodeEncoding, Reason: what + " does not encode: " + err.Error()}
+}
+
+// Keeps the code of an error that already has one, as from a router further
+// along the circuit
+func UnavailableError(what string, err error) error {
+	if ErrorCode(err) != "" {
+		return err
+	}
+	return CodedError{Code: CodeUnavailable, Reason: "Could not reach " + what + ": " + err.Error()}
+}
+
+func InternalError(what string, err error) error {
+	return CodedError{Code: CodeInternal, Reason: what + ": " + err.Error()}
+}
+
+// The code of an error from this file, also after it was passed over RPC as
+// a string; "" for any other error
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	text := err.Error()
+	for _, code := range errorCodes {
+		if strings.HasPrefix(text, code+":") || strings.HasPrefix(text, code+" ") {
+			return code
+		}
+	}
+	return ""
+}
+
+// Whether sending the same request again is bound to fail the same way
+func IsPermanentError(err error) bool {
+	switch ErrorCode(err) {
+	case CodeExpired, CodeMalformed, CodeEncoding:
+		return true
+	}
+	return false
+}
+
+// Final failure of a message with a deadline: it was not delivered in time and
+// nothing will try to deliver it again.
+var ExpiredError = errors.New(expiredPrefix + ": Message was not delivered before its deadline")
+
+// Returned by the IRC server when a user or exit node publishes too fast.
+// net/rpc only carries error strings, so the fields are encoded in Error()
+// and recovered anywhere along the circuit with ParseThrottledError.
+type ThrottledError struct {
+	Scope      string // "user" or "exit"
+	RetryAfter time.Duration
+}
+
+func (e ThrottledError) Error() string {
+	return fmt.Sprintf("%s %s %d: Rate limit exceeded, retry after %v", throttledPrefix, e.Scope, e.RetryAfter.Nanoseconds()/int64(time.Millisecond), e.RetryAfter)
+}
+
+func ParseThrottledError(err error) (ThrottledError, bool) {
+	var e ThrottledError
+	if err == nil || !strings.HasPrefix(err.Error(), throttledPrefix+" ") {
+		return e, false
+	}
+
+	var retryAfterMs int64
+	if _, scanErr := fmt.Sscanf(err.Error(), throttledPrefix+" %s %d:", &e.Scope, &retryAfterMs); scanErr != nil {
+		return e, false
+	}
+	e.RetryAfter = time.Duration(retryAfterMs) * time.Millisecond
+	return e, true
+}
+
+// Returned by DServer.RegisterNode for an OR waiting for the directory
+// operator's approval. The OR registers again until it is approved.
+var EnrollmentPendingError = errors.New(enrollmentPendingPrefix + ": Onion router is waiting for the directory operator's approval")
+
+// Works on errors passed back over RPC as strings too
+func IsEnrollmentPendingError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), enrollmentPendingPrefix+":")
+}
+
+// Returned by DServer.RegisterNode for a new key on the address of an OR that
+// is still sending heartbeats. An OR that restarted with a fresh key registers
+// again once the directory times its old entry out.
+var AddressInUseError = errors.New(addressInUsePrefix + ": Address is registered to another key")
+
+// Works on errors passed back over RPC as strings too
+func IsAddressInUseError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), addressInUsePrefix+":")
+}
+
+// Returned by the IRC server for a posting token signed with a key it no
+// longer redeems. The proxy throws away the other tokens of that key.
+var PostingKeyExpiredError = errors.New(postingKeyExpiredPrefix + ": Posting token was signed with a key that has expired")
+
+// Works on errors passed back through the circuit as strings too
+func IsPostingKeyExpiredError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), postingKeyExpiredPrefix+":")
+}
+
+// Returned by the IRC server for a prekey bundle of a user whose proxy left
+// none, e.g. because it predates encrypted direct messages. The sender's
+// proxy falls back to sending in the clear.
+var NoPrekeysError = errors.New(noPrekeysPrefix + ": User has left no prekeys for encrypted direct messages")
+
+// Works on errors passed back through the circuit as strings too
+func IsNoPrekeysError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), noPrekeysPrefix+":")
+}
+
+// Returned by the IRC server for a roster put whose BaseVersion isn't the
+// stored blob's. The proxy fetches the blob, merges and tries again.
+var RosterConflictError = errors.New(rosterConflictPrefix + ": Roster was changed by another device")
+
+// Works on errors passed back through the circuit as strings too
+func IsRosterConflictError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), rosterConflictPrefix+":")
+}
+
+// Works on errors passed back through the circuit as strings too
+func IsExpiredError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), expiredPrefix+":")
+}
+
+// Returned by an onion router for a cell or payload that doesn't decode to
+// what its RPC expects. The cell is dropped without being relayed, and
+// sending it again won't help.
+type MalformedCellError struct {
+	Reason string
+}
+
+func (e MalformedCellError) Error() string {
+	return malformedPrefix + ": " + e.Reason
+}
+
+// Works on errors passed back through the circuit as strings too
+func IsMalformedCellError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), malformedPrefix+":")
+}
+
+// Returned by the IRC server when registering a username in the namespace
+// takes a proof of work the request didn't carry, or carried too little of.
+// Bits is encoded in Error() like ThrottledError's fields.
+type ProofOfWorkError struct {
+	Bits int
+}
+
+func (e ProofOfWorkError) Error() string {
+	return fmt.Sprintf("%s %d: Registering a username here takes a proof of work of %d bits", proofOfWorkPrefix, e.Bits, e.Bits)
+}
+
+func ParseProofOfWorkError(err error) (ProofOfWorkError, bool) {
+	var e ProofOfWorkError
+	if err == nil || !strings.HasPrefix(err.Error(), proofOfWorkPrefix+" ") {
+		return e, false
+	}
+	if _, scanErr := fmt.Sscanf(err.Error(), proofOfWorkPrefix+" %d:", &e.Bits); scanErr != nil {
+		return e, false
+	}
+	return e, true
+}
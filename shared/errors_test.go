@@ -0,0 +1,102 @@
+package shared
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseThrottledError(t *testing.T) {
+	sent := ThrottledError{Scope: "exit", RetryAfter: 1500 * time.Millisecond}
+
+	// net/rpc hands the error on as its string
+	parsed, ok := ParseThrottledError(errors.New(sent.Error()))
+	if !ok || parsed != sent {
+		t.Fatalf("%q parsed to %+v, %v", sent.Error(), parsed, ok)
+	}
+	for _, err := range []error{nil, errors.New("connection refused"), errors.New("THROTTLED")} {
+		if _, ok := ParseThrottledError(err); ok {
+			t.Fatalf("%v parsed as throttled", err)
+		}
+	}
+}
+
+func TestIsExpiredError(t *testing.T) {
+	if !IsExpiredError(ExpiredError) || !IsExpiredError(errors.New(ExpiredError.Error())) {
+		t.Fatal("an expired error passed on as a string wasn't recognised")
+	}
+	for _, err := range []error{nil, errors.New("EXPIRED"), errors.New("connection refused")} {
+		if IsExpiredError(err) {
+			t.Fatalf("%v is an expired error", err)
+		}
+	}
+}
+
+func TestIsMalformedCellError(t *testing.T) {
+	sent := MalformedCellError{Reason: "onion layer does not decode"}
+	if !IsMalformedCellError(sent) || !IsMalformedCellError(errors.New(sent.Error())) {
+		t.Fatal("a malformed cell error passed on as a string wasn't recognised")
+	}
+	for _, err := range []error{nil, errors.New("MALFORMED"), ExpiredError} {
+		if IsMalformedCellError(err) {
+			t.Fatalf("%v is a malformed cell error", err)
+		}
+	}
+}
+
+func TestParseProofOfWorkError(t *testing.T) {
+	sent := ProofOfWorkError{Bits: 20}
+	parsed, ok := ParseProofOfWorkError(errors.New(sent.Error()))
+	if !ok || parsed != sent {
+		t.Fatalf("%q parsed to %+v, %v", sent.Error(), parsed, ok)
+	}
+	for _, err := range []error{nil, errors.New("POW_REQUIRED"), ExpiredError} {
+		if _, ok := ParseProofOfWorkError(err); ok {
+			t.Fatalf("%v parsed as a proof of work error", err)
+		}
+	}
+}
+
+func TestIsEnrollmentPendingError(t *testing.T) {
+	if !IsEnrollmentPendingError(EnrollmentPendingError) || !IsEnrollmentPendingError(errors.New(EnrollmentPendingError.Error())) {
+		t.Fatal("a pending enrollment passed on as a string wasn't recognised")
+	}
+	if IsEnrollmentPendingError(nil) || IsEnrollmentPendingError(ExpiredError) {
+		t.Fatal("another error is a pending enrollment")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	for err, want := range map[error]string{
+		ExpiredError: CodeExpired,
+		errors.New(EncodingError("payload", errors.New("bad")).Error()):        CodeEncoding,
+		UnavailableError("onion router 127.0.0.1:8002", errors.New("refused")): CodeUnavailable,
+		errors.New("UNAVAILABLEISH: not a code"):                               "",
+		errors.New("connection refused"):                                       "",
+	} {
+		if code := ErrorCode(err); code != want {
+			t.Errorf("%v has code %q, want %q", err, code, want)
+		}
+	}
+	if ErrorCode(nil) != "" {
+		t.Fatal("no error has a code")
+	}
+
+	// A router further along the circuit already said what went wrong
+	if err := UnavailableError("onion router 127.0.0.1:8002", ExpiredError); err != ExpiredError {
+		t.Fatalf("the code of a coded error was replaced: %v", err)
+	}
+}
+
+func TestIsPermanentError(t *testing.T) {
+	for _, err := range []error{ExpiredError, MalformedCellError{Reason: "short"}, EncodingError("payload", errors.New("bad"))} {
+		if !IsPermanentError(errors.New(err.Error())) {
+			t.Errorf("%v isn't permanent", err)
+		}
+	}
+	for _, err := range []error{nil, InternalError("Could not generate id", errors.New("no entropy")), UnavailableError("IRC server", errors.New("refused"))} {
+		if IsPermanentError(err) {
+			t.Errorf("%v is permanent", err)
+		}
+	}
+}
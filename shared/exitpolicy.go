@@ -0,0 +1,236 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type ExitPolicyError error
+
+// Policy of exit nodes that don't declare one: they connect wherever
+// proxies ask, as every exit did before exit policies
+const DefaultExitPolicy = "accept *:*"
+
+var (
+	// Exit Policy Errors
+	exitPolicyRejectError ExitPolicyError = errors.New("Exit policy of this onion router rejects the destination")
+)
+
+// Destinations an exit node connects to, as accept and reject rules of which
+// the first matching one decides. A destination no rule matches is rejected.
+type ExitPolicy []ExitRule
+
+// One rule, e.g. "accept 1.2.3.4:6667", "reject 10.0.0.0/8:*",
+// "accept irc.example.org:6660-6669" or "reject [2001:db8::]/32:*"
+type ExitRule struct {
+	Accept  bool
+	Host    string     // host name, matched before resolving, or "" for an address rule
+	Network *net.IPNet // nil with Host or for *
+	MinPort int
+	MaxPort int
+}
+
+// Parses comma separated rules, e.g. "accept *:6667,reject *:*"
+func ParseExitPolicy(spec string) (ExitPolicy, error) {
+	var policy ExitPolicy
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		rule, err := parseExitRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		policy = append(policy, rule)
+	}
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("exit policy %q has no rules", spec)
+	}
+	return policy, nil
+}
+
+func parseExitRule(entry string) (ExitRule, error) {
+	var rule ExitRule
+	fields := strings.Fields(entry)
+	if len(fields) != 2 || (fields[0] != "accept" && fields[0] != "reject") {
+		return rule, fmt.Errorf("exit rule %q is not accept|reject host:port", entry)
+	}
+	rule.Accept = fields[0] == "accept"
+
+	target := fields[1]
+	colon := strings.LastIndex(target, ":")
+	if colon < 0 {
+		return rule, fmt.Errorf("exit rule %q has no port", entry)
+	}
+	host, ports := target[:colon], target[colon+1:]
+
+	var err error
+	if rule.MinPort, rule.MaxPort, err = parsePortRange(ports); err != nil {
+		return rule, fmt.Errorf("exit rule %q: %s", entry, err)
+	}
+
+	host = strings.TrimPrefix(host, "[")
+	if i := strings.Index(host, "]"); i >= 0 {
+		// [2001:db8::]/32 or [2001:db8::1]
+		host = host[:i] + host[i+1:]
+	}
+	switch {
+	case host == "*":
+	case strings.Contains(host, "/"):
+		if _, rule.Network, err = net.ParseCIDR(host); err != nil {
+			return rule, fmt.Errorf("exit rule %q: %s", entry, err)
+		}
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case host != "" && !strings.ContainsAny(host, ":/"):
+		rule.Host = strings.ToLower(host)
+	default:
+		return rule, fmt.Errorf("exit rule %q has an invalid host", entry)
+	}
+	return rule, nil
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	if ports == "*" {
+		return 1, 65535, nil
+	}
+	bounds := strings.SplitN(ports, "-", 2)
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port %q", ports)
+	}
+	max := min
+	if len(bounds) == 2 {
+		if max, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, fmt.Errorf("invalid port %q", ports)
+		}
+	}
+	if min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return min, max, nil
+}
+
+func (p ExitPolicy) String() string {
+	rules := make([]string, len(p))
+	for i, rule := range p {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ",")
+}
+
+func (rule ExitRule) String() string {
+	action := "reject"
+	if rule.Accept {
+		action = "accept"
+	}
+
+	host := "*"
+	switch {
+	case rule.Host != "":
+		host = rule.Host
+	case rule.Network != nil:
+		ones, bits := rule.Network.Mask.Size()
+		host = rule.Network.IP.String()
+		if bits == 8*net.IPv6len {
+			host = "[" + host + "]"
+		}
+		if ones != bits {
+			host += "/" + strconv.Itoa(ones)
+		}
+	}
+
+	ports := "*"
+	if rule.MinPort != 1 || rule.MaxPort != 65535 {
+		ports = strconv.Itoa(rule.MinPort)
+		if rule.MaxPort != rule.MinPort {
+			ports += "-" + strconv.Itoa(rule.MaxPort)
+		}
+	}
+	return action + " " + host + ":" + ports
+}
+
+// Whether the policy accepts address (host:port). A host name is matched
+// against host name rules and wildcards only, since its address isn't known
+// here; the exit node checks the address it resolves to.
+func (p ExitPolicy) Accepts(address string) bool {
+	host, port, err := splitDestination(address)
+	if err != nil {
+		return false
+	}
+	return p.accepts(host, net.ParseIP(host), port)
+}
+
+// Checks a destination at the exit node. ip is the address host resolved to,
+// or host itself.
+func (p ExitPolicy) Check(host string, ip net.IP, port int) error {
+	if !p.accepts(host, ip, port) {
+		return exitPolicyRejectError
+	}
+	return nil
+}
+
+func (p ExitPolicy) accepts(host string, ip net.IP, port int) bool {
+	host = strings.ToLower(host)
+	for _, rule := range p {
+		if port < rule.MinPort || port > rule.MaxPort {
+			continue
+		}
+		switch {
+		case rule.Host != "":
+			if rule.Host != host {
+				continue
+			}
+		case rule.Network != nil:
+			if ip == nil || !rule.Network.Contains(ip) {
+				continue
+			}
+		}
+		return rule.Accept
+	}
+	return false
+}
+
+func splitDestination(address string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+// The policy an OR published, DefaultExitPolicy for ORs from before exit
+// policies or with one that doesn't parse
+func (info OnionRouterInfo) Policy() ExitPolicy {
+	spec := info.ExitPolicy
+	if spec == "" {
+		spec = DefaultExitPolicy
+	}
+	policy, err := ParseExitPolicy(spec)
+	if err != nil {
+		policy, _ = ParseExitPolicy(DefaultExitPolicy)
+	}
+	return policy
+}
+
+// Whether the OR can exit to destination: its policy accepts it and, for
+// streams, it opens streams at all. An empty destination asks for nothing.
+func (info OnionRouterInfo) ExitsTo(destination string, streams bool) bool {
+	if streams && !info.Offers(CapabilityExitStreams) {
+		return false
+	}
+	return destination == "" || info.Policy().Accepts(destination)
+}
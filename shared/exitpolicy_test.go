@@ -0,0 +1,78 @@
+package shared
+
+import (
+	"net"
+	"testing"
+)
+
+func TestExitPolicyAccepts(t *testing.T) {
+	policy, err := ParseExitPolicy("reject 10.0.0.0/8:*, accept irc.Example.org:6660-6669, accept [2001:db8::]/32:443, accept 1.2.3.4:6667, reject *:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		address string
+		accept  bool
+	}{
+		{"1.2.3.4:6667", true},
+		{"1.2.3.4:6668", false},
+		{"10.1.2.3:6667", false},
+		{"irc.example.org:6665", true},
+		{"IRC.example.org:6669", true},
+		{"irc.example.org:6670", false},
+		{"other.example.org:6665", false},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db9::1]:443", false},
+		{"[2001:db8::1]:80", false},
+		{"no port", false},
+	} {
+		if got := policy.Accepts(test.address); got != test.accept {
+			t.Errorf("Accepts(%q) = %v, want %v", test.address, got, test.accept)
+		}
+	}
+}
+
+// The first matching rule decides, and host names only match name rules
+func TestExitPolicyFirstMatch(t *testing.T) {
+	policy, err := ParseExitPolicy("accept *:6667,reject 1.2.3.4:*,accept *:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.Accepts("1.2.3.4:6667") || policy.Accepts("1.2.3.4:80") || !policy.Accepts("example.org:80") {
+		t.Fatal("rules were not matched in order")
+	}
+	// The exit node checks the address a name resolved to
+	if policy.Check("example.org", net.ParseIP("1.2.3.4"), 80) == nil {
+		t.Fatal("a name resolving to a rejected address was accepted")
+	}
+}
+
+func TestParseExitPolicy(t *testing.T) {
+	for _, spec := range []string{"", "accept", "allow *:*", "accept *", "accept *:0", "accept *:10-5", "accept 10.0.0.0/33:*", "accept a/b:*"} {
+		if _, err := ParseExitPolicy(spec); err == nil {
+			t.Errorf("ParseExitPolicy(%q) succeeded", spec)
+		}
+	}
+
+	// String gives back a policy that parses to the same rules
+	spec := "reject 10.0.0.0/8:*,accept irc.example.org:6660-6669,accept [2001:db8::]/32:443,accept [::1]:22,accept 1.2.3.4:6667,reject *:*"
+	policy, err := ParseExitPolicy(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.String() != spec {
+		t.Fatalf("String() = %q, want %q", policy.String(), spec)
+	}
+}
+
+func TestOnionRouterInfoPolicy(t *testing.T) {
+	if !(OnionRouterInfo{}).ExitsTo("1.2.3.4:80", false) {
+		t.Fatal("an OR from before exit policies doesn't exit everywhere")
+	}
+	if (OnionRouterInfo{}).ExitsTo("1.2.3.4:80", true) {
+		t.Fatal("an OR without the stream capability exits streams")
+	}
+	if (OnionRouterInfo{ExitPolicy: "accept *:6667,reject *:*"}).ExitsTo("1.2.3.4:80", false) {
+		t.Fatal("an OR's own policy was ignored")
+	}
+}
@@ -0,0 +1,360 @@
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Version of the protocol spoken by this build. Bump it, and add the feature
+// below, whenever a change is visible to another component.
+const ProtocolVersion = 64
+
+// Components that take part in the protocol
+const (
+	ComponentOnionProxy      = "onion_proxy"
+	ComponentOnionRouter     = "onion_router"
+	ComponentDirectoryServer = "directory_server"
+	ComponentChatServer      = "chat_server"
+	ComponentChatClient      = "chat_client"
+	ComponentAdmin           = "torchat_admin"
+)
+
+// Protocol-visible behaviour, named so components can ask each other for it
+const (
+	FeatureOnionRouting        = "onion-routing"
+	FeatureNamespaces          = "namespaces"
+	FeatureReachability        = "reachability-tests"
+	FeatureBuildReceipts       = "build-receipts"
+	FeatureReputation          = "failure-reports"
+	FeatureAdminRPC            = "admin-rpc"
+	FeatureShortCircuits       = "short-circuits"
+	FeatureChannels            = "channels"
+	FeatureRateLimits          = "rate-limits"
+	FeatureUserNames           = "usernames"
+	FeaturePresence            = "presence"
+	FeatureEdits               = "edits"
+	FeatureWeightedPaths       = "weighted-consensus"
+	FeatureDirectMessages      = "direct-messages"
+	FeatureDeadlines           = "deadlines"
+	FeatureMultiDevice         = "multi-device"
+	FeatureClockSkew           = "clock-skew"
+	FeatureReadMarkers         = "read-markers"
+	FeatureConsensusParams     = "consensus-params"
+	FeatureIRCBridge           = "irc-bridge"
+	FeatureVersioning          = "protocol-versions"
+	FeatureXMPPGateway         = "xmpp-gateway"
+	FeatureMatrixBridge        = "matrix-bridge"
+	FeatureExport              = "export"
+	FeatureFragmentation       = "fragmentation"
+	FeaturePagination          = "pagination"
+	FeatureLinkCircuitIds      = "link-circuit-ids"
+	FeatureCircuitExpiry       = "circuit-expiry"
+	FeatureBandwidth           = "bandwidth-reports"
+	FeatureBinaryOnions        = "binary-onions"
+	FeatureTransports          = "transports"
+	FeatureNATTraversal        = "nat-traversal"
+	FeatureIPv6                = "ipv6"
+	FeatureStreams             = "tcp-streams"
+	FeatureExitPolicies        = "exit-policies"
+	FeatureChatServers         = "chat-servers"
+	FeatureChatServerDiscovery = "chat-server-registration"
+	FeatureMessageSigning      = "message-signing"
+	FeatureRegistrationGate    = "registration-gate"
+	FeatureEnrollment          = "or-enrollment"
+	FeatureForgetUser          = "forget-user"
+	FeatureMessageTTL          = "message-ttl"
+	FeaturePostingTokens       = "posting-tokens"
+	FeatureGroupKeys           = "group-keys"
+	FeatureDoubleRatchet       = "double-ratchet"
+	FeatureRosterSync          = "roster-sync"
+	FeatureContactApproval     = "contact-approval"
+	FeatureBlocking            = "blocking"
+	FeatureRedundantDelivery   = "redundant-delivery"
+	FeatureLinkPadding         = "link-padding"
+	FeatureMeasurement         = "bandwidth-measurement"
+	FeatureSelfTest            = "self-test"
+	FeatureCapabilities        = "capabilities"
+	FeatureRelayCells          = "relay-cells"
+	FeatureSignedHeartbeats    = "signed-heartbeats"
+	FeatureFailureGossip       = "failure-gossip"
+	FeatureDescriptors         = "descriptors"
+	FeatureStableFlag          = "stable-flag"
+	FeatureCircuitStatus       = "circuit-status"
+	FeatureHopLatency          = "hop-latency"
+	FeaturePing                = "ping"
+	FeatureAccounting          = "accounting"
+	FeatureOutbox              = "outbox"
+	FeatureProfiles            = "profiles"
+	FeatureRESTAPI             = "rest-api"
+	FeatureDashboard           = "dashboard"
+	FeatureChatDashboard       = "chat-dashboard"
+	FeatureConsensusValidity   = "consensus-validity"
+	FeatureDestroyTokens       = "destroy-tokens"
+)
+
+// One protocol feature: the first protocol version with it and the
+// components that must have it for it to work
+type Feature struct {
+	Name        string
+	MinVersion  int
+	Components  []string
+	Description string
+}
+
+// Every protocol feature, oldest first
+var Features = []Feature{
+	{FeatureOnionRouting, 1, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer, ComponentChatServer},
+		"Layered onion encryption over 3-hop circuits from a signed OR list"},
+	{FeatureNamespaces, 2, []string{ComponentOnionProxy, ComponentChatServer},
+		"ChatMessage.Namespace and PollingMessage.Namespace select a tenant"},
+	{FeatureReachability, 3, []string{ComponentOnionRouter, ComponentDirectoryServer},
+		"ORServer.Handshake, used to dial ORs back before listing them"},
+	{FeatureBuildReceipts, 4, []string{ComponentOnionProxy, ComponentChatClient},
+		"OPServer.GetLastBuildReceipt"},
+	{FeatureReputation, 5, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"DServer.ReportFailure and weighting ORs by reputation"},
+	{FeatureAdminRPC, 6, []string{ComponentDirectoryServer, ComponentChatServer, ComponentAdmin},
+		"Authenticated admin and moderation RPCs"},
+	{FeatureShortCircuits, 7, []string{ComponentOnionProxy, ComponentDirectoryServer},
+		"CircuitRequest.MinHops"},
+	{FeatureChannels, 8, []string{ComponentOnionProxy, ComponentChatServer},
+		"ChatMessage.Channel and channel membership"},
+	{FeatureRateLimits, 9, []string{ComponentOnionProxy, ComponentChatServer},
+		"THROTTLED errors with a retry-after hint"},
+	{FeatureUserNames, 10, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"Exit commands register and nick, user tokens"},
+	{FeaturePresence, 11, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"Exit command presence, PollingResponse.Events"},
+	{FeatureEdits, 11, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"Exit commands edit and delete, PollingResponse.Updates"},
+	{FeatureWeightedPaths, 12, []string{ComponentOnionProxy, ComponentDirectoryServer},
+		"DServer.GetConsensus with OR weights for local path selection"},
+	{FeatureDirectMessages, 13, []string{ComponentOnionProxy, ComponentChatServer},
+		"ChatMessage.Recipient, PollingResponse.Inbox"},
+	{FeatureDeadlines, 13, []string{ComponentOnionProxy, ComponentChatServer},
+		"ChatMessage.Deadline and EXPIRED errors"},
+	{FeatureMultiDevice, 14, []string{ComponentOnionProxy, ComponentChatServer},
+		"PollingMessage.DeviceId, per-device cursors"},
+	{FeatureClockSkew, 14, []string{ComponentOnionProxy, ComponentChatServer},
+		"ChatMessage.SentAt, MessageMeta.ClockSkewed"},
+	{FeatureReadMarkers, 15, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"Exit command markread, PollingResponse.UnreadCounts"},
+	{FeatureConsensusParams, 15, []string{ComponentOnionProxy, ComponentDirectoryServer},
+		"OnionRouterInfos.Params, covered by the consensus signature"},
+	{FeatureIRCBridge, 16, []string{ComponentChatServer},
+		"RFC 1459 listener for off-the-shelf IRC clients"},
+	{FeatureVersioning, 16, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"OnionRouterInfo.ProtocolVersion, checked before sending exit commands"},
+	{FeatureXMPPGateway, 17, []string{ComponentChatServer},
+		"XEP-0114 component showing channels as multi-user chat rooms"},
+	{FeatureMatrixBridge, 18, []string{ComponentChatServer},
+		"Matrix application service mirroring channels into rooms"},
+	{FeatureExport, 19, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"ORServer.DecryptExportCell and CServer.ExportLog, chunked archives"},
+	{FeatureFragmentation, 20, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"Exit commands fragment and fetch-fragment, PollingResponse.Fragment"},
+	{FeaturePagination, 21, []string{ComponentOnionProxy, ComponentChatServer, ComponentChatClient},
+		"PollingMessage.Limit, PollingResponse.More, OPServer.PollMessages"},
+	{FeatureLinkCircuitIds, 22, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"ORServer.CreateCircuit, Onion.NextCircuitId translated at each hop"},
+	{FeatureCircuitExpiry, 23, []string{ComponentOnionRouter},
+		"Idle circuits torn down, ORServer.DestroyCircuit passed towards the exit"},
+	{FeatureBandwidth, 24, []string{ComponentOnionRouter, ComponentDirectoryServer},
+		"DServer.SendHeartbeat with measured bandwidth, OnionRouterInfo.Bandwidth weighting"},
+	{FeatureBinaryOnions, 25, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"Onion layers with a binary header and raw next layer, relayed without decoding"},
+	{FeatureTransports, 26, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"OnionRouterInfo.Transports, guard links over a transport other than tcp"},
+	{FeatureNATTraversal, 27, []string{ComponentOnionRouter, ComponentDirectoryServer},
+		"DServer.GetReachability self-test, port mapping and NAT relays for routers behind NAT"},
+	{FeatureIPv6, 28, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"IPv6 addresses, OnionRouterInfo.AltAddresses for dual-stack ORs, one OR per subnet in a circuit"},
+	{FeatureStreams, 29, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"ORServer.DecryptStreamCell, begin/data/end commands carrying TCP connections through circuits"},
+	{FeatureExitPolicies, 30, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"OnionRouterInfo.ExitPolicy, CircuitRequest.Destination picking an exit that accepts it"},
+	{FeatureChatServers, 31, []string{ComponentOnionProxy, ComponentDirectoryServer, ComponentChatClient},
+		"DServer.GetChatServers, OPServer.HomeChannel homing channels on advertised chat servers"},
+	{FeatureChatServerDiscovery, 32, []string{ComponentChatServer, ComponentDirectoryServer, ComponentOnionProxy},
+		"DServer.RegisterChatServer and SendChatServerHeartbeat, proxies finding their chat server through the directory"},
+	{FeatureMessageSigning, 33, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"ChatMessage.Signature and UserNameRequest.SigningKey, Ed25519 signed messages the IRC server verifies"},
+	{FeatureRegistrationGate, 34, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"UserNameRequest.RegistrationToken, PowStamp and PowNonce, namespaces gating new usernames behind a token or proof of work"},
+	{FeatureEnrollment, 35, []string{ComponentOnionRouter, ComponentDirectoryServer, ComponentAdmin},
+		"OnionRouterInfo.EnrollmentToken and Contact, AdminServer.ListPendingNodes, ApproveNode and RejectNode gating which ORs get listed"},
+	{FeatureForgetUser, 36, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Exit command forget, CServer.ForgetUser and OPServer.ForgetUser deleting a user's registration, messages and inbox"},
+	{FeatureMessageTTL, 37, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"ChatMessage.TTL, MessageMeta.ExpiresAt and MessageUpdate.Expired, messages the IRC server purges after a while"},
+	{FeaturePostingTokens, 38, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Polling command posting-tokens, CServer.IssuePostingTokens and ChatMessage.PostingToken, blindly signed tokens spent on anonymous messages"},
+	{FeatureGroupKeys, 39, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Polling command channel-keys, UserNameRequest.EncryptionKey, ChatMessage.Encrypted and SenderKey, end-to-end encrypted channels with sender keys"},
+	{FeatureDoubleRatchet, 40, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"Exit command prekeys, polling command prekey-bundle and ChatMessage.Ratchet, direct messages encrypted with a double ratchet"},
+	{FeatureRosterSync, 41, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Exit command roster, polling command get-roster and OPServer.AddContact, an encrypted contact roster synced between devices as an opaque blob"},
+	{FeatureContactApproval, 42, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Exit command contact and PollingResponse.ContactEvents, direct messages only from approved contacts where the namespace requires it"},
+	{FeatureBlocking, 43, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer, ComponentChatClient},
+		"Exit command block and PollingResponse.Blocked, inboxes closed to blocked users and their channel messages hidden by the proxy"},
+	{FeatureRedundantDelivery, 44, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatServer},
+		"ChatMessage.MessageId, messages sent over two disjoint circuits and published once"},
+	{FeatureLinkPadding, 45, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"ORServer.PaddingCell, padding machines sending dummy cells on proxy to guard and router to router links"},
+	{FeatureMeasurement, 46, []string{ComponentDirectoryServer, ComponentOnionRouter},
+		"Exit command measure, answered by exit nodes, and consensus weights from bandwidth the directory measured through test circuits"},
+	{FeatureSelfTest, 47, []string{ComponentDirectoryServer, ComponentOnionRouter},
+		"Heartbeat.SelfTest, routers test a circuit through themselves and the directory leaves out those that failed"},
+	{FeatureCapabilities, 48, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"OnionRouterInfo.Capabilities and ORServer.NegotiateCircuit, capability bits exchanged in descriptors and circuit handshakes"},
+	{FeatureRelayCells, 49, []string{ComponentOnionProxy, ComponentOnionRouter},
+		"ORServer.Relay, one RPC method for every cell on a circuit, dispatched on a relay command byte"},
+	{FeatureSignedHeartbeats, 50, []string{ComponentDirectoryServer, ComponentOnionRouter},
+		"Heartbeat.Signature, heartbeats signed with the router's identity key and KeepNodeOnline refused for routers that sign them"},
+	{FeatureFailureGossip, 51, []string{ComponentDirectoryServer, ComponentOnionRouter},
+		"DServer.ReportRouterFailure, signed reports of next hops a router repeatedly failed to reach, rechecked by the directory"},
+	{FeatureDescriptors, 52, []string{ComponentDirectoryServer, ComponentOnionRouter, ComponentAdmin},
+		"OnionRouterInfo.Descriptor, DServer.PublishDescriptor and GetDescriptors, signed router descriptors with platform and bandwidth served by the directory"},
+	{FeatureStableFlag, 53, []string{ComponentDirectoryServer, ComponentOnionProxy, ComponentAdmin},
+		"OnionRouterInfo.Stable and CircuitRequest.Stable, routers with a long mean time between failures in the guard position and on long lived circuits"},
+	{FeatureCircuitStatus, 54, []string{ComponentOnionProxy, ComponentChatClient},
+		"OPServer.GetCircuitStatus, the hops, age and recent errors of the circuits in use"},
+	{FeatureHopLatency, 55, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatClient},
+		"Measure cells answered by any hop, CircuitHop.Latency, per-hop latency from the round trip to each hop"},
+	{FeaturePing, 56, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentChatClient},
+		"PING relay cells echoed by the exit, OPServer.PingCircuit, CircuitStatus.RTT and keepalive pings"},
+	{FeatureAccounting, 57, []string{ComponentOnionRouter, ComponentDirectoryServer},
+		"Heartbeat.Accounting, the traffic cap an OR has left this period, and hibernating once it is used up"},
+	{FeatureOutbox, 58, []string{ComponentOnionProxy, ComponentChatClient},
+		"OPServer.SendChatMessage, queueing messages in a persistent outbox while no circuit can carry them"},
+	{FeatureProfiles, 59, []string{ComponentOnionProxy, ComponentChatClient},
+		"OPServer.CreateProfile, ConnectProfile and ListProfiles, connecting as one of several saved identities"},
+	{FeatureRESTAPI, 60, []string{ComponentDirectoryServer},
+		"-api-addr, the consensus, node list and network statistics as JSON over HTTPS"},
+	{FeatureDashboard, 61, []string{ComponentDirectoryServer},
+		"a network status web page on -api-addr, backed by /v1/status"},
+	{FeatureChatDashboard, 62, []string{ComponentChatServer, ComponentAdmin},
+		"operator queries of channels, active users, message rates and moderation actions, and -dashboard-addr showing them"},
+	{FeatureConsensusValidity, 63, []string{ComponentDirectoryServer, ComponentOnionProxy},
+		"OnionRouterInfos.ValidAfter and ValidUntil, signed so proxies refuse and stop using expired consensuses, cached or not"},
+	{FeatureDestroyTokens, 64, []string{ComponentOnionProxy, ComponentOnionRouter, ComponentDirectoryServer},
+		"Onion.DestroyToken and DestroyNotice.Token, circuits torn down only by their creator or the router before them"},
+}
+
+// Exit commands and the features that added them
+var commandFeatures = map[string]string{
+	CommandChatMessage:        FeatureOnionRouting,
+	CommandRegisterUserName:   FeatureUserNames,
+	CommandChangeUserName:     FeatureUserNames,
+	CommandPresence:           FeaturePresence,
+	CommandEditMessage:        FeatureEdits,
+	CommandDeleteMessage:      FeatureEdits,
+	CommandMarkRead:           FeatureReadMarkers,
+	CommandForgetUser:         FeatureForgetUser,
+	CommandFragment:           FeatureFragmentation,
+	CommandFetchFragment:      FeatureFragmentation,
+	CommandIssuePostingTokens: FeaturePostingTokens,
+	CommandChannelKeys:        FeatureGroupKeys,
+	CommandUploadPrekeys:      FeatureDoubleRatchet,
+	CommandPrekeyBundle:       FeatureDoubleRatchet,
+	CommandPutRoster:          FeatureRosterSync,
+	CommandGetRoster:          FeatureRosterSync,
+	CommandMeasure:            FeatureMeasurement,
+	CommandContactRequest:     FeatureContactApproval,
+	CommandBlockUser:          FeatureBlocking,
+	CommandStreamBegin:        FeatureStreams,
+	CommandStreamData:         FeatureStreams,
+	CommandStreamEnd:          FeatureStreams,
+	CommandPing:               FeaturePing,
+}
+
+func FeatureByName(name string) (Feature, bool) {
+	for _, feature := range Features {
+		if feature.Name == name {
+			return feature, true
+		}
+	}
+	return Feature{}, false
+}
+
+// Peers from before versioning don't send a version and speak version 1
+func PeerVersion(version int) int {
+	if version < 1 {
+		return 1
+	}
+	return version
+}
+
+// Whether a peer speaking version has the feature. Unknown features are
+// assumed to be newer than the peer.
+func SupportsFeature(version int, name string) bool {
+	feature, ok := FeatureByName(name)
+	return ok && PeerVersion(version) >= feature.MinVersion
+}
+
+// The feature an exit node needs to understand command
+func CommandFeature(command string) string {
+	if feature, ok := commandFeatures[command]; ok {
+		return feature
+	}
+	return FeatureVersioning
+}
+
+// Whether command is an exit command of any protocol version up to ours
+func KnownCommand(command string) bool {
+	_, ok := commandFeatures[command]
+	return ok
+}
+
+// The features that involve component, oldest first
+func FeaturesOf(component string) []Feature {
+	var features []Feature
+	for _, feature := range Features {
+		for _, c := range feature.Components {
+			if c == component {
+				features = append(features, feature)
+				break
+			}
+		}
+	}
+	return features
+}
+
+// What -version prints: a text line (with a feature table if withFeatures is
+// set) and the same as a value for JSON output
+func VersionReport(component string, withFeatures bool) (string, interface{}) {
+	report := struct {
+		Component       string
+		ProtocolVersion int
+		Features        []Feature `json:",omitempty"`
+	}{
+		Component:       component,
+		ProtocolVersion: ProtocolVersion,
+	}
+	text := fmt.Sprintf("%s speaks TorChat protocol version %d", component, ProtocolVersion)
+	if !withFeatures {
+		return text, report
+	}
+
+	report.Features = FeaturesOf(component)
+	lines := []string{text}
+	for _, feature := range report.Features {
+		others := make([]string, 0, len(feature.Components))
+		for _, c := range feature.Components {
+			if c != component {
+				others = append(others, c)
+			}
+		}
+		sort.Strings(others)
+		peers := "no other component"
+		if len(others) > 0 {
+			peers = strings.Join(others, ", ")
+		}
+		lines = append(lines, fmt.Sprintf("  %-20s v%-3d with %s: %s",
+			feature.Name, feature.MinVersion, peers, feature.Description))
+	}
+	return strings.Join(lines, "\n"), report
+}
@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeatureRegistry(t *testing.T) {
+	seen := make(map[string]bool)
+	last := 0
+	for _, feature := range Features {
+		if seen[feature.Name] {
+			t.Fatalf("%s is listed twice", feature.Name)
+		}
+		seen[feature.Name] = true
+		if feature.MinVersion < last || feature.MinVersion > ProtocolVersion {
+			t.Fatalf("%s has version %d after %d, with the protocol at %d", feature.Name, feature.MinVersion, last, ProtocolVersion)
+		}
+		last = feature.MinVersion
+		if len(feature.Components) == 0 || feature.Description == "" {
+			t.Fatalf("%s doesn't say what it is or who speaks it", feature.Name)
+		}
+	}
+	for command, feature := range commandFeatures {
+		if !seen[feature] {
+			t.Fatalf("command %q needs the unknown feature %s", command, feature)
+		}
+	}
+}
+
+func TestSupportsFeature(t *testing.T) {
+	if PeerVersion(0) != 1 || PeerVersion(5) != 5 {
+		t.Fatal("peers without a version speak version 1")
+	}
+	if !SupportsFeature(0, FeatureOnionRouting) || SupportsFeature(0, FeatureUserNames) {
+		t.Fatal("a version 1 peer only has version 1 features")
+	}
+	if !SupportsFeature(ProtocolVersion, FeatureVersioning) || SupportsFeature(ProtocolVersion, "teleportation") {
+		t.Fatal("unknown features are never supported")
+	}
+	if CommandFeature(CommandPresence) != FeaturePresence || CommandFeature("unknown") != FeatureVersioning {
+		t.Fatal("commands map to the wrong features")
+	}
+}
+
+func TestVersionReport(t *testing.T) {
+	text, _ := VersionReport(ComponentChatClient, false)
+	if strings.Contains(text, "\n") || !strings.Contains(text, "chat_client speaks TorChat protocol version") {
+		t.Fatalf("-version printed %q", text)
+	}
+	text, _ = VersionReport(ComponentChatClient, true)
+	if !strings.Contains(text, FeatureBuildReceipts) || strings.Contains(text, FeatureReachability) {
+		t.Fatalf("-version -features printed\n%s", text)
+	}
+}
@@ -0,0 +1,215 @@
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// End-to-end encrypted channels use sender keys: every member who posts to
+// the channel picks a random AES-256 key of their own and hands it to the
+// other members, each sealed to their X25519 encryption key, in a direct
+// message. Channel messages are then encrypted once with the sender's key.
+// The IRC server relays both but can read neither.
+
+// Shown by the IRC server in place of the text of an encrypted message
+const EncryptedPlaceholder = "[encrypted message]"
+
+// A member's key for one channel, as sealed into a SenderKeyEnvelope
+type SenderKey struct {
+	Channel string
+	Owner   string // username of the member who encrypts with it
+	KeyId   string // random, hex
+	Key     []byte
+}
+
+// A SenderKey sealed to one recipient's encryption key with an ephemeral
+// X25519 key. From is set by the IRC server to the authenticated sender.
+type SenderKeyEnvelope struct {
+	From       string `json:",omitempty"`
+	Ephemeral  []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// The text of a channel message encrypted with the sender's key for the
+// channel
+type EncryptedMessage struct {
+	KeyId      string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Asks for the encryption keys of a channel's members. Sent in polling cells
+// as CommandChannelKeys.
+type ChannelKeysRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	Channel       string // DefaultChannel if empty
+}
+
+type MemberKey struct {
+	Username      string
+	EncryptionKey []byte // X25519 public key
+}
+
+type ChannelKeysResponse struct {
+	Members []MemberKey // registered members with an encryption key, the requester included
+}
+
+var (
+	badEncryptionKeyError = errors.New("Encryption keys must be 32 byte X25519 public keys")
+	badSenderKeyError     = errors.New("Sender key does not decrypt or is not for this channel")
+	badEncryptedError     = errors.New("Encrypted message does not decrypt with its sender key")
+)
+
+// The X25519 key a user's sender keys are sealed to, derived from their
+// Ed25519 signing key so every device holding that key can open them
+func EncryptionKeyFromSigningKey(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	seed, err := hkdf.Key(sha256.New, key.Seed(), nil, "torchat-encryption-key", 32)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(seed)
+}
+
+// Makes a new random sender key for owner in channel
+func NewSenderKey(channel string, owner string, random io.Reader) (SenderKey, error) {
+	id := make([]byte, 8)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(random, id); err != nil {
+		return SenderKey{}, err
+	}
+	if _, err := io.ReadFull(random, key); err != nil {
+		return SenderKey{}, err
+	}
+	return SenderKey{Channel: channel, Owner: owner, KeyId: hex.EncodeToString(id), Key: key}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// The AES key of an envelope, from the X25519 secret and both public keys
+func envelopeKey(secret []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, secret, append(append([]byte(nil), ephemeral...), recipient...), "torchat-sender-key", 32)
+}
+
+// Seals key to a recipient's encryption key
+func SealSenderKey(recipient []byte, key SenderKey, random io.Reader) (SenderKeyEnvelope, error) {
+	recipientKey, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return SenderKeyEnvelope{}, badEncryptionKeyError
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+	secret, err := ephemeral.ECDH(recipientKey)
+	if err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+	aesKey, err := envelopeKey(secret, ephemeral.PublicKey().Bytes(), recipient)
+	if err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+
+	plaintext, err := json.Marshal(key)
+	if err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return SenderKeyEnvelope{}, err
+	}
+	return SenderKeyEnvelope{
+		Ephemeral:  ephemeral.PublicKey().Bytes(),
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	}, nil
+}
+
+// Opens an envelope sealed to key. The sender key inside must be owned by
+// whoever the IRC server says sent the envelope, so a member can't hand out
+// keys in another's name.
+func OpenSenderKey(key *ecdh.PrivateKey, envelope SenderKeyEnvelope) (SenderKey, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(envelope.Ephemeral)
+	if err != nil {
+		return SenderKey{}, badSenderKeyError
+	}
+	secret, err := key.ECDH(ephemeral)
+	if err != nil {
+		return SenderKey{}, badSenderKeyError
+	}
+	aesKey, err := envelopeKey(secret, envelope.Ephemeral, key.PublicKey().Bytes())
+	if err != nil {
+		return SenderKey{}, err
+	}
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return SenderKey{}, err
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return SenderKey{}, badSenderKeyError
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, nil)
+	if err != nil {
+		return SenderKey{}, badSenderKeyError
+	}
+
+	var senderKey SenderKey
+	if err = json.Unmarshal(plaintext, &senderKey); err != nil || len(senderKey.Key) != 32 || senderKey.Owner != envelope.From {
+		return SenderKey{}, badSenderKeyError
+	}
+	return senderKey, nil
+}
+
+// Encrypts text with a sender key. The channel and key id are bound in as
+// additional data, so a message can't be moved to another channel.
+func (k SenderKey) Encrypt(text string, random io.Reader) (EncryptedMessage, error) {
+	aead, err := newGCM(k.Key)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return EncryptedMessage{}, err
+	}
+	return EncryptedMessage{
+		KeyId:      k.KeyId,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, []byte(text), []byte(k.Channel+"\n"+k.KeyId)),
+	}, nil
+}
+
+func (k SenderKey) Decrypt(msg EncryptedMessage) (string, error) {
+	aead, err := newGCM(k.Key)
+	if err != nil {
+		return "", err
+	}
+	if msg.KeyId != k.KeyId || len(msg.Nonce) != aead.NonceSize() {
+		return "", badEncryptedError
+	}
+	plaintext, err := aead.Open(nil, msg.Nonce, msg.Ciphertext, []byte(k.Channel+"\n"+k.KeyId))
+	if err != nil {
+		return "", badEncryptedError
+	}
+	return string(plaintext), nil
+}
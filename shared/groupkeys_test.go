@@ -0,0 +1,82 @@
+package shared
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+func testEncryptionKey(t *testing.T) ([]byte, func(SenderKeyEnvelope) (SenderKey, error)) {
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := EncryptionKeyFromSigningKey(signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := EncryptionKeyFromSigningKey(signingKey)
+	if !key.Equal(again) {
+		t.Fatal("the same signing key gave two encryption keys")
+	}
+	return key.PublicKey().Bytes(), func(envelope SenderKeyEnvelope) (SenderKey, error) { return OpenSenderKey(key, envelope) }
+}
+
+func TestSenderKeyEnvelope(t *testing.T) {
+	bob, openAsBob := testEncryptionKey(t)
+	_, openAsCarol := testEncryptionKey(t)
+	key, err := NewSenderKey("#go", "alice", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := SealSenderKey(bob, key, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope.From = "alice"
+	opened, err := openAsBob(envelope)
+	if err != nil || opened.KeyId != key.KeyId || string(opened.Key) != string(key.Key) {
+		t.Fatalf("opened %+v, %v", opened, err)
+	}
+	if _, err = openAsCarol(envelope); err != badSenderKeyError {
+		t.Fatalf("another member opening it gave %v, want %v", err, badSenderKeyError)
+	}
+	// A key handed out in someone else's name
+	envelope.From = "mallory"
+	if _, err = openAsBob(envelope); err != badSenderKeyError {
+		t.Fatalf("a key from someone else than its owner gave %v, want %v", err, badSenderKeyError)
+	}
+	if _, err = SealSenderKey([]byte("short"), key, rand.Reader); err != badEncryptionKeyError {
+		t.Fatalf("sealing to a bad key gave %v, want %v", err, badEncryptionKeyError)
+	}
+}
+
+func TestSenderKeyEncrypt(t *testing.T) {
+	key, err := NewSenderKey("#go", "alice", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := key.Encrypt("secret plan", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := key.Decrypt(msg); err != nil || text != "secret plan" {
+		t.Fatalf("decrypted %q, %v", text, err)
+	}
+
+	// Moved to another channel, or tampered with
+	moved := key
+	moved.Channel = "#other"
+	if _, err = moved.Decrypt(msg); err != badEncryptedError {
+		t.Fatalf("a message moved to another channel gave %v, want %v", err, badEncryptedError)
+	}
+	msg.Ciphertext[0] ^= 1
+	if _, err = key.Decrypt(msg); err != badEncryptedError {
+		t.Fatalf("a changed message gave %v, want %v", err, badEncryptedError)
+	}
+	other, _ := NewSenderKey("#go", "alice", rand.Reader)
+	if _, err = other.Decrypt(msg); err != badEncryptedError {
+		t.Fatalf("another key gave %v, want %v", err, badEncryptedError)
+	}
+}
@@ -0,0 +1,122 @@
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Binary onion layers. A decrypted layer starting with BinaryOnionFormat is
+// a fixed header followed by the raw next layer, so a middle hop parses the
+// header and forwards the rest without decoding or copying it. JSON layers
+// start with '{' and are still accepted.
+//
+//	format (1) | flags (1) | next circuit id (4) | [destroy token (16)] |
+//	address length (1) | address | command length (1) | command | data
+//
+// The destroy token is there if its flag is, which routers from before
+// FeatureDestroyTokens don't know.
+const BinaryOnionFormat byte = 0x01
+
+const (
+	onionFlagExit         byte = 1 << 0
+	onionFlagDestroyToken byte = 1 << 1
+	binaryOnionMinSize    int  = 8
+)
+
+// Size of a DestroyToken
+const DestroyTokenSize = 16
+
+// The token a router destroys its circuit with key for. Only the circuit's
+// creator and, told in its onion layer, the router before it know it.
+func DestroyToken(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("torchat-destroy\n"))
+	return mac.Sum(nil)[:DestroyTokenSize]
+}
+
+// The size of onion encoded as a binary layer
+func BinaryOnionSize(onion Onion) int {
+	return binaryOnionMinSize + len(onion.DestroyToken) + len(onion.NextAddress) + len(onion.Command) + len(onion.Data)
+}
+
+// Appends onion to buf as a binary layer
+func AppendBinaryOnion(buf []byte, onion Onion) ([]byte, error) {
+	if len(onion.NextAddress) > 255 || len(onion.Command) > 255 {
+		return buf, errors.New("onion address or command longer than 255 bytes")
+	}
+	if onion.DestroyToken != nil && len(onion.DestroyToken) != DestroyTokenSize {
+		return buf, errors.New("onion destroy token is not 16 bytes")
+	}
+
+	var flags byte
+	if onion.IsExitNode {
+		flags |= onionFlagExit
+	}
+	if onion.DestroyToken != nil {
+		flags |= onionFlagDestroyToken
+	}
+	buf = append(buf, BinaryOnionFormat, flags)
+	buf = binary.BigEndian.AppendUint32(buf, onion.NextCircuitId)
+	buf = append(buf, onion.DestroyToken...)
+	buf = append(buf, byte(len(onion.NextAddress)))
+	buf = append(buf, onion.NextAddress...)
+	buf = append(buf, byte(len(onion.Command)))
+	buf = append(buf, onion.Command...)
+	return append(buf, onion.Data...), nil
+}
+
+// Parses a binary layer. The returned Data and DestroyToken share layer's
+// memory.
+func ParseBinaryOnion(layer []byte) (Onion, error) {
+	var onion Onion
+	if len(layer) < binaryOnionMinSize || layer[0] != BinaryOnionFormat {
+		return onion, errors.New("not a binary onion layer")
+	}
+	onion.IsExitNode = layer[1]&onionFlagExit != 0
+	onion.NextCircuitId = binary.BigEndian.Uint32(layer[2:6])
+
+	rest := layer[6:]
+	if layer[1]&onionFlagDestroyToken != 0 {
+		if len(rest) < DestroyTokenSize {
+			return onion, errors.New("binary onion layer truncated in its destroy token")
+		}
+		onion.DestroyToken, rest = rest[:DestroyTokenSize], rest[DestroyTokenSize:]
+	}
+	field := func() (string, bool) {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", false
+		}
+		value := string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+		return value, true
+	}
+	var ok bool
+	if onion.NextAddress, ok = field(); !ok {
+		return onion, errors.New("binary onion layer truncated in its address")
+	}
+	if onion.Command, ok = field(); !ok {
+		return onion, errors.New("binary onion layer truncated in its command")
+	}
+	onion.Data = rest
+	return onion, nil
+}
+
+// Encodes onion as a binary layer after a random IV from rng and encrypts it
+// with block, for circuits built by other components than the proxy
+func SealBinaryOnion(block cipher.Block, onion Onion, rng io.Reader) ([]byte, error) {
+	buf := make([]byte, aes.BlockSize, aes.BlockSize+BinaryOnionSize(onion))
+	buf, err := AppendBinaryOnion(buf, onion)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rng, buf[:aes.BlockSize]); err != nil {
+		return nil, err
+	}
+	cipher.NewCFBEncrypter(block, buf[:aes.BlockSize]).XORKeyStream(buf[aes.BlockSize:], buf[aes.BlockSize:])
+	return buf, nil
+}
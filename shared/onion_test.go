@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBinaryOnionRoundTrip(t *testing.T) {
+	for _, onion := range []Onion{
+		{NextAddress: "127.0.0.1:8002", NextCircuitId: 7, Data: []byte("next layer")},
+		{IsExitNode: true, Command: CommandPresence, Data: []byte(`{"Kind":"typing"}`)},
+		{IsExitNode: true},
+		{NextAddress: "127.0.0.1:8003", DestroyToken: DestroyToken([]byte("key")), Data: []byte("next layer")},
+	} {
+		layer, err := AppendBinaryOnion([]byte("prefix"), onion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(layer) != len("prefix")+BinaryOnionSize(onion) {
+			t.Fatalf("%+v encoded to %d bytes, want %d", onion, len(layer)-len("prefix"), BinaryOnionSize(onion))
+		}
+		parsed, err := ParseBinaryOnion(layer[len("prefix"):])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.IsExitNode != onion.IsExitNode || parsed.NextAddress != onion.NextAddress || parsed.NextCircuitId != onion.NextCircuitId ||
+			parsed.Command != onion.Command || !bytes.Equal(parsed.Data, onion.Data) || !bytes.Equal(parsed.DestroyToken, onion.DestroyToken) {
+			t.Fatalf("parsed %+v, want %+v", parsed, onion)
+		}
+	}
+}
+
+func TestParseBinaryOnionErrors(t *testing.T) {
+	layer, err := AppendBinaryOnion(nil, Onion{NextAddress: "127.0.0.1:8002", Command: CommandPresence})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][]byte{nil, []byte(`{"IsExitNode":true}`), layer[:7], layer[:len(layer)-2]} {
+		if _, err := ParseBinaryOnion(bad); err == nil {
+			t.Fatalf("%x parsed", bad)
+		}
+	}
+	if _, err := AppendBinaryOnion(nil, Onion{NextAddress: strings.Repeat("a", 256)}); err == nil {
+		t.Fatal("an address of 256 bytes was encoded")
+	}
+	if _, err := AppendBinaryOnion(nil, Onion{DestroyToken: []byte("short")}); err == nil {
+		t.Fatal("a destroy token of 5 bytes was encoded")
+	}
+	// A destroy token flag with too few bytes after it
+	if _, err := ParseBinaryOnion([]byte{BinaryOnionFormat, 1 << 1, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Fatal("a layer truncated in its destroy token parsed")
+	}
+}
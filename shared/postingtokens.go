@@ -0,0 +1,213 @@
+package shared
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Posting tokens let a registered user publish a channel message without
+// saying who they are. The IRC server signs tokens blinded by the user's
+// proxy, so it can limit how many each user gets without being able to tell
+// which user a spent token was issued to.
+
+const minPostingKeyBits = 2048
+
+// Public half of the RSA key an IRC server signs posting tokens with
+type PostingKey struct {
+	N         []byte // modulus, big endian
+	E         int
+	ExpiresAt time.Time // tokens signed with the key are redeemed until then
+}
+
+// Redeemed instead of a username and token: an Ed25519 key the message is
+// signed with, and the posting key's signature over it. Tying the token to a
+// key means an exit node that sees it can't spend it on another message.
+type PostingToken struct {
+	KeyId     string // PostingKey.Id of the key that signed it
+	PublicKey []byte
+	Signature []byte
+}
+
+// Asks the IRC server to sign blinded posting tokens. Sent in polling cells
+// as CommandIssuePostingTokens.
+type PostingTokenRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+
+	// Tokens blinded with the key KeyId names. A KeyId that isn't the
+	// current key gets the current key back and nothing signed.
+	KeyId   string
+	Blinded [][]byte
+}
+
+type PostingTokenResponse struct {
+	Key        PostingKey
+	Signatures [][]byte // one per signed token, in the order of the request
+	Remaining  int      // tokens the user may still get with Key
+}
+
+// A token the proxy has blinded, kept until the IRC server signs it
+type BlindedToken struct {
+	Blinded    []byte // sent to the IRC server
+	PrivateKey ed25519.PrivateKey
+
+	key       PostingKey
+	namespace string
+	unblinder *big.Int // the blinding factor's inverse mod N
+}
+
+var (
+	badPostingKeyError       = errors.New("Posting key is too small or malformed")
+	badBlindSignatureError   = errors.New("IRC server's signature does not match the blinded token")
+	blindedTokenRangeError   = errors.New("Blinded token is not smaller than the posting key's modulus")
+	postingKeyMismatchError  = errors.New("Posting key does not match the token")
+	missingBlindedTokenError = errors.New("Blinded token is empty")
+)
+
+// Short name of the key that tokens carry
+func (k PostingKey) Id() string {
+	sum := sha256.Sum256(append([]byte("torchat-posting-key\n"+strconv.Itoa(k.E)+"\n"), k.N...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k PostingKey) modulus() (*big.Int, error) {
+	n := new(big.Int).SetBytes(k.N)
+	if n.BitLen() < minPostingKeyBits || k.E < 3 || k.E%2 == 0 {
+		return nil, badPostingKeyError
+	}
+	return n, nil
+}
+
+func PostingKeyOf(key *rsa.PublicKey, expiresAt time.Time) PostingKey {
+	return PostingKey{N: key.N.Bytes(), E: key.E, ExpiresAt: expiresAt}
+}
+
+// Full domain hash of a token's public key, tied to the namespace it is
+// spent in: SHA-256 under a counter out to the length of N, reduced mod N
+func postingTokenHash(n *big.Int, namespace string, publicKey []byte) *big.Int {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	size := (n.BitLen() + 7) / 8
+	digest := make([]byte, 0, size+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(digest) < size; i++ {
+		binary.BigEndian.PutUint32(counter[:], i)
+		block := sha256.Sum256(append(append([]byte("torchat-posting-token\n"+namespace+"\n"), publicKey...), counter[:]...))
+		digest = append(digest, block[:]...)
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(digest[:size]), n)
+}
+
+// Makes a token for namespace and blinds it for key with a random factor
+func BlindPostingToken(key PostingKey, namespace string, random io.Reader) (BlindedToken, error) {
+	n, err := key.modulus()
+	if err != nil {
+		return BlindedToken{}, err
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(random)
+	if err != nil {
+		return BlindedToken{}, err
+	}
+
+	var r, unblinder *big.Int
+	for unblinder == nil {
+		r, err = randomBelow(random, n)
+		if err != nil {
+			return BlindedToken{}, err
+		}
+		unblinder = new(big.Int).ModInverse(r, n)
+	}
+
+	// hash * r^e mod N; the IRC server's signature of it is hash^d * r
+	blinded := new(big.Int).Exp(r, big.NewInt(int64(key.E)), n)
+	blinded.Mul(blinded, postingTokenHash(n, namespace, publicKey)).Mod(blinded, n)
+	return BlindedToken{
+		Blinded:    blinded.Bytes(),
+		PrivateKey: privateKey,
+		key:        key,
+		namespace:  namespace,
+		unblinder:  unblinder,
+	}, nil
+}
+
+func randomBelow(random io.Reader, n *big.Int) (*big.Int, error) {
+	buf := make([]byte, (n.BitLen()+7)/8+8)
+	if _, err := io.ReadFull(random, buf); err != nil {
+		return nil, err
+	}
+	r := new(big.Int).Mod(new(big.Int).SetBytes(buf), n)
+	if r.Sign() == 0 {
+		r.SetInt64(1)
+	}
+	return r, nil
+}
+
+// Removes the blinding factor from the IRC server's signature and checks
+// that the result is a valid token
+func (b BlindedToken) Unblind(signature []byte) (PostingToken, error) {
+	n, err := b.key.modulus()
+	if err != nil {
+		return PostingToken{}, err
+	}
+	s := new(big.Int).SetBytes(signature)
+	s.Mul(s, b.unblinder).Mod(s, n)
+
+	token := PostingToken{
+		KeyId:     b.key.Id(),
+		PublicKey: b.PrivateKey.Public().(ed25519.PublicKey),
+		Signature: s.Bytes(),
+	}
+	if !VerifyPostingToken(b.key, b.namespace, token) {
+		return PostingToken{}, badBlindSignatureError
+	}
+	return token, nil
+}
+
+// The IRC server's half: a raw RSA signature over a blinded token, which
+// tells it nothing about the token
+func SignBlindedToken(key *rsa.PrivateKey, blinded []byte) ([]byte, error) {
+	if len(blinded) == 0 {
+		return nil, missingBlindedTokenError
+	}
+	m := new(big.Int).SetBytes(blinded)
+	if m.Cmp(key.N) >= 0 {
+		return nil, blindedTokenRangeError
+	}
+	return new(big.Int).Exp(m, key.D, key.N).Bytes(), nil
+}
+
+// Whether token was signed with key for namespace
+func VerifyPostingToken(key PostingKey, namespace string, token PostingToken) bool {
+	n, err := key.modulus()
+	if err != nil || token.KeyId != key.Id() || len(token.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	s := new(big.Int).SetBytes(token.Signature)
+	if s.Sign() == 0 || s.Cmp(n) >= 0 {
+		return false
+	}
+	return new(big.Int).Exp(s, big.NewInt(int64(key.E)), n).Cmp(postingTokenHash(n, namespace, token.PublicKey)) == 0
+}
+
+// Signs an anonymous message with the token's key and attaches the token
+func SignAnonymousMessage(m *ChatMessage, token PostingToken, key ed25519.PrivateKey) error {
+	if !ed25519.PublicKey(token.PublicKey).Equal(key.Public()) {
+		return postingKeyMismatchError
+	}
+	m.Username = ""
+	m.UserToken = ""
+	m.PostingToken = &token
+	SignMessage(m, key)
+	return nil
+}
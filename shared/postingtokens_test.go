@@ -0,0 +1,94 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestPostingKey(t *testing.T) (*rsa.PrivateKey, PostingKey) {
+	private, err := rsa.GenerateKey(rand.Reader, minPostingKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, PostingKeyOf(&private.PublicKey, time.Now().Add(time.Hour))
+}
+
+func TestPostingTokenBlindUnblind(t *testing.T) {
+	private, key := newTestPostingKey(t)
+	blinded, err := BlindPostingToken(key, "books", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := SignBlindedToken(private, blinded.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := blinded.Unblind(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !VerifyPostingToken(key, "books", token) {
+		t.Fatal("an unblinded token didn't verify")
+	}
+	if VerifyPostingToken(key, "films", token) {
+		t.Fatal("a token verified in another namespace")
+	}
+	// The IRC server never sees what it signed
+	if bytes.Equal(signature, token.Signature) || bytes.Equal(blinded.Blinded, postingTokenHash(new(big.Int).SetBytes(key.N), "books", token.PublicKey).Bytes()) {
+		t.Fatal("blinding changed nothing")
+	}
+
+	var m ChatMessage
+	m.Username, m.UserToken, m.Message = "alice", "secret", "anonymous"
+	if err := SignAnonymousMessage(&m, token, blinded.PrivateKey); err != nil {
+		t.Fatal(err)
+	}
+	if m.Username != "" || m.UserToken != "" || m.PostingToken == nil {
+		t.Fatal("an anonymous message still names its sender")
+	}
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SignAnonymousMessage(&m, token, other) != postingKeyMismatchError {
+		t.Fatal("a token was spent with another key")
+	}
+}
+
+func TestPostingTokenBadSignature(t *testing.T) {
+	private, key := newTestPostingKey(t)
+	blinded, err := BlindPostingToken(key, "", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := BlindPostingToken(key, "", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := SignBlindedToken(private, other.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blinded.Unblind(signature); err != badBlindSignatureError {
+		t.Fatalf("unblinding another token's signature gave %v, want %v", err, badBlindSignatureError)
+	}
+}
+
+func TestSignBlindedTokenRange(t *testing.T) {
+	private, _ := newTestPostingKey(t)
+	if _, err := SignBlindedToken(private, nil); err != missingBlindedTokenError {
+		t.Fatalf("signing nothing gave %v", err)
+	}
+	if _, err := SignBlindedToken(private, private.N.Bytes()); err != blindedTokenRangeError {
+		t.Fatalf("signing N gave %v", err)
+	}
+	if _, err := BlindPostingToken(PostingKey{N: []byte{0xff}, E: 3}, "", rand.Reader); err != badPostingKeyError {
+		t.Fatalf("blinding for a small key gave %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+// Hash a registration proof of work is judged by, over the namespace, the
+// username being registered, the stamp time and the nonce. Tying it to the
+// username and time means every registration takes fresh work.
+func ProofOfWorkHash(namespace string, username string, stamp time.Time, nonce uint64) [sha256.Size]byte {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	data := []byte("torchat-register\n" + namespace + "\n" + username + "\n" + strconv.FormatInt(stamp.UnixNano(), 10) + "\n")
+	var nonceBytes [8]byte
+	binary.BigEndian.PutUint64(nonceBytes[:], nonce)
+	return sha256.Sum256(append(data, nonceBytes[:]...))
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// Whether the nonce's hash starts with at least difficulty zero bits
+func CheckProofOfWork(namespace string, username string, stamp time.Time, nonce uint64, difficulty int) bool {
+	return leadingZeroBits(ProofOfWorkHash(namespace, username, stamp, nonce)) >= difficulty
+}
+
+// Finds a nonce for the stamp time, about 2^difficulty hashes of work
+func SolveProofOfWork(namespace string, username string, stamp time.Time, difficulty int) uint64 {
+	for nonce := uint64(0); ; nonce++ {
+		if CheckProofOfWork(namespace, username, stamp, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
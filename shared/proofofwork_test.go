@@ -0,0 +1,42 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProofOfWork(t *testing.T) {
+	stamp := time.Now()
+	nonce := SolveProofOfWork("uni", "alice", stamp, 12)
+	if !CheckProofOfWork("uni", "alice", stamp, nonce, 12) {
+		t.Fatal("a solved proof of work didn't check")
+	}
+	if leadingZeroBits(ProofOfWorkHash("uni", "alice", stamp, nonce)) < 12 {
+		t.Fatal("the solution has too few zero bits")
+	}
+
+	// The work is tied to the username, namespace and stamp
+	for _, fails := range []bool{
+		CheckProofOfWork("uni", "bob", stamp, nonce, 12),
+		CheckProofOfWork("other", "alice", stamp, nonce, 12),
+		CheckProofOfWork("uni", "alice", stamp.Add(time.Nanosecond), nonce, 12),
+	} {
+		if fails {
+			t.Fatal("a proof of work checked for another registration")
+		}
+	}
+	if ProofOfWorkHash("", "alice", stamp, nonce) != ProofOfWorkHash(DefaultNamespace, "alice", stamp, nonce) {
+		t.Fatal("the default namespace hashes differently by name")
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	var hash [32]byte
+	if leadingZeroBits(hash) != 256 {
+		t.Fatal("an all zero hash")
+	}
+	hash[1] = 0x10
+	if n := leadingZeroBits(hash); n != 11 {
+		t.Fatalf("counted %d zero bits, want 11", n)
+	}
+}
@@ -0,0 +1,512 @@
+package shared
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Direct messages are encrypted with a double ratchet, as in Signal. Sessions
+// are set up without the recipient being online (X3DH): their proxy leaves a
+// signed prekey and one-time prekeys on the IRC server, with the private
+// halves sealed to the user's encryption key so only their own proxy can
+// open them. The IRC server hands the sealed halves back along with the first
+// message that used them.
+
+const (
+	maxSkip        = 256  // messages one chain may skip ahead
+	maxSkippedKeys = 1024 // message keys kept for messages that haven't arrived yet
+)
+
+// A prekey's public half, and sealed private half while the IRC server holds it
+type Prekey struct {
+	Id     uint32
+	Public []byte // X25519
+	Sealed []byte `json:",omitempty"` // see NewPrekey; never handed to other users
+}
+
+// Leaves prekeys on the IRC server. Sent as CommandUploadPrekeys.
+type PrekeyUpload struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+
+	SignedPrekey   *Prekey `json:",omitempty"` // replaces the current one if set
+	Signature      []byte  `json:",omitempty"` // SignedPrekeyBytes signed with the user's signing key
+	OneTimePrekeys []Prekey
+}
+
+// Asks for Owner's prekey bundle. Sent in polling cells as CommandPrekeyBundle.
+type PrekeyBundleRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	Owner         string
+}
+
+// What a sender needs to start a session with Owner
+type PrekeyBundle struct {
+	Owner         string
+	IdentityKey   []byte // Owner's registered encryption key
+	SigningKey    []byte // Owner's registered Ed25519 key, which signed SignedPrekey
+	SignedPrekey  Prekey
+	Signature     []byte
+	OneTimePrekey *Prekey `json:",omitempty"` // handed out once, none when they ran out
+}
+
+// Sent with every message of a new session until the recipient answers, so
+// they can work out the session's keys
+type RatchetInit struct {
+	IdentityKey     []byte // the sender's encryption key
+	EphemeralKey    []byte
+	SignedPrekeyId  uint32
+	OneTimePrekeyId uint32 `json:",omitempty"` // zero if the bundle had none
+}
+
+type RatchetHeader struct {
+	DH []byte // sender's current ratchet key
+	PN uint32 // messages in the sender's previous chain
+	N  uint32 // number of this message in its chain
+}
+
+// A direct message's text encrypted in a session. See Ratchet.
+type RatchetMessage struct {
+	Init       *RatchetInit `json:",omitempty"`
+	Header     RatchetHeader
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// A RatchetMessage as the recipient's proxy gets it. For a message that
+// starts a session the IRC server attaches the sealed prekeys it used.
+type RatchetEnvelope struct {
+	From          string
+	Message       RatchetMessage
+	SignedPrekey  *Prekey `json:",omitempty"`
+	OneTimePrekey *Prekey `json:",omitempty"`
+}
+
+// One side of a session. Not safe for concurrent use.
+type Ratchet struct {
+	rootKey   []byte
+	sending   *ecdh.PrivateKey
+	remote    []byte // the other side's current ratchet key
+	sendChain []byte
+	recvChain []byte
+	ns, nr    uint32
+	pn        uint32
+	skipped   map[skippedKey][]byte
+	ad        []byte // initiator's identity key, then the responder's
+
+	ephemeral []byte       // RatchetInit.EphemeralKey of the session
+	init      *RatchetInit // sent along until the other side answers
+}
+
+type skippedKey struct {
+	dh string
+	n  uint32
+}
+
+var (
+	badPrekeyError         = errors.New("Prekey is malformed or does not open with this key")
+	badPrekeyBundleError   = errors.New("Prekey bundle is not signed by its owner")
+	missingPrekeyError     = errors.New("Message starts a session with prekeys that were not attached")
+	badRatchetMessageError = errors.New("Direct message does not decrypt in this session")
+	tooManySkippedError    = errors.New("Direct message skips too many messages")
+)
+
+// The bytes a user signs for their signed prekey
+func SignedPrekeyBytes(p Prekey) []byte {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], p.Id)
+	return append(append([]byte("torchat-signed-prekey\n"), id[:]...), p.Public...)
+}
+
+func prekeySealKey(identity *ecdh.PrivateKey) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, identity.Bytes(), nil, "torchat-prekey-seal", 32)
+	if err != nil {
+		return nil, err
+	}
+	return newGCM(key)
+}
+
+// Makes a prekey with the private half sealed to identity, the user's
+// encryption key
+func NewPrekey(id uint32, identity *ecdh.PrivateKey, random io.Reader) (Prekey, error) {
+	private, err := ecdh.X25519().GenerateKey(random)
+	if err != nil {
+		return Prekey{}, err
+	}
+	aead, err := prekeySealKey(identity)
+	if err != nil {
+		return Prekey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return Prekey{}, err
+	}
+	p := Prekey{Id: id, Public: private.PublicKey().Bytes()}
+	p.Sealed = aead.Seal(nonce, nonce, private.Bytes(), SignedPrekeyBytes(p))
+	return p, nil
+}
+
+// Opens the private half of a prekey sealed with NewPrekey
+func OpenPrekey(identity *ecdh.PrivateKey, p Prekey) (*ecdh.PrivateKey, error) {
+	aead, err := prekeySealKey(identity)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Sealed) < aead.NonceSize() {
+		return nil, badPrekeyError
+	}
+	nonce, sealed := p.Sealed[:aead.NonceSize()], p.Sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, SignedPrekeyBytes(Prekey{Id: p.Id, Public: p.Public}))
+	if err != nil {
+		return nil, badPrekeyError
+	}
+	private, err := ecdh.X25519().NewPrivateKey(plaintext)
+	if err != nil || !bytes.Equal(private.PublicKey().Bytes(), p.Public) {
+		return nil, badPrekeyError
+	}
+	return private, nil
+}
+
+// Whether the bundle's signed prekey is signed by its owner's signing key
+func VerifyPrekeyBundle(b PrekeyBundle) bool {
+	if len(b.SigningKey) != ed25519.PublicKeySize || len(b.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(b.SigningKey), SignedPrekeyBytes(Prekey{Id: b.SignedPrekey.Id, Public: b.SignedPrekey.Public}), b.Signature)
+}
+
+// The session's first secret from the X3DH agreement's outputs
+func x3dhSecret(dhs ...[]byte) ([]byte, error) {
+	secret := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		secret = append(secret, dh...)
+	}
+	return hkdf.Key(sha256.New, secret, nil, "torchat-x3dh", 32)
+}
+
+// Starts a session with a bundle's owner, as the side that speaks first
+func NewInitiatorRatchet(identity *ecdh.PrivateKey, bundle PrekeyBundle, random io.Reader) (*Ratchet, error) {
+	if !VerifyPrekeyBundle(bundle) {
+		return nil, badPrekeyBundleError
+	}
+	curve := ecdh.X25519()
+	theirIdentity, err := curve.NewPublicKey(bundle.IdentityKey)
+	if err != nil {
+		return nil, badPrekeyError
+	}
+	signedPrekey, err := curve.NewPublicKey(bundle.SignedPrekey.Public)
+	if err != nil {
+		return nil, badPrekeyError
+	}
+	ephemeral, err := curve.GenerateKey(random)
+	if err != nil {
+		return nil, err
+	}
+
+	dhs := make([][]byte, 0, 4)
+	for _, pair := range []struct {
+		private *ecdh.PrivateKey
+		public  *ecdh.PublicKey
+	}{{identity, signedPrekey}, {ephemeral, theirIdentity}, {ephemeral, signedPrekey}} {
+		dh, err := pair.private.ECDH(pair.public)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+	}
+	init := &RatchetInit{
+		IdentityKey:    identity.PublicKey().Bytes(),
+		EphemeralKey:   ephemeral.PublicKey().Bytes(),
+		SignedPrekeyId: bundle.SignedPrekey.Id,
+	}
+	if bundle.OneTimePrekey != nil {
+		oneTime, err := curve.NewPublicKey(bundle.OneTimePrekey.Public)
+		if err != nil {
+			return nil, badPrekeyError
+		}
+		dh, err := ephemeral.ECDH(oneTime)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+		init.OneTimePrekeyId = bundle.OneTimePrekey.Id
+	}
+	secret, err := x3dhSecret(dhs...)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Ratchet{
+		remote:    bundle.SignedPrekey.Public,
+		skipped:   make(map[skippedKey][]byte),
+		ad:        append(append([]byte(nil), init.IdentityKey...), bundle.IdentityKey...),
+		ephemeral: init.EphemeralKey,
+		init:      init,
+	}
+	if r.sending, err = curve.GenerateKey(random); err != nil {
+		return nil, err
+	}
+	dh, err := r.sending.ECDH(signedPrekey)
+	if err != nil {
+		return nil, err
+	}
+	r.rootKey, r.sendChain, err = rootStep(secret, dh)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Starts a session from the first message of one, as the side that answers.
+// The session is only worth keeping once that message decrypts.
+func NewResponderRatchet(identity *ecdh.PrivateKey, envelope RatchetEnvelope) (*Ratchet, error) {
+	init := envelope.Message.Init
+	if init == nil || envelope.SignedPrekey == nil || envelope.SignedPrekey.Id != init.SignedPrekeyId {
+		return nil, missingPrekeyError
+	}
+	curve := ecdh.X25519()
+	theirIdentity, err := curve.NewPublicKey(init.IdentityKey)
+	if err != nil {
+		return nil, badRatchetMessageError
+	}
+	ephemeral, err := curve.NewPublicKey(init.EphemeralKey)
+	if err != nil {
+		return nil, badRatchetMessageError
+	}
+	signedPrekey, err := OpenPrekey(identity, *envelope.SignedPrekey)
+	if err != nil {
+		return nil, err
+	}
+
+	dhs := make([][]byte, 0, 4)
+	for _, pair := range []struct {
+		private *ecdh.PrivateKey
+		public  *ecdh.PublicKey
+	}{{signedPrekey, theirIdentity}, {identity, ephemeral}, {signedPrekey, ephemeral}} {
+		dh, err := pair.private.ECDH(pair.public)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+	}
+	if init.OneTimePrekeyId != 0 {
+		if envelope.OneTimePrekey == nil || envelope.OneTimePrekey.Id != init.OneTimePrekeyId {
+			return nil, missingPrekeyError
+		}
+		oneTime, err := OpenPrekey(identity, *envelope.OneTimePrekey)
+		if err != nil {
+			return nil, err
+		}
+		dh, err := oneTime.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+	}
+	secret, err := x3dhSecret(dhs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ratchet{
+		rootKey:   secret,
+		sending:   signedPrekey,
+		skipped:   make(map[skippedKey][]byte),
+		ad:        append(append([]byte(nil), init.IdentityKey...), identity.PublicKey().Bytes()...),
+		ephemeral: init.EphemeralKey,
+	}, nil
+}
+
+// Whether the session is the one init starts
+func (r *Ratchet) BeganWith(init RatchetInit) bool {
+	return bytes.Equal(r.ephemeral, init.EphemeralKey)
+}
+
+// Whether the other side is known to have the session: always for the side
+// that answered, and for the side that spoke first once an answer came
+func (r *Ratchet) Confirmed() bool {
+	return r.init == nil
+}
+
+func rootStep(rootKey []byte, dh []byte) ([]byte, []byte, error) {
+	out, err := hkdf.Key(sha256.New, dh, rootKey, "torchat-ratchet", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// The chain's next key and the key of its next message
+func chainStep(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	return next, mac.Sum(nil)
+}
+
+// Everything sent in the clear is bound into the ciphertext
+func (r *Ratchet) additionalData(msg RatchetMessage) ([]byte, error) {
+	header, err := json.Marshal(struct {
+		Init   *RatchetInit
+		Header RatchetHeader
+	}{msg.Init, msg.Header})
+	if err != nil {
+		return nil, EncodingError("ratchet header", err)
+	}
+	return append(append([]byte(nil), r.ad...), header...), nil
+}
+
+func (r *Ratchet) Encrypt(text string, random io.Reader) (RatchetMessage, error) {
+	if r.sendChain == nil {
+		return RatchetMessage{}, badRatchetMessageError
+	}
+	var messageKey []byte
+	r.sendChain, messageKey = chainStep(r.sendChain)
+	msg := RatchetMessage{
+		Init:   r.init,
+		Header: RatchetHeader{DH: r.sending.PublicKey().Bytes(), PN: r.pn, N: r.ns},
+	}
+	r.ns++
+
+	aead, err := newGCM(messageKey)
+	if err != nil {
+		return RatchetMessage{}, err
+	}
+	msg.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(random, msg.Nonce); err != nil {
+		return RatchetMessage{}, err
+	}
+	ad, err := r.additionalData(msg)
+	if err != nil {
+		return RatchetMessage{}, err
+	}
+	msg.Ciphertext = aead.Seal(nil, msg.Nonce, []byte(text), ad)
+	return msg, nil
+}
+
+// Decrypts a message of the session. The session is left as it was if the
+// message doesn't decrypt.
+func (r *Ratchet) Decrypt(msg RatchetMessage, random io.Reader) (string, error) {
+	next := *r
+	next.skipped = make(map[skippedKey][]byte, len(r.skipped))
+	for k, v := range r.skipped {
+		next.skipped[k] = v
+	}
+
+	text, err := next.decrypt(msg, random)
+	if err != nil {
+		return "", err
+	}
+	next.init = nil
+	*r = next
+	return text, nil
+}
+
+func (r *Ratchet) decrypt(msg RatchetMessage, random io.Reader) (string, error) {
+	skipped := skippedKey{string(msg.Header.DH), msg.Header.N}
+	if messageKey, ok := r.skipped[skipped]; ok {
+		delete(r.skipped, skipped)
+		return r.open(messageKey, msg)
+	}
+
+	if r.remote == nil || !bytes.Equal(msg.Header.DH, r.remote) {
+		if err := r.skipTo(msg.Header.PN); err != nil {
+			return "", err
+		}
+		if err := r.step(msg.Header.DH, random); err != nil {
+			return "", err
+		}
+	}
+	if err := r.skipTo(msg.Header.N); err != nil {
+		return "", err
+	}
+	var messageKey []byte
+	r.recvChain, messageKey = chainStep(r.recvChain)
+	r.nr++
+	return r.open(messageKey, msg)
+}
+
+// Keeps the keys of messages of the receiving chain before until, which may
+// still arrive
+func (r *Ratchet) skipTo(until uint32) error {
+	if r.recvChain == nil || until <= r.nr {
+		return nil
+	}
+	if until-r.nr > maxSkip || len(r.skipped)+int(until-r.nr) > maxSkippedKeys {
+		return tooManySkippedError
+	}
+	for r.nr < until {
+		var messageKey []byte
+		r.recvChain, messageKey = chainStep(r.recvChain)
+		r.skipped[skippedKey{string(r.remote), r.nr}] = messageKey
+		r.nr++
+	}
+	return nil
+}
+
+// Moves on to the other side's new ratchet key, and to a new one of ours
+func (r *Ratchet) step(remote []byte, random io.Reader) error {
+	curve := ecdh.X25519()
+	remoteKey, err := curve.NewPublicKey(remote)
+	if err != nil {
+		return badRatchetMessageError
+	}
+	dh, err := r.sending.ECDH(remoteKey)
+	if err != nil {
+		return badRatchetMessageError
+	}
+	rootKey, recvChain, err := rootStep(r.rootKey, dh)
+	if err != nil {
+		return err
+	}
+	sending, err := curve.GenerateKey(random)
+	if err != nil {
+		return err
+	}
+	if dh, err = sending.ECDH(remoteKey); err != nil {
+		return badRatchetMessageError
+	}
+	if r.rootKey, r.sendChain, err = rootStep(rootKey, dh); err != nil {
+		return err
+	}
+	r.pn, r.ns, r.nr = r.ns, 0, 0
+	r.remote = append([]byte(nil), remote...)
+	r.recvChain = recvChain
+	r.sending = sending
+	return nil
+}
+
+func (r *Ratchet) open(messageKey []byte, msg RatchetMessage) (string, error) {
+	aead, err := newGCM(messageKey)
+	if err != nil {
+		return "", err
+	}
+	if len(msg.Nonce) != aead.NonceSize() {
+		return "", badRatchetMessageError
+	}
+	ad, err := r.additionalData(msg)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := aead.Open(nil, msg.Nonce, msg.Ciphertext, ad)
+	if err != nil {
+		return "", badRatchetMessageError
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,178 @@
+package shared
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+)
+
+// A recipient's keys, and the bundle the IRC server hands out for them
+type testRecipient struct {
+	identity     *ecdh.PrivateKey
+	signedPrekey Prekey
+	oneTime      Prekey
+	bundle       PrekeyBundle
+}
+
+func newTestRecipient(t *testing.T) testRecipient {
+	identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPublic, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedPrekey, err := NewPrekey(1, identity, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneTime, err := NewPrekey(2, identity, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testRecipient{
+		identity:     identity,
+		signedPrekey: signedPrekey,
+		oneTime:      oneTime,
+		bundle: PrekeyBundle{
+			Owner:         "bob",
+			IdentityKey:   identity.PublicKey().Bytes(),
+			SigningKey:    signingPublic,
+			SignedPrekey:  Prekey{Id: signedPrekey.Id, Public: signedPrekey.Public},
+			Signature:     ed25519.Sign(signing, SignedPrekeyBytes(signedPrekey)),
+			OneTimePrekey: &Prekey{Id: oneTime.Id, Public: oneTime.Public},
+		},
+	}
+}
+
+// Starts a session from alice to bob with its first message
+func newTestSession(t *testing.T) (*Ratchet, *Ratchet) {
+	bob := newTestRecipient(t)
+	aliceIdentity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := NewInitiatorRatchet(aliceIdentity, bob.bundle, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := alice.Encrypt("hello bob", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := RatchetEnvelope{From: "alice", Message: first, SignedPrekey: &bob.signedPrekey, OneTimePrekey: &bob.oneTime}
+	responder, err := NewResponderRatchet(bob.identity, envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := responder.Decrypt(first, rand.Reader); err != nil || text != "hello bob" {
+		t.Fatalf("first message decrypted to %q, %v", text, err)
+	}
+	return alice, responder
+}
+
+func encrypt(t *testing.T, r *Ratchet, text string) RatchetMessage {
+	msg, err := r.Encrypt(text, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func expectDecrypt(t *testing.T, r *Ratchet, msg RatchetMessage, want string) {
+	t.Helper()
+	text, err := r.Decrypt(msg, rand.Reader)
+	if err != nil || text != want {
+		t.Fatalf("decrypted to %q, %v; want %q", text, err, want)
+	}
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+	alice, bob := newTestSession(t)
+	if !alice.BeganWith(*encrypt(t, alice, "again").Init) {
+		t.Fatal("the initiator's messages don't carry its init until answered")
+	}
+
+	expectDecrypt(t, alice, encrypt(t, bob, "hello alice"), "hello alice")
+	if encrypt(t, alice, "answered").Init != nil {
+		t.Fatal("the initiator still sends its init after an answer")
+	}
+
+	// Several turns, each a ratchet step
+	for i, text := range []string{"one", "two", "three", "four"} {
+		from, to := alice, bob
+		if i%2 == 1 {
+			from, to = bob, alice
+		}
+		expectDecrypt(t, to, encrypt(t, from, text), text)
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newTestSession(t)
+	first, second, third := encrypt(t, alice, "1"), encrypt(t, alice, "2"), encrypt(t, alice, "3")
+	expectDecrypt(t, bob, third, "3")
+	expectDecrypt(t, bob, first, "1")
+	expectDecrypt(t, bob, second, "2")
+
+	// Every message key is used once
+	if _, err := bob.Decrypt(second, rand.Reader); err == nil {
+		t.Fatal("a message decrypted twice")
+	}
+}
+
+func TestRatchetRejectsTampering(t *testing.T) {
+	alice, bob := newTestSession(t)
+	msg := encrypt(t, alice, "do not touch")
+	tampered := msg
+	tampered.Ciphertext = append([]byte(nil), msg.Ciphertext...)
+	tampered.Ciphertext[0] ^= 1
+	if _, err := bob.Decrypt(tampered, rand.Reader); err == nil {
+		t.Fatal("a tampered message decrypted")
+	}
+	renumbered := msg
+	renumbered.Header.N++
+	if _, err := bob.Decrypt(renumbered, rand.Reader); err == nil {
+		t.Fatal("a message with a changed header decrypted")
+	}
+	// Failed messages leave the session as it was
+	expectDecrypt(t, bob, msg, "do not touch")
+}
+
+func TestRatchetTooManySkipped(t *testing.T) {
+	alice, bob := newTestSession(t)
+	var last RatchetMessage
+	for i := 0; i <= maxSkip+1; i++ {
+		last = encrypt(t, alice, "skipped")
+	}
+	if _, err := bob.Decrypt(last, rand.Reader); err != tooManySkippedError {
+		t.Fatalf("skipping %d messages gave %v, want %v", maxSkip+1, err, tooManySkippedError)
+	}
+}
+
+func TestPrekeyBundleSignature(t *testing.T) {
+	bob := newTestRecipient(t)
+	if !VerifyPrekeyBundle(bob.bundle) {
+		t.Fatal("a signed bundle didn't verify")
+	}
+	forged := bob.bundle
+	other, err := NewPrekey(1, bob.identity, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged.SignedPrekey = Prekey{Id: other.Id, Public: other.Public}
+	aliceIdentity, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewInitiatorRatchet(aliceIdentity, forged, rand.Reader); err != badPrekeyBundleError {
+		t.Fatalf("a bundle with a swapped prekey gave %v, want %v", err, badPrekeyBundleError)
+	}
+
+	// Only the owner's identity key opens their prekeys
+	if _, err := OpenPrekey(aliceIdentity, bob.signedPrekey); err == nil {
+		t.Fatal("a prekey opened with another identity key")
+	}
+}
@@ -0,0 +1,64 @@
+package shared
+
+import "fmt"
+
+// What a relay cell carries, read by every router on the circuit before it
+// peels its layer, so new kinds of cells don't need new RPC methods
+type RelayCommand byte
+
+const (
+	RelayChat    RelayCommand = iota + 1 // exit command with an ack, as DecryptChatMessageCell
+	RelayPoll                            // polling command, as DecryptPollingCell
+	RelayBegin                           // CommandStreamBegin, as DecryptStreamCell
+	RelayData                            // CommandStreamData
+	RelayEnd                             // CommandStreamEnd
+	RelayPadding                         // dropped by the router, as PaddingCell
+	RelayDestroy                         // Cell.Data is the DestroyToken, then the reason, as DestroyCircuit
+	RelayExport                          // export request, as DecryptExportCell
+	RelayPing                            // CommandPing, echoed by the exit
+)
+
+var relayCommandNames = map[RelayCommand]string{
+	RelayChat:    "CHAT",
+	RelayPoll:    "POLL",
+	RelayBegin:   "BEGIN",
+	RelayData:    "DATA",
+	RelayEnd:     "END",
+	RelayPadding: "PADDING",
+	RelayDestroy: "DESTROY",
+	RelayExport:  "EXPORT",
+	RelayPing:    "PING",
+}
+
+func (c RelayCommand) String() string {
+	if name, ok := relayCommandNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("RELAY_%d", byte(c))
+}
+
+// Sent to ORServer.Relay
+type RelayCell struct {
+	Command RelayCommand
+	Cell    Cell
+}
+
+// ORServer.Relay's answer. Only the field for the cell's command is set.
+type RelayReply struct {
+	Polling *PollingResponse `json:",omitempty"`
+	Export  *ExportChunk     `json:",omitempty"`
+	Stream  *StreamResponse  `json:",omitempty"`
+	Pong    *Ping            `json:",omitempty"`
+}
+
+// The relay command of a stream cell carrying command
+func StreamRelayCommand(command string) RelayCommand {
+	switch command {
+	case CommandStreamBegin:
+		return RelayBegin
+	case CommandStreamEnd:
+		return RelayEnd
+	default:
+		return RelayData
+	}
+}
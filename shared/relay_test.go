@@ -0,0 +1,21 @@
+package shared
+
+import "testing"
+
+func TestRelayCommands(t *testing.T) {
+	if got := RelayExport.String(); got != "EXPORT" {
+		t.Fatalf("RelayExport is %q", got)
+	}
+	if got := RelayCommand(42).String(); got != "RELAY_42" {
+		t.Fatalf("an unknown command is %q", got)
+	}
+	for command, want := range map[string]RelayCommand{
+		CommandStreamBegin: RelayBegin,
+		CommandStreamData:  RelayData,
+		CommandStreamEnd:   RelayEnd,
+	} {
+		if got := StreamRelayCommand(command); got != want {
+			t.Errorf("%s is sent as %v, want %v", command, got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// A user's contact as their proxy keeps it in the roster. The roster is
+// encrypted by the proxy; the IRC server only ever holds it as an opaque blob.
+type Contact struct {
+	Username string
+	Alias    string `json:",omitempty"`
+
+	// Pinned the first time the contact's keys are seen, or set by the user
+	// after comparing fingerprints. Keys the IRC server hands out later must
+	// match them.
+	SigningKey    []byte `json:",omitempty"`
+	EncryptionKey []byte `json:",omitempty"`
+
+	Updated time.Time
+	Removed bool `json:",omitempty"` // kept so a removal syncs to the user's other devices
+}
+
+// Asks the IRC server for the user's synced roster blob, or to replace it.
+// Get is sent in polling cells as CommandGetRoster, put as CommandPutRoster.
+type RosterRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+
+	// For a put: the blob's Version it replaces, so a device that hasn't
+	// seen another's change doesn't overwrite it
+	BaseVersion uint64 `json:",omitempty"`
+	Blob        []byte `json:",omitempty"`
+
+	AcceptsFragments bool `json:",omitempty"` // as in PollingMessage
+}
+
+type RosterBlob struct {
+	Version uint64 // zero while nothing was synced
+	Blob    []byte
+}
+
+// Short hex digest of a signing key, grouped for reading out to the contact
+func Fingerprint(signingKey []byte) string {
+	if len(signingKey) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(signingKey)
+	digest := hex.EncodeToString(sum[:10])
+	groups := make([]string, 0, len(digest)/4)
+	for i := 0; i < len(digest); i += 4 {
+		groups = append(groups, digest[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
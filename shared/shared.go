@@ -2,8 +2,20 @@ package shared
 
 import (
 	"crypto/ecdsa"
+	"crypto/md5"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"math/big"
+	"time"
+)
+
+// Namespace and channel used when a message does not name one
+const (
+	DefaultNamespace = "default"
+	DefaultChannel   = "#general"
 )
 
 type Cell struct {
@@ -11,37 +23,999 @@ type Cell struct {
 	Data      []byte
 }
 
+// Largest Cell.Data onion routers accept. Onions of fragmented commands stay
+// far below this; it bounds what proxies that don't fragment can send.
+const MaxCellData = 1 << 20
+
+// Commands carried in the exit node's onion layer. The exit node passes the
+// core data to the IRC server RPC matching the command.
+const (
+	CommandChatMessage      = ""         // ChatMessage -> CServer.PublishMessage
+	CommandRegisterUserName = "register" // UserNameRequest -> CServer.RegisterUserName
+	CommandChangeUserName   = "nick"     // UserNameRequest -> CServer.ChangeUserName
+	CommandPresence         = "presence" // PresenceRequest -> CServer.PublishPresence
+	CommandEditMessage      = "edit"     // MessageEditRequest -> CServer.EditMessage
+	CommandDeleteMessage    = "delete"   // MessageEditRequest -> CServer.DeleteMessage
+	CommandMarkRead         = "markread" // ReadMarkerRequest -> CServer.MarkRead
+	CommandForgetUser       = "forget"   // ForgetRequest -> CServer.ForgetUser
+	CommandUploadPrekeys    = "prekeys"  // PrekeyUpload -> CServer.UploadPrekeys
+	CommandPutRoster        = "roster"   // RosterRequest -> CServer.PutRoster
+	CommandContactRequest   = "contact"  // ContactRequest -> CServer.ChangeContact
+	CommandBlockUser        = "block"    // BlockRequest -> CServer.BlockUser
+	CommandFragment         = "fragment" // Fragment of a larger command, reassembled by the exit node
+
+	// Sent in polling cells
+	CommandFetchFragment      = "fetch-fragment" // FragmentRequest -> the next Fragment of a large response
+	CommandIssuePostingTokens = "posting-tokens" // PostingTokenRequest -> CServer.IssuePostingTokens
+	CommandChannelKeys        = "channel-keys"   // ChannelKeysRequest -> CServer.GetChannelKeys
+	CommandPrekeyBundle       = "prekey-bundle"  // PrekeyBundleRequest -> CServer.GetPrekeyBundle
+	CommandGetRoster          = "get-roster"     // RosterRequest -> CServer.GetRoster
+	CommandMeasure            = "measure"        // MeasureRequest -> as many random bytes, from the exit node itself
+
+	// Sent in stream cells, handled by the exit node itself
+	CommandStreamBegin = "begin" // StreamBegin -> opens a TCP connection
+	CommandStreamData  = "data"  // StreamData -> writes to it and reads what arrived
+	CommandStreamEnd   = "end"   // StreamEnd -> closes it
+
+	// Sent in ping cells, answered by the exit node itself
+	CommandPing = "ping" // Ping -> the same Ping back
+)
+
+// Whether command is one of the stream commands
+func StreamCommand(command string) bool {
+	return command == CommandStreamBegin || command == CommandStreamData || command == CommandStreamEnd
+}
+
+// Sends a chat client has awaiting an end-to-end ack at once. The chat
+// server's default per-user burst lets a full window through.
+const MaxInFlightMessages = 8
+
+// Largest core data carried in one cell. Larger commands and responses are
+// split into Fragments.
+const MaxFragmentData = 4096
+
+// One piece of a command or response too large for a cell. Fragments of one
+// message share an Id, random per circuit, and are numbered from 0.
+type Fragment struct {
+	Id      uint32
+	Seq     int
+	Total   int
+	Command string // command of the reassembled data, only set going to the exit node
+	Data    []byte
+}
+
+// Asks the exit node for fragment Seq of response Id
+type FragmentRequest struct {
+	Id  uint32
+	Seq int
+}
+
+// Splits data into fragments of at most MaxFragmentData bytes
+func SplitFragments(id uint32, command string, data []byte) []Fragment {
+	total := (len(data) + MaxFragmentData - 1) / MaxFragmentData
+	fragments := make([]Fragment, 0, total)
+	for seq := 0; seq < total; seq++ {
+		end := (seq + 1) * MaxFragmentData
+		if end > len(data) {
+			end = len(data)
+		}
+		fragments = append(fragments, Fragment{
+			Id:      id,
+			Seq:     seq,
+			Total:   total,
+			Command: command,
+			Data:    data[seq*MaxFragmentData : end],
+		})
+	}
+	return fragments
+}
+
+// Kinds of ephemeral presence events
+const (
+	PresenceTyping        = "typing"
+	PresenceStoppedTyping = "stopped-typing"
+)
+
 type Onion struct {
-	IsExitNode  bool   // true at layer of exit node
-	NextAddress string // specifies the next address in the forward direction of the circuit
-	Data        []byte
+	IsExitNode    bool   // true at layer of exit node
+	NextAddress   string // specifies the next address in the forward direction of the circuit
+	NextCircuitId uint32 // circuit id on the link to NextAddress, chosen by that router; 0 keeps the cell's id
+	Command       string // only set at layer of exit node
+	Data          []byte
+
+	// DestroyToken of the next router's circuit, so this router can pass a
+	// teardown on; nil at the exit node and for routers from before it
+	DestroyToken []byte `json:",omitempty"`
 }
 
 type ChatMessage struct {
 	IRCServerAddr string
+	Namespace     string // tenant on the IRC server, DefaultNamespace if empty
+	Channel       string // DefaultChannel if empty
+	Recipient     string // username to send a direct message to instead of posting to Channel
 	Username      string
+	UserToken     string // secret proving ownership of Username
 	Message       string
+	Deadline      time.Time // the IRC server rejects the message after this, zero for no deadline
+	SentAt        time.Time // sender's clock when sent, checked against the IRC server's
+
+	// The IRC server purges the message this long after publishing it, zero
+	// keeps it for the namespace's retention
+	TTL time.Duration `json:",omitempty"`
+
+	// Ed25519 signature over MessageSigningBytes by the key registered for
+	// Username, required once one is
+	Signature []byte `json:",omitempty"`
+
+	// Spent instead of Username and UserToken to publish anonymously, with
+	// Signature made by the token's key. See BlindPostingToken.
+	PostingToken *PostingToken `json:",omitempty"`
+
+	// Set instead of Message in end-to-end encrypted channels: the text
+	// encrypted with the sender's key, or for a direct message, the sender's
+	// key sealed to the recipient. See SenderKey.
+	Encrypted *EncryptedMessage  `json:",omitempty"`
+	SenderKey *SenderKeyEnvelope `json:",omitempty"`
+
+	// Set instead of Message in a direct message encrypted with the double
+	// ratchet. See Ratchet.
+	Ratchet *RatchetMessage `json:",omitempty"`
+
+	// Random id the IRC server publishes the message once by, for proxies
+	// sending each message over two circuits. Not signed: the signature
+	// already stops a signed message from being published twice.
+	MessageId string `json:",omitempty"`
+
+	// Numbers the sends of a client on its proxy session, which the proxy
+	// publishes in this order. Only used between client and proxy; zero
+	// sends are not ordered.
+	SendSeq uint64 `json:",omitempty"`
 }
 
 type PollingMessage struct {
 	IRCServerAddr string
+	Namespace     string
+	Username      string // only messages from channels this user joined are returned
+	UserToken     string
 	LastMessageId uint32
+	LastEventId   uint32
+	LastUpdateId  uint32
+	LastInboxId   uint32 // acknowledges inbox messages before this id
+	DeviceId      string // tells apart proxies polling for the same username
+	Limit         int    // most channel messages to return, 0 for the IRC server's default
+
+	AcceptsFragments bool // the exit node may answer with PollingResponse.Fragment
+}
+
+// Claims or renames a username on the IRC server. The first token used with a
+// username owns it until the server restarts.
+type UserNameRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	NewUsername   string // for CommandChangeUserName
+	UserToken     string
+
+	// Ed25519 public key the user's messages are signed with. The first key
+	// registered for a username is the only one accepted for it.
+	SigningKey []byte `json:",omitempty"`
+
+	// X25519 public key sender keys of encrypted channels are sealed to, held
+	// to the same rule as SigningKey
+	EncryptionKey []byte `json:",omitempty"`
+
+	// Pass the namespace's gate for new usernames: an invite from the
+	// operator, or a proof of work, see SolveProofOfWork
+	RegistrationToken string    `json:",omitempty"`
+	PowStamp          time.Time `json:",omitempty"`
+	PowNonce          uint64    `json:",omitempty"`
+}
+
+// Announces a presence event, such as typing, to the members of a channel.
+// Presence events are relayed to pollers but never kept in message history.
+type PresenceRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Channel       string // DefaultChannel if empty
+	Username      string
+	UserToken     string
+	Kind          string
+}
+
+type PresenceEvent struct {
+	Channel  string
+	Username string
+	Kind     string
+}
+
+// Edits or deletes a message. Only the user who sent the message can change it.
+type MessageEditRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	MessageId     uint32
+	Message       string // new text, for CommandEditMessage
+}
+
+type MessageMeta struct {
+	Id          uint32 // for editing and deleting
+	Channel     string
+	Time        time.Time // when the IRC server received the message
+	Edited      bool
+	ClockSkewed bool      // the sender's clock was far from the IRC server's
+	ExpiresAt   time.Time // when a message sent with a TTL is purged, zero if never
+	Anonymous   bool      // published with a posting token, so nobody knows who sent it
+
+	From      string            `json:",omitempty"` // sender's username, empty for notices and anonymous messages
+	Encrypted *EncryptedMessage `json:",omitempty"` // the text the message shows EncryptedPlaceholder for
+}
+
+// Tells a poller that a message it already received was edited or deleted
+type MessageUpdate struct {
+	MessageId uint32
+	Deleted   bool   // tombstone; the message should be removed from view
+	Expired   bool   // the message was deleted because its TTL ran out
+	Message   string // the edited message, formatted like Messages
+}
+
+type PollingResponse struct {
+	Messages      []string
+	MessageMeta   []MessageMeta // one per message
+	NextMessageId uint32        // LastMessageId to use for the next poll
+	More          bool          // the limit was reached before NextMessageId caught up with the log
+	Events        []PresenceEvent
+	NextEventId   uint32 // LastEventId to use for the next poll
+	Updates       []MessageUpdate
+	NextUpdateId  uint32            // LastUpdateId to use for the next poll
+	Inbox         []string          // direct messages and mentions queued while the user was away
+	NextInboxId   uint32            // LastInboxId to use for the next poll once Inbox is shown
+	Username      string            // current username, changed if another device renamed the user
+	ReadMarkers   map[string]uint32 // last read message id by channel, for channels with a marker
+	UnreadCounts  map[string]int    // unread messages by joined channel
+
+	// Set instead of the fields above when the response was too large for a
+	// cell: the first fragment of the JSON encoded response. Fetch the rest
+	// with CommandFetchFragment.
+	Fragment *Fragment `json:",omitempty"`
+
+	// Set instead of the fields above in answer to CommandIssuePostingTokens
+	PostingTokens *PostingTokenResponse `json:",omitempty"`
+	// or to CommandChannelKeys
+	ChannelKeys *ChannelKeysResponse `json:",omitempty"`
+	// or to CommandPrekeyBundle
+	PrekeyBundle *PrekeyBundle `json:",omitempty"`
+	// or to CommandGetRoster
+	Roster *RosterBlob `json:",omitempty"`
+	// or to CommandMeasure
+	Measurement []byte `json:",omitempty"`
+
+	// Sender keys of encrypted channels from the inbox, kept apart from Inbox
+	SenderKeys []SenderKeyEnvelope `json:",omitempty"`
+	// and encrypted direct messages, which the proxy decrypts
+	RatchetMessages []RatchetEnvelope `json:",omitempty"`
+	// and contact requests and their answers
+	ContactEvents []ContactEvent `json:",omitempty"`
+
+	// Usernames the user blocked, so their proxy hides their channel messages
+	Blocked []string `json:",omitempty"`
+
+	// Prekeys the user has left on the IRC server, so their proxy knows
+	// when to leave more. SignedPrekeyId is zero if there is no signed prekey.
+	SignedPrekeyId uint32 `json:",omitempty"`
+	OneTimePrekeys int    `json:",omitempty"`
+}
+
+// One channel message as the onion proxy hands it to clients
+type PolledMessage struct {
+	MessageMeta
+	Text string // formatted like PollingResponse.Messages
+}
+
+// Asks the onion proxy for a page of new messages
+type PollRequest struct {
+	Limit  int    // most messages to return, 0 for the IRC server's default
+	Cursor uint32 // NextCursor of an earlier PollResult to read on from, 0 to continue from the last poll
+}
+
+// OPServer.SendChatMessage's answer
+type SendResult struct {
+	// No circuit could carry the message, so the proxy keeps it in the
+	// session's outbox and sends it once one can. A notice tells how it went.
+	Queued bool
+	Outbox int // messages in the outbox, this one included, when Queued
+}
+
+// Asks OPServer.CreateProfile or ConnectProfile for a saved identity
+type ProfileRequest struct {
+	Name       string
+	Username   string // what the profile chats as, only for CreateProfile
+	Passphrase string // the profile's files are encrypted with a key derived from it
+}
+
+// A page of new messages. Notices and ContactEvents are shown before
+// Messages, and Updates and Events after them.
+type PollResult struct {
+	Notices       []string       // local notices and inbox messages, formatted
+	ContactEvents []ContactEvent `json:",omitempty"`
+	Messages      []PolledMessage
+	Updates       []MessageUpdate
+	Events        []PresenceEvent
+	NextCursor    uint32 // one past the next message id, so 0 can mean the last poll
+	More          bool   // poll again right away for the rest of the backlog
+}
+
+// The result as display lines, in the order they should be shown
+func (r PollResult) Lines() []string {
+	lines := append([]string(nil), r.Notices...)
+	for _, event := range r.ContactEvents {
+		lines = append(lines, event.String())
+	}
+	for _, message := range r.Messages {
+		lines = append(lines, message.String())
+	}
+	for _, update := range r.Updates {
+		if update.Expired {
+			lines = append(lines, fmt.Sprintf("*** #%d expired", update.MessageId))
+		} else if update.Deleted {
+			lines = append(lines, fmt.Sprintf("*** #%d was deleted", update.MessageId))
+		} else {
+			lines = append(lines, fmt.Sprintf("*** #%d was edited: %s", update.MessageId, update.Message))
+		}
+	}
+	for _, event := range r.Events {
+		notice := "*** " + event.Username + " is typing..."
+		if event.Channel != DefaultChannel {
+			notice = "[" + event.Channel + "] " + notice
+		}
+		lines = append(lines, notice)
+	}
+	return lines
+}
+
+// Shows the message id, which the user refers to when editing or deleting,
+// the server's receive time and any indicators
+func (m PolledMessage) String() string {
+	// IRC servers from before message metadata only send the text
+	if m.Time.IsZero() {
+		return m.Text
+	}
+
+	text := fmt.Sprintf("#%d %s %s", m.Id, m.Time.Local().Format("15:04"), m.Text)
+	if m.Edited {
+		text += " (edited)"
+	}
+	if m.ClockSkewed {
+		text += " (sender's clock is wrong)"
+	}
+	if !m.ExpiresAt.IsZero() {
+		text += " (expires " + m.ExpiresAt.Local().Format("15:04:05") + ")"
+	}
+	return text
+}
+
+// Marks the messages of a channel up to and including MessageId as read by the
+// user, on all of their devices
+type ReadMarkerRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+	Channel       string // DefaultChannel if empty
+	MessageId     uint32
+}
+
+// Deletes a registered user and everything the IRC server keeps about them:
+// their messages become tombstones, their direct messages and inbox are
+// dropped and the username is free again
+type ForgetRequest struct {
+	IRCServerAddr string
+	Namespace     string
+	Username      string
+	UserToken     string
+}
+
+// Archive formats of CServer.ExportLog
+const (
+	ExportJSON   = "json"   // the chunks put together are one JSON array of ExportRecords
+	ExportNDJSON = "ndjson" // one ExportRecord per line
+)
+
+// Asks for one chunk of an archive of a channel or of the user's direct
+// messages. Send Cursor 0 first, then each chunk's NextCursor until Done.
+type ExportRequest struct {
+	IRCServerAddr  string
+	Namespace      string
+	Username       string
+	UserToken      string
+	Channel        string    // DefaultChannel if empty, ignored for DirectMessages
+	DirectMessages bool      // export the user's direct messages instead of a channel
+	Since          time.Time // no lower bound if zero
+	Until          time.Time // no upper bound if zero
+	Format         string    // ExportJSON if empty
+	Cursor         uint32
+	MaxBytes       int // chunk size, 0 uses the server's default
+}
+
+type ExportChunk struct {
+	Data       []byte
+	NextCursor uint32
+	Done       bool
+}
+
+// Largest data carried by a stream cell or its response, the same as a
+// fragment so stream cells look like any other
+const MaxStreamData = MaxFragmentData
+
+// Asks the exit node to open a TCP connection to Address (host:port). Stream
+// ids are picked by the proxy, random per circuit.
+type StreamBegin struct {
+	StreamId uint32
+	Address  string
+}
+
+// Sends Data (possibly none) on a stream. The response carries what the
+// destination sent since the last StreamData.
+type StreamData struct {
+	StreamId uint32
+	Data     []byte
+}
+
+type StreamEnd struct {
+	StreamId uint32
+}
+
+// Answer to every stream command. Closed is set once the destination closed
+// its side and all it sent has been returned.
+type StreamResponse struct {
+	Data   []byte
+	Closed bool
+}
+
+// One message in an export archive
+type ExportRecord struct {
+	Id      uint32
+	Channel string `json:",omitempty"`
+	From    string
+	To      string `json:",omitempty"` // recipient of a direct message
+	Message string
+	Time    time.Time
+	Edited  bool `json:",omitempty"`
+}
+
+type CircuitRequest struct {
+	MinHops int // accept a circuit shorter than the directory's hop count down to this many; 0 never accepts one
+
+	// host:port the exit must be willing to connect to, "" for any exit
+	Destination string `json:",omitempty"`
+	Streams     bool   `json:",omitempty"` // the exit must open TCP streams
+
+	// The circuit is long lived, so every OR on it must be Stable. The first
+	// hop always is.
+	Stable bool `json:",omitempty"`
+}
+
+// A chat server the directory advertises. Clients home channels on it by
+// Name or Address.
+type ChatServerInfo struct {
+	Name    string
+	Address string // ip:port of its CServer RPC
+}
+
+// Sent by a chat server to DServer.RegisterChatServer, and then every
+// ChatServerHeartbeatInterval to DServer.SendChatServerHeartbeat
+type ChatServerRegistration struct {
+	Name            string
+	Address         string // ip:port exit nodes reach its CServer RPC on
+	Token           string `json:",omitempty"` // the directory's chat server token, if it requires one
+	ProtocolVersion int
+}
+
+// How often registered chat servers send heartbeats. The directory stops
+// advertising one after ChatServerTimeout without any.
+const (
+	ChatServerHeartbeatInterval = 3 * time.Second
+	ChatServerTimeout           = 10 * time.Second
+)
+
+// The chat servers a directory advertises, signed like OnionRouterInfos
+type ChatServerList struct {
+	PubKey  *ecdsa.PublicKey
+	Hash    []byte // over Servers, see ChatServersHash
+	SigS    *big.Int
+	SigR    *big.Int
+	Servers []ChatServerInfo
+}
+
+// Asks the onion proxy to carry a channel's traffic to another chat server
+type ChannelHome struct {
+	Channel string // DefaultChannel if empty
+	Server  string // Name or Address of an advertised chat server, "" for the proxy's default
 }
 
 type OnionRouterInfos struct {
 	PubKey  *ecdsa.PublicKey
-	Hash    []byte
+	Hash    []byte   // over ORInfos and Params, see ConsensusHash
 	SigS    *big.Int // signed with private key of directory server
 	SigR    *big.Int // edsca.Sign returns R, S which is both needed to verify
 	ORInfos []OnionRouterInfo
+	Params  ClientParams
+
+	// When the consensus may be used, signed apart from Hash so OPs from
+	// before signed validity still verify it, see ConsensusValidityHash.
+	// Zero, and the signature nil, from directory servers from before it.
+	ValidAfter   time.Time
+	ValidUntil   time.Time
+	ValiditySigS *big.Int
+	ValiditySigR *big.Int
+}
+
+// Client behaviour the directory server recommends, so the network can be
+// tuned without new client releases. OPs adopt these unless overridden.
+type ClientParams struct {
+	MinPollInterval     time.Duration // OPs poll the IRC server at most this often
+	PaddingClass        string        // default padding class for new circuits
+	MinRotationInterval time.Duration // circuits are rotated after a random time in this range
+	MaxRotationInterval time.Duration
+}
+
+// Hash directory servers sign a chat server list with. The prefix keeps it
+// from ever matching a ConsensusHash.
+func ChatServersHash(servers []ChatServerInfo) ([]byte, error) {
+	serverBytes, err := json.Marshal(servers)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	hash.Write([]byte("chat-servers\n"))
+	hash.Write(serverBytes)
+	return hash.Sum(nil), nil
+}
+
+// The hash the directory server signs for an OR list and its params
+func ConsensusHash(orInfos []OnionRouterInfo, params ClientParams) ([]byte, error) {
+	orBytes, err := json.Marshal(orInfos)
+	if err != nil {
+		return nil, err
+	}
+	paramBytes, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	hash.Write(orBytes)
+	hash.Write(paramBytes)
+	return hash.Sum(nil), nil
+}
+
+// Hash directory servers sign a consensus' validity with, tied to the
+// consensus by its Hash. The prefix keeps it from ever matching another hash.
+func ConsensusValidityHash(consensusHash []byte, validAfter time.Time, validUntil time.Time) []byte {
+	times := make([]byte, 16)
+	binary.BigEndian.PutUint64(times, uint64(validAfter.Unix()))
+	binary.BigEndian.PutUint64(times[8:], uint64(validUntil.Unix()))
+
+	hash := sha256.New()
+	hash.Write([]byte("consensus-validity\n"))
+	hash.Write(consensusHash)
+	hash.Write(times)
+	return hash.Sum(nil)
 }
 
 type OnionRouterInfo struct {
 	Address string
 	PubKey  *rsa.PublicKey
+	Weight  float64 // relative chance of picking this OR, only set by DServer.GetConsensus
+	Stable  bool    `json:",omitempty"` // long enough between failures for the guard position and long lived circuits
+
+	ProtocolVersion int    // ProtocolVersion of the OR's build, 0 for ORs from before versioning
+	Bandwidth       uint64 // bytes per second the OR sustained relaying, 0 if not measured yet
+
+	// ip:port the OR listens on for each transport besides tcp, by name
+	Transports map[string]string `json:",omitempty"`
+
+	// More tcp addresses of a dual-stack OR, in the other address family.
+	// Address stays the OR's identity in the directory and in onion layers.
+	AltAddresses []string `json:",omitempty"`
+
+	// Destinations the OR exits to, see ParseExitPolicy; "" for ORs from
+	// before exit policies, which accept every destination
+	ExitPolicy  string `json:",omitempty"`
+	ExitStreams bool   `json:",omitempty"` // opens TCP streams as an exit, also CapabilityExitStreams
+
+	// What the OR does with its build and configuration, see Offers
+	Capabilities Capabilities `json:",omitempty"`
+
+	// How to reach the OR's operator, as they gave it
+	Contact string `json:",omitempty"`
+
+	// Sent by the OR to DServer.RegisterNode where the directory only lists
+	// enrolled ORs, never published
+	EnrollmentToken string `json:",omitempty"`
+
+	// Signature over KeyChangeSigningBytes by the key the directory lists
+	// for Address, for an OR moving to PubKey while its old entry is live;
+	// never published
+	KeyChangeSignature []byte `json:",omitempty"`
+
+	// Sent by the OR to DServer.RegisterNode, never published in the
+	// consensus; see DServer.GetDescriptor
+	Descriptor *SignedDescriptor `json:",omitempty"`
+}
+
+// Kinds of failure reported to the directory server
+const (
+	FailureExtend         = "FAILED_EXTEND"
+	FailureDecrypt        = "DECRYPT_ERROR"
+	FailureDroppedCircuit = "DROPPED_CIRCUIT"
+	FailureUnreachable    = "UNREACHABLE" // a router failed to reach the OR as next hop several times in a row
+)
+
+// Sent by OPs and ORs to DServer.ReportFailure when an OR misbehaves
+type FailureReport struct {
+	Address string // ip:port of the OR that failed
+	Kind    string
+}
+
+// Sent by ORs to DServer.ReportRouterFailure when they failed to reach a
+// next hop several times in a row
+type RouterFailureReport struct {
+	Reporter  string        // ip:port of the reporting OR, as it registered
+	Report    FailureReport // Kind is FailureUnreachable
+	Failures  int           // dials that failed in a row
+	SignedAt  int64         // unix nanoseconds
+	Signature []byte        // by the reporter's identity key, over RouterFailureSigningBytes
+}
+
+// Sent by ORs to DServer.SendHeartbeat to stay listed
+type Heartbeat struct {
+	Address   string // ip:port of the OR
+	Bandwidth uint64 // highest throughput, in bytes per second, the OR sustained recently
+	SelfTest  string // result of the OR's latest self-test, empty before the first
+	SignedAt  int64  // unix nanoseconds, later in every heartbeat, so old ones can't be replayed
+	Signature []byte // by the OR's identity key, over HeartbeatSigningBytes
+
+	Accounting *AccountingReport // nil for ORs without a traffic cap
+}
+
+// Traffic an OR with a cap relayed in its current accounting period
+type AccountingReport struct {
+	Max         uint64 // bytes the OR relays per period
+	Used        uint64 // of those, relayed so far
+	PeriodEnd   int64  // unix seconds when the next period starts
+	Hibernating bool   // the OR leaves the directory until PeriodEnd
+}
+
+// Bytes the OR may still relay this period
+func (a AccountingReport) Remaining() uint64 {
+	if a.Used >= a.Max {
+		return 0
+	}
+	return a.Max - a.Used
+}
+
+// Results of an OR's self-test, a circuit built through itself
+const (
+	SelfTestPassed     = "passed"
+	SelfTestFailed     = "failed"
+	SelfTestUntestable = "untestable" // too few other ORs to build the circuit
+)
+
+// Result of the directory's reachability test of a registered OR
+type Reachability struct {
+	Tested    bool // false while the directory is still dialing back
+	Reachable bool
 }
 
 type CircuitInfo struct {
 	CircuitId          uint32
 	EncryptedSharedKey []byte
+	Capabilities       Capabilities // of the onion proxy creating the circuit
+}
+
+// An onion router's answer to ORServer.NegotiateCircuit
+type CircuitCreated struct {
+	CircuitId    uint32       // picked by the router for the link into it
+	Capabilities Capabilities // of the router, as it runs now
+}
+
+// What an onion router knows about one circuit through it, for operators
+type CircuitStats struct {
+	CircuitId     uint32 // id on the link into the router
+	NextAddress   string // empty at the exit node, or before the first relayed cell
+	NextCircuitId uint32
+	Created       time.Time
+	LastActivity  time.Time
+	Cells         uint64
+	CellsByType   map[string]uint64
+	Bytes         uint64       // cell payload bytes received
+	Capabilities  Capabilities // the onion proxy sent when creating the circuit
+}
+
+// An onion router's answer to ORControl.Status
+type RouterStatusReport struct {
+	Address         string
+	ProtocolVersion int
+	Started         time.Time
+	Bandwidth       uint64 // as reported in heartbeats
+	Capabilities    Capabilities
+	Circuits        []CircuitStats
+}
+
+// Reasons a circuit was torn down
+const (
+	DestroyIdle        = "idle"        // no cells for the router's idle timeout
+	DestroyMeasurement = "measurement" // the directory measured the bandwidth it wanted to
+	DestroySelfTest    = "self-test"   // the router's self-test through it is done
+	DestroyHibernating = "hibernating" // the router used up its traffic cap
+	DestroyQueueFull   = "queue-full"  // the circuit queued more cells than the router takes
+)
+
+// Largest MeasureRequest.Data an exit node answers
+const MaxMeasureData = 512 << 10
+
+// Sent by the directory server through a test circuit. The exit node answers
+// with as many random bytes as Data has, so it sends no more than it got.
+type MeasureRequest struct {
+	Data []byte
+}
+
+// Largest Ping.Nonce an exit node echoes
+const MaxPingNonce = 64
+
+// Sent by the onion proxy through its circuit in a PING relay cell. The exit
+// node echoes it without contacting the IRC server, so the round trip says
+// whether the circuit itself still works.
+type Ping struct {
+	Nonce []byte
+}
+
+// Tells the next router that a circuit was torn down before it
+type DestroyNotice struct {
+	CircuitId uint32 // id on the link into the router being told
+	Reason    string
+	Token     []byte // DestroyToken of the circuit at the router being told
+}
+
+// Error codes recorded in circuit build receipts
+const (
+	BuildErrDirectory          = "DIRECTORY_UNAVAILABLE"
+	BuildErrUntrustedDirectory = "UNTRUSTED_DIRECTORY"
+	BuildErrEncrypt            = "KEY_ENCRYPTION_FAILED"
+	BuildErrDial               = "OR_UNREACHABLE"
+	BuildErrCircuitInfo        = "OR_REJECTED_CIRCUIT_INFO"
+	BuildErrTimeout            = "BUILD_TIMEOUT" // abandoned after the OP's adaptive build timeout
+)
+
+type HopReceipt struct {
+	HopNum    int
+	Address   string
+	CircuitId uint32 // id on the link into this hop
+	Duration  time.Duration
+	ErrorCode string // empty if the hop was extended successfully
+	Error     string
+}
+
+// One hop of a circuit, as OPServer.GetCircuitStatus reports it
+type CircuitHop struct {
+	Address         string
+	Fingerprint     string // of the OR's key, see util.Fingerprint
+	ProtocolVersion int
+	Capabilities    Capabilities
+	Latency         time.Duration // of the link into the hop and its answer, 0 until measured
+}
+
+// A circuit in use, as OPServer.GetCircuitStatus reports it
+type CircuitStatus struct {
+	CircuitId    uint32   // id on the link into the guard node
+	Purposes     []string // what the proxy uses the circuit for
+	Hops         []CircuitHop
+	BuiltAt      time.Time
+	Age          time.Duration
+	Idle         time.Duration  // since the circuit last carried traffic
+	RTT          time.Duration  // of the last ping answered by the exit, 0 if none was
+	Errors       uint64         // cells that failed on the circuit since it was built
+	RecentErrors map[string]int // of those, the ones within CircuitErrorWindow, by error code
+	LastError    string         `json:",omitempty"`
+}
+
+// How far back CircuitStatus.RecentErrors goes
+const CircuitErrorWindow = 5 * time.Minute
+
+// Outcome of one circuit build attempt, for diagnosing failed connections
+type CircuitBuildReceipt struct {
+	CircuitId uint32 // id on the link into the guard node
+	Purpose   string
+	Started   time.Time
+	Duration  time.Duration
+	Timeout   time.Duration // the hops had this long to be extended
+	Succeeded bool
+	ErrorCode string
+	Error     string
+	Hops      []HopReceipt // hops attempted, in order; the last one failed if the build did
+	Warnings  []string
+}
+
+func (r CircuitBuildReceipt) String() string {
+	status := "succeeded"
+	if !r.Succeeded {
+		status = fmt.Sprintf("failed (%s: %s)", r.ErrorCode, r.Error)
+	}
+
+	str := fmt.Sprintf("Circuit %v (%s) build %s in %v", r.CircuitId, r.Purpose, status, r.Duration)
+	if r.Timeout > 0 {
+		str += fmt.Sprintf(" (timeout %v)", r.Timeout)
+	}
+	for _, hop := range r.Hops {
+		hopStatus := "ok"
+		if hop.ErrorCode != "" {
+			hopStatus = fmt.Sprintf("%s: %s", hop.ErrorCode, hop.Error)
+		}
+		str += fmt.Sprintf("\n    Hop %v %s circuit %v %v %s", hop.HopNum+1, hop.Address, hop.CircuitId, hop.Duration, hopStatus)
+	}
+	for _, warning := range r.Warnings {
+		str += "\n    WARNING: " + warning
+	}
+	return str
+}
+
+// The consensus as the directory server's REST API serves it at
+// /v1/consensus, in forms tools not written in Go can check the signature in
+type APIConsensus struct {
+	Routers   []OnionRouterInfo
+	Params    ClientParams
+	Hash      []byte // over Routers and Params, see ConsensusHash
+	Signature []byte // ASN.1 DER ECDSA signature of Hash
+	PubKey    []byte // PKIX DER of the directory server's key that made Signature
+
+	ValidAfter        time.Time
+	ValidUntil        time.Time
+	ValiditySignature []byte // ASN.1 DER ECDSA signature of ConsensusValidityHash
+}
+
+// The network as the directory server's REST API reports it at /v1/stats
+type NetworkStats struct {
+	Time              time.Time
+	Registered        int    // ORs registered, whether in the consensus or not
+	InConsensus       int    // reachable, not blacklisted, and passing their self-tests
+	Stable            int    // of those in the consensus
+	StreamExits       int    // of those in the consensus, exits that open TCP streams
+	PendingEnrollment int    // ORs waiting for an admin to approve them
+	Bandwidth         uint64 // sum of what the ORs in the consensus reported, bytes per second
+	Measured          uint64 // sum of what the directory server measured of them
+	MedianBandwidth   uint64
+	Versions          map[int]int // ORs in the consensus by ProtocolVersion
+	ChatServers       int         // advertised to OPs
+	HeartbeatInterval time.Duration
+}
+
+// What the directory server's dashboard shows, from /v1/status
+type NetworkStatus struct {
+	Stats  NetworkStats
+	Health ConsensusHealth
+	Relays []RelayStatus // every registered OR, sorted by address
+}
+
+// A registered OR with its flags, see RelayStatus.Flags
+type RelayStatus struct {
+	RouterStatus
+	InConsensus bool
+	Flags       []string // Running, Stable, Measured, Capped, Blacklisted or SelfTestFailed, then Capabilities.Names
+}
+
+// Whether the consensus is fit to build circuits from
+type ConsensusHealth struct {
+	Ready    bool              // every check passed, as /readyz answers
+	Checks   map[string]string // "ok" or the error of each check
+	Warnings []string          // what doesn't stop OPs from building circuits, but operators may want to look at
+}
+
+// Arguments to the directory server's admin RPC
+type AdminRequest struct {
+	Token   string
+	Address string // OR ip:port, for AdminServer.ExpireNode, ApproveNode and RejectNode
+	Seconds int64  // for AdminServer.SetHeartBeatInterval
+}
+
+// An OR as seen by the directory server's admin RPC
+type RouterStatus struct {
+	Address       string
+	Uptime        time.Duration
+	LastHeartBeat time.Time
+	Reachable     bool
+	Blacklisted   bool
+	FailureScore  float64
+	Weight        float64       // relative chance of being picked for a circuit
+	Bandwidth     uint64        // from the OR's latest heartbeat, in bytes per second
+	Measured      uint64        // by the directory server through test circuits, 0 if not measured yet
+	SelfTest      string        // result of the OR's latest self-test, from its heartbeats
+	MTBF          time.Duration // weighted mean time between failures
+	Stable        bool
+	Capabilities  Capabilities
+	Contact       string
+	Accounting    *AccountingReport `json:",omitempty"` // from the OR's latest heartbeat, nil without a traffic cap
+
+	ProtocolVersion int
+}
+
+// An OR waiting in the directory server's enrollment queue, see
+// AdminServer.ListPendingNodes
+type PendingRouter struct {
+	Address         string
+	Fingerprint     string // of the key it registered with
+	Contact         string
+	ProtocolVersion int
+	RequestedAt     time.Time // first registration attempt
+	LastAttempt     time.Time
+}
+
+// Arguments to the IRC server's moderation RPCs (CServer.Kick, Ban, Mute, ...)
+type ModerationRequest struct {
+	Namespace    string
+	Operator     string
+	Token        string
+	Channel      string // for Kick, DefaultChannel if empty
+	Username     string // user being moderated
+	DurationSecs int64  // for Mute
+	Reason       string
+}
+
+// A moderation action the IRC server carried out, see
+// CServer.ListModerationActions
+type ModerationAction struct {
+	Time         time.Time
+	Operator     string
+	Action       string // kick, ban, unban, mute or unmute
+	Username     string
+	Channel      string // where the notice was posted
+	DurationSecs int64  `json:",omitempty"` // of a mute
+	Reason       string `json:",omitempty"`
+}
+
+// Arguments to the chat server's query RPCs for operators (CServer.ListChannels,
+// ListActiveUsers, GetMessageRates and ListModerationActions)
+type OperatorQuery struct {
+	Namespace string
+	Operator  string
+	Token     string
+}
+
+// A channel as CServer.ListChannels reports it
+type ChannelActivity struct {
+	Name        string
+	Members     int       // users who joined it
+	Messages    int       // kept under the namespace's retention
+	LastMessage time.Time // zero if none is kept
+	PerMinute   float64   // average over the last hour
+}
+
+// A user as CServer.ListActiveUsers reports it
+type UserActivity struct {
+	Username   string
+	Registered bool
+	Channels   []string
+	Devices    int // sessions polling as the user
+	LastPosted time.Time
+	LastPolled time.Time
+	Banned     bool
+	MutedUntil time.Time `json:",omitempty"`
+}
+
+// How many messages a namespace took lately, from CServer.GetMessageRates
+type MessageRates struct {
+	PerMinute []int   // messages published in each of the last 60 minutes, oldest first
+	LastHour  int     // all of them, as far as retention kept them
+	PerSecond float64 // the average over the last minute
+}
+
+// Every query RPC's answer at once, as the chat server's dashboard shows it
+type NamespaceActivity struct {
+	Namespace  string
+	Time       time.Time
+	Channels   []ChannelActivity
+	Users      []UserActivity
+	Rates      MessageRates
+	Moderation []ModerationAction // newest first
 }
@@ -0,0 +1,68 @@
+package shared
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplitFragments(t *testing.T) {
+	for _, size := range []int{1, MaxFragmentData - 1, MaxFragmentData, MaxFragmentData + 1, 3*MaxFragmentData + 7} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		fragments := SplitFragments(9, CommandChatMessage, data)
+
+		total := (size + MaxFragmentData - 1) / MaxFragmentData
+		if len(fragments) != total {
+			t.Fatalf("%d bytes split into %d fragments, want %d", size, len(fragments), total)
+		}
+		var joined []byte
+		for seq, fragment := range fragments {
+			if fragment.Id != 9 || fragment.Seq != seq || fragment.Total != total || fragment.Command != CommandChatMessage {
+				t.Fatalf("fragment %d of %d bytes is %+v", seq, size, fragment)
+			}
+			if len(fragment.Data) > MaxFragmentData || (seq < total-1 && len(fragment.Data) != MaxFragmentData) {
+				t.Fatalf("fragment %d of %d bytes has %d bytes", seq, size, len(fragment.Data))
+			}
+			joined = append(joined, fragment.Data...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("%d bytes don't reassemble", size)
+		}
+	}
+	if len(SplitFragments(1, "", nil)) != 0 {
+		t.Fatal("nothing split into fragments")
+	}
+}
+
+func TestPolledMessageString(t *testing.T) {
+	received := time.Date(2020, 1, 2, 15, 4, 0, 0, time.Local)
+	message := PolledMessage{MessageMeta: MessageMeta{Id: 7, Time: received, Edited: true, ClockSkewed: true}, Text: "alice: hi"}
+	if got, want := message.String(), "#7 15:04 alice: hi (edited) (sender's clock is wrong)"; got != want {
+		t.Fatalf("rendered %q, want %q", got, want)
+	}
+	if got := (PolledMessage{Text: "alice: hi"}).String(); got != "alice: hi" {
+		t.Fatalf("a message without metadata rendered as %q", got)
+	}
+}
+
+func TestPollResultLines(t *testing.T) {
+	result := PollResult{
+		Notices:  []string{"*** notice"},
+		Messages: []PolledMessage{{Text: "alice: hi"}},
+		Updates:  []MessageUpdate{{MessageId: 3, Deleted: true}, {MessageId: 4, Message: "fixed"}},
+		Events:   []PresenceEvent{{Username: "bob", Channel: DefaultChannel}, {Username: "carol", Channel: "#go"}},
+	}
+	want := []string{"*** notice", "alice: hi", "*** #3 was deleted", "*** #4 was edited: fixed", "*** bob is typing...", "[#go] *** carol is typing..."}
+	lines := result.Lines()
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("got %q, want %q", lines, want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"time"
+)
+
+// The bytes a user signs for a chat message: every field the IRC server acts
+// on, so no exit node can change a signed message, where it goes or who it
+// is from. Times are signed as unix nanoseconds, which survive the JSON and
+// gob encodings on the way unchanged.
+func MessageSigningBytes(m ChatMessage) []byte {
+	signed := struct {
+		Namespace string
+		Channel   string
+		Recipient string
+		Username  string
+		Message   string
+		SentAt    int64
+		Deadline  int64
+		TTL       int64  `json:",omitempty"` // left out when zero, so signatures from before TTLs still verify
+		Payload   []byte `json:",omitempty"` // digest of an encrypted message, sender key or ratchet message, likewise
+	}{
+		Namespace: m.Namespace,
+		Channel:   m.Channel,
+		Recipient: m.Recipient,
+		Username:  m.Username,
+		Message:   m.Message,
+		SentAt:    unixNanoOrZero(m.SentAt),
+		Deadline:  unixNanoOrZero(m.Deadline),
+		TTL:       int64(m.TTL),
+		Payload:   payloadDigest(m),
+	}
+	// Strings, integers and bytes always marshal
+	data, _ := json.Marshal(signed)
+	return append([]byte("torchat-message\n"), data...)
+}
+
+func payloadDigest(m ChatMessage) []byte {
+	var payload interface{}
+	if m.Encrypted != nil {
+		payload = m.Encrypted
+	} else if m.SenderKey != nil {
+		payload = struct {
+			Ephemeral, Nonce, Ciphertext []byte
+		}{m.SenderKey.Ephemeral, m.SenderKey.Nonce, m.SenderKey.Ciphertext}
+	} else if m.Ratchet != nil {
+		payload = m.Ratchet
+	} else {
+		return nil
+	}
+	// Like the signed fields, payloads hold only strings, integers and bytes
+	data, _ := json.Marshal(payload)
+	digest := sha256.Sum256(data)
+	return digest[:]
+}
+
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// Signs m with the sender's key, setting m.Signature
+func SignMessage(m *ChatMessage, key ed25519.PrivateKey) {
+	m.Signature = ed25519.Sign(key, MessageSigningBytes(*m))
+}
+
+// Whether m carries a valid signature by key
+func VerifyMessage(m ChatMessage, key ed25519.PublicKey) bool {
+	if len(key) != ed25519.PublicKeySize || len(m.Signature) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(key, MessageSigningBytes(m), m.Signature)
+}
+
+// The bytes an OR signs for a heartbeat: every field the directory acts on
+func HeartbeatSigningBytes(h Heartbeat) []byte {
+	// Accounting is left out while nil, so heartbeats from before it sign
+	// the same bytes
+	signed := struct {
+		Address    string
+		Bandwidth  uint64
+		SelfTest   string
+		SignedAt   int64
+		Accounting *AccountingReport `json:",omitempty"`
+	}{h.Address, h.Bandwidth, h.SelfTest, h.SignedAt, h.Accounting}
+	// Strings, integers and booleans always marshal
+	data, _ := json.Marshal(signed)
+	return append([]byte("torchat-heartbeat\n"), data...)
+}
+
+// The bytes an OR signs for a failure report about another router
+func RouterFailureSigningBytes(r RouterFailureReport) []byte {
+	signed := struct {
+		Reporter string
+		Address  string
+		Kind     string
+		Failures int
+		SignedAt int64
+	}{r.Reporter, r.Report.Address, r.Report.Kind, r.Failures, r.SignedAt}
+	// Strings and integers always marshal
+	data, _ := json.Marshal(signed)
+	return append([]byte("torchat-router-failure\n"), data...)
+}
+
+// The bytes an OR signs with its old key to move address to newKey
+func KeyChangeSigningBytes(address string, newKey *rsa.PublicKey) []byte {
+	signed := struct {
+		Address string
+		PubKey  []byte
+	}{Address: address}
+	if newKey != nil {
+		signed.PubKey = x509.MarshalPKCS1PublicKey(newKey)
+	}
+	// Strings and bytes always marshal
+	data, _ := json.Marshal(signed)
+	return append([]byte("torchat-key-change\n"), data...)
+}
+
+// The bytes an OR signs for its descriptor: all of it
+func DescriptorSigningBytes(d Descriptor) ([]byte, error) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("torchat-descriptor\n"), data...), nil
+}
@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSignMessage(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ChatMessage{Namespace: "uni", Channel: "#general", Username: "alice", UserToken: "token-alice", Message: "hi", SentAt: time.Now()}
+	SignMessage(&m, key)
+	if !VerifyMessage(m, pub) {
+		t.Fatal("a signed message didn't verify")
+	}
+
+	// The signature survives the trip through the network
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ChatMessage
+	if err = json.Unmarshal(data, &decoded); err != nil || !VerifyMessage(decoded, pub) {
+		t.Fatalf("a decoded message didn't verify: %v", err)
+	}
+
+	// The token isn't signed, every field the IRC server acts on is
+	changed := m
+	changed.UserToken = "token-mallory"
+	if !VerifyMessage(changed, pub) {
+		t.Fatal("changing the token broke the signature")
+	}
+	for _, change := range []func(*ChatMessage){
+		func(m *ChatMessage) { m.Message = "bye" },
+		func(m *ChatMessage) { m.Channel = "#other" },
+		func(m *ChatMessage) { m.Recipient = "bob" },
+		func(m *ChatMessage) { m.Username = "mallory" },
+		func(m *ChatMessage) { m.SentAt = m.SentAt.Add(time.Second) },
+		func(m *ChatMessage) { m.Deadline = time.Now() },
+	} {
+		changed := m
+		change(&changed)
+		if VerifyMessage(changed, pub) {
+			t.Fatalf("a changed message %+v verified", changed)
+		}
+	}
+
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if VerifyMessage(m, other) || VerifyMessage(ChatMessage{Message: "hi"}, pub) || VerifyMessage(m, pub[:8]) {
+		t.Fatal("a message verified without a matching key and signature")
+	}
+}
+
+func TestHeartbeatSigningBytes(t *testing.T) {
+	h := Heartbeat{Address: "127.0.0.1:8001", Bandwidth: 100, SignedAt: 7}
+	if want := `torchat-heartbeat
+{"Address":"127.0.0.1:8001","Bandwidth":100,"SelfTest":"","SignedAt":7}`; string(HeartbeatSigningBytes(h)) != want {
+		t.Fatalf("a heartbeat without accounting signs %q, want %q", HeartbeatSigningBytes(h), want)
+	}
+	unsigned := HeartbeatSigningBytes(h)
+	h.Accounting = &AccountingReport{Max: 1000, Used: 10}
+	if string(HeartbeatSigningBytes(h)) == string(unsigned) {
+		t.Fatal("the accounting report isn't signed")
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"../shared"
+	"../util"
+)
+
+const usage = `Usage: go run torchat_admin.go [flags] command
+Directory commands:
+    list                   list every registered OR
+    consensus              list the ORs circuits are currently built from
+    expire [or ip:port]    drop an OR from the directory
+    set-heartbeat [secs]   change the heartbeat timeout
+    pending                list the ORs waiting for enrollment approval
+    approve [or ip:port]   enroll a waiting OR
+    reject [or ip:port]    turn down a waiting OR, or revoke an approval
+    descriptors            list the signed descriptors of usable ORs (needs -dir-addr,
+                           filtered by -platform, -min-version and -exit-to)
+Onion router commands (need -or-control):
+    circuits               list the circuits through the OR
+Chat server commands (need -operator and -namespace):
+    kick [username]        remove a user from -channel
+    ban [username]
+    unban [username]
+    mute [username] [secs]
+    unmute [username]
+    channels               list the channels with their members and message rates
+    users                  list the users active in the last hour
+    rates                  count the messages of each of the last 60 minutes
+    moderation-log         list the latest moderation actions, newest first`
+
+// Command line client for the directory server's admin RPC and the chat
+// server's moderation RPCs.
+// go run torchat_admin.go -token secret list
+// go run torchat_admin.go -or-control 127.0.0.1:9101 circuits
+// go run torchat_admin.go -chat-addr 127.0.0.1:12346 -operator alice -token secret mute bob 600
+func main() {
+	addr := flag.String("addr", "127.0.0.1:12347", "directory server admin ip:port")
+	dirAddr := flag.String("dir-addr", "127.0.0.1:12345", "directory server ip:port, for descriptors")
+	platform := flag.String("platform", "", "only descriptors whose platform contains this, e.g. linux")
+	minVersion := flag.Int("min-version", 0, "only descriptors of at least this protocol version")
+	exitTo := flag.String("exit-to", "", "only descriptors of ORs exiting to this ip:port")
+	chatAddr := flag.String("chat-addr", "127.0.0.1:12346", "chat server ip:port")
+	orControl := flag.String("or-control", "127.0.0.1:9101", "onion router -control-addr ip:port")
+	token := flag.String("token", os.Getenv("TORCHAT_ADMIN_TOKEN"), "admin or operator token")
+	operator := flag.String("operator", "", "chat server operator username")
+	namespace := flag.String("namespace", shared.DefaultNamespace, "chat server namespace")
+	channel := flag.String("channel", shared.DefaultChannel, "channel to kick from")
+	reason := flag.String("reason", "", "reason shown to the channel")
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	showVersion, showFeatures := util.VersionFlags()
+	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+
+	if *showVersion {
+		util.PrintResult(shared.VersionReport(shared.ComponentAdmin, *showFeatures))
+		return
+	}
+	if len(flag.Args()) < 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "kick", "ban", "unban", "mute", "unmute":
+		req := shared.ModerationRequest{
+			Namespace: *namespace,
+			Operator:  *operator,
+			Token:     *token,
+			Channel:   *channel,
+			Username:  requireArg(1),
+			Reason:    *reason,
+		}
+		moderate(*chatAddr, flag.Arg(0), req)
+		return
+	case "channels", "users", "rates", "moderation-log":
+		queryChatServer(*chatAddr, flag.Arg(0), shared.OperatorQuery{Namespace: *namespace, Operator: *operator, Token: *token})
+		return
+	case "circuits":
+		listCircuits(*orControl)
+		return
+	case "descriptors":
+		listDescriptors(*dirAddr, shared.DescriptorFilter{Platform: *platform, MinProtocolVersion: *minVersion, ExitsTo: *exitTo})
+		return
+	}
+
+	admin, err := rpc.Dial("tcp", *addr)
+	util.HandleFatalError("Could not dial directory server admin RPC", err)
+	defer admin.Close()
+
+	req := shared.AdminRequest{Token: *token}
+	var ack bool
+
+	switch flag.Arg(0) {
+	case "list":
+		var statuses []shared.RouterStatus
+		err = admin.Call("AdminServer.ListNodes", req, &statuses)
+		util.HandleFatalError("Could not list ORs", err)
+		printStatuses(statuses)
+	case "consensus":
+		var statuses []shared.RouterStatus
+		err = admin.Call("AdminServer.DumpConsensus", req, &statuses)
+		util.HandleFatalError("Could not dump consensus", err)
+		printStatuses(statuses)
+	case "expire":
+		req.Address = requireArg(1)
+		err = admin.Call("AdminServer.ExpireNode", req, &ack)
+		util.HandleFatalError("Could not expire OR", err)
+		util.PrintResult("Expired "+req.Address, map[string]string{"expired": req.Address})
+	case "set-heartbeat":
+		req.Seconds, err = strconv.ParseInt(requireArg(1), 10, 64)
+		util.HandleFatalError("Invalid number of seconds", err)
+		err = admin.Call("AdminServer.SetHeartBeatInterval", req, &ack)
+		util.HandleFatalError("Could not set heartbeat interval", err)
+		util.PrintResult(fmt.Sprintf("Heartbeat interval set to %ds", req.Seconds), map[string]int64{"heartBeatInterval": req.Seconds})
+	case "pending":
+		var pending []shared.PendingRouter
+		err = admin.Call("AdminServer.ListPendingNodes", req, &pending)
+		util.HandleFatalError("Could not list pending ORs", err)
+		printPending(pending)
+	case "approve":
+		req.Address = requireArg(1)
+		err = admin.Call("AdminServer.ApproveNode", req, &ack)
+		util.HandleFatalError("Could not approve OR", err)
+		util.PrintResult("Approved "+req.Address, map[string]string{"approved": req.Address})
+	case "reject":
+		req.Address = requireArg(1)
+		err = admin.Call("AdminServer.RejectNode", req, &ack)
+		util.HandleFatalError("Could not reject OR", err)
+		util.PrintResult("Rejected "+req.Address, map[string]string{"rejected": req.Address})
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+func moderate(chatAddr string, command string, req shared.ModerationRequest) {
+	chatServer, err := rpc.Dial("tcp", chatAddr)
+	util.HandleFatalError("Could not dial chat server", err)
+	defer chatServer.Close()
+
+	method := map[string]string{
+		"kick":   "CServer.Kick",
+		"ban":    "CServer.Ban",
+		"unban":  "CServer.Unban",
+		"mute":   "CServer.Mute",
+		"unmute": "CServer.Unmute",
+	}[command]
+
+	if command == "mute" {
+		req.DurationSecs, err = strconv.ParseInt(requireArg(2), 10, 64)
+		util.HandleFatalError("Invalid number of seconds", err)
+	}
+
+	var ack bool
+	err = chatServer.Call(method, req, &ack)
+	util.HandleFatalError("Could not "+command+" "+req.Username, err)
+	util.PrintResult(req.Username+": "+command+" done", map[string]string{"username": req.Username, "action": command})
+}
+
+func queryChatServer(chatAddr string, command string, req shared.OperatorQuery) {
+	chatServer, err := rpc.Dial("tcp", chatAddr)
+	util.HandleFatalError("Could not dial chat server", err)
+	defer chatServer.Close()
+
+	var result interface{}
+	switch command {
+	case "channels":
+		var channels []shared.ChannelActivity
+		err = chatServer.Call("CServer.ListChannels", req, &channels)
+		result = channels
+	case "users":
+		var users []shared.UserActivity
+		err = chatServer.Call("CServer.ListActiveUsers", req, &users)
+		result = users
+	case "rates":
+		var rates shared.MessageRates
+		err = chatServer.Call("CServer.GetMessageRates", req, &rates)
+		result = rates
+	case "moderation-log":
+		var actions []shared.ModerationAction
+		err = chatServer.Call("CServer.ListModerationActions", req, &actions)
+		result = actions
+	}
+	util.HandleFatalError("Could not list "+command, err)
+
+	if util.OutputMode() != util.OutputText {
+		util.PrintResult("", result)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	switch result := result.(type) {
+	case []shared.ChannelActivity:
+		fmt.Fprintln(w, "CHANNEL\tMEMBERS\tMESSAGES\tPER MINUTE\tLAST MESSAGE")
+		for _, channel := range result {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.2f\t%s\n", channel.Name, channel.Members, channel.Messages, channel.PerMinute, formatAgo(channel.LastMessage))
+		}
+	case []shared.UserActivity:
+		fmt.Fprintln(w, "USERNAME\tREGISTERED\tDEVICES\tLAST POSTED\tLAST POLLED\tSTATUS\tCHANNELS")
+		for _, user := range result {
+			status := "-"
+			if user.Banned {
+				status = "banned"
+			} else if !user.MutedUntil.IsZero() {
+				status = "muted " + time.Until(user.MutedUntil).Truncate(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%v\t%d\t%s\t%s\t%s\t%v\n", user.Username, user.Registered, user.Devices,
+				formatAgo(user.LastPosted), formatAgo(user.LastPolled), status, user.Channels)
+		}
+	case shared.MessageRates:
+		fmt.Fprintf(w, "%d messages in the last hour, %.2f per second over the last minute\n", result.LastHour, result.PerSecond)
+		fmt.Fprintln(w, "MINUTES AGO\tMESSAGES")
+		for i := len(result.PerMinute) - 1; i >= 0; i-- {
+			if result.PerMinute[i] > 0 {
+				fmt.Fprintf(w, "%d\t%d\n", len(result.PerMinute)-1-i, result.PerMinute[i])
+			}
+		}
+	case []shared.ModerationAction:
+		fmt.Fprintln(w, "TIME\tOPERATOR\tACTION\tUSERNAME\tCHANNEL\tDURATION\tREASON")
+		for _, action := range result {
+			duration := "-"
+			if action.DurationSecs > 0 {
+				duration = (time.Duration(action.DurationSecs) * time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", action.Time.Format(time.RFC3339), action.Operator, action.Action,
+				action.Username, action.Channel, duration, action.Reason)
+		}
+	}
+	w.Flush()
+}
+
+// How long ago t was, or - if never
+func formatAgo(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
+
+func listCircuits(orControl string) {
+	control, err := rpc.Dial("tcp", orControl)
+	util.HandleFatalError("Could not dial onion router control RPC", err)
+	defer control.Close()
+
+	var report shared.RouterStatusReport
+	err = control.Call("ORControl.Status", true, &report)
+	util.HandleFatalError("Could not get onion router status", err)
+
+	if util.OutputMode() != util.OutputText {
+		util.PrintResult("", report)
+		return
+	}
+
+	fmt.Printf("%s, protocol version %d, up %v, %s, capabilities %v, %d circuits\n", report.Address, report.ProtocolVersion,
+		time.Since(report.Started).Truncate(time.Second), formatBandwidth(report.Bandwidth), report.Capabilities, len(report.Circuits))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CIRCUIT\tNEXT HOP\tAGE\tIDLE\tCELLS\tBYTES")
+	for _, circ := range report.Circuits {
+		next := "-"
+		if circ.NextAddress != "" {
+			next = fmt.Sprintf("%s/%d", circ.NextAddress, circ.NextCircuitId)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%v\t%v\t%d\t%d\n",
+			circ.CircuitId,
+			next,
+			time.Since(circ.Created).Truncate(time.Second),
+			time.Since(circ.LastActivity).Truncate(time.Second),
+			circ.Cells,
+			circ.Bytes)
+	}
+	w.Flush()
+}
+
+// Lists descriptors, checking each signature here rather than trusting the
+// directory with it
+func listDescriptors(dirAddr string, filter shared.DescriptorFilter) {
+	dirServer, err := rpc.Dial("tcp", dirAddr)
+	util.HandleFatalError("Could not dial directory server", err)
+	defer dirServer.Close()
+
+	var descriptors []shared.SignedDescriptor
+	err = dirServer.Call("DServer.GetDescriptors", filter, &descriptors)
+	util.HandleFatalError("Could not get descriptors", err)
+
+	if util.OutputMode() != util.OutputText {
+		util.PrintResult("", descriptors)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tVERSION\tPLATFORM\tPUBLISHED\tBANDWIDTH\tEXIT POLICY\tCAPABILITIES\tCONTACT\tFINGERPRINT\tSIGNATURE")
+	for _, signed := range descriptors {
+		d := signed.Descriptor
+		signature := "BAD"
+		if data, err := shared.DescriptorSigningBytes(d); err == nil && signed.PubKey != nil && util.RSAVerify(signed.PubKey, data, signed.Signature) == nil {
+			signature = "ok"
+		}
+		fingerprint := "-"
+		if signed.PubKey != nil {
+			fingerprint = util.Fingerprint(signed.PubKey)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%v\t%s\t%s\t%s\n",
+			d.Address,
+			d.ProtocolVersion,
+			d.Platform,
+			time.Unix(0, d.Published).UTC().Format(time.RFC3339),
+			formatBandwidth(d.Bandwidth),
+			orDash(d.ExitPolicy),
+			d.Capabilities,
+			orDash(d.Contact),
+			fingerprint,
+			signature)
+	}
+	w.Flush()
+}
+
+func requireArg(i int) string {
+	if len(flag.Args()) <= i {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	}
+	return flag.Arg(i)
+}
+
+func printStatuses(statuses []shared.RouterStatus) {
+	if util.OutputMode() != util.OutputText {
+		util.PrintResult("", statuses)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tUPTIME\tMTBF\tLAST HEARTBEAT\tFLAGS\tFAILURES\tBANDWIDTH\tMEASURED\tQUOTA LEFT\tWEIGHT\tCAPABILITIES\tCONTACT")
+	for _, status := range statuses {
+		flags := ""
+		if status.Reachable {
+			flags += "R"
+		}
+		if status.Blacklisted {
+			flags += "B"
+		}
+		if status.Stable {
+			flags += "S"
+		}
+		switch status.SelfTest {
+		case shared.SelfTestPassed:
+			flags += "T"
+		case shared.SelfTestFailed:
+			flags += "F"
+		}
+		quota := "-"
+		if status.Accounting != nil {
+			quota = formatBytes(status.Accounting.Remaining())
+		}
+		fmt.Fprintf(w, "%s\t%v\t%v\t%s\t%s\t%.2f\t%s\t%s\t%s\t%.2f\t%v\t%s\n",
+			status.Address,
+			status.Uptime.Truncate(time.Second),
+			status.MTBF.Truncate(time.Second),
+			status.LastHeartBeat.Format(time.RFC3339),
+			flags,
+			status.FailureScore,
+			formatBandwidth(status.Bandwidth),
+			formatBandwidth(status.Measured),
+			quota,
+			status.Weight,
+			status.Capabilities,
+			orDash(status.Contact))
+	}
+	w.Flush()
+}
+
+func printPending(pending []shared.PendingRouter) {
+	if util.OutputMode() != util.OutputText {
+		util.PrintResult("", pending)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tFINGERPRINT\tVERSION\tWAITING\tCONTACT")
+	for _, router := range pending {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%v\t%s\n",
+			router.Address,
+			router.Fingerprint,
+			router.ProtocolVersion,
+			time.Since(router.RequestedAt).Truncate(time.Second),
+			orDash(router.Contact))
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Bandwidth in bytes per second for humans, "-" if not measured yet
+func formatBytes(bytes uint64) string {
+	switch {
+	case bytes < 1<<10:
+		return fmt.Sprintf("%d B", bytes)
+	case bytes < 1<<20:
+		return fmt.Sprintf("%.1f KiB", float64(bytes)/(1<<10))
+	case bytes < 1<<30:
+		return fmt.Sprintf("%.1f MiB", float64(bytes)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f GiB", float64(bytes)/(1<<30))
+	}
+}
+
+func formatBandwidth(bandwidth uint64) string {
+	switch {
+	case bandwidth == 0:
+		return "-"
+	case bandwidth < 1<<10:
+		return fmt.Sprintf("%d B/s", bandwidth)
+	case bandwidth < 1<<20:
+		return fmt.Sprintf("%.1f KiB/s", float64(bandwidth)/(1<<10))
+	default:
+		return fmt.Sprintf("%.1f MiB/s", float64(bandwidth)/(1<<20))
+	}
+}
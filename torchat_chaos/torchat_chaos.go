@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"../shared"
+	"../util"
+	"../util/retry"
+)
+
+const (
+	dirServerAddr = "127.0.0.1:12345"
+	ircServerAddr = "127.0.0.1:12346"
+
+	pollInterval time.Duration = 200 * time.Millisecond // above the default MinPollInterval
+	pollLimit    int           = 200
+)
+
+// One process of the local network, restartable with the same arguments
+type node struct {
+	sync.Mutex
+	name string
+	args []string
+	cmd  *exec.Cmd
+}
+
+type ChaosRun struct {
+	bin     string
+	logs    string
+	faults  string
+	rng     util.RNG
+	network []*node
+	ors     []*node
+}
+
+// Starts a local network, kills and restarts random ORs while a client sends
+// messages, then checks every message the proxy acknowledged was delivered.
+// Exits 1 if any was lost. Build the binaries into -bin first, e.g.
+// for c in directory_server chat_server onion_router onion_proxy; do (cd $c && go build -o /tmp/torchat/$c .); done
+// go run torchat_chaos.go -bin /tmp/torchat -ors 5 -messages 100 -seed 1
+func main() {
+	bin := flag.String("bin", ".", "directory with the directory_server, chat_server, onion_router and onion_proxy binaries")
+	logs := flag.String("logs", os.TempDir(), "directory for the logs of every node")
+	numORs := flag.Int("ors", 5, "onion routers to start, at least 4 so circuits survive one being down")
+	firstORPort := flag.Int("or-port", 18000, "port of the first onion router, the others follow it")
+	opAddr := flag.String("op-addr", "127.0.0.1:19000", "ip:port of the onion proxy")
+	messages := flag.Int("messages", 100, "messages to send")
+	sendInterval := flag.Duration("send-interval", 200*time.Millisecond, "pause between messages")
+	sendDeadline := flag.Duration("send-deadline", 20*time.Second, "deadline of each message, the proxy retries until it passes")
+	killInterval := flag.Duration("kill-interval", 3*time.Second, "how often an onion router is killed")
+	downtime := flag.Duration("downtime", 2*time.Second, "how long a killed onion router stays down")
+	verifyTimeout := flag.Duration("verify-timeout", 30*time.Second, "how long to poll for the sent messages at the end")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seeds which routers are killed, so a run can be repeated")
+	faultSpec := flag.String("faults", "", "passed to every node as -faults")
+	outputMode := util.OutputFlag()
+	logSpec, logSensitive := util.LogFlags()
+	flag.Parse()
+	util.SetOutputMode(*outputMode)
+	util.HandleFatalError("Could not set up logging", util.SetupLogging(*logSpec, *logSensitive))
+
+	if *numORs < 4 {
+		util.ErrLog.Fatalln("[FATAL ERROR] -ors must be at least 4")
+	}
+
+	run := &ChaosRun{
+		bin:    *bin,
+		logs:   *logs,
+		faults: *faultSpec,
+		rng:    util.NewSeededRNG(*seed),
+	}
+	defer run.stopAll()
+	util.OutLog.Printf("Chaos run with seed %d, logs in %s\n", *seed, *logs)
+
+	run.start("directory_server")
+	time.Sleep(time.Second)
+	run.start("chat_server", "-user-rate", "0", "-exit-rate", "0")
+	for i := 0; i < *numORs; i++ {
+		orAddr := fmt.Sprintf("127.0.0.1:%d", *firstORPort+i)
+		run.ors = append(run.ors, run.start("onion_router", dirServerAddr, orAddr))
+	}
+	time.Sleep(3 * time.Second) // reachability tests
+	run.start("onion_proxy", dirServerAddr, ircServerAddr, *opAddr)
+
+	proxy, err := retry.DialRPC(context.Background(), retry.Startup, "tcp", *opAddr)
+	util.HandleFatalError("Could not dial onion proxy", err)
+	defer proxy.Close()
+
+	var ack bool
+	err = proxy.Call("OPServer.Connect", fmt.Sprintf("chaos%d", *seed%100000), &ack)
+	util.HandleFatalError("Could not connect to onion proxy", err)
+
+	stopChaos := make(chan struct{})
+	chaosDone := make(chan struct{})
+	go func() {
+		run.killRandomORs(*killInterval, *downtime, stopChaos)
+		close(chaosDone)
+	}()
+
+	marker := fmt.Sprintf("chaos-%d", *seed)
+	acked := make(map[string]bool)
+	failed := 0
+	for i := 0; i < *messages; i++ {
+		text := fmt.Sprintf("%s-%d", marker, i)
+		req := shared.ChatMessage{
+			Message:  text,
+			Deadline: time.Now().Add(*sendDeadline),
+		}
+		if err := proxy.Call("OPServer.SendMessageWithDeadline", req, &ack); err != nil {
+			util.OutLog.Printf("%s not sent: %s\n", text, err)
+			failed++
+		} else {
+			acked[text] = true
+		}
+		time.Sleep(*sendInterval)
+	}
+
+	close(stopChaos)
+	<-chaosDone
+
+	delivered, duplicates := collect(proxy, acked, *verifyTimeout)
+	var lost []string
+	for text := range acked {
+		if !delivered[text] {
+			lost = append(lost, text)
+		}
+	}
+
+	report := map[string]interface{}{
+		"seed":       *seed,
+		"sent":       *messages,
+		"acked":      len(acked),
+		"failed":     failed,
+		"lost":       lost,
+		"duplicates": duplicates,
+	}
+	util.PrintResult(fmt.Sprintf("Sent %d, acknowledged %d, failed %d, lost %d %v, duplicated %d",
+		*messages, len(acked), failed, len(lost), lost, duplicates), report)
+
+	if len(lost) > 0 {
+		run.stopAll()
+		os.Exit(1)
+	}
+}
+
+func (run *ChaosRun) start(name string, args ...string) *node {
+	if run.faults != "" {
+		args = append([]string{"-faults", run.faults}, args...)
+	}
+	n := &node{name: name, args: args}
+	run.network = append(run.network, n)
+	n.start(run.bin, run.logs)
+	return n
+}
+
+func (n *node) start(bin string, logs string) {
+	n.Lock()
+	defer n.Unlock()
+
+	logName := n.name
+	if len(n.args) > 0 {
+		logName += "-" + strings.Replace(n.args[len(n.args)-1], ":", "_", -1)
+	}
+	logFile, err := os.OpenFile(filepath.Join(logs, "chaos-"+logName+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	util.HandleFatalError("Could not open log file", err)
+
+	n.cmd = exec.Command(filepath.Join(bin, n.name), n.args...)
+	n.cmd.Stdout = logFile
+	n.cmd.Stderr = logFile
+	util.HandleFatalError("Could not start "+n.name, n.cmd.Start())
+	go n.cmd.Wait()
+}
+
+func (n *node) kill() {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.cmd != nil && n.cmd.Process != nil {
+		n.cmd.Process.Kill()
+	}
+	n.cmd = nil
+}
+
+func (run *ChaosRun) stopAll() {
+	for _, n := range run.network {
+		n.kill()
+	}
+}
+
+// Kills one random onion router every interval and restarts it after
+// downtime, until stop is closed
+func (run *ChaosRun) killRandomORs(interval time.Duration, downtime time.Duration, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		victim := run.ors[run.rng.Uint32()%uint32(len(run.ors))]
+		util.OutLog.Printf("Killing %s %s for %v\n", victim.name, victim.args[len(victim.args)-1], downtime)
+		victim.kill()
+		time.Sleep(downtime)
+		victim.start(run.bin, run.logs)
+	}
+}
+
+// Polls until every acknowledged message was seen or timeout passes. Returns
+// the messages seen and how many were seen more than once.
+func collect(proxy *rpc.Client, acked map[string]bool, timeout time.Duration) (map[string]bool, int) {
+	delivered := make(map[string]bool)
+	duplicates := 0
+	deadline := time.Now().Add(timeout)
+
+	var cursor uint32 = 1
+	for time.Now().Before(deadline) && len(delivered) < len(acked) {
+		var result shared.PollResult
+		err := proxy.Call("OPServer.PollMessages", shared.PollRequest{Limit: pollLimit, Cursor: cursor}, &result)
+		if err != nil {
+			util.HandleNonFatalError("Could not poll", err)
+			time.Sleep(pollInterval)
+			continue
+		}
+		for _, message := range result.Messages {
+			for text := range acked {
+				if strings.HasSuffix(message.Text, " "+text) {
+					if delivered[text] {
+						duplicates++
+					}
+					delivered[text] = true
+				}
+			}
+		}
+		if result.NextCursor > cursor {
+			cursor = result.NextCursor
+		}
+		if !result.More {
+			time.Sleep(pollInterval)
+		}
+	}
+	return delivered, duplicates
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"../shared"
+)
+
+// Stands in for the onion proxy, serving pages of messages in order
+type testProxy struct {
+	pages []shared.PollResult
+	polls int
+}
+
+func (p *testProxy) PollMessages(req shared.PollRequest, result *shared.PollResult) error {
+	if p.polls < len(p.pages) {
+		*result = p.pages[p.polls]
+	}
+	p.polls++
+	return nil
+}
+
+func testProxyClient(t *testing.T, p *testProxy) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.RegisterName("OPServer", p); err != nil {
+		t.Fatal(err)
+	}
+	clientConn, serverConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCollect(t *testing.T) {
+	message := func(text string) shared.PolledMessage {
+		return shared.PolledMessage{Text: "chaos1: " + text}
+	}
+	p := &testProxy{pages: []shared.PollResult{
+		{Messages: []shared.PolledMessage{message("chaos-1-0"), message("other")}, NextCursor: 3, More: true},
+		{Messages: []shared.PolledMessage{message("chaos-1-0"), message("chaos-1-1")}, NextCursor: 5},
+	}}
+	acked := map[string]bool{"chaos-1-0": true, "chaos-1-1": true, "chaos-1-2": true}
+
+	delivered, duplicates := collect(testProxyClient(t, p), acked, 500*time.Millisecond)
+	if len(delivered) != 2 || !delivered["chaos-1-0"] || !delivered["chaos-1-1"] || duplicates != 1 {
+		t.Fatalf("collected %v with %d duplicates", delivered, duplicates)
+	}
+
+	// Every message seen ends the polling early
+	p.polls = 0
+	started := time.Now()
+	delete(acked, "chaos-1-2")
+	if delivered, _ = collect(testProxyClient(t, p), acked, 10*time.Second); len(delivered) != 2 || time.Since(started) > 5*time.Second {
+		t.Fatalf("collected %v after %v", delivered, time.Since(started))
+	}
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffer pool configurations. Buffers come in power of two sizes between
+// these, so a buffer fits any cell up to twice shared.MaxCellData.
+const (
+	minBufferClass uint = 10 // 1 KiB
+	maxBufferClass uint = 21 // 2 MiB
+)
+
+// Holds the OP's inner onion layers and the OR's padding cells. ORs decrypt
+// relayed cells in place and forward the next layer as a slice of them, so
+// relaying itself takes no buffers.
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// Smallest class whose buffers hold size bytes, false if none does
+func bufferClass(size int) (uint, bool) {
+	class := uint(bits.Len(uint(size - 1)))
+	if size <= 1<<minBufferClass {
+		class = minBufferClass
+	}
+	return class, class <= maxBufferClass
+}
+
+// Returns a buffer of size bytes from the pool, with the capacity of its
+// class. Its contents are left over from earlier use. Larger buffers are
+// allocated normally.
+func GetBuffer(size int) []byte {
+	class, ok := bufferClass(size)
+	if !ok {
+		return make([]byte, size)
+	}
+	if buf, ok := bufferPools[class-minBufferClass].Get().(*[]byte); ok {
+		return (*buf)[:size]
+	}
+	return make([]byte, size, 1<<class)
+}
+
+// Returns a buffer from GetBuffer to the pool. Nothing may use buf afterwards.
+// Buffers of other capacities are left to the garbage collector.
+func PutBuffer(buf []byte) {
+	class, ok := bufferClass(cap(buf))
+	if !ok || cap(buf) != 1<<class {
+		return
+	}
+	buf = buf[:cap(buf)]
+	bufferPools[class-minBufferClass].Put(&buf)
+}
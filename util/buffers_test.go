@@ -0,0 +1,29 @@
+package util
+
+import "testing"
+
+func TestBufferClasses(t *testing.T) {
+	for size, want := range map[int]int{1: 1 << 10, 1024: 1 << 10, 1025: 1 << 11, 1 << 21: 1 << 21} {
+		if buf := GetBuffer(size); len(buf) != size || cap(buf) != want {
+			t.Fatalf("a buffer of %d bytes has capacity %d, want %d", size, cap(buf), want)
+		}
+	}
+	if buf := GetBuffer(1<<21 + 1); len(buf) != 1<<21+1 {
+		t.Fatalf("a buffer over the largest class has %d bytes", len(buf))
+	}
+}
+
+func TestPutBuffer(t *testing.T) {
+	buf := GetBuffer(3000)
+	buf[0] = 42
+	PutBuffer(buf)
+	// Anything but a whole class is left to the garbage collector
+	PutBuffer(make([]byte, 3000))
+	PutBuffer(buf[1:])
+
+	for i := 0; i < 10; i++ {
+		if again := GetBuffer(2500); len(again) != 2500 || cap(again) != 1<<12 {
+			t.Fatalf("got a buffer of %d bytes with capacity %d", len(again), cap(again))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source of time for timers that decide behaviour, like circuit rotation and
+// expiry, so simulations can run them on a clock they control.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// The clock every component uses. Only replace it (with SetClock) in tests and
+// simulations.
+var Time Clock = realClock{}
+
+func SetClock(clock Clock) {
+	Time = clock
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// A clock that only moves when Advance is called. Sleepers wake once the
+// clock passed their deadline, in deadline order.
+type ManualClock struct {
+	sync.Mutex
+	now      time.Time
+	sleepers []sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) Sleep(d time.Duration) {
+	c.Lock()
+	if d <= 0 {
+		c.Unlock()
+		return
+	}
+	wake := make(chan struct{})
+	c.sleepers = append(c.sleepers, sleeper{until: c.now.Add(d), wake: wake})
+	c.Unlock()
+	<-wake
+}
+
+// Moves the clock forward by d and wakes every sleeper whose deadline passed
+func (c *ManualClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.now = c.now.Add(d)
+	sort.Slice(c.sleepers, func(i, j int) bool { return c.sleepers[i].until.Before(c.sleepers[j].until) })
+
+	waiting := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.until.After(c.now) {
+			waiting = append(waiting, s)
+			continue
+		}
+		close(s.wake)
+	}
+	c.sleepers = waiting
+}
+
+// Number of goroutines sleeping on the clock, so a simulation can wait for
+// them to block before advancing it
+func (c *ManualClock) Sleepers() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.sleepers)
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	woken := make(chan time.Duration, 2)
+	for _, d := range []time.Duration{2 * time.Second, time.Second} {
+		go func(d time.Duration) {
+			clock.Sleep(d)
+			woken <- d
+		}(d)
+	}
+	for clock.Sleepers() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	if d := <-woken; d != time.Second || clock.Sleepers() != 1 {
+		t.Fatalf("woke the %v sleeper with %d still sleeping", d, clock.Sleepers())
+	}
+	clock.Advance(time.Second)
+	if d := <-woken; d != 2*time.Second || clock.Sleepers() != 0 {
+		t.Fatalf("woke the %v sleeper with %d still sleeping", d, clock.Sleepers())
+	}
+	if now := clock.Now(); !now.Equal(start.Add(2500 * time.Millisecond)) {
+		t.Fatalf("the clock is at %v", now)
+	}
+	clock.Sleep(0)
+}
@@ -1,19 +1,21 @@
 package util
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 )
 
 var label = []byte("")
-var hash = sha256.New()
 
 func RSAEncrypt(pub *rsa.PublicKey, plainText []byte) ([]byte, error) {
-	cipherText, err := rsa.EncryptOAEP(hash, rand.Reader, pub, plainText, label)
+	cipherText, err := rsa.EncryptOAEP(sha256.New(), Random, pub, plainText, label)
 	if err != nil {
 		HandleNonFatalError("Could not encrypt message", err)
 		return nil, err
@@ -23,7 +25,7 @@ func RSAEncrypt(pub *rsa.PublicKey, plainText []byte) ([]byte, error) {
 }
 
 func RSADecrypt(priv *rsa.PrivateKey, cipherText []byte) ([]byte, error) {
-	plainText, err := rsa.DecryptOAEP(hash, rand.Reader, priv, cipherText, label)
+	plainText, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, cipherText, label)
 	if err != nil {
 		HandleNonFatalError("Could not decrypt message", err)
 		return nil, err
@@ -32,9 +34,21 @@ func RSADecrypt(priv *rsa.PrivateKey, cipherText []byte) ([]byte, error) {
 	return plainText, nil
 }
 
+// Signs data with priv, as RSA-PSS over its SHA-256 digest
+func RSASign(priv *rsa.PrivateKey, data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return rsa.SignPSS(Random, priv, crypto.SHA256, digest[:], nil)
+}
+
+// Checks an RSASign signature of data by pub
+func RSAVerify(pub *rsa.PublicKey, data []byte, signature []byte) error {
+	digest := sha256.Sum256(data)
+	return rsa.VerifyPSS(pub, crypto.SHA256, digest[:], signature, nil)
+}
+
 func GenerateAESKey() []byte {
 	key := make([]byte, 32)
-	_, err := rand.Read(key)
+	_, err := Random.Read(key)
 	HandleFatalError("Could not generate random AES key", err)
 
 	return key
@@ -43,3 +57,9 @@ func GenerateAESKey() []byte {
 func PubKeyToString(key ecdsa.PublicKey) string {
 	return hex.EncodeToString(elliptic.Marshal(key.Curve, key.X, key.Y))
 }
+
+// Identifies an onion router by its RSA key, as 40 hex digits
+func Fingerprint(pub *rsa.PublicKey) string {
+	digest := sha1.Sum(x509.MarshalPKCS1PublicKey(pub))
+	return hex.EncodeToString(digest[:])
+}
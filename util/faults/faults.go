@@ -0,0 +1,234 @@
+// Package faults injects network faults between nodes for simulations:
+// latency, lost packets and connection resets. It does nothing unless a
+// binary is started with -faults.
+package faults
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"../../util"
+	"../transport"
+)
+
+type ResetError error
+
+// What to inject. Every connection a binary dials or accepts gets the same
+// faults; with -faults on every binary, each direction of a link gets them once.
+type Config struct {
+	Latency   time.Duration // added before every write
+	Jitter    time.Duration // latency is randomised by up to this much either way
+	Loss      float64       // chance a write is lost and has to be retransmitted
+	LossDelay time.Duration // how much later a lost write arrives, like a TCP retransmission
+	Reset     float64       // chance a read or write resets the connection instead
+	Seed      int64         // seeds every fault decision, so runs can be reproduced
+}
+
+var (
+	// Fault Errors
+	resetError ResetError = errors.New("Connection reset by fault injection")
+
+	mutex   sync.Mutex
+	enabled bool
+	config  Config
+	random  util.RNG
+)
+
+// Registers the -faults flag. Call Setup with its value after flag.Parse.
+func Flag() *string {
+	return flag.String("faults", os.Getenv("TORCHAT_FAULTS"),
+		"inject network faults, e.g. latency=50ms,jitter=10ms,loss=0.01,reset=0.001,seed=1 (env TORCHAT_FAULTS, disabled if empty)")
+}
+
+// Enables the faults in spec, exiting if it doesn't parse. An empty spec
+// leaves fault injection off.
+func Setup(spec string) {
+	if spec == "" {
+		return
+	}
+	cfg, err := Parse(spec)
+	util.HandleFatalError("Invalid -faults", err)
+	Enable(cfg)
+	util.OutLog.Printf("[WARNING] Injecting network faults: %+v\n", cfg)
+}
+
+// Parses comma separated key=value pairs: latency, jitter and lossdelay are
+// durations, loss and reset are chances from 0 to 1 and seed is an integer.
+// lossdelay defaults to 200ms and seed to the current time.
+func Parse(spec string) (Config, error) {
+	cfg := Config{
+		LossDelay: 200 * time.Millisecond,
+		Seed:      time.Now().UnixNano(),
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("expected key=value, got %q", pair)
+		}
+		key, value := kv[0], kv[1]
+
+		var err error
+		switch key {
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			cfg.Jitter, err = time.ParseDuration(value)
+		case "lossdelay":
+			cfg.LossDelay, err = time.ParseDuration(value)
+		case "loss":
+			cfg.Loss, err = parseChance(value)
+		case "reset":
+			cfg.Reset, err = parseChance(value)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = errors.New("unknown fault")
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return cfg, nil
+}
+
+func parseChance(value string) (float64, error) {
+	chance, err := strconv.ParseFloat(value, 64)
+	if err == nil && (chance < 0 || chance > 1) {
+		err = errors.New("must be between 0 and 1")
+	}
+	return chance, err
+}
+
+func Enable(cfg Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	enabled = true
+	config = cfg
+	random = util.NewSeededRNG(cfg.Seed)
+}
+
+func Disable() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	enabled = false
+}
+
+func isEnabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return enabled
+}
+
+// The config and a random number in [0, 1), or false if faults are off
+func draw() (Config, float64, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if !enabled {
+		return Config{}, 0, false
+	}
+	return config, random.Float64(), true
+}
+
+// A connection that suffers the configured faults
+type Conn struct {
+	net.Conn
+}
+
+// Wraps conn if faults are enabled
+func Wrap(conn net.Conn) net.Conn {
+	if !isEnabled() {
+		return conn
+	}
+	return &Conn{Conn: conn}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if cfg, r, ok := draw(); ok && r < cfg.Reset {
+		c.Conn.Close()
+		return 0, resetError
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	cfg, r, ok := draw()
+	if !ok {
+		return c.Conn.Write(b)
+	}
+	if r < cfg.Reset {
+		c.Conn.Close()
+		return 0, resetError
+	}
+
+	delay := cfg.Latency
+	if cfg.Jitter > 0 {
+		_, r, _ = draw()
+		delay += time.Duration((2*r - 1) * float64(cfg.Jitter))
+	}
+	if _, r, _ = draw(); r < cfg.Loss {
+		delay += cfg.LossDelay
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return c.Conn.Write(b)
+}
+
+// A listener whose connections suffer the configured faults
+type Listener struct {
+	net.Listener
+}
+
+// Wraps inbound if faults are enabled
+func Listen(inbound net.Listener) net.Listener {
+	if !isEnabled() {
+		return inbound
+	}
+	return &Listener{Listener: inbound}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(conn), nil
+}
+
+// Dials address over a transport by name, tcp or a registered one
+func Dial(network string, address string) (net.Conn, error) {
+	conn, err := transport.Dial(network, address, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(conn), nil
+}
+
+func DialTimeout(network string, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := transport.Dial(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(conn), nil
+}
+
+// Like rpc.Dial, over a connection that suffers the configured faults
+func DialRPC(network string, address string) (*rpc.Client, error) {
+	conn, err := Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
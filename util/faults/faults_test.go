@@ -0,0 +1,66 @@
+package faults
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse("latency=50ms, jitter=10ms,loss=0.01,reset=0.5,seed=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.01, LossDelay: 200 * time.Millisecond, Reset: 0.5, Seed: 7}
+	if cfg != want {
+		t.Fatalf("parsed %+v, want %+v", cfg, want)
+	}
+	for _, spec := range []string{"latency", "loss=2", "reset=-0.1", "latency=fast", "drop=0.1"} {
+		if _, err = Parse(spec); err == nil {
+			t.Fatalf("%q parsed", spec)
+		}
+	}
+}
+
+func TestWrapOnlyWhenEnabled(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if Wrap(client) != client {
+		t.Fatal("a connection was wrapped with faults off")
+	}
+	Enable(Config{})
+	defer Disable()
+	if _, ok := Wrap(client).(*Conn); !ok {
+		t.Fatal("a connection wasn't wrapped with faults on")
+	}
+}
+
+func TestFaultyWrites(t *testing.T) {
+	defer Disable()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	Enable(Config{Latency: 100 * time.Millisecond, Seed: 1})
+	conn := Wrap(client)
+	started := time.Now()
+	if _, err := conn.Write([]byte("hi")); err != nil || time.Since(started) < 100*time.Millisecond {
+		t.Fatalf("a write gave %v after %v, want it delayed by 100ms", err, time.Since(started))
+	}
+
+	Enable(Config{Reset: 1, Seed: 1})
+	if _, err := conn.Write([]byte("hi")); err != resetError {
+		t.Fatalf("a write gave %v, want %v", err, resetError)
+	}
+	if _, err := client.Write([]byte("hi")); err == nil {
+		t.Fatal("a reset connection was left open")
+	}
+}
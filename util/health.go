@@ -0,0 +1,75 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+)
+
+// A named readiness probe. Checks run on every request, so they must be quick.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// Body of /healthz and /readyz
+type HealthStatus struct {
+	Status string            // "ok", or "unavailable" when /readyz fails
+	Checks map[string]string // "ok" or the error of each check
+}
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// Registers the -health-addr flag shared by every server
+func HealthFlag() *string {
+	return flag.String("health-addr", "", "ip:port to serve /healthz and /readyz on (disabled if empty)")
+}
+
+// Serves /healthz and /readyz on addr. /healthz answers 200 while the process
+// is running, with the results of the checks for information. /readyz answers
+// 503 unless every check passes, so orchestrators only route to ready servers.
+func ServeHealth(addr string, checks []HealthCheck) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status, _ := RunHealthChecks(checks)
+		writeHealth(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status, ready := RunHealthChecks(checks)
+		code := http.StatusOK
+		if !ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, status)
+	})
+
+	OutLog.Printf("Health checks available at http://%s/healthz and /readyz\n", addr)
+	HandleFatalError("Health server stopped", http.ListenAndServe(addr, mux))
+}
+
+// Runs every check, returning their results and whether all passed
+func RunHealthChecks(checks []HealthCheck) (HealthStatus, bool) {
+	status := HealthStatus{Status: healthOK, Checks: make(map[string]string)}
+	ready := true
+	for _, check := range checks {
+		if err := check.Check(); err != nil {
+			status.Checks[check.Name] = err.Error()
+			ready = false
+			continue
+		}
+		status.Checks[check.Name] = healthOK
+	}
+	return status, ready
+}
+
+func writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	if code != http.StatusOK {
+		status.Status = healthUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunHealthChecks(t *testing.T) {
+	checks := []HealthCheck{
+		{Name: "rpc", Check: func() error { return nil }},
+		{Name: "directory", Check: func() error { return errors.New("Directory server unreachable") }},
+	}
+	status, ready := RunHealthChecks(checks)
+	if ready || status.Checks["rpc"] != healthOK || status.Checks["directory"] != "Directory server unreachable" {
+		t.Fatalf("the checks gave %+v, ready %v", status, ready)
+	}
+	if _, ready = RunHealthChecks(checks[:1]); !ready {
+		t.Fatal("passing checks weren't ready")
+	}
+}
+
+func TestWriteHealth(t *testing.T) {
+	for code, want := range map[int]string{http.StatusOK: healthOK, http.StatusServiceUnavailable: healthUnavailable} {
+		w := httptest.NewRecorder()
+		writeHealth(w, code, HealthStatus{Status: healthOK, Checks: map[string]string{"rpc": healthOK}})
+
+		var status HealthStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != code || status.Status != want || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("answered %d with %+v, want %d with status %q", w.Code, status, code, want)
+		}
+	}
+}
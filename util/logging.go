@@ -0,0 +1,97 @@
+package util
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Log sinks selected with -log, comma separated
+const (
+	LogSinkStderr = "stderr" // as -output formats it (default)
+	LogSinkFile   = "file"   // file:path, text lines appended to path
+	LogSinkJSON   = "json"   // json:path, one JSON object per line appended to path
+	LogSinkSyslog = "syslog" // the local syslog daemon
+)
+
+var logSensitive bool
+
+// Registers -log and -log-sensitive. Call SetupLogging with their values
+// after SetOutputMode.
+func LogFlags() (*string, *bool) {
+	return flag.String("log", LogSinkStderr, "where logs go: stderr, file:path, json:path or syslog, comma separated for several"),
+		flag.Bool("log-sensitive", false, "log key material and message bodies, for debugging only (redacted otherwise)")
+}
+
+// Sends OutLog and ErrLog to the sinks in spec. stderr keeps the writer the
+// output mode picked, so -output quiet quiets stderr but not log files.
+// With sensitive set, LogKey and LogText no longer redact.
+func SetupLogging(spec string, sensitive bool) error {
+	logSensitive = sensitive
+	if sensitive {
+		defer ErrLog.Println("[WARNING] Logging key material and message bodies")
+	}
+	if spec == "" || spec == LogSinkStderr {
+		return nil
+	}
+
+	var outs, errs []io.Writer
+	for _, sink := range strings.Split(spec, ",") {
+		sink = strings.TrimSpace(sink)
+		kind, path := sink, ""
+		if i := strings.Index(sink, ":"); i >= 0 {
+			kind, path = sink[:i], sink[i+1:]
+		}
+
+		switch {
+		case kind == LogSinkStderr && path == "":
+			outs = append(outs, OutLog.Writer())
+			errs = append(errs, ErrLog.Writer())
+		case (kind == LogSinkFile || kind == LogSinkJSON) && path != "":
+			file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				return err
+			}
+			if kind == LogSinkJSON {
+				outs = append(outs, jsonLogWriter{level: "info", out: file})
+				errs = append(errs, jsonLogWriter{level: "error", out: file})
+			} else {
+				outs = append(outs, file)
+				errs = append(errs, file)
+			}
+		case kind == LogSinkSyslog && path == "":
+			out, errOut, err := syslogWriters()
+			if err != nil {
+				return err
+			}
+			outs = append(outs, out)
+			errs = append(errs, errOut)
+		default:
+			return fmt.Errorf("Unknown log sink %q, expected stderr, file:path, json:path or syslog", sink)
+		}
+	}
+
+	OutLog.SetOutput(io.MultiWriter(outs...))
+	ErrLog.SetOutput(io.MultiWriter(errs...))
+	return nil
+}
+
+// Key material as logged: hex with -log-sensitive, redacted otherwise
+func LogKey(key []byte) string {
+	if logSensitive {
+		return hex.EncodeToString(key)
+	}
+	return "[redacted]"
+}
+
+// A message body as logged: the text with -log-sensitive, only its length
+// otherwise
+func LogText(text string) string {
+	if logSensitive {
+		return text
+	}
+	return fmt.Sprintf("[%d bytes redacted]", len(text))
+}
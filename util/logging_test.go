@@ -0,0 +1,61 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogSinks(t *testing.T) {
+	defer func(out, errOut *os.File) {
+		OutLog.SetOutput(out)
+		ErrLog.SetOutput(errOut)
+	}(os.Stderr, os.Stderr)
+	dir := t.TempDir()
+	text, lines := filepath.Join(dir, "or.log"), filepath.Join(dir, "or.json")
+
+	if err := SetupLogging("file:"+text+", json:"+lines, false); err != nil {
+		t.Fatal(err)
+	}
+	OutLog.Println("Circuit built")
+	ErrLog.Println("Could not dial")
+
+	data, err := os.ReadFile(text)
+	if err != nil || !strings.Contains(string(data), "Circuit built") || !strings.Contains(string(data), "Could not dial") {
+		t.Fatalf("the log file holds %q, %v", data, err)
+	}
+	if info, _ := os.Stat(text); info.Mode().Perm() != 0600 {
+		t.Fatalf("the log file was created %v", info.Mode())
+	}
+	data, err = os.ReadFile(lines)
+	var levels []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry map[string]string
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%q isn't a JSON line: %v", line, err)
+		}
+		levels = append(levels, entry["level"])
+	}
+	if strings.Join(levels, ",") != "info,error" {
+		t.Fatalf("logged levels %v", levels)
+	}
+
+	for _, spec := range []string{"file", "json:", "stderr:x", "kafka:topic"} {
+		if err = SetupLogging(spec, false); err == nil {
+			t.Fatalf("%q was accepted", spec)
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	defer func() { logSensitive = false }()
+	if LogKey([]byte{0xab}) != "[redacted]" || LogText("hello") != "[5 bytes redacted]" {
+		t.Fatalf("logged %q and %q", LogKey([]byte{0xab}), LogText("hello"))
+	}
+	logSensitive = true
+	if LogKey([]byte{0xab}) != "ab" || LogText("hello") != "hello" {
+		t.Fatalf("with -log-sensitive logged %q and %q", LogKey([]byte{0xab}), LogText("hello"))
+	}
+}
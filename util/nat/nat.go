@@ -0,0 +1,123 @@
+// Package nat asks a home router to forward a port, so onion routers behind
+// NAT can be reached. It speaks NAT-PMP and UPnP IGD.
+package nat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"../../util"
+)
+
+type NoGatewayError error
+
+const (
+	Auto   = "auto"
+	NATPMP = "natpmp"
+	UPnP   = "upnp"
+
+	mappingLifetime time.Duration = time.Hour
+)
+
+var (
+	// NAT Errors
+	noGatewayError NoGatewayError = errors.New("No default gateway found")
+)
+
+// A port forwarded by the home router
+type Mapping struct {
+	Method          string
+	ExternalAddress string // ip:port other nodes reach the forwarded port on
+	internalPort    int
+	externalPort    int
+	renew           func() error
+	remove          func() error
+	stop            chan struct{}
+}
+
+// Forwards internalPort over TCP with method (Auto tries NAT-PMP, then
+// UPnP) and keeps the mapping alive until Close.
+func Map(method string, internalPort int) (*Mapping, error) {
+	var m *Mapping
+	var err error
+	switch method {
+	case NATPMP:
+		m, err = mapNATPMP(internalPort)
+	case UPnP:
+		m, err = mapUPnP(internalPort)
+	case Auto:
+		if m, err = mapNATPMP(internalPort); err != nil {
+			util.OutLog.Printf("NAT-PMP port mapping failed (%s), trying UPnP\n", err)
+			m, err = mapUPnP(internalPort)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown NAT traversal method %q", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m.stop = make(chan struct{})
+	go m.keepAlive()
+	return m, nil
+}
+
+// Renews the mapping at half its lifetime
+func (m *Mapping) keepAlive() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(mappingLifetime / 2):
+		}
+		if err := m.renew(); err != nil {
+			util.HandleNonFatalError("Could not renew "+m.Method+" port mapping", err)
+		}
+	}
+}
+
+// Stops renewing the mapping and asks the router to remove it
+func (m *Mapping) Close() error {
+	close(m.stop)
+	return m.remove()
+}
+
+// The default gateway, from the Linux routing table
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, noGatewayError
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		// Stored little endian
+		return net.IPv4(byte(gateway), byte(gateway>>8), byte(gateway>>16), byte(gateway>>24)), nil
+	}
+	return nil, noGatewayError
+}
+
+// This host's address on the way to ip
+func localAddressTowards(ip net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "9"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,76 @@
+package nat
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSSDPHeader(t *testing.T) {
+	response := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nLocation: http://192.168.1.1:5000/rootDesc.xml\r\n\r\n"
+	if location := ssdpHeader(response, "location"); location != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Fatalf("the location is %q", location)
+	}
+	if st := ssdpHeader(response, "st"); st != "" {
+		t.Fatalf("a missing header is %q", st)
+	}
+}
+
+// Stands in for a gateway, describing a WANIPConnection nested two devices
+// deep and answering its SOAP actions
+func testGateway(t *testing.T, actions map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/rootDesc.xml":
+			io.WriteString(w, `<?xml version="1.0"?><root><device><deviceList><device><deviceList><device><serviceList>
+<service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType><controlURL>/ctl/IPConn</controlURL></service>
+</serviceList></device></deviceList></device></deviceList></device></root>`)
+		case "/ctl/IPConn":
+			action := strings.Trim(strings.SplitN(r.Header.Get("SOAPAction"), "#", 2)[1], `"`)
+			answer, ok := actions[action]
+			if !ok {
+				http.Error(w, "no such action", http.StatusInternalServerError)
+				return
+			}
+			io.WriteString(w, `<s:Envelope><s:Body><u:`+action+`Response>`+answer+`</u:`+action+`Response></s:Body></s:Envelope>`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestUPnPService(t *testing.T) {
+	gateway := testGateway(t, map[string]string{
+		"GetExternalIPAddress": "<NewExternalIPAddress> 203.0.113.7 </NewExternalIPAddress>",
+		"AddPortMapping":       "",
+	})
+	defer gateway.Close()
+
+	service, err := wanService(gateway.URL + "/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.controlURL != gateway.URL+"/ctl/IPConn" || service.serviceType != wanServiceTypes[1] {
+		t.Fatalf("found %+v", service)
+	}
+	if ip, err := service.action("GetExternalIPAddress", nil, "NewExternalIPAddress"); err != nil || ip != "203.0.113.7" {
+		t.Fatalf("the external address is %q, %v", ip, err)
+	}
+	if _, err = service.action("AddPortMapping", [][2]string{{"NewExternalPort", "8001"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = service.action("DeletePortMapping", nil, ""); err == nil {
+		t.Fatal("a failed action gave no error")
+	}
+	if _, err = service.action("AddPortMapping", nil, "NewExternalIPAddress"); err == nil {
+		t.Fatal("an answer without the result gave no error")
+	}
+}
+
+func TestMapUnknownMethod(t *testing.T) {
+	if _, err := Map("stun", 8001); err == nil {
+		t.Fatal("an unknown method mapped a port")
+	}
+}
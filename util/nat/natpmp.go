@@ -0,0 +1,104 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+type NATPMPError error
+
+// NAT-PMP (RFC 6886) configurations
+const (
+	natpmpPort       int           = 5351
+	natpmpAttempts   int           = 4
+	natpmpFirstWait  time.Duration = 250 * time.Millisecond
+	natpmpOpAddress  byte          = 0
+	natpmpOpMapTCP   byte          = 2
+	natpmpResultBase byte          = 128 // added to the opcode in responses
+)
+
+var (
+	// NAT-PMP Errors
+	natpmpNoAnswerError NATPMPError = errors.New("No NAT-PMP answer from the gateway")
+)
+
+func mapNATPMP(internalPort int) (*Mapping, error) {
+	gateway, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := natpmpRequest(gateway, []byte{0, natpmpOpAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	externalIP := net.IP(resp[8:12])
+
+	request := func(lifetime time.Duration) (int, error) {
+		req := make([]byte, 12)
+		req[1] = natpmpOpMapTCP
+		binary.BigEndian.PutUint16(req[4:], uint16(internalPort))
+		binary.BigEndian.PutUint16(req[6:], uint16(internalPort)) // suggested external port
+		binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+		resp, err := natpmpRequest(gateway, req, 16)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint16(resp[10:12])), nil
+	}
+
+	externalPort, err := request(mappingLifetime)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Method:          NATPMP,
+		ExternalAddress: net.JoinHostPort(externalIP.String(), strconv.Itoa(externalPort)),
+		internalPort:    internalPort,
+		externalPort:    externalPort,
+		renew: func() error {
+			_, err := request(mappingLifetime)
+			return err
+		},
+		remove: func() error {
+			_, err := request(0)
+			return err
+		},
+	}, nil
+}
+
+// Sends req to the gateway, retrying with doubling waits as RFC 6886 asks,
+// and returns a successful response of size bytes
+func natpmpRequest(gateway net.IP, req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: gateway, Port: natpmpPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	wait := natpmpFirstWait
+	resp := make([]byte, 16)
+	for attempt := 0; attempt < natpmpAttempts; attempt++ {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(resp)
+		wait *= 2
+		if err != nil {
+			continue
+		}
+		if n < size || resp[1] != natpmpResultBase+req[1] {
+			continue
+		}
+		if result := binary.BigEndian.Uint16(resp[2:4]); result != 0 {
+			return nil, fmt.Errorf("NAT-PMP request refused with result code %d", result)
+		}
+		return resp[:size], nil
+	}
+	return nil, natpmpNoAnswerError
+}
@@ -0,0 +1,254 @@
+package nat
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UPnPError error
+
+// UPnP IGD configurations
+const (
+	ssdpAddress     string        = "239.255.255.250:1900"
+	ssdpSearchWait  time.Duration = 2 * time.Second
+	upnpHTTPTimeout time.Duration = 5 * time.Second
+	igdDeviceType   string        = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+)
+
+var (
+	// UPnP Errors
+	noIGDError UPnPError = errors.New("No UPnP internet gateway device answered")
+
+	// Services that forward ports, in order of preference
+	wanServiceTypes = []string{
+		"urn:schemas-upnp-org:service:WANIPConnection:2",
+		"urn:schemas-upnp-org:service:WANIPConnection:1",
+		"urn:schemas-upnp-org:service:WANPPPConnection:1",
+	}
+)
+
+// The parts of a device description needed to find its WAN service
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpDescription struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// A WAN service of the gateway that takes SOAP actions
+type upnpService struct {
+	controlURL  string
+	serviceType string
+}
+
+func mapUPnP(internalPort int) (*Mapping, error) {
+	service, localIP, err := discoverIGD()
+	if err != nil {
+		return nil, err
+	}
+
+	externalIP, err := service.action("GetExternalIPAddress", nil, "NewExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	add := func() error {
+		_, err := service.action("AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(internalPort)},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", localIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "TorChat onion router"},
+			{"NewLeaseDuration", strconv.Itoa(int(mappingLifetime / time.Second))},
+		}, "")
+		return err
+	}
+	if err = add(); err != nil {
+		return nil, err
+	}
+
+	return &Mapping{
+		Method:          UPnP,
+		ExternalAddress: net.JoinHostPort(externalIP, strconv.Itoa(internalPort)),
+		internalPort:    internalPort,
+		externalPort:    internalPort,
+		renew:           add,
+		remove: func() error {
+			_, err := service.action("DeletePortMapping", [][2]string{
+				{"NewRemoteHost", ""},
+				{"NewExternalPort", strconv.Itoa(internalPort)},
+				{"NewProtocol", "TCP"},
+			}, "")
+			return err
+		},
+	}, nil
+}
+
+// Finds a gateway with SSDP and returns its WAN service and this host's
+// address on the way to it
+func discoverIGD() (*upnpService, net.IP, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\nHOST: " + ssdpAddress + "\r\nST: " + igdDeviceType +
+		"\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n"
+	if _, err = conn.WriteTo([]byte(search), dest); err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpSearchWait))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, nil, noIGDError
+		}
+		location := ssdpHeader(string(buf[:n]), "location")
+		if location == "" {
+			continue
+		}
+		service, err := wanService(location)
+		if err != nil {
+			continue
+		}
+		localIP, err := localAddressTowards(from.(*net.UDPAddr).IP)
+		if err != nil {
+			return nil, nil, err
+		}
+		return service, localIP, nil
+	}
+}
+
+func ssdpHeader(response string, name string) string {
+	for _, line := range strings.Split(response, "\r\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), name) {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// Fetches a device description and finds the service that forwards ports
+func wanService(location string) (*upnpService, error) {
+	client := &http.Client{Timeout: upnpHTTPTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var desc upnpDescription
+	if err = xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, serviceType := range wanServiceTypes {
+		if controlURL, ok := findService(desc.Device, serviceType); ok {
+			control, err := base.Parse(controlURL)
+			if err != nil {
+				return nil, err
+			}
+			return &upnpService{controlURL: control.String(), serviceType: serviceType}, nil
+		}
+	}
+	return nil, noIGDError
+}
+
+func findService(device upnpDevice, serviceType string) (string, bool) {
+	for _, service := range device.Services {
+		if service.ServiceType == serviceType {
+			return service.ControlURL, true
+		}
+	}
+	for _, child := range device.Devices {
+		if controlURL, ok := findService(child, serviceType); ok {
+			return controlURL, true
+		}
+	}
+	return "", false
+}
+
+// Calls a SOAP action on the service and returns the result element named
+// result, if any
+func (s *upnpService) action(name string, args [][2]string, result string) (string, error) {
+	var body bytes.Buffer
+	fmt.Fprintf(&body, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%s xmlns:u="%s">`, name, s.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", name)
+
+	req, err := http.NewRequest("POST", s.controlURL, &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.serviceType+"#"+name+`"`)
+
+	resp, err := (&http.Client{Timeout: upnpHTTPTimeout}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("UPnP %s failed with %s", name, resp.Status)
+	}
+	if result == "" {
+		return "", nil
+	}
+
+	// The result is the text of the only element with its name
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", fmt.Errorf("UPnP %s answered without %s", name, result)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == result {
+			var value string
+			if err = decoder.DecodeElement(&value, &start); err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(value), nil
+		}
+	}
+}
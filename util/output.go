@@ -0,0 +1,99 @@
+package util
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Output modes selected with -output on every binary
+const (
+	OutputText  = "text"  // human readable output and logs (default)
+	OutputJSON  = "json"  // results and logs as one JSON object per line
+	OutputQuiet = "quiet" // results and status suppressed, only errors are logged
+)
+
+var outputMode = OutputText
+
+// Registers the -output flag. Call SetOutputMode with its value after flag.Parse.
+func OutputFlag() *string {
+	return flag.String("output", OutputText, "output format: text, json or quiet")
+}
+
+// Registers -version and -features. A binary given -version prints its
+// protocol version (and with -features, its protocol features) and exits.
+func VersionFlags() (*bool, *bool) {
+	return flag.Bool("version", false, "print the protocol version and exit"),
+		flag.Bool("features", false, "with -version, also list the protocol features and the components they involve")
+}
+
+func SetOutputMode(mode string) {
+	switch mode {
+	case OutputText:
+	case OutputJSON:
+		OutLog.SetFlags(log.Lshortfile)
+		OutLog.SetPrefix("")
+		OutLog.SetOutput(jsonLogWriter{level: "info", out: os.Stderr})
+		ErrLog.SetFlags(log.Lshortfile)
+		ErrLog.SetPrefix("")
+		ErrLog.SetOutput(jsonLogWriter{level: "error", out: os.Stderr})
+	case OutputQuiet:
+		OutLog.SetOutput(ioutil.Discard)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output mode %q, expected text, json or quiet\n", mode)
+		os.Exit(1)
+	}
+	outputMode = mode
+}
+
+func OutputMode() string {
+	return outputMode
+}
+
+// Writes the result of a command to stdout: v as a JSON line in json mode,
+// text in text mode and nothing in quiet mode.
+func PrintResult(text string, v interface{}) {
+	switch outputMode {
+	case OutputJSON:
+		data, err := json.Marshal(v)
+		HandleFatalError("Could not marshal output", err)
+		fmt.Println(string(data))
+	case OutputText:
+		fmt.Println(text)
+	}
+}
+
+// Writes human-oriented status text (prompts, banners) in text mode only
+func PrintStatus(format string, args ...interface{}) {
+	if outputMode == OutputText {
+		fmt.Printf(format, args...)
+	}
+}
+
+// Wraps each log line in a JSON object
+type jsonLogWriter struct {
+	level string
+	out   io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	entry := map[string]string{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": w.level,
+		"msg":   strings.TrimSpace(string(p)),
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.out.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
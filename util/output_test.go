@@ -0,0 +1,55 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestJSONLogWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := jsonLogWriter{level: "error", out: &out}
+	if n, err := w.Write([]byte("output.go:1: Could not dial\n")); err != nil || n != len("output.go:1: Could not dial\n") {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+
+	var entry map[string]string
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("%q isn't a JSON line: %v", out.String(), err)
+	}
+	if entry["level"] != "error" || entry["msg"] != "output.go:1: Could not dial" || entry["time"] == "" {
+		t.Fatalf("logged %v", entry)
+	}
+}
+
+// What PrintResult writes to stdout in mode
+func printedResult(t *testing.T, mode string) string {
+	defer func(mode string, stdout *os.File) { outputMode, os.Stdout = mode, stdout }(outputMode, os.Stdout)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputMode, os.Stdout = mode, w
+	PrintResult("2 routers", map[string]int{"routers": 2})
+	w.Close()
+
+	printed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(printed)
+}
+
+func TestPrintResult(t *testing.T) {
+	for mode, want := range map[string]string{
+		OutputText:  "2 routers\n",
+		OutputJSON:  "{\"routers\":2}\n",
+		OutputQuiet: "",
+	} {
+		if printed := printedResult(t, mode); printed != want {
+			t.Errorf("%s mode printed %q, want %q", mode, printed, want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Package padding runs padding machines, after Tor's circuit padding
+// framework: state machines that send dummy cells on a link at delays drawn
+// from a histogram, and react to the real cells sent on it, so an observer of
+// the link can't tell when and how much real traffic it carries.
+package padding
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"../../util"
+)
+
+// Padding machine configurations
+const (
+	maxCellSize int = 65536 // largest padding cell, well under shared.MaxCellData
+	minCellSize int = 16    // an IV, like the shortest real cell
+)
+
+// A padding machine. It starts in its first state.
+type Machine struct {
+	Name   string
+	States []State
+}
+
+// A state of a padding machine. Entering it, and after every cell sent on
+// the link, the delay to the next padding cell is drawn from Bins, or with
+// weight Infinity no padding is sent until the next real cell.
+type State struct {
+	Name     string
+	Bins     []Bin
+	Infinity int // weight of waiting for real traffic instead
+	MinSize  int // bytes of a padding cell, drawn evenly from MinSize to MaxSize
+	MaxSize  int
+	Length   int    // padding cells sent in the state before moving on to Next, 0 for no limit
+	Next     string // state entered after Length padding cells, empty waits for real traffic
+	Traffic  string // state a real cell moves the machine to, empty stays
+}
+
+// Delays from Low to High, drawn with Weight
+type Bin struct {
+	Low    time.Duration
+	High   time.Duration
+	Weight int
+}
+
+// Machines every component knows, by the padding class that names them
+var Builtin = map[string]Machine{
+	// Sends no padding
+	"none": {Name: "none"},
+
+	// Blurs where bursts of real traffic end: a few padding cells follow
+	// each burst, then the link goes quiet until the next
+	"burst": {Name: "burst", States: []State{
+		{Name: "idle", Infinity: 1, Traffic: "burst"},
+		{Name: "burst", Bins: []Bin{
+			{Low: 5 * time.Millisecond, High: 50 * time.Millisecond, Weight: 3},
+			{Low: 50 * time.Millisecond, High: 500 * time.Millisecond, Weight: 1},
+		}, MinSize: 256, MaxSize: 4096, Length: 4, Traffic: "burst"},
+	}},
+
+	// Cover traffic at a low rate whether or not real traffic is flowing
+	"constant": {Name: "constant", States: []State{
+		{Name: "cover", Bins: []Bin{
+			{Low: 200 * time.Millisecond, High: time.Second, Weight: 1},
+		}, MinSize: 256, MaxSize: 1024},
+	}},
+}
+
+// Checks that the machine's states refer to each other and draw delays and
+// sizes that make sense
+func (m Machine) Validate() error {
+	names := make(map[string]bool)
+	for _, state := range m.States {
+		if state.Name == "" || names[state.Name] {
+			return fmt.Errorf("padding machine %s: state names must be unique and not empty", m.Name)
+		}
+		names[state.Name] = true
+	}
+	for _, state := range m.States {
+		if state.Next != "" && !names[state.Next] || state.Traffic != "" && !names[state.Traffic] {
+			return fmt.Errorf("padding machine %s: state %s moves to an unknown state", m.Name, state.Name)
+		}
+		total := state.Infinity
+		for _, bin := range state.Bins {
+			if bin.Low < 0 || bin.High < bin.Low || bin.Weight < 0 {
+				return fmt.Errorf("padding machine %s: state %s has a bin from %v to %v with weight %d", m.Name, state.Name, bin.Low, bin.High, bin.Weight)
+			}
+			total += bin.Weight
+		}
+		if state.Infinity < 0 || total <= 0 {
+			return fmt.Errorf("padding machine %s: state %s has no positive weight", m.Name, state.Name)
+		}
+		if total > state.Infinity && (state.MinSize < minCellSize || state.MaxSize < state.MinSize || state.MaxSize > maxCellSize) {
+			return fmt.Errorf("padding machine %s: state %s pads with cells of %d to %d bytes, not %d to %d", m.Name, state.Name, state.MinSize, state.MaxSize, minCellSize, maxCellSize)
+		}
+		if state.Length < 0 {
+			return fmt.Errorf("padding machine %s: state %s has a negative length", m.Name, state.Name)
+		}
+	}
+	return nil
+}
+
+// The builtin machines, and those in the JSON list of machines at path, which
+// replace builtin ones of the same name. An empty path loads no file.
+func Load(path string) (map[string]Machine, error) {
+	machines := make(map[string]Machine)
+	for name, machine := range Builtin {
+		machines[name] = machine
+	}
+	if path == "" {
+		return machines, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded []Machine
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("padding machines in %s do not decode: %v", path, err)
+	}
+	for _, machine := range loaded {
+		if err := machine.Validate(); err != nil {
+			return nil, err
+		}
+		machines[machine.Name] = machine
+	}
+	return machines, nil
+}
+
+// Names of the machines, sorted
+func Names(machines map[string]Machine) []string {
+	names := make([]string, 0, len(machines))
+	for name := range machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A machine running on one link
+type Link struct {
+	machine Machine
+	send    func(size int) error
+	idle    time.Duration
+
+	traffic  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// Starts running machine on a link, calling send for every padding cell. The
+// link stops when send fails, when Stop is called, or with idle set, once no
+// real cell was sent for that long.
+func Start(machine Machine, idle time.Duration, send func(size int) error) *Link {
+	link := &Link{
+		machine: machine,
+		send:    send,
+		idle:    idle,
+		traffic: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if len(machine.States) == 0 {
+		close(link.stopped)
+		return link
+	}
+	go link.run()
+	return link
+}
+
+// Tells the machine a real cell was sent on the link. Never blocks.
+func (l *Link) Traffic() {
+	select {
+	case l.traffic <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Link) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// Whether the link stopped padding for good
+func (l *Link) Stopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *Link) run() {
+	defer close(l.stopped)
+
+	states := make(map[string]int)
+	for i, state := range l.machine.States {
+		states[state.Name] = i
+	}
+	current, sent, waiting := 0, 0, false
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	var idleTimer *time.Timer
+	var idle <-chan time.Time
+	if l.idle > 0 {
+		idleTimer = time.NewTimer(l.idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		var fire <-chan time.Time
+		if !waiting {
+			if delay, pad := l.machine.States[current].drawDelay(); pad {
+				timer.Reset(delay)
+				fire = timer.C
+			}
+		}
+
+		select {
+		case <-l.stop:
+			return
+		case <-idle:
+			return
+		case <-l.traffic:
+			timer.Stop()
+			if idleTimer != nil {
+				idleTimer.Reset(l.idle)
+			}
+			if next := l.machine.States[current].Traffic; next != "" {
+				current, sent = states[next], 0
+			}
+			waiting = false
+		case <-fire:
+			state := l.machine.States[current]
+			if err := l.send(state.drawSize()); err != nil {
+				return
+			}
+			sent++
+			if state.Length > 0 && sent >= state.Length {
+				sent = 0
+				if state.Next == "" {
+					waiting = true
+				} else {
+					current = states[state.Next]
+				}
+			}
+		}
+	}
+}
+
+// The delay to the next padding cell, or false to wait for real traffic
+func (s State) drawDelay() (time.Duration, bool) {
+	total := s.Infinity
+	for _, bin := range s.Bins {
+		total += bin.Weight
+	}
+	draw := int(util.Random.Float64() * float64(total))
+	for _, bin := range s.Bins {
+		if draw < bin.Weight {
+			return bin.Low + time.Duration(util.Random.Float64()*float64(bin.High-bin.Low)), true
+		}
+		draw -= bin.Weight
+	}
+	return 0, false
+}
+
+func (s State) drawSize() int {
+	return s.MinSize + int(util.Random.Float64()*float64(s.MaxSize-s.MinSize+1))
+}
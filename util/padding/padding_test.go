@@ -0,0 +1,96 @@
+package padding
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Pads with 3 cells after each burst of real traffic, quickly
+var testBurst = Machine{Name: "test", States: []State{
+	{Name: "idle", Infinity: 1, Traffic: "burst"},
+	{Name: "burst", Bins: []Bin{{Low: time.Millisecond, High: 2 * time.Millisecond, Weight: 1}}, MinSize: 16, MaxSize: 32, Length: 3, Traffic: "burst"},
+}}
+
+func TestBuiltinMachinesAreValid(t *testing.T) {
+	for name, machine := range Builtin {
+		if err := machine.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	for _, machine := range []Machine{
+		{Name: "dup", States: []State{{Name: "a", Infinity: 1}, {Name: "a", Infinity: 1}}},
+		{Name: "lost", States: []State{{Name: "a", Infinity: 1, Next: "b"}}},
+		{Name: "weightless", States: []State{{Name: "a"}}},
+		{Name: "backwards", States: []State{{Name: "a", Bins: []Bin{{Low: time.Second, High: 0, Weight: 1}}, MinSize: 16, MaxSize: 16}}},
+		{Name: "huge", States: []State{{Name: "a", Bins: []Bin{{Weight: 1}}, MinSize: 16, MaxSize: maxCellSize + 1}}},
+	} {
+		if machine.Validate() == nil {
+			t.Fatalf("machine %s was valid", machine.Name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "machines.json")
+	if err := os.WriteFile(path, []byte(`[{"Name": "burst", "States": [{"Name": "only", "Infinity": 1}]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	machines, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines["burst"].States) != 1 || len(machines) != len(Builtin) {
+		t.Fatalf("loaded %v", Names(machines))
+	}
+	if err = os.WriteFile(path, []byte(`[{"Name": "bad", "States": [{"Name": "only"}]}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(path); err == nil {
+		t.Fatal("an invalid machine was loaded")
+	}
+}
+
+func TestBurstPadding(t *testing.T) {
+	sizes := make(chan int, 10)
+	link := Start(testBurst, 0, func(size int) error {
+		sizes <- size
+		return nil
+	})
+	defer link.Stop()
+
+	// Nothing until the first real cell
+	time.Sleep(20 * time.Millisecond)
+	if len(sizes) != 0 {
+		t.Fatalf("padded %d cells before any traffic", len(sizes))
+	}
+	link.Traffic()
+	time.Sleep(50 * time.Millisecond)
+	if len(sizes) != 3 {
+		t.Fatalf("padded %d cells after a burst, want 3", len(sizes))
+	}
+	for i := 0; i < 3; i++ {
+		if size := <-sizes; size < 16 || size > 32 {
+			t.Fatalf("padded a cell of %d bytes", size)
+		}
+	}
+}
+
+func TestLinkStops(t *testing.T) {
+	failing := Start(Builtin["constant"], 0, func(int) error { return errors.New("closed") })
+	idle := Start(testBurst, 10*time.Millisecond, func(int) error { return nil })
+	stopped := Start(testBurst, 0, func(int) error { return nil })
+	stopped.Stop()
+	deadline := time.Now().Add(3 * time.Second)
+	for !failing.Stopped() || !idle.Stopped() || !stopped.Stopped() {
+		if time.Now().After(deadline) {
+			t.Fatalf("stopped: failing %v, idle %v, stopped %v", failing.Stopped(), idle.Stopped(), stopped.Stopped())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !Start(Builtin["none"], 0, nil).Stopped() {
+		t.Fatal("a machine without states runs")
+	}
+}
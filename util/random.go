@@ -0,0 +1,100 @@
+package util
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"flag"
+	"hash/fnv"
+	math_rand "math/rand"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Source of all randomness: keys, nonces, IVs and circuit ids read from it as
+// an io.Reader, path selection and jitter use the other methods.
+type RNG interface {
+	Read(p []byte) (int, error)
+	Uint32() uint32
+	Float64() float64 // in [0, 1)
+}
+
+// The RNG every component uses. Only replace it (with SetRandom) in tests and
+// simulations; anything but the default makes keys predictable.
+var Random RNG = cryptoRNG{}
+
+func SetRandom(rng RNG) {
+	Random = rng
+}
+
+// Registers the -deterministic-seed flag. Call SetupDeterministic with its
+// value after flag.Parse.
+func DeterministicFlag() *int64 {
+	seed, _ := strconv.ParseInt(os.Getenv("TORCHAT_SEED"), 10, 64)
+	return flag.Int64("deterministic-seed", seed,
+		"TEST MODE ONLY: seed circuit ids, AES keys, path selection and rotation timers so runs can be reproduced (env TORCHAT_SEED, disabled if 0)")
+}
+
+// Replaces Random with a seeded RNG if seed isn't 0. identity, e.g. the
+// node's address, is mixed into the seed so nodes sharing a seed don't draw
+// the same circuit ids and keys.
+func SetupDeterministic(seed int64, identity string) {
+	if seed == 0 {
+		return
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(identity))
+	SetRandom(NewSeededRNG(seed ^ int64(hash.Sum64())))
+	ErrLog.Printf("[WARNING] Deterministic mode with seed %d: keys are predictable, never use this outside tests\n", seed)
+}
+
+// Backed by crypto/rand
+type cryptoRNG struct{}
+
+func (cryptoRNG) Read(p []byte) (int, error) {
+	return crypto_rand.Read(p)
+}
+
+func (r cryptoRNG) Uint32() uint32 {
+	var buf [4]byte
+	_, err := r.Read(buf[:])
+	HandleFatalError("Could not read random bytes", err)
+	return binary.LittleEndian.Uint32(buf[:])
+}
+
+func (r cryptoRNG) Float64() float64 {
+	var buf [8]byte
+	_, err := r.Read(buf[:])
+	HandleFatalError("Could not read random bytes", err)
+	// 53 random bits, the precision of a float64
+	return float64(binary.LittleEndian.Uint64(buf[:])>>11) / (1 << 53)
+}
+
+// Deterministic and NOT secure: the same seed gives the same sequence, so
+// tests and simulations can reproduce probabilistic behaviour.
+type seededRNG struct {
+	sync.Mutex
+	rand *math_rand.Rand
+}
+
+func NewSeededRNG(seed int64) RNG {
+	return &seededRNG{rand: math_rand.New(math_rand.NewSource(seed))}
+}
+
+func (r *seededRNG) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Read(p)
+}
+
+func (r *seededRNG) Uint32() uint32 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Uint32()
+}
+
+func (r *seededRNG) Float64() float64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.rand.Float64()
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSeededRNGRepeats(t *testing.T) {
+	a, b := NewSeededRNG(42), NewSeededRNG(42)
+	bufA, bufB := make([]byte, 32), make([]byte, 32)
+	a.Read(bufA)
+	b.Read(bufB)
+	if !bytes.Equal(bufA, bufB) || a.Uint32() != b.Uint32() || a.Float64() != b.Float64() {
+		t.Fatal("two RNGs with the same seed differ")
+	}
+	if other := NewSeededRNG(43); other.Uint32() == NewSeededRNG(42).Uint32() {
+		t.Fatal("two seeds gave the same sequence")
+	}
+}
+
+func TestCryptoRNGFloat64(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if f := Random.Float64(); f < 0 || f >= 1 {
+			t.Fatalf("Float64 gave %v", f)
+		}
+	}
+}
+
+func TestSetRandom(t *testing.T) {
+	defer SetRandom(Random)
+	SetRandom(NewSeededRNG(1))
+	first := GenerateAESKey()
+	SetRandom(NewSeededRNG(1))
+	if !bytes.Equal(first, GenerateAESKey()) {
+		t.Fatal("keys didn't come from the replaced RNG")
+	}
+}
+
+func TestSetupDeterministic(t *testing.T) {
+	defer SetRandom(Random)
+	SetupDeterministic(0, "127.0.0.1:8001")
+	if _, ok := Random.(cryptoRNG); !ok {
+		t.Fatal("a seed of 0 replaced the RNG")
+	}
+
+	SetupDeterministic(1, "127.0.0.1:8001")
+	first := GenerateAESKey()
+	SetupDeterministic(1, "127.0.0.1:8002")
+	other := GenerateAESKey()
+	SetupDeterministic(1, "127.0.0.1:8001")
+	if !bytes.Equal(first, GenerateAESKey()) || bytes.Equal(first, other) {
+		t.Fatal("keys don't depend on just the seed and identity")
+	}
+}
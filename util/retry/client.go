@@ -0,0 +1,110 @@
+package retry
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+
+	"../faults"
+)
+
+// An RPC client that redials its server when the connection is lost, so a
+// restarted server doesn't take down long-lived clients.
+type Client struct {
+	sync.Mutex
+	network string
+	address string
+	policy  Policy
+	client  *rpc.Client
+}
+
+// Dials address according to p. The returned client keeps using p to redial.
+func Dial(ctx context.Context, p Policy, network string, address string) (*Client, error) {
+	c := NewClient(p, network, address)
+	err := Do(ctx, p, func() error {
+		_, err := c.connect()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Returns a client that dials address on its first call, according to p
+func NewClient(p Policy, network string, address string) *Client {
+	return &Client{
+		network: network,
+		address: address,
+		policy:  p,
+	}
+}
+
+// The address the client dials
+func (c *Client) Address() string {
+	return c.address
+}
+
+// Returns the current connection, dialing once if there is none
+func (c *Client) connect() (*rpc.Client, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.client != nil {
+		return c.client, nil
+	}
+
+	client, err := faults.DialRPC(c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	c.client = client
+	return client, nil
+}
+
+// Forgets a broken connection so the next call redials
+func (c *Client) disconnect(broken *rpc.Client) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.client == broken {
+		c.client.Close()
+		c.client = nil
+	}
+}
+
+// Calls method, redialing and retrying if the connection is lost. Errors
+// returned by the server itself are not retried.
+func (c *Client) Call(method string, args interface{}, reply interface{}) error {
+	return c.CallContext(context.Background(), method, args, reply)
+}
+
+func (c *Client) CallContext(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	return Do(ctx, c.policy, func() error {
+		client, err := c.connect()
+		if err != nil {
+			return err
+		}
+
+		err = client.Call(method, args, reply)
+		if _, ok := err.(rpc.ServerError); ok {
+			return Permanent(err)
+		}
+		if err != nil {
+			c.disconnect(client)
+		}
+		return err
+	})
+}
+
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
@@ -0,0 +1,123 @@
+// Package retry runs operations with exponential backoff and jitter
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"net/rpc"
+	"time"
+
+	"../faults"
+)
+
+// How an operation is retried. Attempt n (from 0) waits
+// InitialDelay * Multiplier^n, capped at MaxDelay, randomised by +/- Jitter.
+type Policy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	Jitter       float64 // fraction of the delay, 0 to 1
+	MaxAttempts  int     // 0 retries until the context is done
+
+	Rand func() float64 // jitter source in [0, 1), math/rand if nil
+}
+
+var (
+	// Dials and calls made while starting up, where the other side may not be up yet
+	Startup = Policy{
+		InitialDelay: 250 * time.Millisecond,
+		MaxDelay:     5 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxAttempts:  10,
+	}
+
+	// Dials made while serving a request, which someone is waiting on
+	Interactive = Policy{
+		InitialDelay: 50 * time.Millisecond,
+		MaxDelay:     500 * time.Millisecond,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxAttempts:  3,
+	}
+
+	// Background work that should keep trying until it succeeds
+	Background = Policy{
+		InitialDelay: 500 * time.Millisecond,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+)
+
+// Wraps an error that retrying can't fix, such as a rejected request
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Stops Do from retrying err
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// Returns the delay before retry number attempt
+func (p Policy) Delay(attempt int) time.Duration {
+	delay := float64(p.InitialDelay)
+	for i := 0; i < attempt && delay < float64(p.MaxDelay); i++ {
+		delay *= p.Multiplier
+	}
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		random := rand.Float64
+		if p.Rand != nil {
+			random = p.Rand
+		}
+		delay += delay * p.Jitter * (2*random() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Calls op until it succeeds, returns a permanent error, runs out of attempts
+// or ctx is done. Returns op's last error, unwrapped.
+func Do(ctx context.Context, p Policy, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if perm, ok := err.(permanentError); ok {
+			return perm.err
+		}
+		if p.MaxAttempts > 0 && attempt+1 >= p.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Dials an RPC server, retrying according to p
+func DialRPC(ctx context.Context, p Policy, network string, address string) (*rpc.Client, error) {
+	var client *rpc.Client
+	err := Do(ctx, p, func() error {
+		var err error
+		client, err = faults.DialRPC(network, address)
+		return err
+	})
+	return client, err
+}
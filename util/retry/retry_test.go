@@ -0,0 +1,118 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+var quick = Policy{InitialDelay: time.Millisecond, MaxDelay: 4 * time.Millisecond, Multiplier: 2, MaxAttempts: 5}
+
+func TestDelay(t *testing.T) {
+	for attempt, want := range []time.Duration{1, 2, 4, 4, 4} {
+		if delay := quick.Delay(attempt); delay != want*time.Millisecond {
+			t.Fatalf("attempt %d waits %v, want %v", attempt, delay, want*time.Millisecond)
+		}
+	}
+	jittered := quick
+	jittered.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay := jittered.Delay(2); delay < 2*time.Millisecond || delay > 6*time.Millisecond {
+			t.Fatalf("a jittered delay of 4ms was %v", delay)
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	failed := errors.New("failed")
+	attempts := 0
+	if err := Do(context.Background(), quick, func() error { attempts++; return failed }); err != failed || attempts != quick.MaxAttempts {
+		t.Fatalf("gave %v after %d attempts, want %v after %d", err, attempts, failed, quick.MaxAttempts)
+	}
+
+	attempts = 0
+	if err := Do(context.Background(), quick, func() error { attempts++; return Permanent(failed) }); err != failed || attempts != 1 {
+		t.Fatalf("a permanent error gave %v after %d attempts", err, attempts)
+	}
+
+	attempts = 0
+	if err := Do(context.Background(), quick, func() error {
+		if attempts++; attempts < 3 {
+			return failed
+		}
+		return nil
+	}); err != nil || attempts != 3 {
+		t.Fatalf("gave %v after %d attempts, want success after 3", err, attempts)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	forever := quick
+	forever.MaxAttempts = 0
+	if err := Do(ctx, forever, func() error { return failed }); err != failed {
+		t.Fatalf("a cancelled context gave %v", err)
+	}
+}
+
+type echo int
+
+func (e *echo) Echo(message string, reply *string) error {
+	if message == "" {
+		return errors.New("nothing to echo")
+	}
+	*reply = message
+	return nil
+}
+
+func serveEcho(t *testing.T, address string) net.Listener {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Echo", new(echo)); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeConn(conn)
+		}
+	}()
+	return listener
+}
+
+func TestClientRedials(t *testing.T) {
+	listener := serveEcho(t, "127.0.0.1:0")
+	address := listener.Addr().String()
+	client, err := Dial(context.Background(), quick, "tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var reply string
+	if err = client.Call("Echo.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Fatalf("got %q, %v", reply, err)
+	}
+	if err = client.Call("Echo.Echo", "", &reply); err == nil || err.Error() != "nothing to echo" {
+		t.Fatalf("a server error gave %v", err)
+	}
+
+	// Restart the server; the broken connection is dropped and redialed
+	listener.Close()
+	client.Lock()
+	client.client.Close()
+	client.Unlock()
+	listener = serveEcho(t, address)
+	defer listener.Close()
+	if err = client.Call("Echo.Echo", "again", &reply); err != nil || reply != "again" {
+		t.Fatalf("after a restart got %q, %v", reply, err)
+	}
+}
@@ -0,0 +1,61 @@
+// Package secmem wipes key material and plaintext from memory once it is no
+// longer needed. The Go runtime may already have copied a buffer (when a
+// slice grew, or a string was made from it), and expanded AES key schedules
+// can't be reached at all, so this shortens how long secrets sit in memory
+// rather than guaranteeing they are gone.
+package secmem
+
+import (
+	"crypto/rsa"
+	"math/big"
+	"runtime"
+)
+
+// Overwrites b with zeros. Safe on nil and empty slices.
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// Keep the stores from being optimised away as dead
+	runtime.KeepAlive(b)
+}
+
+// Wipes a set of buffers, skipping any that are nil
+func WipeAll(bufs ...[]byte) {
+	for _, b := range bufs {
+		Wipe(b)
+	}
+}
+
+// Overwrites the words of n with zeros and sets it to 0
+func WipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	runtime.KeepAlive(words)
+	n.SetInt64(0)
+}
+
+// Wipes the private exponent, primes and CRT values of key. The key can't be
+// used afterwards; its public half is left as it was.
+func WipeRSAKey(key *rsa.PrivateKey) {
+	if key == nil {
+		return
+	}
+	WipeBigInt(key.D)
+	for _, prime := range key.Primes {
+		WipeBigInt(prime)
+	}
+	WipeBigInt(key.Precomputed.Dp)
+	WipeBigInt(key.Precomputed.Dq)
+	WipeBigInt(key.Precomputed.Qinv)
+	for _, crt := range key.Precomputed.CRTValues {
+		WipeBigInt(crt.Exp)
+		WipeBigInt(crt.Coeff)
+		WipeBigInt(crt.R)
+	}
+}
@@ -0,0 +1,34 @@
+package secmem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	key, plain := []byte("secret key"), []byte("plaintext")
+	WipeAll(key, nil, plain)
+	if !bytes.Equal(key, make([]byte, len(key))) || !bytes.Equal(plain, make([]byte, len(plain))) {
+		t.Fatalf("left %q and %q", key, plain)
+	}
+	Wipe(nil)
+}
+
+func TestWipeRSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modulus := new(big.Int).Set(key.N)
+	WipeRSAKey(key)
+	if key.D.Sign() != 0 || key.Primes[0].Sign() != 0 || key.Precomputed.Dp.Sign() != 0 || key.Precomputed.Qinv.Sign() != 0 {
+		t.Fatal("the private half of the key was kept")
+	}
+	if key.N.Cmp(modulus) != 0 {
+		t.Fatal("the public half of the key was changed")
+	}
+	WipeRSAKey(nil)
+}
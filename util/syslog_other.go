@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package util
+
+import (
+	"errors"
+	"io"
+)
+
+func syslogWriters() (io.Writer, io.Writer, error) {
+	return nil, nil, errors.New("syslog is not available on this platform")
+}
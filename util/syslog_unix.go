@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+
+package util
+
+import (
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+)
+
+// Writers for info and error lines to the local syslog daemon, tagged with
+// the binary's name
+func syslogWriters() (io.Writer, io.Writer, error) {
+	tag := filepath.Base(os.Args[0])
+	out, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	errOut, err := syslog.New(syslog.LOG_ERR|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, errOut, nil
+}
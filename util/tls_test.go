@@ -0,0 +1,29 @@
+package util
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestSelfSignedCertificate(t *testing.T) {
+	cert, err := SelfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "localhost" || time.Until(leaf.NotAfter) < 300*24*time.Hour || leaf.NotBefore.After(time.Now()) {
+		t.Fatalf("the certificate is for %s from %v to %v", leaf.Subject.CommonName, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	other, err := SelfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint := CertificateFingerprint(cert); len(fingerprint) != 64 || fingerprint == CertificateFingerprint(other) {
+		t.Fatalf("the fingerprint is %q", fingerprint)
+	}
+}
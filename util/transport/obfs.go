@@ -0,0 +1,479 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ObfsError error
+
+// The obfs transport makes links look like uniformly random bytes. A client
+// proves it knows the router's bridge secret in a handshake of random nonces,
+// masked X25519 keys, MACs and padding; a prober without the secret gets no
+// answer, and neither does one replaying a client's hello. Both sides then
+// derive keys from the secret, the nonces and their ephemeral keys' shared
+// secret and send AES-GCM frames with masked lengths and random padding, so
+// neither content nor lengths of the protocol inside show.
+//
+// Addresses are ip:port#secret, with the secret as 64 hex digits. A router
+// listening without a secret makes one; its listener's Advertise gives the
+// address to publish or share out of band.
+const (
+	Obfs = "obfs"
+
+	obfsSecretSize    int = 32
+	obfsNonceSize     int = 32
+	obfsKeySize       int = 32
+	obfsMACSize       int = 16
+	obfsMaxFrameData  int = 16 * 1024
+	obfsMaxFramePad   int = 64
+	obfsLengthSize    int = 2
+	obfsHandshakeWait     = 10 * time.Second
+
+	// Client hellos are MACed with the time in obfsEpoch steps, and only
+	// accepted within obfsMaxEpochSkew steps of the router's clock
+	obfsEpoch        time.Duration = time.Minute
+	obfsMaxEpochSkew int           = 1
+	obfsReplayWindow time.Duration = time.Duration(2*obfsMaxEpochSkew+1) * obfsEpoch
+)
+
+var (
+	// Obfs Errors
+	obfsSecretError    ObfsError = errors.New("obfs address needs a #secret of 64 hex digits")
+	obfsHandshakeError ObfsError = errors.New("obfs handshake failed")
+	obfsFrameError     ObfsError = errors.New("obfs frame failed to authenticate")
+)
+
+func init() {
+	Register(Obfs, obfsTransport{})
+}
+
+// Listeners that can tell clients how to reach them, for transports whose
+// addresses carry more than ip:port
+type Advertiser interface {
+	Advertise() string
+}
+
+// Splits an obfs address into ip:port and its secret, nil if it has none
+func splitObfsAddress(address string) (string, []byte, error) {
+	i := strings.LastIndex(address, "#")
+	if i < 0 {
+		return address, nil, nil
+	}
+	secret, err := hex.DecodeString(address[i+1:])
+	if err != nil || len(secret) != obfsSecretSize {
+		return "", nil, obfsSecretError
+	}
+	return address[:i], secret, nil
+}
+
+type obfsTransport struct{}
+
+func (obfsTransport) Listen(address string) (net.Listener, error) {
+	hostPort, secret, err := splitObfsAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		secret = make([]byte, obfsSecretSize)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	inbound, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return &obfsListener{Listener: inbound, hostPort: hostPort, secret: secret, replays: newObfsReplayFilter()}, nil
+}
+
+func (obfsTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	hostPort, secret, err := splitObfsAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, obfsSecretError
+	}
+	conn, err := (&net.Dialer{Timeout: timeout}).Dial("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &obfsConn{Conn: conn, secret: secret}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err = c.clientHandshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+type obfsListener struct {
+	net.Listener
+	hostPort string
+	secret   []byte
+	replays  *obfsReplayFilter
+}
+
+// Accepts without the handshake, which runs on first use so a slow client
+// can't hold up others
+func (l *obfsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &obfsConn{Conn: conn, secret: l.secret, server: true, replays: l.replays}, nil
+}
+
+func (l *obfsListener) Advertise() string {
+	return l.hostPort + "#" + hex.EncodeToString(l.secret)
+}
+
+type obfsConn struct {
+	net.Conn
+	secret  []byte
+	server  bool
+	replays *obfsReplayFilter // of the listener, on the server side
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+
+	readMutex  sync.Mutex
+	readAEAD   cipher.AEAD
+	readMask   cipher.Stream // masks frame lengths
+	readCount  uint64
+	readBuffer []byte // opened data not returned by Read yet
+
+	writeMutex sync.Mutex
+	writeAEAD  cipher.AEAD
+	writeMask  cipher.Stream
+	writeCount uint64
+}
+
+func (c *obfsConn) mac(label string, parts ...[]byte) []byte {
+	m := hmac.New(sha256.New, c.secret)
+	m.Write([]byte(label))
+	for _, part := range parts {
+		m.Write(part)
+	}
+	return m.Sum(nil)
+}
+
+// Bytes of padding after a handshake message, decided by the secret and the
+// message's nonce so the other side knows how much to skip
+func (c *obfsConn) padLength(label string, nonce []byte) int {
+	return int(c.mac(label, nonce)[0])
+}
+
+// X25519 public keys aren't uniformly random, so they are sent XORed with a
+// mask only holders of the secret can make. Masking and unmasking are the same.
+func (c *obfsConn) maskKey(label string, nonce []byte, key []byte) []byte {
+	mask := c.mac(label, nonce)
+	masked := make([]byte, obfsKeySize)
+	for i := range masked {
+		masked[i] = key[i] ^ mask[i]
+	}
+	return masked
+}
+
+// The coarse time a client MACs its hello with
+func obfsEpochOf(t time.Time) []byte {
+	epoch := make([]byte, 8)
+	binary.BigEndian.PutUint64(epoch, uint64(t.Unix())/uint64(obfsEpoch/time.Second))
+	return epoch
+}
+
+func (c *obfsConn) writeHandshake(nonce []byte, maskedKey []byte, mac []byte, padLength int) error {
+	msg := make([]byte, 0, obfsNonceSize+obfsKeySize+obfsMACSize+padLength)
+	msg = append(msg, nonce...)
+	msg = append(msg, maskedKey...)
+	msg = append(msg, mac[:obfsMACSize]...)
+	pad := make([]byte, padLength)
+	if _, err := rand.Read(pad); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(append(msg, pad...))
+	return err
+}
+
+// Reads a handshake message, and returns its nonce and masked key if valid
+// accepts its MAC
+func (c *obfsConn) readHandshake(label string, valid func(nonce []byte, maskedKey []byte, mac []byte) bool) ([]byte, []byte, error) {
+	msg := make([]byte, obfsNonceSize+obfsKeySize+obfsMACSize)
+	if _, err := io.ReadFull(c.Conn, msg); err != nil {
+		return nil, nil, err
+	}
+	nonce := msg[:obfsNonceSize]
+	maskedKey := msg[obfsNonceSize : obfsNonceSize+obfsKeySize]
+	if !valid(nonce, maskedKey, msg[obfsNonceSize+obfsKeySize:]) {
+		return nil, nil, obfsHandshakeError
+	}
+	if _, err := io.CopyN(io.Discard, c.Conn, int64(c.padLength(label, nonce))); err != nil {
+		return nil, nil, err
+	}
+	return nonce, maskedKey, nil
+}
+
+func newObfsHandshakeKeys() ([]byte, *ecdh.PrivateKey, error) {
+	nonce := make([]byte, obfsNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, private, nil
+}
+
+// The secret both sides get from their ephemeral keys
+func sharedObfsKey(private *ecdh.PrivateKey, peerKey []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, obfsHandshakeError
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, obfsHandshakeError
+	}
+	return shared, nil
+}
+
+func (c *obfsConn) clientHandshake() error {
+	clientNonce, private, err := newObfsHandshakeKeys()
+	if err != nil {
+		return err
+	}
+	clientKey := c.maskKey("client-key", clientNonce, private.PublicKey().Bytes())
+	mac := c.mac("client", obfsEpochOf(time.Now()), clientNonce, clientKey)
+	if err = c.writeHandshake(clientNonce, clientKey, mac, c.padLength("client-pad", clientNonce)); err != nil {
+		return err
+	}
+	serverNonce, serverKey, err := c.readHandshake("server-pad", func(nonce []byte, maskedKey []byte, mac []byte) bool {
+		return hmac.Equal(mac, c.mac("server", clientNonce, clientKey, nonce, maskedKey)[:obfsMACSize])
+	})
+	if err != nil {
+		return err
+	}
+	shared, err := sharedObfsKey(private, c.maskKey("server-key", serverNonce, serverKey))
+	if err != nil {
+		return err
+	}
+	return c.deriveKeys(clientNonce, serverNonce, shared)
+}
+
+// Waits for a client that knows the secret, with a hello MACed within
+// obfsMaxEpochSkew of now that wasn't seen before. Anyone else, replays of
+// a real client's hello included, is left hanging until the wait passes,
+// like a server that never speaks first.
+func (c *obfsConn) serverHandshake() error {
+	c.Conn.SetDeadline(time.Now().Add(obfsHandshakeWait))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	clientNonce, clientKey, err := c.readHandshake("client-pad", func(nonce []byte, maskedKey []byte, mac []byte) bool {
+		now := time.Now()
+		for skew := -obfsMaxEpochSkew; skew <= obfsMaxEpochSkew; skew++ {
+			epoch := obfsEpochOf(now.Add(time.Duration(skew) * obfsEpoch))
+			if hmac.Equal(mac, c.mac("client", epoch, nonce, maskedKey)[:obfsMACSize]) {
+				return !c.replays.seen(nonce, now)
+			}
+		}
+		return false
+	})
+	if err != nil {
+		io.Copy(io.Discard, c.Conn)
+		return obfsHandshakeError
+	}
+
+	serverNonce, private, err := newObfsHandshakeKeys()
+	if err != nil {
+		return err
+	}
+	shared, err := sharedObfsKey(private, c.maskKey("client-key", clientNonce, clientKey))
+	if err != nil {
+		return err
+	}
+	serverKey := c.maskKey("server-key", serverNonce, private.PublicKey().Bytes())
+	mac := c.mac("server", clientNonce, clientKey, serverNonce, serverKey)
+	if err = c.writeHandshake(serverNonce, serverKey, mac, c.padLength("server-pad", serverNonce)); err != nil {
+		return err
+	}
+	return c.deriveKeys(clientNonce, serverNonce, shared)
+}
+
+func (c *obfsConn) handshake() error {
+	if c.server {
+		c.handshakeOnce.Do(func() { c.handshakeErr = c.serverHandshake() })
+	}
+	return c.handshakeErr
+}
+
+// Frame keys depend on the ephemeral keys' shared secret as well as the
+// bridge secret, so recorded links stay closed to whoever learns the bridge
+// secret later
+func (c *obfsConn) deriveKeys(clientNonce []byte, serverNonce []byte, shared []byte) error {
+	keys := func(direction string) (cipher.AEAD, cipher.Stream, error) {
+		block, err := aes.NewCipher(c.mac(direction, clientNonce, serverNonce, shared))
+		if err != nil {
+			return nil, nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, nil, err
+		}
+		maskBlock, err := aes.NewCipher(c.mac(direction+"-length", clientNonce, serverNonce, shared))
+		if err != nil {
+			return nil, nil, err
+		}
+		return aead, cipher.NewCTR(maskBlock, make([]byte, aes.BlockSize)), nil
+	}
+
+	send, receive := "client-to-server", "server-to-client"
+	if c.server {
+		send, receive = receive, send
+	}
+	var err error
+	if c.writeAEAD, c.writeMask, err = keys(send); err != nil {
+		return err
+	}
+	c.readAEAD, c.readMask, err = keys(receive)
+	return err
+}
+
+// Nonces of the client hellos a listener accepted, kept while a replay of
+// them would still be in time
+type obfsReplayFilter struct {
+	sync.Mutex
+	expires map[string]time.Time
+}
+
+func newObfsReplayFilter() *obfsReplayFilter {
+	return &obfsReplayFilter{expires: make(map[string]time.Time)}
+}
+
+// Whether nonce was seen before; if not it is added
+func (f *obfsReplayFilter) seen(nonce []byte, now time.Time) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	for seen, expires := range f.expires {
+		if now.After(expires) {
+			delete(f.expires, seen)
+		}
+	}
+	if _, ok := f.expires[string(nonce)]; ok {
+		return true
+	}
+	f.expires[string(nonce)] = now.Add(obfsReplayWindow)
+	return false
+}
+
+func frameNonce(count uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], count)
+	return nonce
+}
+
+func (c *obfsConn) Write(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > obfsMaxFrameData {
+			chunk = chunk[:obfsMaxFrameData]
+		}
+		if err := c.writeFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Sends data as one frame: masked length, then sealed data length, data and
+// padding. Caller must hold the writeMutex.
+func (c *obfsConn) writeFrame(data []byte) error {
+	padLength, err := rand.Int(rand.Reader, big.NewInt(int64(obfsMaxFramePad)))
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, obfsLengthSize, obfsLengthSize+len(data)+int(padLength.Int64()))
+	binary.BigEndian.PutUint16(plain, uint16(len(data)))
+	plain = append(plain, data...)
+	plain = plain[:cap(plain)] // padding bytes are zero, and encrypted
+
+	sealed := c.writeAEAD.Seal(nil, frameNonce(c.writeCount), plain, nil)
+	c.writeCount++
+
+	frame := make([]byte, obfsLengthSize, obfsLengthSize+len(sealed))
+	binary.BigEndian.PutUint16(frame, uint16(len(sealed)))
+	c.writeMask.XORKeyStream(frame, frame)
+	_, err = c.Conn.Write(append(frame, sealed...))
+	return err
+}
+
+func (c *obfsConn) Read(p []byte) (int, error) {
+	if err := c.handshake(); err != nil {
+		return 0, err
+	}
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for len(c.readBuffer) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.readBuffer)
+	c.readBuffer = c.readBuffer[n:]
+	return n, nil
+}
+
+// Caller must hold the readMutex.
+func (c *obfsConn) readFrame() error {
+	length := make([]byte, obfsLengthSize)
+	if _, err := io.ReadFull(c.Conn, length); err != nil {
+		return err
+	}
+	c.readMask.XORKeyStream(length, length)
+
+	sealed := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+		return err
+	}
+	plain, err := c.readAEAD.Open(sealed[:0], frameNonce(c.readCount), sealed, nil)
+	if err != nil || len(plain) < obfsLengthSize {
+		return obfsFrameError
+	}
+	c.readCount++
+
+	dataLength := int(binary.BigEndian.Uint16(plain))
+	if dataLength > len(plain)-obfsLengthSize {
+		return obfsFrameError
+	}
+	c.readBuffer = plain[obfsLengthSize : obfsLengthSize+dataLength]
+	return nil
+}
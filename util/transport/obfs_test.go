@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testObfsListener(t *testing.T) (*obfsListener, string) {
+	l, err := obfsTransport{}.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	listener := l.(*obfsListener)
+	return listener, l.Addr().String() + "#" + hex.EncodeToString(listener.secret)
+}
+
+// A client hello under secret, MACed with the epoch of now
+func testObfsHello(t *testing.T, secret []byte, now time.Time) []byte {
+	c := &obfsConn{secret: secret}
+	nonce := make([]byte, obfsNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := c.maskKey("client-key", nonce, private.PublicKey().Bytes())
+	hello := append(append([]byte(nil), nonce...), key...)
+	hello = append(hello, c.mac("client", obfsEpochOf(now), nonce, key)[:obfsMACSize]...)
+	return append(hello, make([]byte, c.padLength("client-pad", nonce))...)
+}
+
+// Sends hello to the listener, and returns what the router answered and
+// how its handshake ended
+func sendObfsHello(t *testing.T, l *obfsListener, hello []byte) ([]byte, error) {
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+
+	err = conn.(*obfsConn).handshake()
+	conn.Close()
+	reply, readErr := io.ReadAll(client)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return reply, err
+}
+
+func TestSplitObfsAddress(t *testing.T) {
+	secret := strings.Repeat("ab", obfsSecretSize)
+	if hostPort, key, err := splitObfsAddress("127.0.0.1:9001#" + secret); err != nil || hostPort != "127.0.0.1:9001" || len(key) != obfsSecretSize {
+		t.Fatalf("split into %q, %x, %v", hostPort, key, err)
+	}
+	if hostPort, key, err := splitObfsAddress("127.0.0.1:9001"); err != nil || hostPort != "127.0.0.1:9001" || key != nil {
+		t.Fatalf("an address without a secret split into %q, %x, %v", hostPort, key, err)
+	}
+	for _, address := range []string{"127.0.0.1:9001#abcd", "127.0.0.1:9001#" + strings.Repeat("zz", obfsSecretSize)} {
+		if _, _, err := splitObfsAddress(address); err != obfsSecretError {
+			t.Fatalf("%s gave %v, want %v", address, err, obfsSecretError)
+		}
+	}
+	if _, err := (obfsTransport{}).Dial("127.0.0.1:9001", time.Second); err != obfsSecretError {
+		t.Fatalf("dialing without a secret gave %v, want %v", err, obfsSecretError)
+	}
+}
+
+func TestObfsRoundTrip(t *testing.T) {
+	l, address := testObfsListener(t)
+	message := make([]byte, 3*obfsMaxFrameData+1)
+	rand.Read(message)
+
+	echoed := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			received := make([]byte, len(message))
+			if _, err = io.ReadFull(conn, received); err == nil {
+				_, err = conn.Write(received)
+			}
+		}
+		echoed <- err
+	}()
+
+	conn, err := obfsTransport{}.Dial(address, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(message))
+	if _, err = io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-echoed; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, message) {
+		t.Fatal("the message came back changed")
+	}
+}
+
+func TestObfsHandshakeRejections(t *testing.T) {
+	l, _ := testObfsListener(t)
+	now := time.Now()
+
+	reply, err := sendObfsHello(t, l, testObfsHello(t, l.secret, now.Add(-obfsEpoch)))
+	if err != nil || len(reply) < obfsNonceSize+obfsKeySize+obfsMACSize {
+		t.Fatalf("a hello within the epoch skew got %d bytes and %v", len(reply), err)
+	}
+
+	otherSecret := make([]byte, obfsSecretSize)
+	rand.Read(otherSecret)
+	hello := testObfsHello(t, l.secret, now)
+	for name, rejected := range map[string][]byte{
+		"under another secret": testObfsHello(t, otherSecret, now),
+		"from a stale epoch":   testObfsHello(t, l.secret, now.Add(-time.Duration(obfsMaxEpochSkew+2)*obfsEpoch)),
+		"from a future epoch":  testObfsHello(t, l.secret, now.Add(time.Duration(obfsMaxEpochSkew+2)*obfsEpoch)),
+		"truncated":            hello[:obfsNonceSize+obfsKeySize],
+	} {
+		if reply, err := sendObfsHello(t, l, rejected); err != obfsHandshakeError || len(reply) != 0 {
+			t.Errorf("a hello %s got %d bytes and %v", name, len(reply), err)
+		}
+	}
+
+	if _, err = sendObfsHello(t, l, hello); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := sendObfsHello(t, l, hello); err != obfsHandshakeError || len(reply) != 0 {
+		t.Fatalf("a replayed hello got %d bytes and %v", len(reply), err)
+	}
+}
+
+func TestObfsReplayFilterExpiry(t *testing.T) {
+	f := newObfsReplayFilter()
+	now := time.Now()
+	nonce := []byte("a client's nonce")
+	if f.seen(nonce, now) {
+		t.Fatal("a new nonce was seen")
+	}
+	if !f.seen(nonce, now.Add(obfsReplayWindow)) {
+		t.Fatal("a nonce wasn't seen again within the replay window")
+	}
+	if f.seen(nonce, now.Add(obfsReplayWindow+time.Second)) {
+		t.Fatal("a nonce was still seen after the replay window")
+	}
+	if len(f.expires) != 1 {
+		t.Fatalf("the filter kept %d nonces, want 1", len(f.expires))
+	}
+}
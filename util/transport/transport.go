@@ -0,0 +1,94 @@
+// Package transport carries links between nodes. Every binary has tcp;
+// other transports register themselves under a name that onion routers
+// advertise in the directory next to the address they listen on.
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+type UnknownTransportError error
+
+const TCP = "tcp"
+
+// One way of carrying links
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string, timeout time.Duration) (net.Conn, error) // no timeout if 0
+}
+
+var (
+	mutex      sync.RWMutex
+	transports = map[string]Transport{TCP: tcpTransport{}}
+)
+
+// Makes a transport available under name, replacing any registered before
+func Register(name string, t Transport) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	transports[name] = t
+}
+
+func Lookup(name string) (Transport, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	t, ok := transports[name]
+	if !ok {
+		var err UnknownTransportError = fmt.Errorf("Transport %q is not available in this build, it has %v", name, namesLocked())
+		return nil, err
+	}
+	return t, nil
+}
+
+// Names of the registered transports, sorted
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return namesLocked()
+}
+
+// Caller must hold the mutex.
+func namesLocked() []string {
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func Listen(name string, address string) (net.Listener, error) {
+	t, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.Listen(address)
+}
+
+func Dial(name string, address string, timeout time.Duration) (net.Conn, error) {
+	t, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.Dial(address, timeout)
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (tcpTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return net.Dial("tcp", address)
+}
@@ -0,0 +1,58 @@
+package transport
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Dials tcp, so a registered name can be told apart from tcp by its name only
+type testTransport struct {
+	dials int
+}
+
+func (t *testTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (t *testTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	t.dials++
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func TestRegistry(t *testing.T) {
+	if _, err := Lookup("quic"); err == nil {
+		t.Fatal("quic is available")
+	}
+	test := &testTransport{}
+	Register("test", test)
+	defer func() {
+		mutex.Lock()
+		delete(transports, "test")
+		mutex.Unlock()
+	}()
+	names := Names()
+	if i := sort.SearchStrings(names, "test"); !sort.StringsAreSorted(names) || i == len(names) || names[i] != "test" {
+		t.Fatalf("the transports are %v", names)
+	}
+
+	listener, err := Listen("test", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := Dial("test", listener.Addr().String(), time.Second)
+	if err != nil || test.dials != 1 {
+		t.Fatalf("dialing gave %v after %d dials", err, test.dials)
+	}
+	conn.Close()
+	if _, err = Dial("quic", listener.Addr().String(), 0); err == nil {
+		t.Fatal("dialed over quic")
+	}
+}
@@ -0,0 +1,380 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"../../util"
+)
+
+type WebSocketError error
+
+// WebSocket transports, so links look like a web page opening a socket.
+// wss serves a certificate from TORCHAT_WSS_CERT and TORCHAT_WSS_KEY, or a
+// self-signed one made at startup. Clients don't check it: the onion keys
+// already authenticate every router.
+const (
+	WebSocket       = "ws"
+	SecureWebSocket = "wss"
+
+	webSocketPath = "/ws"
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // from RFC 6455
+
+	wsOpContinuation byte = 0x0
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xA
+
+	wsMaxControlPayload int    = 125
+	wsMaxFramePayload   uint64 = 1 << 24
+)
+
+var (
+	// WebSocket Errors
+	handshakeError     WebSocketError = errors.New("WebSocket handshake failed")
+	frameTooLargeError WebSocketError = errors.New("WebSocket frame too large")
+	listenerClosed     WebSocketError = errors.New("WebSocket listener closed")
+)
+
+func init() {
+	Register(WebSocket, webSocketTransport{secure: false})
+	Register(SecureWebSocket, webSocketTransport{secure: true})
+}
+
+type webSocketTransport struct {
+	secure bool
+}
+
+func (t webSocketTransport) Listen(address string) (net.Listener, error) {
+	inbound, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if t.secure {
+		cert, err := serverCertificate()
+		if err != nil {
+			inbound.Close()
+			return nil, err
+		}
+		inbound = tls.NewListener(inbound, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	l := &webSocketListener{
+		inbound: inbound,
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(webSocketPath, l.upgrade)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go l.server.Serve(inbound)
+	return l, nil
+}
+
+func (t webSocketTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if t.secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	key := make([]byte, 16)
+	if _, err = rand.Read(key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	req, err := http.NewRequest("GET", "http://"+address+webSocketPath, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", encodedKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(encodedKey) {
+		conn.Close()
+		return nil, handshakeError
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &webSocketConn{Conn: conn, reader: reader, client: true}, nil
+}
+
+func acceptKey(key string) string {
+	digest := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// Hands upgraded connections from the HTTP server to Accept
+type webSocketListener struct {
+	inbound   net.Listener
+	server    *http.Server
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *webSocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{}) // left over from reading the request
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- &webSocketConn{Conn: conn, reader: rw.Reader}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, listenerClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.server.Close()
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.inbound.Addr()
+}
+
+// A stream over binary WebSocket frames. Every Write is one frame; clients
+// mask theirs, as RFC 6455 requires.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+	client bool
+
+	readMutex sync.Mutex
+	remaining uint64 // payload bytes left in the frame being read
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+
+	writeMutex sync.Mutex
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos%4]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// Reads frame headers until a data frame starts, answering control frames.
+// Caller must hold the readMutex.
+func (c *webSocketConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxFramePayload {
+		return frameTooLargeError
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	if opcode >= wsOpClose {
+		if length > uint64(wsMaxControlPayload) {
+			return frameTooLargeError
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			if masked {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case wsOpPing:
+			return c.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return io.EOF
+		}
+		return nil
+	}
+
+	c.remaining = length
+	c.mask = mask
+	c.masked = masked
+	c.maskPos = 0
+	return nil
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode) // FIN, unfragmented
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+func (c *webSocketConn) Close() error {
+	c.writeFrame(wsOpClose, nil)
+	return c.Conn.Close()
+}
+
+var (
+	certOnce sync.Once
+	cert     tls.Certificate
+	certErr  error
+)
+
+// The wss certificate, loaded or made once per process
+func serverCertificate() (tls.Certificate, error) {
+	certOnce.Do(func() {
+		certFile, keyFile := os.Getenv("TORCHAT_WSS_CERT"), os.Getenv("TORCHAT_WSS_KEY")
+		if certFile != "" || keyFile != "" {
+			cert, certErr = tls.LoadX509KeyPair(certFile, keyFile)
+			return
+		}
+		cert, certErr = util.SelfSignedCertificate()
+	})
+	return cert, certErr
+}
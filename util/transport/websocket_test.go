@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Sends data from a dialed connection to an accepted one and back
+func echoOver(t *testing.T, name string, data []byte) {
+	listener, err := Listen(name, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := Dial(name, listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write(data)
+	echoed := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = io.ReadFull(conn, echoed); err != nil || !bytes.Equal(echoed, data) {
+		t.Fatalf("%s echoed %d bytes, %v", name, len(echoed), err)
+	}
+}
+
+func TestWebSocketTransports(t *testing.T) {
+	// One frame of each length encoding
+	for _, size := range []int{5, 1000, 70000} {
+		echoOver(t, WebSocket, bytes.Repeat([]byte{0x5a}, size))
+	}
+	echoOver(t, SecureWebSocket, []byte("over tls"))
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &webSocketConn{Conn: server, reader: bufio.NewReader(server)}
+	go func() {
+		// A masked ping, then a data frame
+		client.Write([]byte{0x80 | wsOpPing, 0x80 | 2, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2})
+		client.Write([]byte{0x80 | wsOpBinary, 3, 'a', 'b', 'c'})
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		frame := make([]byte, 4)
+		io.ReadFull(client, frame)
+		pong <- frame
+	}()
+
+	data := make([]byte, 3)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "abc" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if frame := <-pong; !bytes.Equal(frame, []byte{0x80 | wsOpPong, 2, 'h', 'i'}) {
+		t.Fatalf("the ping was answered with %x", frame)
+	}
+}
+
+func TestWebSocketFrameLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &webSocketConn{Conn: server, reader: bufio.NewReader(server)}
+	go client.Write([]byte{0x80 | wsOpBinary, 127, 0, 0, 0, 0, 0x10, 0, 0, 0})
+	if _, err := conn.Read(make([]byte, 10)); err != frameTooLargeError {
+		t.Fatalf("a 256MiB frame gave %v, want %v", err, frameTooLargeError)
+	}
+}
+
+func TestWebSocketUpgradeIsChecked(t *testing.T) {
+	listener, err := Listen(WebSocket, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	for path, want := range map[string]int{"/ws": http.StatusBadRequest, "/": http.StatusNotFound} {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("GET %s gave %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}